@@ -21,8 +21,11 @@ Package cloud provides functions to interact with cloud providers, used to
 create cloud resources so that you can spawn servers, then delete those
 resources when you're done.
 
-Currently implemented providers are OpenStack, with AWS planned for the future.
-The implementation of each supported provider is in its own .go file.
+Currently implemented providers are OpenStack, with AWS planned for the future,
+and Terraform, which drives a Terraform module you supply to create and destroy
+servers in any cloud Terraform supports (see terraform.go for the variables and
+outputs your module must have). The implementation of each supported provider
+is in its own .go file.
 
 It's a pseudo plug-in system in that it is designed so that you can easily add a
 go file that implements the methods of the provideri interface, to support a
@@ -128,6 +131,10 @@ var defaultDNSNameServers = [...]string{"8.8.4.4", "8.8.8.8"}
 const defaultGateWayIP = "192.168.0.1"
 const defaultCIDR = "192.168.0.0/18"
 
+// scratchMountDir is the directory on servers that Server.MountScratch()
+// mounts volumes within.
+const scratchMountDir = "/mnt"
+
 // touchStampFormat is the time format expected by `touch -t`.
 const touchStampFormat = "200601021504.05"
 
@@ -135,6 +142,7 @@ const touchStampFormat = "200601021504.05"
 var hostNameRegex = regexp.MustCompile(`[^a-z0-9\-]+`)
 
 const openstackName = "openstack"
+const terraformName = "terraform"
 
 // Error records an error and the operation and provider caused it.
 type Error struct {
@@ -198,6 +206,16 @@ type provideri interface {
 	destroyServer(serverID string) error
 	// achieve the aims of TearDown()
 	tearDown(resources *Resources) error
+	// create a new, empty volume of the given size, returning its id once it
+	// is ready to be attached
+	createVolume(name string, sizeGB int) (volumeID string, err error)
+	// attach a volume to a server, returning the device path it was given
+	// once attached
+	attachVolume(serverID, volumeID string) (device string, err error)
+	// detach a volume from a server, returning once it is detached
+	detachVolume(serverID, volumeID string) error
+	// delete a volume that is not attached to anything
+	destroyVolume(volumeID string) error
 }
 
 // Provider gives you access to all of the methods you'll need to interact with
@@ -236,6 +254,8 @@ func RequiredEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case terraformName:
+		p = &Provider{impl: new(terraformp)}
 	default:
 		return nil, Error{providerName, "RequiredEnv", ErrBadProvider}
 	}
@@ -250,6 +270,8 @@ func MaybeEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case terraformName:
+		p = &Provider{impl: new(terraformp)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -263,6 +285,8 @@ func AllEnv(providerName string) ([]string, error) {
 	switch providerName {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case terraformName:
+		p = &Provider{impl: new(terraformp)}
 	default:
 		return nil, Error{providerName, "MaybeEnv", ErrBadProvider}
 	}
@@ -274,7 +298,7 @@ func AllEnv(providerName string) ([]string, error) {
 }
 
 // New creates a new Provider to interact with the given cloud provider.
-// Possible names so far are "openstack" ("aws" is planned). You must provide a
+// Possible names so far are "openstack" and "terraform" ("aws" is planned). You must provide a
 // resource name that will be used to name any created cloud resources. You must
 // also provide a file path prefix to save details of created resources to (the
 // actual file created will be suffixed with your resourceName).
@@ -290,6 +314,8 @@ func New(name string, resourceName string, savePath string, logger ...log15.Logg
 	switch name {
 	case openstackName:
 		p = &Provider{impl: new(openstackp)}
+	case terraformName:
+		p = &Provider{impl: new(terraformp)}
 	default:
 		return nil, Error{name, "New", ErrBadProvider}
 	}
@@ -48,6 +48,126 @@ func TestUtility(t *testing.T) {
 	})
 }
 
+func TestTerraform(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wr_testing_terraform")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// a fake terraform that "creates" a server by writing a state file
+	module := filepath.Join(tmpdir, "module")
+	err = os.MkdirAll(module, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(module, "flavors.json"), []byte(`[{"id":"m1","name":"small","cores":1,"ram":2048,"disk":20},{"id":"m2","name":"large","cores":4,"ram":8192,"disk":40},{"id":"bad","cores":1,"ram":1}]`), 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fakeTF := filepath.Join(tmpdir, "terraform")
+	err = ioutil.WriteFile(fakeTF, []byte(`#!/bin/bash
+case $1 in
+init) [ -f main.tf.json ] || exit 1 ;;
+apply) grep -q '"flavor": "bad"' main.tf.json && { echo "bad flavor" >&2; exit 1; }; echo "fake-$(basename $PWD)" > terraform.tfstate ;;
+output) echo "{\"id\":{\"value\":\"$(cat terraform.tfstate)\"},\"ip\":{\"value\":\"127.0.0.1\"}}" ;;
+plan) [ -f terraform.tfstate ] || exit 2 ;;
+destroy) rm -f terraform.tfstate ;;
+esac
+`), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stateDir := filepath.Join(tmpdir, "state")
+	resourceName := "wr-testing-tf"
+	crfileprefix := filepath.Join(tmpdir, "resources")
+
+	origModule := os.Getenv("WR_TERRAFORM_MODULE")
+	origBin := os.Getenv("WR_TERRAFORM_BIN")
+	origState := os.Getenv("WR_TERRAFORM_STATE_DIR")
+	defer func() {
+		os.Setenv("WR_TERRAFORM_MODULE", origModule)
+		os.Setenv("WR_TERRAFORM_BIN", origBin)
+		os.Setenv("WR_TERRAFORM_STATE_DIR", origState)
+	}()
+
+	Convey("The terraform provider needs WR_TERRAFORM_MODULE", t, func() {
+		vars, err := RequiredEnv("terraform")
+		So(err, ShouldBeNil)
+		So(vars, ShouldResemble, []string{"WR_TERRAFORM_MODULE"})
+
+		os.Unsetenv("WR_TERRAFORM_MODULE")
+		_, err = New("terraform", resourceName, crfileprefix)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, ErrMissingEnv)
+	})
+
+	Convey("You can get a new terraform Provider", t, func() {
+		os.Setenv("WR_TERRAFORM_MODULE", module)
+		os.Setenv("WR_TERRAFORM_BIN", fakeTF)
+		os.Setenv("WR_TERRAFORM_STATE_DIR", stateDir)
+		p, err := New("terraform", resourceName, crfileprefix, testLogger)
+		So(err, ShouldBeNil)
+		So(p, ShouldNotBeNil)
+
+		Convey("Its flavors come from the module's flavors.json", func() {
+			flavor, err := p.CheapestServerFlavor(2, 4096, "")
+			So(err, ShouldBeNil)
+			So(flavor.ID, ShouldEqual, "m2")
+			So(flavor.Name, ShouldEqual, "large")
+
+			quota, err := p.GetQuota()
+			So(err, ShouldBeNil)
+			So(quota.MaxInstances, ShouldEqual, 0)
+		})
+
+		Convey("You can deploy, spawn, check and destroy servers, and tear down", func() {
+			err := p.Deploy(&DeployConfig{RequiredPorts: []int{22}})
+			So(err, ShouldBeNil)
+			So(p.PrivateKey(), ShouldContainSubstring, "RSA PRIVATE KEY")
+
+			server, err := p.Spawn("an-image", "user", "m1", 0, 0*time.Second, false)
+			So(err, ShouldBeNil)
+			So(server.ID, ShouldEqual, "fake-"+server.Name)
+			So(server.IP, ShouldEqual, "127.0.0.1")
+			serverDir := filepath.Join(stateDir, resourceName, server.Name)
+			content, err := ioutil.ReadFile(filepath.Join(serverDir, "main.tf.json"))
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, `"image": "an-image"`)
+			So(string(content), ShouldContainSubstring, sentinelFilePath)
+
+			working, err := p.CheckServer(server.ID)
+			So(err, ShouldBeNil)
+			So(working, ShouldBeTrue)
+
+			_, err = p.Spawn("an-image", "user", "bad", 0, 0*time.Second, false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "bad flavor")
+			dirs, err := ioutil.ReadDir(filepath.Join(stateDir, resourceName))
+			So(err, ShouldBeNil)
+			So(len(dirs), ShouldEqual, 1)
+
+			err = p.DestroyServer(server.ID)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(serverDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			server, err = p.Spawn("an-image", "user", "m1", 0, 0*time.Second, false)
+			So(err, ShouldBeNil)
+			err = os.Remove(filepath.Join(stateDir, resourceName, server.Name, "terraform.tfstate"))
+			So(err, ShouldBeNil)
+			working, err = p.CheckServer(server.ID)
+			So(err, ShouldBeNil)
+			So(working, ShouldBeFalse)
+
+			err = p.TearDown()
+			So(err, ShouldBeNil)
+			_, err = os.Stat(filepath.Join(stateDir, resourceName))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
 func TestOpenStack(t *testing.T) {
 	osPrefix := os.Getenv("OS_OS_PREFIX")
 	osUser := os.Getenv("OS_OS_USERNAME")
@@ -38,11 +38,13 @@ import (
 	"github.com/VividCortex/ewma"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v2/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/floatingips"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/keypairs"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/quotasets"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/secgroups"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/images"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
@@ -64,6 +66,10 @@ import (
 // subsequently we learn how long recent builds actually take.
 const initialServerSpawnTimeout = 20 * time.Minute
 
+// volumeStatusTimeout is how long in seconds we wait for volumes to become
+// available or attached.
+const volumeStatusTimeout = 300
+
 // openstack only allows certain chars in resource names, so we have a regexp to
 // check.
 var openstackValidResourceNameRegexp = regexp.MustCompile(`^[\w -]+$`)
@@ -100,6 +106,7 @@ type openstackp struct {
 	spawnTimes        ewma.MovingAverage
 	spawnTimesVolume  ewma.MovingAverage
 	tenantID          string
+	volumeClient      *gophercloud.ServiceClient
 	log15.Logger
 }
 
@@ -174,6 +181,17 @@ func (p *openstackp) initialize(logger log15.Logger) error {
 		return err
 	}
 
+	// make a block storage client; not all installations have one, and we
+	// only need it for scratch volumes, so failure isn't fatal
+	var errv error
+	p.volumeClient, errv = openstack.NewBlockStorageV2(provider, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if errv != nil {
+		p.Debug("no block storage client", "err", errv)
+		p.volumeClient = nil
+	}
+
 	// get the external network id
 	p.externalNetworkID, err = networks.IDFromName(p.networkClient, p.poolName)
 	if err != nil {
@@ -1053,3 +1071,65 @@ func (p *openstackp) getAvailableFloatingIP() (string, error) {
 
 	return floatingIP, nil
 }
+
+// createVolume achieves the aims of provideri's createVolume()
+func (p *openstackp) createVolume(name string, sizeGB int) (string, error) {
+	if p.volumeClient == nil {
+		return "", errors.New("this OpenStack installation has no block storage service")
+	}
+
+	volume, err := volumes.Create(p.volumeClient, volumes.CreateOpts{
+		Name: name,
+		Size: sizeGB,
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+
+	err = volumes.WaitForStatus(p.volumeClient, volume.ID, "available", volumeStatusTimeout)
+	if err != nil {
+		errd := p.destroyVolume(volume.ID)
+		if errd != nil {
+			err = fmt.Errorf("%s (and deleting the volume failed: %s)", err.Error(), errd)
+		}
+		return "", err
+	}
+	return volume.ID, nil
+}
+
+// attachVolume achieves the aims of provideri's attachVolume()
+func (p *openstackp) attachVolume(serverID, volumeID string) (string, error) {
+	attachment, err := volumeattach.Create(p.computeClient, serverID, volumeattach.CreateOpts{
+		VolumeID: volumeID,
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+
+	err = volumes.WaitForStatus(p.volumeClient, volumeID, "in-use", volumeStatusTimeout)
+	return attachment.Device, err
+}
+
+// detachVolume achieves the aims of provideri's detachVolume()
+func (p *openstackp) detachVolume(serverID, volumeID string) error {
+	err := volumeattach.Delete(p.computeClient, serverID, volumeID).ExtractErr()
+	if err != nil {
+		return err
+	}
+	return volumes.WaitForStatus(p.volumeClient, volumeID, "available", volumeStatusTimeout)
+}
+
+// destroyVolume achieves the aims of provideri's destroyVolume()
+func (p *openstackp) destroyVolume(volumeID string) error {
+	if p.volumeClient == nil {
+		return errors.New("this OpenStack installation has no block storage service")
+	}
+
+	// a volume on a just-destroyed server can take a moment to become
+	// detached, so we wait for that first
+	errw := volumes.WaitForStatus(p.volumeClient, volumeID, "available", volumeStatusTimeout)
+	if errw != nil {
+		p.Debug("volume did not become available before deletion", "volume", volumeID, "err", errw)
+	}
+	return volumes.Delete(p.volumeClient, volumeID).ExtractErr()
+}
@@ -72,7 +72,9 @@ type Server struct {
 	mutex             sync.RWMutex
 	onDeathrow        bool
 	permanentProblem  string
+	privateKey        string // for servers with no provider
 	provider          *Provider
+	scratchVolumes    map[string]string // mount path => volume id
 	sshclient         *ssh.Client
 	usedCores         int
 	usedDisk          int
@@ -82,6 +84,34 @@ type Server struct {
 	logger            log15.Logger // (not embedded to make gob happy)
 }
 
+// NewStaticServer returns a Server for an existing machine that isn't managed
+// by any Provider, such as one of a fixed pool of hosts, which you can ssh to
+// (on port 22) as userName using the given PEM format private key. It has the
+// given resources available for you to Allocate(), and is never destroyed for
+// being idle. Methods that need a Provider, such as MountScratch() and Alive(),
+// must not be used on it, and Destroy() only marks it as unusable.
+func NewStaticServer(name, host, userName, privateKey string, cores, ramMB, diskGB int, logger log15.Logger) *Server {
+	return &Server{
+		ID:           name,
+		Name:         name,
+		IP:           host,
+		UserName:     userName,
+		Flavor:       &Flavor{ID: name, Name: name, Cores: cores, RAM: ramMB, Disk: diskGB},
+		Disk:         diskGB,
+		privateKey:   privateKey,
+		cancelRunCmd: make(map[int]chan bool),
+		logger:       logger.New("server", name),
+	}
+}
+
+// sshKey returns the private key we use to ssh to the server.
+func (s *Server) sshKey() string {
+	if s.provider == nil {
+		return s.privateKey
+	}
+	return s.provider.PrivateKey()
+}
+
 // Matches tells you if in principle a Server has the given os, script, config
 // files and flavor. Useful before calling HasSpaceFor, since if you don't match
 // these things you can't use the Server regardless of how empty it is.
@@ -191,15 +221,18 @@ func (s *Server) SSHClient() (*ssh.Client, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	if s.sshclient == nil {
-		if s.provider.PrivateKey() == "" {
-			s.logger.Error("resource file did not contain the ssh key", "path", s.provider.savePath)
+		key := s.sshKey()
+		if key == "" {
+			if s.provider != nil {
+				s.logger.Error("resource file did not contain the ssh key", "path", s.provider.savePath)
+			}
 			return nil, errors.New("missing ssh key")
 		}
 
 		// parse private key and make config
-		signer, err := ssh.ParsePrivateKey([]byte(s.provider.PrivateKey()))
+		signer, err := ssh.ParsePrivateKey([]byte(key))
 		if err != nil {
-			s.logger.Error("failed to parse private key", "path", s.provider.savePath, "err", err)
+			s.logger.Error("failed to parse private key", "err", err)
 			return nil, err
 		}
 		sshConfig := &ssh.ClientConfig{
@@ -622,6 +655,115 @@ func (s *Server) MkDir(dest string) error {
 	return nil
 }
 
+// scratchMountScript is the script MountScratch() runs on a server to find,
+// format and mount a newly attached volume. It must be formatted with the
+// first 20 chars of the volume id, the device the provider said the volume was
+// attached as, the mount path twice, the user to own the mount, and the mount
+// path again.
+const scratchMountScript = `dev=""
+for i in $(seq 1 60); do
+  dev=$(ls /dev/disk/by-id/*%s* 2>/dev/null | head -n 1)
+  [ -n "$dev" ] && break
+  sleep 1
+done
+if [ -z "$dev" ]; then
+  dev=%s
+  if [ ! -b "$dev" ] || lsblk -n -o MOUNTPOINT "$dev" | grep -q .; then
+    echo "could not find the attached volume" >&2
+    exit 1
+  fi
+fi
+sudo mkfs.ext4 -q -F "$dev" && sudo mkdir -p %s && sudo mount "$dev" %s && sudo chown %s %s`
+
+// MountScratch creates a new volume of the given size, attaches it to the
+// server, formats it and mounts it at a new directory owned by the server's
+// UserName. It returns the path to that directory. The volume and everything
+// on it is deleted when you call UnmountScratch() with the returned path (or
+// when the server is destroyed).
+//
+// The server's UserName must be able to use sudo without a password.
+func (s *Server) MountScratch(sizeGB int) (string, error) {
+	volumeID, err := s.provider.impl.createVolume(s.Name+"-scratch", sizeGB)
+	if err != nil {
+		return "", err
+	}
+
+	device, err := s.provider.impl.attachVolume(s.ID, volumeID)
+	if err != nil {
+		errd := s.provider.impl.destroyVolume(volumeID)
+		if errd != nil {
+			err = fmt.Errorf("%s (and deleting the volume failed: %s)", err.Error(), errd)
+		}
+		return "", err
+	}
+
+	// the device name the provider reports isn't always the one the OS uses,
+	// so we prefer to find the disk by its id (which is truncated to 20 chars
+	// for virtio disks), only falling back on the reported device if nothing
+	// on it is mounted
+	path := filepath.Join(scratchMountDir, "wr_scratch_"+volumeID)
+	id := volumeID
+	if len(id) > 20 {
+		id = id[:20]
+	}
+	mountCmd := fmt.Sprintf(scratchMountScript, id, device, path, path, s.UserName, path)
+	_, stderr, err := s.RunCmd(mountCmd, false)
+	if err != nil {
+		if stderr != "" {
+			err = fmt.Errorf("%s [%s]", err.Error(), strings.TrimSpace(stderr))
+		}
+		errd := s.removeScratchVolume(volumeID)
+		if errd != nil {
+			err = fmt.Errorf("%s (and deleting the volume failed: %s)", err.Error(), errd)
+		}
+		return "", err
+	}
+
+	s.mutex.Lock()
+	if s.scratchVolumes == nil {
+		s.scratchVolumes = make(map[string]string)
+	}
+	s.scratchVolumes[path] = volumeID
+	s.mutex.Unlock()
+	return path, nil
+}
+
+// UnmountScratch unmounts a scratch volume previously mounted with
+// MountScratch(), then detaches and deletes it.
+func (s *Server) UnmountScratch(path string) error {
+	s.mutex.Lock()
+	volumeID, exists := s.scratchVolumes[path]
+	delete(s.scratchVolumes, path)
+	s.mutex.Unlock()
+	if !exists {
+		return fmt.Errorf("%s is not a scratch volume mount point", path)
+	}
+
+	_, stderr, err := s.RunCmd(fmt.Sprintf("sudo umount %s && sudo rmdir %s", path, path), false)
+	if err != nil {
+		// we can't safely detach a volume that is still mounted, so leave it
+		// to be cleaned up when the server is destroyed
+		s.mutex.Lock()
+		s.scratchVolumes[path] = volumeID
+		s.mutex.Unlock()
+		if stderr != "" {
+			err = fmt.Errorf("%s [%s]", err.Error(), strings.TrimSpace(stderr))
+		}
+		return err
+	}
+
+	return s.removeScratchVolume(volumeID)
+}
+
+// removeScratchVolume detaches and deletes the given volume.
+func (s *Server) removeScratchVolume(volumeID string) error {
+	err := s.provider.impl.detachVolume(s.ID, volumeID)
+	if err != nil {
+		return err
+	}
+	return s.provider.impl.destroyVolume(volumeID)
+}
+
 // GoneBad lets you mark a server as having something wrong with it, so you can
 // avoid using it in the future, until the problems are confirmed. (At that
 // point you'd either Destroy() it, or if this was a false alarm, call
@@ -696,6 +838,16 @@ func (s *Server) Destroy() error {
 
 	err := s.provider.DestroyServer(s.ID)
 	s.logger.Debug("server destroyed", "err", err)
+
+	// any scratch volumes still attached will have been detached by the
+	// destruction, but not deleted
+	for path, volumeID := range s.scratchVolumes {
+		errv := s.provider.impl.destroyVolume(volumeID)
+		if errv != nil {
+			s.logger.Warn("scratch volume destruction failed", "volume", volumeID, "err", errv)
+		}
+		delete(s.scratchVolumes, path)
+	}
 	if err != nil {
 		// check if the server exists
 		ok, _ := s.provider.CheckServer(s.ID)
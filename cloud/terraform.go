@@ -0,0 +1,499 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cloud
+
+// This file contains a provideri implementation that drives a user-supplied
+// Terraform module, so that wr can spawn servers in any cloud that Terraform
+// supports.
+//
+// The module (a directory given by the WR_TERRAFORM_MODULE environment
+// variable) is responsible for creating exactly one server, and must declare
+// these input variables (it is free to ignore the ones it has no use for):
+//
+//     name             string       unique name for the server
+//     resource_name    string       the prefix shared by everything wr creates
+//     image            string       the OS image name or prefix wr was asked for
+//     flavor           string       the id of a flavor from flavors.json
+//     disk_gb          number       minimum root disk size in GB
+//     external_ip      bool         if the server needs a public ip address
+//     user_data        string       a script to run via cloud-init on boot
+//     public_key       string       an ssh public key to authorize
+//     ports            list(number) TCP ports that must be reachable
+//     cidr             string       the network range servers should be in
+//     gateway_ip       string       the gateway ip for that network
+//     dns_name_servers list(string) DNS name servers for that network
+//
+// It must declare these outputs:
+//
+//     id  the provider's id for the server
+//     ip  the ip address wr should ssh to (the public one if external_ip)
+//
+// The module directory must also contain a flavors.json file describing the
+// server flavors the module understands, as a list of objects with id, name,
+// cores, ram (MB) and disk (GB) keys.
+//
+// Each spawned server gets its own Terraform working directory, and so its
+// own state, in a sub-directory of WR_TERRAFORM_STATE_DIR (which defaults to
+// ~/.wr_terraform).
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/hashicorp/go-multierror"
+	"github.com/inconshreveable/log15"
+	"golang.org/x/crypto/ssh"
+)
+
+// terraformValidResourceNameRegexp limits resource names to characters that
+// are safe to use in directory names and in the names of cloud resources.
+var terraformValidResourceNameRegexp = regexp.MustCompile(`^[\w-]+$`)
+
+// terraformEnvs contains the environment variable names we need to use
+// Terraform. Credentials for the underlying cloud are whatever the user's
+// module and Terraform itself need; they are not managed by us.
+var terraformReqEnvs = [...]string{"WR_TERRAFORM_MODULE"}
+var terraformMaybeEnvs = [...]string{"WR_TERRAFORM_STATE_DIR", "WR_TERRAFORM_BIN"}
+
+// terraformFlavorsFile is the name of the file in the user's module that
+// describes the available server flavors.
+const terraformFlavorsFile = "flavors.json"
+
+// terraformIDFile is the name of the file we store a server's id in, within
+// its Terraform working directory.
+const terraformIDFile = "wr_server_id"
+
+// terraformp is our implementer of provideri
+type terraformp struct {
+	bin       string
+	module    string
+	stateDir  string
+	fmap      map[string]*Flavor
+	resources *Resources
+	ports     []int
+	gatewayIP string
+	cidr      string
+	dns       []string
+	sync.Mutex
+	log15.Logger
+}
+
+// terraformFlavor is the format of entries in terraformFlavorsFile.
+type terraformFlavor struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Cores int    `json:"cores"`
+	RAM   int    `json:"ram"`
+	Disk  int    `json:"disk"`
+}
+
+// requiredEnv returns envs.
+func (p *terraformp) requiredEnv() []string {
+	return terraformReqEnvs[:]
+}
+
+// maybeEnv returns envs.
+func (p *terraformp) maybeEnv() []string {
+	return terraformMaybeEnvs[:]
+}
+
+// initialize finds the terraform executable, checks the user's module and
+// reads the flavors it supports.
+func (p *terraformp) initialize(logger log15.Logger) error {
+	p.Logger = logger.New("cloud", "terraform")
+
+	p.bin = os.Getenv("WR_TERRAFORM_BIN")
+	if p.bin == "" {
+		p.bin = "terraform"
+	}
+	bin, err := exec.LookPath(p.bin)
+	if err != nil {
+		return fmt.Errorf("terraform executable not found: %s", err)
+	}
+	p.bin = bin
+
+	p.module, err = filepath.Abs(os.Getenv("WR_TERRAFORM_MODULE"))
+	if err != nil {
+		return err
+	}
+	if info, errs := os.Stat(p.module); errs != nil || !info.IsDir() {
+		return fmt.Errorf("WR_TERRAFORM_MODULE %s is not a directory", p.module)
+	}
+
+	p.stateDir = os.Getenv("WR_TERRAFORM_STATE_DIR")
+	if p.stateDir == "" {
+		p.stateDir = "~/.wr_terraform"
+	}
+	p.stateDir, err = filepath.Abs(internal.TildaToHome(p.stateDir))
+	if err != nil {
+		return err
+	}
+
+	return p.cacheFlavors()
+}
+
+// cacheFlavors reads the module's terraformFlavorsFile in to our fmap.
+func (p *terraformp) cacheFlavors() error {
+	content, err := ioutil.ReadFile(filepath.Join(p.module, terraformFlavorsFile))
+	if err != nil {
+		return err
+	}
+
+	var tfs []terraformFlavor
+	err = json.Unmarshal(content, &tfs)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", terraformFlavorsFile, err)
+	}
+	if len(tfs) == 0 {
+		return fmt.Errorf("%s defines no flavors", terraformFlavorsFile)
+	}
+
+	p.fmap = make(map[string]*Flavor)
+	for _, tf := range tfs {
+		if tf.ID == "" || tf.Cores < 1 || tf.RAM < 1 {
+			return fmt.Errorf("%s has an invalid flavor: %+v", terraformFlavorsFile, tf)
+		}
+		name := tf.Name
+		if name == "" {
+			name = tf.ID
+		}
+		p.fmap[tf.ID] = &Flavor{
+			ID:    tf.ID,
+			Name:  name,
+			Cores: tf.Cores,
+			RAM:   tf.RAM,
+			Disk:  tf.Disk,
+		}
+	}
+	return nil
+}
+
+// deploy achieves the aims of Deploy(). The only cloud resource we need to
+// create up front is an ssh key pair; everything else is the job of the user's
+// module. We remember the network details for use in each spawn().
+func (p *terraformp) deploy(resources *Resources, requiredPorts []int, gatewayIP, cidr string, dnsNameServers []string) error {
+	if !terraformValidResourceNameRegexp.MatchString(resources.ResourceName) {
+		return Error{terraformName, "deploy", ErrBadResourceName}
+	}
+
+	if resources.PrivateKey == "" || resources.Details["public_key"] == "" {
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+		pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return err
+		}
+		resources.PrivateKey = string(pem.EncodeToMemory(privateKeyPEM))
+		resources.Details["public_key"] = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	}
+	resources.Details["state_dir"] = filepath.Join(p.stateDir, resources.ResourceName)
+
+	p.Lock()
+	defer p.Unlock()
+	p.resources = resources
+	p.ports = requiredPorts
+	p.gatewayIP = gatewayIP
+	p.cidr = cidr
+	p.dns = dnsNameServers
+	return nil
+}
+
+// inCloud checks if we're currently running on a server we spawned, based on
+// the existence of the sentinel file our user data creates.
+func (p *terraformp) inCloud() bool {
+	_, err := os.Stat(sentinelFilePath)
+	return err == nil
+}
+
+// flavors returns all our flavors.
+func (p *terraformp) flavors() map[string]*Flavor {
+	return p.fmap
+}
+
+// getQuota achieves the aims of GetQuota(). We have no general way of knowing
+// the user's quota, so it is always unlimited.
+func (p *terraformp) getQuota() (*Quota, error) {
+	return &Quota{}, nil
+}
+
+// spawn achieves the aims of Spawn() by writing a root Terraform configuration
+// that uses the user's module, then applying it.
+func (p *terraformp) spawn(resources *Resources, osPrefix string, flavorID string, diskGB int, externalIP bool, usingQuotaCh chan bool) (serverID, serverIP, serverName, adminPass string, err error) {
+	p.Lock()
+	ports, gatewayIP, cidr, dns := p.ports, p.gatewayIP, p.cidr, p.dns
+	p.Unlock()
+	if ports == nil {
+		ports = []int{}
+	}
+	if dns == nil {
+		dns = []string{}
+	}
+
+	serverName = uniqueResourceName(resources.ResourceName)
+	dir := filepath.Join(p.stateDir, resources.ResourceName, serverName)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		usingQuotaCh <- true
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	root := map[string]interface{}{
+		"module": map[string]interface{}{
+			"server": map[string]interface{}{
+				"source":           p.module,
+				"name":             serverName,
+				"resource_name":    resources.ResourceName,
+				"image":            osPrefix,
+				"flavor":           flavorID,
+				"disk_gb":          diskGB,
+				"external_ip":      externalIP,
+				"user_data":        string(sentinelInitScript),
+				"public_key":       resources.Details["public_key"],
+				"ports":            ports,
+				"cidr":             cidr,
+				"gateway_ip":       gatewayIP,
+				"dns_name_servers": dns,
+			},
+		},
+		"output": map[string]interface{}{
+			"id": map[string]string{"value": "${module.server.id}"},
+			"ip": map[string]string{"value": "${module.server.ip}"},
+		},
+	}
+	content, err := json.MarshalIndent(root, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "main.tf.json"), content, 0600)
+	}
+	if err == nil {
+		_, err = p.terraform(dir, "init", "-input=false", "-no-color")
+	}
+	if err != nil {
+		usingQuotaCh <- true
+		p.removeDir(dir)
+		return serverID, serverIP, serverName, adminPass, err
+	}
+
+	// we can't know when the underlying cloud starts counting the server
+	// against quota, so treat the start of the apply as that moment
+	usingQuotaCh <- true
+	_, err = p.terraform(dir, "apply", "-input=false", "-auto-approve", "-no-color")
+	if err == nil {
+		serverID, serverIP, err = p.outputs(dir)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, terraformIDFile), []byte(serverID), 0600)
+	}
+	if err != nil {
+		errd := p.destroyDir(dir)
+		if errd != nil {
+			err = fmt.Errorf("%s (and destroying what was created failed: %s)", err, errd)
+		}
+		return "", "", serverName, adminPass, err
+	}
+
+	return serverID, serverIP, serverName, adminPass, err
+}
+
+// outputs reads the id and ip outputs of an applied configuration.
+func (p *terraformp) outputs(dir string) (id, ip string, err error) {
+	out, err := p.terraform(dir, "output", "-json", "-no-color")
+	if err != nil {
+		return "", "", err
+	}
+
+	var outputs map[string]struct {
+		Value interface{} `json:"value"`
+	}
+	err = json.Unmarshal(out, &outputs)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse terraform outputs: %s", err)
+	}
+
+	id = fmt.Sprintf("%v", outputs["id"].Value)
+	ip = fmt.Sprintf("%v", outputs["ip"].Value)
+	if outputs["id"].Value == nil || id == "" {
+		return "", "", errors.New("the terraform module did not output an id")
+	}
+	if outputs["ip"].Value == nil || ip == "" {
+		return "", "", errors.New("the terraform module did not output an ip")
+	}
+	return id, ip, nil
+}
+
+// checkServer achieves the aims of CheckServer(). A server is considered to
+// be working if its state has it existing and a refreshing plan would not
+// need to change anything.
+func (p *terraformp) checkServer(serverID string) (bool, error) {
+	dir := p.serverDir(serverID)
+	if dir == "" {
+		return false, nil
+	}
+
+	_, err := p.terraform(dir, "plan", "-input=false", "-detailed-exitcode", "-no-color")
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// destroyServer achieves the aims of DestroyServer()
+func (p *terraformp) destroyServer(serverID string) error {
+	dir := p.serverDir(serverID)
+	if dir == "" {
+		return nil
+	}
+	return p.destroyDir(dir)
+}
+
+// tearDown achieves the aims of TearDown(), destroying every server we have a
+// working directory for. When run on a server we spawned, our own server lives
+// in the state of the process that spawned us, so is left alone.
+func (p *terraformp) tearDown(resources *Resources) error {
+	var merr *multierror.Error
+
+	base := filepath.Join(p.stateDir, resources.ResourceName)
+	entries, err := ioutil.ReadDir(base)
+	if err != nil && !os.IsNotExist(err) {
+		merr = multierror.Append(merr, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		errd := p.destroyDir(filepath.Join(base, entry.Name()))
+		if errd != nil {
+			p.Warn("server destruction during teardown failed", "server", entry.Name(), "err", errd)
+			merr = multierror.Append(merr, errd)
+		}
+	}
+
+	if merr.ErrorOrNil() == nil {
+		err = os.Remove(base)
+		if err != nil && !os.IsNotExist(err) {
+			p.Warn("failed to remove terraform state directory", "dir", base, "err", err)
+		}
+		if !p.inCloud() {
+			resources.PrivateKey = ""
+			delete(resources.Details, "public_key")
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// serverDir finds the working directory of the server with the given id,
+// returning "" if there isn't one.
+func (p *terraformp) serverDir(serverID string) string {
+	if serverID == "" {
+		return ""
+	}
+	idFiles, err := filepath.Glob(filepath.Join(p.stateDir, "*", "*", terraformIDFile))
+	if err != nil {
+		return ""
+	}
+	for _, idFile := range idFiles {
+		content, err := ioutil.ReadFile(idFile)
+		if err == nil && string(content) == serverID {
+			return filepath.Dir(idFile)
+		}
+	}
+	return ""
+}
+
+// destroyDir destroys everything in a server's Terraform state, then removes
+// its working directory.
+func (p *terraformp) destroyDir(dir string) error {
+	_, err := p.terraform(dir, "destroy", "-input=false", "-auto-approve", "-no-color")
+	if err != nil {
+		return err
+	}
+	p.removeDir(dir)
+	return nil
+}
+
+// removeDir deletes a server's working directory, logging failure.
+func (p *terraformp) removeDir(dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		p.Warn("failed to remove terraform working directory", "dir", dir, "err", err)
+	}
+}
+
+// terraform runs the terraform executable with the given args in the given
+// working directory, returning its STDOUT. Errors include its STDERR.
+func (p *terraformp) terraform(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(p.bin, args...) // #nosec
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	p.Debug("ran terraform", "args", args, "dir", dir, "err", err)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if args[0] == "plan" && exitErr.ExitCode() == 2 {
+				return stdout.Bytes(), err
+			}
+		}
+		return stdout.Bytes(), fmt.Errorf("terraform %s failed: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// createVolume achieves the aims of provideri's createVolume(); volumes are
+// not supported by this provider.
+func (p *terraformp) createVolume(name string, sizeGB int) (string, error) {
+	return "", errors.New("the terraform provider does not support volumes")
+}
+
+// attachVolume achieves the aims of provideri's attachVolume()
+func (p *terraformp) attachVolume(serverID, volumeID string) (string, error) {
+	return "", errors.New("the terraform provider does not support volumes")
+}
+
+// detachVolume achieves the aims of provideri's detachVolume()
+func (p *terraformp) detachVolume(serverID, volumeID string) error {
+	return errors.New("the terraform provider does not support volumes")
+}
+
+// destroyVolume achieves the aims of provideri's destroyVolume()
+func (p *terraformp) destroyVolume(volumeID string) error {
+	return errors.New("the terraform provider does not support volumes")
+}
@@ -21,12 +21,14 @@ package cmd
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/spf13/cobra"
@@ -37,7 +39,14 @@ var reqGroup string
 var cmdTime string
 var cmdMem string
 var cmdCPUs int
+var cmdIdealCPUs int
+var cmdIdealMem string
 var cmdDisk int
+var cmdEnforceDisk bool
+var cmdFingerprint bool
+var cmdCoreDumps bool
+var cmdCoreDest string
+var cmdDatacentre string
 var cmdOvr int
 var cmdPri int
 var cmdRet int
@@ -57,8 +66,41 @@ var cmdOsPrefix string
 var cmdOsUsername string
 var cmdOsRAM int
 var cmdPostCreationScript string
+var cmdScriptVars string
 var cmdCloudConfigs string
 var cmdFlavor string
+var cmdScratch int
+var cmdLimits string
+var cmdRetryDelay string
+var cmdSandbox string
+var cmdOutputDest string
+var cmdShell string
+var cmdArch string
+var cmdSecrets string
+var cmdStartRate int
+var cmdLimitGroups string
+var cmdLabels string
+var cmdSync bool
+var cmdSyncTimeout string
+var cmdPhases bool
+var cmdHostSetup string
+var cmdHostCleanup string
+var cmdMaxPerHost int
+var cmdCallbackURL string
+var cmdStartDeadline string
+var cmdOutputFilter string
+var cmdContainer string
+var cmdEnvMinimal bool
+var cmdEnvInclude string
+var cmdEnvExclude string
+var cmdEnvProfile string
+var cmdReport bool
+var cmdCheckPeers bool
+var cmdCheckCmds bool
+
+// phaseMarker is what lines in the cmd file start with, followed by whitespace
+// or the end of the line, to begin a new phase in --phases mode.
+const phaseMarker = "#phase"
 
 // addCmd represents the add command
 var addCmd = &cobra.Command{
@@ -72,10 +114,14 @@ specific options using a JSON object in (tab separated) column 2, or
 alternatively have only a JSON object in column 1 that also specifies the
 command as one of the name:value pairs. The possible options are:
 
-cmd cwd cwd_matters change_home on_failure on_success on_exit mounts req_grp
-memory time override cpus disk priority retries rep_grp dep_grps deps cmd_deps
-cloud_os cloud_username cloud_ram cloud_script cloud_config_files cloud_flavor
-env
+cmd cwd cwd_matters change_home sandbox on_failure on_success on_exit mounts
+req_grp memory time override cpus ideal_cpus ideal_memory disk enforce_disk arch
+priority retries retry_delay rep_grp dep_grps deps cmd_deps cloud_os
+cloud_username cloud_ram cloud_script cloud_script_vars cloud_config_files
+cloud_flavor cloud_scratch env limits output_dest output_filter container shell
+secrets start_rate limit_grps labels fingerprint core_dumps core_dest report
+host_setup host_cleanup max_per_host datacentre callback_url start_deadline
+fallbacks
 
 If any of these will be the same for all your commands, you can instead specify
 them as flags (which are treated as defaults in the case that they are
@@ -102,7 +148,7 @@ be deleted after the cmd finishes running (according to cleanup behaviour), and
 enables tracking of how much disk space your cmd uses. If using mounts and not
 specifying a mount point, the mount point will be the actual working directory.
 It also sets $TMPDIR to a sister directory of the actual working directory, and
-this is always deleted after the cmd runs. If, on the other hand, you set
+this is deleted after the cmd runs (unless "sandbox" says otherwise). If, on the other hand, you set
 cwd_matters, then "cwd" is the literal command working directory, you can't
 clean up afterwards, you don't get disk space tracking and undefined mounts are
 mounted in the "mnt" subdirectory of cwd. One benefit is that any output files
@@ -115,6 +161,16 @@ paths to your input files in your cmd, assuming they are in your cwd.
 the $HOME environment variable to the actual command working directory before
 running the cmd.
 
+"sandbox" only has an effect when "cwd_matters" is false. It is an object that
+controls when the unique working directory and $TMPDIR get deleted. Possible
+keys are "delete" ("always", to delete them as soon as the cmd exits, or
+"success", to do that only if the cmd succeeded, keeping everything from failed
+cmds for you to investigate) and "keep" (how long anything not deleted when the
+cmd exits should be kept, eg. "3d" or "12h", after which it is deleted by the
+next runner to run on the same host, so long as the manager hasn't been
+restarted in the meantime). For example {"delete":"success","keep":"7d"}. The
+--sandbox option takes the same keys in the form "delete=success,keep=7d".
+
 "on_failure" determines what behaviours are triggered if your cmd exits non-0.
 Behaviours are described using an array of objects, where each object has a key
 corresponding to the name of the desired behaviour, and the relevant value. The
@@ -153,16 +209,21 @@ of the first word in your command, which it assumes to be the name of your
 executable.
 
 "memory" and "time" let you provide hints to wr manager so that it can do a
-better job of spawning runners to handle these commands. "memory" values should
-specify a unit, eg "100M" for 100 megabytes, or "1G" for 1 gigabyte. "time"
-values should do the same, eg. "30m" for 30 minutes, or "1h" for 1 hour.
+better job of spawning runners to handle these commands. "memory" values must
+specify a unit, eg "100M" for 100 megabytes, or "3.5G" for 3.5 gigabytes. "time"
+values must do the same, eg. "30m" for 30 minutes, "1h" for 1 hour, or "2d4h"
+for 2 days and 4 hours. Values of 0, and absurdly large values (more than 16T
+of memory, 1 year of time, 4096 cpus or 1048576 GB of disk), are rejected.
 
 The manager learns how much memory and time commands in the same req_grp
 actually used in the past, and will use its own values unless you set an
-override. For this learning to work well, you should have reason to believe that
-all the commands you add with the same req_grp will have similar memory and time
-requirements, and you should pick the name in a consistent way such that you'll
-use it again in the future.
+override. It also learns how much disk they used (if cwd_matters is false), and
+will increase your disk to that if it is higher, unless override is 2. See
+'wr reqgroup -h' for ways to see and adjust what was learned. For this learning
+to work well, you should have reason to believe that all the commands you add
+with the same req_grp will have similar memory and time requirements, and you
+should pick the name in a consistent way such that you'll use it again in the
+future.
 
 For example, if you want to run an executable called "exop", and you know that
 the memory and time requirements of exop vary with the size of its input file,
@@ -183,6 +244,13 @@ manager's estimate. Possible values are:
 
 "cpus" tells wr manager exactly how many CPU cores your command needs.
 
+"ideal_cpus" and "ideal_memory" let you say that your command could make use of
+more cores and memory than "cpus" and "memory", which then become the minimum
+it needs. The job scheduler will give your command as much as it can up to these
+ideals, depending on what is available, and your command can find out what it
+got from the $WR_CORES and $WR_RAM (in megabytes) environment variables, eg.
+"bwa mem -t $WR_CORES ref.fa reads.fq".
+
 "disk" tells wr manager how much free disk space (in GB) your command needs. If
 you know that where your command will store its outputs to will not run out of
 disk space, set this to 0 to avoid unnecessary disk space checks (or possible
@@ -191,6 +259,19 @@ volume creation, in the case of cloud schedulers).
 the openstack scheduler which will create temporary volumes of the specified
 size if necessary]
 
+"enforce_disk", if true, makes "disk" a quota on the command's unique working
+directory: the space used there (and in its $TMPDIR, but not counting any
+mounts) is checked periodically, and if it grows larger than "disk" the command
+is killed and buried, protecting shared scratch space from runaway commands.
+This has no effect when "cwd_matters" is true or "disk" is 0.
+
+"arch" is the CPU architecture your command needs to run on, eg. "x86_64" or
+"aarch64" (common aliases such as "amd64" and "arm64" are also understood). If
+unset, your command could run on a host of any architecture. For the openstack
+scheduler, wr manager must have been started with --cloud_arch_flavors
+describing which flavors have which architecture. For the kubernetes scheduler,
+pods are only placed on nodes with a matching kubernetes.io/arch label.
+
 "priority" defines how urgent a particular command is; those with higher
 priorities will start running before those with lower priorities. The range of
 possible values is 0 (default) to 255. Commands with the same priority will be
@@ -203,6 +284,26 @@ more memory/time reserved). Once this number of retries is reached, the command
 will be 'buried' until you take manual action to fix the problem and press the
 retry button in the web interface.
 
+"fallbacks" is an array of alternative commands to try, in order, if your
+command still fails after all its retries, eg. a slower but more robust tool to
+use if a fast one fails. Each is a JSON object with a "cmd" and optionally
+"memory", "time", "cpus" and "disk" values to use instead of the command's own
+while it is being tried. Each fallback gets its own set of retries, and only
+once the last one fails does the command get buried. A fallback is also tried
+straight away if a command could not be run at all (eg. it was not found).
+Fallback runs count as further attempts of the same command, which keeps its
+original cmd for the purposes of its identity, dependencies and status.
+
+"retry_delay" is an object that controls how long a failed command waits before
+it is retried. Possible keys are "delay" (the wait, eg. "5m"; default 30s),
+"backoff" ("fixed", the default, or "exponential" to double the wait after each
+failure), "max" (the longest an exponential backoff will wait; default 24h) and
+"window" (a daily window of the manager's local time that retries may start in,
+eg. "22:00-06:00"). For example {"delay":"1m","backoff":"exponential"} stops
+commands that fail because some external service is down from hammering it. The
+--retry_delay option takes the same keys in the form
+"delay=1m,backoff=exponential".
+
 "rep_grp" is an arbitrary group you can give your commands so you can query
 their status later. This is only used for reporting and presentation purposes
 when viewing status.
@@ -233,7 +334,21 @@ flavor (normally the cheapest flavor is chosen for you based on the command's
 resource requirements). The format for cloud_config_files is described under the
 help text for "wr cloud deploy"'s --config_files option. The per-job config
 files you specify will be treated as in addition to any specified during cloud
-deploy or when starting the manager.
+deploy or when starting the manager. If you set "cloud_scratch" to a number of
+GB, a new volume of that size will be created, attached to the server your
+command runs on and mounted, and your command's working directory and $TMPDIR
+will be created on it (unless "cwd_matters" is true); the volume is deleted
+once the command finishes. Use this for disk-heavy commands that would
+otherwise fill up the server's root disk.
+
+Cloud scripts (yours, or those the manager was started with) that contain "{{"
+are treated as Go templates, and can use .Flavor, .Cores, .RAM, .Disk and .OS
+to vary by the server they run on, and .Vars to vary by command.
+"cloud_script_vars" is a comma separated list of key=value pairs that become
+.Vars, eg. with "cloud_script_vars" set to "packages=samtools bwa", a script
+containing "yum install -y {{.Vars.packages}}" will install those packages.
+Commands only share servers if their rendered scripts are identical. Use
+'wr cloud status' to see which version of a script each server ran.
 
 "env" is an array of "key=value" environment variables, which override or add to
 the environment variables the command will see when it runs. The base variables
@@ -243,7 +358,187 @@ base variables as they were at the moment in time you run 'wr add', so to set a
 certain environment variable for all commands, you could instead just set it
 prior to calling 'wr add'. In the remote case the command will use base
 variables as they were on the machine where the command is executed when that
-machine was started.`,
+machine was started.
+
+In the local case, rather than capture your whole environment you can capture
+only the variables commands normally need (PATH, HOME, USER, LANG etc.) with
+--env_minimal, and/or only those matching --env_include patterns (eg.
+"PATH,PERL*"), and not those matching --env_exclude patterns (eg.
+"AWS_*,*TOKEN*"). This keeps user-specific variables out of shared execution
+and reduces what the manager has to store. Alternatively, --env_profile names a
+base environment stored with 'wr envprofile set', which is used instead of your
+current environment whether local or remote.
+
+"limits" is an object that sets the umask and resource limits (as per the
+shell's ulimit builtin) that the command will run with. Possible keys are
+"umask" (an octal mode, eg. "0002"), "nofile" (max open files), "core" (max
+core dump size; "0" disables core dumps), "stack" (max stack size) and "fsize"
+(max size of files written). Sizes can have a unit suffix, eg. "1G". Resource
+limits can't be raised above the hard limits of the runner, but a value of
+"unlimited" will raise them to that hard limit. Unspecified limits are inherited
+from the runner. For example {"umask":"0002","nofile":"8192"}. The --limits
+option takes the same keys in the form "umask=0002,nofile=8192".
+
+"output_dest" describes where you intend your command's final outputs to end up,
+eg. "s3://bucket/results/{repgroup}/{key}/". The placeholders {repgroup},
+{reqgroup} and {key} (the command's unique identifier) will be filled in when
+the command is added, and the result is shown by 'wr status' so that you can
+find your results later. Your command and any "run" behaviours will see the
+value in the $WR_OUTPUT_DEST environment variable, so can use it to upload
+their outputs, eg. {"run":"s3cmd put -r outputs/ $WR_OUTPUT_DEST"}.
+
+"output_filter" is an object of regular expressions controlling which lines of
+your command's STDOUT and STDERR are kept (only the first and last 4KB of each
+are stored, so filtering makes sure the useful lines are amongst those). Lines
+not matching one of the "keep" expressions (if any), or matching one of the
+"drop" expressions, are discarded, and matches of the "redact" expressions are
+replaced with [redacted], eg. {"drop":["^Progress"],"redact":["password=\\S+"]}.
+The default is the manager's manageroutputfilter config option. The
+--output_filter option takes the same JSON.
+
+"container" is an object describing a container to run your command inside,
+instead of directly on the host: "image" is the image to use, "runtime" is
+"docker" (the default) or "singularity", "mounts" is an array of extra host
+paths to make available like "/host/path[:/container/path][:ro]" (your
+command's working directory is always available), "env" is an array of the
+names of environment variables to pass through to the container, and "user" is
+the user[:group] to run as in a docker container (defaulting to you), eg.
+{"image":"ubuntu:22.04","mounts":["/data/ref:/ref:ro"],"env":["REF"]}. The
+image is pulled before your command counts as having started, so pulling
+doesn't count towards its time. The --container option takes the same JSON.
+
+"shell" is the shell your command will be run with, overriding the runner's
+configured shell (normally bash). For commands that must run on Windows
+machines, you can specify "cmd" or "powershell".
+
+"secrets" is an array of the names of secrets previously stored with 'wr secret
+set'. Each will be in an environment variable of the same name when your
+command runs, without the value ever being stored with your command or
+appearing in your input file.
+
+"start_rate" is the maximum number of commands in your command's rep_grp that
+will be started per minute. If your commands all hit some shared service (eg. a
+database, license server or S3 bucket) as they start up, this stops that
+service being overwhelmed when thousands of them become ready to run at once.
+The default of 0 means there is no limit.
+
+"limit_grps" is an array of the names of limit groups your command belongs to,
+eg. ["irods","db-writes"]. No more commands in a limit group will be allowed to
+run at once than its limit, which you can view and change at any time with 'wr
+limit', so you can protect a shared service used by commands in many different
+rep_grps. Groups that haven't been given a limit are unlimited. Names can't
+contain commas or white space.
+
+"labels" is an object of key:value pairs that you can tag your command with,
+such as sample IDs, project codes or analysis versions, eg.
+{"sample":"S1","project":"P2"}. You can then find your commands with those
+labels using 'wr status --label sample=S1'. Keys may only contain letters,
+numbers, _, ., - and /. Labels given with --labels are combined with those in
+the text file, the latter taking precedence for the same key.
+
+"fingerprint", if true, records details of the environment your command runs in
+(OS release, kernel, CPU model, loaded environment modules and container image)
+and stores them with the command, so you can later find out exactly where a
+result came from with 'wr status'. The container image is taken from
+$WR_CONTAINER_IMAGE if you set it, or else from the environment variables
+Singularity and Apptainer set.
+
+"core_dumps", if true, lets your command dump core (up to 2GB, unless you set a
+core size in "limits") should it crash. Any core is gzipped and moved to
+"core_dest", which can be a local directory or an S3 url like
+s3://[profile@]bucket/path, defaulting to a wr_cores directory in your "cwd".
+'wr status' then tells you where to find it. Only cores written to the
+command's working directory can be collected, so the hosts' kernel.core_pattern
+must be a relative path like "core" or "core.%p".
+
+"report", if true, has a wr_report.json file written to your command's working
+directory when it exits (before any on_* behaviours run), containing its start
+and end times, exit code, peak memory usage, CPU time, host and mounts. Later
+steps of your pipeline can read this instead of querying the manager.
+
+"datacentre" is the name of the datacentre your command should run in. If your
+manager has been configured with peer managers in other datacentres (see the
+managerpeersfile option in wr's config file), commands for their datacentres
+are forwarded to them once their dependencies are satisfied, and their progress
+is mirrored back to your manager, so you can follow them with 'wr status' as
+usual. Commands with no datacentre, or your manager's own, run as normal.
+
+"host_setup" is a command that will be run once on each host (per user) before
+the first command with the same host_setup, host_cleanup and resource
+requirements starts running there, eg. to pull a container image or warm a
+cache. If it fails, your command will be buried with the reason "host setup
+command failed", and 'wr status' will show you its error output. "host_cleanup"
+is similarly run once after the last such command on a host finishes. (If the
+setup and cleanup commands would be identical for all your commands, they could
+still end up being run more than once per host if your commands have different
+resource requirements.)
+
+"max_per_host" is the most commands with the same resource requirements as
+yours that may run at once on any one host, regardless of how many would fit
+given their cpus, memory and disk. Use it for commands that are limited by a
+host's local disk or network rather than its CPUs. The default of 0 means there
+is no such limit (though the manager's managermaxjobsperhost config option may
+still apply). It currently only has an effect with the local, ssh and openstack
+schedulers.
+
+"callback_url" is an http(s) URL that the manager will POST to once your command
+completes or is buried, so that you don't have to poll for its status. The JSON
+body has the command's key, cmd, rep_grp, state, exit_code, fail_reason,
+walltime_seconds and peak_ram_mb, and the X-Wr-Event header holds the state. The
+X-Wr-Signature header is "sha256=" followed by the hex HMAC-SHA256 of the body
+keyed with the manager's token (as used by 'wr' commands), so you can check that
+requests really came from the manager. Failed requests are retried a few times,
+backing off between attempts.
+
+"start_deadline" is an object that says what should happen if your command has
+been ready to run for a while without starting, eg. because the cluster is busy
+with other work. Possible keys are "within" (how long it may wait, eg. "30m"),
+"priority" (a higher priority to raise it to), "relax_flavor" (true to drop any
+cloud_flavor restriction), "datacentre" (a datacentre of a peer manager to
+forward it to instead) and "notify" (true to have the manager log a warning and
+POST to your callback_url, with an X-Wr-Event of "ready"). For example
+{"within":"1h","priority":255,"notify":true}. The --start_deadline option takes
+the same keys in the form "within=1h,priority=255,notify=true".
+
+Commands that are already in the queue are not added again. If you run parallel
+managers and have listed the others in your managerpeersfile (peers need no
+datacentres if you don't want commands forwarded to them), --check_peers makes
+commands already in any of their queues count as duplicates as well, so that
+the same command doesn't end up being run by more than one manager.
+
+With --check_cmds, the executables your commands run are looked for in the PATH
+of the environment they'll run in before anything is added, and if any can't be
+found (eg. because you forgot to 'module load' something), they are listed and
+none of your commands are added. Only the first word of each part of your
+command lines (as split by ; && || | etc.) is checked, ignoring shell builtins
+and words that depend on variables, and nothing after something like 'module
+load', 'source' or 'cd' that might change the PATH is checked. When using
+--env_profile or a manager on another machine, your current environment is
+checked, which may differ from the one your commands will actually run in.
+Commands run in a "container" are not checked.
+
+With --sync, this command doesn't return once your commands have been added, but
+waits for them all to finish. It then exits non-zero if any of them failed and
+were buried, listing those that did, so that wr can be used like a distributed
+'make -j' in Makefiles and CI pipelines. --sync_timeout limits how long to wait.
+(Since buried commands count as finished, you may want to set a low --retries
+when using --sync, so you find out about failures quickly.)
+
+With --phases, your file is split in to phases at lines that are '#phase'
+(optionally followed by a space and a name for the phase), and all the commands
+in a phase won't start until all the commands in the previous phase have
+completed. This is done by giving each command the dep_grp
+"[report_grp].[phase name]" (where unnamed phases are called phase1, phase2
+etc.) and making it depend on the previous phase's dep_grp, in addition to any
+dep_grps and deps you specify yourself. [report_grp] is the value of
+--report_grp, so use a unique value for each of your pipelines. For example,
+this file makes sure that all the aligns finish before merging starts:
+
+#phase align
+align sample1
+align sample2
+#phase merge
+merge sample1 sample2`,
 	Run: func(combraCmd *cobra.Command, args []string) {
 		// check the command line options
 		if cmdFile == "" {
@@ -261,14 +556,30 @@ machine was started.`,
 		}()
 
 		jobs, isLocal, defaultedRepG := parseCmdFile(jq)
+		jq.CheckPeers = cmdCheckPeers
 
 		var envVars []string
-		if isLocal {
-			envVars = os.Environ()
+		if isLocal && cmdEnvProfile == "" {
+			envVars = filteredEnviron(cmdEnvMinimal, cmdEnvInclude, cmdEnvExclude)
 		}
 
-		// add the jobs to the queue
-		inserts, dups, err := jq.Add(jobs, envVars, !cmdReRun)
+		if cmdCheckCmds {
+			checkCmdsExist(jobs, envVars)
+		}
+
+		// add the jobs to the queue, in batches if there are a lot of them
+		var progress func(*jobqueue.AddProgress)
+		if len(jobs) > jobqueue.ClientAddBatchSize {
+			progress = func(p *jobqueue.AddProgress) {
+				info("Sent %d/%d commands...", p.Sent, p.Total)
+			}
+		}
+		var inserts, dups int
+		if cmdEnvProfile != "" {
+			inserts, dups, err = jq.AddWithEnvProfile(jobs, cmdEnvProfile, !cmdReRun, 0, progress)
+		} else {
+			inserts, dups, err = jq.AddBulk(jobs, envVars, !cmdReRun, 0, progress)
+		}
 		if err != nil {
 			die("%s", err)
 		}
@@ -278,6 +589,10 @@ machine was started.`,
 		} else {
 			info("Added %d new commands (%d were duplicates) to the queue", inserts, dups)
 		}
+
+		if cmdSync {
+			syncWait(jq, jobs)
+		}
 	},
 }
 
@@ -291,14 +606,19 @@ func init() {
 	addCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "base for the command's working dir")
 	addCmd.Flags().BoolVar(&cmdCwdMatters, "cwd_matters", false, "--cwd should be used as the actual working directory")
 	addCmd.Flags().BoolVar(&cmdChangeHome, "change_home", false, "when not --cwd_matters, set $HOME to the actual working directory")
+	addCmd.Flags().StringVar(&cmdSandbox, "sandbox", "", "comma-separated list of key=value settings controlling when unique working directories get deleted")
 	addCmd.Flags().StringVarP(&reqGroup, "req_grp", "g", "", "group name for commands with similar reqs")
 	addCmd.Flags().StringVarP(&cmdMem, "memory", "m", "1G", "peak mem est. [specify units such as M for Megabytes or G for Gigabytes]")
-	addCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "max time est. [specify units such as m for minutes or h for hours]")
+	addCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "max time est. [specify units such as m for minutes, h for hours or d for days]")
 	addCmd.Flags().IntVar(&cmdCPUs, "cpus", 1, "cpu cores needed")
+	addCmd.Flags().IntVar(&cmdIdealCPUs, "ideal_cpus", 0, "most cpu cores the commands could use, if available [0 means just --cpus]")
+	addCmd.Flags().StringVar(&cmdIdealMem, "ideal_memory", "", "most mem the commands could use, if available [specify units such as M for Megabytes or G for Gigabytes]")
 	addCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required [0 means do not check disk space] (default 0)")
+	addCmd.Flags().BoolVar(&cmdEnforceDisk, "enforce_disk", false, "kill commands that use more than --disk GB in their working directory")
 	addCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
 	addCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
 	addCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
+	addCmd.Flags().StringVar(&cmdRetryDelay, "retry_delay", "", "comma-separated list of key=value settings controlling how long failed commands wait before being retried")
 	addCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
 	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
 	addCmd.Flags().StringVar(&cmdOnFailure, "on_failure", "", "behaviours to carry out when cmds fails, in JSON format")
@@ -310,14 +630,117 @@ func init() {
 	addCmd.Flags().StringVar(&cmdOsUsername, "cloud_username", "", "in the cloud, username needed to log in to the OS image specified by --cloud_os")
 	addCmd.Flags().IntVar(&cmdOsRAM, "cloud_ram", 0, "in the cloud, ram (MB) needed by the OS image specified by --cloud_os")
 	addCmd.Flags().StringVar(&cmdFlavor, "cloud_flavor", "", "in the cloud, exact name of the server flavor that the commands must run on")
+	addCmd.Flags().IntVar(&cmdScratch, "cloud_scratch", 0, "in the cloud, GB of scratch volume to create for each command's working directory")
 	addCmd.Flags().StringVar(&cmdPostCreationScript, "cloud_script", "", "in the cloud, path to a start-up script that will be run on the servers created to run these commands")
+	addCmd.Flags().StringVar(&cmdScriptVars, "cloud_script_vars", "", "in the cloud, comma separated key=value pairs available to templated start-up scripts as .Vars")
 	addCmd.Flags().StringVar(&cmdCloudConfigs, "cloud_config_files", "", "in the cloud, comma separated paths of config files to copy to servers created to run these commands")
 	addCmd.Flags().StringVar(&cmdEnv, "env", "", "comma-separated list of key=value environment variables to set before running the commands")
+	addCmd.Flags().StringVar(&cmdLimits, "limits", "", "comma-separated list of key=value umask and resource limits to run the commands with")
+	addCmd.Flags().StringVar(&cmdOutputDest, "output_dest", "", "templated destination of your commands' final outputs, eg. s3://bucket/{repgroup}/{key}/")
+	addCmd.Flags().StringVar(&cmdOutputFilter, "output_filter", "", "regular expressions controlling which lines of command output are kept, in JSON format")
+	addCmd.Flags().StringVar(&cmdContainer, "container", "", "docker or singularity container to run commands inside, in JSON format")
+	addCmd.Flags().StringVar(&cmdArch, "arch", "", "CPU architecture the commands need to run on, eg. x86_64 or aarch64")
+	addCmd.Flags().StringVar(&cmdSecrets, "secrets", "", "comma-separated list of the names of secrets (see 'wr secret') the commands need")
+	addCmd.Flags().IntVar(&cmdStartRate, "start_rate", 0, "maximum number of commands in the same --rep_grp to start per minute [0 means unlimited]")
+	addCmd.Flags().StringVar(&cmdLimitGroups, "limit_grps", "", "comma-separated list of limit groups")
+	addCmd.Flags().StringVar(&cmdLabels, "labels", "", "comma-separated list of key=value labels to tag the commands with")
+	addCmd.Flags().BoolVar(&cmdFingerprint, "fingerprint", false, "record details of the environment the commands run in")
+	addCmd.Flags().BoolVar(&cmdCoreDumps, "core_dumps", false, "let the commands dump core, collecting any cores produced")
+	addCmd.Flags().StringVar(&cmdCoreDest, "core_dest", "", "directory or s3://[profile@]bucket/path to collect core dumps in [default: wr_cores in --cwd]")
+	addCmd.Flags().StringVar(&cmdDatacentre, "datacentre", "", "datacentre the commands should run in, if your manager has peers in other datacentres")
+	addCmd.Flags().StringVar(&cmdHostSetup, "host_setup", "", "command to run once on each host before the first of these commands runs there")
+	addCmd.Flags().StringVar(&cmdHostCleanup, "host_cleanup", "", "command to run once on each host after the last of these commands runs there")
+	addCmd.Flags().IntVar(&cmdMaxPerHost, "max_per_host", 0, "most of these commands to run at once on any one host [0 means no limit]")
+	addCmd.Flags().StringVar(&cmdCallbackURL, "callback_url", "", "URL to POST to when each command completes or is buried")
+	addCmd.Flags().StringVar(&cmdStartDeadline, "start_deadline", "", "comma-separated list of key=value settings controlling what happens to commands that wait too long to start")
+	addCmd.Flags().BoolVar(&cmdReport, "report", false, "write an execution report to the commands' working directories when they exit")
+	addCmd.Flags().BoolVar(&cmdEnvMinimal, "env_minimal", false, "only capture the environment variables most commands need")
+	addCmd.Flags().StringVar(&cmdEnvInclude, "env_include", "", "comma-separated list of patterns; only capture environment variables with matching names")
+	addCmd.Flags().StringVar(&cmdEnvExclude, "env_exclude", "", "comma-separated list of patterns; don't capture environment variables with matching names")
+	addCmd.Flags().StringVar(&cmdEnvProfile, "env_profile", "", "name of a stored environment (see 'wr envprofile') to run the commands in")
+	addCmd.Flags().StringVar(&cmdShell, "shell", "", "shell to run the commands with, eg. bash, cmd or powershell [defaults to the runner's shell]")
 	addCmd.Flags().BoolVar(&cmdReRun, "rerun", false, "re-run any commands that you add that had been previously added and have since completed")
+	addCmd.Flags().BoolVar(&cmdSync, "sync", false, "wait for the commands to finish, exiting non-zero if any fail")
+	addCmd.Flags().StringVar(&cmdSyncTimeout, "sync_timeout", "", "in --sync mode, the longest to wait, eg. 24h [default forever]")
+	addCmd.Flags().BoolVar(&cmdPhases, "phases", false, "split commands in to dependent phases at lines starting '#phase'")
+	addCmd.Flags().BoolVar(&cmdCheckPeers, "check_peers", false, "treat commands already in the queues of peer managers as duplicates")
+	addCmd.Flags().BoolVar(&cmdCheckCmds, "check_cmds", false, "check that the executables of your commands exist before adding them")
 
 	addCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
 
+// syncWait waits for the given just-added jobs to finish, for --sync mode,
+// exiting non-zero after listing any that failed.
+func syncWait(jq *jobqueue.Client, jobs []*jobqueue.Job) {
+	opts := &jobqueue.WaitOptions{}
+	if cmdSyncTimeout != "" {
+		var err error
+		opts.Timeout, err = time.ParseDuration(cmdSyncTimeout)
+		if err != nil {
+			die("--sync_timeout was not specified correctly: %s", err)
+		}
+	}
+
+	jes := jobsToJobEssenses(jobs)
+	summary, err := jq.WaitForJobs(jes, opts)
+	if err != nil {
+		die("failed waiting for the commands to finish: %s", err)
+	}
+	if summary.Buried == 0 {
+		info("All %d commands completed successfully", summary.Complete)
+		return
+	}
+
+	finished, err := jq.GetByEssences(jes)
+	if err != nil {
+		die("failed to get details of the failed commands: %s", err)
+	}
+	for _, job := range finished {
+		if job.State != jobqueue.JobStateBuried {
+			continue
+		}
+		reason := job.FailReason
+		if job.Exited {
+			reason = fmt.Sprintf("%s (exit code %d)", reason, job.Exitcode)
+		}
+		fmt.Fprintf(os.Stderr, "failed: %s [%s]\n", job.Cmd, reason)
+	}
+	die("%d of %d commands failed", summary.Buried, summary.Total())
+}
+
+// checkCmdsExist dies listing the executables of the given jobs' commands that
+// can't be found in the environment they'll run in (or our current one, if
+// we're not sending that), so that none of the jobs get added.
+func checkCmdsExist(jobs []*jobqueue.Job, envVars []string) {
+	if envVars == nil {
+		envVars = os.Environ()
+	}
+
+	var problems []string
+	for _, job := range jobs {
+		missing, err := job.MissingExecutables(envVars)
+		if err != nil {
+			die("could not check the executables of [%s]: %s", job.Cmd, err)
+		}
+		for _, exe := range missing {
+			problems = append(problems, fmt.Sprintf("%s (in [%s])", exe, job.Cmd))
+		}
+	}
+	if len(problems) == 0 {
+		return
+	}
+
+	const maxListed = 10
+	for i, problem := range problems {
+		if i == maxListed {
+			fmt.Fprintf(os.Stderr, "... and %d more\n", len(problems)-maxListed)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "not found: %s\n", problem)
+	}
+	die("%d executables could not be found, so no commands were added", len(problems))
+}
+
 // convert cmd,cwd columns in to Dependency.
 func colsToDeps(cols []string) (deps jobqueue.Dependencies) {
 	for i := 0; i < len(cols); i += 2 {
@@ -339,14 +762,7 @@ func groupsToDeps(groups string) (deps jobqueue.Dependencies) {
 // the manager is on the same host as us, and bool for if any job defaulted to
 // the default repgrp.
 func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
-	var isLocal bool
-	currentIP, errc := jobqueue.CurrentIP("")
-	if errc != nil {
-		warn("Could not get current IP: %s", errc)
-	}
-	if currentIP+":"+config.ManagerPort == jq.ServerInfo.Addr {
-		isLocal = true
-	}
+	isLocal := managerIsLocal(jq)
 
 	// if the manager is remote, copy over any cloud config files to unique
 	// locations, and adjust cloudConfigFiles to make sense from the manager's
@@ -362,7 +778,17 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 		CwdMatters:       cmdCwdMatters,
 		ChangeHome:       cmdChangeHome,
 		CPUs:             cmdCPUs,
+		IdealCPUs:        cmdIdealCPUs,
 		Disk:             cmdDisk,
+		EnforceDisk:      cmdEnforceDisk,
+		Fingerprint:      cmdFingerprint,
+		CoreDumps:        cmdCoreDumps,
+		CoreDest:         cmdCoreDest,
+		Report:           cmdReport,
+		Datacentre:       cmdDatacentre,
+		OutputDest:       cmdOutputDest,
+		Shell:            cmdShell,
+		Arch:             cmdArch,
 		Override:         cmdOvr,
 		Priority:         cmdPri,
 		Retries:          cmdRet,
@@ -370,9 +796,16 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 		CloudOS:          cmdOsPrefix,
 		CloudUser:        cmdOsUsername,
 		CloudScript:      cmdPostCreationScript,
+		CloudScriptVars:  cmdScriptVars,
 		CloudConfigFiles: cmdCloudConfigs,
 		CloudOSRam:       cmdOsRAM,
 		CloudFlavor:      cmdFlavor,
+		CloudScratch:     cmdScratch,
+		StartRate:        cmdStartRate,
+		HostSetup:        cmdHostSetup,
+		HostCleanup:      cmdHostCleanup,
+		MaxPerHost:       cmdMaxPerHost,
+		CallbackURL:      cmdCallbackURL,
 	}
 
 	if jd.RepGrp == "" {
@@ -383,25 +816,47 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 	if cmdMem == "" {
 		jd.Memory = 0
 	} else {
-		mb, errf := bytefmt.ToMegabytes(cmdMem)
+		mb, errf := jobqueue.ParseMemory(cmdMem)
 		if errf != nil {
 			die("--memory was not specified correctly: %s", errf)
 		}
-		jd.Memory = int(mb)
+		jd.Memory = mb
+	}
+	if cmdIdealMem != "" {
+		mb, errf := jobqueue.ParseMemory(cmdIdealMem)
+		if errf != nil {
+			die("--ideal_memory was not specified correctly: %s", errf)
+		}
+		jd.IdealMemory = mb
 	}
 	if cmdTime == "" {
 		jd.Time = 0 * time.Second
 	} else {
-		jd.Time, err = time.ParseDuration(cmdTime)
+		jd.Time, err = jobqueue.ParseDuration(cmdTime)
 		if err != nil {
 			die("--time was not specified correctly: %s", err)
 		}
 	}
 
+	if cmdSecrets != "" {
+		jd.Secrets = strings.Split(cmdSecrets, ",")
+	}
+
+	if cmdLabels != "" {
+		jd.Labels, err = jobqueue.ParseLabels(cmdLabels)
+		if err != nil {
+			die("--labels was not specified correctly: %s", err)
+		}
+	}
+
 	if cmdDepGroups != "" {
 		jd.DepGroups = strings.Split(cmdDepGroups, ",")
 	}
 
+	if cmdLimitGroups != "" {
+		jd.LimitGroups = strings.Split(cmdLimitGroups, ",")
+	}
+
 	if cmdCmdDeps != "" {
 		cols := strings.Split(cmdCmdDeps, ",")
 		if len(cols)%2 != 0 {
@@ -442,6 +897,48 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 		jd.MountConfigs = mountParse(mountJSON, mountSimple)
 	}
 
+	if cmdLimits != "" {
+		jd.Limits, err = jobqueue.ParseProcessLimits(cmdLimits)
+		if err != nil {
+			die("bad --limits: %s", err)
+		}
+	}
+
+	if cmdRetryDelay != "" {
+		jd.RetryDelay, err = jobqueue.ParseRetryDelay(cmdRetryDelay)
+		if err != nil {
+			die("bad --retry_delay: %s", err)
+		}
+	}
+
+	if cmdSandbox != "" {
+		jd.Sandbox, err = jobqueue.ParseSandboxPolicy(cmdSandbox)
+		if err != nil {
+			die("bad --sandbox: %s", err)
+		}
+	}
+
+	if cmdOutputFilter != "" {
+		jd.OutputFilter, err = jobqueue.ParseOutputFilter(cmdOutputFilter)
+		if err != nil {
+			die("bad --output_filter: %s", err)
+		}
+	}
+
+	if cmdContainer != "" {
+		jd.Container, err = jobqueue.ParseContainer(cmdContainer)
+		if err != nil {
+			die("bad --container: %s", err)
+		}
+	}
+
+	if cmdStartDeadline != "" {
+		jd.StartDeadline, err = jobqueue.ParseStartDeadline(cmdStartDeadline)
+		if err != nil {
+			die("bad --start_deadline: %s", err)
+		}
+	}
+
 	// open file or set up to read from STDIN
 	var reader io.Reader
 	if cmdFile == "-" {
@@ -479,8 +976,26 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 	scanner := bufio.NewScanner(reader)
 	defaultedRepG := false
 	lineNum := 0
+	var phaseNum, phaseJobs int
+	var phaseGroup, prevPhaseGroup string
+	if cmdPhases {
+		phaseNum = 1
+		phaseGroup = phaseDepGroup(phaseNum, "")
+	}
 	for scanner.Scan() {
 		lineNum++
+		if name, isMarker := phaseName(scanner.Text()); cmdPhases && isMarker {
+			// a marker at the start of the file, or straight after another,
+			// just names the current phase
+			if phaseJobs > 0 {
+				prevPhaseGroup = phaseGroup
+				phaseNum++
+				phaseJobs = 0
+			}
+			phaseGroup = phaseDepGroup(phaseNum, name)
+			continue
+		}
+
 		cols := strings.Split(scanner.Text(), "\t")
 		colsn := len(cols)
 		if colsn < 1 || cols[0] == "" {
@@ -530,12 +1045,56 @@ func parseCmdFile(jq *jobqueue.Client) ([]*jobqueue.Job, bool, bool) {
 			die("line %d had a problem: %s\n", lineNum, errf)
 		}
 
+		if cmdPhases {
+			// (copy, since these may be shared with jd and other jobs)
+			job.DepGroups = append(append([]string{}, job.DepGroups...), phaseGroup)
+			if prevPhaseGroup != "" {
+				job.Dependencies = append(append(jobqueue.Dependencies{}, job.Dependencies...), jobqueue.NewDepGroupDependency(prevPhaseGroup))
+			}
+			phaseJobs++
+		}
+
 		jobs = append(jobs, job)
 	}
 
 	return jobs, isLocal, defaultedRepG
 }
 
+// phaseName tells you if the given line from the cmd file is a phase marker,
+// and if so returns the (possibly empty) name given after it. Lines like
+// "#phases" or "#phase2" are not markers.
+func phaseName(line string) (string, bool) {
+	if !strings.HasPrefix(line, phaseMarker) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(line, phaseMarker)
+	if rest != "" {
+		r, _ := utf8.DecodeRuneInString(rest)
+		if !unicode.IsSpace(r) {
+			return "", false
+		}
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// phaseDepGroup returns the dep_grp for the given phase in --phases mode.
+func phaseDepGroup(num int, name string) string {
+	if name == "" {
+		name = fmt.Sprintf("phase%d", num)
+	}
+	return cmdRepGroup + "." + name
+}
+
+// managerIsLocal tells you if the manager jq is connected to is running on the
+// same host as us.
+func managerIsLocal(jq *jobqueue.Client) bool {
+	currentIP, err := jobqueue.CurrentIP("")
+	if err != nil {
+		warn("Could not get current IP: %s", err)
+	}
+	return currentIP+":"+config.ManagerPort == jq.ServerInfo.Addr
+}
+
 // copyCloudConfigFiles copies local config files to the manager's machine to a
 // path based on the file's MD5, and then returns an altered input value to use
 // the MD5 paths as the sources, keeping the desired destinations. It does not
@@ -558,7 +1117,7 @@ func copyCloudConfigFiles(jq *jobqueue.Client, configFiles string) string {
 			desired = parts[0]
 		}
 
-		remote, err := jq.UploadFile(local, desired)
+		remote, err := jq.UploadFile(local, "")
 		if err != nil {
 			warn("failed to open file %s: %s", local, err)
 			remoteConfigFiles = append(remoteConfigFiles, cf)
@@ -0,0 +1,109 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var adjustRepGroup string
+var adjustMem string
+var adjustTime string
+var adjustCPUs int
+var adjustDisk int
+
+// adjustCmd represents the adjust command
+var adjustCmd = &cobra.Command{
+	Use:   "adjust",
+	Short: "Change the resource requirements of queued commands",
+	Long: `You can change the resource requirements of commands you've
+previously added with "wr add" that have not yet run, using this command.
+
+This is useful if you discover that all the commands in a group need more
+memory or time than you said, since you won't have to remove and re-add them.
+
+Specify the rep_grp of the commands you want to change with -i, and then any of
+--memory, --time, --cpus and --disk; the requirements you don't specify are left
+as they were. All the incomplete commands in that rep_grp that are not currently
+running will be affected (running ones carry on with the resources they were
+given).
+
+Commands waiting to run will have runners with the new requirements scheduled
+for them, and any pending runners for their old requirements that are no longer
+needed will be cancelled.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if adjustRepGroup == "" {
+			die("--identifier is required")
+		}
+
+		change := &jobqueue.ReqChange{Cores: adjustCPUs, Disk: adjustDisk}
+		if adjustMem != "" {
+			mb, err := jobqueue.ParseMemory(adjustMem)
+			if err != nil {
+				die("--memory was not specified correctly: %s", err)
+			}
+			change.RAM = mb
+		}
+		if adjustTime != "" {
+			d, err := jobqueue.ParseDuration(adjustTime)
+			if err != nil {
+				die("--time was not specified correctly: %s", err)
+			}
+			change.Time = d
+		}
+		if change.RAM <= 0 && change.Time <= 0 && change.Cores <= 0 && change.Disk <= 0 {
+			die("at least one of --memory, --time, --cpus or --disk is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		modified, err := jq.ModifyRequirements(adjustRepGroup, change)
+		if err != nil {
+			die("failed to change requirements: %s", err)
+		}
+		if modified == 0 {
+			die("No matching queued commands found")
+		}
+		info("Changed the requirements of %d commands", modified)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(adjustCmd)
+
+	// flags specific to this sub-command
+	adjustCmd.Flags().StringVarP(&adjustRepGroup, "identifier", "i", "", "rep_grp of the commands you want to change")
+	adjustCmd.Flags().StringVarP(&adjustMem, "memory", "m", "", "new peak mem est. [specify units such as M for Megabytes or G for Gigabytes]")
+	adjustCmd.Flags().StringVarP(&adjustTime, "time", "t", "", "new max time est. [specify units such as m for minutes, h for hours or d for days]")
+	adjustCmd.Flags().IntVar(&adjustCPUs, "cpus", 0, "new cpu cores needed")
+	adjustCmd.Flags().IntVar(&adjustDisk, "disk", 0, "new number of GB of disk space required")
+
+	adjustCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -28,10 +28,12 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/fatih/color"
 	"github.com/inconshreveable/log15"
 	"github.com/kardianos/osext"
@@ -62,7 +64,9 @@ var osUsername string
 var osRAM int
 var osDisk int
 var flavorRegex string
+var archFlavors string
 var postCreationScript string
+var flavorScripts string
 var postDeploymentScript string
 var cloudGatewayIP string
 var cloudCIDR string
@@ -176,7 +180,24 @@ http:// urls, this is most likely to succeed if you use an IP address instead of
 a domain name. For https:// urls you'll need a domain name, and will have to
 ask your administrator for the appropriate --network_dns settings (or clouddns
 config option) to use; the DNS must be able to resolve the domain name from
-within OpenStack.`,
+within OpenStack.
+
+The terraform provider instead creates servers by applying a Terraform module
+you supply, letting you deploy to any cloud Terraform supports. It needs
+WR_TERRAFORM_MODULE to be set to the path of your module's directory, and a
+terraform executable in your PATH (or at the path in WR_TERRAFORM_BIN). Your
+module must create a single server, declaring the input variables name,
+resource_name, image, flavor, disk_gb, external_ip, user_data, public_key,
+ports, cidr, gateway_ip and dns_name_servers, and the outputs id and ip. It must
+pass user_data to the server as a cloud-init script and authorize public_key
+for ssh by the --username user. The module directory must also contain a
+flavors.json file listing the flavors the module can create, like:
+[{"id":"m1","name":"small","cores":1,"ram":2048,"disk":20}]
+Each server's Terraform state is kept in WR_TERRAFORM_STATE_DIR (default
+~/.wr_terraform). The files of your module are copied to the deployed server,
+but any credentials Terraform needs must be made available there yourself (eg.
+with --config_files), and your --os image must have terraform installed (or
+your --script must install it).`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if providerName == "" {
 			die("--provider is required")
@@ -196,6 +217,10 @@ within OpenStack.`,
 				die("--script %s could not be read: %s", postCreationScript, err)
 			}
 		}
+		if flavorScripts != "" {
+			// (just to check they're all valid and readable)
+			parseFlavorScripts(flavorScripts)
+		}
 
 		// first we need our working directory to exist
 		createWorkingDir()
@@ -368,6 +393,12 @@ within OpenStack.`,
 		}
 
 		info("should you need to, you can ssh to this server using `ssh -i %s %s@%s`", keyPath, osUsername, server.IP)
+
+		// remember how to get to the server, so that wr ssh can go via it
+		err = ioutil.WriteFile(cloudHeadPath(providerName), []byte(osUsername+"@"+server.IP), 0600)
+		if err != nil {
+			warn("failed to record the server's address: %s", err)
+		}
 		token, err := token()
 		if err != nil {
 			warn("token could not be read! [%s]", err)
@@ -394,6 +425,48 @@ within OpenStack.`,
 	},
 }
 
+// status sub-command shows the servers the manager has spawned
+var cloudStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the servers the manager has spawned",
+	Long: `Show the servers that the manager (eg. one brought up by 'wr cloud
+deploy') has spawned to run your commands.
+
+For each server its name, IP, flavor and OS image are shown, along with the
+version of the start-up script it ran (see --script and --flavor_scripts of
+'wr cloud deploy', and --cloud_script and --cloud_script_vars of 'wr add'), and
+whether it has gone bad. The version is a short checksum of the script as it
+was run, so servers with the same version ran identical scripts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		servers, err := jq.GetCloudServers()
+		if errd := jq.Disconnect(); errd != nil {
+			warn("Disconnecting from the server failed: %s", errd)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+		if len(servers) == 0 {
+			info("The manager has no spawned servers (or is not using a cloud scheduler)")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "name\tip\tflavor\tos\tscript\tbad")
+		for _, s := range servers {
+			version := s.ScriptVersion
+			if version == "" {
+				version = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", s.Name, s.IP, s.Flavor, s.OS, version, s.Bad)
+		}
+		err = w.Flush()
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
 // teardown sub-command deletes all cloud resources we created and then stops
 // the daemon by sending it a term signal
 var cloudTearDownCmd = &cobra.Command{
@@ -476,11 +549,11 @@ and accessible.`,
 					syncMsg = " and local database updated"
 				}
 
-				ok := jq.ShutdownServer()
-				if ok {
+				errs := jq.ShutdownServerWithin(jobqueue.ClientShutdownWait)
+				if errs == nil {
 					info("the remote wr manager was shut down" + syncMsg)
 				} else {
-					msg := "there was an error trying to shut down the remote wr manager"
+					msg := "there was an error trying to shut down the remote wr manager: " + errs.Error()
 					if forceTearDown {
 						warn(msg + noManagerForcedMsg)
 						serverHadProblems = true
@@ -551,6 +624,10 @@ and accessible.`,
 		if err != nil {
 			warn("failed to delete the cloud resources file: %s", err)
 		}
+		err = os.Remove(cloudHeadPath(providerName))
+		if err != nil && !os.IsNotExist(err) {
+			warn("failed to delete the server address file: %s", err)
+		}
 		info("deleted all cloud resources previously created")
 
 		err = os.Remove(config.ManagerTokenFile)
@@ -585,16 +662,19 @@ func init() {
 	RootCmd.AddCommand(cloudCmd)
 	cloudCmd.AddCommand(cloudDeployCmd)
 	cloudCmd.AddCommand(cloudTearDownCmd)
+	cloudCmd.AddCommand(cloudStatusCmd)
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(appLogger)
-	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudDeployCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack','terraform'] cloud provider")
 	cloudDeployCmd.Flags().StringVarP(&osPrefix, "os", "o", defaultConfig.CloudOS, "prefix of name, or ID, of the OS image your servers should use")
 	cloudDeployCmd.Flags().StringVarP(&osUsername, "username", "u", defaultConfig.CloudUser, "username needed to log in to the OS image specified by --os")
 	cloudDeployCmd.Flags().IntVarP(&osRAM, "os_ram", "r", defaultConfig.CloudRAM, "ram (MB) needed by the OS image specified by --os")
 	cloudDeployCmd.Flags().IntVarP(&osDisk, "os_disk", "d", defaultConfig.CloudDisk, "minimum disk (GB) for servers")
 	cloudDeployCmd.Flags().StringVarP(&flavorRegex, "flavor", "f", defaultConfig.CloudFlavor, "a regular expression to limit server flavors that can be automatically picked")
+	cloudDeployCmd.Flags().StringVar(&archFlavors, "arch_flavors", defaultConfig.CloudArchFlavors, "comma separated arch=regex pairs describing which server flavors have which CPU architecture, eg. 'aarch64=^a1\\.'")
 	cloudDeployCmd.Flags().StringVarP(&postCreationScript, "script", "s", defaultConfig.CloudScript, "path to a start-up script that will be run on each server created")
+	cloudDeployCmd.Flags().StringVar(&flavorScripts, "flavor_scripts", defaultConfig.CloudFlavorScripts, "comma separated regex=path pairs giving start-up scripts to run instead of --script on servers with matching flavors")
 	cloudDeployCmd.Flags().StringVarP(&postDeploymentScript, "on_success", "x", defaultConfig.DeploySuccessScript, "path to a script to run locally after a successful deployment")
 	cloudDeployCmd.Flags().IntVarP(&serverKeepAlive, "keepalive", "k", defaultConfig.CloudKeepAlive, "how long in seconds to keep idle spawned servers alive for; 0 means forever")
 	cloudDeployCmd.Flags().IntVarP(&maxServers, "max_servers", "m", defaultConfig.CloudServers+1, "maximum number of servers to spawn; 0 means unlimited (default 0)")
@@ -606,9 +686,11 @@ func init() {
 	cloudDeployCmd.Flags().BoolVar(&setDomainIP, "set_domain_ip", defaultConfig.ManagerSetDomainIP, "on success, use infoblox to set your domain's IP")
 	cloudDeployCmd.Flags().BoolVar(&cloudDebug, "debug", false, "include extra debugging information in the logs")
 
-	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack'] cloud provider")
+	cloudTearDownCmd.Flags().StringVarP(&providerName, "provider", "p", "openstack", "['openstack','terraform'] cloud provider")
 	cloudTearDownCmd.Flags().BoolVarP(&forceTearDown, "force", "f", false, "force teardown even when the remote manager cannot be accessed")
 	cloudTearDownCmd.Flags().BoolVar(&cloudDebug, "debug", false, "show details of the teardown process")
+
+	cloudStatusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
 
 func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe string, mp int, wp int, keyPath string, wrMayHaveStarted bool) {
@@ -727,6 +809,14 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 			if val == "" {
 				continue
 			}
+			if env == "WR_TERRAFORM_MODULE" {
+				// the remote manager needs its own copy of the module
+				val, err = uploadTerraformModule(server, val)
+				if err != nil {
+					teardown(provider)
+					die("failed to copy your terraform module to the server at %s: %s", server.IP, err)
+				}
+			}
 			// *** this is bash-like only; is that a problem?
 			envvarExports += fmt.Sprintf("export %s=\"%s\"\n", env, val)
 		}
@@ -753,6 +843,22 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 
 			postCreationArg = " -p " + remoteScriptFile
 		}
+		if flavorScripts != "" {
+			// likewise for the scripts of particular flavors
+			var remotePairs []string
+			for i, pair := range strings.Split(flavorScripts, ",") {
+				parts := strings.SplitN(pair, "=", 2)
+				remoteScriptFile := filepath.Join("./.wr_"+config.Deployment, fmt.Sprintf("cloud_resources.%s.script.%d", providerName, i+1))
+				err = server.UploadFile(internal.TildaToHome(strings.TrimSpace(parts[1])), remoteScriptFile)
+				if err != nil && !wrMayHaveStarted {
+					teardown(provider)
+					die("failed to upload wr cloud flavor script file to the server at %s: %s", server.IP, err)
+				}
+				remotePairs = append(remotePairs, strings.TrimSpace(parts[0])+"="+remoteScriptFile)
+			}
+
+			postCreationArg += " --cloud_flavor_scripts '" + strings.Join(remotePairs, ",") + "'"
+		}
 
 		var configFilesArg string
 		if cloudConfigFiles != "" {
@@ -774,6 +880,9 @@ func bootstrapOnRemote(provider *cloud.Provider, server *cloud.Server, exe strin
 		if flavorRegex != "" {
 			flavorArg = " -l '" + flavorRegex + "'"
 		}
+		if archFlavors != "" {
+			flavorArg += " --cloud_arch_flavors '" + archFlavors + "'"
+		}
 
 		var osDiskArg string
 		if osDisk > 0 {
@@ -909,6 +1018,27 @@ func killProcess(pid int) error {
 	return process.Signal(syscall.Signal(9))
 }
 
+// uploadTerraformModule copies the files in the given local terraform module
+// directory to the given server, returning the path of the remote copy.
+// Sub-directories are not copied.
+func uploadTerraformModule(server *cloud.Server, module string) (string, error) {
+	remoteModule := filepath.Join("./.wr_"+config.Deployment, "terraform_module")
+	entries, err := ioutil.ReadDir(module)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		err = server.UploadFile(filepath.Join(module, entry.Name()), filepath.Join(remoteModule, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+	}
+	return remoteModule, nil
+}
+
 func teardown(p *cloud.Provider) {
 	err := p.TearDown()
 	if err != nil {
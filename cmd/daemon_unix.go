@@ -0,0 +1,124 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package cmd
+
+// This file contains the unix-specific code for running the manager as a
+// daemon.
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sevlyar/go-daemon"
+)
+
+// daemonize spawns a child copy of ourselves with the correct deployment (we
+// need to be careful because the default deployment depends on current dir, and
+// the child is forced to run from /). Supplying extraArgs can override earlier
+// args (to eg. re-specify an option with a relative path with an absolute
+// path). In the child, the returned function should be called before it exits.
+func daemonize(pidFile string, umask int, extraArgs ...string) (*os.Process, func() error) {
+	args := os.Args
+	hadDeployment := false
+	for _, arg := range args {
+		if arg == "--deployment" {
+			hadDeployment = true
+			break
+		}
+	}
+	if !hadDeployment {
+		args = append(args, "--deployment")
+		args = append(args, config.Deployment)
+	}
+
+	args = append(args, extraArgs...)
+
+	context := &daemon.Context{
+		PidFileName: pidFile,
+		PidFilePerm: 0644,
+		WorkDir:     "/",
+		Args:        args,
+		Umask:       umask,
+	}
+
+	child, err := context.Reborn()
+	if err != nil {
+		die("failed to daemonize: %s", err)
+	}
+	return child, context.Release
+}
+
+// stopdaemon stops the daemon created by daemonize() by sending it SIGTERM and
+// checking it really exited
+func stopdaemon(pid int, source string) bool {
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		warn("wr manager is running with pid %d according to %s, but failed to send it SIGTERM: %s", pid, source, err)
+		return false
+	}
+
+	// wait a while for the daemon to gracefully close down
+	giveupseconds := 120
+	giveup := time.After(time.Duration(giveupseconds) * time.Second)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	stopped := make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				err = syscall.Kill(pid, syscall.Signal(0))
+				if err == nil {
+					// pid is still running
+					continue
+				}
+				// assume the error was "no such process" *** should I do a string comparison to confirm?
+				ticker.Stop()
+				stopped <- true
+				return
+			case <-giveup:
+				ticker.Stop()
+				stopped <- false
+				return
+			}
+		}
+	}()
+	ok := <-stopped
+
+	// if it didn't stop, offer to force kill it? That's a bit dangerous...
+	// just warn for now
+	if !ok {
+		warn("wr manager, running with pid %d according to %s, is still running %ds after I sent it a SIGTERM", pid, source, giveupseconds)
+	}
+
+	return ok
+}
+
+// readPidFile returns the pid stored in the given pid file by daemonize().
+func readPidFile(pidFile string) (int, error) {
+	return daemon.ReadPidFile(pidFile)
+}
+
+// setUmask sets our umask.
+func setUmask(umask int) {
+	syscall.Umask(umask)
+}
@@ -0,0 +1,80 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+// This file contains the Windows-specific code for running the manager, which
+// can't be daemonized there.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// daemonize dies, since we can't daemonize on Windows.
+func daemonize(pidFile string, umask int, extraArgs ...string) (*os.Process, func() error) {
+	die("wr manager can't run as a daemon on Windows; use --foreground")
+	return nil, nil
+}
+
+// stopdaemon kills the process with the given pid and checks it really
+// exited. Unlike on unix, this isn't graceful, since Windows has no SIGTERM.
+func stopdaemon(pid int, source string) bool {
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		err = process.Kill()
+	}
+	if err != nil {
+		warn("wr manager is running with pid %d according to %s, but failed to kill it: %s", pid, source, err)
+		return false
+	}
+
+	giveupseconds := 120
+	exited := make(chan bool, 1)
+	go func() {
+		_, errw := process.Wait()
+		exited <- errw == nil
+	}()
+	select {
+	case ok := <-exited:
+		return ok
+	case <-time.After(time.Duration(giveupseconds) * time.Second):
+		warn("wr manager, running with pid %d according to %s, is still running %ds after I killed it", pid, source, giveupseconds)
+		return false
+	}
+}
+
+// readPidFile returns the pid stored in the given pid file.
+func readPidFile(pidFile string) (int, error) {
+	content, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("pid file %s is invalid: %s", pidFile, err)
+	}
+	return pid, nil
+}
+
+// setUmask does nothing, since Windows has no umask.
+func setUmask(umask int) {}
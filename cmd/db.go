@@ -0,0 +1,158 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var dbTopRepGroups int
+var dbExport string
+
+// dbCmd represents the db command
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Work with the manager's database",
+	Long: `Work with the manager's database directly.
+
+These sub-commands do not need (and will not work while there is) a running
+manager that is using the database.`,
+}
+
+// inspect sub-command reports on a database file
+var dbInspectCmd = &cobra.Command{
+	Use:   "inspect [DB-FILE]",
+	Short: "Report on the contents of a database",
+	Long: `Report on the contents and health of a manager's database.
+
+Give the path to a database file, or a backup of one; it defaults to the
+database of the manager for the current deployment (see the managerdbfile config
+option). The file is opened read-only and is not altered in any way, so you can
+use this for post-mortem analysis after losing the manager's host, as long as
+you still have its database or a backup of it.
+
+You will see how many commands there are in each state, the identifiers
+(RepGroups) with the most commands, the number of entries in each part of the
+database, and any problems found with it. Note that the states of incomplete
+commands are only those last stored: in particular, commands that were ready
+or reserved when the manager stopped may be reported as new or delayed.
+
+With --export, every command is also written as JSON to the given file (- for
+STDOUT), one command per line, in the same form as the status web interface
+uses.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := config.ManagerDbFile
+		if len(args) == 1 {
+			path = args[0]
+		}
+
+		insp, err := jobqueue.InspectDB(path, dbTopRepGroups)
+		if err != nil {
+			die("could not inspect %s: %s", path, err)
+		}
+
+		fmt.Printf("Database: %s (%s)\n", insp.Path, bytefmt.ByteSize(uint64(insp.Size)))
+
+		total := 0
+		states := make([]string, 0, len(insp.States))
+		for state, count := range insp.States {
+			states = append(states, string(state))
+			total += count
+		}
+		sort.Strings(states)
+		fmt.Printf("\nCommands: %d\n", total)
+		for _, state := range states {
+			fmt.Printf("  %s: %d\n", state, insp.States[jobqueue.JobState(state)])
+		}
+
+		if len(insp.RepGroups) > 0 {
+			fmt.Printf("\nLargest identifiers:\n")
+			for _, rgc := range insp.RepGroups {
+				rgTotal := 0
+				for _, count := range rgc.Counts {
+					rgTotal += count
+				}
+				fmt.Printf("  %s: %d\n", rgc.RepGroup, rgTotal)
+			}
+		}
+
+		buckets := make([]string, 0, len(insp.Buckets))
+		for bucket := range insp.Buckets {
+			buckets = append(buckets, bucket)
+		}
+		sort.Strings(buckets)
+		fmt.Printf("\nEntries:\n")
+		for _, bucket := range buckets {
+			fmt.Printf("  %s: %d\n", bucket, insp.Buckets[bucket])
+		}
+
+		fmt.Printf("\nHealth: ")
+		if insp.Healthy() {
+			fmt.Printf("OK\n")
+		} else {
+			fmt.Printf("PROBLEMS FOUND\n")
+		}
+		if insp.JournalOps > 0 {
+			fmt.Printf("  %d journalled writes not yet applied (a manager would apply them on start up)\n", insp.JournalOps)
+		}
+		if insp.Undecodable > 0 {
+			fmt.Printf("  %d commands could not be decoded\n", insp.Undecodable)
+		}
+		for _, problem := range insp.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+
+		if dbExport != "" {
+			out := os.Stdout
+			if dbExport != "-" {
+				out, err = os.Create(dbExport)
+				if err != nil {
+					die("could not create %s: %s", dbExport, err)
+				}
+			}
+			n, err := jobqueue.ExportDBJobs(path, out)
+			if err != nil {
+				die("export failed: %s", err)
+			}
+			if out != os.Stdout {
+				err = out.Close()
+				if err != nil {
+					die("could not close %s: %s", dbExport, err)
+				}
+				info("Exported %d commands to %s", n, dbExport)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbInspectCmd)
+
+	dbInspectCmd.Flags().IntVarP(&dbTopRepGroups, "top", "t", 10, "how many of the largest identifiers to list")
+	dbInspectCmd.Flags().StringVarP(&dbExport, "export", "e", "", "file to write every command to as JSON; - means STDOUT")
+}
@@ -0,0 +1,162 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var envProfileMinimal bool
+var envProfileInclude string
+var envProfileExclude string
+
+// envProfileCmd represents the envprofile command
+var envProfileCmd = &cobra.Command{
+	Use:   "envprofile",
+	Short: "Manage stored environments for your commands",
+	Long: `Manage named environment profiles that your commands can run in.
+
+Normally 'wr add' captures your whole environment and stores it with the
+commands you add. Instead you can store an environment once under a name, and
+then have commands run in it with 'wr add --env_profile NAME'. This lets you
+share a known-good environment between users without exposing your own
+variables, and avoids storing a new copy of it with every submission.`,
+}
+
+// set sub-command stores a profile
+var envProfileSetCmd = &cobra.Command{
+	Use:   "set NAME",
+	Short: "Store your current environment as a profile",
+	Long: `Store your current environment variables under the given name,
+replacing any existing profile with that name.
+
+The --minimal, --include and --exclude options work like the --env_* options of
+'wr add' to control which variables are captured. Replacing a profile does not
+affect commands that were already added using it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		envVars := filteredEnviron(envProfileMinimal, envProfileInclude, envProfileExclude)
+		if len(envVars) == 0 {
+			die("no environment variables were captured")
+		}
+
+		jq := envProfileConnect()
+		defer envProfileDisconnect(jq)
+
+		err := jq.SetEnvProfile(args[0], envVars)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Stored %d environment variables as profile %s", len(envVars), args[0])
+	},
+}
+
+// delete sub-command removes a profile
+var envProfileDeleteCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete an environment profile",
+	Long: `Delete the environment profile with the given name.
+
+Commands already added using it are not affected.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := envProfileConnect()
+		defer envProfileDisconnect(jq)
+
+		err := jq.DeleteEnvProfile(args[0])
+		if err != nil {
+			die("%s", err)
+		}
+		info("Deleted environment profile %s", args[0])
+	},
+}
+
+// list sub-command shows the names of stored profiles
+var envProfileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of stored environment profiles",
+	Long:  `List the names of all stored environment profiles.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := envProfileConnect()
+		defer envProfileDisconnect(jq)
+
+		names, err := jq.GetEnvProfileNames()
+		if err != nil {
+			die("%s", err)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(envProfileCmd)
+	envProfileCmd.AddCommand(envProfileSetCmd)
+	envProfileCmd.AddCommand(envProfileDeleteCmd)
+	envProfileCmd.AddCommand(envProfileListCmd)
+
+	envProfileSetCmd.Flags().BoolVar(&envProfileMinimal, "minimal", false, "only capture the environment variables most commands need")
+	envProfileSetCmd.Flags().StringVar(&envProfileInclude, "include", "", "comma-separated list of patterns; only capture environment variables with matching names")
+	envProfileSetCmd.Flags().StringVar(&envProfileExclude, "exclude", "", "comma-separated list of patterns; don't capture environment variables with matching names")
+
+	envProfileCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// filteredEnviron returns os.Environ(), filtered to the minimal set of
+// variables if minimal, and by the given comma-separated include and exclude
+// patterns.
+func filteredEnviron(minimal bool, include, exclude string) []string {
+	var includes, excludes []string
+	if minimal {
+		includes = append(includes, jobqueue.EnvMinimal...)
+	}
+	if include != "" {
+		includes = append(includes, strings.Split(include, ",")...)
+	}
+	if exclude != "" {
+		excludes = strings.Split(exclude, ",")
+	}
+	if len(includes) == 0 && len(excludes) == 0 {
+		return os.Environ()
+	}
+	return jobqueue.FilterEnv(os.Environ(), includes, excludes)
+}
+
+// envProfileConnect connects to the manager for the envprofile sub-commands.
+func envProfileConnect() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// envProfileDisconnect disconnects from the manager, warning on failure.
+func envProfileDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// limitCmd represents the limit command
+var limitCmd = &cobra.Command{
+	Use:   "limit",
+	Short: "Manage limit groups",
+	Long: `Manage the limits of limit groups, which cap how many commands in each
+group may run at once.
+
+Commands join limit groups when added with 'wr add --limit_grps' (or
+"limit_grps" in its JSON input), regardless of their rep_grp. This lets you
+protect a shared service that lots of different commands use, eg. so that no
+more than 20 commands that write to a certain database run at once:
+
+wr add --limit_grps db-writes -f cmds.txt
+wr limit set db-writes=20
+
+Limits can be changed while commands are running, without restarting the
+manager: raising a limit lets waiting commands start, while lowering it below
+the number currently running stops more from starting until enough have
+finished. A limit of 0 stops any more commands in the group from starting.
+Groups that have not been given a limit are unlimited.`,
+}
+
+// set sub-command sets the limits of groups
+var limitSetCmd = &cobra.Command{
+	Use:   "set GROUP=LIMIT [GROUP=LIMIT...]",
+	Short: "Set the limits of limit groups",
+	Long: `Set the maximum number of commands in each of the given limit groups that
+may run at once, replacing any existing limits for those groups.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		groups := make([]*jobqueue.LimitGroup, len(args))
+		for i, arg := range args {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				die("'%s' is not like GROUP=LIMIT", arg)
+			}
+			limit, err := strconv.Atoi(parts[1])
+			if err != nil || limit < 0 {
+				die("the limit in '%s' is not a whole number of 0 or more", arg)
+			}
+			groups[i] = &jobqueue.LimitGroup{Name: parts[0], Limit: limit}
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer limitDisconnect(jq)
+
+		err := jq.SetLimitGroups(groups)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Set the limits of %d limit groups", len(groups))
+	},
+}
+
+// delete sub-command removes the limits of groups
+var limitDeleteCmd = &cobra.Command{
+	Use:   "delete GROUP [GROUP...]",
+	Short: "Remove the limits of limit groups",
+	Long: `Remove the limits of the given limit groups, so that any number of their
+commands may run at once.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer limitDisconnect(jq)
+
+		deleted, err := jq.DeleteLimitGroups(args)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Removed the limits of %d limit groups", deleted)
+	},
+}
+
+// list sub-command shows the current limits
+var limitListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List limit groups",
+	Long: `List the limit groups that have a limit or running commands, along with
+their limit and how many of their commands are currently running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer limitDisconnect(jq)
+
+		groups, err := jq.GetLimitGroups()
+		if err != nil {
+			die("%s", err)
+		}
+		for _, group := range groups {
+			limit := "unlimited"
+			if group.Limit >= 0 {
+				limit = strconv.Itoa(group.Limit)
+			}
+			fmt.Printf("%s\t%d running\tlimit %s\n", group.Name, group.Running, limit)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(limitCmd)
+	limitCmd.AddCommand(limitSetCmd)
+	limitCmd.AddCommand(limitDeleteCmd)
+	limitCmd.AddCommand(limitListCmd)
+
+	limitCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// limitDisconnect disconnects from the manager, warning on failure.
+func limitDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
@@ -19,10 +19,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -35,8 +38,8 @@ import (
 	"github.com/inconshreveable/log15"
 	"github.com/kardianos/osext"
 	"github.com/sb10/l15h"
-	"github.com/sevlyar/go-daemon"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // options for this cmd
@@ -46,6 +49,22 @@ var localUsername string
 var backupPath string
 var managerTimeoutSeconds int
 var managerDebug bool
+var managerFairShare bool
+var managerShareWeights string
+var managerReattachGrace int
+var managerDrainDeadline string
+var managerDrainStatus bool
+var managerUploadGC int
+var managerTrashKeep int
+var managerTimelineInterval int
+var managerTimelineKeep int
+var managerSlowRequest int
+var managerCmdWrapper string
+var managerCmdWrappers string
+var managerOutputFilter string
+var managerSchedulerExe string
+var mirrorPrimary string
+var mirrorPort string
 
 // managerCmd represents the manager command
 var managerCmd = &cobra.Command{
@@ -83,7 +102,27 @@ you've created yourself, note that --local_username will need to be globally
 unique, since it is used to name the private key that will be created in
 OpenStack, and if a key with that name already exists, the manager will not be
 able to create a new one (or get the existing one), and so will not function
-fully.`,
+fully.
+
+The terraform scheduler works the same way as the OpenStack one, but creates
+servers using a Terraform module you supply; see 'wr cloud deploy -h' for the
+details. You would normally start it using 'wr cloud deploy -p terraform'.
+
+If you have managers in more than one datacentre (eg. one using LSF on-prem and
+another in a cloud region), you can configure this one with the others as peers
+(see the managerdatacentre and managerpeersfile options in wr's config file).
+Then commands added here with 'wr add --datacentre' naming a peer's datacentre
+are forwarded to that peer, and their progress is mirrored back here.
+
+If your site uses a job scheduler that wr doesn't support natively, you can use
+the external scheduler (--scheduler external) and supply an --external
+executable that receives JSON requests to schedule or terminate runners on STDIN
+and replies with JSON on STDOUT. The protocol is described in
+jobqueue/scheduler/external.go in wr's source code.
+
+The simulator scheduler (--scheduler simulator) pretends to be a cloud described
+by the managersimfile option in wr's config file, so you can try out how your
+commands would be scheduled there without using one; see 'wr simulate -h'.`,
 }
 
 // start sub-command starts the daemon
@@ -127,6 +166,13 @@ var managerStartCmd = &cobra.Command{
 			}
 		}
 
+		// (likewise for the scripts of particular flavors)
+		flavorScriptContents, fsAbs := parseFlavorScripts(flavorScripts)
+		if fsAbs != flavorScripts {
+			extraArgs = append(extraArgs, "--cloud_flavor_scripts")
+			extraArgs = append(extraArgs, fsAbs)
+		}
+
 		// delete any old token file, so that we later know when the manager has
 		// created a new one
 		err := os.Remove(config.ManagerTokenFile)
@@ -136,10 +182,10 @@ var managerStartCmd = &cobra.Command{
 
 		// now daemonize unless in foreground mode
 		if foreground {
-			syscall.Umask(config.ManagerUmask)
-			startJQ(postCreation)
+			setUmask(config.ManagerUmask)
+			startJQ(postCreation, flavorScriptContents)
 		} else {
-			child, context := daemonize(config.ManagerPidFile, config.ManagerUmask, extraArgs...)
+			child, release := daemonize(config.ManagerPidFile, config.ManagerUmask, extraArgs...)
 			if child != nil {
 				// parent; wait a while for our child to bring up the manager
 				// before exiting
@@ -157,12 +203,12 @@ var managerStartCmd = &cobra.Command{
 			} else {
 				// daemonized child, that will run until signalled to stop
 				defer func() {
-					err := context.Release()
+					err := release()
 					if err != nil {
 						warn("daemon release failed: %s", err)
 					}
 				}()
-				startJQ(postCreation)
+				startJQ(postCreation, flavorScriptContents)
 			}
 		}
 	},
@@ -175,13 +221,15 @@ var managerStopCmd = &cobra.Command{
 	Long: `Immediately stop the workflow manager, saving its state.
 
 Note that any runners that are currently running will die, along with any
-commands they were running. It is more graceful to use 'drain' instead.`,
+commands they were running (which will be run again once the manager is started
+again, with a failure reason of "manager shut down" that doesn't count against
+their retries). It is more graceful to use 'drain' instead.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// the daemon could be running but be non-responsive, or it could have
 		// exited but left the pid file in place; to best cover all
 		// eventualities we check the pid file first, try and terminate its pid,
 		// then confirm we can't connect
-		pid, err := daemon.ReadPidFile(config.ManagerPidFile)
+		pid, err := readPidFile(config.ManagerPidFile)
 		var stopped bool
 		if err == nil {
 			stopped = stopdaemon(pid, "pid file "+config.ManagerPidFile)
@@ -206,6 +254,7 @@ commands they were running. It is more graceful to use 'drain' instead.`,
 				if err != nil {
 					warn("failed to remove token file: %s", err)
 				}
+				removeReadOnlyTokenFile()
 				return
 			}
 		} else {
@@ -234,11 +283,19 @@ commands they were running. It is more graceful to use 'drain' instead.`,
 			}
 			stopped = stopdaemon(jq.ServerInfo.PID, "the manager itself")
 		} else {
-			// use the client command to stop it
-			stopped = jq.ShutdownServer()
+			// use the client command to stop it; the manager confirms it is
+			// about to stop once it has dealt with its runners and backed up
+			// its database (it stops even if the backup fails)
+			errs := jq.ShutdownServerWithin(jobqueue.ClientShutdownWait)
+			if jqerr, ok := errs.(jobqueue.Error); ok && jqerr.Err == jobqueue.ErrDBError {
+				warn("The remote manager at %s failed to back up its database before shutting down: %s", sAddr, errs)
+				errs = nil
+			} else if errs != nil {
+				warn("The remote manager at %s did not confirm it was shutting down: %s", sAddr, errs)
+			}
+			stopped = errs == nil
 
-			// since I don't trust using a client connection to shut down the
-			// server, double check I can no longer connect
+			// double check I can no longer connect
 			if stopped {
 				jq = connect(1*time.Second, true)
 				if jq != nil {
@@ -254,6 +311,7 @@ commands they were running. It is more graceful to use 'drain' instead.`,
 			if err != nil {
 				warn("failed to remove token file: %s", err)
 			}
+			removeReadOnlyTokenFile()
 		} else {
 			die("I've tried everything; giving up trying to stop the manager at %s", sAddr)
 		}
@@ -273,7 +331,13 @@ running until the drain completes (or the manager is stopped) and the manager is
 then started again.
 
 It is safe to repeat this command to get an update on how long before the drain
-completes.
+completes, or use --status to only get an update, without starting a drain.
+
+If you have a hard deadline, eg. the end of a maintenance window, supply
+--deadline: commands still running once it passes will be killed and the manager
+will stop. Those commands are not counted as failures, and will run again once
+the manager is started again. You can change the deadline by repeating this
+command with a new --deadline.
 
 NB: if using 'wr cloud deploy --deployment production', do not use drain without
 also configuring an S3 location for your database backup, as otherwise any
@@ -286,8 +350,22 @@ down will be lost.`,
 			die("could not connect to the manager on port %s, so could not initiate a drain; has it already been stopped?", config.ManagerPort)
 		}
 
+		if managerDrainStatus {
+			drainStatus(jq)
+			return
+		}
+
+		var deadline time.Duration
+		if managerDrainDeadline != "" {
+			var err error
+			deadline, err = time.ParseDuration(managerDrainDeadline)
+			if err != nil || deadline <= 0 {
+				die("--deadline was not specified correctly: %s", managerDrainDeadline)
+			}
+		}
+
 		// we managed to connect to the daemon; ask it to go in to drain mode
-		numLeft, etc, err := jq.DrainServer()
+		numLeft, etc, err := jq.DrainServerBy(deadline)
 		if err != nil {
 			die("even though I was able to connect to the manager, it failed to enter drain mode: %s", err)
 		}
@@ -299,6 +377,9 @@ down will be lost.`,
 		} else {
 			info("wr manager running on port %s is now draining; there are %d jobs still running, and they should complete in less than %s", config.ManagerPort, numLeft, etc)
 		}
+		if numLeft > 0 && deadline > 0 {
+			info("any jobs still running in %s will be killed", deadline)
+		}
 
 		err = jq.Disconnect()
 		if err != nil {
@@ -314,7 +395,7 @@ var managerStatusCmd = &cobra.Command{
 	Long:  `Find out if the workflow manager is currently running or not.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// see if pid file suggests it is supposed to be running
-		pid, err := daemon.ReadPidFile(config.ManagerPidFile)
+		pid, err := readPidFile(config.ManagerPidFile)
 		if err == nil {
 			// confirm
 			jq := connect(5 * time.Second)
@@ -371,6 +452,58 @@ somewhere.)`,
 	},
 }
 
+// mirror sub-command serves a read-only mirror of the manager's status
+var managerMirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "Serve a read-only mirror of the workflow manager's status",
+	Long: `Serve a read-only copy of the manager's status web interface and REST API.
+
+Many people viewing the status web interface, or scripts frequently querying
+the REST API, all add load to the manager, which can slow down its scheduling
+of your commands. You can instead point them at a mirror: a separate
+lightweight process (on this or another machine) that keeps an up-to-date copy
+of the state of the manager's commands by having every change streamed to it,
+and serves status requests from that.
+
+The mirror connects to the manager at --primary using the manager's read-only
+token, and serves on --port using the manager's certificate, so it is reached
+and authenticated in the same way as the manager's own web interface (using the
+read-only token). Only GET requests to the REST API are supported, and the
+STDOUT/ERR and environment of commands are not available.
+
+The mirror runs in the foreground until interrupted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if mirrorPort == "" {
+			die("--port is required")
+		}
+		token, err := ioutil.ReadFile(config.ManagerReadOnlyTokenFile)
+		if err != nil {
+			die("could not read the manager's read-only token: %s", err)
+		}
+
+		m, err := jobqueue.StartMirror(jobqueue.MirrorConfig{
+			Primary:    mirrorPrimary,
+			CAFile:     caFile,
+			CertDomain: config.ManagerCertDomain,
+			Token:      token,
+			Timeout:    time.Duration(timeoutint) * time.Second,
+			WebPort:    mirrorPort,
+			CertFile:   config.ManagerCertFile,
+			KeyFile:    config.ManagerKeyFile,
+			Logger:     appLogger,
+		})
+		if err != nil {
+			die("could not start the mirror: %s", err)
+		}
+		info("mirroring %s; the web interface can be reached at https://%s:%s/?token=%s", mirrorPrimary, config.ManagerCertDomain, mirrorPort, string(token))
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		m.Stop()
+	},
+}
+
 // reportLiveStatus is used by the status command on a working connection to
 // distinguish between the server being in a normal 'started' state or the
 // 'drain' state.
@@ -385,11 +518,13 @@ func init() {
 	managerCmd.AddCommand(managerStopCmd)
 	managerCmd.AddCommand(managerStatusCmd)
 	managerCmd.AddCommand(managerBackupCmd)
+	managerCmd.AddCommand(managerMirrorCmd)
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(appLogger)
 	managerStartCmd.Flags().BoolVarP(&foreground, "foreground", "f", false, "do not daemonize")
-	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','openstack'] job scheduler")
+	managerStartCmd.Flags().StringVarP(&scheduler, "scheduler", "s", defaultConfig.ManagerScheduler, "['local','lsf','openstack','terraform','external','simulator','ssh','kubernetes'] job scheduler")
+	managerStartCmd.Flags().StringVar(&managerSchedulerExe, "external", defaultConfig.ManagerSchedulerExe, "for the external scheduler, the executable that submits to your job scheduler")
 	managerStartCmd.Flags().IntVarP(&managerTimeoutSeconds, "timeout", "t", 10, "how long to wait in seconds for the manager to start up")
 	managerStartCmd.Flags().StringVarP(&osPrefix, "cloud_os", "o", defaultConfig.CloudOS, "for cloud schedulers, prefix name of the OS image your servers should use")
 	managerStartCmd.Flags().StringVarP(&osUsername, "cloud_username", "u", defaultConfig.CloudUser, "for cloud schedulers, username needed to log in to the OS image specified by --cloud_os")
@@ -397,7 +532,9 @@ func init() {
 	managerStartCmd.Flags().IntVarP(&osRAM, "cloud_ram", "r", defaultConfig.CloudRAM, "for cloud schedulers, ram (MB) needed by the OS image specified by --cloud_os")
 	managerStartCmd.Flags().IntVarP(&osDisk, "cloud_disk", "d", defaultConfig.CloudDisk, "for cloud schedulers, minimum disk (GB) for servers")
 	managerStartCmd.Flags().StringVarP(&flavorRegex, "cloud_flavor", "l", defaultConfig.CloudFlavor, "for cloud schedulers, a regular expression to limit server flavors that can be automatically picked")
+	managerStartCmd.Flags().StringVar(&archFlavors, "cloud_arch_flavors", defaultConfig.CloudArchFlavors, "for cloud schedulers, comma separated arch=regex pairs describing which server flavors have which CPU architecture")
 	managerStartCmd.Flags().StringVarP(&postCreationScript, "cloud_script", "p", defaultConfig.CloudScript, "for cloud schedulers, path to a start-up script that will be run on each server created")
+	managerStartCmd.Flags().StringVar(&flavorScripts, "cloud_flavor_scripts", defaultConfig.CloudFlavorScripts, "for cloud schedulers, comma separated regex=path pairs giving start-up scripts to run instead of --cloud_script on servers with matching flavors")
 	managerStartCmd.Flags().IntVarP(&serverKeepAlive, "cloud_keepalive", "k", defaultConfig.CloudKeepAlive, "for cloud schedulers, how long in seconds to keep idle spawned servers alive for; 0 means forever")
 	managerStartCmd.Flags().IntVarP(&maxServers, "cloud_servers", "m", defaultConfig.CloudServers, "for cloud schedulers, maximum number of additional servers to spawn; -1 means unlimited")
 	managerStartCmd.Flags().StringVar(&cloudGatewayIP, "cloud_gateway_ip", defaultConfig.CloudGateway, "for cloud schedulers, gateway IP for the created subnet")
@@ -405,9 +542,27 @@ func init() {
 	managerStartCmd.Flags().StringVar(&cloudDNS, "cloud_dns", defaultConfig.CloudDNS, "for cloud schedulers, comma separated DNS name server IPs to use in the created subnet")
 	managerStartCmd.Flags().StringVar(&cloudConfigFiles, "cloud_config_files", defaultConfig.CloudConfigFiles, "for cloud schedulers, comma separated paths of config files to copy to spawned servers")
 	managerStartCmd.Flags().BoolVar(&setDomainIP, "set_domain_ip", defaultConfig.ManagerSetDomainIP, "on success, use infoblox to set your domain's IP")
+	managerStartCmd.Flags().BoolVar(&managerFairShare, "fair_share", defaultConfig.ManagerFairShare, "share out runners fairly between commands with different rep_grps")
+	managerStartCmd.Flags().StringVar(&managerShareWeights, "share_weights", defaultConfig.ManagerShareWeights, "with --fair_share, comma separated rep_grp=weight pairs giving the relative weights of rep_grps")
+	managerStartCmd.Flags().IntVar(&managerReattachGrace, "reattach_grace", defaultConfig.ManagerReattachGrace, "how long (seconds) after starting to let the runners of commands that were running get back in touch before those commands are run again")
+	managerStartCmd.Flags().IntVar(&managerUploadGC, "upload_gc", defaultConfig.ManagerUploadGC, "how long (hours) to keep uploaded files that no incomplete commands need; 0 means forever")
+	managerStartCmd.Flags().IntVar(&managerTrashKeep, "trash_keep", defaultConfig.ManagerTrashKeep, "how long (hours) removed commands can be restored for; 0 disables the trash")
+	managerStartCmd.Flags().IntVar(&managerTimelineInterval, "timeline_interval", defaultConfig.ManagerTimelineInterval, "how often (minutes) to record the state of the queue for 'wr stats timeline'; 0 disables recording")
+	managerStartCmd.Flags().IntVar(&managerTimelineKeep, "timeline_keep", defaultConfig.ManagerTimelineKeep, "how long (days) to keep recorded queue states for; 0 means forever")
+	managerStartCmd.Flags().IntVar(&managerSlowRequest, "slow_request", defaultConfig.ManagerSlowRequest, "log a warning about client requests that take at least this long (ms) to handle; 0 disables")
+	managerStartCmd.Flags().StringVar(&managerCmdWrapper, "cmd_wrapper", defaultConfig.ManagerCmdWrapper, "command line that every command will be run through, eg. 'nice -n 10'")
+	managerStartCmd.Flags().StringVar(&managerCmdWrappers, "cmd_wrappers", defaultConfig.ManagerCmdWrappers, "path to a file of rep_grp=wrapper lines, giving the --cmd_wrapper to use for particular rep_grps")
+	managerStartCmd.Flags().StringVar(&managerOutputFilter, "output_filter", defaultConfig.ManagerOutputFilter, "JSON object of regular expressions controlling which lines of command output are kept, for commands that don't specify their own")
 	managerStartCmd.Flags().BoolVar(&managerDebug, "debug", false, "include extra debugging information in the logs")
 
 	managerBackupCmd.Flags().StringVarP(&backupPath, "path", "p", "", "backup file path")
+
+	managerMirrorCmd.Flags().StringVar(&mirrorPrimary, "primary", internal.DefaultServer(appLogger), "ip:port of the wr manager to mirror")
+	managerMirrorCmd.Flags().StringVar(&mirrorPort, "port", "", "port to serve the mirrored web interface and REST API on")
+	managerMirrorCmd.Flags().IntVar(&timeoutint, "timeout", 30, "how long (seconds) to wait to get a reply from 'wr manager'")
+
+	managerDrainCmd.Flags().StringVar(&managerDrainDeadline, "deadline", "", "kill any jobs still running after this long [specify units such as m for minutes or h for hours]")
+	managerDrainCmd.Flags().BoolVar(&managerDrainStatus, "status", false, "only report on the progress of a drain, without starting one")
 }
 
 func logStarted(s *jobqueue.ServerInfo, token []byte) {
@@ -428,7 +583,7 @@ func logStarted(s *jobqueue.ServerInfo, token []byte) {
 	}
 }
 
-func startJQ(postCreation []byte) {
+func startJQ(postCreation []byte, flavorScriptContents map[string][]byte) {
 	if runtime.NumCPU() == 1 {
 		// we might lock up with only 1 proc if we mount
 		runtime.GOMAXPROCS(2)
@@ -464,10 +619,21 @@ func startJQ(postCreation []byte) {
 	serverCIDR := ""
 	switch scheduler {
 	case "local":
-		schedulerConfig = &jqs.ConfigLocal{Shell: config.RunnerExecShell}
+		schedulerConfig = &jqs.ConfigLocal{Shell: config.RunnerExecShell, MaxJobsPerHost: config.ManagerMaxJobsPerHost}
 	case "lsf":
 		schedulerConfig = &jqs.ConfigLSF{Deployment: config.Deployment, Shell: config.RunnerExecShell}
-	case "openstack":
+	case "external":
+		if managerSchedulerExe == "" {
+			die("--external must be supplied when using the external scheduler")
+		}
+		schedulerConfig = &jqs.ConfigExternal{Executable: managerSchedulerExe, Deployment: config.Deployment, Shell: config.RunnerExecShell}
+	case "simulator":
+		schedulerConfig = parseSimFile(config.ManagerSimFile)
+	case "ssh":
+		schedulerConfig = parseSSHHostsFile(config.ManagerSSHHostsFile)
+	case "kubernetes":
+		schedulerConfig = parseKubeFile(config.ManagerKubeFile)
+	case "openstack", "terraform":
 		mport, errf := strconv.Atoi(config.ManagerPort)
 		if errf != nil {
 			die("wr manager failed to start : %s\n", errf)
@@ -475,22 +641,26 @@ func startJQ(postCreation []byte) {
 
 		schedulerConfig = &jqs.ConfigOpenStack{
 			ResourceName:         cloudResourceName(localUsername),
-			SavePath:             filepath.Join(config.ManagerDir, "cloud_resources.openstack"),
+			SavePath:             filepath.Join(config.ManagerDir, "cloud_resources."+scheduler),
 			ServerPorts:          []int{22, mport},
 			OSPrefix:             osPrefix,
 			OSUser:               osUsername,
 			OSRAM:                osRAM,
 			OSDisk:               osDisk,
 			FlavorRegex:          flavorRegex,
+			ArchFlavorRegexes:    parseArchFlavors(archFlavors),
 			PostCreationScript:   postCreation,
+			FlavorScripts:        flavorScriptContents,
 			ConfigFiles:          cloudConfigFiles,
 			ServerKeepTime:       time.Duration(serverKeepAlive) * time.Second,
 			StateUpdateFrequency: 1 * time.Minute,
 			MaxInstances:         maxServers,
+			MaxJobsPerHost:       config.ManagerMaxJobsPerHost,
 			Shell:                config.RunnerExecShell,
 			GatewayIP:            cloudGatewayIP,
 			CIDR:                 cloudCIDR,
 			DNSNameServers:       strings.Split(cloudDNS, ","),
+			Provider:             scheduler,
 		}
 		serverCIDR = cloudCIDR
 	}
@@ -505,24 +675,44 @@ func startJQ(postCreation []byte) {
 		}
 	}
 
+	// the proxy in our config is for users reaching us; we contact any peers
+	// directly
+	jobqueue.ClientProxy = ""
+
 	// start the jobqueue server
 	server, msg, token, err := jobqueue.Serve(jobqueue.ServerConfig{
-		Port:            config.ManagerPort,
-		WebPort:         config.ManagerWeb,
-		SchedulerName:   scheduler,
-		SchedulerConfig: schedulerConfig,
-		RunnerCmd:       exe + " runner -s '%s' --deployment %s --server '%s' --domain %s -r %d -m %d",
-		DBFile:          config.ManagerDbFile,
-		DBFileBackup:    config.ManagerDbBkFile,
-		TokenFile:       config.ManagerTokenFile,
-		UploadDir:       config.ManagerUploadDir,
-		CAFile:          config.ManagerCAFile,
-		CertFile:        config.ManagerCertFile,
-		KeyFile:         config.ManagerKeyFile,
-		CertDomain:      config.ManagerCertDomain,
-		Deployment:      config.Deployment,
-		CIDR:            serverCIDR,
-		Logger:          serverLogger,
+		Port:              config.ManagerPort,
+		WebPort:           config.ManagerWeb,
+		SchedulerName:     scheduler,
+		SchedulerConfig:   schedulerConfig,
+		RunnerCmd:         exe + " runner -s '%s' --deployment %s --server '%s' --domain %s -r %d -m %d",
+		DBFile:            config.ManagerDbFile,
+		DBFileBackup:      config.ManagerDbBkFile,
+		TokenFile:         config.ManagerTokenFile,
+		ReadOnlyTokenFile: config.ManagerReadOnlyTokenFile,
+		UploadDir:         config.ManagerUploadDir,
+		UploadGCAge:       time.Duration(managerUploadGC) * time.Hour,
+		TrashKeep:         time.Duration(managerTrashKeep) * time.Hour,
+		TimelineInterval:  time.Duration(managerTimelineInterval) * time.Minute,
+		TimelineKeep:      time.Duration(managerTimelineKeep) * 24 * time.Hour,
+		SlowRequest:       time.Duration(managerSlowRequest) * time.Millisecond,
+		CAFile:            config.ManagerCAFile,
+		CertFile:          config.ManagerCertFile,
+		KeyFile:           config.ManagerKeyFile,
+		CertDomain:        config.ManagerCertDomain,
+		Deployment:        config.Deployment,
+		CIDR:              serverCIDR,
+		FairShare:         managerFairShare,
+		FairShareWeights:  parseShareWeights(managerShareWeights),
+		CmdWrapper:        managerCmdWrapper,
+		CmdWrappers:       parseCmdWrappers(managerCmdWrappers),
+		OutputFilter:      parseOutputFilter(managerOutputFilter),
+		ReattachGrace:     time.Duration(managerReattachGrace) * time.Second,
+		Datacentre:        config.ManagerDatacentre,
+		Peers:             parsePeers(config.ManagerPeersFile),
+		JobMemoryBudget:   config.ManagerJobMemBudget,
+		MountCredentials:  parseMountCredsFile(config.ManagerMountCredsFile),
+		Logger:            serverLogger,
 	})
 
 	if msg != "" {
@@ -552,3 +742,362 @@ func startJQ(postCreation []byte) {
 		}
 	}
 }
+
+// parseArchFlavors parses the value of --cloud_arch_flavors, which is a comma
+// separated list of arch=regex pairs, in to a map of normalised architecture to
+// flavor regex.
+func parseArchFlavors(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+	archs := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			die("--cloud_arch_flavors was not specified correctly: '%s' is not an arch=regex pair", pair)
+		}
+		archs[jqs.NormaliseArch(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return archs
+}
+
+// parseFlavorScripts parses the value of --cloud_flavor_scripts, which is a
+// comma separated list of regex=path pairs, in to a map of flavor regex to
+// script content. Also returns the value with the paths made absolute.
+func parseFlavorScripts(value string) (map[string][]byte, string) {
+	if value == "" {
+		return nil, value
+	}
+	scripts := make(map[string][]byte)
+	var absPairs []string
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			die("--cloud_flavor_scripts was not specified correctly: '%s' is not a regex=path pair", pair)
+		}
+		regex, path := strings.TrimSpace(parts[0]), internal.TildaToHome(strings.TrimSpace(parts[1]))
+		if _, err := regexp.Compile(regex); err != nil {
+			die("--cloud_flavor_scripts regex '%s' is not valid: %s", regex, err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			die("--cloud_flavor_scripts %s could not be read: %s", path, err)
+		}
+		scripts[regex] = content
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			die("--cloud_flavor_scripts %s could not be converted to an absolute path: %s", path, err)
+		}
+		absPairs = append(absPairs, regex+"="+abs)
+	}
+	return scripts, strings.Join(absPairs, ",")
+}
+
+// parseCmdWrappers parses the file given to --cmd_wrappers, which has a
+// rep_grp=wrapper pair on each line (blank lines and those starting with # are
+// ignored), in to a map of rep_grp to wrapper.
+func parseCmdWrappers(path string) map[string]string {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("--cmd_wrappers file could not be read: %s", err)
+	}
+	wrappers := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			die("--cmd_wrappers file was not specified correctly: '%s' is not a rep_grp=wrapper pair", line)
+		}
+		wrappers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return wrappers
+}
+
+// parseOutputFilter parses the JSON given to --output_filter.
+func parseOutputFilter(jsonString string) jobqueue.OutputFilter {
+	filter, err := jobqueue.ParseOutputFilter(jsonString)
+	if err != nil {
+		die("--output_filter was not specified correctly: %s", err)
+	}
+	return filter
+}
+
+// parsePeers parses the managerpeersfile, a YAML (or JSON) list of peer
+// managers to forward commands for other datacentres to.
+func parsePeers(path string) []*jobqueue.Peer {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("managerpeersfile could not be read: %s", err)
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("managerpeersfile %s could not be parsed: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("managerpeersfile %s could not be parsed: %s", path, err)
+	}
+	var peers []*jobqueue.Peer
+	err = json.Unmarshal(jsonBytes, &peers)
+	if err != nil {
+		die("managerpeersfile %s was not specified correctly: %s", path, err)
+	}
+	for _, peer := range peers {
+		peer.TokenFile = internal.TildaToHome(peer.TokenFile)
+		if peer.CAFile != "" {
+			peer.CAFile = internal.TildaToHome(peer.CAFile)
+		}
+	}
+	return peers
+}
+
+// sshHostsFile is the format of the managersshhostsfile.
+type sshHostsFile struct {
+	User    string         `json:"user"`
+	KeyFile string         `json:"key_file"`
+	Hosts   []*jqs.SSHHost `json:"hosts"`
+}
+
+// parseSSHHostsFile parses the managersshhostsfile, a YAML (or JSON)
+// description of the machines that the ssh scheduler runs commands on.
+func parseSSHHostsFile(path string) *jqs.ConfigSSH {
+	if path == "" {
+		die("the managersshhostsfile option must be set in wr's config file to use the ssh scheduler")
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("managersshhostsfile could not be read: %s", err)
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("managersshhostsfile %s could not be parsed: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("managersshhostsfile %s could not be parsed: %s", path, err)
+	}
+	hf := &sshHostsFile{}
+	err = json.Unmarshal(jsonBytes, hf)
+	if err != nil {
+		die("managersshhostsfile %s was not specified correctly: %s", path, err)
+	}
+	if len(hf.Hosts) == 0 {
+		die("managersshhostsfile %s does not list any hosts", path)
+	}
+	if hf.User == "" {
+		hf.User = realUsername()
+	}
+	if hf.KeyFile == "" {
+		hf.KeyFile = "~/.ssh/id_rsa"
+	}
+	key, err := ioutil.ReadFile(internal.TildaToHome(hf.KeyFile))
+	if err != nil {
+		die("the key_file of managersshhostsfile %s could not be read: %s", path, err)
+	}
+
+	return &jqs.ConfigSSH{
+		Hosts:                hf.Hosts,
+		User:                 hf.User,
+		PrivateKey:           string(key),
+		Shell:                config.RunnerExecShell,
+		StateUpdateFrequency: 1 * time.Minute,
+		MaxJobsPerHost:       config.ManagerMaxJobsPerHost,
+	}
+}
+
+// kubeFile is the format of the managerkubefile.
+type kubeFile struct {
+	Image     string `json:"image"`
+	Namespace string `json:"namespace"`
+	MaxPods   int    `json:"max_pods"`
+	Secret    string `json:"secret"`
+	APIServer string `json:"api_server"`
+	TokenFile string `json:"token_file"`
+	CAFile    string `json:"ca_file"`
+}
+
+// parseKubeFile parses the managerkubefile, a YAML (or JSON) description of
+// the kubernetes cluster that the kubernetes scheduler runs commands in.
+func parseKubeFile(path string) *jqs.ConfigKubernetes {
+	if path == "" {
+		die("the managerkubefile option must be set in wr's config file to use the kubernetes scheduler")
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("managerkubefile could not be read: %s", err)
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("managerkubefile %s could not be parsed: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("managerkubefile %s could not be parsed: %s", path, err)
+	}
+	kf := &kubeFile{}
+	err = json.Unmarshal(jsonBytes, kf)
+	if err != nil {
+		die("managerkubefile %s was not specified correctly: %s", path, err)
+	}
+	if kf.Image == "" {
+		die("managerkubefile %s does not specify an image", path)
+	}
+
+	var token string
+	if kf.TokenFile != "" {
+		b, errr := ioutil.ReadFile(internal.TildaToHome(kf.TokenFile))
+		if errr != nil {
+			die("the token_file of managerkubefile %s could not be read: %s", path, errr)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if kf.CAFile != "" {
+		kf.CAFile = internal.TildaToHome(kf.CAFile)
+	}
+
+	return &jqs.ConfigKubernetes{
+		APIServer:            kf.APIServer,
+		BearerToken:          token,
+		CAFile:               kf.CAFile,
+		Namespace:            kf.Namespace,
+		Image:                kf.Image,
+		Secret:               kf.Secret,
+		ManagerTokenFile:     config.ManagerTokenFile,
+		ManagerCAFile:        config.ManagerCAFile,
+		MaxPods:              kf.MaxPods,
+		Deployment:           config.Deployment,
+		Shell:                config.RunnerExecShell,
+		StateUpdateFrequency: 1 * time.Minute,
+	}
+}
+
+// mountCredsFile is the format of the managermountcredsfile.
+type mountCredsFile struct {
+	Endpoint    string `json:"endpoint"`
+	Region      string `json:"region"`
+	RoleARN     string `json:"role_arn"`
+	AccessKey   string `json:"access_key"`
+	SecretKey   string `json:"secret_key"`
+	MaxLifetime int    `json:"max_lifetime"`
+}
+
+// parseMountCredsFile parses the managermountcredsfile, a YAML (or JSON)
+// description of the STS service to mint temporary credentials for commands'
+// S3 mounts with. Returns nil if path is empty.
+func parseMountCredsFile(path string) jobqueue.MountCredentialMinter {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("managermountcredsfile could not be read: %s", err)
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("managermountcredsfile %s could not be parsed: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("managermountcredsfile %s could not be parsed: %s", path, err)
+	}
+	mf := &mountCredsFile{}
+	err = json.Unmarshal(jsonBytes, mf)
+	if err != nil {
+		die("managermountcredsfile %s was not specified correctly: %s", path, err)
+	}
+	if mf.Endpoint == "" || mf.RoleARN == "" {
+		die("managermountcredsfile %s must specify an endpoint and role_arn", path)
+	}
+	if mf.AccessKey == "" {
+		mf.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if mf.SecretKey == "" {
+		mf.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if mf.AccessKey == "" || mf.SecretKey == "" {
+		die("managermountcredsfile %s must specify an access_key and secret_key, or they must be in the environment", path)
+	}
+
+	return &jobqueue.STSMinter{
+		Endpoint:    mf.Endpoint,
+		Region:      mf.Region,
+		RoleARN:     mf.RoleARN,
+		AccessKey:   mf.AccessKey,
+		SecretKey:   mf.SecretKey,
+		MaxLifetime: time.Duration(mf.MaxLifetime) * time.Second,
+	}
+}
+
+// parseShareWeights parses the value of --share_weights, which is a comma
+// separated list of rep_grp=weight pairs, in to a map of rep_grp to weight.
+func parseShareWeights(value string) map[string]int {
+	if value == "" {
+		return nil
+	}
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			die("--share_weights was not specified correctly: '%s' is not a rep_grp=weight pair", pair)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 1 {
+			die("--share_weights was not specified correctly: '%s' does not have a positive whole number weight", pair)
+		}
+		weights[strings.TrimSpace(parts[0])] = weight
+	}
+	return weights
+}
+
+// removeReadOnlyTokenFile removes the read-only token file of a manager that
+// has been stopped, warning on failure.
+func removeReadOnlyTokenFile() {
+	err := os.Remove(config.ManagerReadOnlyTokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		warn("failed to remove read-only token file: %s", err)
+	}
+}
+
+// drainStatus reports on the progress of a drain.
+func drainStatus(jq *jobqueue.Client) {
+	defer func() {
+		err := jq.Disconnect()
+		if err != nil {
+			warn("Disconnecting from the server failed: %s", err)
+		}
+	}()
+
+	stats, err := jq.GetServerStats()
+	if err != nil {
+		die("failed to get the status of the manager: %s", err)
+	}
+
+	if !stats.Draining {
+		info("wr manager running on port %s is not draining", config.ManagerPort)
+		return
+	}
+	info("wr manager running on port %s is draining; there are %d jobs still running, and they should complete in less than %s", config.ManagerPort, stats.Running, stats.ETC)
+	if stats.Deadline > 0 {
+		info("any jobs still running in %s will be killed", stats.Deadline)
+	} else if stats.Running > 0 {
+		info("there is no deadline, so the manager will wait for them")
+	}
+}
@@ -20,28 +20,26 @@ package cmd
 
 import (
 	"encoding/json"
-	"os"
-	"os/signal"
+	"fmt"
+	"io/ioutil"
 	"strings"
-	"syscall"
 
-	"github.com/VertebrateResequencing/muxfys"
 	"github.com/VertebrateResequencing/wr/jobqueue"
-	"github.com/inconshreveable/log15"
-	"github.com/sb10/l15h"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // options for this cmd
 var mountSimple string
 var mountJSON string
+var mountFile string
 var mountVerbose bool
 
 // mountCmd represents the mount command
 var mountCmd = &cobra.Command{
 	Use:   "mount",
-	Short: "Mount an S3 bucket",
-	Long: `Test mounting of S3 buckets.
+	Short: "Mount S3 buckets",
+	Long: `Test mounting of S3 buckets, or mount them for general use.
 
 'wr add' can take mount options if your commands need to read from/ write to
 S3 buckets. Before supplying these mount options to 'wr add', you can use this
@@ -63,14 +61,17 @@ $ fg
 And then kill it by hitting ctrl-c.
 NB: if you are writing to your mount point, it's very important to kill it
 cleanly using one of these methods once you're done, since uploads only occur
-when you do this!
+when you do this! (SIGHUP and SIGQUIT also result in a clean unmount.) All your
+mounts are unmounted together, and if any of them can't be mounted in the first
+place, any already mounted are unmounted before exiting.
 
 
 --mounts is a convenience option that lets you specify your mounts in the common
 case that you wish the contents of 1 or more remote directories to be accessible
 from a single local directory ('mnt' when using this command, the command
 working directory when using 'wr add'). For anything more complicated you'll
-need to use --mount_json. You can't use both --mounts and --mount_json at once.
+need to use --mount_json or --mount_file. You can only use one of --mounts,
+--mount_json and --mount_file at once.
 The format is a comma-separated list of [c|u][r|w]:[profile@]bucket[/path]
 strings. The first character as 'c' means to turn on caching, while 'u' means
 uncached. The second character as 'r' means read-only, while 'w' means writeable
@@ -93,6 +94,23 @@ For example (all on one line): --mounts '[{"Mount":"/tmp/wr_mnt","Targets":
 [{"Profile":"default","Path":"mybucket/subdir","Write":true}]}]'
 The paragraphs below describe all the possible Config object parameters.
 
+
+--mount_file is the path to a file containing the same array of Config objects
+as you would supply to --mount_json, either in JSON or in YAML format. This is
+the most convenient way of managing lots of mounts. Parameter names are case
+insensitive. For example, in YAML:
+- mount: /tmp/wr_mnt/refs
+  cachebase: /tmp/wr_cache
+  targets:
+    - path: mybucket/refs
+      cache: true
+- mount: /tmp/wr_mnt/results
+  verbose: true
+  targets:
+    - profile: other
+      path: otherbucket/results
+      write: true
+
 Mount is the local directory on which to mount your Target(s). It can be (in)
 any directory you're able to write to. If the directory doesn't exist, wr will
 try to create it first. Otherwise, it must be empty. If not supplied, defaults
@@ -157,6 +175,24 @@ colon.
 If set, the environment variables $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
 $AWS_DEFAULT_REGION override corresponding options found in any config file.
 
+Endpoint is the URL of the S3 service to use for this Target, eg.
+"https://s3.eu-west-2.amazonaws.com", overriding the domain and scheme found
+for your Profile. If you leave off the scheme, https is assumed.
+
+Failover is a list of alternate endpoints (specified like Endpoint) that hold a
+replica of the same data, eg. a cloud mirror of your local S3 service. At mount
+time the primary endpoint and then each of these in turn are checked, and the
+first that can be connected to is used, so that an outage of one doesn't stop
+you accessing your data. The same credentials and Region are used for all.
+
+Region is the region to use for this Target, overriding any region found for
+your Profile.
+
+Anonymous is a boolean, which if true, means no credentials are used, so that
+you can read from public buckets (eg. public reference data sets) without
+having to configure any. Profile is then ignored, and Endpoint defaults to
+"https://s3.amazonaws.com".
+
 Path (required) is the name of your S3 bucket, optionally followed URL-style
 (separated with forward slashes) by sub-directory names. The highest performance
 is gained by specifying the deepest path under your bucket that holds all the
@@ -174,77 +210,17 @@ Write is a boolean, which if true, makes the mount point writeable. If you
 don't intend to write to a mount, just leave this parameter out. Note that when
 not cached, only serial writes are possible.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// set up logging
-		logLevel := log15.LvlWarn
-		if mountVerbose {
-			logLevel = log15.LvlInfo
-		}
-		muxfys.SetLogHandler(log15.LvlFilterHandler(logLevel, l15h.CallerInfoHandler(log15.StderrHandler)))
-
-		// mount everything
-		var mounted []*muxfys.MuxFys
-		for _, mc := range mountParse(mountJSON, mountSimple) {
-			var rcs []*muxfys.RemoteConfig
-			for _, mt := range mc.Targets {
-				accessorConfig, err := muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
-				if err != nil {
-					die("had a problem reading S3 config values from the environment: %s", err)
-				}
-				accessor, err := muxfys.NewS3Accessor(accessorConfig)
-				if err != nil {
-					die("had a problem creating an S3 accessor: %s", err)
-				}
-
-				rc := &muxfys.RemoteConfig{
-					Accessor:  accessor,
-					CacheData: mt.Cache,
-					CacheDir:  mt.CacheDir,
-					Write:     mt.Write,
-				}
-
-				rcs = append(rcs, rc)
-			}
-
-			retries := 10
-			if mc.Retries > 0 {
-				retries = mc.Retries
-			}
-
-			cfg := &muxfys.Config{
-				Mount:     mc.Mount,
-				CacheBase: mc.CacheBase,
-				Retries:   retries,
-				Verbose:   mc.Verbose,
-			}
-
-			fs, err := muxfys.New(cfg)
-			if err != nil {
-				die("bad configuration: %s\n", err)
-			}
-
-			err = fs.Mount(rcs...)
-			if err != nil {
-				die("could not mount: %s\n", err)
+		var mcs jobqueue.MountConfigs
+		if mountFile != "" {
+			if mountJSON != "" || mountSimple != "" {
+				die("--mount_file can't be used with --mounts or --mount_json")
 			}
-
-			mounted = append(mounted, fs)
-			// (we can't use each fs's UnmountOnDeath() function because they
-			// won't wait for each other)
+			mcs = mountParseFile(mountFile)
+		} else {
+			mcs = mountParse(mountJSON, mountSimple)
 		}
 
-		// wait for death
-		if len(mounted) > 0 {
-			deathSignals := make(chan os.Signal, 2)
-			signal.Notify(deathSignals, os.Interrupt, syscall.SIGTERM)
-			<-deathSignals
-			for _, fs := range mounted {
-				err := fs.Unmount()
-				if err != nil {
-					fs.Error("Failed to unmount", "err", err)
-				}
-			}
-			return
-		}
+		mountAndWait(mcs)
 	},
 }
 
@@ -254,9 +230,51 @@ func init() {
 	// flags specific to this sub-command
 	mountCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mount parameters JSON (see --help)")
 	mountCmd.Flags().StringVarP(&mountSimple, "mounts", "m", "", "comma-separated list of [c|u][r|w]:bucket[/path] (see --help)")
+	mountCmd.Flags().StringVarP(&mountFile, "mount_file", "f", "", "path to a JSON or YAML file of mount parameters (see --help)")
 	mountCmd.Flags().BoolVarP(&mountVerbose, "verbose", "v", false, "print timing info on all remote calls")
 }
 
+// mountParseFile reads the given JSON or YAML file (as per `wr mount --help`)
+// and parses it to a MountConfig for each mount defined.
+func mountParseFile(path string) jobqueue.MountConfigs {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		die("could not read mount file %s: %s", path, err)
+	}
+
+	// YAML is a superset of JSON, so we parse as YAML, then convert to JSON
+	// so that we get the same case-insensitive field matching as for
+	// --mount_json
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("had a problem with the mount file %s: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("had a problem with the mount file %s: %s", path, err)
+	}
+	return mountParseJSON(string(jsonBytes))
+}
+
+// yamlToJSONable converts the map[interface{}]interface{}s that yaml gives us
+// to map[string]interface{}s that encoding/json can handle.
+func yamlToJSONable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = yamlToJSONable(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = yamlToJSONable(val)
+		}
+	}
+	return v
+}
+
 // mountParse takes possible json string or simple string (as per `wr mount -h`)
 // and parses exactly 1 of them to a MountConfig for each mount defined.
 func mountParse(jsonString, simpleString string) jobqueue.MountConfigs {
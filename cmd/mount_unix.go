@@ -0,0 +1,140 @@
+// Copyright © 2016-2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package cmd
+
+// This file contains the unix-specific code for the mount sub-command.
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/VertebrateResequencing/muxfys"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/inconshreveable/log15"
+	"github.com/sb10/l15h"
+)
+
+// mountAndWait mounts the given MountConfigs, then waits until we're signalled
+// to stop before unmounting them.
+func mountAndWait(mcs jobqueue.MountConfigs) {
+	// set up logging
+	logLevel := log15.LvlWarn
+	if mountVerbose {
+		logLevel = log15.LvlInfo
+	}
+	muxfys.SetLogHandler(log15.LvlFilterHandler(logLevel, l15h.CallerInfoHandler(log15.StderrHandler)))
+
+	// mount everything, listening for death signals first so that we don't
+	// miss any sent while we're mounting
+	deathSignals := make(chan os.Signal, 2)
+	signal.Notify(deathSignals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	var mounted []*muxfys.MuxFys
+	for _, mc := range mcs {
+		fs, err := mountOne(mc)
+		if err != nil {
+			// (we can't use each fs's UnmountOnDeath() function because
+			// they won't wait for each other)
+			mountUnmountAll(mounted)
+			die("%s", err)
+		}
+		mounted = append(mounted, fs)
+	}
+
+	// wait for death
+	if len(mounted) > 0 {
+		<-deathSignals
+		mountUnmountAll(mounted)
+	}
+}
+
+// mountTemporarily mounts the given MountConfig's targets at its mount point,
+// returning a function that unmounts them.
+func mountTemporarily(mc jobqueue.MountConfig) (func(), error) {
+	fs, err := mountOne(mc)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		mountUnmountAll([]*muxfys.MuxFys{fs})
+	}, nil
+}
+
+// mountOne mounts the given MountConfig's targets at its mount point.
+func mountOne(mc jobqueue.MountConfig) (*muxfys.MuxFys, error) {
+	var rcs []*muxfys.RemoteConfig
+	for _, mt := range mc.Targets {
+		accessorConfig, err := mt.S3Config()
+		if err != nil {
+			return nil, fmt.Errorf("had a problem reading S3 config values from the environment: %s", err)
+		}
+		accessor, err := muxfys.NewS3Accessor(accessorConfig)
+		if err != nil {
+			return nil, fmt.Errorf("had a problem creating an S3 accessor: %s", err)
+		}
+
+		rc := &muxfys.RemoteConfig{
+			Accessor:  accessor,
+			CacheData: mt.Cache,
+			CacheDir:  mt.CacheDir,
+			Write:     mt.Write,
+		}
+
+		rcs = append(rcs, rc)
+	}
+
+	retries := 10
+	if mc.Retries > 0 {
+		retries = mc.Retries
+	}
+
+	cfg := &muxfys.Config{
+		Mount:     mc.Mount,
+		CacheBase: mc.CacheBase,
+		Retries:   retries,
+		Verbose:   mc.Verbose,
+	}
+
+	fs, err := muxfys.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("bad configuration: %s", err)
+	}
+
+	err = fs.Mount(rcs...)
+	if err != nil {
+		return nil, fmt.Errorf("could not mount: %s", err)
+	}
+	return fs, nil
+}
+
+// mountUnmountAll cleanly unmounts the given file systems, most recently
+// mounted first.
+func mountUnmountAll(mounted []*muxfys.MuxFys) {
+	for i := len(mounted) - 1; i >= 0; i-- {
+		fs := mounted[i]
+		err := fs.Unmount()
+		if err != nil {
+			fs.Error("Failed to unmount", "err", err)
+		}
+	}
+}
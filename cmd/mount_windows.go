@@ -0,0 +1,41 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+// This file contains the Windows-specific code for the mount sub-command.
+
+import (
+	"errors"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+)
+
+// errMountUnsupported is the error for trying to mount on Windows, which has no
+// fuse support.
+var errMountUnsupported = errors.New("mounting remote file systems is not supported on Windows")
+
+// mountAndWait dies, since we can't mount on Windows.
+func mountAndWait(mcs jobqueue.MountConfigs) {
+	die("%s", errMountUnsupported)
+}
+
+// mountTemporarily returns an error, since we can't mount on Windows.
+func mountTemporarily(mc jobqueue.MountConfig) (func(), error) {
+	return nil, errMountUnsupported
+}
@@ -25,6 +25,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// options for this cmd
+var removePurge bool
+
 // removeCmd represents the remove command
 var removeCmd = &cobra.Command{
 	Use:   "remove",
@@ -38,7 +41,8 @@ work. If you want to remove commands that are currently running you will need to
 
 Specify one of the flags -f, -l, -i or -a to choose which commands you want to
 remove. Amongst those, only currently incomplete, non-running jobs will be
-affected.
+affected. Add --fail_code to only remove those that last failed for a particular
+reason (as shown by "wr status").
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -46,7 +50,13 @@ In -f and -l mode you must provide the cwd the commands were set to run in, if
 CwdMatters (and must NOT be provided otherwise). Likewise provide the mounts
 options that was used when the command was added, if any. You can do this by
 using the -c and --mounts/--mounts_json options in -l mode, or by providing the
-same file you gave to "wr add" in -f mode.`,
+same file you gave to "wr add" in -f mode.
+
+Removed commands are kept in a trash for a while (see the managertrashkeep config
+option), so if you remove commands by mistake you can get them back with
+"wr restore". Use --purge to remove them permanently instead; this also
+permanently removes any of the specified commands that are already in the
+trash.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		set := countGetJobArgs()
 		if set > 1 {
@@ -68,11 +78,29 @@ same file you gave to "wr add" in -f mode.`,
 
 		jobs := getJobs(jq, jobqueue.JobStateDeletable, cmdAll, 0, false, false)
 
+		if removePurge && (cmdAll || cmdIDStatus != "") {
+			tjs, errt := jq.GetTrash(cmdIDStatus)
+			if errt != nil {
+				die("failed to get commands in the trash: %s", errt)
+			}
+			for _, tj := range tjs {
+				jobs = append(jobs, tj.Job)
+			}
+		}
+
 		if len(jobs) == 0 {
 			die("No matching jobs found")
 		}
 
 		jes := jobsToJobEssenses(jobs)
+		if removePurge {
+			removed, errp := jq.Purge(jes)
+			if errp != nil {
+				die("failed to purge desired jobs: %s", errp)
+			}
+			info("Permanently removed %d incomplete, non-running or trashed commands (out of %d eligible)", removed, len(jobs))
+			return
+		}
 		removed, err := jq.Delete(jes)
 		if err != nil {
 			die("failed to remove desired jobs: %s", err)
@@ -89,9 +117,11 @@ func init() {
 	removeCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want to remove; - means read from STDIN")
 	removeCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to remove")
 	removeCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to remove")
+	removeCmd.Flags().StringVar(&cmdFailCode, "fail_code", "", "only remove commands that last failed with this code, eg. ram")
 	removeCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	removeCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	removeCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
+	removeCmd.Flags().BoolVar(&removePurge, "purge", false, "remove permanently, instead of to the trash")
 
 	removeCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
@@ -0,0 +1,180 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var repDefaultsOnFailure string
+var repDefaultsOnSuccess string
+var repDefaultsOnExit string
+var repDefaultsMountJSON string
+var repDefaultsMountSimple string
+
+// repDefaultsCmd represents the repdefaults command
+var repDefaultsCmd = &cobra.Command{
+	Use:   "repdefaults",
+	Short: "Manage default mounts and behaviours for rep_grps",
+	Long: `Manage default mounts and behaviours that the manager gives to commands
+added to matching rep_grps.
+
+This lets you configure things centrally, eg. so that all commands added with a
+rep_grp under project-x/ mount a certain bucket and clean up after themselves
+on success, without everyone having to remember to say so with 'wr add':
+
+wr repdefaults set 'project-x/*' --mounts ur:bucket/project-x --on_success '[{"cleanup":true}]'
+
+Patterns use shell file name matching, where * does not match /, so the above
+does not apply to a rep_grp of project-x/align/lane1. When more than one
+pattern matches a rep_grp, the longest pattern is used.
+
+Commands only get the default mounts if they were added without any of their
+own. Default behaviours are applied per trigger: commands get the default
+on_success behaviours if they have none of their own for on_success, and so on.
+(Note that 'wr add' gives commands an on_exit cleanup behaviour unless you say
+otherwise, so default on_exit behaviours are only used for commands added with
+--on_exit '[]' or via the API.)
+
+Defaults only apply to commands added after they are set.`,
+}
+
+// set sub-command stores defaults for a pattern
+var repDefaultsSetCmd = &cobra.Command{
+	Use:   "set PATTERN",
+	Short: "Set the defaults for rep_grps matching a pattern",
+	Long: `Set the default mounts and behaviours for rep_grps matching the given
+pattern, replacing any existing defaults for that pattern.
+
+The --mounts, --mount_json, --on_failure, --on_success and --on_exit options
+take the same values as those options of 'wr add'; see 'wr add -h' for details.
+At least one of them must be supplied.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &jobqueue.RepGroupDefaults{Pattern: args[0]}
+		if repDefaultsMountJSON != "" || repDefaultsMountSimple != "" {
+			d.MountConfigs = mountParse(repDefaultsMountJSON, repDefaultsMountSimple)
+		}
+		d.Behaviours = append(d.Behaviours, repDefaultsBehaviours("on_failure", repDefaultsOnFailure, jobqueue.OnFailure)...)
+		d.Behaviours = append(d.Behaviours, repDefaultsBehaviours("on_success", repDefaultsOnSuccess, jobqueue.OnSuccess)...)
+		d.Behaviours = append(d.Behaviours, repDefaultsBehaviours("on_exit", repDefaultsOnExit, jobqueue.OnExit)...)
+		if len(d.MountConfigs) == 0 && len(d.Behaviours) == 0 {
+			die("at least one of --mounts, --mount_json, --on_failure, --on_success or --on_exit must be supplied")
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer repDefaultsDisconnect(jq)
+
+		err := jq.SetRepGroupDefaults([]*jobqueue.RepGroupDefaults{d})
+		if err != nil {
+			die("%s", err)
+		}
+		info("Set defaults for rep_grps matching %s", args[0])
+	},
+}
+
+// delete sub-command removes the defaults for patterns
+var repDefaultsDeleteCmd = &cobra.Command{
+	Use:   "delete PATTERN [PATTERN...]",
+	Short: "Delete the defaults for patterns",
+	Long: `Delete the defaults for the given patterns, so that commands added to
+matching rep_grps afterwards no longer get them.
+
+Commands already added are not affected.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer repDefaultsDisconnect(jq)
+
+		deleted, err := jq.DeleteRepGroupDefaults(args)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Deleted the defaults of %d patterns", deleted)
+	},
+}
+
+// list sub-command shows the current defaults
+var repDefaultsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the defaults for each pattern",
+	Long: `List the patterns that have defaults, along with their mounts and
+behaviours in the JSON format accepted by 'wr add'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer repDefaultsDisconnect(jq)
+
+		defaults, err := jq.GetRepGroupDefaults()
+		if err != nil {
+			die("%s", err)
+		}
+		for _, d := range defaults {
+			fmt.Printf("%s\n", d.Pattern)
+			if len(d.MountConfigs) > 0 {
+				fmt.Printf("  mounts: %s\n", d.MountConfigs)
+			}
+			if len(d.Behaviours) > 0 {
+				fmt.Printf("  behaviours: %s\n", d.Behaviours)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(repDefaultsCmd)
+	repDefaultsCmd.AddCommand(repDefaultsSetCmd)
+	repDefaultsCmd.AddCommand(repDefaultsDeleteCmd)
+	repDefaultsCmd.AddCommand(repDefaultsListCmd)
+
+	repDefaultsSetCmd.Flags().StringVar(&repDefaultsOnFailure, "on_failure", "", "behaviours to carry out when cmds fail, in JSON format")
+	repDefaultsSetCmd.Flags().StringVar(&repDefaultsOnSuccess, "on_success", "", "behaviours to carry out when cmds succeed, in JSON format")
+	repDefaultsSetCmd.Flags().StringVar(&repDefaultsOnExit, "on_exit", "", "behaviours to carry out when cmds finish running, in JSON format")
+	repDefaultsSetCmd.Flags().StringVarP(&repDefaultsMountJSON, "mount_json", "j", "", "remote file systems to mount, in JSON format")
+	repDefaultsSetCmd.Flags().StringVar(&repDefaultsMountSimple, "mounts", "", "remote file systems to mount, as a ,-separated list of [c|u][r|w]:bucket[/path]")
+
+	repDefaultsCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// repDefaultsBehaviours parses the JSON given for the named option in to
+// Behaviours for the given trigger.
+func repDefaultsBehaviours(option, value string, when jobqueue.BehaviourTrigger) jobqueue.Behaviours {
+	if value == "" {
+		return nil
+	}
+	var bjs jobqueue.BehavioursViaJSON
+	err := json.Unmarshal([]byte(value), &bjs)
+	if err != nil {
+		die("bad --%s: %s", option, err)
+	}
+	return bjs.Behaviours(when)
+}
+
+// repDefaultsDisconnect disconnects from the manager, warning on failure.
+func repDefaultsDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var reqGroupMem string
+var reqGroupTime string
+var reqGroupDisk int
+var reqGroupOutput string
+var reqGroupFormat string
+
+// reqGroupJSON is the form that ReqGroupProfiles are exported and imported in.
+type reqGroupJSON struct {
+	ReqGroup string `json:"req_grp"`
+	RAM      int    `json:"memory_mb"`
+	Time     string `json:"time"`
+	Disk     int    `json:"disk_gb,omitempty"`
+	Samples  int    `json:"samples,omitempty"`
+	Override bool   `json:"override,omitempty"`
+}
+
+// reqGroupCmd represents the reqgroup command
+var reqGroupCmd = &cobra.Command{
+	Use:   "reqgroup",
+	Short: "Manage learned resource requirements",
+	Long: `Manage the resource requirements the manager recommends for each req_grp.
+
+As commands complete, the manager learns how much memory, time and disk (for
+commands that don't use --cwd_matters) commands in each req_grp (see
+'wr add -h') really need, and adjusts the requirements of subsequent commands in
+the same group (depending on their override setting). The recommendations are
+the 95th percentile of what was used. Commands that fail for using too much
+memory or time are retried with at least the recommended amount.
+
+You can list what has been learned, override it with your own values, forget
+it, and export and import everything, eg. to seed a new deployment's manager
+with the known-good requirements of an old one:
+
+wr reqgroup export -o reqs.json
+wr reqgroup import reqs.json --deployment development
+
+You can also have the manager learn from the accounting records of another job
+scheduler with 'wr reqgroup backfill'.`,
+}
+
+// list sub-command shows the current recommendations
+var reqGroupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the recommended requirements of each req_grp",
+	Long: `List the memory, time and disk the manager currently recommends for
+each req_grp, along with the number of distinct past values the learned memory
+is based on, and whether the values are an override you set. A disk of 0 means
+there is no recommendation.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profiles := getReqGroupProfiles()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "req_grp\tmemory\ttime\tdisk\tsamples\toverride")
+		for _, p := range profiles {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%dG\t%d\t%t\n", p.ReqGroup, bytefmt.ByteSize(uint64(p.RAM)*bytefmt.MEGABYTE), p.Time, p.Disk, p.Samples, p.Override)
+		}
+		err := w.Flush()
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
+// set sub-command overrides the recommendation of a req_grp
+var reqGroupSetCmd = &cobra.Command{
+	Use:   "set REQ_GRP",
+	Short: "Override the recommended requirements of a req_grp",
+	Long: `Override the memory, time and (optionally) disk the manager recommends
+for the given req_grp with the given --memory, --time and --disk, regardless of
+what it learns.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mb, err := jobqueue.ParseMemory(reqGroupMem)
+		if err != nil {
+			die("--memory was not specified correctly: %s", err)
+		}
+		d, err := jobqueue.ParseDuration(reqGroupTime)
+		if err != nil {
+			die("--time was not specified correctly: %s", err)
+		}
+
+		if reqGroupDisk < 0 {
+			die("--disk can't be negative")
+		}
+
+		setReqGroupProfiles([]*jobqueue.ReqGroupProfile{{ReqGroup: args[0], RAM: mb, Time: d, Disk: reqGroupDisk}})
+		info("Overrode the requirements of req_grp %s", args[0])
+	},
+}
+
+// delete sub-command removes overrides
+var reqGroupDeleteCmd = &cobra.Command{
+	Use:   "delete REQ_GRP [REQ_GRP...]",
+	Short: "Remove overrides of the recommended requirements",
+	Long: `Remove the overrides of the given req_grps set with 'wr reqgroup set' or
+'wr reqgroup import', so that learned values are used for them again.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer reqGroupDisconnect(jq)
+
+		deleted, err := jq.DeleteReqGroupProfiles(args)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Removed %d overrides", deleted)
+	},
+}
+
+// reset sub-command forgets what was learned
+var reqGroupResetCmd = &cobra.Command{
+	Use:   "reset REQ_GRP [REQ_GRP...]",
+	Short: "Forget the learned requirements",
+	Long: `Make the manager forget everything it has learned about the memory, time
+and disk usage of commands in the given req_grps, eg. after changing the
+software they run such that it needs very different resources. It will start
+learning again from the next commands to complete. Overrides are not affected.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer reqGroupDisconnect(jq)
+
+		reset, err := jq.ResetReqGroupProfiles(args)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Forgot what was learned about %d req_grps", reset)
+	},
+}
+
+// export sub-command writes the recommendations as JSON
+var reqGroupExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the recommended requirements of each req_grp",
+	Long: `Export the memory, time and disk recommended for every req_grp as JSON,
+to STDOUT or the file given by --output, for use with 'wr reqgroup import'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profiles := getReqGroupProfiles()
+		exported := make([]*reqGroupJSON, 0, len(profiles))
+		for _, p := range profiles {
+			if p.RAM == 0 || p.Time == 0 {
+				continue
+			}
+			exported = append(exported, &reqGroupJSON{ReqGroup: p.ReqGroup, RAM: p.RAM, Time: p.Time.String(), Disk: p.Disk, Samples: p.Samples, Override: p.Override})
+		}
+
+		out, err := json.MarshalIndent(exported, "", "  ")
+		if err != nil {
+			die("%s", err)
+		}
+		out = append(out, '\n')
+		if reqGroupOutput == "" || reqGroupOutput == "-" {
+			_, err = os.Stdout.Write(out)
+		} else {
+			err = ioutil.WriteFile(reqGroupOutput, out, 0644)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
+// import sub-command reads recommendations from JSON and stores them as
+// overrides
+var reqGroupImportCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Import recommended requirements as overrides",
+	Long: `Import the memory, time and disk of req_grps from a file created by
+'wr reqgroup export' (or - to read STDIN), storing them as overrides of what
+the manager would learn.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var content []byte
+		var err error
+		if args[0] == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(args[0])
+		}
+		if err != nil {
+			die("could not read %s: %s", args[0], err)
+		}
+
+		var imported []*reqGroupJSON
+		err = json.Unmarshal(content, &imported)
+		if err != nil {
+			die("%s was not valid JSON: %s", args[0], err)
+		}
+		profiles := make([]*jobqueue.ReqGroupProfile, 0, len(imported))
+		for _, rg := range imported {
+			d, errp := jobqueue.ParseDuration(rg.Time)
+			if errp != nil {
+				die("the time of req_grp %s was not specified correctly: %s", rg.ReqGroup, errp)
+			}
+			profiles = append(profiles, &jobqueue.ReqGroupProfile{ReqGroup: rg.ReqGroup, RAM: rg.RAM, Time: d, Disk: rg.Disk})
+		}
+		if len(profiles) == 0 {
+			die("%s did not contain any req_grps", args[0])
+		}
+
+		setReqGroupProfiles(profiles)
+		info("Imported the requirements of %d req_grps", len(profiles))
+	},
+}
+
+// backfill sub-command seeds what is learned with another job scheduler's
+// accounting records
+var reqGroupBackfillCmd = &cobra.Command{
+	Use:   "backfill FILE",
+	Short: "Learn requirements from another job scheduler's accounting",
+	Long: `Learn the requirements of req_grps from the accounting records of
+commands that were run by another job scheduler, so that a new deployment of wr
+recommends sensible requirements from day one, instead of having to learn
+everything by commands failing.
+
+FILE (or - to read STDIN) must be in the --format given:
+
+lsf: an LSF lsb.acct file (typically found in
+$LSB_SHAREDIR/<cluster>/logdir/).
+
+slurm: the output of sacct with the --parsable2 option and its header line, with
+at least the JobName, State, Elapsed and MaxRSS columns, and ideally also JobID
+(so that the memory usage of job steps is taken in to account), eg.:
+sacct -a -P -S 2018-01-01 -o JobID,JobName,State,Elapsed,MaxRSS
+
+Only commands that completed successfully are used. Each is put in the req_grp
+that wr would give the same command by default (the base name of its
+executable; for slurm, of its JobName), and its peak memory usage and wall time
+are learned from as if wr had run it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var r io.Reader
+		if args[0] == "-" {
+			r = os.Stdin
+		} else {
+			f, err := os.Open(args[0])
+			if err != nil {
+				die("could not open %s: %s", args[0], err)
+			}
+			defer internal.LogClose(appLogger, f, "accounting file", "path", args[0])
+			r = f
+		}
+
+		var samples []*jobqueue.ReqGroupSample
+		var err error
+		switch reqGroupFormat {
+		case "lsf":
+			samples, err = jobqueue.ParseLSFAcct(r)
+		case "slurm":
+			samples, err = jobqueue.ParseSacct(r)
+		default:
+			die("--format must be lsf or slurm")
+		}
+		if err != nil {
+			die("could not parse %s: %s", args[0], err)
+		}
+		if len(samples) == 0 {
+			die("%s did not contain any records of successfully completed commands", args[0])
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer reqGroupDisconnect(jq)
+		err = jq.AddReqGroupSamples(samples)
+		if err != nil {
+			die("%s", err)
+		}
+
+		reqGroups := make(map[string]bool)
+		for _, rs := range samples {
+			reqGroups[rs.ReqGroup] = true
+		}
+		info("Learned from %d commands in %d req_grps", len(samples), len(reqGroups))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reqGroupCmd)
+	reqGroupCmd.AddCommand(reqGroupListCmd)
+	reqGroupCmd.AddCommand(reqGroupSetCmd)
+	reqGroupCmd.AddCommand(reqGroupDeleteCmd)
+	reqGroupCmd.AddCommand(reqGroupResetCmd)
+	reqGroupCmd.AddCommand(reqGroupExportCmd)
+	reqGroupCmd.AddCommand(reqGroupImportCmd)
+	reqGroupCmd.AddCommand(reqGroupBackfillCmd)
+
+	reqGroupSetCmd.Flags().StringVarP(&reqGroupMem, "memory", "m", "1G", "peak mem to recommend [specify units such as M for Megabytes or G for Gigabytes]")
+	reqGroupSetCmd.Flags().StringVarP(&reqGroupTime, "time", "t", "1h", "time to recommend [specify units such as m for minutes, h for hours or d for days]")
+	reqGroupSetCmd.Flags().IntVar(&reqGroupDisk, "disk", 0, "disk to recommend (GB) [0 means no recommendation]")
+	reqGroupExportCmd.Flags().StringVarP(&reqGroupOutput, "output", "o", "-", "file to write the JSON to")
+	reqGroupBackfillCmd.Flags().StringVarP(&reqGroupFormat, "format", "f", "slurm", "format of the accounting records: lsf or slurm")
+
+	reqGroupCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// getReqGroupProfiles gets the current ReqGroupProfiles from the manager.
+func getReqGroupProfiles() []*jobqueue.ReqGroupProfile {
+	jq := connect(time.Duration(timeoutint) * time.Second)
+	defer reqGroupDisconnect(jq)
+
+	profiles, err := jq.GetReqGroupProfiles()
+	if err != nil {
+		die("%s", err)
+	}
+	return profiles
+}
+
+// setReqGroupProfiles sends the given ReqGroupProfiles to the manager.
+func setReqGroupProfiles(profiles []*jobqueue.ReqGroupProfile) {
+	jq := connect(time.Duration(timeoutint) * time.Second)
+	defer reqGroupDisconnect(jq)
+
+	err := jq.SetReqGroupProfiles(profiles)
+	if err != nil {
+		die("%s", err)
+	}
+}
+
+// reqGroupDisconnect disconnects from the manager, warning on failure.
+func reqGroupDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var restoreList bool
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore removed commands",
+	Long: `You can add back commands you previously removed with "wr remove"
+using this command, as long as they are still in the trash (see the
+managertrashkeep config option) and weren't removed with --purge.
+
+Specify one of the flags -i, -l or -a to choose which commands you want to
+restore. Restored commands get the same environment and dependencies they had
+when they were removed, so if you removed a tree of dependent commands, restore
+them all at once to get the tree back.
+
+In -l mode you must provide the cwd the command was set to run in, if CwdMatters
+(and must NOT be provided otherwise). Likewise provide the mounts options that
+was used when the command was added, if any, using the -c and
+--mounts/--mounts_json options.
+
+With --list, the matching commands in the trash are shown instead of being
+restored: their identifier, when they were removed and when they will be
+permanently removed, and the command line, in tab separated columns.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		set := 0
+		for _, given := range []bool{cmdIDStatus != "", cmdLine != "", cmdAll} {
+			if given {
+				set++
+			}
+		}
+		if set > 1 {
+			die("-i, -l and -a are mutually exclusive; only specify one of them")
+		}
+		if set == 0 {
+			die("1 of -i, -l or -a is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		var jes []*jobqueue.JobEssence
+		if cmdLine != "" {
+			var defaultMounts jobqueue.MountConfigs
+			if mountJSON != "" || mountSimple != "" {
+				defaultMounts = mountParse(mountJSON, mountSimple)
+			}
+			jes = append(jes, &jobqueue.JobEssence{Cmd: cmdLine, Cwd: cmdCwd, MountConfigs: defaultMounts})
+		}
+
+		tjs, err := jq.GetTrash(cmdIDStatus)
+		if err != nil {
+			die("failed to get commands in the trash: %s", err)
+		}
+		if cmdLine != "" {
+			key := jes[0].Key()
+			var matching []*jobqueue.TrashedJob
+			for _, tj := range tjs {
+				if tj.Job.ToEssense().Key() == key {
+					matching = append(matching, tj)
+				}
+			}
+			tjs = matching
+		} else {
+			for _, tj := range tjs {
+				jes = append(jes, tj.Job.ToEssense())
+			}
+		}
+
+		if len(tjs) == 0 {
+			die("No matching commands found in the trash")
+		}
+
+		if restoreList {
+			sort.Slice(tjs, func(i, j int) bool {
+				return tjs[i].Trashed.Before(tjs[j].Trashed)
+			})
+			for _, tj := range tjs {
+				fmt.Printf("%s\t%s\t%s\t%s\n", tj.Job.RepGroup, tj.Trashed.Format(time.RFC3339), tj.Expires.Format(time.RFC3339), tj.Job.Cmd)
+			}
+			return
+		}
+
+		restored, err := jq.Restore(jes)
+		if err != nil {
+			die("failed to restore desired commands: %s", err)
+		}
+		info("Restored %d commands (out of %d in the trash)", restored, len(tjs))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+
+	// flags specific to this sub-command
+	restoreCmd.Flags().BoolVarP(&cmdAll, "all", "a", false, "restore all commands in the trash")
+	restoreCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to restore")
+	restoreCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to restore")
+	restoreCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command specified by -l was set to run in")
+	restoreCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command specified by -l was set to use (JSON format)")
+	restoreCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command specified by -l was set to use (simple format)")
+	restoreCmd.Flags().BoolVar(&restoreList, "list", false, "list the matching commands in the trash instead of restoring them")
+
+	restoreCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -27,6 +27,7 @@ import (
 
 // options for this cmd
 var cmdAll bool
+var retryAuto bool
 
 // retryCmd represents the retry command
 var retryCmd = &cobra.Command{
@@ -36,7 +37,10 @@ var retryCmd = &cobra.Command{
 have since failed and become "buried" using this command.
 
 Specify one of the flags -f, -l, -i or -a to choose which commands you want to
-retry. Amongst those, only currently buried jobs will be affected.
+retry. Amongst those, only currently buried jobs will be affected. Add
+--fail_code to only retry those that failed for a particular reason (as shown by
+"wr status"), eg. --fail_code ram --auto to retry with more memory just the
+commands that ran out of it.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -44,7 +48,13 @@ In -f and -l mode you must provide the cwd the commands were set to run in, if
 CwdMatters (and must NOT be provided otherwise). Likewise provide the mounts
 options that was used when the command was added, if any. You can do this by
 using the -c and --mounts/--mounts_json options in -l mode, or by providing the
-same file you gave to "wr add" in -f mode.`,
+same file you gave to "wr add" in -f mode.
+
+"wr status" will show you a suggested fix for buried commands that failed for
+common reasons. With --auto, suggested fixes that only involve changing the
+resources a command is given (because it ran out of memory, time or disk space)
+are applied before the commands are retried. Other suggestions, such as creating
+a missing working directory, are up to you to act on first.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		set := countGetJobArgs()
 		if set > 1 {
@@ -71,6 +81,15 @@ same file you gave to "wr add" in -f mode.`,
 		}
 
 		jes := jobsToJobEssenses(jobs)
+		if retryAuto {
+			kicked, remediated, errk := jq.KickWithRemediation(jes)
+			if errk != nil {
+				die("failed to retry desired jobs: %s", errk)
+			}
+			info("Initiated retry of %d buried commands (out of %d eligible), %d with adjusted resource requirements", kicked, len(jobs), remediated)
+			return
+		}
+
 		kicked, err := jq.Kick(jes)
 		if err != nil {
 			die("failed to retry desired jobs: %s", err)
@@ -84,9 +103,11 @@ func init() {
 
 	// flags specific to this sub-command
 	retryCmd.Flags().BoolVarP(&cmdAll, "all", "a", false, "retry all buried jobs")
+	retryCmd.Flags().BoolVar(&retryAuto, "auto", false, "first apply suggested changes to resource requirements")
 	retryCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want to retry; - means read from STDIN")
 	retryCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to retry")
 	retryCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want to retry")
+	retryCmd.Flags().StringVar(&cmdFailCode, "fail_code", "", "only retry commands that failed with this code, eg. ram")
 	retryCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	retryCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	retryCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
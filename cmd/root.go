@@ -24,13 +24,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"syscall"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/inconshreveable/log15"
-	"github.com/sevlyar/go-daemon"
 	"github.com/spf13/cobra"
 )
 
@@ -95,11 +93,17 @@ func initConfig() {
 }
 
 // token reads and returns the token from the file created when the manager
-// starts.
+// starts. If that can't be read, eg. because the manager was started by someone
+// else, falls back on the read-only token, which is only good for status
+// queries.
 func token() ([]byte, error) {
 	token, err := ioutil.ReadFile(config.ManagerTokenFile)
 	if err != nil {
-		return nil, err
+		roToken, errr := ioutil.ReadFile(config.ManagerReadOnlyTokenFile)
+		if errr != nil {
+			return nil, err
+		}
+		return roToken, nil
 	}
 	return token, nil
 }
@@ -155,87 +159,6 @@ func createWorkingDir() {
 	}
 }
 
-// daemonize spawns a child copy of ourselves with the correct deployment (we
-// need to be careful because the default deployment depends on current dir, and
-// the child is forced to run from /). Supplying extraArgs can override earlier
-// args (to eg. re-specify an option with a relative path with an absolute
-// path).
-func daemonize(pidFile string, umask int, extraArgs ...string) (*os.Process, *daemon.Context) {
-	args := os.Args
-	hadDeployment := false
-	for _, arg := range args {
-		if arg == "--deployment" {
-			hadDeployment = true
-			break
-		}
-	}
-	if !hadDeployment {
-		args = append(args, "--deployment")
-		args = append(args, config.Deployment)
-	}
-
-	args = append(args, extraArgs...)
-
-	context := &daemon.Context{
-		PidFileName: pidFile,
-		PidFilePerm: 0644,
-		WorkDir:     "/",
-		Args:        args,
-		Umask:       umask,
-	}
-
-	child, err := context.Reborn()
-	if err != nil {
-		die("failed to daemonize: %s", err)
-	}
-	return child, context
-}
-
-// stopdaemon stops the daemon created by daemonize() by sending it SIGTERM and
-// checking it really exited
-func stopdaemon(pid int, source string) bool {
-	err := syscall.Kill(pid, syscall.SIGTERM)
-	if err != nil {
-		warn("wr manager is running with pid %d according to %s, but failed to send it SIGTERM: %s", pid, source, err)
-		return false
-	}
-
-	// wait a while for the daemon to gracefully close down
-	giveupseconds := 120
-	giveup := time.After(time.Duration(giveupseconds) * time.Second)
-	ticker := time.NewTicker(50 * time.Millisecond)
-	stopped := make(chan bool, 1)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				err = syscall.Kill(pid, syscall.Signal(0))
-				if err == nil {
-					// pid is still running
-					continue
-				}
-				// assume the error was "no such process" *** should I do a string comparison to confirm?
-				ticker.Stop()
-				stopped <- true
-				return
-			case <-giveup:
-				ticker.Stop()
-				stopped <- false
-				return
-			}
-		}
-	}()
-	ok := <-stopped
-
-	// if it didn't stop, offer to force kill it? That's a bit dangerous...
-	// just warn for now
-	if !ok {
-		warn("wr manager, running with pid %d according to %s, is still running %ds after I sent it a SIGTERM", pid, source, giveupseconds)
-	}
-
-	return ok
-}
-
 // sAddr gets a nice manager address to report in logs, preferring hostname,
 // falling back on the ip address if that wasn't set
 func sAddr(s *jobqueue.ServerInfo) string {
@@ -257,9 +180,16 @@ func connect(wait time.Duration, expectedToBeDown ...bool) *jobqueue.Client {
 		die("could not read token file; has the manager been started? [%s]", err)
 	}
 
+	jobqueue.ClientProxy = config.ManagerProxy
+	jobqueue.ClientProxySSHKey = internal.TildaToHome(config.ManagerProxySSHKey)
 	jq, err := jobqueue.Connect("localhost:"+config.ManagerPort, caFile, config.ManagerCertDomain, token, wait)
 	if err != nil && !(len(expectedToBeDown) == 1 && expectedToBeDown[0]) {
 		die("%s", err)
 	}
+	if jq != nil {
+		// we're short-lived, so there's no harm in not re-asking the manager
+		// about things that rarely change
+		jq.EnableCache(0)
+	}
 	return jq
 }
@@ -0,0 +1,375 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// runPollInterval is how often we check on the status of the command we're
+// waiting on.
+const runPollInterval = 1 * time.Second
+
+// runShellSpecialChars are the characters that cause us to quote an argument
+// when joining args in to a command line.
+const runShellSpecialChars = " \t\n'\"\\$`|&;<>()*?[]#~{}!"
+
+// options for this cmd
+var runRepGroup string
+var runRetries int
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run -- command [args...]",
+	Short: "Run a single command and wait for it to finish",
+	Long: `Run a single command through the queue, waiting for it to finish.
+
+This is like "wr add" for a single command, except that instead of returning
+immediately, wr waits until the command has completed or failed, showing what it
+writes to STDOUT and STDERR as it runs, and exits with the command's own exit
+code.
+This is useful for quick tasks that you want to run with the same scheduling,
+limits and accounting as your other commands, as you would with an interactive
+job in other job schedulers.
+
+Put your command after --, so that its own options aren't confused with those
+of wr:
+$ wr run -m 2G -- mytool --input foo.txt
+
+If your command uses pipes or other shell features, supply it as a single
+quoted argument:
+$ wr run -- 'mytool foo.txt | grep bar > out.txt'
+
+Output is shown within a second or so of the command writing it, though the
+command sees its STDOUT and STDERR as pipes rather than a terminal. (With an
+older manager that can't stream output, only the head and tail of long output
+is shown, once the command has finished.) By default the command is not retried
+if it fails; use --retries to change that.
+
+If the same command (in the same working directory) is already in the queue, wr
+run exits with an error instead of waiting on that one.
+
+If you interrupt wr run (eg. with ctrl-c) while it's waiting, the command will
+be killed if it is running, and then removed from the queue.
+
+The options are the same as for "wr add"; see its help text for details.`,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			die("the command to run must be supplied after --")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+
+		job, isLocal := runJob(jq, shellJoin(args))
+		var envVars []string
+		if isLocal {
+			envVars = os.Environ()
+		}
+
+		_, existed, err := jq.Add([]*jobqueue.Job{job}, envVars, false)
+		if err != nil {
+			die("%s", err)
+		}
+		if existed > 0 {
+			die("the same command (in the same working directory) is already in the queue; use 'wr status' to follow it")
+		}
+		info("Added command to the queue; waiting for it to finish")
+
+		exitCode := waitForRun(jq, job.ToEssense())
+
+		err = jq.Disconnect()
+		if err != nil {
+			warn("Disconnecting from the server failed: %s", err)
+		}
+		os.Exit(exitCode)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(runCmd)
+
+	// flags specific to this sub-command
+	runCmd.Flags().StringVarP(&runRepGroup, "report_grp", "i", "wr_run", "reporting group for your command")
+	runCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "base for the command's working dir")
+	runCmd.Flags().BoolVar(&cmdCwdMatters, "cwd_matters", false, "--cwd should be used as the actual working directory")
+	runCmd.Flags().BoolVar(&cmdChangeHome, "change_home", false, "when not --cwd_matters, set $HOME to the actual working directory")
+	runCmd.Flags().StringVarP(&reqGroup, "req_grp", "g", "", "group name for commands with similar reqs")
+	runCmd.Flags().StringVarP(&cmdMem, "memory", "m", "1G", "peak mem est. [specify units such as M for Megabytes or G for Gigabytes]")
+	runCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "max time est. [specify units such as m for minutes, h for hours or d for days]")
+	runCmd.Flags().IntVar(&cmdCPUs, "cpus", 1, "cpu cores needed")
+	runCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required [0 means do not check disk space] (default 0)")
+	runCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
+	runCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
+	runCmd.Flags().IntVarP(&runRetries, "retries", "r", 0, "[0-255] number of automatic retries if the command fails")
+	runCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "remote file systems to mount, in JSON format")
+	runCmd.Flags().StringVar(&mountSimple, "mounts", "", "remote file systems to mount, as a ,-separated list of [c|u][r|w]:bucket[/path]")
+	runCmd.Flags().StringVar(&cmdEnv, "env", "", "comma-separated list of key=value environment variables to set before running the command")
+	runCmd.Flags().StringVar(&cmdLimits, "limits", "", "comma-separated list of key=value umask and resource limits to run the command with")
+
+	runCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// shellJoin joins args in to a single command line, quoting any that contain
+// characters special to the shell. A single arg is returned as-is, so that
+// users can supply complex command lines (with pipes etc.) as one string.
+func shellJoin(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, runShellSpecialChars) {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		} else {
+			quoted[i] = arg
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// runJob creates the Job for the given command line, based on our command line
+// options. Also returns a bool for if the manager is on the same host as us.
+func runJob(jq *jobqueue.Client, cmdLine string) (*jobqueue.Job, bool) {
+	isLocal := managerIsLocal(jq)
+
+	jd := &jobqueue.JobDefaults{
+		RepGrp:     runRepGroup,
+		ReqGrp:     reqGroup,
+		Cwd:        cmdCwd,
+		CwdMatters: cmdCwdMatters,
+		ChangeHome: cmdChangeHome,
+		CPUs:       cmdCPUs,
+		Disk:       cmdDisk,
+		Override:   cmdOvr,
+		Priority:   cmdPri,
+		Retries:    runRetries,
+		Env:        cmdEnv,
+	}
+
+	if cmdMem != "" {
+		mb, err := jobqueue.ParseMemory(cmdMem)
+		if err != nil {
+			die("--memory was not specified correctly: %s", err)
+		}
+		jd.Memory = mb
+	}
+	if cmdTime != "" {
+		var err error
+		jd.Time, err = jobqueue.ParseDuration(cmdTime)
+		if err != nil {
+			die("--time was not specified correctly: %s", err)
+		}
+	}
+
+	if mountJSON != "" || mountSimple != "" {
+		jd.MountConfigs = mountParse(mountJSON, mountSimple)
+	}
+
+	if cmdLimits != "" {
+		var err error
+		jd.Limits, err = jobqueue.ParseProcessLimits(cmdLimits)
+		if err != nil {
+			die("bad --limits: %s", err)
+		}
+	}
+
+	// like wr add, we default to pwd if the manager is on the same host as us,
+	// or if cwd matters, /tmp otherwise
+	if jd.Cwd == "" {
+		if isLocal || cmdCwdMatters {
+			wd, err := os.Getwd()
+			if err != nil {
+				die("%s", err)
+			}
+			jd.Cwd = wd
+		} else {
+			warn("command working directory defaulting to /tmp since the manager is running remotely")
+		}
+	}
+
+	jvj := &jobqueue.JobViaJSON{Cmd: cmdLine}
+	job, err := jvj.Convert(jd)
+	if err != nil {
+		die("%s", err)
+	}
+
+	// we show the output as it is written, and also need to be able to show
+	// it at the end, even if the command succeeds, in case the manager can't
+	// stream it
+	job.StreamStd = true
+	job.KeepStd = true
+
+	return job, isLocal
+}
+
+// waitForRun waits for the job described by je to complete or be buried,
+// reporting on its progress and outputting its STDOUT and STDERR as they're
+// written. Returns the exit code we should exit with. If we get a signal to
+// stop, the job gets killed and removed.
+func waitForRun(jq *jobqueue.Client, je *jobqueue.JobEssence) int {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(runPollInterval)
+	defer ticker.Stop()
+
+	var lastState jobqueue.JobState
+	stream := &runStream{}
+	for {
+		select {
+		case <-sigs:
+			cancelRun(jq, je)
+			return 1
+		case <-ticker.C:
+		}
+
+		job, err := jq.GetByEssence(je, true, false)
+		if err != nil {
+			// the manager may only be temporarily unavailable
+			warn("could not get the status of the command: %s", err)
+			continue
+		}
+		if job == nil {
+			die("the command is no longer in the queue; was it removed?")
+		}
+
+		if job.State != lastState {
+			switch job.State {
+			case jobqueue.JobStateRunning:
+				info("Command is running on %s", job.Host)
+			case jobqueue.JobStateLost:
+				warn("Lost contact with the command running on %s", job.Host)
+			case jobqueue.JobStateDelayed:
+				info("Command failed (%s), but will be retried", job.FailReason)
+			}
+			lastState = job.State
+		}
+
+		// a complete or buried job sent the last of its output before it
+		// stopped running, so this gets all of it
+		stream.show(jq, je)
+
+		switch job.State {
+		case jobqueue.JobStateComplete:
+			if !stream.shown {
+				showRunOutput(job)
+			}
+			return 0
+		case jobqueue.JobStateBuried:
+			if !stream.shown {
+				showRunOutput(job)
+			}
+			warn("Command failed: %s", job.FailReason)
+			if job.Exited && job.Exitcode > 0 {
+				return job.Exitcode
+			}
+			return 1
+		}
+	}
+}
+
+// runStream follows the output of the command being run.
+type runStream struct {
+	last   *jobqueue.StreamedStd
+	shown  bool // true once we've shown any output
+	failed bool // true if the manager can't stream output
+}
+
+// show prints the STDOUT and STDERR that the command described by je wrote
+// since we were last called to our own.
+func (rs *runStream) show(jq *jobqueue.Client, je *jobqueue.JobEssence) {
+	if rs.failed {
+		return
+	}
+	std, err := jq.GetStreamedStd(je, rs.last)
+	if err != nil {
+		if jqerr, ok := err.(jobqueue.Error); ok && jqerr.Err == jobqueue.ErrUnknownCommand {
+			rs.failed = true
+			return
+		}
+		// the manager may only be temporarily unavailable
+		warn("could not get the output of the command: %s", err)
+		return
+	}
+	rs.last = std
+
+	if len(std.StdOut) > 0 {
+		os.Stdout.Write(std.StdOut) // #nosec nothing useful to do if we can't write our own output
+		rs.shown = true
+	}
+	if len(std.StdErr) > 0 {
+		os.Stderr.Write(std.StdErr) // #nosec nothing useful to do if we can't write our own output
+		rs.shown = true
+	}
+}
+
+// showRunOutput prints the STDOUT and STDERR of the given job to our own.
+func showRunOutput(job *jobqueue.Job) {
+	stdout, err := job.StdOut()
+	if err != nil {
+		warn("problem reading the command's STDOUT: %s", err)
+	} else if stdout != "" {
+		fmt.Fprintln(os.Stdout, stdout)
+	}
+	stderr, err := job.StdErr()
+	if err != nil {
+		warn("problem reading the command's STDERR: %s", err)
+	} else if stderr != "" {
+		fmt.Fprintln(os.Stderr, stderr)
+	}
+}
+
+// cancelRun kills the job described by je if it's running, and removes it from
+// the queue.
+func cancelRun(jq *jobqueue.Client, je *jobqueue.JobEssence) {
+	jes := []*jobqueue.JobEssence{je}
+	_, err := jq.Kill(jes)
+	if err != nil {
+		warn("failed to kill the command: %s", err)
+	}
+
+	// a killed command only becomes removable once its runner has noticed it
+	// was killed and has buried it
+	giveup := time.After(2 * jobqueue.ClientTouchInterval)
+	ticker := time.NewTicker(runPollInterval)
+	defer ticker.Stop()
+	for {
+		removed, err := jq.Delete(jes)
+		if err == nil && removed == 1 {
+			info("Command was removed from the queue")
+			return
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-giveup:
+			warn("Could not remove the command from the queue; use 'wr remove' once it has been killed")
+			return
+		}
+	}
+}
@@ -21,6 +21,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -38,6 +39,11 @@ var reserveint int
 var rserver string
 var rdomain string
 var maxtime int
+var runnerNoSupervisor bool
+
+// runnerSupervisedEnvVar is set in the environment of a runner started by a
+// supervising runner.
+const runnerSupervisedEnvVar = "WR_RUNNER_SUPERVISED"
 
 // runnerCmd represents the runner command
 var runnerCmd = &cobra.Command{
@@ -53,7 +59,29 @@ runner will pick up another and so on. Once max_time has been used (or would be
 used based on the expected time to complete of the next queued command), the
 runner stops picking up new commands and exits instead; max_time does not cause
 the runner to kill itself if the cmd it is running takes longer than max_time to
-complete.`,
+complete.
+
+If the runner loses contact with the manager while running a command, it keeps
+running it, and reports on it once the manager comes back (including a restarted
+manager, if it was started with a --reattach_grace that hasn't yet elapsed). If
+the manager stays away for too long, details of how the command went are kept in
+the "inflight" sub-directory of your managerdir, and the next runner started on
+the same host reports on them.
+
+Before running the first command that has a host setup command, that is run
+(once per host). When a runner exits, any host cleanup commands of the commands
+it ran are run, if no other runner on the host is still running such commands.
+
+Before and after running each command, any working directories on the host that
+were kept due to a command's --sandbox setting, and which have now been kept for
+long enough, are deleted.
+
+Unless --no_supervisor is given, the runner actually runs as a child of a small
+supervising process. If the runner panics or gets killed (eg. by the OOM killer)
+while running commands, the supervisor records what happened in the "crashes"
+sub-directory of your managerdir, and the next runner started on the same host
+reports it to the manager, so that 'wr status' can tell you why contact was lost
+with those commands.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if runtime.NumCPU() == 1 {
 			// we might lock up with only 1 proc if we mount
@@ -69,6 +97,13 @@ complete.`,
 		rtimeout := time.Duration(reserveint) * time.Second
 
 		jobqueue.AppName = "wr"
+		jobqueue.ClientInFlightDir = filepath.Join(config.ManagerDir, "inflight")
+		jobqueue.ClientCrashDir = filepath.Join(config.ManagerDir, "crashes")
+
+		if !runnerNoSupervisor && os.Getenv(runnerSupervisedEnvVar) == "" {
+			superviseRunner()
+			return
+		}
 
 		token, err := token()
 		if err != nil {
@@ -85,6 +120,28 @@ complete.`,
 			}
 		}()
 
+		// if a previous runner on this host crashed, or lost contact with the
+		// manager before it could report how its commands went, report that
+		// now
+		crashed, err := jq.ReportRunnerCrashes()
+		if err != nil {
+			warn("reporting on crashes of previous runners failed: %s", err)
+		}
+		if crashed > 0 {
+			info("reported previous runner crashes affecting %d commands", crashed)
+		}
+		reconciled, err := jq.ReconcileInFlight()
+		if err != nil {
+			warn("reporting on commands run by previous runners failed: %s", err)
+		}
+		if reconciled > 0 {
+			info("reported on %d commands run by previous runners", reconciled)
+		}
+
+		// delete any kept working directories on this host that the manager
+		// says have expired
+		reapSandboxes(jq)
+
 		// in case any job we execute has a Cmd that calls `wr add`, we will
 		// override their environment to make that call work
 		var envOverrides []string
@@ -169,6 +226,12 @@ complete.`,
 			}
 
 			numrun++
+			reapSandboxes(jq)
+		}
+
+		err = jq.HostCleanup()
+		if err != nil {
+			warn("host cleanup failed: %s", err)
 		}
 
 		info("wr runner exiting, having run %d commands, because %s", numrun, exitReason)
@@ -184,5 +247,44 @@ func init() {
 	runnerCmd.Flags().IntVarP(&reserveint, "reserve_timeout", "r", 2, "how long (seconds) to wait for there to be a command in the queue, before exiting")
 	runnerCmd.Flags().IntVarP(&maxtime, "max_time", "m", 0, "maximum time (minutes) to run for before exiting; 0 means unlimited")
 	runnerCmd.Flags().StringVar(&rserver, "server", internal.DefaultServer(appLogger), "ip:port of wr manager")
+	runnerCmd.Flags().BoolVar(&runnerNoSupervisor, "no_supervisor", false, "don't run under a supervisor that records crashes")
 	runnerCmd.Flags().StringVar(&rdomain, "domain", internal.DefaultConfig(appLogger).ManagerCertDomain, "domain the manager's cert is valid for")
 }
+
+// superviseRunner runs our own command line again as a supervised child
+// process, then exits with its exit code.
+func superviseRunner() {
+	exe, err := osext.Executable()
+	if err != nil {
+		die("%s", err)
+	}
+	child := exec.Command(exe, os.Args[1:]...) // #nosec we're just re-running ourselves
+	child.Env = append(os.Environ(), runnerSupervisedEnvVar+"=1")
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	code, crash, err := jobqueue.SuperviseRunner(child)
+	if err != nil {
+		warn("supervising the runner failed: %s", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	if crash != nil {
+		warn("the runner (pid %d) crashed: %s", crash.PID, crash.Reason)
+	}
+	os.Exit(code)
+}
+
+// reapSandboxes deletes the expired kept working directories on this host,
+// warning about any problems.
+func reapSandboxes(jq *jobqueue.Client) {
+	reaped, err := jq.ReapSandboxes()
+	if err != nil {
+		warn("deleting expired working directories failed: %s", err)
+	}
+	if reaped > 0 {
+		info("deleted %d expired working directories", reaped)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// secretCmd represents the secret command
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage secrets for your commands",
+	Long: `Manage secrets, such as credentials, that your commands need.
+
+Secrets are stored by the manager in its database, encrypted with a key kept in
+wr's working directory. Commands that list a secret's name in their "secrets"
+option (see 'wr add -h') will have its value in an environment variable of the
+same name while they run, so you don't need to put credentials in your input
+files or in the environment variables stored with your commands.
+
+Once set, the value of a secret can't be retrieved, only replaced or deleted.`,
+}
+
+// set sub-command stores a secret
+var secretSetCmd = &cobra.Command{
+	Use:   "set NAME",
+	Short: "Store a secret",
+	Long: `Store a secret under the given name, replacing any existing secret
+with that name.
+
+The name must be a valid environment variable name. The value is read from
+STDIN; if that is a terminal you will be prompted for it, and what you type will
+not be echoed. Otherwise, a single trailing newline is removed, so you can do:
+echo "my_password" | wr secret set MY_PASSWORD`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		value := readSecretValue()
+		if len(value) == 0 {
+			die("the secret's value can't be empty")
+		}
+
+		jq := secretConnect()
+		defer secretDisconnect(jq)
+
+		err := jq.SetSecret(args[0], value)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Stored secret %s", args[0])
+	},
+}
+
+// delete sub-command removes a secret
+var secretDeleteCmd = &cobra.Command{
+	Use:   "delete NAME",
+	Short: "Delete a secret",
+	Long: `Delete the secret with the given name.
+
+Commands that need it and have not yet started running will be buried when they
+try to start.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := secretConnect()
+		defer secretDisconnect(jq)
+
+		err := jq.DeleteSecret(args[0])
+		if err != nil {
+			die("%s", err)
+		}
+		info("Deleted secret %s", args[0])
+	},
+}
+
+// list sub-command shows the names of stored secrets
+var secretListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of stored secrets",
+	Long:  `List the names (but not the values) of all stored secrets.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := secretConnect()
+		defer secretDisconnect(jq)
+
+		names, err := jq.GetSecretNames()
+		if err != nil {
+			die("%s", err)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(secretCmd)
+	secretCmd.AddCommand(secretSetCmd)
+	secretCmd.AddCommand(secretDeleteCmd)
+	secretCmd.AddCommand(secretListCmd)
+
+	secretCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// readSecretValue reads the value of a secret from STDIN.
+func readSecretValue() []byte {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Secret value: ")
+		value, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			die("could not read the secret: %s", err)
+		}
+		return value
+	}
+
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		die("could not read the secret from STDIN: %s", err)
+	}
+	return []byte(strings.TrimSuffix(strings.TrimSuffix(string(value), "\n"), "\r"))
+}
+
+// secretConnect connects to the manager for the secret sub-commands.
+func secretConnect() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// secretDisconnect disconnects from the manager, warning on failure.
+func secretDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// shellReqGroup is the ReqGroup of the placeholder jobs we create, so that
+// they don't interfere with learning about real commands.
+const shellReqGroup = "wr_shell"
+
+// options for this cmd
+var shellSSHKey string
+
+// shellCmd represents the shell command
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Get an interactive shell on a node allocated to you",
+	Long: `Get an interactive shell on a node allocated to you by wr.
+
+This requests the given resources (memory, time, cpus, disk and cloud options)
+in exactly the same way as "wr add" does for normal commands, by adding a
+placeholder command to the queue that does nothing but hold on to the allocated
+resources. Once that starts running on some host, you are dropped in to an
+interactive shell in its working directory on that host, letting you debug
+things in the exact environment your commands run in.
+
+If the host is the one you're on now, a local shell is started for you,
+otherwise you're connected to the host using ssh. For hosts in the cloud, you
+will need to supply the --cloud_username and the --ssh_key that lets you log in
+to them.
+
+When you exit the shell, or if you interrupt wr shell while it's waiting for
+resources, the placeholder command is killed and removed from the queue,
+releasing the resources. The placeholder only holds the resources for --time,
+after which your shell will continue to work, but wr may start running other
+commands using those resources.`,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		job := shellJob()
+		_, _, err := jq.Add([]*jobqueue.Job{job}, os.Environ(), false)
+		if err != nil {
+			die("%s", err)
+		}
+		je := job.ToEssense()
+		info("Waiting for resources to be allocated...")
+
+		running := waitForRunning(jq, je)
+		if running == nil {
+			return
+		}
+		defer cancelRun(jq, je)
+
+		dir := running.ActualCwd
+		if dir == "" {
+			dir = running.Cwd
+		}
+		info("Resources allocated on %s", running.Host)
+
+		err = interactiveShell(running.Host, running.HostIP, dir, nil)
+		if err != nil {
+			warn("shell exited with an error: %s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(shellCmd)
+
+	// flags specific to this sub-command
+	shellCmd.Flags().StringVarP(&cmdMem, "memory", "m", "1G", "memory to reserve [specify units such as M for Megabytes or G for Gigabytes]")
+	shellCmd.Flags().StringVarP(&cmdTime, "time", "t", "1h", "how long to reserve resources for [specify units such as m for minutes, h for hours or d for days]")
+	shellCmd.Flags().IntVar(&cmdCPUs, "cpus", 1, "cpu cores to reserve")
+	shellCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required (default 0)")
+	shellCmd.Flags().StringVar(&cmdOsPrefix, "cloud_os", "", "in the cloud, prefix name of the OS image your server must use")
+	shellCmd.Flags().StringVar(&cmdOsUsername, "cloud_username", "", "in the cloud, username needed to log in to the OS image specified by --cloud_os")
+	shellCmd.Flags().IntVar(&cmdOsRAM, "cloud_ram", 0, "in the cloud, ram (MB) needed by the OS image specified by --cloud_os")
+	shellCmd.Flags().StringVar(&cmdFlavor, "cloud_flavor", "", "in the cloud, exact name of the server flavor you want")
+	shellCmd.Flags().StringVarP(&shellSSHKey, "ssh_key", "k", "", "path to the private key needed to ssh to the allocated host")
+
+	shellCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// shellJob creates the placeholder Job that will hold on to the desired
+// resources for our shell.
+func shellJob() *jobqueue.Job {
+	jd := &jobqueue.JobDefaults{
+		RepGrp:      shellReqGroup + "_" + realUsername(),
+		ReqGrp:      shellReqGroup,
+		Cwd:         "/tmp",
+		CPUs:        cmdCPUs,
+		Disk:        cmdDisk,
+		Override:    2,
+		CloudOS:     cmdOsPrefix,
+		CloudUser:   cmdOsUsername,
+		CloudOSRam:  cmdOsRAM,
+		CloudFlavor: cmdFlavor,
+	}
+
+	mb, err := jobqueue.ParseMemory(cmdMem)
+	if err != nil {
+		die("--memory was not specified correctly: %s", err)
+	}
+	jd.Memory = mb
+
+	jd.Time, err = jobqueue.ParseDuration(cmdTime)
+	if err != nil {
+		die("--time was not specified correctly: %s", err)
+	}
+
+	// the comment makes the cmd unique, so that multiple shells can be
+	// requested at once
+	hold := fmt.Sprintf("sleep %d # wr shell %d", int(math.Ceil(jd.Time.Seconds())), time.Now().UnixNano())
+	jvj := &jobqueue.JobViaJSON{Cmd: hold}
+	job, err := jvj.Convert(jd)
+	if err != nil {
+		die("%s", err)
+	}
+	return job
+}
+
+// waitForRunning waits for the job described by je to start running, and then
+// returns it. If the job fails to start, or we get a signal to stop, the job is
+// removed and nil is returned.
+func waitForRunning(jq *jobqueue.Client, je *jobqueue.JobEssence) *jobqueue.Job {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(runPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigs:
+			cancelRun(jq, je)
+			return nil
+		case <-ticker.C:
+		}
+
+		job, err := jq.GetByEssence(je, false, false)
+		if err != nil {
+			warn("could not get the status of the resource request: %s", err)
+			continue
+		}
+		if job == nil {
+			warn("the resource request is no longer in the queue; was it removed?")
+			return nil
+		}
+
+		switch job.State {
+		case jobqueue.JobStateRunning:
+			return job
+		case jobqueue.JobStateBuried, jobqueue.JobStateComplete:
+			warn("the resource request ended without running: %s", job.FailReason)
+			cancelRun(jq, je)
+			return nil
+		}
+	}
+}
+
+// interactiveShell starts a login shell in dir (if not blank) on the given
+// host, connecting to it with ssh (with any extra sshArgs) if it's not the host
+// we're on, and waits for the user to exit it.
+func interactiveShell(host, hostIP, dir string, extraSSHArgs []string) error {
+	var cmd *exec.Cmd
+	localHost, err := os.Hostname()
+	if err != nil {
+		localHost = "localhost"
+	}
+	localIP, err := jobqueue.CurrentIP("")
+	if err != nil {
+		warn("Could not get current IP: %s", err)
+	}
+	if host == localHost || host == "localhost" || (hostIP != "" && hostIP == localIP) {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/bash"
+		}
+		cmd = exec.Command(shell, "-l") // #nosec
+		cmd.Dir = dir
+	} else {
+		target := hostIP
+		if target == "" {
+			target = host
+		}
+		if cmdOsUsername != "" {
+			target = cmdOsUsername + "@" + target
+		}
+		sshArgs := []string{"-t", "-o", "UserKnownHostsFile /dev/null", "-o", "StrictHostKeyChecking no"}
+		if shellSSHKey != "" {
+			sshArgs = append(sshArgs, "-i", shellSSHKey)
+		}
+		sshArgs = append(sshArgs, extraSSHArgs...)
+		remoteCmd := "exec ${SHELL:-/bin/sh} -l"
+		if dir != "" {
+			remoteCmd = fmt.Sprintf("cd %s; %s", shellQuote(dir), remoteCmd)
+		}
+		sshArgs = append(sshArgs, target, remoteCmd)
+		cmd = exec.Command("/usr/bin/ssh", sshArgs...) // #nosec
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// the shell handles ctrl-c and the like itself; we must not die
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	return cmd.Run()
+}
+
+// shellQuote single-quotes the given string for use in a shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,149 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// options for this cmd
+var simCount int
+var simMem string
+var simTime string
+var simCPUs int
+var simDisk int
+var simMaxServers int
+
+// simFile is the format of the managersimfile.
+type simFile struct {
+	Flavors      []*jqs.SimFlavor `json:"flavors"`
+	MaxInstances int              `json:"max_instances"`
+	MaxCores     int              `json:"max_cores"`
+	MaxRAM       int              `json:"max_ram"`
+	SpawnTime    int              `json:"spawn_time"`
+	KeepTime     int              `json:"keep_time"`
+}
+
+// simulateCmd represents the simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Estimate the time and cost of running commands in a cloud",
+	Long: `Estimate how long it would take, and how much it would cost, to run a
+batch of commands in the cloud described by your managersimfile.
+
+The managersimfile (see wr's config file) describes the flavors of server the
+cloud has, along with their prices, the quota and how long servers take to
+spawn. This command models running --count commands that each need the given
+--cpus, --memory and --disk for --time, starting them in order as soon as the
+quota allows, without running anything or contacting any cloud. Use
+--max_servers to try out a different instance quota.
+
+You can also start the manager with '--scheduler simulator' to really run
+commands (on the local machine) while the simulated cloud decides when they may
+start; 'wr manager stop' then logs what the servers would have cost.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if simCount <= 0 {
+			die("--count must be greater than 0")
+		}
+		simConfig := parseSimFile(config.ManagerSimFile)
+		if simMaxServers > 0 {
+			simConfig.MaxInstances = simMaxServers
+		}
+
+		mb, err := jobqueue.ParseMemory(simMem)
+		if err != nil {
+			die("--memory was not specified correctly: %s", err)
+		}
+		d, err := jobqueue.ParseDuration(simTime)
+		if err != nil {
+			die("--time was not specified correctly: %s", err)
+		}
+		req := &jqs.Requirements{RAM: mb, Time: d, Cores: simCPUs, Disk: simDisk}
+		reqs := make([]*jqs.Requirements, simCount)
+		for i := range reqs {
+			reqs[i] = req
+		}
+
+		report, err := jqs.Simulate(simConfig, reqs)
+		if err != nil {
+			die("%s", err)
+		}
+		info("%d commands would finish after %s, using %d servers (at most %d at once), costing %.2f", report.Jobs, report.Duration, report.Servers, report.PeakServers, report.Cost)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(simulateCmd)
+
+	// flags specific to this sub-command
+	simulateCmd.Flags().IntVarP(&simCount, "count", "n", 0, "number of commands to simulate")
+	simulateCmd.Flags().StringVarP(&simMem, "memory", "m", "1G", "peak mem of each command [specify units such as M for Megabytes or G for Gigabytes]")
+	simulateCmd.Flags().StringVarP(&simTime, "time", "t", "1h", "time each command takes [specify units such as m for minutes, h for hours or d for days]")
+	simulateCmd.Flags().IntVar(&simCPUs, "cpus", 1, "cpu cores each command needs")
+	simulateCmd.Flags().IntVar(&simDisk, "disk", 0, "GB of disk space each command needs")
+	simulateCmd.Flags().IntVar(&simMaxServers, "max_servers", 0, "override the max_instances quota of the managersimfile")
+}
+
+// parseSimFile parses the managersimfile, a YAML (or JSON) description of the
+// cloud that the simulator scheduler models.
+func parseSimFile(path string) *jqs.ConfigSimulator {
+	if path == "" {
+		die("the managersimfile option must be set in wr's config file to simulate a cloud")
+	}
+	content, err := ioutil.ReadFile(internal.TildaToHome(path))
+	if err != nil {
+		die("managersimfile could not be read: %s", err)
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(content, &generic)
+	if err != nil {
+		die("managersimfile %s could not be parsed: %s", path, err)
+	}
+	jsonBytes, err := json.Marshal(yamlToJSONable(generic))
+	if err != nil {
+		die("managersimfile %s could not be parsed: %s", path, err)
+	}
+	sf := &simFile{}
+	err = json.Unmarshal(jsonBytes, sf)
+	if err != nil {
+		die("managersimfile %s was not specified correctly: %s", path, err)
+	}
+	if len(sf.Flavors) == 0 {
+		die("managersimfile %s does not list any flavors", path)
+	}
+
+	return &jqs.ConfigSimulator{
+		Flavors:        sf.Flavors,
+		MaxInstances:   sf.MaxInstances,
+		MaxCores:       sf.MaxCores,
+		MaxRAM:         sf.MaxRAM,
+		SpawnTime:      time.Duration(sf.SpawnTime) * time.Second,
+		ServerKeepTime: time.Duration(sf.KeepTime) * time.Second,
+		Shell:          config.RunnerExecShell,
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var sshJobKey string
+var sshProvider string
+var sshCwd bool
+
+// sshCmd represents the ssh command
+var sshCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Get a shell on the host a command is running on",
+	Long: `Get an interactive shell on the host that one of your commands is
+running (or ran) on, to help debug it.
+
+Supply the key of the command with -i; 'wr status' shows you the keys of your
+commands. With --cwd, you start in the command's actual working directory.
+
+If the host is the one you're on now, a local shell is started for you,
+otherwise you're connected to the host using ssh. If you did a 'wr cloud
+deploy', the connection goes via the server the manager is running on, using
+the key and username of your deployment, so that you can reach hosts on the
+deployment's private network. In that case you'll be logged in to the host as
+the command's cloud_username if it had one. Otherwise, or if you need to
+override these, supply the --cloud_username and --ssh_key to use.`,
+	Run: func(cobraCmd *cobra.Command, args []string) {
+		if sshJobKey == "" {
+			die("-i is required")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		job, err := jq.GetByEssence(&jobqueue.JobEssence{JobKey: sshJobKey}, false, false)
+		if err != nil {
+			die("%s", err)
+		}
+		if job == nil {
+			die("no command with key %s was found", sshJobKey)
+		}
+		if job.Host == "" {
+			die("command %s hasn't started running yet", sshJobKey)
+		}
+		if job.State != jobqueue.JobStateRunning {
+			warn("command %s is not running, so the host it ran on may no longer exist", sshJobKey)
+		}
+
+		var dir string
+		if sshCwd {
+			dir = job.ActualCwd
+			if dir == "" {
+				dir = job.Cwd
+			}
+		}
+
+		var sshArgs []string
+		if head := cloudHead(sshProvider); head != "" {
+			keyPath := cloudKeyPath(sshProvider)
+			if shellSSHKey == "" {
+				shellSSHKey = keyPath
+			}
+			if cmdOsUsername == "" {
+				cmdOsUsername = job.Requirements.Other["cloud_user"]
+				if cmdOsUsername == "" {
+					cmdOsUsername = strings.Split(head, "@")[0]
+				}
+			}
+			proxy := "/usr/bin/ssh -i " + shellQuote(keyPath) + " -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no -W %h:%p " + head
+			sshArgs = append(sshArgs, "-o", "ProxyCommand "+proxy)
+		}
+
+		info("Connecting to %s", job.Host)
+		err = interactiveShell(job.Host, job.HostIP, dir, sshArgs)
+		if err != nil {
+			warn("shell exited with an error: %s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(sshCmd)
+
+	// flags specific to this sub-command
+	sshCmd.Flags().StringVarP(&sshJobKey, "identifier", "i", "", "key of the command whose host you want a shell on")
+	sshCmd.Flags().BoolVarP(&sshCwd, "cwd", "c", false, "start in the command's working directory")
+	sshCmd.Flags().StringVarP(&sshProvider, "provider", "p", "openstack", "['openstack','terraform'] cloud provider you did a 'wr cloud deploy' with")
+	sshCmd.Flags().StringVar(&cmdOsUsername, "cloud_username", "", "username needed to log in to the host")
+	sshCmd.Flags().StringVarP(&shellSSHKey, "ssh_key", "k", "", "path to the private key needed to ssh to the host")
+
+	sshCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// cloudKeyPath returns the path to the private key 'wr cloud deploy' created
+// for the given provider.
+func cloudKeyPath(provider string) string {
+	return filepath.Join(config.ManagerDir, "cloud_resources."+provider+".key")
+}
+
+// cloudHeadPath returns the path to the file that 'wr cloud deploy' records
+// the user@ip of the server it started the manager on in.
+func cloudHeadPath(provider string) string {
+	return filepath.Join(config.ManagerDir, "cloud_resources."+provider+".head")
+}
+
+// cloudHead returns the user@ip of the server that 'wr cloud deploy' started
+// the manager on, or blank if there is no current deployment.
+func cloudHead(provider string) string {
+	head, err := ioutil.ReadFile(cloudHeadPath(provider))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(head))
+}
@@ -0,0 +1,230 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var statsRepGroup string
+var statsSince string
+var statsJSON bool
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Get statistics about the manager's queue",
+	Long: `Get statistics about the manager's queue.
+
+The manager periodically records how many commands were in each state, how
+many runners it wanted, and any problems that stopped it running more (see the
+--timeline_interval option to 'wr manager start'), and summarises any metrics
+your commands emitted. Use the sub-commands to report on these.`,
+}
+
+// timeline sub-command shows how the queue changed over time
+var statsTimelineCmd = &cobra.Command{
+	Use:   "timeline",
+	Short: "Show how commands progressed over time",
+	Long: `Show how commands progressed over time.
+
+Each line of the output is one of the manager's recordings of the state of the
+queue, giving the number of commands that were pending (delayed, ready or
+waiting on dependencies), running, lost, buried and complete, along with the
+number of runners the manager wanted and the reasons it gave for not being able
+to run more, if any. Together these let you see when your commands were run,
+and when and why they were held up, eg. for SLA reporting.
+
+By default the counts are of all commands; use -i to limit them to a rep_grp
+(and those below it, if you use a hierarchy of rep_grps).
+
+--since limits the output to recordings made in that long before now, eg.
+--since 48h.
+
+--json outputs the recordings as JSON, one per line, with the counts of every
+rep_grp under -i, for use in your own reports or charts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var since time.Time
+		if statsSince != "" {
+			ago, err := time.ParseDuration(statsSince)
+			if err != nil {
+				die("--since was not specified correctly: %s", err)
+			}
+			since = time.Now().Add(-ago)
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		tss, err := jq.GetTimeline(statsRepGroup, since)
+		if errd := jq.Disconnect(); errd != nil {
+			warn("Disconnecting from the server failed: %s", errd)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+
+		if statsJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetEscapeHTML(false)
+			for _, ts := range tss {
+				if err = encoder.Encode(ts); err != nil {
+					die("%s", err)
+				}
+			}
+			return
+		}
+
+		if len(tss) == 0 {
+			info("No recordings of the queue's state were found")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "time\tpending\trunning\tlost\tburied\tcomplete\trunners\tblocked")
+		for _, ts := range tss {
+			counts := timelineCounts(ts, statsRepGroup)
+			pending := counts[jobqueue.JobStateDelayed] + counts[jobqueue.JobStateReady] + counts[jobqueue.JobStateDependent]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", ts.Time.Format("2006-01-02 15:04:05"), pending, counts[jobqueue.JobStateRunning], counts[jobqueue.JobStateLost], counts[jobqueue.JobStateBuried], counts[jobqueue.JobStateComplete], ts.Runners, timelineBlocked(ts))
+		}
+		err = w.Flush()
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
+// metrics sub-command summarises the metrics emitted by commands
+var statsMetricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Summarise the metrics your commands emitted",
+	Long: `Summarise the metrics your commands emitted.
+
+Commands can emit named numeric metrics (eg. QC values like the number of reads
+mapped) by appending lines of the form "name value" to the file named in their
+$WR_METRICS_FILE environment variable. This shows the count, mean, minimum,
+maximum and sum of each metric for the given rep_grp (-i, required) and each
+rep_grp below it, if you use a hierarchy of rep_grps. Only the metrics of the
+most recent run of each command are included.
+
+--json outputs the summaries as JSON, one rep_grp per line, for use in your own
+reports.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if statsRepGroup == "" {
+			die("--identifier is required")
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		rgms, err := jq.GetRepGroupMetrics(statsRepGroup)
+		if errd := jq.Disconnect(); errd != nil {
+			warn("Disconnecting from the server failed: %s", errd)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+
+		if statsJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetEscapeHTML(false)
+			for _, rgm := range rgms {
+				if err = encoder.Encode(rgm); err != nil {
+					die("%s", err)
+				}
+			}
+			return
+		}
+
+		if len(rgms) == 0 {
+			info("No metrics were emitted by commands in that rep_grp")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "rep_grp\tmetric\tcount\tmean\tmin\tmax\tsum")
+		for _, rgm := range rgms {
+			names := make([]string, 0, len(rgm.Metrics))
+			for name := range rgm.Metrics {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				ms := rgm.Metrics[name]
+				fmt.Fprintf(w, "%s\t%s\t%d\t%g\t%g\t%g\t%g\n", rgm.RepGroup, name, ms.Count, ms.Mean(), ms.Min, ms.Max, ms.Sum)
+			}
+		}
+		err = w.Flush()
+		if err != nil {
+			die("%s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statsCmd)
+	statsCmd.AddCommand(statsTimelineCmd)
+	statsCmd.AddCommand(statsMetricsCmd)
+
+	statsTimelineCmd.Flags().StringVarP(&statsRepGroup, "identifier", "i", "", "limit counts to this rep_grp")
+	statsTimelineCmd.Flags().StringVar(&statsSince, "since", "", "only show recordings made in this long before now [specify units such as h for hours]")
+	statsTimelineCmd.Flags().BoolVar(&statsJSON, "json", false, "output the recordings as JSON")
+
+	statsMetricsCmd.Flags().StringVarP(&statsRepGroup, "identifier", "i", "", "rep_grp to summarise the metrics of")
+	statsMetricsCmd.Flags().BoolVar(&statsJSON, "json", false, "output the summaries as JSON")
+
+	statsCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// timelineCounts returns the state counts of the given rep_grp in the given
+// snapshot, or the total of all rep_grps if repGroup is blank.
+func timelineCounts(ts *jobqueue.TimelineSnapshot, repGroup string) map[jobqueue.JobState]int {
+	if repGroup != "" {
+		return ts.Counts(repGroup)
+	}
+	total := make(map[jobqueue.JobState]int)
+	for _, rgc := range ts.RepGroups {
+		if strings.Contains(rgc.RepGroup, jobqueue.RepGroupSeparator) {
+			continue
+		}
+		for state, count := range rgc.Counts {
+			total[state] += count
+		}
+	}
+	return total
+}
+
+// timelineBlocked describes why the manager wasn't running more at the time of
+// the given snapshot.
+func timelineBlocked(ts *jobqueue.TimelineSnapshot) string {
+	reasons := ts.Blocked
+	if ts.Draining {
+		reasons = append([]string{"draining"}, reasons...)
+	}
+	if len(reasons) == 0 {
+		return "-"
+	}
+	return strings.Join(reasons, "; ")
+}
@@ -19,12 +19,16 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const shortTimeFormat = "06/1/2-15:04:05"
@@ -33,11 +37,18 @@ const shortTimeFormat = "06/1/2-15:04:05"
 var cmdFileStatus string
 var cmdIDStatus string
 var cmdLine string
+var cmdLabelStatus string
+var statusTree bool
 var showBuried bool
 var showStd bool
 var showEnv bool
 var quietMode bool
 var statusLimit int
+var failedSummary bool
+var cmdFailCode string
+var statusJSON bool
+var statusJSONL bool
+var statusYAML bool
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
@@ -46,9 +57,17 @@ var statusCmd = &cobra.Command{
 	Long: `You can find the status of commands you've previously added using
 "wr add" or "wr setup" by running this command.
 
-Specify one of the flags -f, -l  or -i to choose which commands you want the
-status of. If none are supplied, it gives you an overview of all your currently
-incomplete commands.
+Specify one of the flags -f, -l, -i or --label to choose which commands you
+want the status of. If none are supplied, it gives you an overview of all your
+currently incomplete commands.
+
+--label takes a key=value label (see "wr add -h") and finds your incomplete
+commands that were tagged with it. Supply just a key to find commands with that
+label key regardless of its value.
+
+--fail_code limits the commands found to those that last failed for a particular
+reason, identified by its short code, eg. "ram" for commands that used too much
+memory. Each reason for failure shown by this command is followed by its code.
 
 The file to provide -f is in the format taken by "wr add".
 
@@ -63,11 +82,44 @@ grouped together and only a random 1 of them is displayed (and you are told how
 many were skipped). --limit changes how many commands in each of these groups
 are displayed. A limit of 0 turns off grouping and shows all your desired
 commands individually, but you could hit a timeout if retrieving the details of
-very many (tens of thousands+) commands.`,
+very many (tens of thousands+) commands.
+
+--failed-summary instead gives you an overview of why your buried commands
+failed, optionally limited to those with the identifier given to -i. Commands
+whose final line of STDERR is the same (ignoring any paths and numbers in it)
+are counted together, and you are told how many hosts they failed on.
+
+Identifiers can be hierarchical, with levels separated by "/", eg.
+project/stage/sample. With --tree, -i also matches the commands with
+identifiers below the one you give, so "-i project/stage --tree" finds those
+with identifier project/stage/sample1 and project/stage/sample2 (but not
+project/stage2). Combined with -q, you get the status counts at each level of
+the hierarchy, with each level including the counts of all levels below it.
+
+For use in scripts, --json outputs the status of the commands as a JSON array
+of objects, in the same format as the REST API (see the documentation of
+jobqueue.JobStatus; times are in seconds, memory in MB), including each
+command's Key, State, Exitcode, PeakRAM, CPUtime, Host, FailReason, Started
+and Ended. --jsonl instead outputs one such object per line, which is easier to
+process when there are very many commands, and --yaml outputs them as YAML.
+--limit applies as usual, so use --limit 0 to get every command.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		set := countGetJobArgs()
 		if set > 1 {
-			die("-f, -i and -l are mutually exclusive; only specify one of them")
+			die("-f, -i, -l and --label are mutually exclusive; only specify one of them")
+		}
+		if failedSummary && (cmdFileStatus != "" || cmdLine != "" || cmdLabelStatus != "") {
+			die("--failed-summary can only be combined with -i")
+		}
+		if statusTree && cmdIDStatus == "" {
+			die("--tree can only be used with -i")
+		}
+		machineReadable := statusJSON || statusJSONL || statusYAML
+		if machineReadable && (quietMode || failedSummary) {
+			die("--json, --jsonl and --yaml can't be combined with -q or --failed-summary")
+		}
+		if (statusJSON && statusJSONL) || (statusJSON && statusYAML) || (statusJSONL && statusYAML) {
+			die("--json, --jsonl and --yaml are mutually exclusive; only specify one of them")
 		}
 		var cmdState jobqueue.JobState
 		if showBuried {
@@ -84,7 +136,21 @@ very many (tens of thousands+) commands.`,
 			}
 		}()
 
+		if failedSummary {
+			showFailureSummary(jq, cmdIDStatus)
+			return
+		}
+
+		if statusTree && quietMode {
+			showRepGroupCounts(jq, cmdIDStatus)
+			return
+		}
+
 		jobs := getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
+		if machineReadable {
+			printJobStatuses(jobs)
+			return
+		}
 		showextra := cmdFileStatus == ""
 
 		if quietMode {
@@ -127,6 +193,62 @@ very many (tens of thousands+) commands.`,
 				if len(job.Behaviours) > 0 {
 					behaviours = fmt.Sprintf("Behaviours: %s\n", job.Behaviours)
 				}
+				var outputDest string
+				if job.OutputDest != "" {
+					outputDest = fmt.Sprintf("Output destination: %s\n", job.OutputDest)
+				}
+				var outputs string
+				if len(job.Outputs) > 0 {
+					var registered []string
+					for _, a := range job.Outputs {
+						registered = append(registered, a.String())
+					}
+					outputs = fmt.Sprintf("Outputs: %s\n", strings.Join(registered, "; "))
+				}
+				var metrics string
+				if len(job.Metrics) > 0 {
+					var kvs []string
+					for name, value := range job.Metrics {
+						kvs = append(kvs, fmt.Sprintf("%s=%g", name, value))
+					}
+					sort.Strings(kvs)
+					metrics = fmt.Sprintf("Metrics: %s\n", strings.Join(kvs, ", "))
+				}
+				var limits string
+				if job.ProcessLimits.IsSet() {
+					limits = fmt.Sprintf("Limits: %s\n", job.ProcessLimits)
+				}
+				if job.RetryDelay.IsSet() {
+					limits += fmt.Sprintf("Retry delay: %s\n", job.RetryDelay)
+				}
+				if job.SandboxPolicy.IsSet() {
+					limits += fmt.Sprintf("Sandbox: %s\n", job.SandboxPolicy)
+				}
+				var secrets string
+				if len(job.Secrets) > 0 {
+					secrets = fmt.Sprintf("Secrets: %s\n", strings.Join(job.Secrets, ", "))
+				}
+				var labels string
+				if len(job.Labels) > 0 {
+					var kvs []string
+					for key, val := range job.Labels {
+						kvs = append(kvs, key+"="+val)
+					}
+					sort.Strings(kvs)
+					labels = fmt.Sprintf("Labels: %s\n", strings.Join(kvs, ", "))
+				}
+				var fallbacks string
+				if len(job.Fallbacks) > 0 {
+					var fbs []string
+					for i, fb := range job.Fallbacks {
+						current := ""
+						if job.FallbackIndex == i+1 {
+							current = " (current)"
+						}
+						fbs = append(fbs, fmt.Sprintf("%d: %s%s", i+1, fb.Cmd, current))
+					}
+					fallbacks = fmt.Sprintf("Fallbacks: %s\n", strings.Join(fbs, "; "))
+				}
 				var other string
 				if len(job.Requirements.Other) > 0 {
 					var others []string
@@ -135,7 +257,7 @@ very many (tens of thousands+) commands.`,
 					}
 					other = fmt.Sprintf("Resource requirements: %s\n", strings.Join(others, ", "))
 				}
-				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%sId: %s; Requirements group: %s; Priority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %d disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, behaviours, other, job.RepGroup, job.ReqGroup, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, job.Requirements.Cores, job.Requirements.Disk)
+				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%s%s%s%s%s%s%sId: %s; Key: %s; Requirements group: %s; Priority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %d disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, behaviours, outputDest, outputs, metrics, limits, secrets, labels, fallbacks, other, job.RepGroup, job.ToEssense().Key(), job.ReqGroup, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, job.Requirements.Cores, job.Requirements.Disk)
 
 				switch job.State {
 				case jobqueue.JobStateDelayed:
@@ -155,13 +277,32 @@ very many (tens of thousands+) commands.`,
 				}
 
 				if job.FailReason != "" {
-					fmt.Printf("Previous problem: %s\n", job.FailReason)
+					fmt.Printf("Previous problem: %s [%s]\n", job.FailReason, job.FailCode)
+				}
+				if job.Remediation != nil {
+					fmt.Printf("Suggested fix: %s\n", job.Remediation.Advice)
+				}
+				if rc := job.RunnerCrash; rc != nil {
+					fmt.Printf("Runner crash: %s (host %s, pid %d, at %s)\n", rc.Reason, rc.Host, rc.PID, rc.Time.Format(shortTimeFormat))
+					if showextra && rc.Detail != "" {
+						fmt.Printf("Crash details:\n%s\n", rc.Detail)
+					}
+				}
+				if job.Datacentre != "" {
+					forwarded := ""
+					if job.Peer != "" {
+						forwarded = fmt.Sprintf(" (forwarded to peer manager %s)", job.Peer)
+					}
+					fmt.Printf("Datacentre: %s%s\n", job.Datacentre, forwarded)
 				}
 
 				var hostID string
 				if job.HostID != "" {
 					hostID = ", ID: " + job.HostID
 				}
+				if job.SchedulerID != "" {
+					hostID += ", Scheduler ID: " + job.SchedulerID
+				}
 
 				if job.Exited {
 					prefix := "Stats"
@@ -169,6 +310,12 @@ very many (tens of thousands+) commands.`,
 						prefix = "Stats of previous attempt"
 					}
 					fmt.Printf("%s: { Exit code: %d; Peak memory: %dMB; Wall time: %s; CPU time: %s }\nHost: %s (IP: %s%s); Pid: %d\n", prefix, job.Exitcode, job.PeakRAM, job.WallTime(), job.CPUtime, job.Host, job.HostIP, hostID, job.Pid)
+					if fp := job.Fingerprint; fp != nil {
+						fmt.Printf("Environment: { OS: %s; Kernel: %s; Arch: %s; CPU: %s; Modules: %s; Container: %s }\n", fp.OS, fp.Kernel, fp.Arch, fp.CPUModel, fp.Modules, fp.ContainerImage)
+					}
+					if job.CoreFile != "" {
+						fmt.Printf("Core dump: %s\n", job.CoreFile)
+					}
 					if showextra && showStd && job.Exitcode != 0 {
 						stdout, err := job.StdOut()
 						if err != nil {
@@ -240,6 +387,9 @@ func init() {
 	statusCmd.Flags().StringVarP(&cmdFileStatus, "file", "f", "", "file containing commands you want the status of; - means read from STDIN")
 	statusCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want the status of")
 	statusCmd.Flags().StringVarP(&cmdLine, "cmdline", "l", "", "a command line you want the status of")
+	statusCmd.Flags().StringVar(&cmdLabelStatus, "label", "", "key=value label of the commands you want the status of")
+	statusCmd.Flags().StringVar(&cmdFailCode, "fail_code", "", "only consider commands that last failed with this code, eg. ram")
+	statusCmd.Flags().BoolVar(&statusTree, "tree", false, "in -i mode, also include commands with identifiers below the given one")
 	statusCmd.Flags().StringVarP(&cmdCwd, "cwd", "c", "", "working dir that the command(s) specified by -l or -f were set to run in")
 	statusCmd.Flags().StringVarP(&mountJSON, "mount_json", "j", "", "mounts that the command(s) specified by -l or -f were set to use (JSON format)")
 	statusCmd.Flags().StringVar(&mountSimple, "mounts", "", "mounts that the command(s) specified by -l or -f were set to use (simple format)")
@@ -248,10 +398,57 @@ func init() {
 	statusCmd.Flags().BoolVarP(&showEnv, "env", "e", false, "except in -f mode, also show the environment variables the command(s) ran with")
 	statusCmd.Flags().BoolVarP(&quietMode, "quiet", "q", false, "minimal verbosity: just display status counts")
 	statusCmd.Flags().IntVar(&statusLimit, "limit", 1, "number of commands that share the same properties to display; 0 displays all")
+	statusCmd.Flags().BoolVar(&failedSummary, "failed-summary", false, "in default or -i mode only, summarise why buried commands failed")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "output the status of the commands as a JSON array")
+	statusCmd.Flags().BoolVar(&statusJSONL, "jsonl", false, "output the status of each command as JSON on its own line")
+	statusCmd.Flags().BoolVar(&statusYAML, "yaml", false, "output the status of the commands as YAML")
 
 	statusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
 
+// showFailureSummary prints out how many buried commands (optionally just
+// those with the given RepGroup) failed for each distinct reason.
+func showFailureSummary(jq *jobqueue.Client, repGroup string) {
+	failures, err := jq.GetFailureSummary(repGroup)
+	if err != nil {
+		die("failed to get the failure summary: %s", err)
+	}
+	if len(failures) == 0 {
+		info("No buried commands found")
+		return
+	}
+
+	for _, failure := range failures {
+		noun := "commands"
+		if failure.Count == 1 {
+			noun = "command"
+		}
+		hosts := "hosts"
+		if len(failure.Hosts) == 1 {
+			hosts = "host"
+		}
+		fmt.Printf("%d %s failed with '%s' on %d %s\n  eg. %s\n", failure.Count, noun, failure.Error, len(failure.Hosts), hosts, failure.Example)
+	}
+}
+
+// showRepGroupCounts prints out the status counts of commands at each level of
+// the hierarchy of identifiers (repgroups) starting at the given one.
+func showRepGroupCounts(jq *jobqueue.Client, repGroup string) {
+	rgcs, err := jq.GetRepGroupCounts(repGroup)
+	if err != nil {
+		die("failed to get status counts: %s", err)
+	}
+	if len(rgcs) == 0 {
+		info("No matching commands found")
+		return
+	}
+
+	for _, rgc := range rgcs {
+		c := rgc.Counts
+		fmt.Printf("%s: complete: %d; running: %d; ready: %d; dependent: %d; lost contact: %d; delayed: %d; buried: %d\n", rgc.RepGroup, c[jobqueue.JobStateComplete], c[jobqueue.JobStateRunning], c[jobqueue.JobStateReady], c[jobqueue.JobStateDependent], c[jobqueue.JobStateLost], c[jobqueue.JobStateDelayed], c[jobqueue.JobStateBuried])
+	}
+}
+
 func countGetJobArgs() int {
 	set := 0
 	if cmdFileStatus != "" {
@@ -266,6 +463,9 @@ func countGetJobArgs() int {
 	if cmdAll {
 		set++
 	}
+	if cmdLabelStatus != "" {
+		set++
+	}
 	return set
 }
 
@@ -277,9 +477,20 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 	case all:
 		// get all jobs
 		jobs, err = jq.GetIncomplete(statusLimit, cmdState, showStd, showEnv)
+	case cmdIDStatus != "" && statusTree:
+		// get all jobs with this identifier (repgroup) or one below it
+		jobs, err = jq.GetByRepGroupTree(cmdIDStatus, statusLimit, cmdState, showStd, showEnv)
 	case cmdIDStatus != "":
 		// get all jobs with this identifier (repgroup)
 		jobs, err = jq.GetByRepGroup(cmdIDStatus, statusLimit, cmdState, showStd, showEnv)
+	case cmdLabelStatus != "":
+		// get all jobs with this label
+		kv := strings.SplitN(cmdLabelStatus, "=", 2)
+		var value string
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		jobs, err = jq.GetByLabel(kv[0], value, statusLimit, cmdState, showStd, showEnv)
 	case cmdFileStatus != "":
 		// parse the supplied commands
 		parsedJobs, _, _ := parseCmdFile(jq)
@@ -308,6 +519,13 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 		die("failed to get jobs corresponding to your settings: %s", err)
 	}
 
+	if cmdFailCode != "" {
+		if jobqueue.FailCodeReason(cmdFailCode) == "" {
+			die("--fail_code %s is not a known code", cmdFailCode)
+		}
+		jobs = jobqueue.FilterJobsByFailCode(jobs, cmdFailCode)
+	}
+
 	return jobs
 }
 
@@ -318,3 +536,39 @@ func jobsToJobEssenses(jobs []*jobqueue.Job) []*jobqueue.JobEssence {
 	}
 	return jes
 }
+
+// printJobStatuses prints the status of the given jobs as a JSON array, JSON
+// lines or YAML, depending on the --json, --jsonl and --yaml options.
+func printJobStatuses(jobs []*jobqueue.Job) {
+	if statusJSONL {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		for _, job := range jobs {
+			if err := encoder.Encode(job.ToStatus()); err != nil {
+				die("%s", err)
+			}
+		}
+		return
+	}
+
+	statuses := make([]jobqueue.JobStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = job.ToStatus()
+	}
+
+	if statusYAML {
+		out, err := yaml.Marshal(statuses)
+		if err != nil {
+			die("%s", err)
+		}
+		fmt.Print(string(out))
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(statuses); err != nil {
+		die("%s", err)
+	}
+}
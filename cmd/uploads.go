@@ -0,0 +1,182 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var uploadsOutput string
+var uploadsForce bool
+var uploadsGCAge int
+
+// uploadsCmd represents the uploads command
+var uploadsCmd = &cobra.Command{
+	Use:   "uploads",
+	Short: "Manage files uploaded to the manager",
+	Long: `Manage the files that have been uploaded to the manager.
+
+When you 'wr add' commands with cloud_config_files while the manager is running
+on a different machine, those files are first uploaded to the manager's upload
+directory (see the manageruploaddir config option), stored under names based on
+their MD5 checksums.
+
+The manager deletes uploaded files that no incomplete command needs after a
+while (see the --upload_gc option to 'wr manager start'), but these
+sub-commands let you see what is there, retrieve files and delete them
+yourself.`,
+}
+
+// list sub-command shows the uploaded files
+var uploadsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List uploaded files",
+	Long: `List the files that have been uploaded to the manager.
+
+For each file, its path on the manager's machine, size, MD5 checksum, when it
+was last uploaded and how many incomplete commands need it are shown in tab
+separated columns.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := uploadsConnect()
+		defer uploadsDisconnect(jq)
+
+		ufs, err := jq.GetUploads()
+		if err != nil {
+			die("%s", err)
+		}
+		sort.Slice(ufs, func(i, j int) bool {
+			return ufs[i].Modified.Before(ufs[j].Modified)
+		})
+		for _, uf := range ufs {
+			fmt.Printf("%s\t%s\t%s\t%s\t%d\n", uf.Path, bytefmt.ByteSize(uint64(uf.Size)), uf.MD5, uf.Modified.Format(time.RFC3339), uf.Refs)
+		}
+	},
+}
+
+// get sub-command retrieves an uploaded file
+var uploadsGetCmd = &cobra.Command{
+	Use:   "get PATH",
+	Short: "Retrieve an uploaded file",
+	Long: `Retrieve the content of the uploaded file with the given path (as
+shown by 'wr uploads list'), writing it to STDOUT or the --output file.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := uploadsConnect()
+		defer uploadsDisconnect(jq)
+
+		content, err := jq.FetchUpload(args[0])
+		if err != nil {
+			die("%s", err)
+		}
+		if uploadsOutput == "" {
+			_, err = os.Stdout.Write(content)
+		} else {
+			err = ioutil.WriteFile(uploadsOutput, content, 0600)
+		}
+		if err != nil {
+			die("could not write the file: %s", err)
+		}
+	},
+}
+
+// delete sub-command removes uploaded files
+var uploadsDeleteCmd = &cobra.Command{
+	Use:   "delete PATH [PATH...]",
+	Short: "Delete uploaded files",
+	Long: `Delete the uploaded files with the given paths (as shown by 'wr uploads
+list').
+
+Files that incomplete commands need are not deleted unless you supply --force,
+in which case those commands will fail to run on new cloud servers.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := uploadsConnect()
+		defer uploadsDisconnect(jq)
+
+		failed := 0
+		for _, path := range args {
+			err := jq.DeleteUpload(path, uploadsForce)
+			if err != nil {
+				warn("%s", err)
+				failed++
+				continue
+			}
+			info("Deleted %s", path)
+		}
+		if failed > 0 {
+			die("%d files could not be deleted", failed)
+		}
+	},
+}
+
+// gc sub-command deletes unneeded uploaded files
+var uploadsGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete unneeded uploaded files",
+	Long: `Delete the uploaded files that no incomplete command needs, and that
+were uploaded longer than --age hours ago.
+
+The manager does this itself every hour, based on its --upload_gc option.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		jq := uploadsConnect()
+		defer uploadsDisconnect(jq)
+
+		deleted, err := jq.GCUploads(time.Duration(uploadsGCAge) * time.Hour)
+		if err != nil {
+			die("%s", err)
+		}
+		info("Deleted %d uploaded files", deleted)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(uploadsCmd)
+	uploadsCmd.AddCommand(uploadsListCmd)
+	uploadsCmd.AddCommand(uploadsGetCmd)
+	uploadsCmd.AddCommand(uploadsDeleteCmd)
+	uploadsCmd.AddCommand(uploadsGCCmd)
+
+	uploadsGetCmd.Flags().StringVarP(&uploadsOutput, "output", "o", "", "file to write to, instead of STDOUT")
+	uploadsDeleteCmd.Flags().BoolVarP(&uploadsForce, "force", "f", false, "delete files even if incomplete commands need them")
+	uploadsGCCmd.Flags().IntVar(&uploadsGCAge, "age", 0, "only delete files uploaded longer than this many hours ago")
+
+	uploadsCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// uploadsConnect connects to the manager for the uploads sub-commands.
+func uploadsConnect() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// uploadsDisconnect disconnects from the manager, warning on failure.
+func uploadsDisconnect(jq *jobqueue.Client) {
+	err := jq.Disconnect()
+	if err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
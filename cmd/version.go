@@ -21,6 +21,7 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/spf13/cobra"
 )
 
@@ -40,4 +41,8 @@ var versionCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(versionCmd)
+
+	// so that clients and managers can tell each other what version they are
+	// if they turn out to be incompatible
+	jobqueue.Version = wrVersion
 }
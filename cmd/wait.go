@@ -0,0 +1,118 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var waitTimeout string
+var waitInterval string
+var waitTree bool
+var waitQuiet bool
+
+// waitCmd represents the wait command
+var waitCmd = &cobra.Command{
+	Use:   "wait",
+	Short: "Wait for commands to finish",
+	Long: `You can wait for all the commands you've previously added with
+"wr add" using a particular identifier to finish, using this command.
+
+This is useful in shell pipelines where you need to sequence your wr submissions
+with other steps, eg:
+wr add -f cmds.txt -i mystep && wr wait -i mystep --timeout 24h && next_step
+
+Commands are considered finished once they are either complete or buried. Lost
+commands are not considered finished until you confirm they are dead (after
+which they become buried) or they come back.
+
+This command exits 0 once all the commands are complete. It exits non-zero if
+any of them were buried, if --timeout is reached first, or if there are no
+commands with the given identifier.
+
+With --tree, commands with identifiers below the given one in the hierarchy are
+also waited on (see "wr status -h").`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cmdIDStatus == "" {
+			die("-i is required")
+		}
+
+		opts := &jobqueue.WaitOptions{Tree: waitTree}
+		var err error
+		if waitTimeout != "" {
+			opts.Timeout, err = time.ParseDuration(waitTimeout)
+			if err != nil {
+				die("--timeout was not specified correctly: %s", err)
+			}
+		}
+		if waitInterval != "" {
+			opts.Interval, err = time.ParseDuration(waitInterval)
+			if err != nil {
+				die("--interval was not specified correctly: %s", err)
+			}
+		}
+		if !waitQuiet {
+			var last jobqueue.WaitSummary
+			opts.Progress = func(summary *jobqueue.WaitSummary) {
+				if summary.Complete == last.Complete && summary.Buried == last.Buried && summary.Incomplete == last.Incomplete {
+					return
+				}
+				last = *summary
+				info("%d complete, %d buried, %d yet to finish", summary.Complete, summary.Buried, summary.Incomplete)
+			}
+		}
+
+		jq := connect(time.Duration(timeoutint) * time.Second)
+		defer func() {
+			errd := jq.Disconnect()
+			if errd != nil {
+				warn("Disconnecting from the server failed: %s", errd)
+			}
+		}()
+
+		summary, err := jq.WaitForRepGroup(cmdIDStatus, opts)
+		if err != nil {
+			if jqerr, ok := err.(jobqueue.Error); ok && jqerr.Err == jobqueue.ErrMissingJob {
+				die("No matching commands found")
+			}
+			die("%s", err)
+		}
+		if summary.Buried > 0 {
+			die("%d of %d commands were buried", summary.Buried, summary.Total())
+		}
+		info("All %d commands are complete", summary.Complete)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(waitCmd)
+
+	// flags specific to this sub-command
+	waitCmd.Flags().StringVarP(&cmdIDStatus, "identifier", "i", "", "identifier of the commands you want to wait for")
+	waitCmd.Flags().BoolVar(&waitTree, "tree", false, "also wait for commands with identifiers below the given one")
+	waitCmd.Flags().StringVar(&waitTimeout, "timeout", "", "the longest to wait, eg. 24h [default forever]")
+	waitCmd.Flags().StringVar(&waitInterval, "interval", "10s", "how often to check on the commands")
+	waitCmd.Flags().BoolVarP(&waitQuiet, "quiet", "q", false, "don't report progress while waiting")
+
+	waitCmd.Flags().IntVar(&timeoutint, "reply_timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
@@ -0,0 +1,264 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var watchCmdTemplate string
+var watchJSON string
+var watchPattern string
+var watchRecursive bool
+var watchInterval string
+var watchStateFile string
+var watchReRun bool
+var watchRepGroup string
+var watchReqGroup string
+var watchCwd string
+var watchMountJSON string
+var watchMountSimple string
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch DIR",
+	Short: "Add commands when new files appear",
+	Long: `Watch a directory or S3 prefix, and add a command for each new file.
+
+This lets wr be the ingest point for pipelines that should run whenever new
+data turns up, eg. when a sequencer writes out a new run:
+
+wr watch /seq/runs --pattern '*.cram' --cmd 'pipeline.sh {path}' -i 'ingest/{stem}'
+
+Every --interval, the directory (and its sub-directories with --recursive) is
+listed, and files with names matching --pattern that have not changed since the
+previous listing have a command added for them. So that files still being
+written aren't acted on, a new file is acted on at the earliest one --interval
+after it appears.
+
+The command is given by --cmd, or by --json in the format of a line of the JSON
+input to 'wr add' (see 'wr add -h'), for when you need to specify more options.
+In the cmd, cwd and rep_grp, these placeholders are replaced:
+{path} = the path to the file
+{name} = the file's base name
+{stem} = the file's base name without its extension
+{dir}  = the directory containing the file
+
+Each file is only acted on once while it remains unmodified; commands are
+labelled with wr_watch_key=[key], where key identifies the file and its current
+size and modification time. Supply --state to remember which files have been
+acted on between invocations of this command. Even without it, identical
+commands that already exist, or have completed (unless --rerun), are not added
+again.
+
+To watch an S3 prefix instead, supply --mounts or --mount_json as per 'wr mount'
+with a single target, and give DIR relative to that target, or as '.'. The
+prefix is mounted afresh each --interval, and {path} is the S3 path of the file
+(eg. mybucket/runs/a.cram), so your commands will need their own --mounts to
+read the file.
+
+This command keeps running until killed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if watchCmdTemplate == "" && watchJSON == "" {
+			die("--cmd or --json is required")
+		}
+		interval, err := time.ParseDuration(watchInterval)
+		if err != nil || interval <= 0 {
+			die("--interval was not specified correctly: %s", watchInterval)
+		}
+
+		var jvj jobqueue.JobViaJSON
+		if watchJSON != "" {
+			err = json.Unmarshal([]byte(watchJSON), &jvj)
+			if err != nil {
+				die("bad --json: %s", err)
+			}
+		}
+		if watchCmdTemplate != "" {
+			jvj.Cmd = watchCmdTemplate
+		}
+		template, err := jvj.Convert(&jobqueue.JobDefaults{RepGrp: watchRepGroup, ReqGrp: watchReqGroup, Cwd: watchCwd})
+		if err != nil {
+			die("bad command template: %s", err)
+		}
+
+		opts := &jobqueue.WatchOptions{
+			Dir:       args[0],
+			Pattern:   watchPattern,
+			Recursive: watchRecursive,
+			Template:  template,
+			Env:       os.Environ(),
+			Rerun:     watchReRun,
+			Interval:  interval,
+			Seen:      watchLoadState(watchStateFile),
+			Added: func(file *jobqueue.WatchedFile, job *jobqueue.Job, added bool) {
+				if added {
+					info("added command for %s", file.Path)
+				} else {
+					info("command for %s already existed", file.Path)
+				}
+				watchSaveState(watchStateFile, file.IdempotencyKey())
+			},
+		}
+		if watchMountJSON != "" || watchMountSimple != "" {
+			opts.List = watchS3Lister(mountParse(watchMountJSON, watchMountSimple), args[0])
+		}
+
+		jq := connect(10 * time.Second)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		stop := make(chan struct{})
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			close(stop)
+		}()
+
+		info("watching %s every %s", args[0], interval)
+		err = jq.Watch(opts, stop)
+		if err != nil {
+			die("watching failed: %s", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+
+	// flags specific to this sub-command
+	watchCmd.Flags().StringVar(&watchCmdTemplate, "cmd", "", "the command to add for each new file, with placeholders")
+	watchCmd.Flags().StringVar(&watchJSON, "json", "", "the command to add for each new file, and its options, in JSON format")
+	watchCmd.Flags().StringVarP(&watchPattern, "pattern", "p", "", "only act on files with names matching this glob pattern")
+	watchCmd.Flags().BoolVarP(&watchRecursive, "recursive", "r", false, "also watch sub-directories")
+	watchCmd.Flags().StringVar(&watchInterval, "interval", "1m", "how often to look for new files")
+	watchCmd.Flags().StringVar(&watchStateFile, "state", "", "file to record the files acted on in, to avoid acting on them again if restarted")
+	watchCmd.Flags().BoolVar(&watchReRun, "rerun", false, "re-run commands that already completed")
+	watchCmd.Flags().StringVarP(&watchRepGroup, "rep_grp", "i", "watch", "rep_grp to give the commands, with placeholders")
+	watchCmd.Flags().StringVarP(&watchReqGroup, "req_grp", "g", "", "group name for commands with similar reqs")
+	watchCmd.Flags().StringVarP(&watchCwd, "cwd", "c", "", "working dir, with placeholders")
+	watchCmd.Flags().StringVarP(&watchMountJSON, "mount_json", "j", "", "S3 prefix to watch, in JSON format")
+	watchCmd.Flags().StringVar(&watchMountSimple, "mounts", "", "S3 prefix to watch, as [c|u][r|w]:bucket[/path]")
+}
+
+// watchLoadState reads the idempotency keys from the given state file, if any.
+func watchLoadState(path string) map[string]bool {
+	seen := make(map[string]bool)
+	if path == "" {
+		return seen
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			die("could not read --state file: %s", err)
+		}
+		return seen
+	}
+	defer internal.LogClose(appLogger, f, "watch state file", "path", path)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			seen[key] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		die("could not read --state file: %s", err)
+	}
+	return seen
+}
+
+// watchSaveState appends the given idempotency key to the given state file, if
+// any.
+func watchSaveState(path, key string) {
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		warn("could not write to --state file: %s", err)
+		return
+	}
+	_, err = fmt.Fprintln(f, key)
+	if err != nil {
+		warn("could not write to --state file: %s", err)
+	}
+	err = f.Close()
+	if err != nil {
+		warn("could not write to --state file: %s", err)
+	}
+}
+
+// watchS3Lister returns a function that lists the files in dir within the
+// single target of the given mount config, by mounting it in a temporary
+// directory, and returns them with S3 paths.
+func watchS3Lister(mcs jobqueue.MountConfigs, dir string) func() ([]*jobqueue.WatchedFile, error) {
+	if len(mcs) != 1 || len(mcs[0].Targets) != 1 {
+		die("only a single S3 target can be watched")
+	}
+	mc := mcs[0]
+	s3Path := strings.TrimSuffix(mc.Targets[0].Path, "/")
+	mc.Targets[0].Write = false
+
+	return func() ([]*jobqueue.WatchedFile, error) {
+		mountDir, err := ioutil.TempDir("", "wr_watch")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(mountDir)
+		mc.Mount = mountDir
+		unmount, err := mountTemporarily(mc)
+		if err != nil {
+			return nil, err
+		}
+		defer unmount()
+
+		files, err := jobqueue.ListWatchedFiles(filepath.Join(mountDir, dir), watchPattern, watchRecursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			rel, errr := filepath.Rel(mountDir, file.Path)
+			if errr != nil {
+				return nil, errr
+			}
+			file.Path = s3Path + "/" + filepath.ToSlash(rel)
+		}
+		return files, nil
+	}
+}
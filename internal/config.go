@@ -45,38 +45,63 @@ const (
 
 // Config holds the configuration options for jobqueue server and client
 type Config struct {
-	ManagerPort         string `default:""`
-	ManagerWeb          string `default:""`
-	ManagerHost         string `default:"localhost"`
-	ManagerDir          string `default:"~/.wr"`
-	ManagerPidFile      string `default:"pid"`
-	ManagerLogFile      string `default:"log"`
-	ManagerDbFile       string `default:"db"`
-	ManagerDbBkFile     string `default:"db_bk"`
-	ManagerTokenFile    string `default:"client.token"`
-	ManagerUploadDir    string `default:"uploads"`
-	ManagerUmask        int    `default:"007"`
-	ManagerScheduler    string `default:"local"`
-	ManagerCAFile       string `default:"ca.pem"`
-	ManagerCertFile     string `default:"cert.pem"`
-	ManagerKeyFile      string `default:"key.pem"`
-	ManagerCertDomain   string `default:"localhost"`
-	ManagerSetDomainIP  bool   `default:"false"`
-	RunnerExecShell     string `default:"bash"`
-	Deployment          string `default:"production"`
-	CloudFlavor         string `default:""`
-	CloudKeepAlive      int    `default:"120"`
-	CloudServers        int    `default:"-1"`
-	CloudCIDR           string `default:"192.168.0.0/18"`
-	CloudGateway        string `default:"192.168.0.1"`
-	CloudDNS            string `default:"8.8.4.4,8.8.8.8"`
-	CloudOS             string `default:"Ubuntu Xenial"`
-	CloudUser           string `default:"ubuntu"`
-	CloudRAM            int    `default:"2048"`
-	CloudDisk           int    `default:"1"`
-	CloudScript         string `default:""`
-	CloudConfigFiles    string `default:"~/.s3cfg,~/.aws/credentials,~/.aws/config"`
-	DeploySuccessScript string `default:""`
+	ManagerPort              string `default:""`
+	ManagerWeb               string `default:""`
+	ManagerHost              string `default:"localhost"`
+	ManagerDir               string `default:"~/.wr"`
+	ManagerPidFile           string `default:"pid"`
+	ManagerLogFile           string `default:"log"`
+	ManagerDbFile            string `default:"db"`
+	ManagerDbBkFile          string `default:"db_bk"`
+	ManagerTokenFile         string `default:"client.token"`
+	ManagerReadOnlyTokenFile string `default:"client.ro.token"`
+	ManagerUploadDir         string `default:"uploads"`
+	ManagerUmask             int    `default:"007"`
+	ManagerScheduler         string `default:"local"`
+	ManagerSchedulerExe      string `default:""`
+	ManagerCAFile            string `default:"ca.pem"`
+	ManagerCertFile          string `default:"cert.pem"`
+	ManagerKeyFile           string `default:"key.pem"`
+	ManagerCertDomain        string `default:"localhost"`
+	ManagerSetDomainIP       bool   `default:"false"`
+	ManagerFairShare         bool   `default:"false"`
+	ManagerShareWeights      string `default:""`
+	ManagerReattachGrace     int    `default:"300"`
+	ManagerUploadGC          int    `default:"168"`
+	ManagerTrashKeep         int    `default:"24"`
+	ManagerTimelineInterval  int    `default:"10"`
+	ManagerTimelineKeep      int    `default:"90"`
+	ManagerSlowRequest       int    `default:"1000"`
+	ManagerCmdWrapper        string `default:""`
+	ManagerCmdWrappers       string `default:""`
+	ManagerOutputFilter      string `default:""`
+	ManagerDatacentre        string `default:""`
+	ManagerPeersFile         string `default:""`
+	ManagerSimFile           string `default:""`
+	ManagerSSHHostsFile      string `default:""`
+	ManagerKubeFile          string `default:""`
+	ManagerMountCredsFile    string `default:""`
+	ManagerJobMemBudget      int    `default:"0"`
+	ManagerMaxJobsPerHost    int    `default:"0"`
+	ManagerProxy             string `default:""`
+	ManagerProxySSHKey       string `default:""`
+	RunnerExecShell          string `default:"bash"`
+	Deployment               string `default:"production"`
+	CloudFlavor              string `default:""`
+	CloudArchFlavors         string `default:""`
+	CloudKeepAlive           int    `default:"120"`
+	CloudServers             int    `default:"-1"`
+	CloudCIDR                string `default:"192.168.0.0/18"`
+	CloudGateway             string `default:"192.168.0.1"`
+	CloudDNS                 string `default:"8.8.4.4,8.8.8.8"`
+	CloudOS                  string `default:"Ubuntu Xenial"`
+	CloudUser                string `default:"ubuntu"`
+	CloudRAM                 int    `default:"2048"`
+	CloudDisk                int    `default:"1"`
+	CloudScript              string `default:""`
+	CloudFlavorScripts       string `default:""`
+	CloudConfigFiles         string `default:"~/.s3cfg,~/.aws/credentials,~/.aws/config"`
+	DeploySuccessScript      string `default:""`
 }
 
 /*
@@ -197,6 +222,9 @@ func ConfigLoad(deployment string, useparentdir bool, logger log15.Logger) Confi
 	if !filepath.IsAbs(config.ManagerTokenFile) {
 		config.ManagerTokenFile = filepath.Join(config.ManagerDir, config.ManagerTokenFile)
 	}
+	if !filepath.IsAbs(config.ManagerReadOnlyTokenFile) {
+		config.ManagerReadOnlyTokenFile = filepath.Join(config.ManagerDir, config.ManagerReadOnlyTokenFile)
+	}
 	if !filepath.IsAbs(config.ManagerUploadDir) {
 		config.ManagerUploadDir = filepath.Join(config.ManagerDir, config.ManagerUploadDir)
 	}
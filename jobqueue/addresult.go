@@ -0,0 +1,138 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for checking that jobs are valid before adding
+// them, and for telling clients what happened to each job they tried to add.
+
+// AddStatus describes what happened to a Job passed to
+// Client.AddWithResults().
+type AddStatus string
+
+// AddStatus* are the possible AddResult Statuses.
+const (
+	AddStatusAdded    AddStatus = "added"
+	AddStatusExisted  AddStatus = "existed"
+	AddStatusRejected AddStatus = "rejected"
+)
+
+// AddResult is what Client.AddWithResults() returns for each of the Jobs you
+// supplied.
+type AddResult struct {
+	// Key is the Job's key.
+	Key string
+
+	// Status says if the Job was newly added, was not added because an
+	// identical Job was already in the queue (or had already completed), or
+	// was rejected as invalid.
+	Status AddStatus
+
+	// Reason, for rejected Jobs, says what was wrong with the Job. For Jobs
+	// that existed in the queue of a peer manager (see Client.CheckPeers),
+	// says which one.
+	Reason string
+}
+
+// validateJob checks that the given job could be added to the queue. If not,
+// returns one of our Err constant strings along with a more detailed error.
+func (s *Server) validateJob(job *Job) (string, error) {
+	if job.Cmd == "" {
+		return ErrInvalidJob, Error{"add", job.key(), "no command given"}
+	}
+	if !s.fed.routable(job.Datacentre) || !s.fed.routable(job.StartDeadline.Datacentre) {
+		return ErrBadDatacentre, Error{"add", job.key(), ErrBadDatacentre}
+	}
+	if err := job.StartDeadline.Validate(); err != nil {
+		return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+	}
+	if err := job.OutputFilter.Validate(); err != nil {
+		return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+	}
+	if err := job.Container.Validate(); err != nil {
+		return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+	}
+	for _, group := range job.LimitGroups {
+		if err := validateLimitGroupName(group); err != nil {
+			return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+		}
+	}
+	if err := validateLabels(job.Labels); err != nil {
+		return ErrBadLabel, Error{"add", job.key(), err.Error()}
+	}
+	if err := job.validateFallbacks(); err != nil {
+		return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+	}
+	req := job.Requirements
+	if req == nil {
+		return ErrInvalidJob, Error{"add", job.key(), "no requirements given"}
+	}
+	if err := validateRequirements(req); err != nil {
+		return ErrInvalidJob, Error{"add", job.key(), err.Error()}
+	}
+	return "", nil
+}
+
+// addJobsWithResults is like createJobs(), but instead of failing if any of
+// the jobs are invalid, only adds the valid ones. Jobs with keys in peerDups
+// are not added either, being treated as existing in the named peer. Returns a
+// result for each of the given jobs, in the same order.
+func (s *Server) addJobsWithResults(inputJobs []*Job, envkey string, ignoreComplete bool, peerDups map[string]string) ([]*AddResult, string, error) {
+	results := make([]*AddResult, len(inputJobs))
+	valid := make([]*Job, 0, len(inputJobs))
+	for i, job := range inputJobs {
+		results[i] = &AddResult{Key: job.key()}
+		if _, err := s.validateJob(job); err != nil {
+			results[i].Status = AddStatusRejected
+			if jqerr, ok := err.(Error); ok {
+				results[i].Reason = jqerr.Err
+			} else {
+				results[i].Reason = err.Error()
+			}
+			continue
+		}
+		if peer := peerDups[results[i].Key]; peer != "" {
+			results[i].Status = AddStatusExisted
+			results[i].Reason = "already in the queue of peer manager " + peer
+			continue
+		}
+		valid = append(valid, job)
+	}
+
+	if len(valid) > 0 {
+		_, _, _, srerr, err := s.createJobs(valid, envkey, ignoreComplete)
+		if err != nil {
+			return nil, srerr, err
+		}
+	}
+
+	// a job was added if it is the one now in the queue; otherwise it was a
+	// duplicate of one already there, or had already completed. (We get the
+	// key again, since RepGroup defaults may have changed it.)
+	for i, job := range inputJobs {
+		if results[i].Status != "" {
+			continue
+		}
+		results[i].Key = job.key()
+		results[i].Status = AddStatusExisted
+		if item, err := s.q.Get(results[i].Key); err == nil && item.Data == job {
+			results[i].Status = AddStatusAdded
+		}
+	}
+	return results, "", nil
+}
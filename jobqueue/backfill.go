@@ -0,0 +1,358 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for backfilling the resource requirements the
+// server learns with the accounting records of other job schedulers, so that a
+// new deployment doesn't have to learn everything from scratch.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// lsfJobDone is the jStatus of JOB_FINISH records in lsb.acct for jobs that
+// completed successfully.
+const lsfJobDone = 64
+
+// ReqGroupSample is an observation of the peak memory usage and wall time of
+// a command in a ReqGroup, eg. from another job scheduler's accounting
+// records.
+type ReqGroupSample struct {
+	ReqGroup string
+	RAM      int           // peak memory usage in MB
+	Time     time.Duration // wall time
+}
+
+// valid tells you if the sample can be stored.
+func (rs *ReqGroupSample) valid() bool {
+	return rs.ReqGroup != "" && !strings.Contains(rs.ReqGroup, dbDelimiter) && rs.RAM > 0 && rs.Time > 0
+}
+
+// reqGroupForCmd returns the ReqGroup that Jobs with the given Cmd get by
+// default: the base name of the command's executable.
+func reqGroupForCmd(cmd string) string {
+	parts := strings.Split(strings.TrimSpace(cmd), " ")
+	return filepath.Base(parts[0])
+}
+
+// ParseSacct reads the output of Slurm's `sacct --parsable2`, eg.
+//
+//	sacct -a -P -S 2018-01-01 -o JobID,JobName,State,Elapsed,MaxRSS
+//
+// and returns a ReqGroupSample for each successfully completed job. The header
+// line must be included. JobName, State, Elapsed and MaxRSS columns are
+// required. The ReqGroup of each job is determined from its JobName as wr
+// would for a command. When there is a JobID column, the largest MaxRSS of the
+// job's steps is used as its peak memory usage. MaxRSS values without a unit
+// suffix are taken to be in KB.
+func ParseSacct(r io.Reader) ([]*ReqGroupSample, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+	cols := make(map[string]int)
+	for i, col := range strings.Split(scanner.Text(), "|") {
+		cols[strings.ToLower(strings.TrimSpace(col))] = i
+	}
+	for _, required := range []string{"jobname", "state", "elapsed", "maxrss"} {
+		if _, exists := cols[required]; !exists {
+			return nil, fmt.Errorf("sacct output has no %s column", required)
+		}
+	}
+	field := func(fields []string, col string) string {
+		i, exists := cols[col]
+		if !exists || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	}
+
+	samples := make(map[string]*ReqGroupSample)
+	var order []string
+	for n := 2; scanner.Scan(); n++ {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < len(cols) {
+			continue
+		}
+
+		// steps have JobIDs like 123.batch, and hold the memory usage of
+		// the job with JobID 123
+		id := field(fields, "jobid")
+		step := false
+		if i := strings.Index(id, "."); i > 0 {
+			id = id[:i]
+			step = true
+		}
+		if id == "" {
+			id = strconv.Itoa(n)
+		}
+
+		mb, err := parseSacctMem(field(fields, "maxrss"))
+		if err != nil {
+			return nil, fmt.Errorf("sacct line %d: %s", n, err)
+		}
+
+		if step {
+			if rs, exists := samples[id]; exists && mb > rs.RAM {
+				rs.RAM = mb
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(field(fields, "state"), "COMPLETED") {
+			continue
+		}
+		elapsed, err := parseSacctElapsed(field(fields, "elapsed"))
+		if err != nil {
+			return nil, fmt.Errorf("sacct line %d: %s", n, err)
+		}
+		samples[id] = &ReqGroupSample{ReqGroup: reqGroupForCmd(field(fields, "jobname")), RAM: mb, Time: elapsed}
+		order = append(order, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var valid []*ReqGroupSample
+	for _, id := range order {
+		if rs := samples[id]; rs.valid() {
+			valid = append(valid, rs)
+		}
+	}
+	return valid, nil
+}
+
+// parseSacctMem parses a sacct memory value like "1234K" or "1.5G" in to MB,
+// rounding up.
+func parseSacctMem(val string) (int, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0, nil
+	}
+	multiplier := 1.0 / 1024 // KB
+	switch val[len(val)-1] {
+	case 'K', 'k':
+		val = val[:len(val)-1]
+	case 'M', 'm':
+		multiplier = 1
+		val = val[:len(val)-1]
+	case 'G', 'g':
+		multiplier = 1024
+		val = val[:len(val)-1]
+	case 'T', 't':
+		multiplier = 1024 * 1024
+		val = val[:len(val)-1]
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memory value %q is not valid", val)
+	}
+	return int(math.Ceil(f * multiplier)), nil
+}
+
+// parseSacctElapsed parses a sacct time value of the form
+// [DD-[HH:]]MM:SS[.mmm].
+func parseSacctElapsed(val string) (time.Duration, error) {
+	var days int
+	rest := strings.TrimSpace(val)
+	if i := strings.Index(rest, "-"); i >= 0 {
+		d, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, fmt.Errorf("elapsed value %q is not valid", val)
+		}
+		days = d
+		rest = rest[i+1:]
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("elapsed value %q is not valid", val)
+	}
+	var secs float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("elapsed value %q is not valid", val)
+		}
+		secs = secs*60 + n
+	}
+	return time.Duration(days)*24*time.Hour + time.Duration(secs*float64(time.Second)), nil
+}
+
+// ParseLSFAcct reads LSF's lsb.acct accounting file and returns a
+// ReqGroupSample for each JOB_FINISH record of a job that completed
+// successfully. The ReqGroup of each is determined from the job's command, as
+// wr would for the same command, its peak memory usage comes from maxRMem and
+// its wall time is the time between it starting and the record being written.
+func ParseLSFAcct(r io.Reader) ([]*ReqGroupSample, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var samples []*ReqGroupSample
+	for n := 1; scanner.Scan(); n++ {
+		fields := splitLSFRecord(scanner.Text())
+		if len(fields) == 0 || fields[0] != "JOB_FINISH" {
+			continue
+		}
+		rs, err := lsfJobFinishSample(fields)
+		if err != nil {
+			return nil, fmt.Errorf("lsb.acct line %d: %s", n, err)
+		}
+		if rs != nil && rs.valid() {
+			samples = append(samples, rs)
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// lsfJobFinishSample extracts a ReqGroupSample from the fields of a JOB_FINISH
+// record, returning nil if the job didn't complete successfully. The fields
+// are, in part:
+//
+//	0 "JOB_FINISH", 2 eventTime, 10 startTime, 22 numAskedHosts, then the
+//	asked hosts, numExHosts, the execution hosts, jStatus, hostFactor,
+//	jobName, command, 19 rusage fields, mailUser, projectName, exitStatus,
+//	maxNumProcessors, loginShell, timeEvent, idx, maxRMem (KB)
+func lsfJobFinishSample(fields []string) (*ReqGroupSample, error) {
+	ints := func(is ...int) ([]int, error) {
+		vals := make([]int, len(is))
+		for j, i := range is {
+			if i >= len(fields) {
+				return nil, fmt.Errorf("JOB_FINISH record has too few fields")
+			}
+			v, err := strconv.Atoi(fields[i])
+			if err != nil {
+				return nil, fmt.Errorf("JOB_FINISH field %d (%q) is not a number", i, fields[i])
+			}
+			vals[j] = v
+		}
+		return vals, nil
+	}
+
+	vals, err := ints(2, 10, 22)
+	if err != nil {
+		return nil, err
+	}
+	eventTime, startTime, numAsked := vals[0], vals[1], vals[2]
+	exHostsIndex := 23 + numAsked
+	vals, err = ints(exHostsIndex)
+	if err != nil {
+		return nil, err
+	}
+	jStatusIndex := exHostsIndex + 1 + vals[0]
+	cmdIndex := jStatusIndex + 3
+	maxRMemIndex := cmdIndex + 27
+	vals, err = ints(jStatusIndex, maxRMemIndex)
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] != lsfJobDone || startTime <= 0 || eventTime < startTime {
+		return nil, nil
+	}
+
+	return &ReqGroupSample{
+		ReqGroup: reqGroupForCmd(fields[cmdIndex]),
+		RAM:      int(math.Ceil(float64(vals[1]) / 1024)),
+		Time:     time.Duration(eventTime-startTime) * time.Second,
+	}, nil
+}
+
+// splitLSFRecord splits a line of an LSF event or accounting file in to its
+// space separated fields, where string fields are double quoted, with any
+// double quotes within them doubled up.
+func splitLSFRecord(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes, quoted := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuotes && c == '"':
+			if i+1 < len(line) && line[i+1] == '"' {
+				field.WriteByte('"')
+				i++
+			} else {
+				inQuotes = false
+			}
+		case inQuotes:
+			field.WriteByte(c)
+		case c == '"':
+			inQuotes, quoted = true, true
+		case c == ' ':
+			if quoted || field.Len() > 0 {
+				fields = append(fields, field.String())
+			}
+			field.Reset()
+			quoted = false
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if quoted || field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// storeReqGroupSamples stores the given samples alongside the peak memory
+// usage and wall times of Jobs that ran, so that they are taken in to account
+// when recommending the requirements of their ReqGroups.
+func (db *db) storeReqGroupSamples(samples []*ReqGroupSample) error {
+	err := db.update(func(tx *bolt.Tx) error {
+		bm := tx.Bucket(bucketJobMBs)
+		bs := tx.Bucket(bucketJobSecs)
+		for _, rs := range samples {
+			secs := int(math.Ceil(rs.Time.Seconds()))
+			err := bm.Put([]byte(fmt.Sprintf("%s%s%20d", rs.ReqGroup, dbDelimiter, rs.RAM)), []byte(strconv.Itoa(rs.RAM)))
+			if err != nil {
+				return err
+			}
+			err = bs.Put([]byte(fmt.Sprintf("%s%s%20d", rs.ReqGroup, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.backgroundBackup()
+	return err
+}
+
+// AddReqGroupSamples tells the server about the peak memory usage and wall
+// time of commands that ran elsewhere, eg. as parsed from another job
+// scheduler's accounting records with ParseSacct() or ParseLSFAcct(). These
+// are learned from just like the usage of Jobs that the server ran itself,
+// so that a new deployment can recommend sensible requirements from day one.
+func (c *Client) AddReqGroupSamples(samples []*ReqGroupSample) error {
+	for _, rs := range samples {
+		if !rs.valid() {
+			return Error{"AddReqGroupSamples", rs.ReqGroup, ErrBadRequest}
+		}
+	}
+	_, err := c.request(&clientRequest{Method: "addreqsamples", ReqSamples: samples})
+	return err
+}
@@ -270,6 +270,9 @@ func (b *Behaviour) run(j *Job) error {
 	// so can do whatever they can do...
 	cmd := exec.Command("/bin/bash", "-c", bc) // #nosec
 	cmd.Dir = actualCwd
+	if j.OutputDest != "" {
+		cmd.Env = envOverride(os.Environ(), []string{outputDestEnvVar + "=" + j.OutputDest})
+	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("run behaviour failed: %s\n%s", err, string(out))
@@ -0,0 +1,266 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the client code for bridging a message queue to the
+// server: adding jobs defined in messages, and publishing events when they
+// finish.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// defaultBridgeInterval is used when BridgeOptions.Interval is not set.
+const defaultBridgeInterval = 10 * time.Second
+
+// BrokerMessage is a message consumed from a Broker.
+type BrokerMessage interface {
+	// Body returns the content of the message.
+	Body() []byte
+
+	// Ack tells the broker the message was handled, so it can be discarded.
+	Ack() error
+
+	// Nack tells the broker the message was not handled. If requeue, it
+	// should be delivered again later, otherwise discarded (or dead-lettered).
+	Nack(requeue bool) error
+}
+
+// Broker is a message queue system, such as AMQP, Kafka or NATS, that
+// Bridge() consumes job definitions from and publishes job events to.
+type Broker interface {
+	// Consume returns a channel of messages from the given topic (or queue),
+	// which should be closed if the connection to the broker is lost.
+	Consume(topic string) (<-chan BrokerMessage, error)
+
+	// Publish sends a message to the given topic (or queue).
+	Publish(topic string, body []byte) error
+}
+
+// BridgeOptions configure Bridge().
+type BridgeOptions struct {
+	// Defaults are used for properties of jobs not specified in messages.
+	Defaults *JobDefaults
+
+	// Env is the environment the jobs will run in, as per Add().
+	Env []string
+
+	// Rerun, if true, adds jobs even if identical jobs have already completed.
+	Rerun bool
+
+	// EventsTopic, if set, is the topic that a BridgeEvent is published to for
+	// each added job once it completes or is buried.
+	EventsTopic string
+
+	// Interval is how often to check if added jobs have finished. Defaults to
+	// 10s.
+	Interval time.Duration
+
+	// Rejected, if set, is called for each message that couldn't be turned in
+	// to jobs, and was discarded.
+	Rejected func(body []byte, err error)
+
+	// Added, if set, is called after each message is handled, with the number
+	// of jobs it defined that were added and that already existed.
+	Added func(added, existed int)
+}
+
+// BridgeEvent is published by Bridge() when a job it added finishes.
+type BridgeEvent struct {
+	Key        string   `json:"key"`
+	Cmd        string   `json:"cmd"`
+	RepGroup   string   `json:"rep_grp"`
+	State      JobState `json:"state"`
+	Exitcode   int      `json:"exit_code"`
+	FailReason string   `json:"fail_reason,omitempty"`
+	Walltime   float64  `json:"walltime_seconds"`
+	PeakRAM    int      `json:"peak_ram_mb"`
+}
+
+// Bridge consumes messages from the given topic of the broker, each holding a
+// job definition, or an array of them, in the JSON format of JobViaJSON. It
+// adds the jobs, and only then acks the message, so that no job is lost if we
+// or the server go down. Messages that aren't valid job definitions are nacked
+// without requeue.
+//
+// If BridgeOptions.EventsTopic is set, a BridgeEvent is published there for
+// each added job once it completes or is buried. (Only jobs added since this
+// call are tracked.)
+//
+// Bridge keeps going until the stop channel is closed, or an error occurs
+// (adding jobs fails, or the broker closes the message channel).
+func (c *Client) Bridge(broker Broker, topic string, opts *BridgeOptions, stop <-chan struct{}) error {
+	msgs, err := broker.Consume(topic)
+	if err != nil {
+		return err
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultBridgeInterval
+	}
+	defaults := opts.Defaults
+	if defaults == nil {
+		defaults = &JobDefaults{}
+	}
+
+	tracked := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("the broker stopped delivering messages from %s", topic)
+			}
+			keys, err := c.bridgeMessage(msg, defaults, opts)
+			if err != nil {
+				return err
+			}
+			if opts.EventsTopic != "" {
+				for _, key := range keys {
+					tracked[key] = true
+				}
+			}
+		case <-ticker.C:
+			if len(tracked) == 0 {
+				continue
+			}
+			err := c.bridgeEvents(broker, opts.EventsTopic, tracked)
+			if err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// bridgeMessage adds the jobs defined in the given message, acking or nacking
+// it as appropriate, and returns the keys of the jobs. An error is only
+// returned if adding failed, in which case the message is requeued.
+func (c *Client) bridgeMessage(msg BrokerMessage, defaults *JobDefaults, opts *BridgeOptions) ([]string, error) {
+	jobs, err := bridgeParse(msg.Body(), defaults)
+	if err != nil {
+		if opts.Rejected != nil {
+			opts.Rejected(msg.Body(), err)
+		}
+		return nil, msg.Nack(false)
+	}
+
+	added, existed, err := c.Add(jobs, opts.Env, opts.Rerun)
+	if err != nil {
+		errn := msg.Nack(true)
+		if errn != nil {
+			err = fmt.Errorf("%s (and nacking the message failed: %s)", err, errn)
+		}
+		return nil, err
+	}
+	if opts.Added != nil {
+		opts.Added(added, existed)
+	}
+
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.key()
+	}
+	return keys, msg.Ack()
+}
+
+// bridgeParse converts the JSON of a single JobViaJSON, or an array of them, in
+// to Jobs.
+func bridgeParse(body []byte, defaults *JobDefaults) ([]*Job, error) {
+	var jvjs []*JobViaJSON
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err := json.Unmarshal(body, &jvjs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		jvj := &JobViaJSON{}
+		err := json.Unmarshal(body, jvj)
+		if err != nil {
+			return nil, err
+		}
+		jvjs = append(jvjs, jvj)
+	}
+	if len(jvjs) == 0 {
+		return nil, fmt.Errorf("no jobs were defined")
+	}
+
+	jobs := make([]*Job, len(jvjs))
+	for i, jvj := range jvjs {
+		job, err := jvj.Convert(defaults)
+		if err != nil {
+			return nil, err
+		}
+		jobs[i] = job
+	}
+	return jobs, nil
+}
+
+// bridgeEvents publishes a BridgeEvent for each of the tracked jobs that has
+// finished, and stops tracking them. Jobs that no longer exist (eg. because
+// they were removed) also stop being tracked.
+func (c *Client) bridgeEvents(broker Broker, topic string, tracked map[string]bool) error {
+	jes := make([]*JobEssence, 0, len(tracked))
+	for key := range tracked {
+		jes = append(jes, &JobEssence{JobKey: key})
+	}
+	jobs, err := c.GetByEssences(jes)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		key := job.key()
+		found[key] = true
+		if job.State != JobStateComplete && job.State != JobStateBuried {
+			continue
+		}
+		event, err := json.Marshal(&BridgeEvent{
+			Key:        key,
+			Cmd:        job.Cmd,
+			RepGroup:   job.RepGroup,
+			State:      job.State,
+			Exitcode:   job.Exitcode,
+			FailReason: job.FailReason,
+			Walltime:   job.WallTime().Seconds(),
+			PeakRAM:    job.PeakRAM,
+		})
+		if err != nil {
+			return err
+		}
+		err = broker.Publish(topic, event)
+		if err != nil {
+			return err
+		}
+		delete(tracked, key)
+	}
+	for key := range tracked {
+		if !found[key] {
+			delete(tracked, key)
+		}
+	}
+	return nil
+}
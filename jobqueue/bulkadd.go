@@ -0,0 +1,110 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for adding very large numbers of jobs to the
+// queue efficiently, in sorted batches with progress reporting.
+
+import "sort"
+
+// ClientAddBatchSize is the default number of jobs that AddBulk() sends to the
+// server per request.
+var ClientAddBatchSize = 50000
+
+// AddProgress describes how far through an AddBulk() we are.
+type AddProgress struct {
+	Total   int // the total number of jobs being added
+	Sent    int // how many of them the server has dealt with so far
+	Added   int // how many of those sent were new to the queue
+	Existed int // how many of those sent were already in the queue
+}
+
+// AddBulk is like Add(), but is more efficient when adding very large numbers
+// of jobs (hundreds of thousands or more). The jobs are sent to the server in
+// batches of batchSize (ClientAddBatchSize if 0), so that no single request
+// takes longer than the Client's timeout, and each batch is sorted by job key
+// so that the server can store it without further sorting.
+//
+// If any job has Dependencies, all the jobs are sent in a single request
+// regardless of batchSize, since otherwise a job could start running before
+// the jobs it depends on had been added in a later batch.
+//
+// If progress is non-nil, it will be called after each batch has been added.
+// On error, the returned counts cover the batches that were successfully
+// added before the error.
+func (c *Client) AddBulk(jobs []*Job, envVars []string, ignoreComplete bool, batchSize int, progress func(*AddProgress)) (added, existed int, err error) {
+	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.addBatches(jobs, &clientRequest{Method: "add", Env: compressed, IgnoreComplete: ignoreComplete}, batchSize, progress)
+}
+
+// addBatches sends the given jobs to the server in sorted batches, each in a
+// copy of the given "add" request.
+func (c *Client) addBatches(jobs []*Job, cr *clientRequest, batchSize int, progress func(*AddProgress)) (added, existed int, err error) {
+	if batchSize <= 0 {
+		batchSize = ClientAddBatchSize
+	}
+	for _, job := range jobs {
+		if len(job.Dependencies) > 0 {
+			batchSize = len(jobs)
+			break
+		}
+	}
+
+	p := &AddProgress{Total: len(jobs)}
+	for start := 0; start < len(jobs); start += batchSize {
+		end := start + batchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+
+		bcr := *cr
+		bcr.Jobs = sortJobsByKey(jobs[start:end])
+		bcr.CheckPeers = c.CheckPeers
+		resp, errr := c.request(&bcr)
+		if errr != nil {
+			return p.Added, p.Existed, errr
+		}
+
+		p.Sent = end
+		p.Added += resp.Added
+		p.Existed += resp.Existed
+		if progress != nil {
+			progress(p)
+		}
+	}
+	return p.Added, p.Existed, nil
+}
+
+// sortJobsByKey returns a copy of the given slice of jobs, sorted by their
+// keys.
+func sortJobsByKey(jobs []*Job) []*Job {
+	keys := make(map[*Job]string, len(jobs))
+	for _, job := range jobs {
+		keys[job] = job.key()
+	}
+	sorted := make([]*Job, len(jobs))
+	copy(sorted, jobs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return keys[sorted[i]] < keys[sorted[j]]
+	})
+	return sorted
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the server code for POSTing to the CallbackURL of jobs
+// when they finish.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// CallbackSignatureHeader is the HTTP header that holds the signature of the
+// body of callback requests: "sha256=" followed by the hex encoded HMAC-SHA256
+// of the body, keyed with the Server's token. Receivers should check it to be
+// sure the request came from the Server.
+const CallbackSignatureHeader = "X-Wr-Signature"
+
+// CallbackEventHeader is the HTTP header that holds the JobState the job of a
+// callback request ended up in.
+const CallbackEventHeader = "X-Wr-Event"
+
+// callbackAttempts is the number of times we'll try to POST to a CallbackURL,
+// waiting callbackBackoff (doubling each time) between attempts, with each
+// attempt timing out after callbackTimeout.
+var (
+	callbackAttempts = 5
+	callbackBackoff  = 1 * time.Second
+	callbackTimeout  = 10 * time.Second
+)
+
+// CallbackEvent is the JSON body that the Server POSTs to a Job's CallbackURL.
+// It has the same form as the events that Bridge() publishes.
+type CallbackEvent BridgeEvent
+
+// callbackSignature returns the value of the CallbackSignatureHeader for the
+// given body and token.
+func callbackSignature(body, token []byte) string {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(body) // #nosec hash writes never return an error
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendCallback POSTs a CallbackEvent to the given job's CallbackURL in a
+// goroutine, if it has one, retrying with backoff on failure.
+func (s *Server) sendCallback(job *Job, state JobState) {
+	job.RLock()
+	if job.CallbackURL == "" {
+		job.RUnlock()
+		return
+	}
+	callbackURL := job.CallbackURL
+	key := job.key()
+	body, err := json.Marshal(&CallbackEvent{
+		Key:        key,
+		Cmd:        job.Cmd,
+		RepGroup:   job.RepGroup,
+		State:      state,
+		Exitcode:   job.Exitcode,
+		FailReason: job.FailReason,
+		Walltime:   job.WallTime().Seconds(),
+		PeakRAM:    job.PeakRAM,
+	})
+	job.RUnlock()
+	if err != nil {
+		s.Warn("callback encoding failed", "job", key, "err", err)
+		return
+	}
+	signature := callbackSignature(body, s.token)
+
+	s.wg.Add(1)
+	go func() {
+		defer internal.LogPanic(s.Logger, "job callback", false)
+		defer s.wg.Done()
+
+		client := &http.Client{Timeout: callbackTimeout}
+		backoff := callbackBackoff
+		for attempt := 1; ; attempt++ {
+			retry, errp := s.postCallback(client, callbackURL, body, signature, state)
+			if errp == nil {
+				s.Debug("sent job callback", "job", key, "url", callbackURL)
+				return
+			}
+			if !retry || attempt >= callbackAttempts {
+				s.Warn("job callback failed", "job", key, "url", callbackURL, "attempts", attempt, "err", errp)
+				return
+			}
+
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-s.stopClientHandling:
+				s.Warn("job callback abandoned due to shutdown", "job", key, "url", callbackURL, "err", errp)
+				return
+			}
+		}
+	}()
+}
+
+// postCallback makes a single attempt at POSTing a callback. It returns true
+// along with any error if the failure was such that it's worth trying again.
+func (s *Server) postCallback(client *http.Client, callbackURL string, body []byte, signature string, state JobState) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackSignatureHeader, signature)
+	req.Header.Set(CallbackEventHeader, string(state))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	errc := resp.Body.Close()
+	if errc != nil {
+		s.Warn("job callback response close failed", "err", errc)
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("callback got status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("callback got status %s", resp.Status)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for injecting faults in to the server, so that
+// clients' retry and recovery logic can be tested against realistic failures.
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChaosConfig describes faults for the Server to inject, for testing how
+// clients cope with an unreliable manager. Zero values inject nothing. Never
+// use this in production.
+type ChaosConfig struct {
+	// TouchDropRate is the fraction (0..1) of Touch() requests that are carried
+	// out but never replied to, as if the reply was lost on the network.
+	TouchDropRate float64
+
+	// ReserveDelay is how long to wait before handling each Reserve()
+	// request, as if the manager was under heavy load.
+	ReserveDelay time.Duration
+
+	// ArchiveFailOnce makes the first Archive() of each Job fail, as if the
+	// database write had failed.
+	ArchiveFailOnce bool
+
+	// Seed seeds the choice of which requests to drop, for reproducible tests.
+	// 0 means seed from the current time.
+	Seed int64
+}
+
+// chaos injects the faults described by a ChaosConfig.
+type chaos struct {
+	cfg          ChaosConfig
+	rand         *rand.Rand
+	archiveFails map[string]bool
+	sync.Mutex
+}
+
+// newChaos creates a chaos that injects the faults described by the given
+// config, which can be nil to inject none.
+func newChaos(cfg *ChaosConfig) *chaos {
+	c := &chaos{}
+	c.set(cfg)
+	return c
+}
+
+// set changes the faults we inject.
+func (c *chaos) set(cfg *ChaosConfig) {
+	c.Lock()
+	defer c.Unlock()
+	c.cfg = ChaosConfig{}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	seed := c.cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.rand = rand.New(rand.NewSource(seed)) // #nosec this isn't security related
+	c.archiveFails = make(map[string]bool)
+}
+
+// before is called before handling the given request, and returns a server
+// error if the request should fail instead of being handled.
+func (c *chaos) before(cr *clientRequest) string {
+	if c == nil {
+		return ""
+	}
+	c.Lock()
+	cfg := c.cfg
+	c.Unlock()
+
+	switch cr.Method {
+	case "reserve":
+		if cfg.ReserveDelay > 0 {
+			<-time.After(cfg.ReserveDelay)
+		}
+	case "jarchive":
+		if !cfg.ArchiveFailOnce || cr.Job == nil {
+			return ""
+		}
+		key := cr.Job.key()
+		c.Lock()
+		defer c.Unlock()
+		if c.archiveFails[key] {
+			// it failed once already; let this attempt work
+			delete(c.archiveFails, key)
+			return ""
+		}
+		c.archiveFails[key] = true
+		return ErrChaos
+	}
+	return ""
+}
+
+// dropReply tells you if the successful response to a request with the given
+// method should not be sent.
+func (c *chaos) dropReply(method string) bool {
+	if c == nil || method != "jtouch" {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.cfg.TouchDropRate > 0 && c.rand.Float64() < c.cfg.TouchDropRate
+}
+
+// SetChaos changes the faults this Server injects (see ServerConfig.Chaos),
+// eg. to start injecting them only after some test setup is complete. Pass
+// nil to stop injecting faults.
+func (s *Server) SetChaos(cfg *ChaosConfig) {
+	s.chaos.set(cfg)
+}
@@ -22,19 +22,23 @@ package jobqueue
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
-	"runtime"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/req"
 	"github.com/go-mangos/mangos/transport/tlstcp"
@@ -42,7 +46,8 @@ import (
 	"github.com/ugorji/go/codec"
 )
 
-// FailReason* are the reasons for cmd line failure stored on Jobs
+// FailReason* are the reasons for cmd line failure stored on Jobs. Each has a
+// corresponding FailCode* that won't change if these are reworded.
 const (
 	FailReasonEnv      = "failed to get environment variables"
 	FailReasonCwd      = "working directory does not exist"
@@ -60,6 +65,24 @@ const (
 	FailReasonMount    = "mounting of remote file system(s) failed"
 	FailReasonUpload   = "failed to upload files to remote file system"
 	FailReasonKilled   = "killed by user request"
+	FailReasonLimits   = "umask or resource limits could not be applied"
+	FailReasonDisk     = "command used too much disk space"
+	FailReasonSecrets  = "secrets could not be retrieved"
+	FailReasonHostSet  = "host setup command failed"
+	FailReasonShutdown = "manager shut down"
+	FailReasonParent   = "a job this depends on was buried"
+	FailReasonImage    = "container image could not be prepared"
+)
+
+// outputDestEnvVar is the environment variable that Cmds and "run" Behaviours
+// get a Job's OutputDest in.
+const outputDestEnvVar = "WR_OUTPUT_DEST"
+
+// coresEnvVar and ramEnvVar are the environment variables that Cmds get the
+// number of cores and RAM (MB) they were given in.
+const (
+	coresEnvVar = "WR_CORES"
+	ramEnvVar   = "WR_RAM"
 )
 
 // these global variables are primarily exported for testing purposes; you
@@ -68,47 +91,101 @@ const (
 var (
 	ClientTouchInterval               = 15 * time.Second
 	ClientReleaseDelay                = 30 * time.Second
+	ClientDiskCheckInterval           = 1 * time.Minute
+	ClientShutdownWait                = 2 * time.Minute
+	ClientReservePoll                 = 1 * time.Second
 	RAMIncreaseMin            float64 = 1000
 	RAMIncreaseMultLow                = 2.0
 	RAMIncreaseMultHigh               = 1.3
 	RAMIncreaseMultBreakpoint float64 = 8192
 )
 
+// ClientInFlightDir is a directory that Execute() records the Jobs it is
+// running in, so that if the server can't be reached when they finish, their
+// end states can be reported later by ReconcileInFlight(). The default of
+// blank string disables this.
+var ClientInFlightDir string
+
 // clientRequest is the struct that clients send to the server over the network
 // to request it do something. (The properties are only exported so the
 // encoder doesn't ignore them.)
 type clientRequest struct {
-	ClientID       uuid.UUID
-	Env            []byte // compressed binc encoding of []string
-	FirstReserve   bool
-	GetEnv         bool
-	GetStd         bool
-	IgnoreComplete bool
-	Job            *Job
-	JobEndState    *JobEndState
-	Jobs           []*Job
-	Keys           []string
-	Limit          int
-	Method         string
-	SchedulerGroup string
-	State          JobState
-	File           []byte // compressed bytes of file content
-	Path           string // desired path File should be stored at, can be blank
-	Timeout        time.Duration
-	Token          []byte
+	CheckPeers       bool
+	ClientID         uuid.UUID
+	Codec            WireCodec
+	Deadline         time.Duration
+	Crash            *RunnerCrash
+	Env              []byte // compressed binc encoding of []string
+	EnvProfile       string
+	Filter           *JobFilter
+	FirstReserve     bool
+	Force            bool
+	GetEnv           bool
+	GetStd           bool
+	Host             string
+	IgnoreComplete   bool
+	Job              *Job
+	JobEndState      *JobEndState
+	Jobs             []*Job
+	Keys             []string
+	Labels           map[string]string
+	Limit            int
+	LimitGroups      []*LimitGroup
+	Method           string
+	MinProtocol      int
+	Modification     *JobModification
+	Outputs          []Artifact
+	Protocol         int
+	SchedulerGroup   string
+	Since            time.Time
+	State            JobState
+	Stream           *StreamedStd
+	File             []byte // compressed bytes of file content
+	Path             string // desired path File should be stored at, can be blank
+	Purge            bool
+	Remediate        bool
+	RepGroup         string
+	RepGroupDefaults []*RepGroupDefaults
+	ReqChange        *ReqChange
+	ReqProfiles      []*ReqGroupProfile
+	ReqSamples       []*ReqGroupSample
+	Secret           []byte
+	Timeout          time.Duration
+	Token            []byte
+	Version          string
 }
 
 // Client represents the client side of the socket that the jobqueue server is
 // Serve()ing, specific to a particular queue.
 type Client struct {
-	ch          codec.Handle
+	ch          codec.Handle // for things we store, which must always be binc
+	wire        codec.Handle // for requests, negotiated during Connect()
 	clientid    uuid.UUID
 	hasReserved bool
 	sock        mangos.Socket
 	sync.Mutex
 	teMutex    sync.Mutex // to protect Touch() from other methods during Execute()
 	token      []byte
+	hostGroups map[string]*hostGroup
+	cache      *clientCache
+	tunnel     *tunnel
 	ServerInfo *ServerInfo
+
+	// what we were Connect()ed with, so Subscribe() can make another
+	// connection, and how we tell its goroutines to stop
+	addr       string
+	caFile     string
+	certDomain string
+	timeout    time.Duration
+	subStop    chan struct{}
+	subOnce    sync.Once
+
+	// CheckPeers, if set to true, makes the Add*() methods have the server
+	// also check the queues of all its peer managers (see ServerConfig.Peers)
+	// for the jobs being added, treating any found there as already existing.
+	// Use this if you run parallel managers and need to avoid the same job
+	// being added to more than one of them.
+	CheckPeers bool
 }
 
 // envStr holds the []string from os.Environ(), for codec compatibility.
@@ -135,6 +212,13 @@ type envStr struct {
 // Timeout determines how long to wait for a response from the server, not only
 // while connecting, but for all subsequent interactions with it using the
 // returned Client.
+//
+// The encoding of requests sent after the initial ping is negotiated with the
+// server based on ClientWireCodec.
+//
+// If ClientProxy is set, the server is reached through that proxy or SSH tunnel
+// instead of directly. The server's certificate is still verified against
+// certDomain.
 func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duration) (*Client, error) {
 	sock, err := req.NewSocket()
 	if err != nil {
@@ -159,9 +243,22 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 		tlsConfig.RootCAs = certPool
 	}
 
+	var t *tunnel
+	dialAddr := addr
+	if ClientProxy != "" {
+		t, err = startTunnel(ClientProxy, ClientProxySSHKey, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		dialAddr = t.addr()
+	}
+
 	dialOpts := make(map[string]interface{})
 	dialOpts[mangos.OptionTLSConfig] = tlsConfig
-	if err = sock.DialOptions("tls+tcp://"+addr, dialOpts); err != nil {
+	if err = sock.DialOptions("tls+tcp://"+dialAddr, dialOpts); err != nil {
+		if t != nil {
+			t.close()
+		}
 		return nil, err
 	}
 
@@ -172,25 +269,50 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 	// running on machines with low time resolution
 	u, err := uuid.NewV4()
 	if err != nil {
+		if t != nil {
+			t.close()
+		}
 		return nil, err
 	}
-	c := &Client{sock: sock, ch: new(codec.BincHandle), token: token, clientid: u}
+	bh, _ := wireHandle(WireCodecBinc)
+	c := &Client{sock: sock, ch: new(codec.BincHandle), wire: bh, token: token, clientid: u, cache: newClientCache(), tunnel: t}
+	c.addr, c.caFile, c.certDomain, c.timeout = addr, caFile, certDomain, timeout
+	c.subStop = make(chan struct{})
 
 	// Dial succeeds even when there's no server up, so we test the connection
-	// works with a Ping()
-	si, err := c.Ping(timeout)
+	// works with a ping, which is always binc encoded; at the same time we ask
+	// for our desired encoding, which the server agrees to by echoing it back
+	resp, err := c.request(&clientRequest{Method: "ping", Timeout: timeout, Codec: ClientWireCodec, Version: Version})
+	if err == nil && !protocolCompatible(resp.SInfo.Protocol, resp.SInfo.MinProtocol) {
+		// (a server from before protocol versioning will have Protocol 0)
+		err = Error{"ping", "", ErrIncompatible}
+	}
 	if err != nil {
+		if t != nil {
+			t.close()
+		}
 		errc := sock.Close()
 		if errc != nil {
 			return c, errc
 		}
 		msg := ErrNoServer
-		if jqerr, ok := err.(Error); ok && jqerr.Err == ErrPermissionDenied {
-			msg = ErrPermissionDenied
+		if jqerr, ok := err.(Error); ok {
+			switch jqerr.Err {
+			case ErrPermissionDenied:
+				msg = ErrPermissionDenied
+			case ErrIncompatible:
+				if resp != nil && resp.SInfo != nil {
+					return nil, VersionError{ClientVersion: Version, ClientProtocol: protocolVersion, ServerVersion: resp.SInfo.Version, ServerProtocol: resp.SInfo.Protocol}
+				}
+				msg = ErrIncompatible
+			}
 		}
 		return nil, Error{"Connect", "", msg}
 	}
-	c.ServerInfo = si
+	c.ServerInfo = resp.SInfo
+	if resp.Codec == ClientWireCodec {
+		c.wire, _ = wireHandle(resp.Codec)
+	}
 
 	return c, err
 }
@@ -198,7 +320,17 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 // Disconnect closes the connection to the jobqueue server. It is CRITICAL that
 // you call Disconnect() before calling Connect() again in the same process.
 func (c *Client) Disconnect() error {
-	return c.sock.Close()
+	c.subOnce.Do(func() {
+		close(c.subStop)
+	})
+	c.cache.invalidate()
+	err := c.sock.Close()
+	if c.tunnel != nil {
+		if errt := c.tunnel.close(); err == nil {
+			err = errt
+		}
+	}
+	return err
 }
 
 // Ping tells you if your connection to the server is working, returning static
@@ -218,7 +350,17 @@ func (c *Client) Ping(timeout time.Duration) (*ServerInfo, error) {
 // running. You get back a count of existing runners and and an estimated time
 // until completion for the last of those runners.
 func (c *Client) DrainServer() (running int, etc time.Duration, err error) {
-	resp, err := c.request(&clientRequest{Method: "drain"})
+	return c.DrainServerBy(0)
+}
+
+// DrainServerBy is like DrainServer(), but if jobs are still running once the
+// given deadline has passed, they are killed and released back to the queue
+// (without counting against their Retries, so they run again once the server
+// is restarted), and the server stops. Calling this again while the server is
+// draining sets a new deadline. A deadline of 0 means no deadline.
+func (c *Client) DrainServerBy(deadline time.Duration) (running int, etc time.Duration, err error) {
+	c.cache.invalidate(cacheKeyServerInfo)
+	resp, err := c.request(&clientRequest{Method: "drain", Deadline: deadline})
 	if err != nil {
 		return running, etc, err
 	}
@@ -228,16 +370,62 @@ func (c *Client) DrainServer() (running int, etc time.Duration, err error) {
 	return running, etc, err
 }
 
-// ShutdownServer tells the server to immediately cease all operations. Its last
-// act will be to backup its internal database. Any existing runners will fail.
-// Because the server gets shut down it can't respond with success/failure, so
-// we indirectly report if the server was shut down successfully.
+// GetServerStats returns some simple live stats about what's happening in the
+// server's queue, including whether it is draining, and how long until its
+// drain deadline.
+func (c *Client) GetServerStats() (*ServerStats, error) {
+	resp, err := c.request(&clientRequest{Method: "getstats"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.SStats, err
+}
+
+// GetCloudServers describes the servers that the server's cloud scheduler has
+// spawned, including the version of the post creation script each ran. Returns
+// nil if the server isn't using a cloud scheduler.
+func (c *Client) GetCloudServers() ([]*scheduler.CloudServer, error) {
+	resp, err := c.request(&clientRequest{Method: "getservers"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CloudServers, err
+}
+
+// ShutdownServer tells the server to cease all operations, returning true if
+// it confirmed it was doing so within ClientShutdownWait. See
+// ShutdownServerWithin() for details.
 func (c *Client) ShutdownServer() bool {
+	return c.ShutdownServerWithin(ClientShutdownWait) == nil
+}
+
+// ShutdownServerWithin tells the server to cease all operations, in two
+// phases. First the server acknowledges the request and stops handing out
+// jobs. It then tells any existing runners to kill their Cmds and release their
+// jobs with FailReasonShutdown (which doesn't count against their Retries),
+// gives them a little time to exit, and backs up its internal database. Only
+// then does it confirm to us that it is about to stop.
+//
+// An error is returned if the server couldn't be told to shut down, if its
+// database backup failed (though it still stops), or if its confirmation didn't
+// arrive within the given time.
+func (c *Client) ShutdownServerWithin(wait time.Duration) error {
+	if c.ServerInfo != nil && c.ServerInfo.Protocol < 5 {
+		// older servers stop without replying, so we can only assume that a
+		// timeout means success
+		_, err := c.request(&clientRequest{Method: "shutdown"})
+		if err != nil && err.Error() == "receive time out" {
+			return nil
+		}
+		return err
+	}
+
 	_, err := c.request(&clientRequest{Method: "shutdown"})
-	if err == nil || (err != nil && err.Error() == "receive time out") {
-		return true
+	if err != nil {
+		return err
 	}
-	return false
+	_, err = c.requestWithin(&clientRequest{Method: "shutdownwait"}, wait)
+	return err
 }
 
 // BackupDB backs up the server's database to the given path. Note that
@@ -264,8 +452,9 @@ func (c *Client) BackupDB(path string) error {
 // there.
 //
 // If any were already there, you will not get an error, but the returned
-// 'existed' count will be > 0. Note that no cross-queue checking is done, so
-// you need to be careful not to add the same job to different queues.
+// 'existed' count will be > 0. Note that no cross-queue checking is done unless
+// you set CheckPeers, so you need to be careful not to add the same job to
+// different queues.
 //
 // Note that if you add jobs to the queue that were previously added, Execute()d
 // and were successfully Archive()d, the existed count will be 0 and the jobs
@@ -281,13 +470,30 @@ func (c *Client) Add(jobs []*Job, envVars []string, ignoreComplete bool) (added,
 	if err != nil {
 		return 0, 0, err
 	}
-	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete})
+	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete, CheckPeers: c.CheckPeers})
 	if err != nil {
 		return 0, 0, err
 	}
 	return resp.Added, resp.Existed, err
 }
 
+// AddWithResults is like Add(), but instead of adding none of the jobs if any
+// of them are invalid (eg. they have negative requirements or an unroutable
+// Datacentre), it adds the valid ones and tells you what happened to each job
+// you supplied, in the same order, so you can fix and resubmit just the
+// rejected ones.
+func (c *Client) AddWithResults(jobs []*Job, envVars []string, ignoreComplete bool) ([]*AddResult, error) {
+	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.request(&clientRequest{Method: "addresults", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete, CheckPeers: c.CheckPeers})
+	if err != nil {
+		return nil, err
+	}
+	return resp.AddResults, err
+}
+
 // Reserve takes a job off the jobqueue. If you process the job successfully you
 // should Archive() it. If you can't deal with it right now you should Release()
 // it. If you think it can never be dealt with you should Bury() it. If you die
@@ -354,17 +560,26 @@ func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string)
 // variable. Once the Cmd exits, this temp directory will be deleted and the
 // path to the actual working directory created will be in the Job's ActualCwd
 // property. The unique folder structure itself can be wholly deleted through
-// the Job behaviour "cleanup".
+// the Job behaviour "cleanup", or as the Job's SandboxPolicy dictates. If the scheduler provided a scratch volume for
+// the Job (by setting scheduler.ScratchDirEnvVar in our environment), the
+// unique subdirectory is created there instead of within Cwd.
 //
 // If any remote file system mounts have been configured for the Job, these are
 // mounted prior to running the Cmd, and unmounted afterwards.
 //
+// If the Job has a Container, its image is pulled before Started() is called,
+// and the Cmd is then run inside it with docker or singularity. The peak RAM
+// of a docker container is taken from its cgroup.
+//
 // Internally, Execute() calls Mount() and Started() and keeps track of peak RAM
 // used. It regularly calls Touch() on the Job so that the server knows we are
 // still alive and handling the Job successfully. It also intercepts SIGTERM,
 // SIGINT, SIGQUIT, SIGUSR1 and SIGUSR2, sending SIGKILL to the running Cmd and
 // returning Error.Err(FailReasonSignal); you should check for this and exit
-// your process. Finally it calls Unmount() and TriggerBehaviours().
+// your process. On unix, the Cmd is run in its own process group, and the RAM
+// tracking and killing apply to everything in that group and everything the
+// Cmd spawns, so that commands that fork pipelines of other tools are fully
+// accounted for. Finally it calls Unmount() and TriggerBehaviours().
 //
 // If Kill() is called while executing the Cmd, the next internal Touch() call
 // will result in the Cmd being killed and the job being Bury()ied.
@@ -380,6 +595,18 @@ func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string)
 // immediately return an error. NB: the peak RAM tracking assumes we are running
 // on a modern linux system with /proc/*/smaps.
 func (c *Client) Execute(job *Job, shell string) error {
+	return c.ExecuteContext(context.Background(), job, shell)
+}
+
+// ExecuteContext is like Execute(), but cancelling ctx while the Cmd is running
+// is treated like receiving a signal: the Cmd is killed and
+// Error.Err(FailReasonSignal) is returned after the usual clean up. If ctx is
+// already done, ctx.Err() is returned without anything being run.
+func (c *Client) ExecuteContext(ctx context.Context, job *Job, shell string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// quickly check upfront that we Reserve()d the job; this isn't required
 	// for other methods since the server does this check and returns an error,
 	// but in this case we want to avoid starting to execute the command before
@@ -389,28 +616,61 @@ func (c *Client) Execute(job *Job, shell string) error {
 	}
 
 	// we support arbitrary shell commands that may include semi-colons,
-	// quoted stuff and pipes, so it's best if we just pass it to bash
-	jc := job.Cmd
-	if strings.Contains(jc, " | ") {
+	// quoted stuff and pipes, so it's best if we just pass it to bash (or
+	// whatever shell the job wants)
+	if job.Shell != "" {
+		shell = job.Shell
+	}
+	jc := job.activeCmd()
+	if strings.Contains(jc, " | ") && !isWindowsShell(shell) {
 		jc = "set -o pipefail; " + jc
 	}
-	cmd := exec.Command(shell, "-c", jc) // #nosec Our whole purpose is to allow users to run arbitrary commands via us...
+	if job.Wrapper != "" && !isWindowsShell(shell) {
+		jc = wrapCmd(job.Wrapper, shell, jc)
+	}
+	cmd := shellCommand(shell, jc)
 
 	// we'll filter STDERR/OUT of the cmd to keep only the first and last line
 	// of any contiguous block of \r terminated lines (to mostly eliminate
-	// progress bars), and  we'll store only up to 4kb of their head and tail
+	// progress bars), then apply the job's OutputFilter, and  we'll store only
+	// up to 4kb of their head and tail
+	filter, err := job.OutputFilter.compile()
+	if err != nil {
+		return err
+	}
+	stderr := &prefixSuffixSaver{N: 4096}
+	stdout := &prefixSuffixSaver{N: 4096}
+	var stderrTo, stdoutTo io.Writer = stderr, stdout
+	var collector *stdCollector
+	if job.StreamStd {
+		// the output is being followed, so we also collect all of it to send
+		// to the server while the cmd runs
+		collector = newStdCollector()
+		stderrTo = io.MultiWriter(stderr, collector.err)
+		stdoutTo = io.MultiWriter(stdout, collector.out)
+	}
 	errReader, err := cmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create a pipe for STDERR from cmd [%s]: %s", jc, err)
 	}
-	stderr := &prefixSuffixSaver{N: 4096}
-	stderrWait := stdFilter(errReader, stderr)
+	stderrWait := stdFilter(errReader, stderrTo, filter)
 	outReader, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create a pipe for STDOUT from cmd [%s]: %s", jc, err)
 	}
-	stdout := &prefixSuffixSaver{N: 4096}
-	stdoutWait := stdFilter(outReader, stdout)
+	stdoutWait := stdFilter(outReader, stdoutTo, filter)
+
+	// before the first job of its scheduler group runs on this host, we may
+	// need to run a setup command
+	err = c.hostSetup(job, shell)
+	if err != nil {
+		buryErr := fmt.Errorf("host setup failed: %s", err)
+		errb := c.Bury(job, nil, FailReasonHostSet, buryErr)
+		if errb != nil {
+			buryErr = fmt.Errorf("%s (and burying the job failed: %s)", buryErr.Error(), errb)
+		}
+		return buryErr
+	}
 
 	// we'll run the command from the desired directory, which must exist or
 	// it will fail
@@ -426,8 +686,13 @@ func (c *Client) Execute(job *Job, shell string) error {
 	if job.CwdMatters {
 		cmd.Dir = job.Cwd
 	} else {
-		// we'll create a unique location to work in
-		actualCwd, tmpDir, err = mkHashedDir(job.Cwd, job.key())
+		// we'll create a unique location to work in, on any scratch volume
+		// we were given
+		baseDir := job.Cwd
+		if scratch := os.Getenv(scheduler.ScratchDirEnvVar); scratch != "" {
+			baseDir = scratch
+		}
+		actualCwd, tmpDir, err = mkHashedDir(baseDir, job.key())
 		if err != nil {
 			buryErr := fmt.Errorf("could not create working directory: %s", err)
 			errb := c.Bury(job, nil, FailReasonCwd, buryErr)
@@ -440,6 +705,20 @@ func (c *Client) Execute(job *Job, shell string) error {
 		job.ActualCwd = actualCwd
 	}
 
+	// if the server mints temporary credentials for our mounts, we use those
+	// instead of any in our environment
+	if len(job.credentialTargets()) > 0 {
+		job.mountCreds, err = c.getJobMountCredentials(job)
+		if err != nil {
+			buryErr := fmt.Errorf("failed to get credentials for remote file system(s): %s", err)
+			errb := c.Bury(job, nil, FailReasonMount, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%s (and burying the job failed: %s)", buryErr.Error(), errb)
+			}
+			return buryErr
+		}
+	}
+
 	// we'll mount any configured remote file systems
 	err = job.Mount()
 	if err != nil {
@@ -463,8 +742,8 @@ func (c *Client) Execute(job *Job, shell string) error {
 
 	// and we'll run it with the environment variables that were present when
 	// the command was first added to the queue (or if none, current env vars,
-	// and in either case, including any overrides) *** we need a way for users
-	// to update a job with new env vars
+	// and in either case, including any overrides, which users can change with
+	// Modify())
 	env, err := job.Env()
 	if err != nil {
 		errb := c.Bury(job, nil, FailReasonEnv)
@@ -478,10 +757,14 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 		return fmt.Errorf("failed to extract environment variables for job [%s]: %s%s", job.key(), err, extra)
 	}
+	var keepTmp bool
 	if tmpDir != "" {
 		// (this works fine even if tmpDir has a space in one of the dir names)
 		env = envOverride(env, []string{"TMPDIR=" + tmpDir})
 		defer func() {
+			if keepTmp {
+				return
+			}
 			errr := os.RemoveAll(tmpDir)
 			if errr != nil {
 				if myerr == nil {
@@ -496,18 +779,174 @@ func (c *Client) Execute(job *Job, shell string) error {
 			env = envOverride(env, []string{"HOME=" + actualCwd})
 		}
 	}
+	if job.OutputDest != "" {
+		env = envOverride(env, []string{outputDestEnvVar + "=" + job.OutputDest})
+	}
+	cores, ram := job.Requirements.Cores, job.Requirements.RAM
+	if job.GrantedCores > 0 {
+		cores, ram = job.GrantedCores, job.GrantedRAM
+	}
+	env = envOverride(env, []string{coresEnvVar + "=" + strconv.Itoa(cores), ramEnvVar + "=" + strconv.Itoa(ram)})
+
+	// now that we know what we were granted and where we're running, we can
+	// fill in any variables in the cmd
+	if expanded := job.expandCmd(jc, cores, ram, tmpDir, cmd.Dir); expanded != jc {
+		jc = expanded
+		setShellCmdLine(cmd, shell, jc)
+	}
+
+	// secrets are only ever given to the cmd, never stored with the job
+	if len(job.Secrets) > 0 {
+		secrets, errs := c.getJobSecrets(job)
+		if errs != nil {
+			buryErr := fmt.Errorf("failed to get secrets: %s", errs)
+			errb := c.Bury(job, nil, FailReasonSecrets, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%s (and burying the job failed: %s)", buryErr.Error(), errb)
+			}
+			_, erru := job.Unmount(true)
+			if erru != nil {
+				buryErr = fmt.Errorf("%s (and unmounting the job failed: %s)", buryErr.Error(), erru)
+			}
+			return buryErr
+		}
+		secretEnv := make([]string, 0, len(secrets))
+		for name, value := range secrets {
+			secretEnv = append(secretEnv, name+"="+value)
+		}
+		env = envOverride(env, secretEnv)
+	}
+
+	// let the cmd register its outputs with us while it runs; if we can't, the
+	// cmd just won't be able to do that
+	outputsSock, stopOutputs, err := c.serveJobOutputs(job, cmd.Dir)
+	if err == nil {
+		env = envOverride(env, []string{JobOutputsSocketEnvVar + "=" + outputsSock})
+		defer func() {
+			if stopOutputs != nil {
+				stopOutputs() // #nosec only fails to remove an empty tmp dir
+			}
+		}()
+	}
+
+	// and give it somewhere to write its metrics; again, if we can't, it just
+	// won't be able to emit any
+	metricsFile, err := createMetricsFile()
+	if err == nil {
+		env = envOverride(env, []string{MetricsFileEnvVar + "=" + metricsFile})
+		defer os.Remove(metricsFile) // #nosec nothing useful to do on failure
+	}
 	cmd.Env = env
 
-	// intercept certain signals (under LSF and SGE, SIGUSR2 may mean out-of-
-	// time, but there's no reliable way of knowing out-of-memory, so we will
-	// just treat them all the same)
+	// if the cmd is to be run in a container, we make sure we have its image
+	// now, so that pulling it doesn't count against the cmd's time
+	var ctr *containerRun
+	kill := func() error {
+		return killProcessGroup(cmd)
+	}
+	if job.Container.IsSet() {
+		if isWindowsShell(shell) {
+			err = fmt.Errorf("containers can't be used with the %s shell", shell)
+		} else {
+			ctr, err = c.prepareContainer(job)
+		}
+		if err != nil {
+			buryErr := fmt.Errorf("failed to prepare container: %s", err)
+			errb := c.Bury(job, nil, FailReasonImage, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%s (and burying the job failed: %s)", buryErr.Error(), errb)
+			}
+			_, erru := job.Unmount(true)
+			if erru != nil {
+				buryErr = fmt.Errorf("%s (and unmounting the job failed: %s)", buryErr.Error(), erru)
+			}
+			return buryErr
+		}
+		defer ctr.cleanup() // #nosec nothing useful to do on failure
+		kill = func() error {
+			return ctr.kill(cmd)
+		}
+		cmd.Env = envOverride(cmd.Env, []string{containerImageEnvVar + "=" + job.Container.Image})
+	}
+
+	// intercept certain signals
 	sigs := make(chan os.Signal, 5)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(sigs, runnerSignals...)
 	defer signal.Stop(sigs)
 
+	// and treat ctx being cancelled the same way
+	if ctx.Done() != nil {
+		executed := make(chan struct{})
+		defer close(executed)
+		go func() {
+			select {
+			case <-ctx.Done():
+				select {
+				case sigs <- os.Interrupt:
+				default:
+				}
+			case <-executed:
+			}
+		}()
+	}
+
+	// the cmd inherits our umask and resource limits, so we temporarily alter
+	// our own to whatever the job wants
+	var restoreLimits func() error
+	var stopMetadata func() error
+	if limits := job.processLimits(); limits.IsSet() {
+		procLimitsMutex.Lock()
+		restoreLimits, err = limits.apply()
+		if err != nil {
+			procLimitsMutex.Unlock()
+			buryErr := fmt.Errorf("failed to apply process limits: %s", err)
+			errb := c.Bury(job, nil, FailReasonLimits, buryErr)
+			if errb != nil {
+				buryErr = fmt.Errorf("%s (and burying the job failed: %s)", buryErr.Error(), errb)
+			}
+			_, erru := job.Unmount(true)
+			if erru != nil {
+				buryErr = fmt.Errorf("%s (and unmounting the job failed: %s)", buryErr.Error(), erru)
+			}
+			return buryErr
+		}
+	}
+
+	// record the environment the command runs in, if desired
+	var fingerprint *Fingerprint
+	if job.CaptureFingerprint {
+		fingerprint = captureFingerprint(cmd.Env)
+	}
+
 	// start running the command
 	endT := time.Now().Add(job.Requirements.Time)
+	if metadataSock, stop, errm := serveJobMetadata(job, endT); errm == nil {
+		cmd.Env = envOverride(cmd.Env, []string{JobMetadataSocketEnvVar + "=" + metadataSock})
+		stopMetadata = stop
+		defer func() {
+			if stopMetadata != nil {
+				stopMetadata() // #nosec nothing we can do about failure here
+			}
+		}()
+	}
+	if ctr != nil {
+		workDir := cmd.Dir
+		if actualCwd != "" {
+			workDir = filepath.Dir(actualCwd) // contains cwd and tmp
+		}
+		ctr.wrap(cmd, shell, jc, workDir, containerPassEnv(job, cmd.Env))
+	}
+
+	// run the cmd in its own process group, so that anything it spawns is
+	// included when we check its memory usage and kill it
+	setProcessGroup(cmd)
+	cmdStarted := time.Now()
 	err = cmd.Start()
+	var limitsErr error
+	if restoreLimits != nil {
+		limitsErr = restoreLimits()
+		procLimitsMutex.Unlock()
+	}
 	if err != nil {
 		// some obscure internal error about setting things up
 		errr := c.Release(job, nil, FailReasonStart)
@@ -527,7 +966,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 	if err != nil {
 		// if we can't access the server, may as well bail out now - kill the
 		// command (and don't bother trying to Release(); it will auto-Release)
-		errk := cmd.Process.Kill()
+		errk := kill()
 		extra := ""
 		if errk != nil {
 			extra = fmt.Sprintf(" (and killing the cmd failed: %s)", errk)
@@ -543,6 +982,26 @@ func (c *Client) Execute(job *Job, shell string) error {
 		return fmt.Errorf("command [%s] started running, but I killed it due to a jobqueue server error: %s%s", job.Cmd, err, extra)
 	}
 
+	// note that we're running the job locally, in case we lose contact with
+	// the server and need to tell a future one how it went
+	c.recordInFlight(job, "", "", nil) // #nosec this is only a fallback
+
+	var stopStreaming func()
+	if collector != nil {
+		stopStreaming = c.streamStd(job, collector)
+	}
+
+	// watch for the kernel killing the cmd for using too much memory, which
+	// we'd otherwise mistake for some other failure
+	oom := newOOMWatcher()
+	defer oom.stop()
+	keepInFlight := false
+	defer func() {
+		if !keepInFlight {
+			c.forgetInFlight(job)
+		}
+	}()
+
 	// update peak mem used by command, touch job and check if we use too much
 	// resources, every 15s. Also check for signals
 	peakmem := 0
@@ -550,17 +1009,37 @@ func (c *Client) Execute(job *Job, shell string) error {
 	memTicker := time.NewTicker(1 * time.Second)  // we need to check on memory usage frequently
 	ranoutMem := false
 	ranoutTime := false
+	ranoutDisk := false
 	signalled := false
 	killCalled := false
+	shuttingDown := false
+	disowned := false
 	var killErr error
 	var closeErr error
 	var stateMutex sync.Mutex
 	stopChecking := make(chan bool, 1)
+
+	// we also check on disk usage of the working directory (if we made it),
+	// though less frequently since this could be slow for big directories, to
+	// learn peak usage and, if desired, enforce the disk requirement
+	var diskTicker *time.Ticker
+	var diskCheck <-chan time.Time
+	var maxDisk, peakDisk int64
+	var workSpace string
+	if actualCwd != "" {
+		diskTicker = time.NewTicker(ClientDiskCheckInterval)
+		diskCheck = diskTicker.C
+		workSpace = filepath.Dir(actualCwd) // contains cwd and tmp
+		if job.EnforceDisk && job.Requirements.Disk > 0 {
+			maxDisk = int64(job.Requirements.Disk) * 1024 * 1024 * 1024
+		}
+	}
+
 	go func() {
 		for {
 			select {
 			case <-sigs:
-				killErr = cmd.Process.Kill()
+				killErr = kill()
 				stateMutex.Lock()
 				signalled = true
 				stateMutex.Unlock()
@@ -583,11 +1062,12 @@ func (c *Client) Execute(job *Job, shell string) error {
 				}
 				stateMutex.Unlock()
 
-				kc, errf := c.Touch(job)
+				kc, sd, errf := c.touch(job)
 				if kc {
-					killErr = cmd.Process.Kill()
+					killErr = kill()
 					stateMutex.Lock()
 					killCalled = true
+					shuttingDown = sd
 					stateMutex.Unlock()
 					errc := errReader.Close()
 					if errc != nil {
@@ -600,26 +1080,70 @@ func (c *Client) Execute(job *Job, shell string) error {
 					return
 				}
 				if errf != nil {
+					if jobDisowned(errf) {
+						// the manager is up, but has given up on us running
+						// this job (eg. it was restarted and we didn't get
+						// back in touch in time), so it may already be
+						// running elsewhere
+						killErr = kill()
+						stateMutex.Lock()
+						disowned = true
+						stateMutex.Unlock()
+						errc := errReader.Close()
+						if errc != nil {
+							closeErr = errc
+						}
+						errc = outReader.Close()
+						if errc != nil {
+							closeErr = errc
+						}
+						return
+					}
+
 					// we may have lost contact with the manager; this is OK. We
-					// will keep trying to touch until it works
+					// keep running the cmd and will keep trying to touch until
+					// it works
 					continue
 				}
 			case <-memTicker.C:
-				mem, errf := currentMemory(job.Pid)
+				mem, errf := groupMemory(job.Pid)
+				if ctr != nil && errf == nil {
+					// a docker container's processes aren't our descendants
+					if cmem, errc := ctr.memory(); errc == nil {
+						mem += cmem
+					}
+				}
 				stateMutex.Lock()
+				oom.track(job.Pid)
 				if errf == nil && mem > peakmem {
 					peakmem = mem
 
 					if peakmem > job.Requirements.RAM {
 						// we don't allow things to use too much memory, or we
 						// could screw up the machine we're running on
-						killErr = cmd.Process.Kill()
+						killErr = kill()
 						ranoutMem = true
 						stateMutex.Unlock()
 						return
 					}
 				}
 				stateMutex.Unlock()
+			case <-diskCheck:
+				used, errf := currentDisk(workSpace)
+				if errf != nil {
+					continue
+				}
+				stateMutex.Lock()
+				if used > peakDisk {
+					peakDisk = used
+				}
+				if maxDisk > 0 && used > maxDisk {
+					killErr = kill()
+					ranoutDisk = true
+					stateMutex.Unlock()
+					return
+				}
+				stateMutex.Unlock()
 			case <-stopChecking:
 				return
 			}
@@ -629,9 +1153,25 @@ func (c *Client) Execute(job *Job, shell string) error {
 	// wait for the command to exit
 	errsew := <-stderrWait
 	errsow := <-stdoutWait
+	if stopStreaming != nil {
+		// send the last of the output before the job stops running, so that
+		// followers get all of it
+		stopStreaming()
+	}
 	err = cmd.Wait()
 	ticker.Stop()
 	memTicker.Stop()
+	if stopOutputs != nil {
+		stopOutputs() // #nosec only fails to remove an empty tmp dir
+		stopOutputs = nil
+	}
+	if stopMetadata != nil {
+		stopMetadata() // #nosec nothing we can do about failure here
+		stopMetadata = nil
+	}
+	if diskTicker != nil {
+		diskTicker.Stop()
+	}
 	stopChecking <- true
 	stateMutex.Lock()
 	defer stateMutex.Unlock()
@@ -640,14 +1180,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 	// our better (?) pss-based Peakmem, unless the command exited so quickly
 	// we never ticked and calculated it
 	if peakmem == 0 {
-		ru := cmd.ProcessState.SysUsage().(*syscall.Rusage)
-		if runtime.GOOS == "darwin" {
-			// Maxrss values are bytes
-			peakmem = int((ru.Maxrss / 1024) / 1024)
-		} else {
-			// Maxrss values are kb
-			peakmem = int(ru.Maxrss / 1024)
-		}
+		peakmem = peakRSS(cmd.ProcessState)
 	}
 
 	// include our own memory usage in the peakmem of the command, since the
@@ -660,6 +1193,17 @@ func (c *Client) Execute(job *Job, shell string) error {
 	}
 	peakmem += ourmem
 
+	// likewise, get the final disk usage in case the command was quick or
+	// wrote most of its output at the end
+	var peakDiskMB int
+	if workSpace != "" {
+		if used, errf := currentDisk(workSpace); errf == nil && used > peakDisk {
+			peakDisk = used
+		}
+		mb := int64(1024 * 1024)
+		peakDiskMB = int((peakDisk + mb - 1) / mb)
+	}
+
 	// get the exit code and figure out what to do with the Job
 	var exitcode int
 	dobury := false
@@ -673,7 +1217,9 @@ func (c *Client) Execute(job *Job, shell string) error {
 	if err != nil {
 		// there was a problem running the command
 		if exitError, ok := err.(*exec.ExitError); ok {
-			exitcode = exitError.Sys().(syscall.WaitStatus).ExitStatus()
+			ws := exitError.Sys().(syscall.WaitStatus)
+			exitcode = ws.ExitStatus()
+			sigkilled := (ws.Signaled() && ws.Signal() == syscall.SIGKILL) || exitcode == 137
 			switch exitcode {
 			case 126:
 				dobury = true
@@ -692,6 +1238,13 @@ func (c *Client) Execute(job *Job, shell string) error {
 				if ranoutMem {
 					failreason = FailReasonRAM
 					myerr = Error{"Execute", job.key(), FailReasonRAM}
+				} else if ranoutDisk {
+					// using more disk than expected is not something that
+					// will go away with a retry, and could be a danger to
+					// other jobs sharing the disk, so we bury
+					dobury = true
+					failreason = FailReasonDisk
+					myerr = Error{"Execute", job.key(), FailReasonDisk}
 				} else if signalled {
 					if ranoutTime {
 						failreason = FailReasonTime
@@ -700,10 +1253,24 @@ func (c *Client) Execute(job *Job, shell string) error {
 						failreason = FailReasonSignal
 						myerr = Error{"Execute", job.key(), FailReasonSignal}
 					}
+				} else if disowned {
+					failreason = FailReasonKilled
+					myerr = fmt.Errorf("command [%s] was killed because the manager no longer considers us to be running it", job.Cmd)
+				} else if shuttingDown {
+					failreason = FailReasonShutdown
+					myerr = Error{"Execute", job.key(), FailReasonShutdown}
 				} else if killCalled {
 					dobury = true
 					failreason = FailReasonKilled
 					myerr = Error{"Execute", job.key(), FailReasonKilled}
+				} else if oomKilled, kernelPeak := oom.killed(); sigkilled && oomKilled {
+					// the kernel's view of how much memory was used at the
+					// end is more accurate than our last check
+					if kernelPeak+ourmem > peakmem {
+						peakmem = kernelPeak + ourmem
+					}
+					failreason = FailReasonRAM
+					myerr = Error{"Execute", job.key(), FailReasonRAM}
 				} else {
 					failreason = FailReasonExit
 					myerr = fmt.Errorf("command [%s] exited with code %d%s", job.Cmd, exitcode, mayBeTemp)
@@ -735,7 +1302,7 @@ func (c *Client) Execute(job *Job, shell string) error {
 			case <-sigs:
 				return
 			case <-ticker2.C:
-				if !killCalled && !ranoutMem && !signalled {
+				if !killCalled && !ranoutMem && !ranoutDisk && !signalled {
 					_, errf := c.Touch(job)
 					if errf != nil {
 						return
@@ -763,8 +1330,56 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 	}
 
+	if limitsErr != nil {
+		if myerr != nil {
+			myerr = fmt.Errorf("%s; restoring the runner's own process limits also failed: %s", myerr.Error(), limitsErr.Error())
+		} else {
+			myerr = limitsErr
+		}
+	}
+
+	// collect any core dump before behaviours get a chance to clean up the
+	// working directory
+	var coreFile string
+	if job.CoreDumps && !doarchive {
+		var errc error
+		coreFile, errc = collectCoreDump(job, cmd.Dir, cmdStarted)
+		if errc != nil {
+			finalStdErr = append(finalStdErr, "\n\nCore dump handling problems:\n"...)
+			finalStdErr = append(finalStdErr, errc.Error()...)
+		}
+	}
+
+	// write our report before behaviours get a chance to clean up or copy the
+	// working directory
+	if job.ExecutionReport {
+		ended := time.Now()
+		errr := writeExecutionReport(cmd.Dir, &ExecutionReport{
+			Cmd:        job.Cmd,
+			Key:        job.key(),
+			RepGroup:   job.RepGroup,
+			Host:       job.Host,
+			HostIP:     job.HostIP,
+			Cwd:        cmd.Dir,
+			Started:    cmdStarted,
+			Ended:      ended,
+			Walltime:   ended.Sub(cmdStarted).Seconds(),
+			CPUtime:    cmd.ProcessState.SystemTime().Seconds(),
+			Exitcode:   exitcode,
+			FailReason: failreason,
+			PeakRAM:    peakmem,
+			Attempt:    job.Attempts,
+			Mounts:     job.mountSummaries(),
+		})
+		if errr != nil {
+			finalStdErr = append(finalStdErr, "\n\nExecution report problems:\n"...)
+			finalStdErr = append(finalStdErr, errr.Error()...)
+		}
+	}
+
 	// run behaviours
-	berr := job.TriggerBehaviours(myerr == nil)
+	succeeded := myerr == nil
+	berr := job.TriggerBehaviours(succeeded)
 	if berr != nil {
 		if myerr != nil {
 			myerr = fmt.Errorf("%s; behaviour(s) also had problem(s): %s", myerr.Error(), berr.Error())
@@ -773,6 +1388,26 @@ func (c *Client) Execute(job *Job, shell string) error {
 		}
 	}
 
+	// deal with our unique working directory as the job's sandbox policy
+	// desires
+	var keptSandbox string
+	if actualCwd != "" {
+		keepTmp = job.SandboxPolicy.keepTmp(succeeded)
+		if job.SandboxPolicy.deleteAll(succeeded) {
+			b := &Behaviour{Do: CleanupAll}
+			errc := b.cleanup(job, true)
+			if errc != nil {
+				if myerr != nil {
+					myerr = fmt.Errorf("%s; deleting the sandbox also had problem(s): %s", myerr.Error(), errc.Error())
+				} else {
+					myerr = errc
+				}
+			}
+		} else if job.SandboxPolicy.Keep != "" {
+			keptSandbox = filepath.Dir(actualCwd)
+		}
+	}
+
 	// try and unmount now, because if we fail to upload files, we'll have to
 	// start over
 	addMountLogs := dobury || dorelease
@@ -820,6 +1455,16 @@ func (c *Client) Execute(job *Job, shell string) error {
 		finalStdOut = append(finalStdOut, errsow.Error()...)
 	}
 
+	var metrics map[string]float64
+	if metricsFile != "" {
+		var errm error
+		metrics, errm = readMetricsFile(metricsFile)
+		if errm != nil {
+			finalStdErr = append(finalStdErr, "\n\nMetrics file problems:\n"...)
+			finalStdErr = append(finalStdErr, errm.Error()...)
+		}
+	}
+
 	// though we may have had some problem, we always try and update our job end
 	// state, and we try many times to avoid having to repeat jobs unnecessarily
 	// (we keep retying for ~12+ hrs, giving plenty of time for issues to be
@@ -828,13 +1473,22 @@ func (c *Client) Execute(job *Job, shell string) error {
 	maxRetries := 300
 	worked := false
 	jes := &JobEndState{
-		Cwd:      actualCwd,
-		Exitcode: exitcode,
-		PeakRAM:  peakmem,
-		CPUtime:  cmd.ProcessState.SystemTime(),
-		Stdout:   finalStdOut,
-		Stderr:   finalStdErr,
-		Exited:   true,
+		Cwd:         actualCwd,
+		Exitcode:    exitcode,
+		PeakRAM:     peakmem,
+		PeakDisk:    peakDiskMB,
+		CPUtime:     cmd.ProcessState.SystemTime(),
+		Stdout:      finalStdOut,
+		Stderr:      finalStdErr,
+		Exited:      true,
+		Fingerprint: fingerprint,
+		CoreFile:    coreFile,
+		KeptSandbox: keptSandbox,
+		Metrics:     metrics,
+	}
+	if disowned {
+		// there's no one to tell about our end state
+		return myerr
 	}
 	for retryNum := 0; retryNum < maxRetries; retryNum++ {
 		// update the database with our final state
@@ -846,6 +1500,10 @@ func (c *Client) Execute(job *Job, shell string) error {
 			err = c.Archive(job, jes)
 		}
 		if err != nil {
+			if jobDisowned(err) {
+				// trying again won't help
+				break
+			}
 			<-time.After(time.Duration(retryNum*100) * time.Millisecond)
 			continue
 		}
@@ -859,6 +1517,20 @@ func (c *Client) Execute(job *Job, shell string) error {
 		if errt != nil {
 			extra = fmt.Sprintf(" (and triggering behaviours failed: %s)", errt)
 		}
+		if !jobDisowned(err) && inFlightPath(job) != "" {
+			// keep our end state around for ReconcileInFlight()
+			action := inFlightActionArchive
+			if dobury {
+				action = inFlightActionBury
+			} else if dorelease {
+				action = inFlightActionRelease
+			}
+			errr := c.recordInFlight(job, action, failreason, jes)
+			if errr == nil {
+				keepInFlight = true
+				extra += " (its end state has been kept to report later)"
+			}
+		}
 		return fmt.Errorf("command [%s] finished running, but will need to be rerun due to a jobqueue server error: %s%s", job.Cmd, err, extra)
 	}
 
@@ -867,8 +1539,10 @@ func (c *Client) Execute(job *Job, shell string) error {
 
 // Started updates a Job on the server with information that you've started
 // running the Job's Cmd. Started also figures out some host name, ip and
-// possibly id (in cloud situations) to associate with the job, so that if
-// something goes wrong the user can go to the host and investigate. Note that
+// possibly id (in cloud situations) to associate with the job, along with the
+// identifier the external job scheduler knows us by (see
+// scheduler.RunnerID()), so that if something goes wrong the user can go to the
+// host and investigate. Note that
 // HostID will not be set on job after this call; only the server will know
 // about it (use one of the Get methods afterwards to get a new object with the
 // HostID set if necessary).
@@ -883,6 +1557,7 @@ func (c *Client) Started(job *Job, pid int) error {
 	if err != nil {
 		return err
 	}
+	job.SchedulerID = scheduler.RunnerID()
 	job.Pid = pid
 	job.Attempts++             // not considered by server, which does this itself - just for benefit of this process
 	job.StartTime = time.Now() // ditto
@@ -893,15 +1568,22 @@ func (c *Client) Started(job *Job, pid int) error {
 // Touch adds to a job's ttr, allowing you more time to work on it. Note that
 // you must have reserved the job before you can touch it. If the returned bool
 // is true, you stop doing what you're doing and bury the job, since this means
-// that Kill() has been called for this job.
+// that Kill() has been called for this job (or, if the server is shutting
+// down, release it with FailReasonShutdown).
 func (c *Client) Touch(job *Job) (bool, error) {
+	killCalled, _, err := c.touch(job)
+	return killCalled, err
+}
+
+// touch is like Touch(), but also returns true if the server is shutting down.
+func (c *Client) touch(job *Job) (killCalled bool, shuttingDown bool, err error) {
 	c.teMutex.Lock()
 	defer c.teMutex.Unlock()
 	resp, err := c.request(&clientRequest{Method: "jtouch", Job: job})
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
-	return resp.KillCalled, err
+	return resp.KillCalled, resp.ShuttingDown, err
 }
 
 // JobEndState is used to describe the state of a job after it has (tried to)
@@ -912,13 +1594,18 @@ func (c *Client) Touch(job *Job) (bool, error) {
 // tried to execute the Cmd, in which case you would just provide a nil
 // JobEndState to the methods that need one.
 type JobEndState struct {
-	Cwd      string
-	Exitcode int
-	PeakRAM  int
-	CPUtime  time.Duration
-	Stdout   []byte
-	Stderr   []byte
-	Exited   bool
+	Cwd         string
+	Exitcode    int
+	PeakRAM     int
+	PeakDisk    int
+	CPUtime     time.Duration
+	Stdout      []byte
+	Stderr      []byte
+	Exited      bool
+	Fingerprint *Fingerprint
+	CoreFile    string
+	KeptSandbox string
+	Metrics     map[string]float64
 }
 
 // ended updates a Job for the benefit of the client only; this has no effect on
@@ -933,7 +1620,15 @@ func (c *Client) ended(job *Job, jes *JobEndState) error {
 	job.Exited = true
 	job.Exitcode = jes.Exitcode
 	job.PeakRAM = jes.PeakRAM
+	job.PeakDisk = jes.PeakDisk
 	job.CPUtime = jes.CPUtime
+	if jes.Fingerprint != nil {
+		job.Fingerprint = jes.Fingerprint
+	}
+	if jes.CoreFile != "" {
+		job.CoreFile = jes.CoreFile
+	}
+	job.Metrics = jes.Metrics
 	if jes.Cwd != "" {
 		job.ActualCwd = jes.Cwd
 	}
@@ -995,7 +1690,7 @@ func (c *Client) Release(job *Job, jes *JobEndState, failreason string) error {
 	// update our process with what the server would have done
 	if job.Exited && job.Exitcode != 0 {
 		job.UntilBuried--
-		job.updateRecsAfterFailure()
+		job.updateRecsAfterFailure(nil)
 	}
 	if job.UntilBuried <= 0 {
 		job.State = JobStateBuried
@@ -1047,6 +1742,10 @@ func (c *Client) Kick(jes []*JobEssence) (int, error) {
 // completely. For use when jobs were created incorrectly/ by accident, or they
 // can never be fixed. It returns a count of jobs that it actually removed.
 // Errors will only be related to not being able to contact the server.
+//
+// If the server was configured with a TrashKeep, the removed jobs are kept in
+// a trash for that long, and can be brought back with Restore(). Use Purge()
+// to remove jobs permanently.
 func (c *Client) Delete(jes []*JobEssence) (int, error) {
 	keys := c.jesToKeys(jes)
 	resp, err := c.request(&clientRequest{Method: "jdel", Keys: keys})
@@ -1165,6 +1864,29 @@ func (c *Client) UploadFile(local, remote string) (string, error) {
 	return resp.Path, err
 }
 
+// requestWithin is like request(), but waits up to the given time for the
+// response, instead of the timeout supplied to Connect().
+func (c *Client) requestWithin(cr *clientRequest, timeout time.Duration) (sr *serverResponse, err error) {
+	c.Lock()
+	orig, err := c.sock.GetOption(mangos.OptionRecvDeadline)
+	if err == nil {
+		err = c.sock.SetOption(mangos.OptionRecvDeadline, timeout)
+	}
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		c.Lock()
+		errs := c.sock.SetOption(mangos.OptionRecvDeadline, orig)
+		c.Unlock()
+		if err == nil {
+			err = errs
+		}
+	}()
+	return c.request(cr)
+}
+
 // request the server do something and get back its response. We can only cope
 // with one request at a time per client, or we'll get replies back in the
 // wrong order, hence we lock.
@@ -1174,25 +1896,30 @@ func (c *Client) request(cr *clientRequest) (*serverResponse, error) {
 
 	// encode and send the request
 	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, c.ch)
+	enc := codec.NewEncoderBytes(&encoded, c.wire)
 	cr.Token = c.token
 	cr.ClientID = c.clientid
+	cr.Protocol = protocolVersion
+	cr.MinProtocol = minProtocolVersion
 	err := enc.Encode(cr)
 	if err != nil {
 		return nil, err
 	}
 	err = c.sock.Send(encoded)
 	if err != nil {
+		c.cache.invalidate()
 		return nil, err
 	}
 
-	// get the response and decode it
+	// get the response and decode it; on failure we may be reconnected to a
+	// different server, so we don't trust anything we cached
 	resp, err := c.sock.Recv()
 	if err != nil {
+		c.cache.invalidate()
 		return nil, err
 	}
 	sr := &serverResponse{}
-	dec := codec.NewDecoderBytes(resp, c.ch)
+	dec := codec.NewDecoderBytes(resp, c.wire)
 	err = dec.Decode(sr)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,170 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for optionally caching the results of queries
+// about things that rarely change, like ServerInfo, so that clients that
+// repeatedly ask for them don't need to keep making round-trips to the server.
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientCacheTTL is the default time that a Client with caching enabled will
+// remember query results for, when EnableCache() is given a ttl of 0.
+var ClientCacheTTL = 30 * time.Second
+
+// cache keys for the queries we cache
+const (
+	cacheKeyServerInfo  = "serverinfo"
+	cacheKeySecretNames = "secretnames"
+)
+
+// cachedResult is a query result and when it stops being valid.
+type cachedResult struct {
+	value   interface{}
+	expires time.Time
+}
+
+// clientCache holds a Client's cached query results, along with the identity
+// of the server they came from, so that they can be thrown away if we find
+// ourselves talking to a different (eg. restarted) server.
+type clientCache struct {
+	ttl      time.Duration
+	results  map[string]*cachedResult
+	serverID string
+	sync.Mutex
+}
+
+// newClientCache creates a disabled clientCache.
+func newClientCache() *clientCache {
+	return &clientCache{results: make(map[string]*cachedResult)}
+}
+
+// get returns the unexpired cached value for the given key, if any.
+func (cc *clientCache) get(key string) (interface{}, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.ttl <= 0 {
+		return nil, false
+	}
+	cr, exists := cc.results[key]
+	if !exists || time.Now().After(cr.expires) {
+		return nil, false
+	}
+	return cr.value, true
+}
+
+// set stores the given value under the given key, if caching is enabled.
+func (cc *clientCache) set(key string, value interface{}) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.ttl <= 0 {
+		return
+	}
+	cc.results[key] = &cachedResult{value: value, expires: time.Now().Add(cc.ttl)}
+}
+
+// invalidate forgets the given keys, or everything if no keys are supplied.
+func (cc *clientCache) invalidate(keys ...string) {
+	cc.Lock()
+	defer cc.Unlock()
+	if len(keys) == 0 {
+		cc.results = make(map[string]*cachedResult)
+		return
+	}
+	for _, key := range keys {
+		delete(cc.results, key)
+	}
+}
+
+// seenServer records the identity of the server described by the given
+// ServerInfo, invalidating everything if it differs from the server we
+// previously cached results from.
+func (cc *clientCache) seenServer(si *ServerInfo) {
+	if si == nil {
+		return
+	}
+	id := si.Addr + ":" + si.Host + ":" + strconv.Itoa(si.PID)
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.serverID != "" && cc.serverID != id {
+		cc.results = make(map[string]*cachedResult)
+	}
+	cc.serverID = id
+}
+
+// EnableCache turns on caching of the results of queries about things that
+// rarely change (currently ServerInfo() and GetSecretNames()), with results
+// being remembered for the given ttl (ClientCacheTTL if 0). This is useful for
+// short-lived clients, like command line invocations, that would otherwise
+// ask the same questions more than once.
+//
+// Cached results are forgotten early when this client makes a change that
+// would affect them, when communication with the server fails (since we may
+// end up reconnected to a different server), and when we discover the server
+// has been restarted. Changes made by other clients may not be seen until the
+// ttl expires.
+func (c *Client) EnableCache(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = ClientCacheTTL
+	}
+	c.cache.Lock()
+	c.cache.ttl = ttl
+	c.cache.Unlock()
+	c.cache.seenServer(c.ServerInfo)
+	c.cache.set(cacheKeyServerInfo, c.ServerInfo)
+}
+
+// DisableCache turns off caching of query results and forgets any results
+// that were cached.
+func (c *Client) DisableCache() {
+	c.cache.Lock()
+	c.cache.ttl = 0
+	c.cache.Unlock()
+	c.cache.invalidate()
+}
+
+// InvalidateCache forgets any cached query results, so that the next queries
+// will get fresh answers from the server.
+func (c *Client) InvalidateCache() {
+	c.cache.invalidate()
+}
+
+// GetServerInfo returns static information about the server, like Ping() does,
+// but if caching has been turned on with EnableCache(), it avoids a round-trip
+// when the information was recently retrieved. The Client's ServerInfo
+// property is updated with the result.
+func (c *Client) GetServerInfo() (*ServerInfo, error) {
+	if val, cached := c.cache.get(cacheKeyServerInfo); cached {
+		if si, ok := val.(*ServerInfo); ok && si != nil {
+			return si, nil
+		}
+	}
+	si, err := c.Ping(0)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.seenServer(si)
+	c.cache.set(cacheKeyServerInfo, si)
+	c.ServerInfo = si
+	return si, nil
+}
@@ -0,0 +1,177 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the variants of Client methods that take a
+// context.Context, so that callers can cancel them or give them their own
+// deadlines.
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-mangos/mangos"
+)
+
+// ConnectContext is like Connect(), but returns ctx.Err() as soon as ctx is
+// done, if that happens before the connection has been established. (A
+// connection that gets established after that is disconnected.)
+func ConnectContext(ctx context.Context, addr, caFile, certDomain string, token []byte, timeout time.Duration) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type connection struct {
+		client *Client
+		err    error
+	}
+	done := make(chan connection, 1)
+	go func() {
+		client, err := Connect(addr, caFile, certDomain, token, timeout)
+		done <- connection{client, err}
+	}()
+
+	select {
+	case conn := <-done:
+		return conn.client, conn.err
+	case <-ctx.Done():
+		go func() {
+			conn := <-done
+			if conn.err == nil {
+				_ = conn.client.Disconnect() // #nosec nothing useful to do on failure
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// PingContext is like Ping(), but waits no longer than ctx's deadline for the
+// server to respond, returning early if ctx is cancelled.
+func (c *Client) PingContext(ctx context.Context) (*ServerInfo, error) {
+	timeout := c.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "ping", Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return resp.SInfo, err
+}
+
+// AddContext is like Add(), but waits no longer than ctx's deadline for the
+// server to respond, returning early if ctx is cancelled. Note that in that
+// case the jobs may still have been added.
+func (c *Client) AddContext(ctx context.Context, jobs []*Job, envVars []string, ignoreComplete bool) (added, existed int, err error) {
+	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := c.requestContext(ctx, &clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete, CheckPeers: c.CheckPeers})
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Added, resp.Existed, err
+}
+
+// ReserveContext is like Reserve(), but also stops waiting for a job, returning
+// ctx.Err(), once ctx is done. A timeout of 0 means to wait until then.
+//
+// So that no job gets reserved without being returned, the server is asked
+// for jobs ClientReservePoll at a time, so it may take that long for
+// cancellation to be noticed.
+func (c *Client) ReserveContext(ctx context.Context, timeout time.Duration) (*Job, error) {
+	return c.ReserveScheduledContext(ctx, timeout, "")
+}
+
+// ReserveScheduledContext is like ReserveScheduled(), but also stops waiting
+// for a job once ctx is done, as per ReserveContext().
+func (c *Client) ReserveScheduledContext(ctx context.Context, timeout time.Duration, schedulerGroup string) (*Job, error) {
+	var giveUp time.Time
+	if timeout > 0 {
+		giveUp = time.Now().Add(timeout)
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		wait := ClientReservePoll
+		if !giveUp.IsZero() {
+			remaining := time.Until(giveUp)
+			if remaining <= 0 {
+				return nil, nil
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			if untilDeadline := time.Until(deadline); untilDeadline > 0 && untilDeadline < wait {
+				wait = untilDeadline
+			}
+		}
+
+		job, err := c.ReserveScheduled(wait, schedulerGroup)
+		if err != nil || job != nil {
+			return job, err
+		}
+	}
+}
+
+// requestContext is like request(), but waits no longer than ctx's deadline
+// (if it has one) for the response, instead of the timeout supplied to
+// Connect(), and returns ctx.Err() as soon as ctx is done. (We can only make
+// one request at a time, so further requests will still wait for the response
+// to an abandoned one to arrive or time out.)
+func (c *Client) requestContext(ctx context.Context, cr *clientRequest) (*serverResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type response struct {
+		sr  *serverResponse
+		err error
+	}
+	done := make(chan response, 1)
+	go func() {
+		var r response
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline)
+			if timeout <= 0 {
+				done <- response{nil, context.DeadlineExceeded}
+				return
+			}
+			r.sr, r.err = c.requestWithin(cr, timeout)
+		} else {
+			r.sr, r.err = c.request(cr)
+		}
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		if r.err == mangos.ErrRecvTimeout && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return r.sr, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the functions that let a client reach the server through
+// an HTTP or SOCKS5 proxy, or an SSH tunnel, such as via a bastion host.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// ClientProxy, if set, is the URL of something Connect() should reach the
+// server through, instead of connecting to it directly. Supported forms are:
+//
+// http://[user:password@]host:port to use an HTTP proxy that supports CONNECT.
+//
+// socks5://[user:password@]host:port to use a SOCKS5 proxy.
+//
+// ssh://[user@]host[:port] to tunnel through an SSH server, authenticating
+// with the private key at ClientProxySSHKey. The SSH server's host key is
+// checked against ~/.ssh/known_hosts if that exists.
+var ClientProxy string
+
+// ClientProxySSHKey is the path to the private key file used to authenticate
+// when ClientProxy is an ssh:// URL.
+var ClientProxySSHKey string
+
+// proxyDialFunc makes a connection to the given address via a proxy.
+type proxyDialFunc func(addr string) (net.Conn, error)
+
+// tunnel listens on a local port and relays every connection made to it on to
+// a target address via a proxyDialFunc. This lets the mangos transport, which
+// can only dial addresses directly, reach the server through a proxy.
+type tunnel struct {
+	ln     net.Listener
+	target string
+	dial   proxyDialFunc
+	closer io.Closer
+	conns  map[net.Conn]bool
+	closed bool
+	mutex  sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// startTunnel parses the given proxy URL and starts relaying connections made
+// to the returned tunnel's addr() on to the given target address.
+func startTunnel(proxyURL, sshKeyFile, target string, timeout time.Duration) (*tunnel, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy url %s: %s", proxyURL, err)
+	}
+
+	var dial proxyDialFunc
+	var closer io.Closer
+	switch u.Scheme {
+	case "http":
+		dial = httpConnectDialer(u, timeout)
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		var dialer proxy.Dialer
+		dialer, err = proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+		dial = func(addr string) (net.Conn, error) {
+			return dialer.Dial("tcp", addr)
+		}
+	case "ssh":
+		var client *ssh.Client
+		client, err = sshTunnelClient(u, sshKeyFile, timeout)
+		if err != nil {
+			return nil, err
+		}
+		dial = func(addr string) (net.Conn, error) {
+			return client.Dial("tcp", addr)
+		}
+		closer = client
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s", u.Scheme)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	t := &tunnel{
+		ln:     ln,
+		target: target,
+		dial:   dial,
+		closer: closer,
+		conns:  make(map[net.Conn]bool),
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// addr returns the local address that connections should be made to.
+func (t *tunnel) addr() string {
+	return t.ln.Addr().String()
+}
+
+// accept relays each connection made to our listener until close() is called.
+func (t *tunnel) accept() {
+	defer t.wg.Done()
+	for {
+		local, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		t.wg.Add(1)
+		go t.relay(local)
+	}
+}
+
+// relay copies data between the given local connection and a new connection
+// to our target made via our proxy, until either side closes.
+func (t *tunnel) relay(local net.Conn) {
+	defer t.wg.Done()
+	remote, err := t.dial(t.target)
+	if err != nil {
+		local.Close()
+		return
+	}
+	if !t.track(local, remote) {
+		local.Close()
+		remote.Close()
+		return
+	}
+
+	done := make(chan bool, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- true
+	}
+	go cp(remote, local)
+	go cp(local, remote)
+	<-done
+	local.Close()
+	remote.Close()
+	<-done
+	t.untrack(local, remote)
+}
+
+// track remembers the given connections so that close() can close them,
+// returning false if we've already been closed.
+func (t *tunnel) track(conns ...net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	for _, conn := range conns {
+		t.conns[conn] = true
+	}
+	return true
+}
+
+// untrack forgets connections previously passed to track().
+func (t *tunnel) untrack(conns ...net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, conn := range conns {
+		delete(t.conns, conn)
+	}
+}
+
+// close stops accepting connections, closes any being relayed and, for SSH
+// tunnels, disconnects from the SSH server.
+func (t *tunnel) close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.closed = true
+	err := t.ln.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+	t.wg.Wait()
+	if t.closer != nil {
+		if errc := t.closer.Close(); err == nil {
+			err = errc
+		}
+	}
+	return err
+}
+
+// httpConnectDialer returns a proxyDialFunc that uses the CONNECT method of the
+// HTTP proxy at the given URL.
+func httpConnectDialer(u *url.URL, timeout time.Duration) proxyDialFunc {
+	return func(addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", u.Host, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+
+		err = conn.SetDeadline(time.Now().Add(timeout))
+		if err == nil {
+			err = req.Write(conn)
+		}
+		var resp *http.Response
+		br := bufio.NewReader(conn)
+		if err == nil {
+			resp, err = http.ReadResponse(br, req)
+		}
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("proxy %s refused to connect to %s: %s", u.Host, addr, resp.Status)
+			}
+		}
+		if err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// the server won't say anything until the client starts the TLS
+		// handshake, but just in case the proxy sent more than its response
+		// we don't want to lose it
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	}
+}
+
+// bufferedConn is a net.Conn that first returns anything read in to its
+// bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements io.Reader.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sshTunnelClient connects to the SSH server at the given ssh:// URL.
+func sshTunnelClient(u *url.URL, keyFile string, timeout time.Duration) (*ssh.Client, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("an ssh key file is required to tunnel through %s", u.Host)
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	username := ""
+	if u.User != nil {
+		username = u.User.Username()
+	}
+	var home string
+	if usr, erru := user.Current(); erru == nil {
+		home = usr.HomeDir
+		if username == "" {
+			username = usr.Username
+		}
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	knownHostsFile := filepath.Join(home, ".ssh", "known_hosts")
+	if _, errs := os.Stat(knownHostsFile); home != "" && errs == nil {
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	return ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for cloning existing Jobs, so that past work can
+// be re-run with changes without having to recreate the original submission.
+
+import (
+	"os"
+	"strings"
+)
+
+// CloneMods describes changes to make to Jobs being Clone()d. Zero values leave
+// the corresponding property as it was.
+type CloneMods struct {
+	// CmdReplace are pairs of old and new substrings to replace in each Job's
+	// Cmd, as per strings.NewReplacer().
+	CmdReplace []string
+
+	// Reqs changes the Requirements of the clones.
+	Reqs *ReqChange
+
+	// RepGroup gives the clones a new RepGroup.
+	RepGroup string
+}
+
+// apply makes the changes to the given job.
+func (m *CloneMods) apply(job *Job) {
+	if len(m.CmdReplace) > 0 {
+		job.Cmd = strings.NewReplacer(m.CmdReplace...).Replace(job.Cmd)
+	}
+	if m.Reqs != nil && !m.Reqs.isEmpty() && job.Requirements != nil {
+		m.Reqs.apply(job)
+	}
+	if m.RepGroup != "" {
+		job.RepGroup = m.RepGroup
+	}
+}
+
+// Clone adds new Jobs to the queue that are copies of the existing Jobs
+// described by the given JobEssences, which can be incomplete or complete. The
+// copies have the same specification, environment, DepGroups and Dependencies
+// as the originals, but with the changes described by mods (which can be nil).
+//
+// Clones that end up identical to an incomplete Job (eg. because you did not
+// change their Cmd) are not added, but are counted in the returned existed.
+// Clones identical to complete Jobs are added, so you can re-run completed
+// work unchanged. Note that, as with Add(), adding clones that are in the
+// DepGroups of complete Jobs will cause those Jobs to be re-run as well.
+func (c *Client) Clone(jes []*JobEssence, mods *CloneMods) (added, existed int, err error) {
+	if mods != nil && len(mods.CmdReplace)%2 == 1 {
+		return 0, 0, Error{"Clone", "", ErrBadRequest}
+	}
+
+	resp, err := c.request(&clientRequest{Method: "getbc", Keys: c.jesToKeys(jes), GetEnv: true})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the clones keep the environment of their original, so we add them in
+	// groups of those sharing an environment
+	var envs []string
+	groups := make(map[string][]*Job)
+	for _, job := range resp.Jobs {
+		clone := job.specCopy()
+		clone.DepGroups = job.DepGroups
+		clone.Dependencies = job.Dependencies
+		clone.Datacentre = job.Datacentre
+		clone.EnvOverride = job.EnvOverride
+		if mods != nil {
+			mods.apply(clone)
+		}
+
+		env := string(job.EnvC)
+		if _, exists := groups[env]; !exists {
+			envs = append(envs, env)
+		}
+		groups[env] = append(groups[env], clone)
+	}
+
+	for _, env := range envs {
+		envc := []byte(env)
+		if len(envc) == 0 {
+			envc, err = c.CompressEnv(os.Environ())
+			if err != nil {
+				return added, existed, err
+			}
+		}
+		resp, err = c.request(&clientRequest{Method: "add", Jobs: groups[env], Env: envc})
+		if err != nil {
+			return added, existed, err
+		}
+		added += resp.Added
+		existed += resp.Existed
+	}
+	return added, existed, err
+}
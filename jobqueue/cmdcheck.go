@@ -0,0 +1,278 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for checking that the executables a Cmd runs can
+// be found, so that users can find out about missing software before they add
+// Jobs instead of when they get buried.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// cmdPrefixes are words that can come before the executable of a simple
+// command.
+var cmdPrefixes = map[string]bool{
+	"!": true, "{": true, "time": true, "if": true, "then": true, "else": true, "elif": true,
+	"while": true, "until": true, "do": true, "exec": true, "command": true, "env": true,
+}
+
+// cmdSkips are words that start parts of a command line we don't try to
+// understand, or that have no executable.
+var cmdSkips = map[string]bool{
+	"for": true, "case": true, "select": true, "function": true, "in": true, "[[": true,
+	"((": true, "fi": true, "done": true, "esac": true, "}": true,
+}
+
+// cmdEnvChangers are commands that may change PATH or the working directory,
+// after which we can't know what the executables of later commands will
+// resolve to.
+var cmdEnvChangers = map[string]bool{
+	"module": true, "ml": true, "source": true, ".": true, "export": true, "eval": true,
+	"cd": true, "pushd": true, "popd": true, "conda": true, "spack": true,
+}
+
+// shellBuiltins are bash builtins, which don't need an executable.
+var shellBuiltins = map[string]bool{
+	":": true, "[": true, "alias": true, "bg": true, "bind": true, "break": true, "builtin": true,
+	"caller": true, "compgen": true, "complete": true, "continue": true, "declare": true,
+	"dirs": true, "disown": true, "echo": true, "enable": true, "exit": true, "false": true,
+	"fc": true, "fg": true, "getopts": true, "hash": true, "help": true, "history": true,
+	"jobs": true, "kill": true, "let": true, "local": true, "logout": true, "mapfile": true,
+	"printf": true, "pwd": true, "read": true, "readarray": true, "readonly": true,
+	"return": true, "set": true, "shift": true, "shopt": true, "suspend": true, "test": true,
+	"times": true, "trap": true, "true": true, "type": true, "typeset": true, "ulimit": true,
+	"umask": true, "unalias": true, "unset": true, "wait": true,
+}
+
+// cmdWord is a word of a command line, with quoting removed. unknown is true if
+// its value depends on a variable or command substitution.
+type cmdWord struct {
+	text    string
+	unknown bool
+}
+
+// cmdSegments splits a (bash) command line in to the words of each of its
+// simple commands, splitting on ; & | ( ) and new lines outside of quotes.
+func cmdSegments(cmdLine string) [][]cmdWord {
+	var segments [][]cmdWord
+	var words []cmdWord
+	var word strings.Builder
+	var inWord, unknown bool
+	var quote rune
+	endWord := func() {
+		if inWord {
+			words = append(words, cmdWord{text: word.String(), unknown: unknown})
+			word.Reset()
+			inWord, unknown = false, false
+		}
+	}
+	endSegment := func() {
+		endWord()
+		if len(words) > 0 {
+			segments = append(segments, words)
+			words = nil
+		}
+	}
+
+	runes := []rune(cmdLine)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				r = runes[i]
+			} else if (r == '$' && quote == '"') || r == '`' {
+				unknown = true
+			}
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			if i+1 < len(runes) {
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+					inWord = true
+				}
+			}
+		case r == '$' || r == '`':
+			word.WriteRune(r)
+			inWord, unknown = true, true
+		case r == '>' || r == '<':
+			// keep redirections like 2>&1 together, so the & doesn't look
+			// like a separator
+			word.WriteRune(r)
+			inWord = true
+			if i+1 < len(runes) && (runes[i+1] == '&' || runes[i+1] == r) {
+				i++
+				word.WriteRune(runes[i])
+			}
+		case r == ';' || r == '&' || r == '|' || r == '(' || r == ')' || r == '\n':
+			endSegment()
+		case unicode.IsSpace(r):
+			endWord()
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endSegment()
+	return segments
+}
+
+// isRedirection tells you if the given word is a redirection like >out or
+// 2>&1, and if so, if it is just the operator, with the target being the next
+// word.
+func isRedirection(word string) (redirection bool, operatorOnly bool) {
+	op := strings.TrimLeft(word, "0123456789")
+	if op == "" || (op[0] != '>' && op[0] != '<') {
+		return false, false
+	}
+	return true, strings.Trim(op, "<>&") == ""
+}
+
+// isAssignment tells you if the given word is a variable assignment like
+// FOO=bar.
+func isAssignment(word string) bool {
+	i := strings.Index(word, "=")
+	return i > 0 && validEnvName.MatchString(word[:i])
+}
+
+// CmdExecutables returns the executables that the given (bash) command line
+// would run, in the order they appear: the first word of each of its simple
+// commands, ignoring variable assignments, redirections, shell keywords and
+// builtins. Commands whose executable depends on a variable or command
+// substitution are ignored. We stop at the first command that might change
+// PATH or the working directory (eg. "module load" or "cd"), since we can't
+// know what the executables after it resolve to.
+func CmdExecutables(cmdLine string) []string {
+	var exes []string
+	seen := make(map[string]bool)
+	for _, words := range cmdSegments(cmdLine) {
+		for i := 0; i < len(words); i++ {
+			w := words[i]
+			if redirection, operatorOnly := isRedirection(w.text); redirection && !w.unknown {
+				if operatorOnly {
+					i++
+				}
+				continue
+			}
+			if w.unknown {
+				break
+			}
+			if isAssignment(w.text) {
+				if strings.HasPrefix(w.text, "PATH=") {
+					return exes
+				}
+				continue
+			}
+			if cmdPrefixes[w.text] || (strings.HasPrefix(w.text, "-") && i > 0 && words[i-1].text == "env") {
+				continue
+			}
+			if cmdEnvChangers[w.text] {
+				return exes
+			}
+			if !cmdSkips[w.text] && !shellBuiltins[w.text] && !seen[w.text] {
+				exes = append(exes, w.text)
+				seen[w.text] = true
+			}
+			break
+		}
+	}
+	return exes
+}
+
+// MissingExecutables returns those of CmdExecutables(cmdLine) that can't be
+// found. Executables containing a / are checked as paths (relative ones
+// against cwd, unless cwd is blank, in which case they are assumed to exist),
+// while others are looked for in the PATH of the given environment.
+func MissingExecutables(cmdLine string, env []string, cwd string) []string {
+	var path string
+	for _, envvar := range env {
+		if strings.HasPrefix(envvar, "PATH=") {
+			path = strings.TrimPrefix(envvar, "PATH=")
+		}
+	}
+
+	var missing []string
+	for _, exe := range CmdExecutables(cmdLine) {
+		if strings.Contains(exe, "/") {
+			if !filepath.IsAbs(exe) {
+				if cwd == "" {
+					continue
+				}
+				exe = filepath.Join(cwd, exe)
+			}
+			if !isExecutable(exe) {
+				missing = append(missing, exe)
+			}
+			continue
+		}
+
+		found := false
+		for _, dir := range filepath.SplitList(path) {
+			if dir != "" && isExecutable(filepath.Join(dir, exe)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, exe)
+		}
+	}
+	return missing
+}
+
+// isExecutable tells you if the given path is an executable file.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+// MissingExecutables returns the executables of the Job's Cmd that can't be
+// found in the given environment (with the Job's EnvOverride applied), as per
+// the MissingExecutables() function. Cmds that will run in a Container or a
+// Windows shell aren't checked.
+func (j *Job) MissingExecutables(env []string) ([]string, error) {
+	if j.Container.IsSet() || isWindowsShell(j.Shell) {
+		return nil, nil
+	}
+	overrides, err := j.envCurrentOverrides()
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		env = envOverride(env, overrides)
+	}
+	var cwd string
+	if j.CwdMatters {
+		cwd = j.Cwd
+	}
+	return MissingExecutables(j.Cmd, env, cwd), nil
+}
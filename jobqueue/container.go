@@ -0,0 +1,390 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a Job's Cmd inside a docker or
+// singularity container.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ContainerRuntime* are the container runtimes a Container can use.
+const (
+	ContainerRuntimeDocker      = "docker"
+	ContainerRuntimeSingularity = "singularity"
+)
+
+// containerImageEnvVar is the environment variable we set to the image Cmd runs
+// in, which also gets it recorded in the Job's Fingerprint.
+const containerImageEnvVar = "WR_CONTAINER_IMAGE"
+
+// validEnvName matches acceptable environment variable names.
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Container describes a container that a Job's Cmd should be run inside of,
+// instead of directly on the host.
+type Container struct {
+	// Runtime is "docker" (the default) or "singularity".
+	Runtime string `json:"runtime,omitempty"`
+
+	// Image is the image to run, eg. "ubuntu:22.04" for docker, or for
+	// singularity, something like "docker://ubuntu:22.04" or the path to a
+	// .sif file. Images are pulled before Cmd is considered to have started,
+	// so pulling doesn't count against the Job's time requirement.
+	Image string `json:"image"`
+
+	// Mounts are extra host paths to make available in the container,
+	// specified like "/host/path[:/container/path][:ro]". Cmd's working
+	// directory is always mounted at the same path.
+	Mounts []string `json:"mounts,omitempty"`
+
+	// Env are the names of environment variables to pass through from the
+	// Job's environment in to the container. Cmd's Secrets, TMPDIR and the
+	// WR_* variables set by Execute() are always passed through.
+	Env []string `json:"env,omitempty"`
+
+	// User is the user[:group] to run as in a docker container, defaulting to
+	// the user and group of the runner. Singularity always runs as the
+	// runner's user.
+	User string `json:"user,omitempty"`
+}
+
+// ParseContainer parses the JSON representation of a Container, eg.
+// {"image":"ubuntu:22.04","mounts":["/data:/data:ro"],"env":["REF"]}, and
+// validates it.
+func ParseContainer(container string) (Container, error) {
+	var c Container
+	if container == "" {
+		return c, nil
+	}
+	if err := json.Unmarshal([]byte(container), &c); err != nil {
+		return c, fmt.Errorf("container [%s] is not valid JSON: %s", container, err)
+	}
+	return c, c.Validate()
+}
+
+// IsSet tells you if a container has been specified.
+func (c Container) IsSet() bool {
+	return c.Image != "" || c.Runtime != "" || len(c.Mounts) > 0 || len(c.Env) > 0 || c.User != ""
+}
+
+// Validate checks that an image has been specified, and that the runtime,
+// mounts and env names are valid.
+func (c Container) Validate() error {
+	if !c.IsSet() {
+		return nil
+	}
+	if c.Image == "" {
+		return fmt.Errorf("container has no image")
+	}
+	switch c.runtime() {
+	case ContainerRuntimeDocker:
+	case ContainerRuntimeSingularity:
+		if c.User != "" {
+			return fmt.Errorf("container user can't be set for %s", ContainerRuntimeSingularity)
+		}
+	default:
+		return fmt.Errorf("container runtime [%s] is not one of %s or %s", c.Runtime, ContainerRuntimeDocker, ContainerRuntimeSingularity)
+	}
+	for _, mount := range c.Mounts {
+		if _, _, _, err := parseContainerMount(mount); err != nil {
+			return err
+		}
+	}
+	for _, name := range c.Env {
+		if !validEnvName.MatchString(name) {
+			return fmt.Errorf("container env [%s] is not a valid environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// runtime returns our Runtime, defaulting to docker.
+func (c Container) runtime() string {
+	if c.Runtime == "" {
+		return ContainerRuntimeDocker
+	}
+	return c.Runtime
+}
+
+// parseContainerMount parses a "/host/path[:/container/path][:ro]" mount.
+func parseContainerMount(mount string) (src, dst string, ro bool, err error) {
+	parts := strings.Split(mount, ":")
+	if n := len(parts); n > 1 && (parts[n-1] == "ro" || parts[n-1] == "rw") {
+		ro = parts[n-1] == "ro"
+		parts = parts[:n-1]
+	}
+	if len(parts) > 2 || !filepath.IsAbs(parts[0]) || (len(parts) == 2 && !filepath.IsAbs(parts[1])) {
+		return "", "", false, fmt.Errorf("container mount [%s] is not like /host/path[:/container/path][:ro]", mount)
+	}
+	src, dst = parts[0], parts[0]
+	if len(parts) == 2 {
+		dst = parts[1]
+	}
+	return src, dst, ro, nil
+}
+
+// containerRun is what Execute() needs to run a particular Job's Cmd in its
+// Container.
+type containerRun struct {
+	Container
+	name    string // the name we give a docker container
+	dir     string // holds the docker cidfile or pulled singularity image
+	image   string // the image to run, once pulled
+	cgroups []string
+}
+
+// newContainerRun makes a containerRun for the given Job's Container.
+func newContainerRun(job *Job) (*containerRun, error) {
+	dir, err := ioutil.TempDir("", "wr_container")
+	if err != nil {
+		return nil, err
+	}
+	return &containerRun{
+		Container: job.Container,
+		name:      fmt.Sprintf("wr_%s_%d", job.key(), os.Getpid()),
+		dir:       dir,
+		image:     job.Container.Image,
+	}, nil
+}
+
+// pull makes sure the image is available locally, downloading it if
+// necessary.
+func (cr *containerRun) pull() error {
+	if cr.runtime() == ContainerRuntimeSingularity {
+		if _, err := os.Stat(cr.Image); err == nil {
+			return nil
+		}
+		cr.image = filepath.Join(cr.dir, "image.sif")
+		return runContainerCmd(ContainerRuntimeSingularity, "pull", cr.image, cr.Image)
+	}
+	if runContainerCmd(ContainerRuntimeDocker, "image", "inspect", cr.Image) == nil {
+		return nil
+	}
+	return runContainerCmd(ContainerRuntimeDocker, "pull", cr.Image)
+}
+
+// runContainerCmd runs the given container runtime command, returning an error
+// that includes (the head and tail of) its output if it fails.
+func runContainerCmd(args ...string) error {
+	cmd := exec.Command(args[0], args[1:]...) // #nosec the image comes from the user
+	out := &prefixSuffixSaver{N: 4096}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("[%s] failed: %s\n%s", strings.Join(args, " "), err, out.Bytes())
+	}
+	return nil
+}
+
+// wrap alters cmd (made by shellCommand()) so that it runs cmdLine with shell
+// inside the container, with workDir (which contains cmd.Dir) and the runner's
+// facilities in cmd.Env mounted, and the given environment variable names
+// passed through.
+func (cr *containerRun) wrap(cmd *exec.Cmd, shell, cmdLine, workDir string, passEnv []string) {
+	var args []string
+	facilities := facilityPaths(cmd.Env, workDir)
+	if cr.runtime() == ContainerRuntimeSingularity {
+		args = []string{ContainerRuntimeSingularity, "exec", "--cleanenv", "--pwd", cmd.Dir, "--bind", workDir}
+		for _, mount := range cr.Mounts {
+			src, dst, ro, _ := parseContainerMount(mount) // #nosec Validate()d
+			if ro {
+				dst += ":ro"
+			}
+			args = append(args, "--bind", src+":"+dst)
+		}
+		for _, path := range facilities {
+			args = append(args, "--bind", path)
+		}
+
+		// singularity passes through SINGULARITYENV_ prefixed variables
+		// without the prefix
+		values := envValues(cmd.Env)
+		for _, name := range passEnv {
+			if value, set := values[name]; set {
+				cmd.Env = envOverride(cmd.Env, []string{"SINGULARITYENV_" + name + "=" + value})
+			}
+		}
+	} else {
+		user := cr.User
+		if user == "" {
+			user = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+		}
+		args = []string{ContainerRuntimeDocker, "run", "--rm", "--name", cr.name, "--cidfile", cr.cidFile(),
+			"--user", user, "-w", cmd.Dir, "-v", workDir + ":" + workDir}
+		for _, mount := range cr.Mounts {
+			src, dst, ro, _ := parseContainerMount(mount) // #nosec Validate()d
+			if ro {
+				dst += ":ro"
+			}
+			args = append(args, "-v", src+":"+dst)
+		}
+		for _, path := range facilities {
+			args = append(args, "-v", path+":"+path)
+		}
+
+		// docker takes the values of -e variables without values from its own
+		// environment, keeping them off the command line
+		values := envValues(cmd.Env)
+		for _, name := range passEnv {
+			if _, set := values[name]; set {
+				args = append(args, "-e", name)
+			}
+		}
+	}
+	args = append(args, cr.image, shell, "-c", cmdLine)
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		path = args[0]
+	}
+	cmd.Path = path
+	cmd.Args = args
+}
+
+// facilityPaths returns the paths that must be mounted in a container for its
+// Cmd to use the WR_OUTPUTS_SOCKET, WR_METADATA_SOCKET and WR_METRICS_FILE set
+// in env: the directories of the sockets, and the metrics file itself. Paths
+// within workDir are left out, since that gets mounted anyway.
+func facilityPaths(env []string, workDir string) []string {
+	values := envValues(env)
+	var paths []string
+	for _, name := range []string{JobOutputsSocketEnvVar, JobMetadataSocketEnvVar, MetricsFileEnvVar} {
+		path := values[name]
+		if path == "" {
+			continue
+		}
+		if name != MetricsFileEnvVar {
+			path = filepath.Dir(path)
+		}
+		if strings.HasPrefix(path, workDir+string(filepath.Separator)) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// envValues returns the given environment variables keyed by name.
+func envValues(env []string) map[string]string {
+	values := make(map[string]string, len(env))
+	for _, envvar := range env {
+		pair := strings.SplitN(envvar, "=", 2)
+		if len(pair) == 2 {
+			values[pair[0]] = pair[1]
+		}
+	}
+	return values
+}
+
+// containerPassEnv returns the names of the environment variables in env that
+// should be passed through to the given Job's container: those the Container
+// asks for, the Job's Secrets, TMPDIR, HOME if the Job changes it, and our
+// WR_* variables.
+func containerPassEnv(job *Job, env []string) []string {
+	names := append([]string{}, job.Container.Env...)
+	names = append(names, job.Secrets...)
+	names = append(names, "TMPDIR")
+	if job.ChangeHome {
+		names = append(names, "HOME")
+	}
+	for name := range envValues(env) {
+		if strings.HasPrefix(name, "WR_") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// cidFile is where docker writes the id of our container.
+func (cr *containerRun) cidFile() string {
+	return filepath.Join(cr.dir, "cid")
+}
+
+// memory returns the peak MB of memory used by our docker container so far,
+// according to its cgroup. Singularity containers don't have their own cgroup;
+// their processes are simply part of the Cmd's process group.
+func (cr *containerRun) memory() (int, error) {
+	if cr.runtime() != ContainerRuntimeDocker {
+		return 0, nil
+	}
+	if len(cr.cgroups) == 0 {
+		id, err := ioutil.ReadFile(cr.cidFile())
+		if err != nil || len(id) == 0 {
+			return 0, fmt.Errorf("container not yet created")
+		}
+		cr.cgroups = containerCgroupMemoryFiles(strings.TrimSpace(string(id)))
+	}
+	return cgroupMemory(cr.cgroups)
+}
+
+// kill kills cmd's process group, and for docker, the container, which
+// doesn't die with the docker client.
+func (cr *containerRun) kill(cmd *exec.Cmd) error {
+	err := killProcessGroup(cmd)
+	if cr.runtime() == ContainerRuntimeDocker {
+		// (the container may have already exited)
+		exec.Command(ContainerRuntimeDocker, "kill", cr.name).Run() // #nosec
+	}
+	return err
+}
+
+// cleanup removes our cidfile or pulled image.
+func (cr *containerRun) cleanup() error {
+	return os.RemoveAll(cr.dir)
+}
+
+// prepareContainer creates a containerRun for the given Job and pulls its
+// image, touching the Job while we wait so that long pulls don't result in the
+// server thinking we've died.
+func (c *Client) prepareContainer(job *Job) (*containerRun, error) {
+	cr, err := newContainerRun(job)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- cr.pull()
+	}()
+	ticker := time.NewTicker(ClientTouchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-errs:
+			if err != nil {
+				cr.cleanup() // #nosec the pull error is more important
+				return nil, err
+			}
+			return cr, nil
+		case <-ticker.C:
+			c.touch(job) // #nosec if this fails, the next one might work
+		}
+	}
+}
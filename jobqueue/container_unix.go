@@ -0,0 +1,74 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package jobqueue
+
+// This file contains the unix-specific code for finding out how much memory a
+// docker container has used, via its cgroup.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// containerCgroupMemoryFiles returns the files that may record the peak (or
+// failing that, current) memory usage in bytes of the docker container with
+// the given id, for cgroup v2 and v1 and for both the systemd and cgroupfs
+// cgroup drivers, most useful first. Only those that exist are returned.
+func containerCgroupMemoryFiles(id string) []string {
+	dirs := []string{
+		filepath.Join(cgroupRoot, "system.slice", "docker-"+id+".scope"),
+		filepath.Join(cgroupRoot, "docker", id),
+		filepath.Join(cgroupRoot, "memory", "system.slice", "docker-"+id+".scope"),
+		filepath.Join(cgroupRoot, "memory", "docker", id),
+	}
+	files := []string{}
+	for _, dir := range dirs {
+		for _, base := range []string{"memory.peak", "memory.max_usage_in_bytes", "memory.current", "memory.usage_in_bytes"} {
+			path := filepath.Join(dir, base)
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			}
+		}
+	}
+	return files
+}
+
+// cgroupMemory returns the MB of memory recorded in the first of the given
+// cgroup files that can be read.
+func cgroupMemory(files []string) (int, error) {
+	for _, path := range files {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		bytes, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			continue
+		}
+		return int(bytes / 1024 / 1024), nil
+	}
+	return 0, fmt.Errorf("no cgroup memory usage could be read")
+}
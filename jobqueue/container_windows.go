@@ -0,0 +1,34 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the Windows-specific code for finding out how much memory
+// a docker container has used; we can't, so never find anything.
+
+import "fmt"
+
+// containerCgroupMemoryFiles returns nothing on Windows.
+func containerCgroupMemoryFiles(id string) []string {
+	return []string{}
+}
+
+// cgroupMemory always returns an error on Windows.
+func cgroupMemory(files []string) (int, error) {
+	return 0, fmt.Errorf("cgroup memory usage is not available on Windows")
+}
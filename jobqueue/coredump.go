@@ -0,0 +1,186 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for collecting the core dumps of Cmds.
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// ClientCoreDumpLimit is the maximum size of core dump Cmds are allowed to
+// produce when Job.CoreDumps is set, unless Job.ProcessLimits.Core says
+// otherwise.
+var ClientCoreDumpLimit = "2G"
+
+// coreDumpDir is the directory name, relative to the Job's Cwd, that core dumps
+// are collected in if Job.CoreDest isn't set.
+const coreDumpDir = "wr_cores"
+
+// processLimits returns the ProcessLimits the Job's Cmd should run with, which
+// are its ProcessLimits with the core size raised if CoreDumps is set.
+func (j *Job) processLimits() ProcessLimits {
+	pl := j.ProcessLimits
+	if j.CoreDumps && pl.Core == "" {
+		pl.Core = ClientCoreDumpLimit
+	}
+	return pl
+}
+
+// findCoreDumps returns the paths of any files in dir modified since the given
+// time that look like core dumps, as named by the common kernel.core_pattern
+// settings of "core" and "core.<pid>".
+func findCoreDumps(dir string, since time.Time) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var cores []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !(name == "core" || strings.HasPrefix(name, "core.")) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(since.Truncate(time.Second)) {
+			continue
+		}
+		cores = append(cores, filepath.Join(dir, name))
+	}
+	return cores
+}
+
+// collectCoreDump looks in dir for a core dump left behind by the Job's Cmd
+// (which started at the given time), and if found gzips it in to the Job's CoreDest (or a wr_cores directory in
+// its Cwd), deleting the original. Returns the location of the compressed
+// core, or an empty string if there wasn't one.
+func collectCoreDump(j *Job, dir string, started time.Time) (string, error) {
+	cores := findCoreDumps(dir, started)
+	if len(cores) == 0 {
+		return "", nil
+	}
+
+	// if the Cmd dumped more than once (eg. from child processes), we keep the
+	// last, which is most likely the one that took the Cmd down
+	var core string
+	var newest time.Time
+	for _, path := range cores {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if core == "" || info.ModTime().After(newest) {
+			core = path
+			newest = info.ModTime()
+		}
+	}
+	if core == "" {
+		return "", nil
+	}
+
+	name := fmt.Sprintf("core.%s.%d.gz", j.key(), time.Now().Unix())
+	dest := j.CoreDest
+	if dest == "" {
+		dest = filepath.Join(j.Cwd, coreDumpDir)
+	}
+
+	var location string
+	var destDir string
+	var fs remoteMount
+	if internal.InS3(dest) {
+		path := strings.TrimPrefix(dest, internal.S3Prefix)
+		pp := strings.Split(path, "@")
+		profile := "default"
+		if len(pp) == 2 {
+			profile = pp[0]
+			path = pp[1]
+		}
+
+		var err error
+		destDir, err = os.MkdirTemp("", "wr_core_mount")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(destDir) // #nosec nothing we can do about failure here
+
+		fs, err = mountS3Backup(profile, strings.TrimSuffix(path, "/"), destDir)
+		if err != nil {
+			return "", err
+		}
+		location = strings.TrimSuffix(dest, "/") + "/" + name
+	} else {
+		destDir = dest
+		err := os.MkdirAll(destDir, 0700)
+		if err != nil {
+			return "", err
+		}
+		location = filepath.Join(destDir, name)
+	}
+
+	err := gzipFile(core, filepath.Join(destDir, name))
+	if fs != nil {
+		if erru := fs.Unmount(); erru != nil && err == nil {
+			err = erru
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range cores {
+		err = os.Remove(path)
+		if err != nil {
+			return location, err
+		}
+	}
+
+	return location, nil
+}
+
+// gzipFile writes a gzip compressed copy of the file at source to dest.
+func gzipFile(source, dest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // #nosec we only read from it
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if errc := zw.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if errc := out.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
@@ -36,11 +36,11 @@ import (
 	"sync"
 	"time"
 
-	"github.com/VertebrateResequencing/muxfys"
 	"github.com/VertebrateResequencing/wr/internal"
 	bolt "github.com/coreos/bbolt"
 	"github.com/hashicorp/golang-lru"
 	"github.com/inconshreveable/log15"
+	"github.com/satori/go.uuid"
 	"github.com/ugorji/go/codec"
 )
 
@@ -49,28 +49,39 @@ const (
 	jobStatWindowPercent      = float32(5)
 	dbFilePermission          = 0600
 	minimumTimeBetweenBackups = 30 * time.Second
+	dbSingleTxLimit           = 50000
 )
 
 var (
-	bucketJobsLive     = []byte("jobslive")
-	bucketJobsComplete = []byte("jobscomplete")
-	bucketRTK          = []byte("repgroupToKey")
-	bucketDTK          = []byte("depgroupToKey")
-	bucketRDTK         = []byte("reverseDepgroupToKey")
-	bucketEnvs         = []byte("envs")
-	bucketStdO         = []byte("stdo")
-	bucketStdE         = []byte("stde")
-	bucketJobMBs       = []byte("jobMBs")
-	bucketJobSecs      = []byte("jobSecs")
-	wipeDevDBOnInit    = true
-	forceBackups       = false
+	bucketJobsLive          = []byte("jobslive")
+	bucketJobsComplete      = []byte("jobscomplete")
+	bucketRTK               = []byte("repgroupToKey")
+	bucketDTK               = []byte("depgroupToKey")
+	bucketRDTK              = []byte("reverseDepgroupToKey")
+	bucketEnvs              = []byte("envs")
+	bucketStdO              = []byte("stdo")
+	bucketStdE              = []byte("stde")
+	bucketJobMBs            = []byte("jobMBs")
+	bucketJobSecs           = []byte("jobSecs")
+	bucketJobDisk           = []byte("jobDisk")
+	bucketSecrets           = []byte("secrets")
+	bucketJobsRunning       = []byte("jobsRunning")
+	bucketJobsTrash         = []byte("jobsTrash")
+	bucketEnvProfiles       = []byte("envProfiles")
+	bucketReqGroupOverrides = []byte("reqGroupOverrides")
+	bucketRepGroupDefaults  = []byte("repGroupDefaults")
+	bucketTimeline          = []byte("timeline")
+	bucketLimitGroups       = []byte("limitGroups")
+	wipeDevDBOnInit         = true
+	forceBackups            = false
 )
 
 // Rec* variables are only exported for testing purposes (*** though they should
 // probably be user configurable somewhere...).
 var (
-	RecMBRound  = 100  // when we recommend amount of memory to reserve for a job, we round up to the nearest RecMBRound MBs
-	RecSecRound = 1800 // when we recommend time to reserve for a job, we round up to the nearest RecSecRound seconds
+	RecMBRound   = 100  // when we recommend amount of memory to reserve for a job, we round up to the nearest RecMBRound MBs
+	RecSecRound  = 1800 // when we recommend time to reserve for a job, we round up to the nearest RecSecRound seconds
+	RecDiskRound = 1024 // when we recommend disk to reserve for a job, we round up to the nearest RecDiskRound MBs
 )
 
 // sobsd ('slice of byte slice doublets') implements sort interface so we can
@@ -98,16 +109,18 @@ type db struct {
 	backupFinal        bool
 	backupStopWait     chan bool
 	backupLast         time.Time
-	backupMount        *muxfys.MuxFys
+	backupMount        remoteMount
 	backupNotification chan bool
 	backupPath         string
 	backupQueued       bool
 	backupWait         time.Duration
 	backupsEnabled     bool
+	backupFileMutex    sync.Mutex
 	bolt               *bolt.DB
 	ch                 codec.Handle
 	closed             bool
 	envcache           *lru.ARCCache
+	journal            *dbJournal
 	slowBackups        bool // just for testing purposes
 	sync.RWMutex
 	updatingAfterJobExit int
@@ -130,7 +143,7 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 
 	var backupsEnabled bool
 	bkPath := dbBkFile
-	var fs *muxfys.MuxFys
+	var fs remoteMount
 	if deployment == internal.Production || forceBackups {
 		backupsEnabled = true
 		if internal.InS3(dbBkFile) {
@@ -150,31 +163,11 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 			mnt := filepath.Join(filepath.Dir(dbFile), ".db_bk_mount", path)
 			bkPath = filepath.Join(mnt, base)
 
-			accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
+			var err error
+			fs, err = mountS3Backup(profile, path, mnt)
 			if err != nil {
 				return nil, "", err
 			}
-			accessor, err := muxfys.NewS3Accessor(accessorConfig)
-			if err != nil {
-				return nil, "", err
-			}
-			remoteConfig := &muxfys.RemoteConfig{
-				Accessor: accessor,
-				Write:    true,
-			}
-			cfg := &muxfys.Config{
-				Mount:   mnt,
-				Retries: 10,
-			}
-			fs, err = muxfys.New(cfg)
-			if err != nil {
-				return nil, "", err
-			}
-			err = fs.Mount(remoteConfig)
-			if err != nil {
-				return nil, "", err
-			}
-			fs.UnmountOnDeath()
 		}
 	}
 
@@ -187,6 +180,10 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		if errr != nil && !os.IsNotExist(errr) {
 			l.Warn("Failed to remove database backup file", "path", bkPath, "err", errr)
 		}
+		errr = os.Remove(dbFile + dbJournalSuffix)
+		if errr != nil && !os.IsNotExist(errr) {
+			l.Warn("Failed to remove database journal file", "path", dbFile+dbJournalSuffix, "err", errr)
+		}
 	}
 
 	var boltdb *bolt.DB
@@ -273,6 +270,42 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		if errf != nil {
 			return fmt.Errorf("create bucket %s: %s", bucketJobSecs, errf)
 		}
+		_, errf = tx.CreateBucketIfNotExists(bucketJobDisk)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketJobDisk, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketSecrets)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketSecrets, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketJobsRunning)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketJobsRunning, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketJobsTrash)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketJobsTrash, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketEnvProfiles)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketEnvProfiles, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketReqGroupOverrides)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketReqGroupOverrides, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketRepGroupDefaults)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketRepGroupDefaults, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketTimeline)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketTimeline, errf)
+		}
+		_, errf = tx.CreateBucketIfNotExists(bucketLimitGroups)
+		if errf != nil {
+			return fmt.Errorf("create bucket %s: %s", bucketLimitGroups, errf)
+		}
 		return nil
 	})
 	if err != nil {
@@ -285,10 +318,18 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		return nil, msg, err
 	}
 
+	// state changes of jobs are journalled and applied to the db in batches
+	ch := new(codec.BincHandle)
+	journal, err := openJournal(dbFile+dbJournalSuffix, boltdb, ch, l)
+	if err != nil {
+		return nil, msg, err
+	}
+
 	dbstruct := &db{
 		bolt:               boltdb,
 		envcache:           envcache,
-		ch:                 new(codec.BincHandle),
+		journal:            journal,
+		ch:                 ch,
 		backupsEnabled:     backupsEnabled,
 		backupPath:         bkPath,
 		backupNotification: make(chan bool),
@@ -334,16 +375,26 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 	depGroups := make(map[string]bool)
 	newJobKeys := make(map[string]bool)
 	var keptJobs []*Job
-	for _, job := range jobs {
-		keyStr := job.key()
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.key()
+	}
+
+	// rather than look up each job in its own transaction, find all the ones
+	// already in the db in one go
+	var inDB map[string]bool
+	if ignoreAdded {
+		inDB, err = db.checkIfAddedBatch(keys)
+		if err != nil {
+			return jobsToQueue, jobsToUpdate, alreadyAdded, err
+		}
+	}
+
+	for i, job := range jobs {
+		keyStr := keys[i]
 
 		if ignoreAdded {
-			var added bool
-			added, err = db.checkIfAdded(keyStr)
-			if err != nil {
-				return jobsToQueue, jobsToUpdate, alreadyAdded, err
-			}
-			if added {
+			if inDB[keyStr] {
 				alreadyAdded++
 				continue
 			}
@@ -413,7 +464,9 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 			jobsToQueue = keptJobs
 		}
 
-		// now go ahead and store the lookups and jobs
+		// now go ahead and store the lookups and jobs; clients adding large
+		// numbers of jobs can send them already sorted by key, in which case
+		// we avoid sorting the jobs again
 		numStores := 2
 		if len(dgLookups) > 0 {
 			numStores++
@@ -426,7 +479,9 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 		db.wg.Add(1)
 		go func() {
 			defer db.wg.Done()
-			sort.Sort(rgLookups)
+			if !sort.IsSorted(rgLookups) {
+				sort.Sort(rgLookups)
+			}
 			errors <- db.storeBatched(bucketRTK, rgLookups, db.storeLookups)
 		}()
 
@@ -434,7 +489,9 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 			db.wg.Add(1)
 			go func() {
 				defer db.wg.Done()
-				sort.Sort(dgLookups)
+				if !sort.IsSorted(dgLookups) {
+					sort.Sort(dgLookups)
+				}
 				errors <- db.storeBatched(bucketDTK, dgLookups, db.storeLookups)
 			}()
 		}
@@ -443,7 +500,9 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 			db.wg.Add(1)
 			go func() {
 				defer db.wg.Done()
-				sort.Sort(rdgLookups)
+				if !sort.IsSorted(rdgLookups) {
+					sort.Sort(rdgLookups)
+				}
 				errors <- db.storeBatched(bucketRDTK, rdgLookups, db.storeLookups)
 			}()
 		}
@@ -451,7 +510,9 @@ func (db *db) storeNewJobs(jobs []*Job, ignoreAdded bool) (jobsToQueue []*Job, j
 		db.wg.Add(1)
 		go func() {
 			defer db.wg.Done()
-			sort.Sort(encodedJobs)
+			if !sort.IsSorted(encodedJobs) {
+				sort.Sort(encodedJobs)
+			}
 			errors <- db.storeBatched(bucketJobsLive, encodedJobs, db.storeEncodedJobs)
 		}()
 
@@ -495,7 +556,7 @@ func (db *db) generateLookupKey(prefix string, jobKey []byte) []byte {
 // bucket.
 func (db *db) checkIfLive(key string) (bool, error) {
 	var isLive bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		if newJobBucket.Get([]byte(key)) != nil {
 			isLive = true
@@ -505,19 +566,27 @@ func (db *db) checkIfLive(key string) (bool, error) {
 	return isLive, err
 }
 
-// checkIfAdded tells you if a job with the given key is currently in the
-// complete bucket or the live bucket.
-func (db *db) checkIfAdded(key string) (bool, error) {
-	var isInDB bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+// checkIfAddedBatch tells you which of the jobs with the given keys are
+// currently in the complete bucket or the live bucket. The keys are all looked
+// up (in sorted order) in a single transaction, and the returned map has true
+// values for the keys that were found.
+func (db *db) checkIfAddedBatch(keys []string) (map[string]bool, error) {
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	inDB := make(map[string]bool)
+	err := db.view(func(tx *bolt.Tx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		if newJobBucket.Get([]byte(key)) != nil || completeJobBucket.Get([]byte(key)) != nil {
-			isInDB = true
+		for _, key := range sorted {
+			bkey := []byte(key)
+			if newJobBucket.Get(bkey) != nil || completeJobBucket.Get(bkey) != nil {
+				inDB[key] = true
+			}
 		}
 		return nil
 	})
-	return isInDB, err
+	return inDB, err
 }
 
 // archiveJob deletes a job from the live bucket, and adds a new version of it
@@ -529,49 +598,20 @@ func (db *db) checkIfAdded(key string) (bool, error) {
 // The key you supply must be the key of the job you supply, or bad things will
 // happen - no checking is done! A backgroundBackup() is triggered afterwards.
 func (db *db) archiveJob(key string, job *Job) error {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
-	job.RLock()
-	err := enc.Encode(job)
-	job.RUnlock()
+	encoded, err := db.encodeJob(job)
 	if err != nil {
 		return err
 	}
 
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(key)
-		errf := bo.Delete(key)
-		if errf != nil {
-			return errf
-		}
-		errf = be.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b := tx.Bucket(bucketJobsLive)
-		errf = b.Delete(key)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobsComplete)
-		errf = b.Put(key, encoded)
-		if errf != nil {
-			return errf
-		}
-
-		b = tx.Bucket(bucketJobMBs)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakRAM)), []byte(strconv.Itoa(job.PeakRAM)))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobSecs)
-		secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-		return b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
-	})
+	bkey := []byte(key)
+	ops := []*dbOp{
+		{Bucket: bucketStdO, Key: bkey, Delete: true},
+		{Bucket: bucketStdE, Key: bkey, Delete: true},
+		{Bucket: bucketJobsLive, Key: bkey, Delete: true},
+		{Bucket: bucketJobsRunning, Key: bkey, Delete: true},
+		{Bucket: bucketJobsComplete, Key: bkey, Val: encoded},
+	}
+	err = db.record(append(ops, jobStatOps(job)...)...)
 
 	db.backgroundBackup()
 
@@ -586,14 +626,36 @@ func (db *db) deleteLiveJob(key string) {
 	//*** we're not removing the lookup entries from the bucket*TK buckets...
 }
 
+// updateLiveJobs re-stores the given jobs in the live bucket, for use when a
+// user has changed properties of incomplete jobs (such as their Labels) that
+// should survive a restart.
+func (db *db) updateLiveJobs(jobs []*Job) error {
+	var encodedJobs sobsd
+	for _, job := range jobs {
+		encoded, err := db.encodeJob(job)
+		if err != nil {
+			return err
+		}
+		job.RLock()
+		key := []byte(job.key())
+		job.RUnlock()
+		encodedJobs = append(encodedJobs, [2][]byte{key, encoded})
+	}
+	sort.Sort(encodedJobs)
+	err := db.storeBatched(bucketJobsLive, encodedJobs, db.storeEncodedJobs)
+	db.backgroundBackup()
+	return err
+}
+
 // recoverIncompleteJobs returns all jobs in the live bucket, for use when
 // restarting the server, allowing you start working on any jobs that were
 // stored with storeNewJobs() but not yet archived with archiveJob(). Note that
 // any state changes to the Jobs that may have occurred will be lost: you get
-// back the Jobs exactly as they were when you put them in with storeNewJobs().
+// back the Jobs exactly as they were when you put them in with storeNewJobs()
+// (or last updateLiveJobs()).
 func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketJobsLive)
 		return b.ForEach(func(_, encoded []byte) error {
 			if encoded != nil {
@@ -611,11 +673,45 @@ func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 	return jobs, err
 }
 
+// storeRunningJob records that the job with the given key has started running
+// in the given client's process with the given pid, so that if we're restarted
+// while it's still running, the client can re-attach to it. The record is
+// removed by archiveJob() and updateJobAfterExit().
+func (db *db) storeRunningJob(key string, clientID uuid.UUID, pid int) error {
+	return db.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte(key), Val: []byte(fmt.Sprintf("%s%s%d", clientID, dbDelimiter, pid))})
+}
+
+// retrieveRunningJobs returns what was stored with storeRunningJob() for all
+// the jobs that were still running when we last stopped, keyed on job key.
+func (db *db) retrieveRunningJobs() (map[string]*runningJob, error) {
+	rjs := make(map[string]*runningJob)
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobsRunning)
+		return b.ForEach(func(key, val []byte) error {
+			parts := strings.Split(string(val), dbDelimiter)
+			if len(parts) != 2 {
+				return nil
+			}
+			clientID, errf := uuid.FromString(parts[0])
+			if errf != nil {
+				return nil
+			}
+			pid, errf := strconv.Atoi(parts[1])
+			if errf != nil {
+				return nil
+			}
+			rjs[string(key)] = &runningJob{clientID: clientID, pid: pid}
+			return nil
+		})
+	})
+	return rjs, err
+}
+
 // retrieveCompleteJobsByKeys gets jobs with the given keys from the completed
 // jobs bucket (ie. those that have gone through the queue and been Remove()d).
 func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketJobsComplete)
 		for _, key := range keys {
 			encoded := b.Get([]byte(key))
@@ -639,7 +735,7 @@ func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 // re-run).
 func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
 		lookupBucket := tx.Bucket(bucketRTK).Cursor()
@@ -662,6 +758,50 @@ func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
 	return jobs, err
 }
 
+// retrieveCompleteJobsByRepGroupTree is like retrieveCompleteJobsByRepGroup(),
+// but also gets the jobs in all the RepGroups below the given one in the
+// hierarchy. The returned jobs have their RepGroup set to the one they were
+// found under.
+func (db *db) retrieveCompleteJobsByRepGroupTree(parent string) ([]*Job, error) {
+	var jobs []*Job
+	seen := make(map[string]bool)
+	err := db.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		lookupBucket := tx.Bucket(bucketRTK).Cursor()
+		prefix := []byte(parent)
+		delimiter := []byte(dbDelimiter)
+		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+			i := bytes.Index(k, delimiter)
+			if i == -1 {
+				continue
+			}
+			repGroup := string(k[:i])
+			if !repGroupIsUnder(repGroup, parent) {
+				continue
+			}
+			key := k[i+len(delimiter):]
+			if seen[string(key)] {
+				continue
+			}
+			encoded := completeJobBucket.Get(key)
+			if len(encoded) > 0 && newJobBucket.Get(key) == nil {
+				dec := codec.NewDecoderBytes(encoded, db.ch)
+				job := &Job{}
+				err := dec.Decode(job)
+				if err != nil {
+					return err
+				}
+				job.RepGroup = repGroup
+				seen[string(key)] = true
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
 // retrieveDependentJobs gets previously stored jobs that had a dependency on
 // one for the input depGroups. If the job is found in the live bucket, then it
 // is returned in the jobsToUpdate return value. If it is found in the complete
@@ -675,7 +815,7 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 	}
 	sort.Sort(prefixes)
 
-	err = db.bolt.View(func(tx *bolt.Tx) error {
+	err = db.view(func(tx *bolt.Tx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		completeJobBucket := tx.Bucket(bucketJobsComplete)
 		lookupBucket := tx.Bucket(bucketRDTK).Cursor()
@@ -748,7 +888,7 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 // Archive()d - even if they've been added and archived in the past).
 func (db *db) retrieveIncompleteJobKeysByDepGroup(depgroup string) ([]string, error) {
 	var jobKeys []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		newJobBucket := tx.Bucket(bucketJobsLive)
 		lookupBucket := tx.Bucket(bucketDTK).Cursor()
 		prefix := []byte(depgroup + dbDelimiter)
@@ -790,9 +930,48 @@ func (db *db) retrieveEnv(envkey string) []byte {
 	return envc
 }
 
-// updateJobAfterExit stores the Job's peak RAM usage and wall time against the
-// Job's ReqGroup, allowing recommendedReqGroup*(ReqGroup) to work. It also
-// updates the stdout/err associated with a job.
+// storeSecret stores an (already encrypted) secret under the given name.
+func (db *db) storeSecret(name string, encrypted []byte) error {
+	return db.store(bucketSecrets, name, encrypted)
+}
+
+// retrieveSecret gets a value stored with storeSecret(). Returns nil if there
+// is no secret with the given name.
+func (db *db) retrieveSecret(name string) []byte {
+	return db.retrieve(bucketSecrets, name)
+}
+
+// deleteSecret removes a secret stored with storeSecret(), returning false if
+// there was no such secret.
+func (db *db) deleteSecret(name string) (bool, error) {
+	var existed bool
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSecrets)
+		if b.Get([]byte(name)) == nil {
+			return nil
+		}
+		existed = true
+		return b.Delete([]byte(name))
+	})
+	return existed, err
+}
+
+// retrieveSecretNames returns the names of all stored secrets.
+func (db *db) retrieveSecretNames() ([]string, error) {
+	var names []string
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSecrets)
+		return b.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// updateJobAfterExit stores the Job's peak RAM usage, wall time and peak disk
+// usage against the Job's ReqGroup, allowing recommendedReqGroup*(ReqGroup) to
+// work. It also updates the stdout/err associated with a job.
 //
 // We don't want to store these in the job, since that would waste a lot of the
 // queue's memory; we store in db instead, and only retrieve when a client needs
@@ -812,11 +991,9 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 	}
 	jobkey := job.key()
 	job.RLock()
-	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-	jrg := job.ReqGroup
-	jpm := job.PeakRAM
 	jec := job.Exitcode
 	job.RUnlock()
+	statOps := jobStatOps(job)
 	db.wg.Add(1)
 	go func() {
 		defer internal.LogPanic(db.Logger, "updateJobAfterExit", true)
@@ -825,39 +1002,21 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 		db.Lock()
 		db.updatingAfterJobExit++
 		db.Unlock()
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			bo := tx.Bucket(bucketStdO)
-			be := tx.Bucket(bucketStdE)
-			key := []byte(jobkey)
-			errf := bo.Delete(key)
-			if errf != nil {
-				return errf
-			}
-			errf = be.Delete(key)
-			if errf != nil {
-				return errf
-			}
-
-			if jec != 0 || forceStorage {
-				if len(stdo) > 0 {
-					errf = bo.Put(key, stdo)
-				}
-				if len(stde) > 0 {
-					errf = be.Put(key, stde)
-				}
-			}
-			if errf != nil {
-				return errf
+		key := []byte(jobkey)
+		ops := []*dbOp{
+			{Bucket: bucketStdO, Key: key, Delete: true},
+			{Bucket: bucketStdE, Key: key, Delete: true},
+			{Bucket: bucketJobsRunning, Key: key, Delete: true},
+		}
+		if jec != 0 || forceStorage {
+			if len(stdo) > 0 {
+				ops = append(ops, &dbOp{Bucket: bucketStdO, Key: key, Val: stdo})
 			}
-
-			b := tx.Bucket(bucketJobMBs)
-			errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpm)), []byte(strconv.Itoa(jpm)))
-			if errf != nil {
-				return errf
+			if len(stde) > 0 {
+				ops = append(ops, &dbOp{Bucket: bucketStdE, Key: key, Val: stde})
 			}
-			b = tx.Bucket(bucketJobSecs)
-			return b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
-		})
+		}
+		err := db.record(append(ops, statOps...)...)
 		if err != nil {
 			db.Error("Database operation updateJobAfterExit failed", "err", err)
 		}
@@ -867,6 +1026,29 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 	}()
 }
 
+// jobStatOps returns the dbOps that store the given Job's peak RAM usage, wall
+// time and (if it was measured) peak disk usage against its ReqGroup.
+func jobStatOps(job *Job) []*dbOp {
+	job.RLock()
+	defer job.RUnlock()
+	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
+	ops := []*dbOp{
+		{Bucket: bucketJobMBs, Key: jobStatKey(job.ReqGroup, job.PeakRAM), Val: []byte(strconv.Itoa(job.PeakRAM))},
+		{Bucket: bucketJobSecs, Key: jobStatKey(job.ReqGroup, secs), Val: []byte(strconv.Itoa(secs))},
+	}
+	if job.ActualCwd != "" && !job.CwdMatters {
+		ops = append(ops, &dbOp{Bucket: bucketJobDisk, Key: jobStatKey(job.ReqGroup, job.PeakDisk), Val: []byte(strconv.Itoa(job.PeakDisk))})
+	}
+	return ops
+}
+
+// jobStatKey returns the key that a stat of a job in the given ReqGroup is
+// stored under in one of the job stat buckets, such that the keys of a
+// ReqGroup sort by value.
+func jobStatKey(reqGroup string, stat int) []byte {
+	return []byte(fmt.Sprintf("%s%s%20d", reqGroup, dbDelimiter, stat))
+}
+
 // retrieveJobStd gets the values that were stored using updateJobStd() for the
 // given job.
 func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
@@ -883,7 +1065,7 @@ func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
 		<-time.After(10 * time.Millisecond)
 	}
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		bo := tx.Bucket(bucketStdO)
 		be := tx.Bucket(bucketStdE)
 		key := []byte(jobkey)
@@ -927,13 +1109,21 @@ func (db *db) recommendedReqGroupTime(reqGroup string) (int, error) {
 	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, RecSecRound)
 }
 
+// recommendedReqGroupDisk returns the 95th percentile peak disk usage (in MB)
+// of all jobs that previously ran with the given reqGroup and CwdMatters false,
+// in the same way as recommendedReqGroupMemory(), but rounded up to the
+// nearest GB. Returns 0 if there are no prior values.
+func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
+	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, RecDiskRound)
+}
+
 // recommendedReqGroupStat is the implementation for the other recommend*()
 // methods.
 func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundAmount int) (int, error) {
-	prefix := []byte(reqGroup)
+	prefix := []byte(reqGroup + dbDelimiter)
 	max := 0
 	var recommendation int
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		c := tx.Bucket(statBucket).Cursor()
 
 		// we seek over the bucket, and to avoid having to do it twice (first to
@@ -983,7 +1173,7 @@ func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundA
 
 // store does a basic set of a key/val in a given bucket
 func (db *db) store(bucket []byte, key string, val []byte) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.batch(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucket)
 		err := b.Put([]byte(key), val)
 		return err
@@ -995,7 +1185,7 @@ func (db *db) store(bucket []byte, key string, val []byte) error {
 // possible here.
 func (db *db) retrieve(bucket []byte, key string) []byte {
 	var val []byte
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucket)
 		v := b.Get([]byte(key))
 		if v != nil {
@@ -1018,7 +1208,7 @@ func (db *db) remove(bucket []byte, key string) {
 	db.wg.Add(1)
 	go func() {
 		defer db.wg.Done()
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
+		err := db.batch(func(tx *bolt.Tx) error {
 			b := tx.Bucket(bucket)
 			return b.Delete([]byte(key))
 		})
@@ -1031,9 +1221,15 @@ func (db *db) remove(bucket []byte, key string) {
 // storeBatched stores items in the db in batches for efficiency. bucket is the
 // name of the bucket to store in.
 func (db *db) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error {
-	// we want to add in batches of size data/10, minimum 1000, rounded to
-	// the nearest 1000
+	// a single transaction is fastest, up until the point that the memory
+	// needed to hold it becomes a problem
 	num := len(data)
+	if num <= dbSingleTxLimit {
+		return storer(bucket, data)
+	}
+
+	// otherwise we want to add in batches of size data/10, minimum 1000,
+	// rounded to the nearest 1000
 	batchSize := num / 10
 	rem := batchSize % 1000
 	if rem > 500 {
@@ -1072,7 +1268,7 @@ func (db *db) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error
 // storeLookups is a sobsdStorer for storing Job.[somevalue]->Job.Key() lookups
 // in the db.
 func (db *db) storeLookups(bucket []byte, lookups sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.batch(func(tx *bolt.Tx) error {
 		lookup := tx.Bucket(bucket)
 		for _, doublet := range lookups {
 			err := lookup.Put(doublet[0], nil)
@@ -1087,7 +1283,7 @@ func (db *db) storeLookups(bucket []byte, lookups sobsd) error {
 
 // storeEncodedJobs is a sobsdStorer for storing Jobs in the db.
 func (db *db) storeEncodedJobs(bucket []byte, encodes sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.batch(func(tx *bolt.Tx) error {
 		bjobs := tx.Bucket(bucket)
 		for _, doublet := range encodes {
 			err := bjobs.Put(doublet[0], doublet[1])
@@ -1124,10 +1320,21 @@ func (db *db) close() error {
 			db.Lock()
 		}
 
+		// apply everything that was journalled
+		if db.journal != nil {
+			errj := db.journal.close()
+			if errj != nil {
+				db.Error("Database journal could not be closed", "err", errj)
+			}
+		}
+
 		// do a final backup
 		if db.backupsEnabled && db.backupQueued {
 			db.Debug("Jobqueue database not backed up, will do final backup")
-			db.backupToBackupFile(false)
+			errb := db.backupToBackupFile(false)
+			if errb != nil {
+				db.Error("Database backup failed", "err", errb)
+			}
 		}
 
 		err := db.bolt.Close()
@@ -1188,7 +1395,10 @@ func (db *db) backgroundBackup() {
 		}
 
 		start := time.Now()
-		db.backupToBackupFile(slowBackups)
+		errb := db.backupToBackupFile(slowBackups)
+		if errb != nil {
+			db.Error("Database backup failed", "err", errb)
+		}
 
 		db.Lock()
 		db.backingUp = false
@@ -1218,9 +1428,21 @@ func (db *db) backgroundBackup() {
 	}(db.backupLast, db.backupWait, db.backupFinal)
 }
 
-// backupToBackupFile is used by backgroundBackup() and close() to do the actual
-// backup.
-func (db *db) backupToBackupFile(slowBackups bool) {
+// backupNow immediately backs up the database to the backup file (if backups
+// are enabled), waiting for the backup to complete and returning any error.
+func (db *db) backupNow() error {
+	db.RLock()
+	enabled := db.backupsEnabled && !db.closed
+	db.RUnlock()
+	if !enabled {
+		return nil
+	}
+	return db.backupToBackupFile(false)
+}
+
+// backupToBackupFile is used by backgroundBackup(), backupNow() and close() to
+// do the actual backup.
+func (db *db) backupToBackupFile(slowBackups bool) error {
 	// we most likely triggered this backup immediately following an operation
 	// that alters (the important parts of) the database; wait for those
 	// transactions to actually complete before backing up
@@ -1228,10 +1450,12 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 
 	db.wg.Add(1)
 	defer db.wg.Done()
+	db.backupFileMutex.Lock()
+	defer db.backupFileMutex.Unlock()
 
 	// create the new backup file with temp name
 	tmpBackupPath := db.backupPath + ".tmp"
-	err := db.bolt.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		return tx.CopyFile(tmpBackupPath, dbFilePermission)
 	})
 
@@ -1240,20 +1464,20 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 	}
 
 	if err != nil {
-		db.Error("Database backup failed", "err", err)
-
 		// if it failed, delete any partial file that got made
 		errr := os.Remove(tmpBackupPath)
 		if errr != nil && !os.IsNotExist(errr) {
 			db.Warn("Removing bad database backup file failed", "path", tmpBackupPath, "err", errr)
 		}
-	} else {
-		// backup succeeded, move it over any old backup
-		errr := os.Rename(tmpBackupPath, db.backupPath)
-		if errr != nil {
-			db.Warn("Renaming new database backup file failed", "source", tmpBackupPath, "dest", db.backupPath, "err", errr)
-		}
+		return err
 	}
+
+	// backup succeeded, move it over any old backup
+	err = os.Rename(tmpBackupPath, db.backupPath)
+	if err != nil {
+		db.Warn("Renaming new database backup file failed", "source", tmpBackupPath, "dest", db.backupPath, "err", err)
+	}
+	return err
 }
 
 // backup backs up the database to the given writer. Can be called at the same
@@ -1268,7 +1492,7 @@ func (db *db) backup(w io.Writer) error {
 	}
 	db.RUnlock()
 
-	return db.bolt.View(func(tx *bolt.Tx) error {
+	return db.view(func(tx *bolt.Tx) error {
 		_, txErr := tx.WriteTo(w)
 		return txErr
 	})
@@ -0,0 +1,239 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains functions for looking at a manager's database without a
+// running manager, eg. for post-mortem analysis after losing the manager's
+// host.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/ugorji/go/codec"
+)
+
+// dbInspectLockWait is how long we wait to open a database that might be in use
+// by a running manager.
+const dbInspectLockWait = 2 * time.Second
+
+// DBInspection describes the contents of a manager's database, as found by
+// InspectDB().
+type DBInspection struct {
+	Path string
+	Size int64
+
+	// Buckets is the number of entries in each of the database's buckets.
+	Buckets map[string]int
+
+	// States counts the jobs in each state. Complete jobs are those that were
+	// archived, and running ones are those that had started and not yet
+	// exited. Other jobs are counted by the state they were last stored with,
+	// which may be out of date since not every state change is stored.
+	States map[JobState]int
+
+	// RepGroups are the RepGroups with the most jobs, largest first.
+	RepGroups []*RepGroupCount
+
+	// JournalOps is the number of writes in the database's journal that have
+	// not yet been applied to it; a manager would apply them when it started.
+	JournalOps int
+
+	// Undecodable is the number of stored jobs that could not be decoded.
+	Undecodable int
+
+	// Problems are the consistency errors found in the database file itself.
+	Problems []string
+}
+
+// Healthy tells you if no problems were found with the database.
+func (i *DBInspection) Healthy() bool {
+	return len(i.Problems) == 0 && i.Undecodable == 0
+}
+
+// openDBReadOnly opens the bolt database at the given path without changing
+// it.
+func openDBReadOnly(path string) (*bolt.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	boltdb, err := bolt.Open(path, dbFilePermission, &bolt.Options{ReadOnly: true, Timeout: dbInspectLockWait})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked; is a manager still using it?", path)
+	}
+	return boltdb, err
+}
+
+// forEachStoredJob calls the given function with each job stored in the
+// database. Each job's State is set to complete if it was archived, running if
+// it had started and not yet exited, and is otherwise left as it was stored
+// (which may be out of date, since not every state change is stored). Jobs that
+// can't be decoded are counted and skipped.
+func forEachStoredJob(tx *bolt.Tx, ch codec.Handle, cb func(job *Job) error) (int, error) {
+	running := make(map[string]bool)
+	if b := tx.Bucket(bucketJobsRunning); b != nil {
+		err := b.ForEach(func(key, _ []byte) error {
+			running[string(key)] = true
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	undecodable := 0
+	for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete} {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			continue
+		}
+		complete := bytes.Equal(bucket, bucketJobsComplete)
+		err := b.ForEach(func(_, encoded []byte) error {
+			job := &Job{}
+			if errd := codec.NewDecoderBytes(encoded, ch).Decode(job); errd != nil {
+				undecodable++
+				return nil
+			}
+			switch {
+			case complete:
+				job.State = JobStateComplete
+			case running[job.key()]:
+				job.State = JobStateRunning
+			case job.State == "":
+				job.State = JobStateNew
+			}
+			return cb(job)
+		})
+		if err != nil {
+			return undecodable, err
+		}
+	}
+	return undecodable, nil
+}
+
+// InspectDB opens the manager database (or a backup of one) at the given path
+// in read-only mode, and reports on its contents and health. It fails if a
+// manager is currently using the database. topRepGroups is the maximum number
+// of RepGroups to report on.
+func InspectDB(path string, topRepGroups int) (*DBInspection, error) {
+	boltdb, err := openDBReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer boltdb.Close()
+
+	insp := &DBInspection{
+		Path:    path,
+		Buckets: make(map[string]int),
+		States:  make(map[JobState]int),
+	}
+	ch := new(codec.BincHandle)
+	rgCounts := make(map[string]map[JobState]int)
+	rgTotals := make(map[string]int)
+
+	err = boltdb.View(func(tx *bolt.Tx) error {
+		insp.Size = tx.Size()
+
+		errf := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			insp.Buckets[string(name)] = b.Stats().KeyN
+			return nil
+		})
+		if errf != nil {
+			return errf
+		}
+
+		insp.Undecodable, errf = forEachStoredJob(tx, ch, func(job *Job) error {
+			state := job.State
+			insp.States[state]++
+			if rgCounts[job.RepGroup] == nil {
+				rgCounts[job.RepGroup] = make(map[JobState]int)
+			}
+			rgCounts[job.RepGroup][state]++
+			rgTotals[job.RepGroup]++
+			return nil
+		})
+		if errf != nil {
+			return errf
+		}
+
+		for errc := range tx.Check() {
+			insp.Problems = append(insp.Problems, errc.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rgs := make([]string, 0, len(rgTotals))
+	for rg := range rgTotals {
+		rgs = append(rgs, rg)
+	}
+	sort.Slice(rgs, func(i, j int) bool {
+		if rgTotals[rgs[i]] == rgTotals[rgs[j]] {
+			return rgs[i] < rgs[j]
+		}
+		return rgTotals[rgs[i]] > rgTotals[rgs[j]]
+	})
+	if topRepGroups >= 0 && len(rgs) > topRepGroups {
+		rgs = rgs[:topRepGroups]
+	}
+	for _, rg := range rgs {
+		insp.RepGroups = append(insp.RepGroups, &RepGroupCount{RepGroup: rg, Counts: rgCounts[rg]})
+	}
+
+	if jf, errj := os.Open(path + dbJournalSuffix); errj == nil {
+		insp.JournalOps = len(readJournalOps(jf, ch))
+		errc := jf.Close()
+		if errc != nil {
+			return insp, errc
+		}
+	}
+
+	return insp, nil
+}
+
+// ExportDBJobs opens the manager database (or a backup of one) at the given
+// path in read-only mode, and writes every job stored in it to the given
+// writer as JSON, one job per line, in the same form as the status web
+// interface uses. Returns the number of jobs written.
+func ExportDBJobs(path string, w io.Writer) (int, error) {
+	boltdb, err := openDBReadOnly(path)
+	if err != nil {
+		return 0, err
+	}
+	defer boltdb.Close()
+
+	enc := json.NewEncoder(w)
+	exported := 0
+	err = boltdb.View(func(tx *bolt.Tx) error {
+		_, errf := forEachStoredJob(tx, new(codec.BincHandle), func(job *Job) error {
+			exported++
+			return enc.Encode(jobToStatus(job))
+		})
+		return errf
+	})
+	return exported, err
+}
@@ -0,0 +1,381 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the database journal, which lets us
+// acknowledge the frequent small writes that happen when jobs change state
+// (starting, being released, being archived) as soon as they are safely on
+// disk in an append-only file, and then apply them to the database proper in
+// large batches, so that storms of such changes don't each wait on their own
+// database commit.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+)
+
+// dbJournalSuffix is appended to the database file path to get the path of its
+// journal.
+const dbJournalSuffix = ".journal"
+
+// dbJournalApplyMax is the number of journalled operations that will trigger
+// them being applied to the database before DBJournalApplyInterval is up.
+const dbJournalApplyMax = 10000
+
+// DBJournalApplyInterval is the longest time that job state changes recorded
+// in the database journal wait before being applied to the database itself.
+// Any other access to the database applies them first, so this doesn't affect
+// what is read from it.
+var DBJournalApplyInterval = 1 * time.Second
+
+// errJournalClosed is returned by record() once the journal has been closed.
+var errJournalClosed = errors.New("database journal closed")
+
+// dbOp is a single put or delete of a key in a bucket, as recorded in the
+// journal.
+type dbOp struct {
+	Bucket []byte
+	Key    []byte
+	Val    []byte
+	Delete bool
+}
+
+// journalReq is a request to the journal writer to record some dbOps.
+type journalReq struct {
+	ops  []*dbOp
+	done chan error
+}
+
+// dbJournal records dbOps in a file and applies them to a bolt database in
+// batches.
+type dbJournal struct {
+	bolt    *bolt.DB
+	ch      codec.Handle
+	file    *os.File
+	pending []*dbOp
+	reqs    chan *journalReq
+	stop    chan bool
+	stopped chan bool
+	mutex   sync.Mutex
+	log15.Logger
+}
+
+// openJournal opens (creating if necessary) the journal at the given path,
+// applies any operations recorded in it that didn't get applied before we last
+// stopped, and starts accepting new operations.
+func openJournal(path string, boltdb *bolt.DB, ch codec.Handle, logger log15.Logger) (*dbJournal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, dbFilePermission)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &dbJournal{
+		bolt:    boltdb,
+		ch:      ch,
+		file:    file,
+		reqs:    make(chan *journalReq, 1000),
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+		Logger:  logger,
+	}
+
+	// after applying what we read, we always empty the file, since it may end
+	// in a partial record that new records must not be appended after
+	j.pending = readJournalOps(file, ch)
+	err = j.apply()
+	if err == nil {
+		err = j.truncate(0)
+	}
+	if err != nil {
+		errc := file.Close()
+		if errc != nil {
+			return nil, errc
+		}
+		return nil, err
+	}
+
+	go j.writer()
+	return j, nil
+}
+
+// readJournalOps returns all the dbOps that were completely recorded in a
+// journal; a partial final record would be from a write that was never
+// acknowledged, so is ignored.
+func readJournalOps(r io.Reader, ch codec.Handle) []*dbOp {
+	var ops []*dbOp
+	dec := codec.NewDecoder(bufio.NewReader(r), ch)
+	for {
+		op := &dbOp{}
+		if err := dec.Decode(op); err != nil {
+			break
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// record journals the given operations, returning once they are safely on
+// disk. They will be applied to the database later. Once the journal has been
+// closed, returns errJournalClosed instead.
+func (j *dbJournal) record(ops ...*dbOp) error {
+	req := &journalReq{ops: ops, done: make(chan error, 1)}
+	select {
+	case j.reqs <- req:
+	case <-j.stop:
+		return errJournalClosed
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-j.stopped:
+		// the writer may have handled our request on its way out
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return errJournalClosed
+		}
+	}
+}
+
+// writer is run in a goroutine to append the operations of journalReqs to our
+// file, syncing once for all the requests that arrived while we were busy, and
+// to periodically apply them to the database.
+func (j *dbJournal) writer() {
+	defer close(j.stopped)
+	ticker := time.NewTicker(DBJournalApplyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case req := <-j.reqs:
+			batch := []*journalReq{req}
+		GATHER:
+			for {
+				select {
+				case another := <-j.reqs:
+					batch = append(batch, another)
+				default:
+					break GATHER
+				}
+			}
+
+			j.appendAndAck(batch)
+
+			j.mutex.Lock()
+			full := len(j.pending) >= dbJournalApplyMax
+			j.mutex.Unlock()
+			if full {
+				j.applyAndLog()
+			}
+		case <-ticker.C:
+			j.applyAndLog()
+		case <-j.stop:
+			// write out any requests that were queued before we stopped
+			var batch []*journalReq
+		DRAIN:
+			for {
+				select {
+				case req := <-j.reqs:
+					batch = append(batch, req)
+				default:
+					break DRAIN
+				}
+			}
+			if len(batch) > 0 {
+				j.appendAndAck(batch)
+			}
+			j.applyAndLog()
+			return
+		}
+	}
+}
+
+// appendAndAck calls append() and tells each request how it went.
+func (j *dbJournal) appendAndAck(batch []*journalReq) {
+	err := j.append(batch)
+	for _, r := range batch {
+		r.done <- err
+	}
+}
+
+// append writes the operations of the given requests to our file and syncs
+// it, adding them to our pending operations on success. On failure, the file
+// is truncated back to how it was, so that a partially written batch can't
+// hide later records from readJournalOps().
+func (j *dbJournal) append(batch []*journalReq) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	start, err := j.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err = j.write(batch); err != nil {
+		if errt := j.truncate(start); errt != nil {
+			j.Error("Database journal could not be truncated after a failed write", "err", errt)
+		}
+		return err
+	}
+	for _, req := range batch {
+		j.pending = append(j.pending, req.ops...)
+	}
+	return nil
+}
+
+// write encodes the operations of the given requests to our file and syncs it.
+func (j *dbJournal) write(batch []*journalReq) error {
+	w := bufio.NewWriter(j.file)
+	enc := codec.NewEncoder(w, j.ch)
+	for _, req := range batch {
+		for _, op := range req.ops {
+			if err := enc.Encode(op); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// truncate truncates our file to the given size and moves to its end.
+func (j *dbJournal) truncate(size int64) error {
+	if err := j.file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// applyAndLog calls apply(), logging any error.
+func (j *dbJournal) applyAndLog() {
+	if err := j.apply(); err != nil {
+		j.Error("Database journal could not be applied", "err", err)
+	}
+}
+
+// apply applies all pending operations to the database in a single
+// transaction, and then empties the journal file.
+func (j *dbJournal) apply() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if len(j.pending) == 0 {
+		return nil
+	}
+
+	err := j.bolt.Update(func(tx *bolt.Tx) error {
+		for _, op := range j.pending {
+			b := tx.Bucket(op.Bucket)
+			if b == nil {
+				continue
+			}
+			var errf error
+			if op.Delete {
+				errf = b.Delete(op.Key)
+			} else {
+				errf = b.Put(op.Key, op.Val)
+			}
+			if errf != nil {
+				return errf
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	j.pending = nil
+	return j.truncate(0)
+}
+
+// close stops accepting new operations, applies pending ones and closes the
+// journal file.
+func (j *dbJournal) close() error {
+	close(j.stop)
+	<-j.stopped
+	if err := j.apply(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
+
+// view is like bolt's View(), but first applies any journalled operations so
+// that they are visible.
+func (db *db) view(fn func(*bolt.Tx) error) error {
+	db.applyJournal()
+	return db.bolt.View(fn)
+}
+
+// batch is like bolt's Batch(), but first applies any journalled operations,
+// so that writes happen in the order they were requested.
+func (db *db) batch(fn func(*bolt.Tx) error) error {
+	db.applyJournal()
+	return db.bolt.Batch(fn)
+}
+
+// update is like bolt's Update(), but first applies any journalled operations,
+// so that writes happen in the order they were requested.
+func (db *db) update(fn func(*bolt.Tx) error) error {
+	db.applyJournal()
+	return db.bolt.Update(fn)
+}
+
+// applyJournal applies any journalled operations to the database.
+func (db *db) applyJournal() {
+	if db.journal != nil {
+		if err := db.journal.apply(); err != nil {
+			db.Error("Database journal could not be applied", "err", err)
+		}
+	}
+}
+
+// record journals the given operations if we have a journal, otherwise
+// applies them to the database immediately.
+func (db *db) record(ops ...*dbOp) error {
+	if db.journal != nil {
+		return db.journal.record(ops...)
+	}
+	return db.bolt.Batch(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			b := tx.Bucket(op.Bucket)
+			if b == nil {
+				continue
+			}
+			var errf error
+			if op.Delete {
+				errf = b.Delete(op.Key)
+			} else {
+				errf = b.Put(op.Key, op.Val)
+			}
+			if errf != nil {
+				return errf
+			}
+		}
+		return nil
+	})
+}
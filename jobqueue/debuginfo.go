@@ -0,0 +1,80 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for reporting on the server's internal state,
+// for debugging jobs that seem to be stuck.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// debugTimers is the default number of items with the soonest timers that
+// DebugInfo includes.
+const debugTimers = 10
+
+// DebugInfo describes the internal state of the Server's queue and scheduling,
+// as returned by the admin-only REST debug endpoint.
+type DebugInfo struct {
+	// Queue describes the queue's sub-queues, reservation groups,
+	// dependencies and timers.
+	Queue *queue.Internals
+
+	// QueueLockWait is how long, in total, callers have waited to lock the
+	// queue.
+	QueueLockWait time.Duration
+
+	// SchedulerGroups are the number of runners we think we need for each
+	// scheduler group.
+	SchedulerGroups map[string]int
+
+	// StartDeadlines is the number of ready jobs with a StartDeadline that
+	// are being watched.
+	StartDeadlines int
+
+	// Subscriptions is the number of current job event subscriptions.
+	Subscriptions int
+}
+
+// debugInfo returns a DebugInfo with the given number of timers.
+func (s *Server) debugInfo(timers int) *DebugInfo {
+	di := &DebugInfo{
+		Queue:           s.q.Internals(timers),
+		QueueLockWait:   s.q.LockWait(),
+		SchedulerGroups: make(map[string]int),
+	}
+
+	s.sgcmutex.Lock()
+	for group, count := range s.sgroupcounts {
+		di.SchedulerGroups[group] = count
+	}
+	s.sgcmutex.Unlock()
+
+	s.deadlines.Lock()
+	di.StartDeadlines = len(s.deadlines.jobs)
+	s.deadlines.Unlock()
+
+	s.subs.Lock()
+	di.Subscriptions = len(s.subs.subs)
+	s.subs.Unlock()
+
+	return di
+}
@@ -20,6 +20,10 @@ package jobqueue
 
 // This file contains the dependency related code.
 
+import (
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
 // Dependencies is a slice of *Dependency, for use in Job.Dependencies. It
 // describes the jobs that must be complete before the Job you associate this
 // with will start.
@@ -128,3 +132,268 @@ func NewDepGroupDependency(depgroup string) *Dependency {
 		DepGroup: depgroup,
 	}
 }
+
+// DependencyNode describes a Job in the tree returned by
+// Client.GetDependencyTree().
+type DependencyNode struct {
+	Key      string
+	Cmd      string
+	RepGroup string
+	State    JobState
+
+	// Parents are the Jobs this one was waiting on when it was added. They
+	// are not filled in for Jobs that are complete, or that already appear
+	// elsewhere in the tree.
+	Parents []*DependencyNode
+
+	// Children are the incomplete Jobs that are waiting on this one. They are
+	// not filled in for Jobs that already appear elsewhere in the tree.
+	Children []*DependencyNode
+}
+
+// checkDependencyCycles returns an Error with Err ErrDependencyCycle if adding
+// the given Jobs to the queue would result in Jobs that wait on each other
+// (or themselves) forever, directly or via other Jobs.
+func (s *Server) checkDependencyCycles(jobs []*Job) error {
+	newJobs := make(map[string]*Job, len(jobs))
+	groups := make(map[string][]string)
+	hasDeps := false
+	for _, job := range jobs {
+		key := job.key()
+		newJobs[key] = job
+		for _, group := range job.DepGroups {
+			groups[group] = append(groups[group], key)
+		}
+		if len(job.Dependencies) > 0 {
+			hasDeps = true
+		}
+	}
+	if !hasDeps {
+		// a cycle must involve at least one new Job waiting on another
+		return nil
+	}
+
+	existingGroups := make(map[string][]string)
+	parents := func(key string) ([]string, error) {
+		var deps Dependencies
+		var keys []string
+		job, isNew := newJobs[key]
+		if isNew {
+			deps = job.Dependencies
+		} else {
+			item, err := s.q.Get(key)
+			if err != nil {
+				// complete or unknown Jobs can't be waiting on anything
+				return nil, nil
+			}
+			keys = append(keys, item.Dependencies()...)
+			existing := item.Data.(*Job)
+			existing.RLock()
+			deps = existing.Dependencies
+			existing.RUnlock()
+		}
+
+		for _, dep := range deps {
+			switch {
+			case dep.DepGroup != "":
+				keys = append(keys, groups[dep.DepGroup]...)
+				if !isNew {
+					// we already have the group members from before
+					continue
+				}
+				existing, done := existingGroups[dep.DepGroup]
+				if !done {
+					var err error
+					existing, err = s.db.retrieveIncompleteJobKeysByDepGroup(dep.DepGroup)
+					if err != nil {
+						return nil, err
+					}
+					existingGroups[dep.DepGroup] = existing
+				}
+				keys = append(keys, existing...)
+			case dep.Essence != nil && isNew:
+				keys = append(keys, dep.Essence.Key())
+			}
+		}
+		return keys, nil
+	}
+
+	// depth-first search for a Job we're still in the middle of visiting
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[string]int)
+	var visit func(key string) error
+	visit = func(key string) error {
+		states[key] = visiting
+		keys, err := parents(key)
+		if err != nil {
+			return err
+		}
+		for _, parent := range keys {
+			switch states[parent] {
+			case visiting:
+				return Error{"Add", parent, ErrDependencyCycle}
+			case unvisited:
+				if err = visit(parent); err != nil {
+					return err
+				}
+			}
+		}
+		states[key] = visited
+		return nil
+	}
+	for key := range newJobs {
+		if states[key] == unvisited {
+			if err := visit(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buryDependents buries the Jobs that are waiting on the Job with the given
+// key, directly or indirectly, since they can't run until it is fixed.
+func (s *Server) buryDependents(key string) {
+	keys, err := s.q.BuryDependents(key)
+	if err != nil {
+		s.Warn("burying dependents failed", "key", key, "err", err)
+		return
+	}
+	for _, k := range keys {
+		item, errg := s.q.Get(k)
+		if errg != nil {
+			continue
+		}
+		job := item.Data.(*Job)
+		job.Lock()
+		job.FailReason = FailReasonParent
+		job.Unlock()
+	}
+}
+
+// kickDependents kicks the Jobs that buryDependents() buried because of the
+// Job with the given key, so that they go back to waiting on it.
+func (s *Server) kickDependents(key string) {
+	for _, item := range s.q.Dependents(key) {
+		if item.Stats().State != queue.ItemStateBury {
+			continue
+		}
+		job := item.Data.(*Job)
+		job.RLock()
+		reason := job.FailReason
+		job.RUnlock()
+		if reason != FailReasonParent {
+			continue
+		}
+		if err := s.q.Kick(item.Key); err != nil {
+			continue
+		}
+		job.Lock()
+		job.FailReason = ""
+		job.UntilBuried = job.Retries + 1
+		job.Unlock()
+		s.kickDependents(item.Key)
+	}
+}
+
+// dependencyTree returns the tree of Jobs that the Job with the given key
+// waits on and that wait on it. Returns nil if there is no such Job.
+func (s *Server) dependencyTree(key string) (*DependencyNode, error) {
+	root, item, err := s.dependencyNode(key)
+	if err != nil || root == nil {
+		return root, err
+	}
+
+	seen := map[string]bool{key: true}
+	var addParents func(node *DependencyNode, deps []string) error
+	addParents = func(node *DependencyNode, deps []string) error {
+		for _, dep := range deps {
+			parent, pitem, errn := s.dependencyNode(dep)
+			if errn != nil {
+				return errn
+			}
+			if parent == nil {
+				continue
+			}
+			node.Parents = append(node.Parents, parent)
+			if pitem != nil && !seen[dep] {
+				seen[dep] = true
+				if errn = addParents(parent, pitem.Dependencies()); errn != nil {
+					return errn
+				}
+			}
+		}
+		return nil
+	}
+	if item != nil {
+		if err = addParents(root, item.Dependencies()); err != nil {
+			return nil, err
+		}
+	}
+
+	seen = map[string]bool{key: true}
+	var addChildren func(node *DependencyNode)
+	addChildren = func(node *DependencyNode) {
+		for _, citem := range s.q.Dependents(node.Key) {
+			child := &DependencyNode{Key: citem.Key}
+			s.fillDependencyNode(child, citem)
+			node.Children = append(node.Children, child)
+			if !seen[citem.Key] {
+				seen[citem.Key] = true
+				addChildren(child)
+			}
+		}
+	}
+	addChildren(root)
+	return root, nil
+}
+
+// dependencyNode makes a DependencyNode for the Job with the given key, which
+// may be in the queue (in which case its item is also returned) or complete.
+// Returns nils if there is no such Job.
+func (s *Server) dependencyNode(key string) (*DependencyNode, *queue.Item, error) {
+	node := &DependencyNode{Key: key}
+	item, err := s.q.Get(key)
+	if err == nil {
+		s.fillDependencyNode(node, item)
+		return node, item, nil
+	}
+
+	jobs, err := s.db.retrieveCompleteJobsByKeys([]string{key})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil, nil
+	}
+	node.Cmd = jobs[0].Cmd
+	node.RepGroup = jobs[0].RepGroup
+	node.State = JobStateComplete
+	return node, nil, nil
+}
+
+// fillDependencyNode fills in the details of a node from the given queue item.
+func (s *Server) fillDependencyNode(node *DependencyNode, item *queue.Item) {
+	job := item.Data.(*Job)
+	job.RLock()
+	node.Cmd = job.Cmd
+	node.RepGroup = job.RepGroup
+	job.RUnlock()
+	node.State = itemsStateToJobState[item.Stats().State]
+}
+
+// GetDependencyTree returns the tree of Jobs that the Job with the given
+// essence waits on (its Parents, and their Parents, etc.) and that wait on it
+// (its Children, and their Children, etc.). Returns an Error with Err
+// ErrMissingJob if there is no such Job.
+func (c *Client) GetDependencyTree(je *JobEssence) (*DependencyNode, error) {
+	resp, err := c.request(&clientRequest{Method: "getdeptree", Keys: []string{je.Key()}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.DepTree, err
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for capturing less than the full environment for
+// Jobs to run in: filtered environments, and named environment profiles stored
+// by the server.
+
+import (
+	"path/filepath"
+	"strings"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// EnvMinimal are the patterns of the names of the environment variables that
+// are needed for most commands to run normally, for use as the include
+// argument to FilterEnv() when you want to capture a minimal environment.
+var EnvMinimal = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LANGUAGE", "LC_*", "TZ", "TMPDIR", "TERM"}
+
+// FilterEnv returns the "key=value" strings of envVars whose keys match any of
+// the include patterns (or all of them if include is empty), and none of the
+// exclude patterns. Patterns are as per filepath.Match(), eg. "LC_*". The
+// result can be passed to Add() or CompressEnv() to avoid storing variables
+// that the Jobs don't need, or that shouldn't be seen by others.
+func FilterEnv(envVars, include, exclude []string) []string {
+	matches := func(key string, patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, err := filepath.Match(pattern, key); err == nil && matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	filtered := make([]string, 0, len(envVars))
+	for _, env := range envVars {
+		key := strings.SplitN(env, "=", 2)[0]
+		if len(include) > 0 && !matches(key, include) {
+			continue
+		}
+		if matches(key, exclude) {
+			continue
+		}
+		filtered = append(filtered, env)
+	}
+	return filtered
+}
+
+// storeEnvProfile stores the given compressed environment and records it under
+// the given profile name, replacing any existing profile with that name.
+func (db *db) storeEnvProfile(name string, env []byte) error {
+	envkey, err := db.storeEnv(env)
+	if err != nil {
+		return err
+	}
+	return db.store(bucketEnvProfiles, name, []byte(envkey))
+}
+
+// retrieveEnvProfile returns the key of the environment stored with
+// storeEnvProfile() under the given name, or blank if there is no such profile.
+func (db *db) retrieveEnvProfile(name string) string {
+	return string(db.retrieve(bucketEnvProfiles, name))
+}
+
+// deleteEnvProfile removes a profile stored with storeEnvProfile(), returning
+// false if there was no such profile. The environment itself is kept, since
+// Jobs may be using it.
+func (db *db) deleteEnvProfile(name string) (bool, error) {
+	var existed bool
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketEnvProfiles)
+		if b.Get([]byte(name)) == nil {
+			return nil
+		}
+		existed = true
+		return b.Delete([]byte(name))
+	})
+	return existed, err
+}
+
+// retrieveEnvProfileNames returns the names of all stored profiles.
+func (db *db) retrieveEnvProfileNames() ([]string, error) {
+	var names []string
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketEnvProfiles)
+		return b.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// SetEnvProfile stores the given environment variables ("key=value" strings)
+// in the server's database under the given name, replacing any existing
+// profile with that name. Jobs can then be added to run in this environment
+// with AddWithEnvProfile(), without each submission sending and storing its
+// own copy. Replacing a profile does not affect Jobs that were already added
+// using it.
+func (c *Client) SetEnvProfile(name string, envVars []string) error {
+	if name == "" {
+		return Error{"SetEnvProfile", name, ErrBadRequest}
+	}
+	compressed, err := c.CompressEnv(envVars)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(&clientRequest{Method: "setenvprofile", Keys: []string{name}, Env: compressed})
+	return err
+}
+
+// DeleteEnvProfile removes the environment profile with the given name from
+// the server's database. Jobs already added using it are unaffected.
+func (c *Client) DeleteEnvProfile(name string) error {
+	_, err := c.request(&clientRequest{Method: "delenvprofile", Keys: []string{name}})
+	return err
+}
+
+// GetEnvProfileNames returns the names of all the environment profiles stored
+// in the server's database.
+func (c *Client) GetEnvProfileNames() ([]string, error) {
+	resp, err := c.request(&clientRequest{Method: "getenvprofiles"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Names, err
+}
+
+// AddWithEnvProfile is like AddBulk(), but instead of running in a given
+// environment, the Jobs will run in the environment stored under the given
+// name with SetEnvProfile(). Returns an Error with Err ErrUnknownEnvProfile if
+// there is no such profile.
+func (c *Client) AddWithEnvProfile(jobs []*Job, profile string, ignoreComplete bool, batchSize int, progress func(*AddProgress)) (added, existed int, err error) {
+	return c.addBatches(jobs, &clientRequest{Method: "add", EnvProfile: profile, IgnoreComplete: ignoreComplete}, batchSize, progress)
+}
@@ -0,0 +1,261 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package jobqueue
+
+// This file contains the unix-specific parts of executing Cmds.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+var pss = []byte("Pss:")
+
+// runnerSignals are the signals Execute() intercepts so it can kill the Cmd and
+// bury or release its job (under LSF and SGE, SIGUSR2 may mean out-of-time, but
+// there's no reliable way of knowing out-of-memory, so we treat them all the
+// same).
+var runnerSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// get the current memory usage of a pid, relying on modern linux /proc/*/smaps
+// (based on http://stackoverflow.com/a/31881979/675083).
+func currentMemory(pid int) (int, error) {
+	kb, err := currentMemoryKB(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// convert kB to MB
+	return int(kb / 1024), nil
+}
+
+// currentMemoryKB is like currentMemory(), but returns kB.
+func currentMemoryKB(pid int) (uint64, error) {
+	var err error
+	f, err := os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		errc := f.Close()
+		if errc != nil {
+			if err == nil {
+				err = errc
+			} else {
+				err = fmt.Errorf("%s (and closing smaps failed: %s)", err.Error(), errc)
+			}
+		}
+	}()
+
+	kb := uint64(0)
+	r := bufio.NewScanner(f)
+	for r.Scan() {
+		line := r.Bytes()
+		if bytes.HasPrefix(line, pss) {
+			var size uint64
+			_, err = fmt.Sscanf(string(line[4:]), "%d", &size)
+			if err != nil {
+				return 0, err
+			}
+			kb += size
+		}
+	}
+	if err = r.Err(); err != nil {
+		return 0, err
+	}
+
+	return kb, err
+}
+
+// setProcessGroup makes the cmd start in a new process group of its own, so
+// that we can account for and kill everything it spawns.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the started cmd and every other process in its
+// process group (see setProcessGroup()), as well as any of its descendants that
+// have moved to other groups.
+func killProcessGroup(cmd *exec.Cmd) error {
+	pid := cmd.Process.Pid
+	for _, p := range groupPids(pid) {
+		if p != pid {
+			syscall.Kill(p, syscall.SIGKILL) // #nosec it may have already exited
+		}
+	}
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err != nil {
+		// we might not be a group leader if setProcessGroup() wasn't used
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// groupMemory returns the current memory usage (in MB) of the process with the
+// given pid plus that of every other process in its process group, and of any
+// of its descendants that have moved to other groups. Since we use PSS, memory
+// shared between these processes is not double counted. Processes that have
+// fully daemonized (changed group and been re-parented away from us) are not
+// included.
+func groupMemory(pid int) (int, error) {
+	var kb uint64
+	var found bool
+	var err error
+	for _, p := range groupPids(pid) {
+		pkb, errc := currentMemoryKB(p)
+		if errc != nil {
+			// processes can exit while we look
+			if p == pid {
+				err = errc
+			}
+			continue
+		}
+		kb += pkb
+		found = true
+	}
+	if !found {
+		return 0, err
+	}
+	return int(kb / 1024), nil
+}
+
+// groupPids returns the given pid along with the pids of the other processes in
+// its process group and its descendants, found via /proc. If /proc can't be
+// read, just returns the given pid.
+func groupPids(pid int) []int {
+	pids := []int{pid}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		p, errc := strconv.Atoi(entry.Name())
+		if errc != nil || p == pid {
+			continue
+		}
+		ppid, pgrp, errs := procParentAndGroup(p)
+		if errs != nil {
+			continue
+		}
+		if pgrp == pid {
+			pids = append(pids, p)
+			continue
+		}
+		children[ppid] = append(children[ppid], p)
+	}
+
+	// add descendants that are not in our group, checking the children of
+	// everything we have so far
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, children[pids[i]]...)
+		delete(children, pids[i])
+	}
+	return pids
+}
+
+// procParentAndGroup returns the parent pid and process group id of the given
+// pid, from /proc/[pid]/stat.
+func procParentAndGroup(pid int) (int, int, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the command name is in brackets and may contain spaces, so we parse
+	// from after the last closing bracket: state ppid pgrp ...
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	var state string
+	var ppid, pgrp int
+	_, err = fmt.Sscanf(string(b[i+1:]), "%s %d %d", &state, &ppid, &pgrp)
+	return ppid, pgrp, err
+}
+
+// processAlive tells you if the process with the given pid is still running.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, syscall.Signal(0)) == nil
+}
+
+// peakRSS returns the maximum resident set size (in MB) of an exited process.
+func peakRSS(ps *os.ProcessState) int {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		// Maxrss values are bytes
+		return int((ru.Maxrss / 1024) / 1024)
+	}
+	// Maxrss values are kb
+	return int(ru.Maxrss / 1024)
+}
+
+// fileUsage returns the id of the device the file with the given info is on,
+// and how much disk space (in bytes) it uses.
+func fileUsage(info os.FileInfo) (uint64, int64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), st.Blocks * 512
+	}
+	return 0, info.Size()
+}
+
+// fsSpace returns the free and total space (in bytes) of the file system that
+// path is on.
+func fsSpace(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// prepareShellCmd does nothing on unix, where cmd's args reach the shell as-is.
+func prepareShellCmd(cmd *exec.Cmd, shellName, cmdLine string) {}
+
+// lockFile takes an advisory lock on the given open file, exclusive or shared,
+// waiting for it if block is true. Changing the type of a lock you already
+// hold is allowed. The lock is released when the file is closed.
+func lockFile(f *os.File, exclusive bool, block bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
@@ -0,0 +1,135 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the Windows-specific parts of executing Cmds.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// runnerSignals are the signals Execute() intercepts so it can kill the Cmd and
+// bury or release its job; Windows only gives us the equivalent of these.
+var runnerSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// processQueryLimitedInformation is the access right we need to get the exit
+// code of a process, which is stillActive while it's running.
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+)
+
+// kernel32 lets us find out about disk space without extra dependencies.
+var (
+	kernel32               = syscall.NewLazyDLL("kernel32.dll")
+	procGetDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// get the current memory usage (in MB) of a pid; Windows has no equivalent of
+// PSS, so we use the working set size.
+func currentMemory(pid int) (int, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return 0, err
+	}
+	mi, err := p.MemoryInfo()
+	if err != nil {
+		return 0, err
+	}
+	return int(mi.RSS / 1024 / 1024), nil
+}
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup just kills the started cmd on Windows, where we don't track
+// the processes it spawns.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// processAlive tells you if the process with the given pid is still running.
+// If we're not allowed to find out, we assume it is.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h) // #nosec nothing we can do about failure here
+	var code uint32
+	if syscall.GetExitCodeProcess(h, &code) != nil {
+		return true
+	}
+	return code == stillActive
+}
+
+// groupMemory just returns the currentMemory() of the given pid on Windows,
+// where we don't track the processes it spawns.
+func groupMemory(pid int) (int, error) {
+	return currentMemory(pid)
+}
+
+// peakRSS always returns 0 on Windows, since the exit status of a process
+// doesn't include its memory usage; we rely on the currentMemory() checks made
+// while it was running instead.
+func peakRSS(ps *os.ProcessState) int {
+	return 0
+}
+
+// fileUsage returns 0 for the device id (we don't support detecting mount
+// points on Windows) and the size of the file with the given info.
+func fileUsage(info os.FileInfo) (uint64, int64) {
+	return 0, info.Size()
+}
+
+// fsSpace returns the free and total space (in bytes) of the volume that path
+// is on.
+func fsSpace(path string) (uint64, uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var free, total, totalFree uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&totalFree))) // #nosec
+	if r == 0 {
+		return 0, 0, fmt.Errorf("GetDiskFreeSpaceEx failed for %s: %s", path, err)
+	}
+	return free, total, nil
+}
+
+// prepareShellCmd works around cmd.exe not understanding the way Go quotes
+// arguments, by supplying cmd.exe's command line ourselves.
+func prepareShellCmd(cmd *exec.Cmd, shellName, cmdLine string) {
+	if shellName == "cmd" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: cmd.Path + " /S /C \"" + cmdLine + "\""}
+	}
+}
+
+// lockFile always succeeds on Windows, where we don't support advisory locks;
+// host setup commands are then run once per host, but host cleanup commands
+// are run each time a runner finishes.
+func lockFile(f *os.File, exclusive bool, block bool) error {
+	return nil
+}
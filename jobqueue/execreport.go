@@ -0,0 +1,97 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for writing execution reports of Cmds to their
+// working directories.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// ClientReportFile is the name of the file that Execute() writes an
+// ExecutionReport to, in the Cmd's working directory, for Jobs with
+// ExecutionReport set.
+var ClientReportFile = "wr_report.json"
+
+// ExecutionReport is the machine-readable summary of a Cmd's execution that
+// Execute() writes to ClientReportFile when Job.ExecutionReport is set, so that
+// downstream steps of a pipeline can find out how a Cmd ran without querying
+// the manager.
+type ExecutionReport struct {
+	Cmd        string         `json:"cmd"`
+	Key        string         `json:"key"`
+	RepGroup   string         `json:"rep_group"`
+	Host       string         `json:"host"`
+	HostIP     string         `json:"host_ip"`
+	Cwd        string         `json:"cwd"`
+	Started    time.Time      `json:"started"`
+	Ended      time.Time      `json:"ended"`
+	Walltime   float64        `json:"walltime_seconds"`
+	CPUtime    float64        `json:"cputime_seconds"`
+	Exitcode   int            `json:"exit_code"`
+	FailReason string         `json:"fail_reason,omitempty"`
+	PeakRAM    int            `json:"peak_ram_mb"`
+	Attempt    uint32         `json:"attempt"`
+	Mounts     []MountSummary `json:"mounts,omitempty"`
+}
+
+// MountSummary describes one of the remote file systems that were mounted
+// while a Cmd ran, for an ExecutionReport.
+type MountSummary struct {
+	Mount    string   `json:"mount"`
+	Targets  []string `json:"targets"`
+	Writable bool     `json:"writable"`
+	Cached   bool     `json:"cached"`
+}
+
+// mountSummaries describes the file systems the Job currently has mounted.
+func (j *Job) mountSummaries() []MountSummary {
+	var summaries []MountSummary
+	for i, mc := range j.MountConfigs {
+		if i >= len(j.mountPoints) {
+			break
+		}
+		ms := MountSummary{Mount: j.mountPoints[i]}
+		for _, t := range mc.Targets {
+			ms.Targets = append(ms.Targets, t.Path)
+			if t.Write {
+				ms.Writable = true
+			}
+			if t.Cache {
+				ms.Cached = true
+			}
+		}
+		summaries = append(summaries, ms)
+	}
+	return summaries
+}
+
+// writeExecutionReport writes the given report as JSON to ClientReportFile in
+// the given directory.
+func writeExecutionReport(dir string, report *ExecutionReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ClientReportFile), append(data, '\n'), 0644)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for identifying why Jobs failed with short,
+// stable codes, so that tools don't have to match FailReason text.
+
+// FailCode* are the codes corresponding to each FailReason*. Unlike the
+// FailReason* strings, which are meant for humans and may be reworded, these
+// will not change.
+const (
+	FailCodeEnv      = "env"
+	FailCodeCwd      = "cwd"
+	FailCodeStart    = "start"
+	FailCodeCPerm    = "cmd_perm"
+	FailCodeCFound   = "cmd_not_found"
+	FailCodeCExit    = "cmd_exit_code"
+	FailCodeExit     = "exit"
+	FailCodeRAM      = "ram"
+	FailCodeTime     = "time"
+	FailCodeAbnormal = "abnormal"
+	FailCodeLost     = "lost"
+	FailCodeSignal   = "signal"
+	FailCodeResource = "resource"
+	FailCodeMount    = "mount"
+	FailCodeUpload   = "upload"
+	FailCodeKilled   = "killed"
+	FailCodeLimits   = "limits"
+	FailCodeDisk     = "disk"
+	FailCodeSecrets  = "secrets"
+	FailCodeHostSet  = "host_setup"
+	FailCodeShutdown = "shutdown"
+	FailCodeParent   = "parent"
+	FailCodeImage    = "container_image"
+)
+
+// failReasonToCode maps each FailReason* to its FailCode*.
+var failReasonToCode = map[string]string{
+	FailReasonEnv:      FailCodeEnv,
+	FailReasonCwd:      FailCodeCwd,
+	FailReasonStart:    FailCodeStart,
+	FailReasonCPerm:    FailCodeCPerm,
+	FailReasonCFound:   FailCodeCFound,
+	FailReasonCExit:    FailCodeCExit,
+	FailReasonExit:     FailCodeExit,
+	FailReasonRAM:      FailCodeRAM,
+	FailReasonTime:     FailCodeTime,
+	FailReasonAbnormal: FailCodeAbnormal,
+	FailReasonLost:     FailCodeLost,
+	FailReasonSignal:   FailCodeSignal,
+	FailReasonResource: FailCodeResource,
+	FailReasonMount:    FailCodeMount,
+	FailReasonUpload:   FailCodeUpload,
+	FailReasonKilled:   FailCodeKilled,
+	FailReasonLimits:   FailCodeLimits,
+	FailReasonDisk:     FailCodeDisk,
+	FailReasonSecrets:  FailCodeSecrets,
+	FailReasonHostSet:  FailCodeHostSet,
+	FailReasonShutdown: FailCodeShutdown,
+	FailReasonParent:   FailCodeParent,
+	FailReasonImage:    FailCodeImage,
+}
+
+// FailReasonCode returns the FailCode* corresponding to the given FailReason*
+// string, or an empty string if it isn't one of them.
+func FailReasonCode(reason string) string {
+	return failReasonToCode[reason]
+}
+
+// FailCodeReason returns the FailReason* string corresponding to the given
+// FailCode*, or an empty string if it isn't one of them.
+func FailCodeReason(code string) string {
+	for reason, c := range failReasonToCode {
+		if c == code {
+			return reason
+		}
+	}
+	return ""
+}
+
+// FilterJobsByFailCode returns those of the given Jobs that have the given
+// FailCode.
+func FilterJobsByFailCode(jobs []*Job, code string) []*Job {
+	var filtered []*Job
+	for _, job := range jobs {
+		if job.FailCode == code {
+			filtered = append(filtered, job)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,163 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for summarising why buried jobs failed, by
+// clustering them on the (normalised) last thing their Cmds wrote to STDERR.
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// failureMessageMaxLength is the longest a FailureCluster.Error can be.
+const failureMessageMaxLength = 200
+
+// failurePathRegex, failureHexRegex and failureNumRegex match the parts of an
+// error message that vary between otherwise identical failures, so that we
+// can replace them with placeholders.
+var (
+	failurePathRegex = regexp.MustCompile(`\S*/\S*`)
+	failureHexRegex  = regexp.MustCompile(`\b0[xX][0-9a-fA-F]+\b`)
+	failureNumRegex  = regexp.MustCompile(`\d+(\.\d+)?`)
+)
+
+// FailureCluster describes a set of buried Jobs that all failed in the same
+// way.
+type FailureCluster struct {
+	// Error is the last line the Cmds wrote to STDERR, with paths replaced by
+	// <path> and numbers replaced by <n>. If they wrote nothing to STDERR, it
+	// is their FailReason instead.
+	Error string
+
+	// Example is the Cmd of one of the Jobs in this cluster.
+	Example string
+
+	// Count is how many Jobs failed in this way.
+	Count int
+
+	// Hosts are the (sorted) names of the hosts the Jobs failed on.
+	Hosts []string
+}
+
+// normaliseFailure returns the last non-blank line of the given STDERR with
+// the parts that are likely to differ between similar failures (paths and
+// numbers) replaced with placeholders. Returns an empty string if stderr is
+// blank.
+func normaliseFailure(stderr string) string {
+	lines := strings.Split(stderr, "\n")
+	var last string
+	for i := len(lines) - 1; i >= 0; i-- {
+		last = strings.TrimSpace(lines[i])
+		if last != "" {
+			break
+		}
+	}
+	if last == "" {
+		return ""
+	}
+
+	last = failurePathRegex.ReplaceAllString(last, "<path>")
+	last = failureHexRegex.ReplaceAllString(last, "<n>")
+	last = failureNumRegex.ReplaceAllString(last, "<n>")
+	if len(last) > failureMessageMaxLength {
+		last = last[:failureMessageMaxLength] + "..."
+	}
+	return last
+}
+
+// clusterFailures groups the given Jobs (which should have had their STDERR
+// populated) by their normalised STDERR, returning the clusters sorted by
+// descending Count.
+func clusterFailures(jobs []*Job) []*FailureCluster {
+	clusters := make(map[string]*FailureCluster)
+	hosts := make(map[string]map[string]bool)
+	for _, job := range jobs {
+		job.RLock()
+		stderr, err := job.StdErr()
+		msg := normaliseFailure(stderr)
+		if err != nil || msg == "" {
+			msg = job.FailReason
+			if msg == "" {
+				msg = "unknown reason"
+			}
+		}
+		host := job.Host
+		cmd := job.Cmd
+		job.RUnlock()
+
+		cluster, exists := clusters[msg]
+		if !exists {
+			cluster = &FailureCluster{Error: msg, Example: cmd}
+			clusters[msg] = cluster
+			hosts[msg] = make(map[string]bool)
+		}
+		cluster.Count++
+		if host != "" && !hosts[msg][host] {
+			hosts[msg][host] = true
+			cluster.Hosts = append(cluster.Hosts, host)
+		}
+	}
+
+	summary := make([]*FailureCluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		sort.Strings(cluster.Hosts)
+		summary = append(summary, cluster)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Count == summary[j].Count {
+			return summary[i].Error < summary[j].Error
+		}
+		return summary[i].Count > summary[j].Count
+	})
+	return summary
+}
+
+// failureSummary clusters the currently buried jobs, optionally only those in
+// the given RepGroup, using clusterFailures().
+func (s *Server) failureSummary(repGroup string) ([]*FailureCluster, string, string) {
+	var jobs []*Job
+	if repGroup == "" {
+		jobs = s.getJobsCurrent(0, JobStateBuried, true, false)
+	} else {
+		var srerr, qerr string
+		jobs, srerr, qerr = s.getJobsByRepGroup(repGroup, 0, JobStateBuried, true, false)
+		if srerr != "" {
+			return nil, srerr, qerr
+		}
+	}
+	return clusterFailures(jobs), "", ""
+}
+
+// GetFailureSummary gets a summary of why the currently buried Jobs failed,
+// with Jobs that wrote the same thing to STDERR (ignoring differences in paths
+// and numbers) grouped together, biggest group first. If repGroup is supplied,
+// only Jobs with that RepGroup are considered.
+func (c *Client) GetFailureSummary(repGroup string) ([]*FailureCluster, error) {
+	cr := &clientRequest{Method: "getfailsum"}
+	if repGroup != "" {
+		cr.Job = &Job{RepGroup: repGroup}
+	}
+	resp, err := c.request(cr)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Failures, err
+}
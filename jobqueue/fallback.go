@@ -0,0 +1,153 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the implementation of fallback command chains: jobs that
+// try alternative commands in turn when their Cmd keeps failing.
+
+import (
+	"fmt"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// Fallback is an alternative command for a Job to try if its Cmd (or the
+// previous Fallback) still fails after all its Retries. Eg. a fast but fragile
+// tool could have a slower but more robust tool as its Fallback.
+type Fallback struct {
+	// Cmd is the command to run instead; it supports the same variables as
+	// Job.Cmd.
+	Cmd string
+
+	// Requirements, if set, replace the Job's Requirements while this Cmd is
+	// being tried (and are not overridden by learned values). If not set, the
+	// Job keeps its current Requirements.
+	Requirements *scheduler.Requirements
+}
+
+// FallbackViaJSON describes a Fallback in a JobViaJSON. Unset resource values
+// are taken from the job being converted.
+type FallbackViaJSON struct {
+	Cmd string `json:"cmd"`
+	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte (see
+	// ParseMemory()).
+	Memory string `json:"memory"`
+	// Time is a duration with a unit suffix, eg. 1h for 1 hour or 2d4h for 2
+	// days and 4 hours (see ParseDuration()).
+	Time string `json:"time"`
+	CPUs *int   `json:"cpus"`
+	Disk *int   `json:"disk"`
+}
+
+// convert returns the Fallback equivalent of this FallbackViaJSON, basing any
+// changed Requirements on the given ones.
+func (fvj FallbackViaJSON) convert(req *scheduler.Requirements) (*Fallback, error) {
+	if fvj.Cmd == "" {
+		return nil, fmt.Errorf("a fallback has no cmd")
+	}
+	fb := &Fallback{Cmd: fvj.Cmd}
+	if fvj.Memory == "" && fvj.Time == "" && fvj.CPUs == nil && fvj.Disk == nil {
+		return fb, nil
+	}
+
+	fbreq := copyRequirements(req)
+	if fvj.Memory != "" {
+		mb, err := ParseMemory(fvj.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("fallback %s", err)
+		}
+		fbreq.RAM = mb
+	}
+	if fvj.Time != "" {
+		dur, err := ParseDuration(fvj.Time)
+		if err != nil {
+			return nil, fmt.Errorf("fallback %s", err)
+		}
+		fbreq.Time = dur
+	}
+	if fvj.CPUs != nil {
+		fbreq.Cores = *fvj.CPUs
+	}
+	if fvj.Disk != nil {
+		fbreq.Disk = *fvj.Disk
+	}
+	fb.Requirements = fbreq
+	return fb, nil
+}
+
+// copyRequirements returns a copy of the given Requirements that doesn't share
+// its Other map.
+func copyRequirements(req *scheduler.Requirements) *scheduler.Requirements {
+	cp := *req
+	if req.Other != nil {
+		cp.Other = make(map[string]string, len(req.Other))
+		for key, val := range req.Other {
+			cp.Other[key] = val
+		}
+	}
+	return &cp
+}
+
+// activeCmd returns the command the Job should currently run: its Cmd, or one
+// of its Fallbacks if earlier commands kept failing.
+func (j *Job) activeCmd() string {
+	if j.FallbackIndex > 0 && j.FallbackIndex <= len(j.Fallbacks) {
+		return j.Fallbacks[j.FallbackIndex-1].Cmd
+	}
+	return j.Cmd
+}
+
+// nextFallback switches the Job over to its next Fallback, giving it a fresh
+// set of Retries and the Fallback's Requirements. Returns false if there are
+// no more Fallbacks to try. You must hold the Job's lock before calling this.
+func (j *Job) nextFallback() bool {
+	if j.FallbackIndex >= len(j.Fallbacks) {
+		return false
+	}
+	fb := j.Fallbacks[j.FallbackIndex]
+	j.FallbackIndex++
+	j.UntilBuried = j.Retries + 1
+	if fb.Requirements != nil {
+		j.Requirements = copyRequirements(fb.Requirements)
+		j.Override = uint8(2)
+	}
+	return true
+}
+
+// validateFallbacks checks that all of the Job's Fallbacks have a Cmd and
+// sensible Requirements.
+func (j *Job) validateFallbacks() error {
+	for i, fb := range j.Fallbacks {
+		if fb == nil || fb.Cmd == "" {
+			return fmt.Errorf("fallback %d has no command", i+1)
+		}
+		if fb.Requirements != nil {
+			if err := validateRequirements(fb.Requirements); err != nil {
+				return fmt.Errorf("fallback %d: %s", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// permanentCmdFailure returns true if the given FailReason means the cmd could
+// not be run at all, such that retrying it would be pointless.
+func permanentCmdFailure(reason string) bool {
+	return reason == FailReasonCPerm || reason == FailReasonCFound || reason == FailReasonCExit
+}
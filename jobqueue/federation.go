@@ -0,0 +1,551 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for forwarding jobs to peer managers in other
+// datacentres, and mirroring their progress back.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+// peerGroupPrefix prefixes the scheduler group of jobs that are to be
+// forwarded to a peer, so that only that peer's forwarder reserves them.
+const peerGroupPrefix = "wr_peer:"
+
+// Peer describes another wr manager, typically in a different datacentre, that
+// jobs can be forwarded to.
+type Peer struct {
+	// Name identifies the peer, eg. in the status of the jobs forwarded to it.
+	Name string `json:"name"`
+
+	// Addr is the ip:port of the peer manager's client port.
+	Addr string `json:"addr"`
+
+	// CAFile is the path to the CA certificate that the peer manager's
+	// certificate can be verified with, if not a system-installed one.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// CertDomain is the domain that the peer manager's certificate is valid
+	// for.
+	CertDomain string `json:"cert_domain"`
+
+	// TokenFile is the path to a file containing the peer manager's
+	// authentication token.
+	TokenFile string `json:"token_file"`
+
+	// Datacentres are the routing rules for the peer: Jobs with a Datacentre
+	// in this list are forwarded to it.
+	Datacentres []string `json:"datacentres"`
+}
+
+// federation holds our own datacentre and the forwarders for our peers.
+type federation struct {
+	datacentre string
+	byName     map[string]*peerForwarder
+	byDC       map[string]*peerForwarder
+}
+
+// newFederation creates a federation from the given ServerConfig, reading the
+// tokens of all its Peers.
+func newFederation(config ServerConfig) (*federation, error) {
+	f := &federation{
+		datacentre: config.Datacentre,
+		byName:     make(map[string]*peerForwarder),
+		byDC:       make(map[string]*peerForwarder),
+	}
+	for _, peer := range config.Peers {
+		if peer.Name == "" || peer.Addr == "" {
+			return nil, fmt.Errorf("peer managers must have a name and addr")
+		}
+		if _, exists := f.byName[peer.Name]; exists {
+			return nil, fmt.Errorf("peer manager %s was specified more than once", peer.Name)
+		}
+		token, err := ioutil.ReadFile(peer.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the token of peer manager %s: %s", peer.Name, err)
+		}
+		pf := &peerForwarder{
+			Peer:    peer,
+			token:   []byte(strings.TrimSpace(string(token))),
+			jobs:    make(map[string]*forwardedJob),
+			trigger: make(chan bool, 1),
+		}
+		f.byName[peer.Name] = pf
+		for _, dc := range peer.Datacentres {
+			if dc == config.Datacentre {
+				return nil, fmt.Errorf("peer manager %s can't handle our own datacentre %s", peer.Name, dc)
+			}
+			if other, exists := f.byDC[dc]; exists {
+				return nil, fmt.Errorf("datacentre %s is routed to both %s and %s", dc, other.Name, peer.Name)
+			}
+			f.byDC[dc] = pf
+		}
+	}
+	return f, nil
+}
+
+// routable tells you if we can run jobs with the given datacentre, either
+// ourselves or via a peer.
+func (f *federation) routable(dc string) bool {
+	if dc == "" || dc == f.datacentre {
+		return true
+	}
+	_, exists := f.byDC[dc]
+	return exists
+}
+
+// peerFor returns the forwarder for the peer that handles the given
+// datacentre, or nil if we handle it ourselves.
+func (f *federation) peerFor(dc string) *peerForwarder {
+	if dc == "" || dc == f.datacentre {
+		return nil
+	}
+	return f.byDC[dc]
+}
+
+// peerDups asks all our peers if they already have any of the given jobs,
+// returning the names of the peers that do, keyed on job key. Jobs that have
+// completed on a peer only count if ignoreComplete is true. Returns an error
+// if any peer can't be asked, since we can't then be sure there are no
+// duplicates.
+func (f *federation) peerDups(jobs []*Job, ignoreComplete bool) (map[string]string, error) {
+	dups := make(map[string]string)
+	if len(f.byName) == 0 || len(jobs) == 0 {
+		return dups, nil
+	}
+
+	jes := make([]*JobEssence, len(jobs))
+	for i, job := range jobs {
+		jes[i] = job.ToEssense()
+	}
+
+	for _, pf := range f.byName {
+		peer, err := Connect(pf.Addr, pf.CAFile, pf.CertDomain, pf.token, ServerFederationPoll)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to peer manager %s: %s", pf.Name, err)
+		}
+		pjobs, err := peer.GetByEssences(jes)
+		_ = peer.Disconnect() // #nosec
+		if err != nil {
+			return nil, fmt.Errorf("could not get jobs from peer manager %s: %s", pf.Name, err)
+		}
+		for _, pjob := range pjobs {
+			if pjob.State == JobStateComplete && !ignoreComplete {
+				continue
+			}
+			dups[pjob.key()] = pf.Name
+		}
+	}
+	return dups, nil
+}
+
+// withoutPeerDups returns the given jobs, minus those whose keys are in the
+// given result of peerDups().
+func withoutPeerDups(jobs []*Job, dups map[string]string) []*Job {
+	if len(dups) == 0 {
+		return jobs
+	}
+	var keep []*Job
+	for _, job := range jobs {
+		if _, dup := dups[job.key()]; !dup {
+			keep = append(keep, job)
+		}
+	}
+	return keep
+}
+
+// start begins forwarding jobs to all our peers, using a client connected to
+// ourselves to reserve and update the local copies of forwarded jobs.
+func (f *federation) start(s *Server, caFile, certDomain string) {
+	for _, pf := range f.byName {
+		s.wg.Add(1)
+		go func(pf *peerForwarder) {
+			defer internal.LogPanic(s.Logger, "jobqueue peer forwarder", true)
+			defer s.wg.Done()
+			pf.run(s, caFile, certDomain)
+		}(pf)
+	}
+}
+
+// forwardedJob is a local job that we've added to a peer.
+type forwardedJob struct {
+	local   *Job
+	started bool
+}
+
+// peerForwarder forwards jobs to a single peer and mirrors their state back.
+type peerForwarder struct {
+	*Peer
+	token   []byte
+	self    *Client
+	peer    *Client
+	jobs    map[string]*forwardedJob
+	trigger chan bool
+	sync.Mutex
+}
+
+// group is the scheduler group of jobs destined for this peer.
+func (pf *peerForwarder) group() string {
+	return peerGroupPrefix + pf.Name
+}
+
+// isPeerGroup tells you if the given scheduler group is one for jobs that are
+// forwarded to a peer.
+func isPeerGroup(group string) bool {
+	return strings.HasPrefix(group, peerGroupPrefix)
+}
+
+// claim marks the given job (which should be in our queue) as destined for
+// this peer, and wakes up the forwarder.
+func (pf *peerForwarder) claim(s *Server, job *Job) {
+	group := pf.group()
+	if job.getSchedulerGroup() != group {
+		job.setSchedulerGroup(group)
+		err := s.q.SetReserveGroup(job.key(), group)
+		if err != nil {
+			s.Warn("peer forwarding queue setreservegroup failed", "peer", pf.Name, "err", err)
+		}
+	}
+	select {
+	case pf.trigger <- true:
+	default:
+	}
+}
+
+// run forwards and monitors jobs every ServerFederationPoll (or sooner when
+// triggered by claim()), until the server stops.
+func (pf *peerForwarder) run(s *Server, caFile, certDomain string) {
+	ticker := time.NewTicker(ServerFederationPoll)
+	defer ticker.Stop()
+	defer pf.disconnect()
+	for {
+		select {
+		case <-s.stopClientHandling:
+			return
+		case <-ticker.C:
+		case <-pf.trigger:
+		}
+
+		if pf.self == nil {
+			self, err := Connect(s.ServerInfo.Addr, caFile, certDomain, s.token, ServerFederationPoll)
+			if err != nil {
+				s.Warn("peer forwarder could not connect to its own server", "peer", pf.Name, "err", err)
+				continue
+			}
+			pf.self = self
+		}
+
+		if pf.peer == nil {
+			peer, err := Connect(pf.Addr, pf.CAFile, pf.CertDomain, pf.token, ServerFederationPoll)
+			if err != nil {
+				s.Warn("could not connect to peer manager", "peer", pf.Name, "err", err)
+			} else {
+				pf.peer = peer
+			}
+		}
+
+		pf.monitor(s)
+		if pf.peer != nil {
+			pf.forward(s)
+		}
+	}
+}
+
+// disconnect closes our client connections.
+func (pf *peerForwarder) disconnect() {
+	if pf.self != nil {
+		_ = pf.self.Disconnect() // #nosec
+		pf.self = nil
+	}
+	pf.dropPeer()
+}
+
+// dropPeer closes our connection to the peer, so that we'll reconnect next
+// time.
+func (pf *peerForwarder) dropPeer() {
+	if pf.peer != nil {
+		_ = pf.peer.Disconnect() // #nosec
+		pf.peer = nil
+	}
+}
+
+// forward reserves all the local jobs destined for our peer and adds them to
+// it.
+func (pf *peerForwarder) forward(s *Server) {
+	for {
+		job, err := pf.self.ReserveScheduled(1*time.Millisecond, pf.group())
+		if err != nil {
+			s.Warn("peer forwarder reserve failed", "peer", pf.Name, "err", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+
+		err = pf.add(s, job)
+		if err != nil {
+			s.Warn("forwarding job to peer manager failed", "peer", pf.Name, "cmd", job.Cmd, "err", err)
+			errr := pf.self.Release(job, nil, "forwarding to peer manager "+pf.Name+" failed")
+			if errr != nil {
+				s.Warn("peer forwarder release failed", "peer", pf.Name, "err", errr)
+			}
+			pf.dropPeer()
+			return
+		}
+		s.Debug("forwarded job", "peer", pf.Name, "cmd", job.Cmd)
+	}
+}
+
+// add adds a copy of the given local job to our peer, along with its
+// environment and any uploaded files it needs.
+func (pf *peerForwarder) add(s *Server, job *Job) error {
+	env, err := job.Env()
+	if err != nil {
+		return err
+	}
+
+	pjob, err := pf.peerCopy(s, job)
+	if err != nil {
+		return err
+	}
+
+	_, existed, err := pf.peer.Add([]*Job{pjob}, env, false)
+	if err != nil {
+		return err
+	}
+	if existed > 0 {
+		// we may have forwarded it before; if it failed there and was kicked
+		// here, kick it there as well
+		existing, errg := pf.peer.GetByEssence(job.ToEssense(), false, false)
+		if errg == nil && existing != nil && existing.State == JobStateBuried {
+			_, err = pf.peer.Kick([]*JobEssence{job.ToEssense()})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	pf.Lock()
+	pf.jobs[job.key()] = &forwardedJob{local: job}
+	pf.Unlock()
+
+	if item, errg := s.q.Get(job.key()); errg == nil {
+		sjob := item.Data.(*Job)
+		sjob.Lock()
+		sjob.Peer = pf.Name
+		sjob.Unlock()
+	}
+	return nil
+}
+
+// peerCopy makes a new Job with the same specification as the given job, for
+// adding to our peer. Dependencies are not included, since the job is only
+// forwarded once they have been satisfied. Files that were uploaded to us for
+// the job's cloud_config_files are uploaded to the peer as well.
+func (pf *peerForwarder) peerCopy(s *Server, job *Job) (*Job, error) {
+	pjob := job.specCopy()
+	if req := pjob.Requirements; req != nil {
+		if ccf := req.Other["cloud_config_files"]; ccf != "" {
+			cfs := strings.Split(ccf, ",")
+			for i, cf := range cfs {
+				parts := strings.SplitN(cf, ":", 2)
+				if s.uploadMD5(parts[0]) == "" {
+					continue
+				}
+				remote, err := pf.peer.UploadFile(parts[0], "")
+				if err != nil {
+					return nil, err
+				}
+				parts[0] = remote
+				cfs[i] = strings.Join(parts, ":")
+			}
+			req.Other["cloud_config_files"] = strings.Join(cfs, ",")
+		}
+	}
+	return pjob, nil
+}
+
+// monitor keeps our forwarded jobs alive locally, and mirrors their state on
+// our peer back to them.
+func (pf *peerForwarder) monitor(s *Server) {
+	pf.Lock()
+	fjs := make([]*forwardedJob, 0, len(pf.jobs))
+	for _, fj := range pf.jobs {
+		fjs = append(fjs, fj)
+	}
+	pf.Unlock()
+	if len(fjs) == 0 {
+		return
+	}
+
+	// touch them all, so they don't get lost even when our peer is
+	// unreachable, passing on any kill requests (but not the ones that are
+	// only due to us shutting down: we'll pick the jobs up again when we
+	// restart)
+	s.krmutex.RLock()
+	shuttingDown := s.killRunners
+	s.krmutex.RUnlock()
+	var toKill []*JobEssence
+	for _, fj := range fjs {
+		killCalled, err := pf.self.Touch(fj.local)
+		if err != nil {
+			s.Warn("peer forwarder touch failed", "peer", pf.Name, "cmd", fj.local.Cmd, "err", err)
+			if jqerr, ok := err.(Error); ok && (jqerr.Err == ErrBadJob || jqerr.Err == ErrMustReserve) {
+				pf.forget(fj)
+			}
+			continue
+		}
+		if killCalled && !shuttingDown {
+			toKill = append(toKill, fj.local.ToEssense())
+		}
+	}
+
+	if pf.peer == nil {
+		return
+	}
+
+	if len(toKill) > 0 {
+		_, err := pf.peer.Kill(toKill)
+		if err != nil {
+			s.Warn("peer forwarder kill failed", "peer", pf.Name, "err", err)
+		}
+	}
+
+	jes := make([]*JobEssence, len(fjs))
+	for i, fj := range fjs {
+		jes[i] = fj.local.ToEssense()
+	}
+	pjobs, err := pf.peer.GetByEssences(jes)
+	if err != nil {
+		s.Warn("getting the state of forwarded jobs failed", "peer", pf.Name, "err", err)
+		pf.dropPeer()
+		return
+	}
+	pjobsByKey := make(map[string]*Job, len(pjobs))
+	for _, pjob := range pjobs {
+		pjobsByKey[pjob.key()] = pjob
+	}
+
+	for _, fj := range fjs {
+		pjob, found := pjobsByKey[fj.local.key()]
+		if !found {
+			pf.release(s, fj, "job disappeared from peer manager "+pf.Name)
+			continue
+		}
+		pf.mirror(s, fj, pjob)
+	}
+}
+
+// mirror updates our local copy of a forwarded job given its state on our
+// peer.
+func (pf *peerForwarder) mirror(s *Server, fj *forwardedJob, pjob *Job) {
+	switch pjob.State {
+	case JobStateRunning, JobStateLost, JobStateComplete, JobStateBuried:
+		if !fj.started && pjob.Pid > 0 {
+			pf.start(s, fj, pjob)
+		}
+	}
+
+	switch pjob.State {
+	case JobStateComplete, JobStateBuried:
+		if pjob.State == JobStateComplete && !fj.started {
+			// we can't mark it complete without having marked it started
+			return
+		}
+
+		// get the job again with its STDOUT/ERR
+		full, err := pf.peer.GetByEssence(pjob.ToEssense(), true, false)
+		if err != nil || full == nil {
+			s.Warn("getting the output of a forwarded job failed", "peer", pf.Name, "cmd", pjob.Cmd, "err", err)
+			return
+		}
+		jes := peerEndState(full)
+
+		if full.State == JobStateComplete {
+			err = pf.self.Archive(fj.local, jes)
+		} else {
+			err = pf.self.Bury(fj.local, jes, full.FailReason)
+		}
+		if err != nil {
+			s.Warn("mirroring the end of a forwarded job failed", "peer", pf.Name, "cmd", pjob.Cmd, "err", err)
+			return
+		}
+		pf.forget(fj)
+	}
+}
+
+// start tells our server that a forwarded job has started running on our peer.
+func (pf *peerForwarder) start(s *Server, fj *forwardedJob, pjob *Job) {
+	fj.local.Host = pjob.Host
+	fj.local.HostIP = pjob.HostIP
+	fj.local.SchedulerID = pjob.SchedulerID
+	fj.local.Pid = pjob.Pid
+	_, err := pf.self.request(&clientRequest{Method: "jstart", Job: fj.local})
+	if err != nil {
+		s.Warn("mirroring the start of a forwarded job failed", "peer", pf.Name, "cmd", pjob.Cmd, "err", err)
+		return
+	}
+	fj.started = true
+}
+
+// release puts a forwarded job back in our queue to be forwarded again.
+func (pf *peerForwarder) release(s *Server, fj *forwardedJob, reason string) {
+	err := pf.self.Release(fj.local, nil, reason)
+	if err != nil {
+		s.Warn("peer forwarder release failed", "peer", pf.Name, "cmd", fj.local.Cmd, "err", err)
+	}
+	pf.forget(fj)
+}
+
+// forget stops us tracking a forwarded job.
+func (pf *peerForwarder) forget(fj *forwardedJob) {
+	pf.Lock()
+	delete(pf.jobs, fj.local.key())
+	pf.Unlock()
+}
+
+// peerEndState converts a finished job from a peer in to the JobEndState a
+// runner would have reported for it.
+func peerEndState(pjob *Job) *JobEndState {
+	jes := &JobEndState{
+		Cwd:         pjob.ActualCwd,
+		Exitcode:    pjob.Exitcode,
+		PeakRAM:     pjob.PeakRAM,
+		PeakDisk:    pjob.PeakDisk,
+		CPUtime:     pjob.CPUtime,
+		Exited:      pjob.Exited,
+		Fingerprint: pjob.Fingerprint,
+		CoreFile:    pjob.CoreFile,
+		Metrics:     pjob.Metrics,
+	}
+	if stdout, err := pjob.StdOut(); err == nil {
+		jes.Stdout = []byte(stdout)
+	}
+	if stderr, err := pjob.StdErr(); err == nil {
+		jes.Stderr = []byte(stderr)
+	}
+	return jes
+}
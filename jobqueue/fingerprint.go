@@ -0,0 +1,131 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for capturing a fingerprint of the environment
+// a Job's Cmd was executed in, so that results can be traced back to it.
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// fingerprintOSReleaseFile, fingerprintKernelFile and fingerprintCPUInfoFile
+// are where we look for information about the host on Linux; on other
+// systems the corresponding Fingerprint properties are left blank.
+const (
+	fingerprintOSReleaseFile = "/etc/os-release"
+	fingerprintKernelFile    = "/proc/sys/kernel/osrelease"
+	fingerprintCPUInfoFile   = "/proc/cpuinfo"
+)
+
+// fingerprintContainerEnvVars are the environment variables that container
+// runtimes set to tell you what image you're in, in order of preference.
+var fingerprintContainerEnvVars = []string{"WR_CONTAINER_IMAGE", "SINGULARITY_CONTAINER", "APPTAINER_CONTAINER"}
+
+// Fingerprint describes the environment a Job's Cmd was executed in. Any
+// property that could not be determined will be blank.
+type Fingerprint struct {
+	OS             string // the OS release, eg. "Ubuntu 18.04.1 LTS"
+	Kernel         string // the kernel release, eg. "4.15.0-36-generic"
+	Arch           string // the CPU architecture, eg. "amd64"
+	CPUModel       string // eg. "Intel(R) Xeon(R) CPU E5-2690 v4 @ 2.60GHz"
+	Modules        string // environment modules that were loaded (from $LOADEDMODULES)
+	ContainerImage string // the container image Cmd ran in, if any
+}
+
+// captureFingerprint works out the Fingerprint of the current host, given the
+// environment variables the Cmd will run with.
+func captureFingerprint(env []string) *Fingerprint {
+	fp := &Fingerprint{
+		OS:       fingerprintOS(),
+		Kernel:   fingerprintFirstLine(fingerprintKernelFile),
+		Arch:     runtime.GOARCH,
+		CPUModel: fingerprintCPUModel(),
+		Modules:  envValue(env, "LOADEDMODULES"),
+	}
+	for _, key := range fingerprintContainerEnvVars {
+		if image := envValue(env, key); image != "" {
+			fp.ContainerImage = image
+			break
+		}
+	}
+	if fp.OS == "" {
+		fp.OS = runtime.GOOS
+	}
+	return fp
+}
+
+// envValue returns the value of the given key in the given environment
+// variables.
+func envValue(env []string, key string) string {
+	prefix := key + "="
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return strings.TrimPrefix(kv, prefix)
+		}
+	}
+	return ""
+}
+
+// fingerprintOS returns the PRETTY_NAME from fingerprintOSReleaseFile.
+func fingerprintOS() string {
+	content, err := ioutil.ReadFile(fingerprintOSReleaseFile)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"'`)
+		}
+	}
+	return ""
+}
+
+// fingerprintFirstLine returns the trimmed first line of the given file.
+func fingerprintFirstLine(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+}
+
+// fingerprintCPUModel returns the first "model name" in
+// fingerprintCPUInfoFile.
+func fingerprintCPUModel() string {
+	f, err := os.Open(fingerprintCPUInfoFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close() // #nosec we only read from it
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "model name") {
+			if i := strings.Index(line, ":"); i != -1 {
+				return strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets runners on the same host run a
+// scheduler group's host setup command once before the first of its jobs
+// starts there, and its host cleanup command once after the last finishes.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// hostSetupOther and hostCleanupOther are the Requirements.Other keys that
+// hold a Job's host setup and cleanup commands. Being in Other means Jobs with
+// different commands end up in different scheduler groups.
+const (
+	hostSetupOther   = "host_setup"
+	hostCleanupOther = "host_cleanup"
+)
+
+// ClientHostSetupDir is a directory that Execute() uses to coordinate with
+// other runners on the same host, so that host setup commands are only run
+// once per host. It must be on a local disk. The default of blank string means
+// a user-specific sub-directory of os.TempDir() is used.
+var ClientHostSetupDir string
+
+// hostGroup is what a Client remembers about a set of host setup and cleanup
+// commands it has joined in on.
+type hostGroup struct {
+	active  *os.File // we hold a shared lock on this until we leave
+	cleanup string
+	shell   string
+}
+
+// hostSetupBase returns the path (minus suffix) of the files we use to
+// coordinate running the host commands with the given key.
+func hostSetupBase(key string) (string, error) {
+	dir := ClientHostSetupDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("wr_hostsetup_%d", os.Getuid()))
+	}
+	err := os.MkdirAll(dir, 0700)
+	return filepath.Join(dir, key), err
+}
+
+// runHostCmd runs a host setup or cleanup command, returning an error that
+// includes (the head and tail of) its output if it fails.
+func runHostCmd(shell, cmdLine string) error {
+	cmd := shellCommand(shell, cmdLine)
+	out := &prefixSuffixSaver{N: 4096}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("[%s] failed: %s\n%s", cmdLine, err, out.Bytes())
+	}
+	return nil
+}
+
+// hostSetup makes sure that the given job's host setup command has been run
+// successfully on this host, running it if we're the first runner here to need
+// it. Other runners needing the same command wait for us to finish. We then
+// count as running jobs that need the command until HostCleanup() is called.
+func (c *Client) hostSetup(job *Job, shell string) error {
+	setup := job.Requirements.Other[hostSetupOther]
+	cleanup := job.Requirements.Other[hostCleanupOther]
+	if setup == "" && cleanup == "" {
+		return nil
+	}
+	key := byteKey([]byte(setup + "\n" + cleanup))
+
+	c.Lock()
+	_, joined := c.hostGroups[key]
+	c.Unlock()
+	if joined {
+		return nil
+	}
+
+	base, err := hostSetupBase(key)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(base+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close() // #nosec (releases our lock)
+	err = lockFile(lock, true, true)
+	if err != nil {
+		return err
+	}
+
+	done := base + ".done"
+	if _, err = os.Stat(done); err != nil {
+		if setup != "" {
+			err = runHostCmd(shell, setup)
+			if err != nil {
+				return err
+			}
+		}
+		var f *os.File
+		f, err = os.Create(done)
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	active, err := os.OpenFile(base+".active", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = lockFile(active, false, true)
+	if err != nil {
+		active.Close() // #nosec
+		return err
+	}
+
+	c.Lock()
+	if c.hostGroups == nil {
+		c.hostGroups = make(map[string]*hostGroup)
+	}
+	c.hostGroups[key] = &hostGroup{active: active, cleanup: cleanup, shell: shell}
+	c.Unlock()
+	return nil
+}
+
+// hostGroupLeave stops us counting as a runner of jobs in the given hostGroup,
+// and runs its cleanup command if no other runner on this host still counts.
+func hostGroupLeave(key string, hg *hostGroup) error {
+	defer hg.active.Close() // #nosec (releases our lock)
+	base, err := hostSetupBase(key)
+	if err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(base+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close() // #nosec
+	err = lockFile(lock, true, true)
+	if err != nil {
+		return err
+	}
+
+	if lockFile(hg.active, true, false) != nil {
+		// other runners are still using the host setup
+		return nil
+	}
+
+	if hg.cleanup != "" {
+		err = runHostCmd(hg.shell, hg.cleanup)
+	}
+
+	// the next runner to need it will have to run the setup again
+	errr := os.Remove(base + ".done")
+	if err == nil && errr != nil && !os.IsNotExist(errr) {
+		err = errr
+	}
+	return err
+}
+
+// HostCleanup should be called once you've finished executing Jobs with this
+// Client (eg. at the end of a runner's life). For each distinct host setup and
+// cleanup command pair of the Jobs that Execute() ran, if no other Client on
+// this host is still executing Jobs with that pair, the cleanup command is run.
+// Returns an error if any cleanup command failed.
+func (c *Client) HostCleanup() error {
+	c.Lock()
+	groups := c.hostGroups
+	c.hostGroups = nil
+	c.Unlock()
+
+	var merr *multierror.Error
+	for key, hg := range groups {
+		if err := hostGroupLeave(key, hg); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	return merr.ErrorOrNil()
+}
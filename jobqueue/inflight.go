@@ -0,0 +1,187 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets a runner that loses contact with the
+// server while running a job carry on, and get its results to the server (or
+// a new one at the same address) once it comes back.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/satori/go.uuid"
+	"github.com/ugorji/go/codec"
+)
+
+// inFlightAction* say what a runner was trying to do with a job when it gave up
+// trying to contact the server.
+const (
+	inFlightActionArchive = "archive"
+	inFlightActionRelease = "release"
+	inFlightActionBury    = "bury"
+)
+
+// inFlight is what we store on local disk about a job we're running, so that
+// we can get its end state to the server even if the server was unreachable
+// when the job's Cmd finished.
+type inFlight struct {
+	ClientID   uuid.UUID
+	RunnerPID  int
+	Job        *Job
+	Action     string
+	FailReason string
+	EndState   *JobEndState
+}
+
+// jobDisowned tells you if the given error from a method that needs a job to
+// have been reserved by us means that the server is up, but no longer
+// considers us to be running the job (eg. it was restarted and we didn't get
+// back in touch within its ReattachGrace). Trying again won't help.
+func jobDisowned(err error) bool {
+	jqerr, ok := err.(Error)
+	return ok && (jqerr.Err == ErrBadJob || jqerr.Err == ErrMustReserve)
+}
+
+// inFlightPath returns the path to the file we store the given job's inFlight
+// in, or blank if ClientInFlightDir has not been set.
+func inFlightPath(job *Job) string {
+	if ClientInFlightDir == "" {
+		return ""
+	}
+	return filepath.Join(ClientInFlightDir, job.key())
+}
+
+// recordInFlight stores an inFlight for the given job in ClientInFlightDir.
+// Call it with a blank action when the job's Cmd starts running, and again
+// with the action and end state if you couldn't tell the server about how the
+// Cmd ended. Does nothing if ClientInFlightDir has not been set.
+func (c *Client) recordInFlight(job *Job, action string, failreason string, jes *JobEndState) error {
+	path := inFlightPath(job)
+	if path == "" {
+		return nil
+	}
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, c.ch)
+	err := enc.Encode(&inFlight{ClientID: c.clientid, RunnerPID: os.Getpid(), Job: job, Action: action, FailReason: failreason, EndState: jes})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(ClientInFlightDir, 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, encoded, 0600)
+}
+
+// forgetInFlight removes what recordInFlight() stored for the given job.
+func (c *Client) forgetInFlight(job *Job) {
+	path := inFlightPath(job)
+	if path == "" {
+		return
+	}
+	os.Remove(path) // #nosec a future ReconcileInFlight() will clean up on failure
+}
+
+// ReconcileInFlight looks in ClientInFlightDir for the end states of Jobs that
+// previous runners on this host finished executing but could not tell the
+// server about, and tells the server about them now, as if the original
+// runner had done so. This way the work done is not lost, even if contact with
+// the server was lost for longer than Execute() keeps trying for.
+//
+// End states the server no longer wants (because it has since given the Job
+// to another runner) are discarded. Records of Jobs whose Cmds were still
+// running when their runner died are discarded if the Cmd is no longer
+// running.
+//
+// Call this straight after Connect(), before doing anything else with the
+// Client. Returns the number of Jobs whose end states were successfully
+// reported. Does nothing if ClientInFlightDir has not been set.
+func (c *Client) ReconcileInFlight() (int, error) {
+	if ClientInFlightDir == "" {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(ClientInFlightDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	c.Lock()
+	ourID := c.clientid
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.clientid = ourID
+		c.Unlock()
+	}()
+
+	reconciled := 0
+	for _, entry := range entries {
+		path := filepath.Join(ClientInFlightDir, entry.Name())
+		encoded, errr := ioutil.ReadFile(path)
+		if errr != nil {
+			continue
+		}
+		ifl := &inFlight{}
+		dec := codec.NewDecoderBytes(encoded, c.ch)
+		errr = dec.Decode(ifl)
+		if errr != nil || ifl.Job == nil {
+			os.Remove(path) // #nosec it's unusable anyway
+			continue
+		}
+
+		if ifl.EndState == nil {
+			// the runner died while the Cmd was running; if the Cmd is still
+			// going, leave it be, since the server may yet get to hear about
+			// it via a Touch()
+			if ifl.Job.Pid > 0 && processAlive(ifl.Job.Pid) {
+				continue
+			}
+			os.Remove(path) // #nosec nothing we can do about failure here
+			continue
+		}
+
+		// the server only lets the client that reserved a job end it, so
+		// pretend to be the original runner
+		c.Lock()
+		c.clientid = ifl.ClientID
+		c.Unlock()
+		switch ifl.Action {
+		case inFlightActionBury:
+			errr = c.Bury(ifl.Job, ifl.EndState, ifl.FailReason)
+		case inFlightActionRelease:
+			errr = c.Release(ifl.Job, ifl.EndState, ifl.FailReason)
+		default:
+			errr = c.Archive(ifl.Job, ifl.EndState)
+		}
+		if errr != nil && !jobDisowned(errr) {
+			// the server is probably still unreachable; try again next time
+			return reconciled, errr
+		}
+		os.Remove(path) // #nosec nothing we can do about failure here
+		if errr == nil {
+			reconciled++
+		}
+	}
+	return reconciled, nil
+}
@@ -24,14 +24,13 @@ import (
 	"fmt"
 	"math"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/VertebrateResequencing/muxfys"
 	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/hashicorp/go-multierror"
@@ -89,7 +88,14 @@ var itemsStateToJobState = map[queue.ItemState]JobState{
 // Get*()), you should treat the properties as read-only: changing them will
 // have no effect.
 type Job struct {
-	// Cmd is the actual command line that will be run via the shell.
+	// Cmd is the actual command line that will be run via the shell. It can
+	// contain the variables {CORES}, {MEM} (MB), {DISK} (GB), {TIME}
+	// (seconds), {TMPDIR}, {CWD}, {OUTPUT_DIR} (the final OutputDest) and
+	// {ATTEMPT} (1 for the first attempt), which are replaced when the Job is
+	// Execute()d with the resources it was actually granted and where it is
+	// running, so that eg. "java -Xmx{MEM}m" keeps up with any increase in
+	// Requirements after a failure. (Shell variables like ${MEM} are left
+	// alone.) The Job's key is based on the Cmd before replacement.
 	Cmd string
 
 	// Cwd determines the command working directory, the directory we cd to
@@ -106,9 +112,14 @@ type Job struct {
 	// Cwd, enabling features like tracking disk space usage and clean up of the
 	// working directory by simply deleting the whole thing. The TMPDIR
 	// environment variable is also set to a sister folder of the unique
-	// subfolder, and this is always cleaned up after the Cmd exits.
+	// subfolder, and this is cleaned up after the Cmd exits (unless
+	// SandboxPolicy says otherwise).
 	CwdMatters bool
 
+	// SandboxPolicy controls when the unique subfolder and TMPDIR created
+	// when CwdMatters is false get deleted.
+	SandboxPolicy SandboxPolicy
+
 	// ChangeHome sets the $HOME environment variable to the actual working
 	// directory before running Cmd, but only when CwdMatters is false.
 	ChangeHome bool
@@ -133,6 +144,15 @@ type Job struct {
 	// values.
 	Override uint8
 
+	// IdealCores and IdealRAM (in MB) let you say that Cmd can make use of
+	// more cores and RAM than in its Requirements, which are then treated as
+	// the minimum. The job scheduler will give Cmd as much as it can, up to
+	// these ideals, depending on what is available when it is scheduled. Cmd
+	// can find out what it was given from the WR_CORES and WR_RAM environment
+	// variables. Values no greater than the Requirements are ignored.
+	IdealCores int
+	IdealRAM   int
+
 	// Priority is a number between 0 and 255 inclusive - higher numbered jobs
 	// will run before lower numbered ones (the default is 0).
 	Priority uint8
@@ -140,12 +160,26 @@ type Job struct {
 	// Retries is the number of times to retry running a Cmd if it fails.
 	Retries uint8
 
+	// RetryDelay controls how long to wait after Cmd fails before retrying it.
+	// If not set, retries happen after ClientReleaseDelay.
+	RetryDelay RetryDelay
+
+	// Fallbacks are alternative commands to try, in order, if Cmd still fails
+	// after all its Retries. Each Fallback gets its own set of Retries, and
+	// its runs are recorded as further Attempts of this same Job (which keeps
+	// the key of its Cmd). The Job is only buried once the last Fallback has
+	// run out of Retries.
+	Fallbacks []*Fallback
+
 	// DepGroups are the dependency groups this job belongs to that other jobs
 	// can refer to in their Dependencies.
 	DepGroups []string
 
 	// Dependencies describe the jobs that must be complete before this job
-	// starts.
+	// starts. If one of them gets buried, so does this job (with FailReason
+	// FailReasonParent), until the other job is kicked. Adding jobs whose
+	// Dependencies would form a cycle fails with ErrDependencyCycle. See
+	// Client.GetDependencyTree() to find out what a job is waiting on.
 	Dependencies Dependencies
 
 	// Behaviours describe what should happen after Cmd is executed, depending
@@ -168,6 +202,122 @@ type Job struct {
 	// ActualCwd.
 	MountConfigs MountConfigs
 
+	// ProcessLimits lets you set the umask and resource limits (such as the
+	// maximum number of open files) that Cmd will be run with. By default Cmd
+	// inherits these from the runner that executes it.
+	ProcessLimits ProcessLimits
+
+	// EnforceDisk, when CwdMatters is false and Requirements.Disk is set,
+	// results in Cmd being killed and the job buried if the disk space used
+	// by its unique working directory (including TMPDIR, but excluding any
+	// mounts) exceeds Requirements.Disk, protecting shared scratch space from
+	// runaway commands.
+	EnforceDisk bool
+
+	// OutputDest is where you intend the final outputs of Cmd to end up, eg.
+	// "s3://bucket/results/{repgroup}/{key}/". The placeholders {repgroup},
+	// {reqgroup} and {key} get replaced with the Job's RepGroup, ReqGroup and
+	// unique key when the Job is added to the queue, so that the final value is
+	// predictable and can be queried via status requests. Cmd and any "run"
+	// Behaviours see the final value in the $WR_OUTPUT_DEST environment
+	// variable, so they can upload their results there.
+	OutputDest string
+
+	// KeepStd results in the (truncated) STDOUT and STDERR of Cmd being kept
+	// even when it completes successfully; normally they're only kept for
+	// failed Cmds.
+	KeepStd bool
+
+	// StreamStd results in the STDOUT and STDERR of Cmd being sent to the
+	// server as they are written while it runs, so that they can be followed
+	// with Client.GetStreamedStd().
+	StreamStd bool
+
+	// OutputFilter controls which lines of Cmd's STDOUT and STDERR are kept
+	// (and redacts parts of them) before they get truncated. Defaults to the
+	// Server's ServerConfig.OutputFilter.
+	OutputFilter OutputFilter
+
+	// Container, if set, results in Cmd being run (with Shell) inside the
+	// given docker or singularity container, instead of directly on the
+	// host. The WR_OUTPUTS_SOCKET, WR_METRICS_FILE and WR_METADATA_SOCKET
+	// facilities are mounted in to the container at the same paths, so Cmd can
+	// still use them.
+	Container Container
+
+	// Shell is the shell that Cmd will be run with, eg. "bash", or on Windows,
+	// "cmd" or "powershell". Defaults to the shell the runner was configured to
+	// use.
+	Shell string
+
+	// Secrets are the names of secrets (see Client.SetSecret()) that Cmd
+	// needs. Their values will be in environment variables of the same name
+	// while Cmd runs, but are not stored with the Job.
+	Secrets []string
+
+	// StartRate is the maximum number of Jobs in this Job's RepGroup that
+	// will be allowed to start running per minute. Use this to protect a
+	// shared service that Cmd uses from being overwhelmed when many Jobs
+	// become ready at once. The default of 0 means there is no limit.
+	StartRate int
+
+	// LimitGroups are the names of limit groups this Job belongs to. The
+	// server will not let more Jobs in a limit group run at once than the
+	// group's limit (see Client.SetLimitGroups()), which you can use to
+	// protect shared services used by Jobs in many different RepGroups.
+	// Groups without a limit are unlimited.
+	LimitGroups []string
+
+	// Labels are arbitrary key=value pairs you can use to tag the Job with
+	// information such as sample IDs or project codes, without having to
+	// encode them in RepGroup. You can find incomplete Jobs by their labels
+	// with Client.GetByLabel(), and change them later with
+	// Client.SetLabels().
+	Labels map[string]string
+
+	// CaptureFingerprint, if true, results in a Fingerprint of the host's
+	// environment (OS release, kernel, CPU model, loaded modules and
+	// container image) being recorded when Cmd is executed, and stored with
+	// the Job, so that results can be traced back to the exact environment
+	// that produced them.
+	CaptureFingerprint bool
+
+	// CoreDumps, if true, lets Cmd dump core (up to ClientCoreDumpLimit, unless
+	// ProcessLimits.Core is set). If it does, the core file is gzipped to
+	// CoreDest and its location recorded in CoreFile. Only cores written to
+	// Cmd's working directory are found, so the host's kernel.core_pattern
+	// must be a relative path like "core" or "core.%p".
+	CoreDumps bool
+
+	// CoreDest is the directory core dumps are collected in when CoreDumps is
+	// set. It can be an S3 url specified like: s3://[profile@]bucket/path.
+	// Defaults to a "wr_cores" directory in Cwd.
+	CoreDest string
+
+	// ExecutionReport, if true, has Execute() write an ExecutionReport as JSON
+	// to ClientReportFile in Cmd's actual working directory once Cmd exits,
+	// before any Behaviours are triggered.
+	ExecutionReport bool
+
+	// Datacentre, if set to something other than the Server's own
+	// ServerConfig.Datacentre, has the Job forwarded to the peer manager (see
+	// ServerConfig.Peers) that handles that datacentre, once its dependencies
+	// are satisfied.
+	Datacentre string
+
+	// CallbackURL, if set, is a URL that the Server will POST a JSON
+	// description of the Job to (see CallbackEvent) once it completes or is
+	// buried, so that whoever added it doesn't need to poll for its status.
+	// (It is also POSTed to if StartDeadline.Notify is set and the Job
+	// misses its start deadline.)
+	CallbackURL string
+
+	// StartDeadline, if set, has the Server escalate the Job (eg. by raising
+	// its Priority, or forwarding it to another Datacentre) if it has been
+	// ready to run for a while but has not yet started, so that latency-
+	// sensitive Jobs don't languish behind a full cluster.
+	StartDeadline StartDeadline
+
 	// The remaining properties are used to record information about what
 	// happened when Cmd was executed, or otherwise provide its current state.
 	// It is meaningless to set these yourself.
@@ -175,8 +325,18 @@ type Job struct {
 	// the actual working directory used, which would have been created with a
 	// unique name if CwdMatters = false
 	ActualCwd string
+	// the wrapper (see ServerConfig.CmdWrapper) the Server said Cmd should be
+	// executed through; set when the Job is Reserve()d.
+	Wrapper string
 	// peak RAM (MB) used.
 	PeakRAM int
+	// peak disk space (MB) used in the working directory (and its tmp
+	// directory); only measured if CwdMatters is false.
+	PeakDisk int
+	// the number of cores and RAM (MB) the job scheduler gave Cmd, chosen
+	// from the range allowed by IdealCores and IdealRAM.
+	GrantedCores int
+	GrantedRAM   int
 	// true if the Cmd was run and exited.
 	Exited bool
 	// if the job ran and exited, its exit code is recorded here, but check
@@ -184,9 +344,18 @@ type Job struct {
 	Exitcode int
 	// true if the job was running but we've lost contact with it
 	Lost bool
+	// if the runner running the job crashed, and a later runner on the same
+	// host reported it (see SuperviseRunner()), this describes the crash.
+	RunnerCrash *RunnerCrash
 	// if the job failed to complete successfully, this will hold one of the
 	// FailReason* strings. Also set if Lost == true.
 	FailReason string
+	// the FailCode* corresponding to FailReason, for matching on in
+	// preference to the FailReason text.
+	FailCode string
+	// if the job is buried, this may hold a suggested fix based on
+	// FailReason.
+	Remediation *Remediation
 	// pid of the running or ran process.
 	Pid int
 	// host the process is running or did run on.
@@ -195,12 +364,30 @@ type Job struct {
 	HostID string
 	// host ip the process is running or did run on (cloud specific).
 	HostIP string
+	// the identifier the external job scheduler knows the runner that ran Cmd
+	// by (eg. an LSF job ID or Kubernetes pod name), if any.
+	SchedulerID string
 	// time the cmd started running.
 	StartTime time.Time
 	// time the cmd stopped running.
 	EndTime time.Time
 	// CPU time used.
 	CPUtime time.Duration
+	// the environment Cmd was executed in, if CaptureFingerprint was set.
+	Fingerprint *Fingerprint
+	// the location of the compressed core dump Cmd produced, if CoreDumps was
+	// set and it crashed.
+	CoreFile string
+	// the name of the peer manager the Job was forwarded to because of its
+	// Datacentre, if any. Host etc. then describe where it ran under that
+	// manager.
+	Peer string
+	// files and metrics that Cmd registered as its outputs while it was
+	// running (see RegisterJobOutputs()).
+	Outputs []Artifact
+	// named numeric metrics that Cmd emitted the last time it ran (see
+	// MetricsFileEnvVar).
+	Metrics map[string]float64
 	// to read, call job.StdErr() instead; if the job ran, its (truncated)
 	// STDERR will be here.
 	StdErrC []byte
@@ -221,6 +408,9 @@ type Job struct {
 	State JobState
 	// number of times the job had ever entered 'running' state.
 	Attempts uint32
+	// which command the job is currently trying: 0 for Cmd, 1 for the first
+	// of Fallbacks, and so on.
+	FallbackIndex int
 	// remaining number of Release()s allowed before being buried instead.
 	UntilBuried uint8
 	// we note which client reserved this job, for validating if that client has
@@ -244,11 +434,23 @@ type Job struct {
 
 	// we store the MuxFys that we mount during Mount() so we can Unmount() them
 	// later; this is purely client side
-	mountedFS []*muxfys.MuxFys
+	mountedFS []remoteMount
+
+	// the mount points of the mountedFS, in the same order
+	mountPoints []string
+
+	// temporary credentials minted by the server for Mount() to use; these
+	// are purely client side and never stored
+	mountCreds *MountCredential
 
 	// killCalled is set for running jobs if Kill() is called on them
 	killCalled bool
 
+	// the server uses these to track the memory used by our EnvOverride and
+	// Behaviours, and if they were dropped from memory to stay within budget
+	coldSize    int
+	coldSpilled bool
+
 	sync.RWMutex
 }
 
@@ -349,7 +551,7 @@ func (j *Job) EnvAddOverride(env []string) error {
 // job.Cmd's STDOUT when it ran. If the Cmd hasn't run yet, or if it output
 // nothing to STDOUT, you will get an empty string. Note that StdOutC is only
 // populated if you got the Job from GetByCmd(_, true), and if the Job's Cmd ran
-// but failed.
+// but failed (or KeepStd was set).
 func (j *Job) StdOut() (string, error) {
 	if len(j.StdOutC) == 0 {
 		return "", nil
@@ -365,7 +567,7 @@ func (j *Job) StdOut() (string, error) {
 // job.Cmd's STDERR when it ran. If the Cmd hasn't run yet, or if it output
 // nothing to STDERR, you will get an empty string. Note that StdErrC is only
 // populated if you got the Job from GetByCmd(_, true), and if the Job's Cmd ran
-// but failed.
+// but failed (or KeepStd was set).
 func (j *Job) StdErr() (string, error) {
 	if len(j.StdErrC) == 0 {
 		return "", nil
@@ -384,139 +586,6 @@ func (j *Job) TriggerBehaviours(success bool) error {
 	return j.Behaviours.Trigger(success, j)
 }
 
-// Mount uses the Job's MountConfigs to mount the remote file systems at the
-// desired mount points. If a mount point is unspecified, mounts in the sub
-// folder Cwd/mnt if CwdMatters (and unspecified CacheBase becomes Cwd),
-// otherwise the actual working directory is used as the mount point (and the
-// parent of that used for unspecified CacheBase). Relative CacheDir options
-// are treated relative to the CacheBase.
-func (j *Job) Mount() error {
-	cwd := j.Cwd
-	defaultMount := filepath.Join(j.Cwd, "mnt")
-	defaultCacheBase := cwd
-	if j.ActualCwd != "" {
-		cwd = j.ActualCwd
-		defaultMount = cwd
-		defaultCacheBase = filepath.Dir(cwd)
-	}
-
-	for _, mc := range j.MountConfigs {
-		var rcs []*muxfys.RemoteConfig
-		for _, mt := range mc.Targets {
-			accessorConfig, err := muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
-			if err != nil {
-				_, erru := j.Unmount()
-				if erru != nil {
-					err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-				}
-				return err
-			}
-			accessor, err := muxfys.NewS3Accessor(accessorConfig)
-			if err != nil {
-				_, erru := j.Unmount()
-				if erru != nil {
-					err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-				}
-				return err
-			}
-
-			cacheDir := mt.CacheDir
-			if cacheDir != "" && !filepath.IsAbs(cacheDir) {
-				cacheDir = filepath.Join(defaultCacheBase, cacheDir)
-			}
-			rc := &muxfys.RemoteConfig{
-				Accessor:  accessor,
-				CacheData: mt.Cache,
-				CacheDir:  cacheDir,
-				Write:     mt.Write,
-			}
-
-			rcs = append(rcs, rc)
-		}
-
-		if len(rcs) == 0 {
-			err := fmt.Errorf("No Targets specified")
-			_, erru := j.Unmount()
-			if erru != nil {
-				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-			}
-			return err
-		}
-
-		retries := 10
-		if mc.Retries > 0 {
-			retries = mc.Retries
-		}
-
-		mount := mc.Mount
-		if mount != "" {
-			if !filepath.IsAbs(mount) {
-				mount = filepath.Join(cwd, mount)
-			}
-		} else {
-			mount = defaultMount
-		}
-		cacheBase := mc.CacheBase
-		if cacheBase != "" {
-			if !filepath.IsAbs(cacheBase) {
-				cacheBase = filepath.Join(cwd, cacheBase)
-			}
-		} else {
-			cacheBase = defaultCacheBase
-		}
-		cfg := &muxfys.Config{
-			Mount:     mount,
-			CacheBase: cacheBase,
-			Retries:   retries,
-			Verbose:   mc.Verbose,
-		}
-
-		fs, err := muxfys.New(cfg)
-		if err != nil {
-			_, erru := j.Unmount()
-			if erru != nil {
-				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-			}
-			return err
-		}
-
-		err = fs.Mount(rcs...)
-		if err != nil {
-			_, erru := j.Unmount()
-			if erru != nil {
-				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
-			}
-			return err
-		}
-
-		// (we can't use each fs.UnmountOnDeath() function because that tries
-		// to upload, but if we get killed we don't want that)
-
-		j.mountedFS = append(j.mountedFS, fs)
-	}
-
-	// unmount all on death without trying to upload
-	if len(j.mountedFS) > 0 {
-		deathSignals := make(chan os.Signal, 2)
-		signal.Notify(deathSignals, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-deathSignals
-			var merr *multierror.Error
-			for _, fs := range j.mountedFS {
-				erru := fs.Unmount(true)
-				if erru != nil {
-					merr = multierror.Append(merr, erru)
-				}
-			}
-			if len(merr.Errors) > 0 {
-				panic(merr)
-			}
-		}()
-	}
-
-	return nil
-}
-
 // Unmount unmounts any remote filesystems that were previously mounted with
 // Mount(), returning a string of any log messages generated during the mount.
 // Returns nil error if Mount() had not been called or there were no
@@ -547,6 +616,7 @@ func (j *Job) Unmount(stopUploads ...bool) (logs string, err error) {
 		}
 	}
 	j.mountedFS = nil
+	j.mountPoints = nil
 	if len(allLogs) > 0 {
 		logs = strings.TrimSpace(strings.Join(allLogs, ""))
 	}
@@ -570,6 +640,160 @@ func (j *Job) Unmount(stopUploads ...bool) (logs string, err error) {
 	return logs, err
 }
 
+// clientCopy returns a new Job with the properties of this one that we send to
+// clients, in the given state. Fields that have been spilled to the database
+// are not included. You must hold at least a read lock on this Job.
+func (j *Job) clientCopy(state JobState) *Job {
+	// we're going to fill in some properties of the Job and return
+	// it to client, but don't want those properties set here for
+	// us, so we make a new Job and fill stuff in that
+	req := &scheduler.Requirements{}
+	*req = *j.Requirements // copy reqs since server changes these, avoiding a race condition
+	job := &Job{
+		RepGroup:           j.RepGroup,
+		ReqGroup:           j.ReqGroup,
+		DepGroups:          j.DepGroups,
+		Cmd:                j.Cmd,
+		Cwd:                j.Cwd,
+		CwdMatters:         j.CwdMatters,
+		ChangeHome:         j.ChangeHome,
+		SandboxPolicy:      j.SandboxPolicy,
+		ActualCwd:          j.ActualCwd,
+		Requirements:       req,
+		Priority:           j.Priority,
+		Retries:            j.Retries,
+		RetryDelay:         j.RetryDelay,
+		Fallbacks:          j.Fallbacks,
+		FallbackIndex:      j.FallbackIndex,
+		PeakRAM:            j.PeakRAM,
+		PeakDisk:           j.PeakDisk,
+		Exited:             j.Exited,
+		Exitcode:           j.Exitcode,
+		FailReason:         j.FailReason,
+		FailCode:           FailReasonCode(j.FailReason),
+		StartTime:          j.StartTime,
+		EndTime:            j.EndTime,
+		Pid:                j.Pid,
+		Host:               j.Host,
+		HostID:             j.HostID,
+		SchedulerID:        j.SchedulerID,
+		HostIP:             j.HostIP,
+		CPUtime:            j.CPUtime,
+		State:              state,
+		Attempts:           j.Attempts,
+		UntilBuried:        j.UntilBuried,
+		ReservedBy:         j.ReservedBy,
+		EnvKey:             j.EnvKey,
+		EnvOverride:        j.EnvOverride,
+		Dependencies:       j.Dependencies,
+		Behaviours:         j.Behaviours,
+		MountConfigs:       j.MountConfigs,
+		ProcessLimits:      j.ProcessLimits,
+		EnforceDisk:        j.EnforceDisk,
+		OutputDest:         j.OutputDest,
+		KeepStd:            j.KeepStd,
+		StreamStd:          j.StreamStd,
+		OutputFilter:       j.OutputFilter,
+		Container:          j.Container,
+		Outputs:            j.Outputs,
+		Metrics:            j.Metrics,
+		Shell:              j.Shell,
+		Secrets:            j.Secrets,
+		StartRate:          j.StartRate,
+		LimitGroups:        j.LimitGroups,
+		IdealCores:         j.IdealCores,
+		IdealRAM:           j.IdealRAM,
+		GrantedCores:       j.GrantedCores,
+		GrantedRAM:         j.GrantedRAM,
+		CaptureFingerprint: j.CaptureFingerprint,
+		Fingerprint:        j.Fingerprint,
+		CoreDumps:          j.CoreDumps,
+		CoreDest:           j.CoreDest,
+		CoreFile:           j.CoreFile,
+		ExecutionReport:    j.ExecutionReport,
+		Datacentre:         j.Datacentre,
+		CallbackURL:        j.CallbackURL,
+		StartDeadline:      j.StartDeadline,
+		RunnerCrash:        j.RunnerCrash,
+		Peer:               j.Peer,
+	}
+
+	if !j.StartTime.IsZero() && state == JobStateReserved {
+		job.State = JobStateRunning
+	}
+	if state == JobStateBuried {
+		job.Remediation = j.remediation()
+	}
+	if len(j.Labels) > 0 {
+		job.Labels = make(map[string]string, len(j.Labels))
+		for key, value := range j.Labels {
+			job.Labels[key] = value
+		}
+	}
+	return job
+}
+
+// specCopy returns a new Job with the same user-specified properties as this
+// one, with its own copies of the Requirements and Labels, but without its
+// DepGroups, Dependencies, Datacentre or environment, nor anything about it
+// having been queued or run.
+func (j *Job) specCopy() *Job {
+	var req *scheduler.Requirements
+	if j.Requirements != nil {
+		reqCopy := *j.Requirements
+		reqCopy.Other = make(map[string]string)
+		for key, val := range j.Requirements.Other {
+			reqCopy.Other[key] = val
+		}
+		req = &reqCopy
+	}
+	var labels map[string]string
+	if j.Labels != nil {
+		labels = make(map[string]string, len(j.Labels))
+		for key, val := range j.Labels {
+			labels[key] = val
+		}
+	}
+
+	return &Job{
+		Cmd:                j.Cmd,
+		Cwd:                j.Cwd,
+		CwdMatters:         j.CwdMatters,
+		SandboxPolicy:      j.SandboxPolicy,
+		ChangeHome:         j.ChangeHome,
+		RepGroup:           j.RepGroup,
+		ReqGroup:           j.ReqGroup,
+		Requirements:       req,
+		Override:           j.Override,
+		IdealCores:         j.IdealCores,
+		IdealRAM:           j.IdealRAM,
+		Priority:           j.Priority,
+		Retries:            j.Retries,
+		RetryDelay:         j.RetryDelay,
+		Fallbacks:          j.Fallbacks,
+		Behaviours:         j.Behaviours,
+		MountConfigs:       j.MountConfigs,
+		ProcessLimits:      j.ProcessLimits,
+		EnforceDisk:        j.EnforceDisk,
+		OutputDest:         j.OutputDest,
+		KeepStd:            j.KeepStd,
+		StreamStd:          j.StreamStd,
+		OutputFilter:       j.OutputFilter,
+		Container:          j.Container,
+		Shell:              j.Shell,
+		Secrets:            j.Secrets,
+		StartRate:          j.StartRate,
+		LimitGroups:        j.LimitGroups,
+		Labels:             labels,
+		CaptureFingerprint: j.CaptureFingerprint,
+		CoreDumps:          j.CoreDumps,
+		CoreDest:           j.CoreDest,
+		ExecutionReport:    j.ExecutionReport,
+		CallbackURL:        j.CallbackURL,
+		StartDeadline:      j.StartDeadline,
+	}
+}
+
 // ToEssense converts a Job to its matching JobEssense, taking less space and
 // being required as input for certain methods.
 func (j *Job) ToEssense() *JobEssence {
@@ -586,7 +810,15 @@ func (j *Job) updateAfterExit(jes *JobEndState) {
 	j.Exited = true
 	j.Exitcode = jes.Exitcode
 	j.PeakRAM = jes.PeakRAM
+	j.PeakDisk = jes.PeakDisk
 	j.CPUtime = jes.CPUtime
+	if jes.Fingerprint != nil {
+		j.Fingerprint = jes.Fingerprint
+	}
+	if jes.CoreFile != "" {
+		j.CoreFile = jes.CoreFile
+	}
+	j.Metrics = jes.Metrics
 	j.EndTime = time.Now()
 	if jes.Cwd != "" {
 		j.ActualCwd = jes.Cwd
@@ -595,13 +827,14 @@ func (j *Job) updateAfterExit(jes *JobEndState) {
 }
 
 // updateRecsAfterFailure checks the FailReason and bumps RAM or Time as
-// appropriate.
-func (j *Job) updateRecsAfterFailure() {
+// appropriate. If learned is supplied (the recommended requirements of the
+// Job's ReqGroup), the bump is to at least the learned value, since that is
+// what most similar jobs needed.
+func (j *Job) updateRecsAfterFailure(learned *scheduler.Requirements) {
 	switch j.FailReason {
 	case FailReasonRAM:
 		// increase by 1GB or [100% if under 8GB, 30% if over], whichever is
 		// greater, and round up to nearest 100
-		// *** increase to greater than max seen for jobs in our ReqGroup?
 		updatedMB := float64(j.PeakRAM)
 		if updatedMB <= RAMIncreaseMultBreakpoint {
 			updatedMB *= RAMIncreaseMultLow
@@ -612,13 +845,70 @@ func (j *Job) updateRecsAfterFailure() {
 			updatedMB = float64(j.PeakRAM) + RAMIncreaseMin
 		}
 		j.Requirements.RAM = int(math.Ceil(updatedMB/100) * 100)
+		if learned != nil && learned.RAM > j.Requirements.RAM {
+			j.Requirements.RAM = learned.RAM
+		}
 		j.Override = uint8(1)
 	case FailReasonTime:
 		j.Requirements.Time += 1 * time.Hour
+		if learned != nil && learned.Time > j.Requirements.Time {
+			j.Requirements.Time = learned.Time
+		}
 		j.Override = uint8(1)
 	}
 }
 
+// expandOutputDest replaces the placeholders in OutputDest with their real
+// values.
+func (j *Job) expandOutputDest() {
+	if j.OutputDest == "" || !strings.Contains(j.OutputDest, "{") {
+		return
+	}
+	r := strings.NewReplacer("{repgroup}", j.RepGroup, "{reqgroup}", j.ReqGroup, "{key}", j.key())
+	j.OutputDest = r.Replace(j.OutputDest)
+}
+
+// cmdVarRegex matches the variables that expandCmd() replaces, along with any
+// preceding $, so that shell variables of the same name can be left alone.
+var cmdVarRegex = regexp.MustCompile(`\$?\{(CORES|MEM|DISK|TIME|TMPDIR|CWD|OUTPUT_DIR|ATTEMPT)\}`)
+
+// expandCmd returns the given command line (the Job's Cmd, possibly wrapped)
+// with its variables replaced by their values for this execution of the Job,
+// which was granted the given cores and ram, and is running in cwd with the
+// given tmpDir.
+func (j *Job) expandCmd(cmdLine string, cores, ram int, tmpDir, cwd string) string {
+	if !strings.Contains(cmdLine, "{") {
+		return cmdLine
+	}
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	return cmdVarRegex.ReplaceAllStringFunc(cmdLine, func(match string) string {
+		if strings.HasPrefix(match, "$") {
+			return match
+		}
+		switch match {
+		case "{CORES}":
+			return strconv.Itoa(cores)
+		case "{MEM}":
+			return strconv.Itoa(ram)
+		case "{DISK}":
+			return strconv.Itoa(j.Requirements.Disk)
+		case "{TIME}":
+			return strconv.Itoa(int(j.Requirements.Time.Seconds()))
+		case "{TMPDIR}":
+			return tmpDir
+		case "{CWD}":
+			return cwd
+		case "{OUTPUT_DIR}":
+			return j.OutputDest
+		default:
+			// we haven't Started() yet, so this attempt isn't counted
+			return strconv.Itoa(int(j.Attempts) + 1)
+		}
+	})
+}
+
 // key calculates a unique key to describe the job.
 func (j *Job) key() string {
 	if j.CwdMatters {
@@ -651,6 +941,14 @@ func (j *Job) getSchedulerGroup() string {
 	return j.schedulerGroup
 }
 
+// getLimitGroups provides a thread-safe way of getting the LimitGroups property
+// of a Job.
+func (j *Job) getLimitGroups() []string {
+	j.RLock()
+	defer j.RUnlock()
+	return j.LimitGroups
+}
+
 // setSchedulerGroup provides a thread-safe way of setting the schedulerGroup
 // property of a Job.
 func (j *Job) setSchedulerGroup(newval string) {
@@ -19,12 +19,21 @@
 package jobqueue
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -40,10 +49,12 @@ import (
 	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	bolt "github.com/coreos/bbolt"
 	"github.com/inconshreveable/log15"
 	"github.com/sevlyar/go-daemon"
 	"github.com/shirou/gopsutil/process"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/ugorji/go/codec"
 )
 
 var runnermode bool
@@ -102,998 +113,4492 @@ func TestJobqueueUtils(t *testing.T) {
 		So(tokenMatches(token, token2), ShouldBeFalse)
 		So(tokenMatches(token, token), ShouldBeTrue)
 	})
-}
 
-func TestJobqueue(t *testing.T) {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	if runnermode {
-		// we have a full test of Serve() below that needs a client executable;
-		// we say this test script is that exe, and when --runnermode is passed
-		// to us we skip all tests and just act like a runner
-		runner()
-		return
-	}
+	Convey("currentDisk() works", t, func() {
+		dir, err := ioutil.TempDir("", "wr_jobqueue_test_disk_dir_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
 
-	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
+		empty, err := currentDisk(dir)
+		So(err, ShouldBeNil)
 
-	// load our config to know where our development manager port is supposed to
-	// be; we'll use that to test jobqueue
-	config := internal.ConfigLoad("development", true, testLogger)
-	managerDBBkFile := config.ManagerDbFile + "_bk" // not config.ManagerDbBkFile in case it is an s3 url
-	serverConfig := ServerConfig{
-		Port:            config.ManagerPort,
-		WebPort:         config.ManagerWeb,
-		SchedulerName:   "local",
-		SchedulerConfig: &jqs.ConfigLocal{Shell: config.RunnerExecShell},
-		DBFile:          config.ManagerDbFile,
-		DBFileBackup:    managerDBBkFile,
-		TokenFile:       config.ManagerTokenFile,
-		CAFile:          config.ManagerCAFile,
-		CertFile:        config.ManagerCertFile,
-		CertDomain:      config.ManagerCertDomain,
-		KeyFile:         config.ManagerKeyFile,
-		Deployment:      config.Deployment,
-		Logger:          testLogger,
-	}
-	addr := "localhost:" + config.ManagerPort
+		err = os.MkdirAll(filepath.Join(dir, "cwd", "sub"), os.ModePerm)
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(dir, "cwd", "sub", "file"), make([]byte, 1024*1024), 0600)
+		So(err, ShouldBeNil)
+		err = os.Mkdir(filepath.Join(dir, ".muxfys_cache"), os.ModePerm)
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(dir, ".muxfys_cache", "file"), make([]byte, 1024*1024), 0600)
+		So(err, ShouldBeNil)
 
-	setDomainIP(config.ManagerCertDomain)
+		used, err := currentDisk(dir)
+		So(err, ShouldBeNil)
+		So(used-empty, ShouldBeGreaterThanOrEqualTo, 1024*1024)
+		So(used-empty, ShouldBeLessThan, 2*1024*1024)
 
-	ServerInterruptTime = 10 * time.Millisecond
-	ServerReserveTicker = 10 * time.Millisecond
-	ClientReleaseDelay = 100 * time.Millisecond
-	clientConnectTime := 1500 * time.Millisecond
+		_, err = currentDisk(filepath.Join(dir, "nonexistent"))
+		So(err, ShouldNotBeNil)
+	})
 
-	standardReqs := &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1, Disk: 0, Other: make(map[string]string)}
+	Convey("shellCommand() works", t, func() {
+		cmd := shellCommand("bash", "echo foo")
+		So(cmd.Args, ShouldResemble, []string{"bash", "-c", "echo foo"})
+		cmd = shellCommand(`C:\Windows\System32\WindowsPowerShell\v1.0\PowerShell.exe`, "echo foo")
+		So(cmd.Args[1:], ShouldResemble, []string{"-NoProfile", "-NonInteractive", "-Command", "echo foo"})
+		cmd = shellCommand("cmd.exe", "echo foo")
+		So(cmd.Args[1:], ShouldResemble, []string{"/S", "/C", "echo foo"})
+
+		So(isWindowsShell("bash"), ShouldBeFalse)
+		So(isWindowsShell("/bin/sh"), ShouldBeFalse)
+		So(isWindowsShell("cmd"), ShouldBeTrue)
+		So(isWindowsShell("pwsh"), ShouldBeTrue)
+	})
 
-	// these tests need the server running in it's own pid so we can test signal
-	// handling in the client; to get the server in its own pid we need to
-	// "fork", and that means these must be the first tests to run or else we
-	// won't know in our parent process when our desired server is ready
-	Convey("Once a jobqueue server is up as a daemon", t, func() {
-		ServerItemTTR = 200 * time.Millisecond
-		ClientTouchInterval = 50 * time.Millisecond
+	Convey("ParseProcessLimits() works", t, func() {
+		pl, err := ParseProcessLimits("")
+		So(err, ShouldBeNil)
+		So(pl.IsSet(), ShouldBeFalse)
 
-		errr := os.Remove(config.ManagerTokenFile)
-		So(errr == nil || os.IsNotExist(errr), ShouldBeTrue)
+		pl, err = ParseProcessLimits("umask=0002,nofile=4096,core=0,stack=unlimited,fsize=1G")
+		So(err, ShouldBeNil)
+		So(pl.IsSet(), ShouldBeTrue)
+		So(pl, ShouldResemble, ProcessLimits{Umask: "0002", NoFile: "4096", Core: "0", Stack: "unlimited", FileSize: "1G"})
+		So(pl.String(), ShouldEqual, "umask=0002,nofile=4096,core=0,stack=unlimited,fsize=1G")
 
-		context := &daemon.Context{
-			PidFileName: config.ManagerPidFile,
-			PidFilePerm: 0644,
-			WorkDir:     "/",
-			Umask:       config.ManagerUmask,
-		}
-		child, errc := context.Reborn()
-		if errc != nil {
-			log.Fatalf("failed to daemonize for the initial test: %s (you probably need to `wr manager stop`)", errc)
+		_, err = ParseProcessLimits("umask=0999")
+		So(err, ShouldNotBeNil)
+		_, err = ParseProcessLimits("nofile=1G")
+		So(err, ShouldNotBeNil)
+		_, err = ParseProcessLimits("nproc=10")
+		So(err, ShouldNotBeNil)
+		_, err = ParseProcessLimits("nofile")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Every FailReason has a distinct FailCode", t, func() {
+		codes := make(map[string]bool)
+		for _, reason := range []string{FailReasonEnv, FailReasonCwd, FailReasonStart, FailReasonCPerm, FailReasonCFound, FailReasonCExit, FailReasonExit, FailReasonRAM, FailReasonTime, FailReasonAbnormal, FailReasonLost, FailReasonSignal, FailReasonResource, FailReasonMount, FailReasonUpload, FailReasonKilled, FailReasonLimits, FailReasonDisk, FailReasonSecrets, FailReasonHostSet, FailReasonImage} {
+			code := FailReasonCode(reason)
+			So(code, ShouldNotBeBlank)
+			So(codes[code], ShouldBeFalse)
+			codes[code] = true
+			So(FailCodeReason(code), ShouldEqual, reason)
 		}
-		if child == nil {
-			// daemonized child, that will run until signalled to stop
-			defer context.Release()
+		So(FailReasonCode("foo"), ShouldBeBlank)
+		So(FailCodeReason("foo"), ShouldBeBlank)
 
-			//*** we need a log rotation scheme in place to have this...
-			// logfile, errlog := os.OpenFile(config.ManagerLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			// if errlog == nil {
-			// 	defer logfile.Close()
-			// 	log.SetOutput(logfile)
-			// }
+		jobs := []*Job{{Cmd: "a", FailCode: FailCodeRAM}, {Cmd: "b", FailCode: FailCodeExit}, {Cmd: "c", FailCode: FailCodeRAM}}
+		filtered := FilterJobsByFailCode(jobs, FailCodeRAM)
+		So(len(filtered), ShouldEqual, 2)
+		So(filtered[1].Cmd, ShouldEqual, "c")
+	})
 
-			server, msg, _, err := Serve(serverConfig)
-			if err != nil {
-				log.Fatalf("test daemon failed to start: %s\n", err)
-			}
-			if msg != "" {
-				log.Println(msg)
-			}
+	Convey("ParseRetryDelay() works, and delays are calculated correctly", t, func() {
+		rd, err := ParseRetryDelay("")
+		So(err, ShouldBeNil)
+		So(rd.IsSet(), ShouldBeFalse)
+		now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.Local)
+		So(rd.delayFor(1, now), ShouldEqual, ClientReleaseDelay)
 
-			// we'll Block() later, but just in case the parent tests bomb out
-			// without killing us, we'll stop after 10s
-			go func() {
-				<-time.After(10 * time.Second)
-				log.Println("test daemon stopping after 10s")
-				server.Stop(true)
-			}()
+		rd, err = ParseRetryDelay("delay=1m,backoff=exponential,max=5m,window=22:00-06:00")
+		So(err, ShouldBeNil)
+		So(rd, ShouldResemble, RetryDelay{Delay: "1m", Backoff: "exponential", Max: "5m", Window: "22:00-06:00"})
+		So(rd.String(), ShouldEqual, "delay=1m,backoff=exponential,max=5m,window=22:00-06:00")
+
+		rd.Window = ""
+		So(rd.delayFor(1, now), ShouldEqual, 1*time.Minute)
+		So(rd.delayFor(2, now), ShouldEqual, 2*time.Minute)
+		So(rd.delayFor(3, now), ShouldEqual, 4*time.Minute)
+		So(rd.delayFor(4, now), ShouldEqual, 5*time.Minute)
+		So(rd.delayFor(100, now), ShouldEqual, 5*time.Minute)
+
+		rd = RetryDelay{Delay: "10m", Window: "22:00-06:00"}
+		So(rd.delayFor(1, now), ShouldEqual, 10*time.Hour)
+		So(rd.delayFor(1, now.Add(11*time.Hour)), ShouldEqual, 10*time.Minute)
+		So(rd.delayFor(1, now.Add(17*time.Hour+55*time.Minute)), ShouldEqual, 16*time.Hour+5*time.Minute)
+
+		_, err = ParseRetryDelay("delay=soon")
+		So(err, ShouldNotBeNil)
+		_, err = ParseRetryDelay("backoff=linear")
+		So(err, ShouldNotBeNil)
+		_, err = ParseRetryDelay("window=22:00")
+		So(err, ShouldNotBeNil)
+		_, err = ParseRetryDelay("jitter=1s")
+		So(err, ShouldNotBeNil)
+	})
 
-			log.Println("test daemon up, will block")
+	Convey("ParseStartDeadline() works, and deadlines are tracked", t, func() {
+		sd, err := ParseStartDeadline("")
+		So(err, ShouldBeNil)
+		So(sd.IsSet(), ShouldBeFalse)
 
-			// wait until we are killed
-			err = server.Block()
-			log.Printf("test daemon exiting due to %s\n", err)
-			os.Exit(0)
+		sd, err = ParseStartDeadline("within=30m,priority=200,relax_flavor=true,datacentre=cloud,notify=true")
+		So(err, ShouldBeNil)
+		So(sd, ShouldResemble, StartDeadline{Within: "30m", Priority: 200, RelaxFlavor: true, Datacentre: "cloud", Notify: true})
+		So(sd.String(), ShouldEqual, "within=30m,priority=200,relax_flavor=true,datacentre=cloud,notify=true")
+		So(sd.within(), ShouldEqual, 30*time.Minute)
+
+		for _, bad := range []string{"within=soon,notify=true", "within=1h", "priority=10", "within=1h,priority=256", "within=1h,notify=maybe", "within=1h,page=true", "within"} {
+			_, err = ParseStartDeadline(bad)
+			So(err, ShouldNotBeNil)
 		}
-		// parent; wait a while for our child to bring up the server
-		defer syscall.Kill(child.Pid, syscall.SIGTERM)
 
-		mTimeout := 10 * time.Second
-		internal.WaitForFile(config.ManagerTokenFile, mTimeout)
-		token, err := ioutil.ReadFile(config.ManagerTokenFile)
+		sds := &startDeadlines{jobs: make(map[string]*readyJob)}
+		now := time.Now()
+		sds.ready(&Job{Cmd: "a"}, now)
+		sds.ready(&Job{Cmd: "b", StartDeadline: StartDeadline{Within: "1m", Notify: true}}, now)
+		sds.ready(&Job{Cmd: "c", StartDeadline: StartDeadline{Within: "1h", Notify: true}}, now)
+		left := &Job{Cmd: "d", StartDeadline: StartDeadline{Within: "1m", Notify: true}}
+		sds.ready(left, now)
+		sds.left(left)
+		So(len(sds.jobs), ShouldEqual, 2)
+		So(sds.due(now), ShouldBeEmpty)
+		due := sds.due(now.Add(2 * time.Minute))
+		So(len(due), ShouldEqual, 1)
+		So(due[0].Cmd, ShouldEqual, "b")
+		So(sds.due(now.Add(2*time.Minute)), ShouldBeEmpty)
+		So(len(sds.due(now.Add(2*time.Hour))), ShouldEqual, 1)
+	})
+
+	Convey("ParseOutputFilter() works, and filters apply to command output", t, func() {
+		of, err := ParseOutputFilter("")
 		So(err, ShouldBeNil)
-		So(token, ShouldNotBeNil)
-		jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, 10*time.Second)
+		So(of.IsSet(), ShouldBeFalse)
+		filter, err := of.compile()
 		So(err, ShouldBeNil)
-		defer jq.Disconnect()
+		So(filter, ShouldBeNil)
 
-		So(jq.ServerInfo.PID, ShouldEqual, child.Pid)
+		of, err = ParseOutputFilter(`{"drop":["^Progress"],"redact":["password=\\S+"]}`)
+		So(err, ShouldBeNil)
+		So(of, ShouldResemble, OutputFilter{Drop: []string{"^Progress"}, Redact: []string{"password=\\S+"}})
+		filter, err = of.compile()
+		So(err, ShouldBeNil)
+		So(filter, ShouldNotBeNil)
 
-		Convey("You can set up a long-running job for execution", func() {
-			cmd := "perl -e 'for (1..3) { sleep(1) }'"
-			cmd2 := "perl -e 'for (2..4) { sleep(1) }'"
-			var jobs []*Job
-			jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 4 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "3secs_pass"})
-			jobs = append(jobs, &Job{Cmd: cmd2, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "3secs_fail"})
-			RecSecRound = 1
-			inserts, already, err := jq.Add(jobs, envVars, true)
-			So(err, ShouldBeNil)
-			So(inserts, ShouldEqual, 2)
-			So(already, ShouldEqual, 0)
+		for _, bad := range []string{"drop", `{"drop":"^Progress"}`, `{"keep":["("]}`, `{"redact":["[a-"]}`} {
+			_, err = ParseOutputFilter(bad)
+			So(err, ShouldNotBeNil)
+		}
+		So(OutputFilter{Drop: []string{"*"}}.Validate(), ShouldNotBeNil)
 
-			job, err := jq.Reserve(50 * time.Millisecond)
-			So(err, ShouldBeNil)
-			So(job.Cmd, ShouldEqual, cmd)
-			So(job.State, ShouldEqual, JobStateReserved)
+		output := "line one\nProgress 10%\rProgress 50%\rProgress 100%\nuser=me password=abc123\nlast"
+		var out bytes.Buffer
+		err = <-stdFilter(strings.NewReader(output), &out, filter)
+		So(err, ShouldBeNil)
+		So(out.String(), ShouldEqual, "line one\nuser=me [redacted]\nlast")
 
-			job2, err := jq.Reserve(50 * time.Millisecond)
-			So(err, ShouldBeNil)
-			So(job2.Cmd, ShouldEqual, cmd2)
-			So(job2.State, ShouldEqual, JobStateReserved)
+		filter, err = OutputFilter{Keep: []string{"^line", "^last$"}}.compile()
+		So(err, ShouldBeNil)
+		out.Reset()
+		err = <-stdFilter(strings.NewReader(output), &out, filter)
+		So(err, ShouldBeNil)
+		So(out.String(), ShouldEqual, "line one\nlast")
 
-			Convey("Signals are handled during execution, and we can see when jobs take too long", func() {
-				go func() {
-					<-time.After(2 * time.Second)
-					syscall.Kill(os.Getpid(), syscall.SIGTERM)
-				}()
+		out.Reset()
+		err = <-stdFilter(strings.NewReader(output), &out, nil)
+		So(err, ShouldBeNil)
+		So(out.String(), ShouldEqual, "line one\nProgress 10%\nProgress 50%\nuser=me password=abc123\nlast")
+
+		fw := &filterWriter{out: &out, filter: filter}
+		out.Reset()
+		for _, p := range []string{"li", "ne a\nnot", " kept\nlas", "t"} {
+			n, errw := fw.Write([]byte(p))
+			So(errw, ShouldBeNil)
+			So(n, ShouldEqual, len(p))
+		}
+		So(out.String(), ShouldEqual, "line a\n")
+		So(fw.flush(), ShouldBeNil)
+		So(out.String(), ShouldEqual, "line a\nlast")
+	})
 
-				ClientReleaseDelay = 100 * time.Second
-				j1worked := make(chan bool)
-				go func() {
-					err := jq.Execute(job, config.RunnerExecShell)
-					if err != nil {
-						if jqerr, ok := err.(Error); ok && jqerr.Err == FailReasonSignal && job.State == JobStateDelayed && job.Exited && job.Exitcode == -1 && job.FailReason == FailReasonSignal {
-							j1worked <- true
-						}
-					}
-					j1worked <- false
-				}()
+	Convey("limitGroups track running jobs against their limits", t, func() {
+		lg := newLimitGroups(map[string]int{"a": 1, "b": 0})
+		So(lg.available("key0", nil), ShouldBeTrue)
+		So(lg.available("key0", []string{"a", "c"}), ShouldBeTrue)
+		So(lg.available("key2", []string{"b"}), ShouldBeFalse)
+
+		lg.start("key1", []string{"a", "c"})
+		lg.start("key1", []string{"a", "c"})
+		So(lg.available("key3", []string{"a"}), ShouldBeFalse)
+		So(lg.available("key4", []string{"a", "b"}), ShouldBeFalse)
+		So(lg.available("key0", []string{"c"}), ShouldBeTrue)
+		So(lg.list(), ShouldResemble, []*LimitGroup{{Name: "a", Limit: 1, Running: 1}, {Name: "b", Limit: 0}, {Name: "c", Limit: -1, Running: 1}})
+
+		waiting := lg.set([]*LimitGroup{{Name: "a", Limit: 2}})
+		So(len(waiting), ShouldEqual, 2)
+		So(waiting, ShouldContain, "key3")
+		So(waiting, ShouldContain, "key4")
+		So(lg.available("key3", []string{"a"}), ShouldBeTrue)
+		So(lg.remove([]string{"b"}), ShouldResemble, []string{"key2"})
+		So(lg.available("key2", []string{"b"}), ShouldBeTrue)
+
+		lg.start("key5", []string{"a"})
+		So(lg.available("key6", []string{"a"}), ShouldBeFalse)
+		So(lg.finish("key1", []string{"a", "c"}), ShouldResemble, []string{"key6"})
+		So(lg.finish("key1", []string{"a", "c"}), ShouldBeEmpty)
+		So(lg.finish("key5", []string{"a"}), ShouldBeEmpty)
+		So(lg.list(), ShouldResemble, []*LimitGroup{{Name: "a", Limit: 2}})
+
+		So(validateLimitGroupName("db-writes"), ShouldBeNil)
+		for _, bad := range []string{"", "a,b", "a b"} {
+			So(validateLimitGroupName(bad), ShouldNotBeNil)
+		}
+	})
 
-				j2worked := make(chan bool)
-				go func() {
-					err := jq.Execute(job2, config.RunnerExecShell)
-					if err != nil {
-						if jqerr, ok := err.(Error); ok && jqerr.Err == FailReasonTime && job2.State == JobStateDelayed && job2.Exited && job2.Exitcode == -1 && job2.FailReason == FailReasonTime {
-							j2worked <- true
-						}
-					}
-					j2worked <- false
-				}()
+	Convey("CmdExecutables() and MissingExecutables() find the executables of cmds", t, func() {
+		So(CmdExecutables("bwa mem ref.fa in.fq | samtools sort -o out.bam - && samtools index out.bam"), ShouldResemble, []string{"bwa", "samtools"})
+		So(CmdExecutables("FOO=bar time ./run.sh > out 2>&1; echo done"), ShouldResemble, []string{"./run.sh"})
+		So(CmdExecutables("for f in *.txt; do gzip $f; done"), ShouldResemble, []string{"gzip"})
+		So(CmdExecutables("$TOOL run"), ShouldBeEmpty)
+		So(CmdExecutables("module load samtools && samtools view x"), ShouldBeEmpty)
+		So(CmdExecutables("PATH=/opt/bin:$PATH mytool"), ShouldBeEmpty)
 
-				So(<-j1worked, ShouldBeTrue)
-				So(<-j2worked, ShouldBeTrue)
+		tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_cmdcheck_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		err = ioutil.WriteFile(filepath.Join(tmpdir, "mytool"), []byte("#!/bin/sh\n"), 0755)
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(tmpdir, "notexe"), []byte("#!/bin/sh\n"), 0644)
+		So(err, ShouldBeNil)
 
-				jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-				So(err, ShouldBeNil)
-				defer jq2.Disconnect()
-				job, err = jq2.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
-				So(err, ShouldBeNil)
-				So(job, ShouldNotBeNil)
-				So(job.Cmd, ShouldEqual, cmd)
-				So(job.State, ShouldEqual, JobStateDelayed)
-				So(job.FailReason, ShouldEqual, FailReasonSignal)
+		env := []string{"PATH=/nonexistent:" + tmpdir}
+		So(MissingExecutables("mytool a | notexe b | nosuchtool c", env, ""), ShouldResemble, []string{"notexe", "nosuchtool"})
+		So(MissingExecutables("./mytool && ./nosuchtool", env, ""), ShouldBeEmpty)
+		So(MissingExecutables("./mytool && ./nosuchtool", env, tmpdir), ShouldResemble, []string{filepath.Join(tmpdir, "nosuchtool")})
 
-				job2, err = jq2.GetByEssence(&JobEssence{Cmd: cmd2}, false, false)
-				So(err, ShouldBeNil)
-				So(job2, ShouldNotBeNil)
-				So(job2.Cmd, ShouldEqual, cmd2)
-				So(job2.State, ShouldEqual, JobStateDelayed)
-				So(job2.FailReason, ShouldEqual, FailReasonTime)
-				So(job2.Requirements.Time.Seconds(), ShouldEqual, 3601)
+		job := &Job{Cmd: "nosuchtool", Cwd: tmpdir}
+		missing, err := job.MissingExecutables(env)
+		So(err, ShouldBeNil)
+		So(missing, ShouldResemble, []string{"nosuchtool"})
 
-				ClientReleaseDelay = 100 * time.Millisecond
+		job.Container = Container{Image: "ubuntu:22.04"}
+		missing, err = job.MissingExecutables(env)
+		So(err, ShouldBeNil)
+		So(missing, ShouldBeEmpty)
+	})
 
-				// all signals handled the same way, so no need for further
-				// tests
-			})
+	Convey("ParseContainer() works, and cmds can be wrapped to run in containers", t, func() {
+		c, err := ParseContainer("")
+		So(err, ShouldBeNil)
+		So(c.IsSet(), ShouldBeFalse)
 
-			RecSecRound = 1800 // revert back to normal
+		c, err = ParseContainer(`{"image":"ubuntu:22.04","mounts":["/data/ref:/ref:ro","/scratch"],"env":["REF"],"user":"1000:1000"}`)
+		So(err, ShouldBeNil)
+		So(c, ShouldResemble, Container{Image: "ubuntu:22.04", Mounts: []string{"/data/ref:/ref:ro", "/scratch"}, Env: []string{"REF"}, User: "1000:1000"})
+		So(c.runtime(), ShouldEqual, ContainerRuntimeDocker)
+
+		for _, bad := range []string{"ubuntu", `{"runtime":"docker"}`, `{"image":"a","runtime":"podman"}`, `{"image":"a","runtime":"singularity","user":"root"}`, `{"image":"a","mounts":["data"]}`, `{"image":"a","mounts":["/data:ref"]}`, `{"image":"a","mounts":["/a:/b:/c"]}`, `{"image":"a","env":["NOT-VALID"]}`} {
+			_, err = ParseContainer(bad)
+			So(err, ShouldNotBeNil)
+		}
+
+		job := &Job{Cmd: "echo $REF", Cwd: "/work", Secrets: []string{"TOKEN"}, Container: c}
+		env := []string{"PATH=/bin", "REF=hg38", "TOKEN=secret", "TMPDIR=/work/tmp", "WR_CORES=2"}
+		passEnv := containerPassEnv(job, env)
+		So(passEnv, ShouldContain, "REF")
+		So(passEnv, ShouldContain, "TOKEN")
+		So(passEnv, ShouldContain, "TMPDIR")
+		So(passEnv, ShouldContain, "WR_CORES")
+		So(passEnv, ShouldNotContain, "PATH")
+
+		cr := &containerRun{Container: c, name: "wr_key_1", dir: "/tmp/wr_container1", image: c.Image}
+		cmd := shellCommand("bash", job.Cmd)
+		cmd.Dir = "/work/cwd"
+		cmd.Env = env
+		cr.wrap(cmd, "bash", job.Cmd, "/work", passEnv)
+		So(strings.Join(cmd.Args, " "), ShouldStartWith, "docker run --rm --name wr_key_1 --cidfile /tmp/wr_container1/cid --user 1000:1000 -w /work/cwd -v /work:/work -v /data/ref:/ref:ro -v /scratch:/scratch -e REF -e TOKEN -e TMPDIR -e WR_CORES")
+		So(cmd.Args[len(cmd.Args)-4:], ShouldResemble, []string{"ubuntu:22.04", "bash", "-c", "echo $REF"})
+		So(cmd.Env, ShouldResemble, env)
+
+		c = Container{Runtime: ContainerRuntimeSingularity, Image: "/images/ubuntu.sif", Mounts: []string{"/data/ref:/ref:ro"}, Env: []string{"REF"}}
+		So(c.Validate(), ShouldBeNil)
+		cr = &containerRun{Container: c, image: c.Image}
+		cmd = shellCommand("bash", job.Cmd)
+		cmd.Dir = "/work/cwd"
+		cmd.Env = env
+		cr.wrap(cmd, "bash", job.Cmd, "/work", []string{"REF", "TMPDIR"})
+		So(cmd.Args, ShouldResemble, []string{"singularity", "exec", "--cleanenv", "--pwd", "/work/cwd", "--bind", "/work", "--bind", "/data/ref:/ref:ro", "/images/ubuntu.sif", "bash", "-c", "echo $REF"})
+		So(cmd.Env, ShouldContain, "SINGULARITYENV_REF=hg38")
+		So(cmd.Env, ShouldContain, "SINGULARITYENV_TMPDIR=/work/tmp")
+
+		Convey("The runner's sockets and metrics file are mounted in containers", func() {
+			env = []string{"PATH=/bin", "WR_OUTPUTS_SOCKET=/tmp/wr_outputs1/sock", "WR_METADATA_SOCKET=/tmp/wr_metadata2/sock", "WR_METRICS_FILE=/tmp/wr_metrics3"}
+			So(facilityPaths(env, "/work"), ShouldResemble, []string{"/tmp/wr_outputs1", "/tmp/wr_metadata2", "/tmp/wr_metrics3"})
+			So(facilityPaths(env, "/tmp"), ShouldBeEmpty)
+			So(facilityPaths([]string{"PATH=/bin"}, "/work"), ShouldBeEmpty)
+
+			cr = &containerRun{Container: Container{Image: "ubuntu:22.04"}, name: "wr_key_2", dir: "/tmp/wr_container2", image: "ubuntu:22.04"}
+			cmd = shellCommand("bash", job.Cmd)
+			cmd.Dir = "/work/cwd"
+			cmd.Env = env
+			cr.wrap(cmd, "bash", job.Cmd, "/work", nil)
+			So(strings.Join(cmd.Args, " "), ShouldContainSubstring, "-v /work:/work -v /tmp/wr_outputs1:/tmp/wr_outputs1 -v /tmp/wr_metadata2:/tmp/wr_metadata2 -v /tmp/wr_metrics3:/tmp/wr_metrics3 ubuntu:22.04")
+
+			cr = &containerRun{Container: Container{Runtime: ContainerRuntimeSingularity, Image: "/images/ubuntu.sif"}, image: "/images/ubuntu.sif"}
+			cmd = shellCommand("bash", job.Cmd)
+			cmd.Dir = "/work/cwd"
+			cmd.Env = env
+			cr.wrap(cmd, "bash", job.Cmd, "/work", nil)
+			So(cmd.Args, ShouldResemble, []string{"singularity", "exec", "--cleanenv", "--pwd", "/work/cwd", "--bind", "/work", "--bind", "/tmp/wr_outputs1", "--bind", "/tmp/wr_metadata2", "--bind", "/tmp/wr_metrics3", "/images/ubuntu.sif", "bash", "-c", "echo $REF"})
 		})
 
-		Reset(func() {
-			syscall.Kill(child.Pid, syscall.SIGTERM)
+		Convey("Container memory can be read from cgroup files", func() {
+			tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_cgroup_")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(tmpdir)
+			current := filepath.Join(tmpdir, "memory.current")
+			err = ioutil.WriteFile(current, []byte("52428800\n"), 0600)
+			So(err, ShouldBeNil)
+			mb, err := cgroupMemory([]string{filepath.Join(tmpdir, "memory.peak"), current})
+			So(err, ShouldBeNil)
+			So(mb, ShouldEqual, 50)
+			_, err = cgroupMemory([]string{filepath.Join(tmpdir, "memory.peak")})
+			So(err, ShouldNotBeNil)
 		})
 	})
 
-	<-time.After(5 * time.Second) // wait for the "fork" to really not be listening on the ports any more
+	Convey("Resource values can be parsed and requirements validated", t, func() {
+		mb, err := ParseMemory("3.5G")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 3584)
+		mb, err = ParseMemory(" 200M ")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 200)
+		mb, err = ParseMemory("1TiB")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 1024*1024)
+		mb, err = ParseMemory("1500k")
+		So(err, ShouldBeNil)
+		So(mb, ShouldEqual, 2)
+		for _, bad := range []string{"", "512", "0G", "-1G", "1.5X", "G", "20T"} {
+			_, err = ParseMemory(bad)
+			So(err, ShouldNotBeNil)
+		}
 
-	ServerItemTTR = 1 * time.Second
-	ClientTouchInterval = 500 * time.Millisecond
+		d, err := ParseDuration("2d4h")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 52*time.Hour)
+		d, err = ParseDuration("1w1.5h30s")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 7*24*time.Hour+90*time.Minute+30*time.Second)
+		d, err = ParseDuration("500ms")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, 500*time.Millisecond)
+		for _, bad := range []string{"", "30", "0s", "-1h", "1h 30m", "h", "1y", "400d"} {
+			_, err = ParseDuration(bad)
+			So(err, ShouldNotBeNil)
+		}
 
-	var server *Server
-	var token []byte
-	var errs error
-	Convey("Without the jobserver being up, clients can't connect and time out", t, func() {
-		_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-		So(err, ShouldNotBeNil)
-		jqerr, ok := err.(Error)
-		So(ok, ShouldBeTrue)
-		So(jqerr.Err, ShouldEqual, ErrNoServer)
+		So(validateRequirements(&jqs.Requirements{RAM: 100, Time: time.Hour, Cores: 0}), ShouldBeNil)
+		So(validateRequirements(&jqs.Requirements{RAM: 0, Time: time.Hour, Cores: 1}), ShouldNotBeNil)
+		So(validateRequirements(&jqs.Requirements{RAM: 100, Time: 0, Cores: 1}), ShouldNotBeNil)
+		So(validateRequirements(&jqs.Requirements{RAM: 100, Time: time.Hour, Cores: -1}).Error(), ShouldContainSubstring, "negative")
+		So(validateRequirements(&jqs.Requirements{RAM: MaxRAM + 1, Time: time.Hour, Cores: 1}), ShouldNotBeNil)
+		So(validateRequirements(&jqs.Requirements{RAM: 100, Time: time.Hour, Cores: MaxCores + 1}), ShouldNotBeNil)
+		So(validateRequirements(&jqs.Requirements{RAM: 100, Time: time.Hour, Cores: 1, Disk: MaxDisk + 1}), ShouldNotBeNil)
+		So((&ReqChange{Time: MaxTime + time.Hour}).validate(), ShouldNotBeNil)
+		So((&ReqChange{RAM: 100}).validate(), ShouldBeNil)
 	})
 
-	Convey("Once the jobqueue server is up", t, func() {
-		server, _, token, errs = Serve(serverConfig)
-		So(errs, ShouldBeNil)
+	Convey("ParseSandboxPolicy() works", t, func() {
+		sp, err := ParseSandboxPolicy("")
+		So(err, ShouldBeNil)
+		So(sp.IsSet(), ShouldBeFalse)
+		So(sp.deleteAll(true), ShouldBeFalse)
+		So(sp.keepTmp(false), ShouldBeFalse)
 
-		server.rc = `echo %s %s %s %s %d %d` // ReserveScheduled() only works if we have an rc
+		sp, err = ParseSandboxPolicy("delete=success,keep=3d")
+		So(err, ShouldBeNil)
+		So(sp, ShouldResemble, SandboxPolicy{Delete: "success", Keep: "3d"})
+		So(sp.String(), ShouldEqual, "delete=success,keep=3d")
+		So(sp.deleteAll(true), ShouldBeTrue)
+		So(sp.deleteAll(false), ShouldBeFalse)
+		So(sp.keepTmp(false), ShouldBeTrue)
+		keep, err := sp.keepFor()
+		So(err, ShouldBeNil)
+		So(keep, ShouldEqual, 72*time.Hour)
 
-		Convey("You can connect to the server and add jobs to the queue", func() {
-			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-			So(err, ShouldBeNil)
-			defer jq.Disconnect()
+		sp, err = ParseSandboxPolicy("delete=always,keep=90m")
+		So(err, ShouldBeNil)
+		So(sp.deleteAll(false), ShouldBeTrue)
+		keep, err = sp.keepFor()
+		So(err, ShouldBeNil)
+		So(keep, ShouldEqual, 90*time.Minute)
 
-			So(jq.ServerInfo.Port, ShouldEqual, serverConfig.Port)
-			So(jq.ServerInfo.PID, ShouldBeGreaterThan, 0)
-			So(jq.ServerInfo.Deployment, ShouldEqual, "development")
+		_, err = ParseSandboxPolicy("delete=never")
+		So(err, ShouldNotBeNil)
+		_, err = ParseSandboxPolicy("keep=xd")
+		So(err, ShouldNotBeNil)
+		_, err = ParseSandboxPolicy("keep=-1h")
+		So(err, ShouldNotBeNil)
+		_, err = ParseSandboxPolicy("size=1G")
+		So(err, ShouldNotBeNil)
+	})
 
-			var jobs []*Job
-			for i := 0; i < 10; i++ {
-				pri := i
-				if i == 7 {
-					pri = 4
-				} else if i == 4 {
-					pri = 7
-				}
-				jobs = append(jobs, &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 4 * time.Hour, Cores: 1}, Priority: uint8(pri), Retries: uint8(3), RepGroup: "manually_added"})
-			}
-			inserts, already, err := jq.Add(jobs, envVars, true)
-			So(err, ShouldBeNil)
-			So(inserts, ShouldEqual, 10)
-			So(already, ShouldEqual, 0)
+	Convey("Core dumps can be collected from a cmd's working directory", t, func() {
+		tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_core_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		cwd := filepath.Join(tmpdir, "cwd")
+		err = os.Mkdir(cwd, 0700)
+		So(err, ShouldBeNil)
 
-			Convey("You can't add the same jobs to the queue again", func() {
-				inserts, already, err := jq.Add(jobs, envVars, true)
-				So(err, ShouldBeNil)
-				So(inserts, ShouldEqual, 0)
-				So(already, ShouldEqual, 10)
-			})
+		job := &Job{Cmd: "crash", Cwd: tmpdir, CoreDumps: true}
+		So(job.processLimits().Core, ShouldEqual, ClientCoreDumpLimit)
+		job.ProcessLimits.Core = "1M"
+		So(job.processLimits().Core, ShouldEqual, "1M")
 
-			Convey("You can get back jobs you've just added", func() {
-				job, err := jq.GetByEssence(&JobEssence{Cmd: "test cmd 3"}, false, false)
-				So(err, ShouldBeNil)
-				So(job, ShouldNotBeNil)
-				So(job.Cmd, ShouldEqual, "test cmd 3")
-				So(job.State, ShouldEqual, JobStateReady)
+		started := time.Now()
+		location, err := collectCoreDump(job, cwd, started)
+		So(err, ShouldBeNil)
+		So(location, ShouldBeEmpty)
 
-				job, err = jq.GetByEssence(&JobEssence{Cmd: "test cmd x"}, false, false)
-				So(err, ShouldBeNil)
-				So(job, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(cwd, "core.123"), []byte("core contents"), 0600)
+		So(err, ShouldBeNil)
+		err = ioutil.WriteFile(filepath.Join(cwd, "corefile.txt"), []byte("not a core"), 0600)
+		So(err, ShouldBeNil)
 
-				var jes []*JobEssence
-				for i := 0; i < 10; i++ {
-					jes = append(jes, &JobEssence{Cmd: fmt.Sprintf("test cmd %d", i)})
-				}
-				jobs, err = jq.GetByEssences(jes)
-				So(err, ShouldBeNil)
-				So(len(jobs), ShouldEqual, 10)
-				for i, job := range jobs {
-					So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", i))
-					So(job.State, ShouldEqual, JobStateReady)
-				}
+		location, err = collectCoreDump(job, cwd, started)
+		So(err, ShouldBeNil)
+		So(filepath.Dir(location), ShouldEqual, filepath.Join(tmpdir, coreDumpDir))
+		So(filepath.Base(location), ShouldStartWith, "core."+job.key()+".")
 
-				jobs, err = jq.GetByRepGroup("manually_added", 0, "", false, false)
-				So(err, ShouldBeNil)
-				So(len(jobs), ShouldEqual, 10)
+		_, err = os.Stat(filepath.Join(cwd, "core.123"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+		_, err = os.Stat(filepath.Join(cwd, "corefile.txt"))
+		So(err, ShouldBeNil)
 
-				jobs, err = jq.GetByRepGroup("foo", 0, "", false, false)
-				So(err, ShouldBeNil)
-				So(len(jobs), ShouldEqual, 0)
-			})
+		f, err := os.Open(location)
+		So(err, ShouldBeNil)
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		So(err, ShouldBeNil)
+		content, err := ioutil.ReadAll(zr)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "core contents")
 
-			Convey("You can store their (fake) runtime stats and get recommendations", func() {
-				for index, job := range jobs {
-					job.PeakRAM = index + 1
-					job.StartTime = time.Now()
-					job.EndTime = job.StartTime.Add(time.Duration(index+1) * time.Second)
-					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
-				}
-				<-time.After(100 * time.Millisecond)
-				rmem, err := server.db.recommendedReqGroupMemory("fake_group")
-				So(err, ShouldBeNil)
-				So(rmem, ShouldEqual, 100)
-				rtime, err := server.db.recommendedReqGroupTime("fake_group")
-				So(err, ShouldBeNil)
-				So(rtime, ShouldEqual, 1800)
+		Convey("Old cores and other destinations are handled", func() {
+			old := filepath.Join(cwd, "core")
+			err = ioutil.WriteFile(old, []byte("old core"), 0600)
+			So(err, ShouldBeNil)
+			err = os.Chtimes(old, started.Add(-1*time.Hour), started.Add(-1*time.Hour))
+			So(err, ShouldBeNil)
+			location, err = collectCoreDump(job, cwd, started)
+			So(err, ShouldBeNil)
+			So(location, ShouldBeEmpty)
 
-				for i := 11; i <= 100; i++ {
-					job := &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 4 * time.Hour, Cores: 1}, Retries: uint8(3), RepGroup: "manually_added"}
-					job.PeakRAM = i * 100
-					job.StartTime = time.Now()
-					job.EndTime = job.StartTime.Add(time.Duration(i*100) * time.Second)
-					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
-				}
-				<-time.After(500 * time.Millisecond)
-				rmem, err = server.db.recommendedReqGroupMemory("fake_group")
-				So(err, ShouldBeNil)
-				So(rmem, ShouldEqual, 9500)
-				rtime, err = server.db.recommendedReqGroupTime("fake_group")
-				So(err, ShouldBeNil)
-				So(rtime, ShouldEqual, 10800)
-			})
+			err = os.Chtimes(old, time.Now(), time.Now())
+			So(err, ShouldBeNil)
+			job.CoreDest = filepath.Join(tmpdir, "cores")
+			location, err = collectCoreDump(job, cwd, started)
+			So(err, ShouldBeNil)
+			So(filepath.Dir(location), ShouldEqual, job.CoreDest)
+		})
+	})
 
-			Convey("You can reserve jobs from the queue in the correct order", func() {
-				for i := 9; i >= 0; i-- {
-					jid := i
-					if i == 7 {
-						jid = 4
-					} else if i == 4 {
-						jid = 7
-					}
-					job, err := jq.ReserveScheduled(50*time.Millisecond, "1024:240:1:0")
-					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", jid))
-					So(job.EnvC, ShouldNotBeNil)
-					So(job.State, ShouldEqual, JobStateReserved)
-				}
+	Convey("newFederation() validates peers and routes datacentres", t, func() {
+		tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_federation_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		tokenFile := filepath.Join(tmpdir, "token")
+		err = ioutil.WriteFile(tokenFile, []byte("tok\n"), 0600)
+		So(err, ShouldBeNil)
 
-				Convey("Reserving when all have been reserved returns nil", func() {
-					job, err := jq.ReserveScheduled(50*time.Millisecond, "1024:240:1:0")
-					So(err, ShouldBeNil)
-					So(job, ShouldBeNil)
+		config := ServerConfig{Datacentre: "dc1", Peers: []*Peer{
+			{Name: "a", Addr: "hosta:1234", TokenFile: tokenFile, Datacentres: []string{"dc2", "dc3"}},
+			{Name: "b", Addr: "hostb:1234", TokenFile: tokenFile, Datacentres: []string{"dc4"}},
+		}}
+		fed, err := newFederation(config)
+		So(err, ShouldBeNil)
+		So(fed.routable(""), ShouldBeTrue)
+		So(fed.routable("dc1"), ShouldBeTrue)
+		So(fed.routable("dc3"), ShouldBeTrue)
+		So(fed.routable("dc5"), ShouldBeFalse)
+		So(fed.peerFor("dc1"), ShouldBeNil)
+		pf := fed.peerFor("dc3")
+		So(pf, ShouldNotBeNil)
+		So(pf.Name, ShouldEqual, "a")
+		So(string(pf.token), ShouldEqual, "tok")
+		So(isPeerGroup(pf.group()), ShouldBeTrue)
+		So(isPeerGroup("foo"), ShouldBeFalse)
+		So(fed.peerFor("dc4").Name, ShouldEqual, "b")
+
+		config.Peers[1].Datacentres = []string{"dc2"}
+		_, err = newFederation(config)
+		So(err, ShouldNotBeNil)
 
-					Convey("Adding one while waiting on a Reserve will return the new job", func() {
-						worked := make(chan bool)
-						go func() {
-							job, err := jq.ReserveScheduled(1000*time.Millisecond, "1024:300:1:0")
-							if err != nil {
-								worked <- false
-								return
-							}
-							if job == nil {
-								worked <- false
-								return
-							}
-							if job.Cmd == "new" {
-								worked <- true
-								return
-							}
-							worked <- false
-						}()
+		config.Peers[1].Datacentres = []string{"dc1"}
+		_, err = newFederation(config)
+		So(err, ShouldNotBeNil)
 
-						ok := make(chan bool)
-						go func() {
-							ticker := time.NewTicker(100 * time.Millisecond)
-							ticks := 0
-							for {
-								select {
-								case <-ticker.C:
-									ticks++
-									if ticks == 2 {
-										jobs = append(jobs, &Job{Cmd: "new", Cwd: "/fake/cwd", ReqGroup: "add_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 5 * time.Hour, Cores: 1}, Retries: uint8(3), RepGroup: "manually_added"})
-										gojq, _ := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-										defer gojq.Disconnect()
-										gojq.Add(jobs, envVars, true)
-									}
-									continue
-								case w := <-worked:
-									ticker.Stop()
-									if w && ticks <= 8 {
-										ok <- true
-									}
-									ok <- false
-									return
-								}
-							}
-						}()
+		config.Peers[1].Datacentres = []string{"dc4"}
+		config.Peers[1].Name = "a"
+		_, err = newFederation(config)
+		So(err, ShouldNotBeNil)
 
-						<-time.After(2 * time.Second)
-						So(<-ok, ShouldBeTrue)
-					})
-				})
-			})
+		config.Peers[1].Name = "b"
+		config.Peers[1].TokenFile = filepath.Join(tmpdir, "missing")
+		_, err = newFederation(config)
+		So(err, ShouldNotBeNil)
 
-			Convey("You can subsequently add more jobs", func() {
-				for i := 10; i < 20; i++ {
-					jobs = append(jobs, &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "new_group", Requirements: &jqs.Requirements{RAM: 2048, Time: 1 * time.Hour, Cores: 2}, Retries: uint8(3), RepGroup: "manually_added"})
-				}
-				inserts, already, err := jq.Add(jobs, envVars, true)
-				So(err, ShouldBeNil)
-				So(inserts, ShouldEqual, 10)
-				So(already, ShouldEqual, 10)
+		jobs := []*Job{{Cmd: "a"}, {Cmd: "b"}}
+		nopeers, err := newFederation(ServerConfig{})
+		So(err, ShouldBeNil)
+		dups, err := nopeers.peerDups(jobs, false)
+		So(err, ShouldBeNil)
+		So(dups, ShouldBeEmpty)
+		So(withoutPeerDups(jobs, dups), ShouldResemble, jobs)
+		So(withoutPeerDups(jobs, map[string]string{jobs[0].key(): "a"}), ShouldResemble, jobs[1:])
+	})
 
-				Convey("You can reserve jobs for a particular scheduler group", func() {
-					for i := 10; i < 20; i++ {
-						job, err := jq.ReserveScheduled(20*time.Millisecond, "2048:60:2:0")
-						So(err, ShouldBeNil)
-						So(job, ShouldNotBeNil)
-						So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", i))
-					}
-					job, err := jq.ReserveScheduled(10*time.Millisecond, "2048:60:2:0")
-					So(err, ShouldBeNil)
-					So(job, ShouldBeNil)
+	Convey("readyGrouper works out scheduler groups once per signature", t, func() {
+		lookups := 0
+		rg := newReadyGrouper(func(reqGroup string) *jqs.Requirements {
+			lookups++
+			if reqGroup == "rec" {
+				return &jqs.Requirements{RAM: 2000, Time: 2 * time.Hour}
+			}
+			return nil
+		})
 
-					for i := 9; i >= 0; i-- {
-						jid := i
-						if i == 7 {
-							jid = 4
-						} else if i == 4 {
-							jid = 7
-						}
-						job, err = jq.ReserveScheduled(10*time.Millisecond, "1024:240:1:0")
-						So(err, ShouldBeNil)
-						So(job, ShouldNotBeNil)
-						So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", jid))
-					}
-					job, err = jq.ReserveScheduled(10*time.Millisecond, "1024:240:1:0")
-					So(err, ShouldBeNil)
-					So(job, ShouldBeNil)
-				})
-			})
+		newJob := func(reqGroup string, override uint8, ram int, other map[string]string) *Job {
+			return &Job{ReqGroup: reqGroup, Override: override, Requirements: &jqs.Requirements{RAM: ram, Time: 1 * time.Hour, Cores: 1, Other: other}}
+		}
 
-			Convey("You can add more jobs, but without any environment variables", func() {
-				server.racmutex.Lock()
-				server.rc = ""
-				server.racmutex.Unlock()
-				os.Setenv("wr_jobqueue_test_no_envvar", "a")
-				inserts, already, err := jq.Add([]*Job{{Cmd: "echo $wr_jobqueue_test_no_envvar && false", Cwd: "/tmp", ReqGroup: "new_group", Requirements: standardReqs, Priority: uint8(100), RepGroup: "noenvvar"}}, []string{}, true)
-				So(err, ShouldBeNil)
-				So(inserts, ShouldEqual, 1)
-				So(already, ShouldEqual, 0)
+		j1 := newJob("norec", 0, 100, nil)
+		j2 := newJob("norec", 0, 100, nil)
+		req1, noRec1 := rg.group(j1)
+		req2, noRec2 := rg.group(j2)
+		So(noRec1, ShouldBeTrue)
+		So(noRec2, ShouldBeTrue)
+		So(req2, ShouldEqual, req1)
+		So(req1.RAM, ShouldEqual, 200)
+		So(rg.stringify(req1), ShouldEqual, req1.Stringify())
+		So(lookups, ShouldEqual, 1)
+
+		j3 := newJob("rec", 0, 100, nil)
+		j4 := newJob("rec", 0, 100, nil)
+		req3, noRec3 := rg.group(j3)
+		req4, _ := rg.group(j4)
+		So(noRec3, ShouldBeFalse)
+		So(req4, ShouldEqual, req3)
+		So(j4.Requirements.RAM, ShouldEqual, 2000)
+		So(j4.Requirements.Time, ShouldEqual, 2*time.Hour)
+		So(lookups, ShouldEqual, 2)
+
+		j5 := newJob("rec", 1, 3000, nil)
+		req5, _ := rg.group(j5)
+		So(req5.RAM, ShouldEqual, 3000)
+		So(j5.Requirements.Time, ShouldEqual, 2*time.Hour)
+
+		j6 := newJob("rec", 2, 100, nil)
+		req6, noRec6 := rg.group(j6)
+		So(noRec6, ShouldBeFalse)
+		So(req6.RAM, ShouldEqual, 200)
+
+		j7 := newJob("norec", 0, 100, map[string]string{"a": "b"})
+		j8 := newJob("norec", 0, 100, map[string]string{"a": "c"})
+		req7, _ := rg.group(j7)
+		req8, _ := rg.group(j8)
+		So(req7, ShouldNotEqual, req1)
+		So(rg.stringify(req7), ShouldNotEqual, rg.stringify(req8))
+		So(lookups, ShouldEqual, 2)
+	})
 
-				job, err := jq.Reserve(50 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job, ShouldNotBeNil)
-				So(job.RepGroup, ShouldEqual, "noenvvar")
+	Convey("jobMemory interns strings and keeps to its budget", t, func() {
+		m := newJobMemory(1)
+		newJob := func(cmd string, override int) *Job {
+			return &Job{
+				Cmd:          cmd,
+				Cwd:          strings.Repeat("/cwd", 2),
+				RepGroup:     fmt.Sprintf("rep%d", 1),
+				Requirements: &jqs.Requirements{RAM: 1, Other: map[string]string{"a": "b"}},
+				EnvOverride:  make([]byte, override),
+				Behaviours:   Behaviours{{When: OnSuccess, Do: CleanupAll}},
+			}
+		}
 
-				env, err := job.Env()
-				So(err, ShouldBeNil)
-				So(env, ShouldNotBeEmpty)
+		j1 := newJob("cmd1", 1024*1024-behaviourOverhead)
+		j2 := newJob("cmd2", 10)
+		m.slim(j1)
+		m.slim(j2)
+		So(j1.coldSpilled, ShouldBeFalse)
+		So(j1.coldSize, ShouldEqual, 1024*1024)
+		So(m.held, ShouldEqual, 1024*1024)
+		So(j2.coldSpilled, ShouldBeTrue)
+		So(j2.EnvOverride, ShouldBeNil)
+		So(j2.Behaviours, ShouldBeNil)
+		So(j2.Requirements.Other, ShouldResemble, j1.Requirements.Other)
+		So(len(m.pool.strs), ShouldEqual, 2)
+		So(len(m.pool.others), ShouldEqual, 1)
+
+		m.forget(j1)
+		So(m.held, ShouldEqual, 0)
+		j3 := newJob("cmd3", 10)
+		m.slim(j3)
+		So(j3.coldSpilled, ShouldBeFalse)
+		So(len(j3.EnvOverride), ShouldEqual, 10)
+
+		unlimited := newJobMemory(0)
+		j4 := newJob("cmd4", 10*1024*1024)
+		unlimited.slim(j4)
+		So(j4.coldSpilled, ShouldBeFalse)
+	})
 
-				os.Setenv("wr_jobqueue_test_no_envvar", "b")
-				err = jq.Execute(job, config.RunnerExecShell)
-				So(err, ShouldNotBeNil)
-				So(job.FailReason, ShouldEqual, FailReasonExit)
-				stdout, err := job.StdOut()
-				So(err, ShouldBeNil)
-				So(stdout, ShouldEqual, "b")
+	Convey("sniffWireCodec() recognises each wire encoding", t, func() {
+		cr := &clientRequest{Method: "ping", Timeout: 1 * time.Second, Keys: []string{"a"}}
+		for _, wc := range []WireCodec{WireCodecBinc, WireCodecMsgpack, WireCodecJSON} {
+			h, known := wireHandle(wc)
+			So(known, ShouldBeTrue)
+			var encoded []byte
+			err := codec.NewEncoderBytes(&encoded, h).Encode(cr)
+			So(err, ShouldBeNil)
+			So(sniffWireCodec(encoded), ShouldEqual, wc)
+		}
+		So(sniffWireCodec([]byte(" \n{}")), ShouldEqual, WireCodecJSON)
+		So(sniffWireCodec(nil), ShouldEqual, WireCodecBinc)
+		_, known := wireHandle(WireCodec("foo"))
+		So(known, ShouldBeFalse)
+	})
 
-				// by comparison, compare normal behaviour, where the initial
-				// value of the envvar gets used for the job
-				os.Setenv("wr_jobqueue_test_no_envvar", "a")
-				inserts, already, err = jq.Add([]*Job{{Cmd: "echo $wr_jobqueue_test_no_envvar && false && false", Cwd: "/tmp", ReqGroup: "new_group", Requirements: standardReqs, Priority: uint8(101), RepGroup: "withenvvar"}}, os.Environ(), true)
-				So(err, ShouldBeNil)
-				So(inserts, ShouldEqual, 1)
-				So(already, ShouldEqual, 0)
+	Convey("Databases can be inspected and exported without a manager", t, func() {
+		tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_inspect_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		dbFile := filepath.Join(tmpdir, "db")
 
-				job, err = jq.Reserve(50 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job, ShouldNotBeNil)
-				So(job.RepGroup, ShouldEqual, "withenvvar")
+		boltdb, err := bolt.Open(dbFile, dbFilePermission, nil)
+		So(err, ShouldBeNil)
+		ch := new(codec.BincHandle)
+		jobs := []*Job{
+			{Cmd: "live1", Cwd: "/tmp", RepGroup: "a", State: JobStateBuried},
+			{Cmd: "live2", Cwd: "/tmp", RepGroup: "a"},
+			{Cmd: "running", Cwd: "/tmp", RepGroup: "b"},
+		}
+		complete := &Job{Cmd: "done", Cwd: "/tmp", RepGroup: "a", Exited: true}
+		err = boltdb.Update(func(tx *bolt.Tx) error {
+			for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete, bucketJobsRunning} {
+				if _, errc := tx.CreateBucketIfNotExists(bucket); errc != nil {
+					return errc
+				}
+			}
+			put := func(bucket []byte, job *Job) error {
+				var encoded []byte
+				if erre := codec.NewEncoderBytes(&encoded, ch).Encode(job); erre != nil {
+					return erre
+				}
+				return tx.Bucket(bucket).Put([]byte(job.key()), encoded)
+			}
+			for _, job := range jobs {
+				if errp := put(bucketJobsLive, job); errp != nil {
+					return errp
+				}
+			}
+			if errp := put(bucketJobsComplete, complete); errp != nil {
+				return errp
+			}
+			if errp := tx.Bucket(bucketJobsLive).Put([]byte("bad"), []byte("not a job")); errp != nil {
+				return errp
+			}
+			return tx.Bucket(bucketJobsRunning).Put([]byte(jobs[2].key()), []byte("id"+dbDelimiter+"1"))
+		})
+		So(err, ShouldBeNil)
 
-				env, err = job.Env()
-				So(err, ShouldBeNil)
-				So(env, ShouldNotBeEmpty)
+		Convey("InspectDB() refuses to open a database in use", func() {
+			_, err = InspectDB(dbFile, 10)
+			So(err, ShouldNotBeNil)
+			So(boltdb.Close(), ShouldBeNil)
+		})
 
-				os.Setenv("wr_jobqueue_test_no_envvar", "b")
-				err = jq.Execute(job, config.RunnerExecShell)
-				So(err, ShouldNotBeNil)
-				So(job.FailReason, ShouldEqual, FailReasonExit)
-				stdout, err = job.StdOut()
-				So(err, ShouldBeNil)
-				So(stdout, ShouldEqual, "a")
-			})
+		Convey("InspectDB() reports on the contents", func() {
+			So(boltdb.Close(), ShouldBeNil)
+			err = ioutil.WriteFile(dbFile+dbJournalSuffix, nil, dbFilePermission)
+			So(err, ShouldBeNil)
+			j, errj := os.OpenFile(dbFile+dbJournalSuffix, os.O_WRONLY, dbFilePermission)
+			So(errj, ShouldBeNil)
+			err = codec.NewEncoder(j, ch).Encode(&dbOp{Bucket: bucketJobsRunning, Key: []byte("k"), Delete: true})
+			So(err, ShouldBeNil)
+			So(j.Close(), ShouldBeNil)
 
-			Convey("You can add more jobs, overriding certain environment variables", func() {
-				server.racmutex.Lock()
-				server.rc = ""
-				server.racmutex.Unlock()
-				os.Setenv("wr_jobqueue_test_no_envvar", "a")
-				compressed, err := jq.CompressEnv([]string{"wr_jobqueue_test_no_envvar=c", "wr_jobqueue_test_no_envvar2=d"})
-				So(err, ShouldBeNil)
-				inserts, already, err := jq.Add([]*Job{{
-					Cmd:          "echo $wr_jobqueue_test_no_envvar && echo $wr_jobqueue_test_no_envvar2 && false",
-					Cwd:          "/tmp",
-					RepGroup:     "noenvvar",
-					ReqGroup:     "new_group",
-					Requirements: standardReqs,
-					Priority:     uint8(100),
-					Retries:      uint8(0),
-					EnvOverride:  compressed,
-				}}, []string{}, true)
-				So(err, ShouldBeNil)
-				So(inserts, ShouldEqual, 1)
-				So(already, ShouldEqual, 0)
+			insp, err := InspectDB(dbFile, 1)
+			So(err, ShouldBeNil)
+			So(insp.Size, ShouldBeGreaterThan, 0)
+			So(insp.States, ShouldResemble, map[JobState]int{JobStateBuried: 1, JobStateNew: 1, JobStateRunning: 1, JobStateComplete: 1})
+			So(len(insp.RepGroups), ShouldEqual, 1)
+			So(insp.RepGroups[0].RepGroup, ShouldEqual, "a")
+			So(insp.RepGroups[0].Counts[JobStateComplete], ShouldEqual, 1)
+			So(insp.Buckets[string(bucketJobsLive)], ShouldEqual, 4)
+			So(insp.Buckets[string(bucketJobsRunning)], ShouldEqual, 1)
+			So(insp.JournalOps, ShouldEqual, 1)
+			So(insp.Undecodable, ShouldEqual, 1)
+			So(insp.Problems, ShouldBeEmpty)
+			So(insp.Healthy(), ShouldBeFalse)
+
+			buf := new(bytes.Buffer)
+			n, err := ExportDBJobs(dbFile, buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 4)
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			So(len(lines), ShouldEqual, 4)
+			So(buf.String(), ShouldContainSubstring, `"Cmd":"running"`)
+			So(buf.String(), ShouldContainSubstring, `"State":"running"`)
+		})
+	})
 
-				job, err := jq.Reserve(50 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job, ShouldNotBeNil)
-				So(job.RepGroup, ShouldEqual, "noenvvar")
+	Convey("Mount credentials are minted with a policy limited to the mounted paths", t, func() {
+		targets := []MountTarget{
+			{Path: "bucket/in/put/"},
+			{Path: "/other", Write: true},
+			{Path: "public/data", Anonymous: true},
+		}
+		policy, err := mountPolicy(targets)
+		So(err, ShouldBeNil)
+		doc := &policyDocument{}
+		err = json.Unmarshal([]byte(policy), doc)
+		So(err, ShouldBeNil)
+		So(len(doc.Statement), ShouldEqual, 4)
+		So(doc.Statement[0].Resource, ShouldResemble, []string{"arn:aws:s3:::bucket"})
+		So(doc.Statement[0].Condition["StringLike"]["s3:prefix"], ShouldResemble, []string{"in/put", "in/put/*"})
+		So(doc.Statement[1].Resource, ShouldResemble, []string{"arn:aws:s3:::bucket/in/put/*"})
+		So(doc.Statement[1].Action, ShouldResemble, []string{"s3:GetObject"})
+		So(doc.Statement[2].Condition, ShouldBeNil)
+		So(doc.Statement[3].Resource, ShouldResemble, []string{"arn:aws:s3:::other/*"})
+		So(doc.Statement[3].Action, ShouldContain, "s3:PutObject")
+
+		_, err = mountPolicy(targets[2:])
+		So(err, ShouldNotBeNil)
 
-				env, err := job.Env()
-				So(err, ShouldBeNil)
-				So(env, ShouldNotBeEmpty)
+		var got url.Values
+		var auth string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			errp := r.ParseForm()
+			So(errp, ShouldBeNil)
+			got = r.PostForm
+			auth = r.Header.Get("Authorization")
+			if got.Get("RoleArn") != "arn:role" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>nope</Message></Error></ErrorResponse>`)
+				return
+			}
+			fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>AK</AccessKeyId><SecretAccessKey>SK</SecretAccessKey><SessionToken>TOK</SessionToken><Expiration>2030-01-02T03:04:05Z</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+		}))
+		defer ts.Close()
 
-				os.Setenv("wr_jobqueue_test_no_envvar", "b")
-				err = jq.Execute(job, config.RunnerExecShell)
-				So(err, ShouldNotBeNil)
-				So(job.FailReason, ShouldEqual, FailReasonExit)
-				stdout, err := job.StdOut()
-				So(err, ShouldBeNil)
-				So(stdout, ShouldEqual, "c\nd")
-			})
+		minter := &STSMinter{Endpoint: ts.URL, RoleARN: "arn:role", AccessKey: "base", SecretKey: "secret", MaxLifetime: 2 * time.Hour}
+		creds, err := minter.Mint("wr-key", targets, 2*time.Hour)
+		So(err, ShouldBeNil)
+		So(creds.AccessKey, ShouldEqual, "AK")
+		So(creds.SecretKey, ShouldEqual, "SK")
+		So(creds.SessionToken, ShouldEqual, "TOK")
+		So(creds.Expiration.Year(), ShouldEqual, 2030)
+		So(got.Get("Action"), ShouldEqual, "AssumeRole")
+		So(got.Get("RoleSessionName"), ShouldEqual, "wr-key")
+		So(got.Get("DurationSeconds"), ShouldEqual, "7200")
+		So(got.Get("Policy"), ShouldEqual, policy)
+		So(auth, ShouldStartWith, "AWS4-HMAC-SHA256 Credential=base/")
+		So(auth, ShouldContainSubstring, "/us-east-1/sts/aws4_request")
+
+		_, err = minter.Mint("wr-key", targets, 1*time.Minute)
+		So(err, ShouldBeNil)
+		So(got.Get("DurationSeconds"), ShouldEqual, "900")
 
-			Convey("You can stop the server by sending it a SIGTERM or SIGINT", func() {
-				jq.Disconnect()
+		// credentials aren't refreshed, so we refuse to mint ones that would
+		// expire too soon
+		got = nil
+		_, err = minter.Mint("wr-key", targets, 3*time.Hour)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "can only be minted for 2h0m0s")
+		So(got, ShouldBeNil)
 
-				syscall.Kill(os.Getpid(), syscall.SIGTERM)
-				<-time.After(ClientTouchInterval)
-				<-time.After(ClientTouchInterval)
-				_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-				So(err, ShouldNotBeNil)
-				jqerr, ok := err.(Error)
-				So(ok, ShouldBeTrue)
-				So(jqerr.Err, ShouldEqual, ErrNoServer)
+		minter.RoleARN = "arn:other"
+		_, err = minter.Mint("wr-key", targets, 1*time.Hour)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "AccessDenied")
+	})
 
-				server, _, token, errs = Serve(serverConfig)
-				So(errs, ShouldBeNil)
+	Convey("Accounting records of other job schedulers can be parsed in to ReqGroupSamples", t, func() {
+		sacct := "JobID|JobName|State|Elapsed|MaxRSS\n" +
+			"100|samtools|COMPLETED|01:00:00|\n" +
+			"100.batch|batch|COMPLETED|01:00:00|1500M\n" +
+			"100.extern|extern|COMPLETED|01:00:00|1024K\n" +
+			"101|/usr/bin/bwa|COMPLETED|1-00:00:30|\n" +
+			"101.batch|batch|COMPLETED|1-00:00:30|1.5G\n" +
+			"102|samtools|FAILED|00:10|\n" +
+			"102.batch|batch|FAILED|00:10|1G\n"
+		samples, err := ParseSacct(strings.NewReader(sacct))
+		So(err, ShouldBeNil)
+		So(len(samples), ShouldEqual, 2)
+		So(*samples[0], ShouldResemble, ReqGroupSample{ReqGroup: "samtools", RAM: 1500, Time: 1 * time.Hour})
+		So(*samples[1], ShouldResemble, ReqGroupSample{ReqGroup: "bwa", RAM: 1536, Time: 24*time.Hour + 30*time.Second})
 
-				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-				So(err, ShouldBeNil)
-				jq.Disconnect()
+		_, err = ParseSacct(strings.NewReader("JobID|JobName\n1|foo\n"))
+		So(err, ShouldNotBeNil)
 
-				syscall.Kill(os.Getpid(), syscall.SIGINT)
-				<-time.After(ClientTouchInterval)
-				<-time.After(ClientTouchInterval)
-				_, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-				So(err, ShouldNotBeNil)
-				jqerr, ok = err.(Error)
-				So(ok, ShouldBeTrue)
-				So(jqerr.Err, ShouldEqual, ErrNoServer)
-			})
+		record := func(jStatus int, cmd string) string {
+			return `"JOB_FINISH" "10.1" 1500003600 123 1000 0 1 1500000000 0 0 1500000000 "user" "normal" "" "" "" "host1" "/cwd" "" "" "" "1500000000.123" 1 "hostA" 2 "h1" "h1" ` +
+				fmt.Sprintf(`%d 1.00 "myjob" "%s" `, jStatus, cmd) + strings.Repeat("0.0 ", 19) + `"" "default" 0 1 "" "" 0 2048000 0`
+		}
+		lsbAcct := `"JOB_NEW" "10.1" 1500000000 123` + "\n" +
+			record(64, `/software/bin/bwa mem ""my ref.fa"" reads.fq`) + "\n" +
+			record(32, "samtools sort x") + "\n"
+		samples, err = ParseLSFAcct(strings.NewReader(lsbAcct))
+		So(err, ShouldBeNil)
+		So(len(samples), ShouldEqual, 1)
+		So(*samples[0], ShouldResemble, ReqGroupSample{ReqGroup: "bwa", RAM: 2000, Time: 1 * time.Hour})
 
-			Convey("You get a nice error if you send the server junk", func() {
-				_, err := jq.request(&clientRequest{Method: "junk"})
-				So(err, ShouldNotBeNil)
-				jqerr, ok := err.(Error)
-				So(ok, ShouldBeTrue)
-				So(jqerr.Err, ShouldEqual, ErrUnknownCommand)
-				jq.Disconnect()
-			})
-		})
+		So(splitLSFRecord(`"a ""b""" 1 "" c`), ShouldResemble, []string{`a "b"`, "1", "", "c"})
+	})
 
-		Reset(func() {
-			server.Stop(true)
-		})
+	Convey("Protocol versions are checked for compatibility", t, func() {
+		So(protocolCompatible(ProtocolVersion, MinProtocolVersion), ShouldBeTrue)
+		So(protocolCompatible(0, 0), ShouldBeFalse)
+		So(protocolCompatible(ProtocolVersion+1, MinProtocolVersion), ShouldBeTrue)
+		So(protocolCompatible(ProtocolVersion+1, ProtocolVersion+1), ShouldBeFalse)
+
+		err := VersionError{ClientVersion: "v0.19.0", ClientProtocol: 3, ServerVersion: "v0.12.0", ServerProtocol: 1}
+		So(err.Error(), ShouldEqual, "client v0.19.0 (protocol 3) cannot talk to manager v0.12.0 (protocol 1), please upgrade the manager")
+		err = VersionError{ClientProtocol: 0, ServerVersion: "v0.19.0", ServerProtocol: 3}
+		So(err.Error(), ShouldEqual, "client of unknown version (protocol 0) cannot talk to manager v0.19.0 (protocol 3), please upgrade the client")
 	})
 
-	if server != nil {
-		server.Stop(true)
-	}
+	Convey("Slow client requests are logged with their details", t, func() {
+		var logged []*log15.Record
+		logger := log15.New()
+		logger.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+			logged = append(logged, r)
+			return nil
+		}))
+		s := &Server{slowRequest: 20 * time.Millisecond, timings: make(map[string]*timingAvg), Logger: logger}
+
+		rt := s.timeRequest("add", 100)
+		s.requestDone(rt, 10)
+		So(logged, ShouldBeEmpty)
+
+		rt = s.timeRequest("add", 100)
+		<-time.After(25 * time.Millisecond)
+		s.requestDone(rt, 10)
+		So(len(logged), ShouldEqual, 1)
+		So(logged[0].Msg, ShouldEqual, "slow request")
+		ctx := make(map[string]interface{})
+		for i := 0; i < len(logged[0].Ctx)-1; i += 2 {
+			ctx[logged[0].Ctx[i].(string)] = logged[0].Ctx[i+1]
+		}
+		So(ctx["method"], ShouldEqual, "add")
+		So(ctx["requestBytes"], ShouldEqual, 100)
+		So(ctx["replyBytes"], ShouldEqual, 10)
+		So(ctx["queueLockWait"], ShouldEqual, time.Duration(0))
+		So(ctx["took"], ShouldBeGreaterThanOrEqualTo, 25*time.Millisecond)
+
+		s.slowRequest = 0
+		rt = s.timeRequest("add", 100)
+		<-time.After(25 * time.Millisecond)
+		s.requestDone(rt, 10)
+		So(len(logged), ShouldEqual, 1)
+	})
 
-	// start these tests anew because I don't want to mess with the timings in
-	// the above tests
-	Convey("Once a new jobqueue server is up", t, func() {
-		ServerItemTTR = 200 * time.Millisecond
-		ClientTouchInterval = 50 * time.Millisecond
-		server, _, token, errs = Serve(serverConfig)
-		So(errs, ShouldBeNil)
+	Convey("Commands that spawn other processes are accounted for and killed as a group", t, func() {
+		if runtime.GOOS != "linux" {
+			SkipSo("process groups are only tracked via /proc on linux", ShouldBeTrue)
+			return
+		}
+		cmd := exec.Command("bash", "-c", "sleep 30 & sleep 30 & wait") // #nosec
+		setProcessGroup(cmd)
+		err := cmd.Start()
+		So(err, ShouldBeNil)
+		pid := cmd.Process.Pid
+		<-time.After(500 * time.Millisecond)
 
-		Convey("You can connect, and add some real jobs", func() {
-			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-			So(err, ShouldBeNil)
-			defer jq.Disconnect()
-			jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
-			So(err, ShouldBeNil)
-			defer jq2.Disconnect()
+		pids := groupPids(pid)
+		So(pids[0], ShouldEqual, pid)
+		So(len(pids), ShouldEqual, 3)
+		leader, err := currentMemory(pid)
+		So(err, ShouldBeNil)
+		mem, err := groupMemory(pid)
+		So(err, ShouldBeNil)
+		So(mem, ShouldBeGreaterThanOrEqualTo, leader)
 
-			var jobs []*Job
-			jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(2), RepGroup: "manually_added"})
-			jobs = append(jobs, &Job{Cmd: "sleep 0.1 && false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(2), RepGroup: "manually_added"})
-			inserts, already, err := jq.Add(jobs, envVars, true)
-			So(err, ShouldBeNil)
-			So(inserts, ShouldEqual, 2)
-			So(already, ShouldEqual, 0)
+		err = killProcessGroup(cmd)
+		So(err, ShouldBeNil)
+		err = cmd.Wait()
+		So(err, ShouldNotBeNil)
+		<-time.After(100 * time.Millisecond)
+		for _, p := range pids[1:] {
+			stat, errr := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", p))
+			if errr == nil {
+				So(string(stat), ShouldContainSubstring, ") Z ")
+			}
+		}
+	})
 
-			Convey("You can't execute a job without reserving it", func() {
-				err := jq.Execute(jobs[0], config.RunnerExecShell)
-				So(err, ShouldNotBeNil)
-				jqerr, ok := err.(Error)
-				So(ok, ShouldBeTrue)
-				So(jqerr.Err, ShouldEqual, ErrMustReserve)
-				jq.Disconnect()
-			})
+	Convey("Supervised runners that panic or get killed are reported as crashed", t, func() {
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", "echo starting >&2; echo 'panic: oh no' >&2; echo 'goroutine 1 [running]:' >&2; exit 2") // #nosec
+		cmd.Stderr = &stderr
+		code, crash, err := SuperviseRunner(cmd)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, 2)
+		So(crash, ShouldNotBeNil)
+		So(crash.Reason, ShouldEqual, RunnerCrashPanic)
+		So(crash.Detail, ShouldEqual, "panic: oh no\ngoroutine 1 [running]:")
+		So(crash.PID, ShouldBeGreaterThan, 0)
+		So(stderr.String(), ShouldStartWith, "starting\n")
+
+		cmd = exec.Command("sh", "-c", "kill -9 $$") // #nosec
+		code, crash, err = SuperviseRunner(cmd)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, 128+9)
+		So(crash, ShouldNotBeNil)
+		So(crash.Reason, ShouldBeIn, []string{RunnerCrashSignal, RunnerCrashOOM})
 
-			Convey("Once reserved you can execute jobs, and other clients see the correct state on gets", func() {
-				// job that succeeds, no std out
-				job, err := jq.Reserve(50 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job.Cmd, ShouldEqual, "sleep 0.1 && true")
-				So(job.State, ShouldEqual, JobStateReserved)
-				So(job.Attempts, ShouldEqual, 0)
-				So(job.UntilBuried, ShouldEqual, 3)
+		cmd = exec.Command("sh", "-c", "echo 'panic: not go' >&2; exit 1") // #nosec
+		cmd.Stderr = &stderr
+		code, crash, err = SuperviseRunner(cmd)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, 1)
+		So(crash, ShouldBeNil)
 
-				job2, err := jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && true"}, false, false)
-				So(err, ShouldBeNil)
-				So(job2, ShouldNotBeNil)
-				So(job2.Cmd, ShouldEqual, "sleep 0.1 && true")
-				So(job2.State, ShouldEqual, JobStateReserved)
+		cmd = exec.Command("true") // #nosec
+		code, crash, err = SuperviseRunner(cmd)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, 0)
+		So(crash, ShouldBeNil)
+	})
 
-				err = jq.Execute(job, config.RunnerExecShell)
-				So(err, ShouldBeNil)
-				So(job.State, ShouldEqual, JobStateComplete)
-				So(job.Exited, ShouldBeTrue)
-				So(job.Exitcode, ShouldEqual, 0)
-				So(job.PeakRAM, ShouldBeGreaterThan, 0)
-				So(job.Pid, ShouldBeGreaterThan, 0)
-				host, _ := os.Hostname()
-				So(job.Host, ShouldEqual, host)
-				So(job.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
-				So(job.CPUtime, ShouldBeGreaterThanOrEqualTo, 0*time.Millisecond)
-				So(job.Attempts, ShouldEqual, 1)
-				So(job.UntilBuried, ShouldEqual, 3)
-				stdout, err := job.StdOut()
-				So(err, ShouldBeNil)
-				So(stdout, ShouldEqual, "")
-				stderr, err := job.StdErr()
-				So(err, ShouldBeNil)
-				So(stderr, ShouldEqual, "")
-				actualCwd := job.ActualCwd
-				So(actualCwd, ShouldStartWith, filepath.Join("/tmp", "jobqueue_cwd", "7", "4", "7", "27e23009c78b126f274aa64416f30"))
-				So(actualCwd, ShouldEndWith, "cwd")
+	Convey("Environments can be filtered before capture", t, func() {
+		env := []string{"PATH=/bin", "HOME=/home/u", "LC_ALL=C", "AWS_SECRET_ACCESS_KEY=x", "MY_TOKEN=y", "OTHER=z=z"}
 
-				job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && true"}, false, false)
-				So(err, ShouldBeNil)
-				So(job2, ShouldNotBeNil)
-				So(job2.State, ShouldEqual, JobStateComplete)
-				So(job2.Exited, ShouldBeTrue)
-				So(job2.Exitcode, ShouldEqual, 0)
-				So(job2.PeakRAM, ShouldEqual, job.PeakRAM)
-				So(job2.Pid, ShouldEqual, job.Pid)
-				So(job2.Host, ShouldEqual, host)
-				So(job2.WallTime(), ShouldBeLessThanOrEqualTo, job.WallTime())
-				So(job2.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
-				So(job2.CPUtime, ShouldEqual, job.CPUtime)
-				So(job2.Attempts, ShouldEqual, 1)
-				So(job2.ActualCwd, ShouldEqual, actualCwd)
+		So(FilterEnv(env, nil, nil), ShouldResemble, env)
+		So(FilterEnv(env, EnvMinimal, nil), ShouldResemble, []string{"PATH=/bin", "HOME=/home/u", "LC_ALL=C"})
+		So(FilterEnv(env, nil, []string{"AWS_*", "*TOKEN*"}), ShouldResemble, []string{"PATH=/bin", "HOME=/home/u", "LC_ALL=C", "OTHER=z=z"})
+		So(FilterEnv(env, []string{"OTHER", "MY_*"}, []string{"*TOKEN"}), ShouldResemble, []string{"OTHER=z=z"})
+	})
 
-				// job that fails, no std out
-				job, err = jq.Reserve(50 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
-				So(job.State, ShouldEqual, JobStateReserved)
-				So(job.Attempts, ShouldEqual, 0)
-				So(job.UntilBuried, ShouldEqual, 3)
+	Convey("jobStreams hold the end of streamed output for a while", t, func() {
+		js := newJobStreams()
+		js.write("a", &StreamedStd{StdOut: []byte("foo"), StdErr: []byte("e")})
+		js.write("a", &StreamedStd{StdOut: []byte("bar")})
+
+		std := js.read("a", nil)
+		So(string(std.StdOut), ShouldEqual, "foobar")
+		So(string(std.StdErr), ShouldEqual, "e")
+		So(std.StdOutOffset, ShouldEqual, 6)
+		So(std.StdErrOffset, ShouldEqual, 1)
+		std = js.read("a", &StreamedStd{StdOutOffset: 4, StdErrOffset: 1})
+		So(string(std.StdOut), ShouldEqual, "ar")
+		So(std.StdErr, ShouldBeEmpty)
+		So(std.StdErrOffset, ShouldEqual, 1)
+
+		std = js.read("b", &StreamedStd{StdOutOffset: 3})
+		So(std.StdOut, ShouldBeEmpty)
+		So(std.StdOutOffset, ShouldEqual, 3)
+
+		// only the last jobStreamMax bytes are kept, and readers that fell
+		// behind get what's left
+		js.write("a", &StreamedStd{StdOut: bytes.Repeat([]byte("x"), jobStreamMax)})
+		std = js.read("a", &StreamedStd{StdOutOffset: 6})
+		So(len(std.StdOut), ShouldEqual, jobStreamMax)
+		So(std.StdOutOffset, ShouldEqual, jobStreamMax+6)
+		std = js.read("a", nil)
+		So(len(std.StdOut), ShouldEqual, jobStreamMax)
+		So(string(std.StdOut[:1]), ShouldEqual, "x")
+
+		origKeep := jobStreamKeep
+		jobStreamKeep = 0
+		defer func() {
+			jobStreamKeep = origKeep
+		}()
+		<-time.After(time.Millisecond)
+		std = js.read("a", nil)
+		So(std.StdOut, ShouldBeEmpty)
+		So(js.streams, ShouldBeEmpty)
+	})
 
-				err = jq.Execute(job, config.RunnerExecShell)
-				So(err, ShouldNotBeNil)
-				So(err.Error(), ShouldEqual, "command [sleep 0.1 && false] exited with code 1, which may be a temporary issue, so it will be tried again")
-				So(job.State, ShouldEqual, JobStateDelayed)
-				So(job.Exited, ShouldBeTrue)
-				So(job.Exitcode, ShouldEqual, 1)
-				So(job.PeakRAM, ShouldBeGreaterThan, 0)
-				So(job.Pid, ShouldBeGreaterThan, 0)
-				So(job.Host, ShouldEqual, host)
-				So(job.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
-				So(job.CPUtime, ShouldBeGreaterThanOrEqualTo, 0*time.Millisecond)
-				So(job.Attempts, ShouldEqual, 1)
-				So(job.UntilBuried, ShouldEqual, 2)
-				stdout, err = job.StdOut()
-				So(err, ShouldBeNil)
-				So(stdout, ShouldEqual, "")
-				stderr, err = job.StdErr()
-				So(err, ShouldBeNil)
-				So(stderr, ShouldEqual, "")
+	Convey("The database journal applies operations in batches and survives crashes", t, func() {
+		tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_journal_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		origInterval := DBJournalApplyInterval
+		DBJournalApplyInterval = 1 * time.Hour
+		defer func() {
+			DBJournalApplyInterval = origInterval
+		}()
 
-				job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
-				So(err, ShouldBeNil)
+		dbFile := filepath.Join(tmpdir, "db")
+		boltdb, err := bolt.Open(dbFile, dbFilePermission, nil)
+		So(err, ShouldBeNil)
+		defer boltdb.Close()
+		err = boltdb.Update(func(tx *bolt.Tx) error {
+			_, errc := tx.CreateBucketIfNotExists(bucketJobsRunning)
+			return errc
+		})
+		So(err, ShouldBeNil)
+
+		get := func(key string) []byte {
+			var val []byte
+			errv := boltdb.View(func(tx *bolt.Tx) error {
+				val = tx.Bucket(bucketJobsRunning).Get([]byte(key))
+				return nil
+			})
+			So(errv, ShouldBeNil)
+			return val
+		}
+
+		ch := new(codec.BincHandle)
+		j, err := openJournal(dbFile+dbJournalSuffix, boltdb, ch, testLogger)
+		So(err, ShouldBeNil)
+		err = j.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte("a"), Val: []byte("1")}, &dbOp{Bucket: bucketJobsRunning, Key: []byte("b"), Val: []byte("2")})
+		So(err, ShouldBeNil)
+		err = j.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte("a"), Delete: true})
+		So(err, ShouldBeNil)
+		So(get("b"), ShouldBeNil)
+
+		// a new journal on the same file, as if we had crashed and restarted,
+		// applies what was recorded
+		j2, err := openJournal(dbFile+dbJournalSuffix, boltdb, ch, testLogger)
+		So(err, ShouldBeNil)
+		So(get("a"), ShouldBeNil)
+		So(string(get("b")), ShouldEqual, "2")
+		info, err := os.Stat(dbFile + dbJournalSuffix)
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 0)
+
+		// closing applies anything still pending
+		err = j2.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte("c"), Val: []byte("3")})
+		So(err, ShouldBeNil)
+		So(get("c"), ShouldBeNil)
+		err = j2.close()
+		So(err, ShouldBeNil)
+		So(string(get("c")), ShouldEqual, "3")
+
+		// recording after closing fails instead of hanging
+		err = j2.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte("f"), Val: []byte("6")})
+		So(err, ShouldEqual, errJournalClosed)
+		So(get("f"), ShouldBeNil)
+		err = j.close()
+		So(err, ShouldBeNil)
+
+		// a partial record left by a crash mid-write doesn't stop later
+		// records being read after another crash
+		var encoded []byte
+		err = codec.NewEncoderBytes(&encoded, ch).Encode(&dbOp{Bucket: bucketJobsRunning, Key: []byte("e"), Val: []byte("5")})
+		So(err, ShouldBeNil)
+		f, err := os.OpenFile(dbFile+dbJournalSuffix, os.O_WRONLY|os.O_APPEND, dbFilePermission)
+		So(err, ShouldBeNil)
+		_, err = f.Write(encoded[:len(encoded)/2])
+		So(err, ShouldBeNil)
+		err = f.Close()
+		So(err, ShouldBeNil)
+
+		j3, err := openJournal(dbFile+dbJournalSuffix, boltdb, ch, testLogger)
+		So(err, ShouldBeNil)
+		So(get("e"), ShouldBeNil)
+		info, err = os.Stat(dbFile + dbJournalSuffix)
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldEqual, 0)
+		err = j3.record(&dbOp{Bucket: bucketJobsRunning, Key: []byte("d"), Val: []byte("4")})
+		So(err, ShouldBeNil)
+		So(get("d"), ShouldBeNil)
+
+		j4, err := openJournal(dbFile+dbJournalSuffix, boltdb, ch, testLogger)
+		So(err, ShouldBeNil)
+		So(string(get("d")), ShouldEqual, "4")
+		err = j4.close()
+		So(err, ShouldBeNil)
+		err = j3.close()
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestJobqueue(t *testing.T) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	if runnermode {
+		// we have a full test of Serve() below that needs a client executable;
+		// we say this test script is that exe, and when --runnermode is passed
+		// to us we skip all tests and just act like a runner
+		runner()
+		return
+	}
+
+	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
+
+	// load our config to know where our development manager port is supposed to
+	// be; we'll use that to test jobqueue
+	config := internal.ConfigLoad("development", true, testLogger)
+	managerDBBkFile := config.ManagerDbFile + "_bk" // not config.ManagerDbBkFile in case it is an s3 url
+	serverConfig := ServerConfig{
+		Port:            config.ManagerPort,
+		WebPort:         config.ManagerWeb,
+		SchedulerName:   "local",
+		SchedulerConfig: &jqs.ConfigLocal{Shell: config.RunnerExecShell},
+		DBFile:          config.ManagerDbFile,
+		DBFileBackup:    managerDBBkFile,
+		TokenFile:       config.ManagerTokenFile,
+		CAFile:          config.ManagerCAFile,
+		CertFile:        config.ManagerCertFile,
+		CertDomain:      config.ManagerCertDomain,
+		KeyFile:         config.ManagerKeyFile,
+		Deployment:      config.Deployment,
+		TrashKeep:       1 * time.Hour,
+		Logger:          testLogger,
+	}
+	addr := "localhost:" + config.ManagerPort
+
+	setDomainIP(config.ManagerCertDomain)
+
+	ServerInterruptTime = 10 * time.Millisecond
+	ServerReserveTicker = 10 * time.Millisecond
+	ClientReleaseDelay = 100 * time.Millisecond
+	clientConnectTime := 1500 * time.Millisecond
+
+	standardReqs := &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1, Disk: 0, Other: make(map[string]string)}
+
+	// these tests need the server running in it's own pid so we can test signal
+	// handling in the client; to get the server in its own pid we need to
+	// "fork", and that means these must be the first tests to run or else we
+	// won't know in our parent process when our desired server is ready
+	Convey("Once a jobqueue server is up as a daemon", t, func() {
+		ServerItemTTR = 200 * time.Millisecond
+		ClientTouchInterval = 50 * time.Millisecond
+
+		errr := os.Remove(config.ManagerTokenFile)
+		So(errr == nil || os.IsNotExist(errr), ShouldBeTrue)
+
+		context := &daemon.Context{
+			PidFileName: config.ManagerPidFile,
+			PidFilePerm: 0644,
+			WorkDir:     "/",
+			Umask:       config.ManagerUmask,
+		}
+		child, errc := context.Reborn()
+		if errc != nil {
+			log.Fatalf("failed to daemonize for the initial test: %s (you probably need to `wr manager stop`)", errc)
+		}
+		if child == nil {
+			// daemonized child, that will run until signalled to stop
+			defer context.Release()
+
+			//*** we need a log rotation scheme in place to have this...
+			// logfile, errlog := os.OpenFile(config.ManagerLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			// if errlog == nil {
+			// 	defer logfile.Close()
+			// 	log.SetOutput(logfile)
+			// }
+
+			server, msg, _, err := Serve(serverConfig)
+			if err != nil {
+				log.Fatalf("test daemon failed to start: %s\n", err)
+			}
+			if msg != "" {
+				log.Println(msg)
+			}
+
+			// we'll Block() later, but just in case the parent tests bomb out
+			// without killing us, we'll stop after 10s
+			go func() {
+				<-time.After(10 * time.Second)
+				log.Println("test daemon stopping after 10s")
+				server.Stop(true)
+			}()
+
+			log.Println("test daemon up, will block")
+
+			// wait until we are killed
+			err = server.Block()
+			log.Printf("test daemon exiting due to %s\n", err)
+			os.Exit(0)
+		}
+		// parent; wait a while for our child to bring up the server
+		defer syscall.Kill(child.Pid, syscall.SIGTERM)
+
+		mTimeout := 10 * time.Second
+		internal.WaitForFile(config.ManagerTokenFile, mTimeout)
+		token, err := ioutil.ReadFile(config.ManagerTokenFile)
+		So(err, ShouldBeNil)
+		So(token, ShouldNotBeNil)
+		jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, 10*time.Second)
+		So(err, ShouldBeNil)
+		defer jq.Disconnect()
+
+		So(jq.ServerInfo.PID, ShouldEqual, child.Pid)
+
+		Convey("You can set up a long-running job for execution", func() {
+			cmd := "perl -e 'for (1..3) { sleep(1) }'"
+			cmd2 := "perl -e 'for (2..4) { sleep(1) }'"
+			var jobs []*Job
+			jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 4 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "3secs_pass"})
+			jobs = append(jobs, &Job{Cmd: cmd2, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "3secs_fail"})
+			RecSecRound = 1
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+			So(already, ShouldEqual, 0)
+
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job.Cmd, ShouldEqual, cmd)
+			So(job.State, ShouldEqual, JobStateReserved)
+
+			job2, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job2.Cmd, ShouldEqual, cmd2)
+			So(job2.State, ShouldEqual, JobStateReserved)
+
+			Convey("Signals are handled during execution, and we can see when jobs take too long", func() {
+				go func() {
+					<-time.After(2 * time.Second)
+					syscall.Kill(os.Getpid(), syscall.SIGTERM)
+				}()
+
+				ClientReleaseDelay = 100 * time.Second
+				j1worked := make(chan bool)
+				go func() {
+					err := jq.Execute(job, config.RunnerExecShell)
+					if err != nil {
+						if jqerr, ok := err.(Error); ok && jqerr.Err == FailReasonSignal && job.State == JobStateDelayed && job.Exited && job.Exitcode == -1 && job.FailReason == FailReasonSignal {
+							j1worked <- true
+						}
+					}
+					j1worked <- false
+				}()
+
+				j2worked := make(chan bool)
+				go func() {
+					err := jq.Execute(job2, config.RunnerExecShell)
+					if err != nil {
+						if jqerr, ok := err.(Error); ok && jqerr.Err == FailReasonTime && job2.State == JobStateDelayed && job2.Exited && job2.Exitcode == -1 && job2.FailReason == FailReasonTime {
+							j2worked <- true
+						}
+					}
+					j2worked <- false
+				}()
+
+				So(<-j1worked, ShouldBeTrue)
+				So(<-j2worked, ShouldBeTrue)
+
+				jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+				defer jq2.Disconnect()
+				job, err = jq2.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, cmd)
+				So(job.State, ShouldEqual, JobStateDelayed)
+				So(job.FailReason, ShouldEqual, FailReasonSignal)
+
+				job2, err = jq2.GetByEssence(&JobEssence{Cmd: cmd2}, false, false)
+				So(err, ShouldBeNil)
 				So(job2, ShouldNotBeNil)
+				So(job2.Cmd, ShouldEqual, cmd2)
 				So(job2.State, ShouldEqual, JobStateDelayed)
-				So(job2.Exited, ShouldBeTrue)
-				So(job2.Exitcode, ShouldEqual, 1)
-				So(job2.PeakRAM, ShouldEqual, job.PeakRAM)
-				So(job2.Pid, ShouldEqual, job.Pid)
-				So(job2.Host, ShouldEqual, host)
-				So(job2.WallTime(), ShouldBeLessThanOrEqualTo, job.WallTime())
-				So(job2.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
-				So(job2.CPUtime, ShouldEqual, job.CPUtime)
-				So(job2.Attempts, ShouldEqual, 1)
+				So(job2.FailReason, ShouldEqual, FailReasonTime)
+				So(job2.Requirements.Time.Seconds(), ShouldEqual, 3601)
+
+				ClientReleaseDelay = 100 * time.Millisecond
+
+				// all signals handled the same way, so no need for further
+				// tests
+			})
+
+			RecSecRound = 1800 // revert back to normal
+		})
+
+		Reset(func() {
+			syscall.Kill(child.Pid, syscall.SIGTERM)
+		})
+	})
+
+	<-time.After(5 * time.Second) // wait for the "fork" to really not be listening on the ports any more
+
+	ServerItemTTR = 1 * time.Second
+	ClientTouchInterval = 500 * time.Millisecond
+
+	var server *Server
+	var token []byte
+	var errs error
+	Convey("Without the jobserver being up, clients can't connect and time out", t, func() {
+		_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+		So(err, ShouldNotBeNil)
+		jqerr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(jqerr.Err, ShouldEqual, ErrNoServer)
+	})
+
+	Convey("Once the jobqueue server is up", t, func() {
+		server, _, token, errs = Serve(serverConfig)
+		So(errs, ShouldBeNil)
+
+		server.rc = `echo %s %s %s %s %d %d` // ReserveScheduled() only works if we have an rc
+
+		Convey("You can connect to the server and add jobs to the queue", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer jq.Disconnect()
+
+			So(jq.ServerInfo.Port, ShouldEqual, serverConfig.Port)
+			So(jq.ServerInfo.PID, ShouldBeGreaterThan, 0)
+			So(jq.ServerInfo.Deployment, ShouldEqual, "development")
+
+			var jobs []*Job
+			for i := 0; i < 10; i++ {
+				pri := i
+				if i == 7 {
+					pri = 4
+				} else if i == 4 {
+					pri = 7
+				}
+				jobs = append(jobs, &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 4 * time.Hour, Cores: 1}, Priority: uint8(pri), Retries: uint8(3), RepGroup: "manually_added"})
+			}
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 10)
+			So(already, ShouldEqual, 0)
+
+			Convey("You can't add the same jobs to the queue again", func() {
+				inserts, already, err := jq.Add(jobs, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 0)
+				So(already, ShouldEqual, 10)
+			})
+
+			Convey("You can get back jobs you've just added", func() {
+				job, err := jq.GetByEssence(&JobEssence{Cmd: "test cmd 3"}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, "test cmd 3")
+				So(job.State, ShouldEqual, JobStateReady)
+
+				job, err = jq.GetByEssence(&JobEssence{Cmd: "test cmd x"}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldBeNil)
+
+				var jes []*JobEssence
+				for i := 0; i < 10; i++ {
+					jes = append(jes, &JobEssence{Cmd: fmt.Sprintf("test cmd %d", i)})
+				}
+				jobs, err = jq.GetByEssences(jes)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 10)
+				for i, job := range jobs {
+					So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", i))
+					So(job.State, ShouldEqual, JobStateReady)
+				}
+
+				jobs, err = jq.GetByRepGroup("manually_added", 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 10)
+
+				jobs, err = jq.GetByRepGroup("foo", 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 0)
+			})
+
+			Convey("You can store their (fake) runtime stats and get recommendations", func() {
+				for index, job := range jobs {
+					job.PeakRAM = index + 1
+					job.StartTime = time.Now()
+					job.EndTime = job.StartTime.Add(time.Duration(index+1) * time.Second)
+					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
+				}
+				<-time.After(100 * time.Millisecond)
+				rmem, err := server.db.recommendedReqGroupMemory("fake_group")
+				So(err, ShouldBeNil)
+				So(rmem, ShouldEqual, 100)
+				rtime, err := server.db.recommendedReqGroupTime("fake_group")
+				So(err, ShouldBeNil)
+				So(rtime, ShouldEqual, 1800)
+
+				for i := 11; i <= 100; i++ {
+					job := &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 4 * time.Hour, Cores: 1}, Retries: uint8(3), RepGroup: "manually_added"}
+					job.PeakRAM = i * 100
+					job.StartTime = time.Now()
+					job.EndTime = job.StartTime.Add(time.Duration(i*100) * time.Second)
+					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
+				}
+				<-time.After(500 * time.Millisecond)
+				rmem, err = server.db.recommendedReqGroupMemory("fake_group")
+				So(err, ShouldBeNil)
+				So(rmem, ShouldEqual, 9500)
+				rtime, err = server.db.recommendedReqGroupTime("fake_group")
+				So(err, ShouldBeNil)
+				So(rtime, ShouldEqual, 10800)
+			})
+
+			Convey("You can list, override, restore and reset learned requirements", func() {
+				for index, job := range jobs {
+					job.PeakRAM = index + 1
+					job.PeakDisk = (index + 1) * 100
+					job.ActualCwd = "/fake/cwd/hashed/cwd"
+					job.StartTime = time.Now()
+					job.EndTime = job.StartTime.Add(time.Duration(index+1) * time.Second)
+					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
+				}
+				<-time.After(100 * time.Millisecond)
+
+				findProfile := func(rg string) *ReqGroupProfile {
+					profiles, errg := jq.GetReqGroupProfiles()
+					So(errg, ShouldBeNil)
+					for _, p := range profiles {
+						if p.ReqGroup == rg {
+							return p
+						}
+					}
+					return nil
+				}
+				p := findProfile("fake_group")
+				So(p, ShouldNotBeNil)
+				So(p.RAM, ShouldEqual, 100)
+				So(p.Time, ShouldEqual, 30*time.Minute)
+				So(p.Disk, ShouldEqual, 1)
+				So(p.Samples, ShouldBeGreaterThanOrEqualTo, 10)
+				So(p.Override, ShouldBeFalse)
+				So(server.recommendedReqs("fake_group").RAM, ShouldEqual, 100)
+				So(server.recommendedReqs("fake_group").Disk, ShouldEqual, 1)
+				So(server.recommendedReqs("seeded_group"), ShouldBeNil)
+
+				err := jq.SetReqGroupProfiles([]*ReqGroupProfile{{ReqGroup: "bad"}})
+				So(err, ShouldNotBeNil)
+
+				err = jq.SetReqGroupProfiles([]*ReqGroupProfile{
+					{ReqGroup: "fake_group", RAM: 2000, Time: 2 * time.Hour},
+					{ReqGroup: "seeded_group", RAM: 500, Time: 10 * time.Minute},
+				})
+				So(err, ShouldBeNil)
+				p = findProfile("fake_group")
+				So(p.RAM, ShouldEqual, 2000)
+				So(p.Time, ShouldEqual, 2*time.Hour)
+				So(p.Override, ShouldBeTrue)
+				p = findProfile("seeded_group")
+				So(p, ShouldNotBeNil)
+				So(p.RAM, ShouldEqual, 500)
+				So(p.Samples, ShouldEqual, 0)
+				rec := server.recommendedReqs("seeded_group")
+				So(rec, ShouldNotBeNil)
+				So(rec.RAM, ShouldEqual, 500)
+				So(rec.Time, ShouldEqual, 10*time.Minute)
+				So(rec.Disk, ShouldEqual, 0)
+
+				failed := &Job{PeakRAM: 100, FailReason: FailReasonRAM, Requirements: &jqs.Requirements{RAM: 100, Time: time.Hour}}
+				failed.updateRecsAfterFailure(nil)
+				So(failed.Requirements.RAM, ShouldEqual, 1100)
+				failed.updateRecsAfterFailure(server.recommendedReqs("fake_group"))
+				So(failed.Requirements.RAM, ShouldEqual, 2000)
+				So(failed.Override, ShouldEqual, 1)
+				failed.FailReason = FailReasonTime
+				failed.updateRecsAfterFailure(server.recommendedReqs("seeded_group"))
+				So(failed.Requirements.Time, ShouldEqual, 2*time.Hour)
+				failed.Requirements.Time = 30 * time.Minute
+				failed.updateRecsAfterFailure(server.recommendedReqs("fake_group"))
+				So(failed.Requirements.Time, ShouldEqual, 2*time.Hour)
+
+				deleted, err := jq.DeleteReqGroupProfiles([]string{"fake_group", "seeded_group", "nonexistent"})
+				So(err, ShouldBeNil)
+				So(deleted, ShouldEqual, 2)
+				p = findProfile("fake_group")
+				So(p.RAM, ShouldEqual, 100)
+				So(p.Override, ShouldBeFalse)
+				So(findProfile("seeded_group"), ShouldBeNil)
+
+				reset, err := jq.ResetReqGroupProfiles([]string{"fake_group", "nonexistent"})
+				So(err, ShouldBeNil)
+				So(reset, ShouldEqual, 1)
+				So(findProfile("fake_group"), ShouldBeNil)
+				So(server.recommendedReqs("fake_group"), ShouldBeNil)
+			})
+
+			Convey("You can reserve jobs from the queue in the correct order", func() {
+				for i := 9; i >= 0; i-- {
+					jid := i
+					if i == 7 {
+						jid = 4
+					} else if i == 4 {
+						jid = 7
+					}
+					job, err := jq.ReserveScheduled(50*time.Millisecond, "1024:240:1:0")
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", jid))
+					So(job.EnvC, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateReserved)
+				}
+
+				Convey("Reserving when all have been reserved returns nil", func() {
+					job, err := jq.ReserveScheduled(50*time.Millisecond, "1024:240:1:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+
+					Convey("Adding one while waiting on a Reserve will return the new job", func() {
+						worked := make(chan bool)
+						go func() {
+							job, err := jq.ReserveScheduled(1000*time.Millisecond, "1024:300:1:0")
+							if err != nil {
+								worked <- false
+								return
+							}
+							if job == nil {
+								worked <- false
+								return
+							}
+							if job.Cmd == "new" {
+								worked <- true
+								return
+							}
+							worked <- false
+						}()
+
+						ok := make(chan bool)
+						go func() {
+							ticker := time.NewTicker(100 * time.Millisecond)
+							ticks := 0
+							for {
+								select {
+								case <-ticker.C:
+									ticks++
+									if ticks == 2 {
+										jobs = append(jobs, &Job{Cmd: "new", Cwd: "/fake/cwd", ReqGroup: "add_group", Requirements: &jqs.Requirements{RAM: 1024, Time: 5 * time.Hour, Cores: 1}, Retries: uint8(3), RepGroup: "manually_added"})
+										gojq, _ := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+										defer gojq.Disconnect()
+										gojq.Add(jobs, envVars, true)
+									}
+									continue
+								case w := <-worked:
+									ticker.Stop()
+									if w && ticks <= 8 {
+										ok <- true
+									}
+									ok <- false
+									return
+								}
+							}
+						}()
+
+						<-time.After(2 * time.Second)
+						So(<-ok, ShouldBeTrue)
+					})
+				})
+			})
+
+			Convey("You can subsequently add more jobs", func() {
+				for i := 10; i < 20; i++ {
+					jobs = append(jobs, &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "new_group", Requirements: &jqs.Requirements{RAM: 2048, Time: 1 * time.Hour, Cores: 2}, Retries: uint8(3), RepGroup: "manually_added"})
+				}
+				inserts, already, err := jq.Add(jobs, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 10)
+				So(already, ShouldEqual, 10)
+
+				Convey("You can reserve jobs for a particular scheduler group", func() {
+					for i := 10; i < 20; i++ {
+						job, err := jq.ReserveScheduled(20*time.Millisecond, "2048:60:2:0")
+						So(err, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", i))
+					}
+					job, err := jq.ReserveScheduled(10*time.Millisecond, "2048:60:2:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+
+					for i := 9; i >= 0; i-- {
+						jid := i
+						if i == 7 {
+							jid = 4
+						} else if i == 4 {
+							jid = 7
+						}
+						job, err = jq.ReserveScheduled(10*time.Millisecond, "1024:240:1:0")
+						So(err, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						So(job.Cmd, ShouldEqual, fmt.Sprintf("test cmd %d", jid))
+					}
+					job, err = jq.ReserveScheduled(10*time.Millisecond, "1024:240:1:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+				})
+
+				Convey("You can change the requirements of queued jobs by RepGroup", func() {
+					modified, err := jq.ModifyRequirements("manually_added", &ReqChange{RAM: 4096})
+					So(err, ShouldBeNil)
+					So(modified, ShouldEqual, 20)
+
+					job, err := jq.GetByEssence(&JobEssence{Cmd: "test cmd 15"}, false, false)
+					So(err, ShouldBeNil)
+					So(job.Requirements.RAM, ShouldEqual, 4096)
+					So(job.Requirements.Time, ShouldEqual, 1*time.Hour)
+					So(job.Requirements.Cores, ShouldEqual, 2)
+
+					job, err = jq.ReserveScheduled(1*time.Second, "4096:60:2:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, "test cmd 10")
+					job, err = jq.ReserveScheduled(1*time.Second, "4096:240:1:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					job, err = jq.ReserveScheduled(10*time.Millisecond, "1024:240:1:0")
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+
+					modified, err = jq.ModifyRequirements("manually_added", &ReqChange{Time: 2 * time.Hour})
+					So(err, ShouldBeNil)
+					So(modified, ShouldEqual, 18)
+
+					modified, err = jq.ModifyRequirements("foo", &ReqChange{RAM: 10})
+					So(err, ShouldBeNil)
+					So(modified, ShouldEqual, 0)
+
+					_, err = jq.ModifyRequirements("manually_added", &ReqChange{})
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("Jobs that wait too long to start get escalated", func() {
+				req := &jqs.Requirements{RAM: 10, Time: 1 * time.Hour, Cores: 1, Other: map[string]string{"cloud_flavor": "o2.small"}}
+				sd := StartDeadline{Within: "1m", Priority: 200, RelaxFlavor: true, Notify: true}
+				inserts, _, err := jq.Add([]*Job{{Cmd: "echo deadline", Cwd: "/tmp", ReqGroup: "deadline", Requirements: req, Priority: 5, RepGroup: "deadline", StartDeadline: sd}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				<-time.After(50 * time.Millisecond) // the queue's changed callback is async
+
+				So(server.deadlines.due(time.Now()), ShouldBeEmpty)
+				escalated, err := server.escalate(server.deadlines.due(time.Now().Add(2 * time.Minute)))
+				So(err, ShouldBeNil)
+				So(escalated, ShouldEqual, 1)
+
+				job, err := jq.GetByEssence(&JobEssence{Cmd: "echo deadline", Cwd: "/tmp"}, false, false)
+				So(err, ShouldBeNil)
+				So(job.Priority, ShouldEqual, 200)
+				So(job.Requirements.Other, ShouldNotContainKey, "cloud_flavor")
+				So(job.StartDeadline, ShouldResemble, sd)
+
+				_, _, err = jq.Add([]*Job{{Cmd: "echo bad deadline", Cwd: "/tmp", Requirements: standardReqs, StartDeadline: StartDeadline{Within: "1m"}}}, envVars, true)
+				So(err, ShouldNotBeNil)
+				_, _, err = jq.Add([]*Job{{Cmd: "echo bad deadline", Cwd: "/tmp", Requirements: standardReqs, StartDeadline: StartDeadline{Within: "1m", Datacentre: "nowhere"}}}, envVars, true)
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("You can add more jobs, but without any environment variables", func() {
+				server.racmutex.Lock()
+				server.rc = ""
+				server.racmutex.Unlock()
+				os.Setenv("wr_jobqueue_test_no_envvar", "a")
+				inserts, already, err := jq.Add([]*Job{{Cmd: "echo $wr_jobqueue_test_no_envvar && false", Cwd: "/tmp", ReqGroup: "new_group", Requirements: standardReqs, Priority: uint8(100), RepGroup: "noenvvar"}}, []string{}, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				So(already, ShouldEqual, 0)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.RepGroup, ShouldEqual, "noenvvar")
+
+				env, err := job.Env()
+				So(err, ShouldBeNil)
+				So(env, ShouldNotBeEmpty)
+
+				os.Setenv("wr_jobqueue_test_no_envvar", "b")
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				So(job.FailReason, ShouldEqual, FailReasonExit)
+				stdout, err := job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, "b")
+
+				// by comparison, compare normal behaviour, where the initial
+				// value of the envvar gets used for the job
+				os.Setenv("wr_jobqueue_test_no_envvar", "a")
+				inserts, already, err = jq.Add([]*Job{{Cmd: "echo $wr_jobqueue_test_no_envvar && false && false", Cwd: "/tmp", ReqGroup: "new_group", Requirements: standardReqs, Priority: uint8(101), RepGroup: "withenvvar"}}, os.Environ(), true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				So(already, ShouldEqual, 0)
+
+				job, err = jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.RepGroup, ShouldEqual, "withenvvar")
+
+				env, err = job.Env()
+				So(err, ShouldBeNil)
+				So(env, ShouldNotBeEmpty)
+
+				os.Setenv("wr_jobqueue_test_no_envvar", "b")
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				So(job.FailReason, ShouldEqual, FailReasonExit)
+				stdout, err = job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, "a")
+			})
+
+			Convey("You can add more jobs, overriding certain environment variables", func() {
+				server.racmutex.Lock()
+				server.rc = ""
+				server.racmutex.Unlock()
+				os.Setenv("wr_jobqueue_test_no_envvar", "a")
+				compressed, err := jq.CompressEnv([]string{"wr_jobqueue_test_no_envvar=c", "wr_jobqueue_test_no_envvar2=d"})
+				So(err, ShouldBeNil)
+				inserts, already, err := jq.Add([]*Job{{
+					Cmd:          "echo $wr_jobqueue_test_no_envvar && echo $wr_jobqueue_test_no_envvar2 && false",
+					Cwd:          "/tmp",
+					RepGroup:     "noenvvar",
+					ReqGroup:     "new_group",
+					Requirements: standardReqs,
+					Priority:     uint8(100),
+					Retries:      uint8(0),
+					EnvOverride:  compressed,
+				}}, []string{}, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				So(already, ShouldEqual, 0)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.RepGroup, ShouldEqual, "noenvvar")
+
+				env, err := job.Env()
+				So(err, ShouldBeNil)
+				So(env, ShouldNotBeEmpty)
+
+				os.Setenv("wr_jobqueue_test_no_envvar", "b")
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				So(job.FailReason, ShouldEqual, FailReasonExit)
+				stdout, err := job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, "c\nd")
+			})
+
+			Convey("Client calls can be cancelled or given deadlines with a context", func() {
+				cancelled, cancel := context.WithCancel(context.Background())
+				cancel()
+				_, err := ConnectContext(cancelled, addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldEqual, context.Canceled)
+				_, err = jq.PingContext(cancelled)
+				So(err, ShouldEqual, context.Canceled)
+
+				info, err := jq.PingContext(context.Background())
+				So(err, ShouldBeNil)
+				So(info, ShouldNotBeNil)
+
+				ctx, cancelc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancelc()
+				before := time.Now()
+				job, err := jq.ReserveScheduledContext(ctx, 0, "nonesuch")
+				So(err, ShouldEqual, context.DeadlineExceeded)
+				So(job, ShouldBeNil)
+				So(time.Since(before), ShouldBeLessThan, 1*time.Second)
+
+				server.racmutex.Lock()
+				server.rc = ""
+				server.racmutex.Unlock()
+				inserts, _, err := jq.Add([]*Job{{Cmd: "sleep 5", Cwd: "/tmp", RepGroup: "ctx", ReqGroup: "ctx", Requirements: standardReqs, Priority: uint8(100), Retries: uint8(0)}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				job, err = jq.ReserveContext(context.Background(), 50*time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.RepGroup, ShouldEqual, "ctx")
+
+				So(jq.ExecuteContext(cancelled, job, config.RunnerExecShell), ShouldEqual, context.Canceled)
+
+				ctx, cancelc = context.WithTimeout(context.Background(), 500*time.Millisecond)
+				defer cancelc()
+				before = time.Now()
+				err = jq.ExecuteContext(ctx, job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, FailReasonSignal)
+				So(time.Since(before), ShouldBeLessThan, 5*time.Second)
+				So(job.FailReason, ShouldEqual, FailReasonSignal)
+			})
+
+			Convey("You can stop the server by sending it a SIGTERM or SIGINT", func() {
+				jq.Disconnect()
+
+				syscall.Kill(os.Getpid(), syscall.SIGTERM)
+				<-time.After(ClientTouchInterval)
+				<-time.After(ClientTouchInterval)
+				_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNoServer)
+
+				server, _, token, errs = Serve(serverConfig)
+				So(errs, ShouldBeNil)
+
+				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+				jq.Disconnect()
+
+				syscall.Kill(os.Getpid(), syscall.SIGINT)
+				<-time.After(ClientTouchInterval)
+				<-time.After(ClientTouchInterval)
+				_, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNoServer)
+			})
+
+			Convey("You get a nice error if you send the server junk", func() {
+				_, err := jq.request(&clientRequest{Method: "junk"})
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrUnknownCommand)
+				jq.Disconnect()
+			})
+		})
+
+		Reset(func() {
+			server.Stop(true)
+		})
+	})
+
+	if server != nil {
+		server.Stop(true)
+	}
+
+	// start these tests anew because I don't want to mess with the timings in
+	// the above tests
+	Convey("Once a new jobqueue server is up", t, func() {
+		ServerItemTTR = 200 * time.Millisecond
+		ClientTouchInterval = 50 * time.Millisecond
+		server, _, token, errs = Serve(serverConfig)
+		So(errs, ShouldBeNil)
+
+		Convey("You can connect, and add some real jobs", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer jq.Disconnect()
+			jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer jq2.Disconnect()
+
+			var jobs []*Job
+			jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(2), RepGroup: "manually_added"})
+			jobs = append(jobs, &Job{Cmd: "sleep 0.1 && false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(2), RepGroup: "manually_added"})
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+			So(already, ShouldEqual, 0)
+
+			Convey("You can't execute a job without reserving it", func() {
+				err := jq.Execute(jobs[0], config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrMustReserve)
+				jq.Disconnect()
+			})
+
+			Convey("Once reserved you can execute jobs, and other clients see the correct state on gets", func() {
+				// job that succeeds, no std out
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "sleep 0.1 && true")
+				So(job.State, ShouldEqual, JobStateReserved)
+				So(job.Attempts, ShouldEqual, 0)
+				So(job.UntilBuried, ShouldEqual, 3)
+
+				job2, err := jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && true"}, false, false)
+				So(err, ShouldBeNil)
+				So(job2, ShouldNotBeNil)
+				So(job2.Cmd, ShouldEqual, "sleep 0.1 && true")
+				So(job2.State, ShouldEqual, JobStateReserved)
+
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+				So(job.State, ShouldEqual, JobStateComplete)
+				So(job.Exited, ShouldBeTrue)
+				So(job.Exitcode, ShouldEqual, 0)
+				So(job.PeakRAM, ShouldBeGreaterThan, 0)
+				So(job.Pid, ShouldBeGreaterThan, 0)
+				host, _ := os.Hostname()
+				So(job.Host, ShouldEqual, host)
+				So(job.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
+				So(job.CPUtime, ShouldBeGreaterThanOrEqualTo, 0*time.Millisecond)
+				So(job.Attempts, ShouldEqual, 1)
+				So(job.UntilBuried, ShouldEqual, 3)
+				stdout, err := job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, "")
+				stderr, err := job.StdErr()
+				So(err, ShouldBeNil)
+				So(stderr, ShouldEqual, "")
+				actualCwd := job.ActualCwd
+				So(actualCwd, ShouldStartWith, filepath.Join("/tmp", "jobqueue_cwd", "7", "4", "7", "27e23009c78b126f274aa64416f30"))
+				So(actualCwd, ShouldEndWith, "cwd")
+
+				job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && true"}, false, false)
+				So(err, ShouldBeNil)
+				So(job2, ShouldNotBeNil)
+				So(job2.State, ShouldEqual, JobStateComplete)
+				So(job2.Exited, ShouldBeTrue)
+				So(job2.Exitcode, ShouldEqual, 0)
+				So(job2.PeakRAM, ShouldEqual, job.PeakRAM)
+				So(job2.Pid, ShouldEqual, job.Pid)
+				So(job2.Host, ShouldEqual, host)
+				So(job2.WallTime(), ShouldBeLessThanOrEqualTo, job.WallTime())
+				So(job2.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
+				So(job2.CPUtime, ShouldEqual, job.CPUtime)
+				So(job2.Attempts, ShouldEqual, 1)
+				So(job2.ActualCwd, ShouldEqual, actualCwd)
+
+				// job that fails, no std out
+				job, err = jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
+				So(job.State, ShouldEqual, JobStateReserved)
+				So(job.Attempts, ShouldEqual, 0)
+				So(job.UntilBuried, ShouldEqual, 3)
+
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "command [sleep 0.1 && false] exited with code 1, which may be a temporary issue, so it will be tried again")
+				So(job.State, ShouldEqual, JobStateDelayed)
+				So(job.Exited, ShouldBeTrue)
+				So(job.Exitcode, ShouldEqual, 1)
+				So(job.PeakRAM, ShouldBeGreaterThan, 0)
+				So(job.Pid, ShouldBeGreaterThan, 0)
+				So(job.Host, ShouldEqual, host)
+				So(job.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
+				So(job.CPUtime, ShouldBeGreaterThanOrEqualTo, 0*time.Millisecond)
+				So(job.Attempts, ShouldEqual, 1)
+				So(job.UntilBuried, ShouldEqual, 2)
+				stdout, err = job.StdOut()
+				So(err, ShouldBeNil)
+				So(stdout, ShouldEqual, "")
+				stderr, err = job.StdErr()
+				So(err, ShouldBeNil)
+				So(stderr, ShouldEqual, "")
+
+				job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+				So(err, ShouldBeNil)
+				So(job2, ShouldNotBeNil)
+				So(job2.State, ShouldEqual, JobStateDelayed)
+				So(job2.Exited, ShouldBeTrue)
+				So(job2.Exitcode, ShouldEqual, 1)
+				So(job2.PeakRAM, ShouldEqual, job.PeakRAM)
+				So(job2.Pid, ShouldEqual, job.Pid)
+				So(job2.Host, ShouldEqual, host)
+				So(job2.WallTime(), ShouldBeLessThanOrEqualTo, job.WallTime())
+				So(job2.WallTime(), ShouldBeGreaterThanOrEqualTo, 1*time.Millisecond)
+				So(job2.CPUtime, ShouldEqual, job.CPUtime)
+				So(job2.Attempts, ShouldEqual, 1)
+
+				Convey("Both current and archived jobs can be retrieved with GetByRepGroup", func() {
+					jobs, err = jq.GetByRepGroup("manually_added", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(jobs), ShouldEqual, 2)
+
+					Convey("But only current jobs are retrieved with GetIncomplete", func() {
+						jobs, err = jq.GetIncomplete(0, "", false, false)
+						So(err, ShouldBeNil)
+						So(len(jobs), ShouldEqual, 1)
+						So(jobs[0].Cmd, ShouldEqual, "sleep 0.1 && false")
+						//*** should probably have a better test, where there are incomplete jobs in each of the sub queues
+					})
+				})
+
+				Convey("A temp failed job is reservable after a delay", func() {
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateDelayed)
+
+					<-time.After(60 * time.Millisecond)
+					job, err = jq.Reserve(5 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
+					So(job.State, ShouldEqual, JobStateReserved)
+					So(job.Attempts, ShouldEqual, 1)
+					So(job.UntilBuried, ShouldEqual, 2)
+					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateReserved)
+
+					Convey("After 2 retries (3 attempts) it gets buried", func() {
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldNotBeNil)
+						So(job.State, ShouldEqual, JobStateDelayed)
+						So(job.Exited, ShouldBeTrue)
+						So(job.Exitcode, ShouldEqual, 1)
+						So(job.Attempts, ShouldEqual, 2)
+						So(job.UntilBuried, ShouldEqual, 1)
+
+						<-time.After(210 * time.Millisecond)
+						job, err = jq.Reserve(5 * time.Millisecond)
+						So(err, ShouldBeNil)
+						So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
+						So(job.State, ShouldEqual, JobStateReserved)
+						So(job.Attempts, ShouldEqual, 2)
+						So(job.UntilBuried, ShouldEqual, 1)
+
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldNotBeNil)
+						So(job.State, ShouldEqual, JobStateBuried)
+						So(job.Exited, ShouldBeTrue)
+						So(job.Exitcode, ShouldEqual, 1)
+						So(job.Attempts, ShouldEqual, 3)
+						So(job.UntilBuried, ShouldEqual, 0)
+
+						<-time.After(210 * time.Millisecond)
+						job, err = jq.Reserve(5 * time.Millisecond)
+						So(err, ShouldBeNil)
+						So(job, ShouldBeNil)
+
+						Convey("Once buried it can be kicked back to ready state and be reserved again", func() {
+							job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+							So(err, ShouldBeNil)
+							So(job2, ShouldNotBeNil)
+							So(job2.State, ShouldEqual, JobStateBuried)
+
+							kicked, err := jq.Kick([]*JobEssence{{Cmd: "sleep 0.1 && false"}})
+							So(err, ShouldBeNil)
+							So(kicked, ShouldEqual, 1)
+
+							job, err = jq.Reserve(5 * time.Millisecond)
+							So(err, ShouldBeNil)
+							So(job, ShouldNotBeNil)
+							So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
+							So(job.State, ShouldEqual, JobStateReserved)
+							So(job.Attempts, ShouldEqual, 3)
+							So(job.UntilBuried, ShouldEqual, 3)
+
+							job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+							So(err, ShouldBeNil)
+							So(job2, ShouldNotBeNil)
+							So(job2.State, ShouldEqual, JobStateReserved)
+							So(job2.Attempts, ShouldEqual, 3)
+							So(job2.UntilBuried, ShouldEqual, 3)
+
+							Convey("If you do nothing with a reserved job, it auto reverts back to delayed", func() {
+								<-time.After(210 * time.Millisecond)
+								job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+								So(err, ShouldBeNil)
+								So(job2, ShouldNotBeNil)
+								So(job2.State, ShouldEqual, JobStateDelayed)
+								So(job2.Attempts, ShouldEqual, 3)
+								So(job2.UntilBuried, ShouldEqual, 3)
+							})
+						})
+					})
+				})
+			})
+
+			Convey("Jobs can be deleted in any state except running", func() {
+				for _, added := range jobs {
+					job, err := jq.GetByEssence(&JobEssence{Cmd: added.Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateReady)
+
+					deleted, err := jq.Delete([]*JobEssence{{Cmd: added.Cmd}})
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 1)
+
+					job, err = jq.GetByEssence(&JobEssence{Cmd: added.Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+
+					//*** add tests to show this doesn't work if running...
+				}
+				job, err := jq.Reserve(5 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldBeNil)
+
+				Convey("Cmds killed by something other than the OOM killer don't look like they ran out of memory", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "sleep 0.1 && kill -9 $$", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "sigkilled"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateDelayed)
+					So(job.FailReason, ShouldEqual, FailReasonExit)
+				})
+
+				Convey("Cmds with pipes in them are handled correctly", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true | true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_pass"})
+					jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true | false | true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_fail"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					// pipe job that succeeds
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "sleep 0.1 && true | true")
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, 0)
+					So(job.FailReason, ShouldEqual, "")
+
+					// pipe job that fails in the middle
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "sleep 0.1 && true | false | true")
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "command [sleep 0.1 && true | false | true] exited with code 1, which may be a temporary issue, so it will be tried again") //*** can fail with a receive time out; why?!
+					So(job.State, ShouldEqual, JobStateDelayed)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, 1)
+					So(job.FailReason, ShouldEqual, FailReasonExit)
+				})
+
+				Convey("Invalid commands are immediately buried", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "awesjnalakjf --foo", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_fail"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					// job that fails because of non-existent exe
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "awesjnalakjf --foo")
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "command [awesjnalakjf --foo] exited with code 127 (command not found), which seems permanent, so it has been buried")
+					So(job.State, ShouldEqual, JobStateBuried)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, 127)
+					So(job.FailReason, ShouldEqual, FailReasonCFound)
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "awesjnalakjf --foo"}, false, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateBuried)
+					So(job2.FailReason, ShouldEqual, FailReasonCFound)
+					So(job2.FailCode, ShouldEqual, FailCodeCFound)
+					So(job2.Remediation, ShouldNotBeNil)
+					So(job2.Remediation.Advice, ShouldContainSubstring, "PATH")
+					So(job2.Remediation.Automatic(), ShouldBeFalse)
+
+					//*** how to test the other bury cases of invalid exit code
+					// and permission problems on the exe?
+				})
+
+				Convey("If a job uses too much memory it is killed and we recommend more next time", func() {
+					jobs = nil
+					cmd := "perl -e '@a; for (1..3) { push(@a, q[a] x 50000000); sleep(1) }'"
+					jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "run_out_of_mem"})
+					RecMBRound = 1
+					inserts, already, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+					So(already, ShouldEqual, 0)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, cmd)
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, FailReasonRAM)
+					So(job.State, ShouldEqual, JobStateDelayed)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, -1)
+					So(job.FailReason, ShouldEqual, FailReasonRAM)
+					So(job.Requirements.RAM, ShouldEqual, 1200)
+					jq.Delete([]*JobEssence{{Cmd: cmd}})
+				})
+
+				Convey("If a job is buried for using too much memory, it can be retried with the suggested amount", func() {
+					jobs = nil
+					cmd := "perl -e '@a; for (1..3) { push(@a, q[a] x 50000000); sleep(1) }' && echo remediate"
+					jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "remediate_mem"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateBuried)
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job2.FailReason, ShouldEqual, FailReasonRAM)
+					So(job2.Remediation, ShouldNotBeNil)
+					So(job2.Remediation.Automatic(), ShouldBeTrue)
+					So(job2.Remediation.RAM, ShouldBeGreaterThan, job2.PeakRAM)
+					So(job2.Remediation.Advice, ShouldStartWith, "retry with memory ")
+
+					kicked, remediated, err := jq.KickWithRemediation([]*JobEssence{{Cmd: cmd}})
+					So(err, ShouldBeNil)
+					So(kicked, ShouldEqual, 1)
+					So(remediated, ShouldEqual, 1)
+
+					job3, err := jq2.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job3.State, ShouldEqual, JobStateReady)
+					So(job3.Requirements.RAM, ShouldEqual, job2.Remediation.RAM)
+					So(job3.Remediation, ShouldBeNil)
+					jq.Delete([]*JobEssence{{Cmd: cmd}})
+				})
+
+				Convey("If a job enforcing its disk requirement uses too much disk it is killed and buried", func() {
+					origDiskCheckInterval := ClientDiskCheckInterval
+					ClientDiskCheckInterval = 100 * time.Millisecond
+					defer func() {
+						ClientDiskCheckInterval = origDiskCheckInterval
+					}()
+
+					jobs = nil
+					cmd := "dd if=/dev/zero of=too_big bs=1048576 count=1100 2>/dev/null && sleep 20"
+					diskReqs := &jqs.Requirements{RAM: 10, Time: time.Minute, Cores: 1, Disk: 1, Other: make(map[string]string)}
+					jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", EnforceDisk: true, ReqGroup: "fake_group", Requirements: diskReqs, Retries: uint8(3), RepGroup: "run_out_of_disk"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, cmd)
+
+					t := time.Now()
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(time.Since(t), ShouldBeLessThan, 15*time.Second)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, FailReasonDisk)
+					So(job.State, ShouldEqual, JobStateBuried)
+					So(job.Exited, ShouldBeTrue)
+					So(job.FailReason, ShouldEqual, FailReasonDisk)
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateBuried)
+					So(job2.FailReason, ShouldEqual, FailReasonDisk)
+					jq.Delete([]*JobEssence{{Cmd: cmd}})
+				})
+
+				RecMBRound = 100 // revert back to normal
+
+				Convey("The stdout/err of jobs is only kept for failed jobs, and cwd&TMPDIR&HOME get set appropriately", func() {
+					jobs = nil
+					baseDir, err := ioutil.TempDir("", "wr_jobqueue_test_runner_dir_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(baseDir)
+					tmpDir := filepath.Join(baseDir, "jobqueue tmpdir") // testing that it works with spaces in the name
+					err = os.Mkdir(tmpDir, os.ModePerm)
+					So(err, ShouldBeNil)
+					jobs = append(jobs, &Job{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir, CwdMatters: true, ChangeHome: true, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "should_pass"})
+					jobs = append(jobs, &Job{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir, CwdMatters: false, ChangeHome: true, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "should_fail"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					// job that outputs to stdout and stderr but succeeds
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'")
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, 0)
+					stdout, err := job.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, tmpDir+"-"+os.Getenv("HOME"))
+					stderr, err := job.StdErr()
+					So(err, ShouldBeNil)
+					So(stderr, ShouldEqual, os.TempDir())
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir}, true, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateComplete)
+					stdout, err = job2.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, "")
+					stderr, err = job2.StdErr()
+					So(err, ShouldBeNil)
+					So(stderr, ShouldEqual, "")
+
+					// job that outputs to stdout and stderr and fails
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'")
+					So(job.State, ShouldEqual, JobStateReserved)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateBuried)
+					So(job.Exited, ShouldBeTrue)
+					So(job.Exitcode, ShouldEqual, 255)
+					So(job.FailReason, ShouldEqual, FailReasonExit)
+					stdout, err = job.StdOut()
+					So(err, ShouldBeNil)
+					actualCwd := job.ActualCwd
+					So(actualCwd, ShouldStartWith, filepath.Join(tmpDir, "jobqueue_cwd", "d", "4", "1", "7364d743329da784e74f2d69d438d"))
+					So(actualCwd, ShouldEndWith, "cwd")
+					So(stdout, ShouldEqual, actualCwd+"-"+actualCwd)
+					stderr, err = job.StdErr()
+					So(err, ShouldBeNil)
+					tmpDir = actualCwd[:len(actualCwd)-3] + "tmp"
+					So(stderr, ShouldEqual, tmpDir)
+
+					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'"}, true, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(job2.State, ShouldEqual, JobStateBuried)
+					So(job2.FailReason, ShouldEqual, FailReasonExit)
+					stdout, err = job2.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, actualCwd+"-"+actualCwd)
+					stderr, err = job2.StdErr()
+					So(err, ShouldBeNil)
+					So(stderr, ShouldEqual, tmpDir)
+				})
+
+				Convey("Jobs can be run with a particular umask and resource limits", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "umask && ulimit -n", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "limits", ProcessLimits: ProcessLimits{Umask: "0027", NoFile: "100"}})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.ProcessLimits.Umask, ShouldEqual, "0027")
+					So(job.ProcessLimits.NoFile, ShouldEqual, "100")
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					stdout, err := job.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, "0027\n100")
+				})
+
+				Convey("Jobs can have a templated output destination", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo $WR_OUTPUT_DEST", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "outputs", OutputDest: "s3://bucket/{repgroup}/{reqgroup}/{key}/"})
+					expected := "s3://bucket/outputs/fake_group/" + jobs[0].key() + "/"
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.OutputDest, ShouldEqual, expected)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					stdout, err := job.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, expected)
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "echo $WR_OUTPUT_DEST"}, false, false)
+					So(err, ShouldBeNil)
+					So(job2.OutputDest, ShouldEqual, expected)
+				})
+
+				Convey("Running jobs can register their outputs", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_outputs_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					sockFile := filepath.Join(tmpdir, "sock")
+
+					outCmd := "echo -n $WR_OUTPUTS_SOCKET > " + sockFile + " && sleep 2"
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: outCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "outputs"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+
+					regErr := make(chan error, 1)
+					go func() {
+						limit := time.After(2 * time.Second)
+						ticker := time.NewTicker(50 * time.Millisecond)
+						defer ticker.Stop()
+						for {
+							select {
+							case <-ticker.C:
+								sock, errr := ioutil.ReadFile(sockFile)
+								if errr != nil || len(sock) == 0 {
+									continue
+								}
+								os.Setenv(JobOutputsSocketEnvVar, string(sock))
+								regErr <- RegisterJobOutputs([]Artifact{{Name: "reads", Value: "42"}, {Path: sockFile}, {Name: "reads", Value: "43"}})
+								os.Unsetenv(JobOutputsSocketEnvVar)
+								return
+							case <-limit:
+								regErr <- fmt.Errorf("the cmd never reported its socket")
+								return
+							}
+						}
+					}()
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(<-regErr, ShouldBeNil)
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: outCmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job2, ShouldNotBeNil)
+					So(len(job2.Outputs), ShouldEqual, 2)
+					So(job2.Outputs[0].Name, ShouldEqual, "reads")
+					So(job2.Outputs[0].Value, ShouldEqual, "43")
+					So(job2.Outputs[1].Path, ShouldEqual, sockFile)
+					So(job2.Outputs[1].Size, ShouldBeGreaterThan, 0)
+
+					err = RegisterJobOutputs([]Artifact{{Name: "foo"}})
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Running jobs can get their own metadata", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_metadata_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					sockFile := filepath.Join(tmpdir, "sock")
+
+					mdCmd := "echo -n $WR_METADATA_SOCKET > " + sockFile + " && sleep 2"
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: mdCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "metadata"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+
+					mdCh := make(chan *JobMetadata, 1)
+					go func() {
+						limit := time.After(2 * time.Second)
+						ticker := time.NewTicker(50 * time.Millisecond)
+						defer ticker.Stop()
+						for {
+							select {
+							case <-ticker.C:
+								sock, errr := ioutil.ReadFile(sockFile)
+								if errr != nil || len(sock) == 0 {
+									continue
+								}
+								info, errs := os.Stat(filepath.Dir(string(sock)))
+								if errs != nil || info.Mode().Perm() != 0700 {
+									mdCh <- nil
+									return
+								}
+								os.Setenv(JobMetadataSocketEnvVar, string(sock))
+								md, errg := GetJobMetadata()
+								os.Unsetenv(JobMetadataSocketEnvVar)
+								if errg != nil {
+									md = nil
+								}
+								mdCh <- md
+								return
+							case <-limit:
+								mdCh <- nil
+								return
+							}
+						}
+					}()
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					md := <-mdCh
+					So(md, ShouldNotBeNil)
+					So(md.Key, ShouldEqual, job.key())
+					So(md.RepGroup, ShouldEqual, "metadata")
+					So(md.ReqGroup, ShouldEqual, "fake_group")
+					So(md.Attempt, ShouldEqual, 1)
+					So(md.MemoryMB, ShouldEqual, standardReqs.RAM)
+					So(md.Cores, ShouldEqual, standardReqs.Cores)
+					So(md.ActualCwd, ShouldEqual, job.ActualCwd)
+					So(md.RemainingSeconds, ShouldBeGreaterThan, 0)
+					So(md.RemainingSeconds, ShouldBeLessThanOrEqualTo, standardReqs.Time.Seconds())
+
+					_, err = GetJobMetadata()
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Jobs can be added in sorted batches with progress", func() {
+					jobs = nil
+					for i := 0; i < 25; i++ {
+						jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo bulk %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "bulk"})
+					}
+					var sent []int
+					added, existed, err := jq.AddBulk(jobs, envVars, true, 10, func(p *AddProgress) {
+						So(p.Total, ShouldEqual, 25)
+						sent = append(sent, p.Sent)
+					})
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 25)
+					So(existed, ShouldEqual, 0)
+					So(sent, ShouldResemble, []int{10, 20, 25})
+
+					added, existed, err = jq.AddBulk(jobs[5:15], envVars, true, 0, nil)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 0)
+					So(existed, ShouldEqual, 10)
+
+					got, err := jq.GetByRepGroup("bulk", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 25)
+
+					Convey("But not if any of them have dependencies", func() {
+						jobs = nil
+						for i := 0; i < 25; i++ {
+							jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo bulkdep %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "bulkdep", DepGroups: []string{"bulkdep"}})
+						}
+						jobs[0].DepGroups = nil
+						jobs[0].Dependencies = Dependencies{NewDepGroupDependency("bulkdep")}
+						sent = nil
+						added, existed, err = jq.AddBulk(jobs, envVars, true, 10, func(p *AddProgress) {
+							sent = append(sent, p.Sent)
+						})
+						So(err, ShouldBeNil)
+						So(added, ShouldEqual, 25)
+						So(existed, ShouldEqual, 0)
+						So(sent, ShouldResemble, []int{25})
+
+						job, err := jq.GetByEssence(&JobEssence{Cmd: "echo bulkdep 0"}, false, false)
+						So(err, ShouldBeNil)
+						So(job.State, ShouldEqual, JobStateDependent)
+					})
+				})
+
+				Convey("Clients can negotiate other wire encodings", func() {
+					defer func() {
+						ClientWireCodec = WireCodecBinc
+					}()
+					for _, wc := range []WireCodec{WireCodecJSON, WireCodecMsgpack} {
+						ClientWireCodec = wc
+						jqc, errc := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+						So(errc, ShouldBeNil)
+						h, _ := wireHandle(wc)
+						So(jqc.wire, ShouldEqual, h)
+
+						added, existed, errc := jqc.Add([]*Job{{Cmd: "echo " + string(wc), Cwd: "/tmp", ReqGroup: "codec", Requirements: standardReqs, RepGroup: "codec_" + string(wc)}}, envVars, true)
+						So(errc, ShouldBeNil)
+						So(added, ShouldEqual, 1)
+						So(existed, ShouldEqual, 0)
+						got, errc := jqc.GetByRepGroup("codec_"+string(wc), 0, "", false, false)
+						So(errc, ShouldBeNil)
+						So(len(got), ShouldEqual, 1)
+						So(got[0].Cmd, ShouldEqual, "echo "+string(wc))
+						So(got[0].Requirements.RAM, ShouldEqual, standardReqs.RAM)
+						jqc.Disconnect()
+					}
+
+					ClientWireCodec = WireCodec("foo")
+					jqc, errc := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+					So(errc, ShouldBeNil)
+					defer jqc.Disconnect()
+					h, _ := wireHandle(WireCodecBinc)
+					So(jqc.wire, ShouldEqual, h)
+					_, errc = jqc.GetServerInfo()
+					So(errc, ShouldBeNil)
+				})
+
+				Convey("Clients can connect through an HTTP proxy", func() {
+					ln, err := net.Listen("tcp", "127.0.0.1:0")
+					So(err, ShouldBeNil)
+					defer ln.Close()
+					var proxied []string
+					var pmutex sync.Mutex
+					go func() {
+						for {
+							conn, erra := ln.Accept()
+							if erra != nil {
+								return
+							}
+							go func(conn net.Conn) {
+								defer conn.Close()
+								br := bufio.NewReader(conn)
+								r, errr := http.ReadRequest(br)
+								if errr != nil || r.Method != "CONNECT" {
+									return
+								}
+								pmutex.Lock()
+								proxied = append(proxied, r.Host)
+								pmutex.Unlock()
+								remote, errd := net.Dial("tcp", r.Host)
+								if errd != nil {
+									fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+									return
+								}
+								defer remote.Close()
+								fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+								go io.Copy(remote, br)
+								io.Copy(conn, remote)
+							}(conn)
+						}
+					}()
+
+					defer func() {
+						ClientProxy = ""
+					}()
+					ClientProxy = "http://" + ln.Addr().String()
+					jqp, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+					So(err, ShouldBeNil)
+					So(jqp.ServerInfo.PID, ShouldEqual, jq.ServerInfo.PID)
+					added, _, err := jqp.Add([]*Job{{Cmd: "echo proxied", Cwd: "/tmp", ReqGroup: "proxied", Requirements: standardReqs, RepGroup: "proxied"}}, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+					err = jqp.Disconnect()
+					So(err, ShouldBeNil)
+					pmutex.Lock()
+					So(proxied, ShouldNotBeEmpty)
+					So(proxied[0], ShouldEqual, addr)
+					pmutex.Unlock()
+
+					ClientProxy = "gopher://" + ln.Addr().String()
+					_, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+					So(err, ShouldNotBeNil)
+
+					ClientProxy = "ssh://" + ln.Addr().String()
+					ClientProxySSHKey = ""
+					_, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Deleted jobs can be restored from the trash, unless purged", func() {
+					parent := &Job{Cmd: "echo trash parent", Cwd: "/tmp", ReqGroup: "trash", Requirements: standardReqs, RepGroup: "trash", DepGroups: []string{"trashparent"}}
+					child := &Job{Cmd: "echo trash child", Cwd: "/tmp", ReqGroup: "trash", Requirements: standardReqs, RepGroup: "trash", Dependencies: Dependencies{NewDepGroupDependency("trashparent")}}
+					added, _, err := jq.Add([]*Job{parent, child}, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 2)
+
+					jes := []*JobEssence{{Cmd: "echo trash parent"}, {Cmd: "echo trash child"}}
+					deleted, err := jq.Delete(jes)
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 2)
+					got, err := jq.GetByRepGroup("trash", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(got, ShouldBeEmpty)
+
+					tjs, err := jq.GetTrash("trash")
+					So(err, ShouldBeNil)
+					So(len(tjs), ShouldEqual, 2)
+					for _, tj := range tjs {
+						So(tj.Job.State, ShouldEqual, JobStateDeleted)
+						So(tj.Expires, ShouldHappenWithin, 1*time.Second, tj.Trashed.Add(1*time.Hour))
+					}
+					tjs, err = jq.GetTrash("other")
+					So(err, ShouldBeNil)
+					So(tjs, ShouldBeEmpty)
+
+					restored, err := jq.Restore(jes)
+					So(err, ShouldBeNil)
+					So(restored, ShouldEqual, 2)
+					tjs, err = jq.GetTrash("trash")
+					So(err, ShouldBeNil)
+					So(tjs, ShouldBeEmpty)
+					job, err := jq.GetByEssence(&JobEssence{Cmd: "echo trash child"}, false, true)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateDependent)
+					env, err := job.Env()
+					So(err, ShouldBeNil)
+					So(env, ShouldContain, envVars[0])
+
+					deleted, err = jq.Delete(jes)
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 2)
+					purged, err := jq.Purge(jes)
+					So(err, ShouldBeNil)
+					So(purged, ShouldEqual, 2)
+					tjs, err = jq.GetTrash("")
+					So(err, ShouldBeNil)
+					So(tjs, ShouldBeEmpty)
+					restored, err = jq.Restore(jes)
+					So(err, ShouldBeNil)
+					So(restored, ShouldEqual, 0)
+				})
+
+				Convey("Jobs can be cloned with modifications", func() {
+					orig := &Job{Cmd: "echo clone input_a", Cwd: "/tmp", ReqGroup: "clone", Requirements: standardReqs, RepGroup: "clone", Labels: map[string]string{"run": "1"}}
+					added, _, err := jq.Add([]*Job{orig}, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+					jes := []*JobEssence{{Cmd: "echo clone input_a"}}
+
+					added, existed, err := jq.Clone(jes, nil)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 0)
+					So(existed, ShouldEqual, 1)
+
+					_, _, err = jq.Clone(jes, &CloneMods{CmdReplace: []string{"input_a"}})
+					So(err, ShouldNotBeNil)
+
+					added, existed, err = jq.Clone(jes, &CloneMods{CmdReplace: []string{"input_a", "input_b"}, Reqs: &ReqChange{RAM: 2000}, RepGroup: "cloned"})
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+					So(existed, ShouldEqual, 0)
+
+					job, err := jq.GetByEssence(&JobEssence{Cmd: "echo clone input_b"}, false, true)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.RepGroup, ShouldEqual, "cloned")
+					So(job.Requirements.RAM, ShouldEqual, 2000)
+					So(job.Requirements.Time, ShouldEqual, standardReqs.Time)
+					So(job.Override, ShouldEqual, 1)
+					So(job.Labels, ShouldResemble, map[string]string{"run": "1"})
+					env, err := job.Env()
+					So(err, ShouldBeNil)
+					So(env, ShouldContain, envVars[0])
+
+					job, err = jq.GetByEssence(&JobEssence{Cmd: "echo clone input_a"}, false, false)
+					So(err, ShouldBeNil)
+					So(job.RepGroup, ShouldEqual, "clone")
+					So(job.Requirements.RAM, ShouldEqual, standardReqs.RAM)
+				})
+
+				Convey("Clients with incompatible protocol versions can't connect", func() {
+					So(jq.ServerInfo.Protocol, ShouldEqual, ProtocolVersion)
+					So(jq.ServerInfo.MinProtocol, ShouldEqual, MinProtocolVersion)
+
+					defer func() {
+						protocolVersion = ProtocolVersion
+						minProtocolVersion = MinProtocolVersion
+					}()
+					protocolVersion = 0
+					_, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+					So(err, ShouldNotBeNil)
+					verr, ok := err.(VersionError)
+					So(ok, ShouldBeTrue)
+					So(verr.ClientProtocol, ShouldEqual, 0)
+					So(verr.ServerProtocol, ShouldEqual, ProtocolVersion)
+					So(err.Error(), ShouldContainSubstring, "please upgrade the client")
+
+					_, err = jq.GetByRepGroup("profile", 0, "", false, false)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrIncompatible)
+				})
+
+				Convey("Crashes of runners are reported on the jobs they were running", func() {
+					dir, err := ioutil.TempDir("", "wr_jobqueue_test_crash_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(dir)
+					origInFlight, origCrash := ClientInFlightDir, ClientCrashDir
+					ClientInFlightDir = filepath.Join(dir, "inflight")
+					ClientCrashDir = filepath.Join(dir, "crashes")
+					defer func() {
+						ClientInFlightDir, ClientCrashDir = origInFlight, origCrash
+					}()
+
+					inserts, _, err := jq.Add([]*Job{{Cmd: "echo crashed", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "crash"}}, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, "echo crashed")
+
+					err = jq.recordInFlight(job, "", "", nil)
+					So(err, ShouldBeNil)
+
+					err = recordRunnerCrash(os.Getpid()+1, &RunnerCrash{Reason: RunnerCrashPanic})
+					So(err, ShouldBeNil)
+					entries, err := ioutil.ReadDir(ClientCrashDir)
+					So(os.IsNotExist(err) || len(entries) == 0, ShouldBeTrue)
+
+					crash := &RunnerCrash{Host: "host", PID: os.Getpid(), Time: time.Now(), Reason: RunnerCrashOOM, Detail: "killed while using 100MB"}
+					err = recordRunnerCrash(os.Getpid(), crash)
+					So(err, ShouldBeNil)
+					entries, err = ioutil.ReadDir(ClientCrashDir)
+					So(err, ShouldBeNil)
+					So(len(entries), ShouldEqual, 1)
+
+					reported, err := jq.ReportRunnerCrashes()
+					So(err, ShouldBeNil)
+					So(reported, ShouldEqual, 1)
+					entries, err = ioutil.ReadDir(ClientCrashDir)
+					So(err, ShouldBeNil)
+					So(len(entries), ShouldEqual, 0)
+
+					got, err := jq.GetByEssence(&JobEssence{JobKey: job.key()}, false, false)
+					So(err, ShouldBeNil)
+					So(got, ShouldNotBeNil)
+					So(got.RunnerCrash, ShouldNotBeNil)
+					So(got.RunnerCrash.Reason, ShouldEqual, RunnerCrashOOM)
+					So(got.RunnerCrash.Detail, ShouldEqual, "killed while using 100MB")
+					So(got.RunnerCrash.Host, ShouldEqual, "host")
+				})
+
+				Convey("AddWithResults() adds the valid jobs and says why others were rejected", func() {
+					jobs := []*Job{
+						{Cmd: "echo valid", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "addresults"},
+						{Cmd: "echo negative", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: -1, Time: 1 * time.Second, Cores: 1}, RepGroup: "addresults"},
+						{Cmd: "echo label", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "addresults", Labels: map[string]string{"bad key": "v"}},
+						{Cmd: "echo valid", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "addresults"},
+					}
+					results, err := jq.AddWithResults(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(len(results), ShouldEqual, 4)
+					So(results[0].Status, ShouldEqual, AddStatusAdded)
+					So(results[0].Key, ShouldEqual, jobs[0].key())
+					So(results[1].Status, ShouldEqual, AddStatusRejected)
+					So(results[1].Reason, ShouldContainSubstring, "negative")
+					So(results[2].Status, ShouldEqual, AddStatusRejected)
+					So(results[2].Reason, ShouldContainSubstring, ErrBadLabel)
+					So(results[3].Status, ShouldEqual, AddStatusExisted)
+					So(results[3].Reason, ShouldBeEmpty)
+
+					got, err := jq.GetByRepGroup("addresults", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+
+					Convey("Whereas Add() adds none of them", func() {
+						jobs[0].Cmd = "echo valid2"
+						added, _, err := jq.Add(jobs[:2], envVars, true)
+						So(err, ShouldNotBeNil)
+						jqerr, ok := err.(Error)
+						So(ok, ShouldBeTrue)
+						So(jqerr.Err, ShouldEqual, ErrInvalidJob)
+						So(added, ShouldEqual, 0)
+
+						got, err = jq.GetByRepGroup("addresults", 0, "", false, false)
+						So(err, ShouldBeNil)
+						So(len(got), ShouldEqual, 1)
+					})
+
+					Convey("Jobs needing more than the maximum RAM are rejected", func() {
+						huge := []*Job{{Cmd: "echo huge", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: MaxRAM * 2, Time: 1 * time.Second, Cores: 1}, RepGroup: "addresults"}}
+						hugeResults, err := jq.AddWithResults(huge, envVars, true)
+						So(err, ShouldBeNil)
+						So(len(hugeResults), ShouldEqual, 1)
+						So(hugeResults[0].Status, ShouldEqual, AddStatusRejected)
+						So(hugeResults[0].Reason, ShouldContainSubstring, "maximum")
+
+						got, err = jq.GetByRepGroup("addresults", 0, "", false, false)
+						So(err, ShouldBeNil)
+						So(len(got), ShouldEqual, 1)
+					})
+				})
+
+				Convey("Dependency cycles are rejected, and buried parents bury their children", func() {
+					cycle := []*Job{
+						{Cmd: "echo cycle a", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cycle", DepGroups: []string{"cyc_a"}, Dependencies: Dependencies{NewDepGroupDependency("cyc_b")}},
+						{Cmd: "echo cycle b", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cycle", DepGroups: []string{"cyc_b"}, Dependencies: Dependencies{NewDepGroupDependency("cyc_a")}},
+					}
+					_, _, err := jq.Add(cycle, envVars, true)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrDependencyCycle)
+
+					_, _, err = jq.Add(cycle[:1], envVars, true)
+					So(err, ShouldBeNil)
+					_, _, err = jq.Add(cycle[1:], envVars, true)
+					So(err, ShouldNotBeNil)
+					So(err.(Error).Err, ShouldEqual, ErrDependencyCycle)
+
+					self := []*Job{{Cmd: "echo self", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cycle", DepGroups: []string{"self"}, Dependencies: Dependencies{NewDepGroupDependency("self")}}}
+					_, _, err = jq.Add(self, envVars, true)
+					So(err, ShouldNotBeNil)
+					So(err.(Error).Err, ShouldEqual, ErrDependencyCycle)
+
+					jobs := []*Job{
+						{Cmd: "false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dag", Retries: 0},
+						{Cmd: "echo dag child", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dag", Dependencies: Dependencies{NewEssenceDependency("false", "")}},
+						{Cmd: "echo dag grandchild", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "dag", Dependencies: Dependencies{NewEssenceDependency("echo dag child", "")}},
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
+
+					tree, err := jq.GetDependencyTree(&JobEssence{Cmd: "echo dag child"})
+					So(err, ShouldBeNil)
+					So(tree.State, ShouldEqual, JobStateDependent)
+					So(len(tree.Parents), ShouldEqual, 1)
+					So(tree.Parents[0].Cmd, ShouldEqual, "false")
+					So(tree.Parents[0].State, ShouldEqual, JobStateReady)
+					So(len(tree.Children), ShouldEqual, 1)
+					So(tree.Children[0].Cmd, ShouldEqual, "echo dag grandchild")
+					_, err = jq.GetDependencyTree(&JobEssence{Cmd: "echo not added"})
+					So(err, ShouldNotBeNil)
+					So(err.(Error).Err, ShouldEqual, ErrMissingJob)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, "false")
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+
+					buried := func() int {
+						got, errg := jq.GetByRepGroup("dag", 0, JobStateBuried, false, false)
+						So(errg, ShouldBeNil)
+						return len(got)
+					}
+					for i := 0; i < 50 && buried() < 3; i++ {
+						<-time.After(20 * time.Millisecond)
+					}
+					So(buried(), ShouldEqual, 3)
+					child, err := jq.GetByEssence(&JobEssence{Cmd: "echo dag grandchild"}, false, false)
+					So(err, ShouldBeNil)
+					So(child.FailReason, ShouldEqual, FailReasonParent)
+
+					kicked, err := jq.Kick([]*JobEssence{{Cmd: "false"}})
+					So(err, ShouldBeNil)
+					So(kicked, ShouldEqual, 1)
+					got, err := jq.GetByRepGroup("dag", 0, JobStateDependent, false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 2)
+				})
+
+				Convey("Subscribe() streams events for the jobs that pass its filter", func() {
+					events, err := jq.Subscribe(JobFilter{RepGroup: "subscribed"})
+					So(err, ShouldBeNil)
+					finished, err := jq.Subscribe(JobFilter{States: []JobState{JobStateComplete, JobStateBuried}})
+					So(err, ShouldBeNil)
+
+					jobs := []*Job{
+						{Cmd: "echo subscribed", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "subscribed"},
+						{Cmd: "echo ignored", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "ignored", Priority: 1},
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						errr = jq.Execute(job, config.RunnerExecShell)
+						So(errr, ShouldBeNil)
+					}
+
+					next := func(ch <-chan *JobEvent) *JobEvent {
+						select {
+						case event := <-ch:
+							return event
+						case <-time.After(5 * time.Second):
+							return nil
+						}
+					}
+
+					var states []JobState
+					for {
+						event := next(events)
+						So(event, ShouldNotBeNil)
+						So(event.RepGroup, ShouldEqual, "subscribed")
+						states = append(states, event.State)
+						if event.State == JobStateComplete {
+							So(event.Cmd, ShouldEqual, "echo subscribed")
+							So(event.Exitcode, ShouldEqual, 0)
+							break
+						}
+					}
+					So(states, ShouldContain, JobStateReserved)
+					So(states, ShouldContain, JobStateRunning)
+
+					cmds := make(map[string]bool)
+					for i := 0; i < 2; i++ {
+						event := next(finished)
+						So(event, ShouldNotBeNil)
+						So(event.State, ShouldEqual, JobStateComplete)
+						cmds[event.Cmd] = true
+					}
+					So(cmds["echo subscribed"], ShouldBeTrue)
+					So(cmds["echo ignored"], ShouldBeTrue)
+				})
+
+				Convey("Variables in Cmds are replaced with the granted resources when executed", func() {
+					tmplCmd := "echo {MEM} {CORES} {TIME} {ATTEMPT} {OUTPUT_DIR} ${MEM:-unset} {NOPE}"
+					jobs := []*Job{{Cmd: tmplCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "tmpl", OutputDest: "s3://b/{repgroup}", KeepStd: true}}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					job, err = jq.GetByEssence(&JobEssence{Cmd: tmplCmd}, true, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, tmplCmd)
+					stdout, err := job.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, "10 1 10 1 s3://b/tmpl unset {NOPE}")
+
+					tmpl := &Job{Requirements: standardReqs}
+					So(tmpl.expandCmd("cd {TMPDIR} && ls {CWD}", 2, 100, "/tmp/x", "/work"), ShouldEqual, "cd /tmp/x && ls /work")
+				})
+
+				Convey("Jobs with Fallbacks try each in turn before being buried", func() {
+					fbReqs := &jqs.Requirements{RAM: 20, Time: 10 * time.Second, Cores: 1}
+					jobs := []*Job{{Cmd: "false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "fb", KeepStd: true, Retries: 0, Fallbacks: []*Fallback{
+						{Cmd: "wr_fallback_test_not_a_cmd"},
+						{Cmd: "echo fallback {ATTEMPT} {MEM}", Requirements: fbReqs},
+					}}}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(1 * time.Second)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						So(job.FallbackIndex, ShouldEqual, i)
+						errr = jq.Execute(job, config.RunnerExecShell)
+						So(errr, ShouldNotBeNil)
+
+						job, errr = jq.GetByEssence(&JobEssence{Cmd: "false"}, false, false)
+						So(errr, ShouldBeNil)
+						So(job.State, ShouldNotEqual, JobStateBuried)
+						So(job.FallbackIndex, ShouldEqual, i+1)
+					}
+
+					job, err := jq.Reserve(1 * time.Second)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Requirements.RAM, ShouldEqual, 20)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					job, err = jq.GetByEssence(&JobEssence{Cmd: "false"}, true, false)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					So(job.Cmd, ShouldEqual, "false")
+					So(job.Attempts, ShouldEqual, 3)
+					stdout, err := job.StdOut()
+					So(err, ShouldBeNil)
+					So(stdout, ShouldEqual, "fallback 3 20")
+
+					_, _, err = jq.Add([]*Job{{Cmd: "true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "fb", Fallbacks: []*Fallback{{}}}}, envVars, true)
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Metrics emitted by Cmds are stored and summarised per RepGroup", func() {
+					jobs := []*Job{
+						{Cmd: "echo reads 10 >> $" + MetricsFileEnvVar + " && echo not a metric >> $" + MetricsFileEnvVar, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "metrics/a"},
+						{Cmd: "echo reads=30 >> $" + MetricsFileEnvVar + " && echo qual 0.5 >> $" + MetricsFileEnvVar, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "metrics/b"},
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						errr = jq.Execute(job, config.RunnerExecShell)
+						So(errr, ShouldBeNil)
+					}
+
+					job, err := jq.GetByEssence(&JobEssence{Cmd: jobs[0].Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job.Metrics, ShouldResemble, map[string]float64{"reads": 10})
+
+					rgms, err := jq.GetRepGroupMetrics("metrics")
+					So(err, ShouldBeNil)
+					So(len(rgms), ShouldEqual, 3)
+					So(rgms[0].RepGroup, ShouldEqual, "metrics")
+					reads := rgms[0].Metrics["reads"]
+					So(reads, ShouldNotBeNil)
+					So(reads.Count, ShouldEqual, 2)
+					So(reads.Mean(), ShouldEqual, 20)
+					So(reads.Min, ShouldEqual, 10)
+					So(reads.Max, ShouldEqual, 30)
+					So(rgms[0].Metrics["qual"].Count, ShouldEqual, 1)
+					So(rgms[1].RepGroup, ShouldEqual, "metrics/a")
+					So(rgms[1].Metrics["qual"], ShouldBeNil)
+					So(rgms[2].Metrics["reads"].Sum, ShouldEqual, 30)
+
+					metrics, err := parseMetrics(strings.NewReader("a 1\nb=2e3\nbad name 3\nc NaN\na 4\n"))
+					So(err, ShouldBeNil)
+					So(metrics, ShouldResemble, map[string]float64{"a": 4, "b": 2000})
+				})
+
+				Convey("Chaos mode injects faults that clients recover from", func() {
+					defer server.SetChaos(nil)
+					server.SetChaos(&ChaosConfig{ArchiveFailOnce: true, ReserveDelay: 200 * time.Millisecond, Seed: 1})
+
+					jobs := []*Job{
+						{Cmd: "echo chaos 1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "chaos"},
+						{Cmd: "echo chaos 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "chaos"},
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					started := time.Now()
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(time.Since(started), ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					job, err = jq.GetByEssence(&JobEssence{Cmd: job.Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					server.SetChaos(&ChaosConfig{TouchDropRate: 1})
+					_, err = jq.Touch(job)
+					So(err, ShouldNotBeNil)
+					server.SetChaos(nil)
+					_, err = jq.Touch(job)
+					So(err, ShouldBeNil)
+				})
+
+				Convey("AddReqGroupSamples() seeds the learned requirements of ReqGroups", func() {
+					err := jq.AddReqGroupSamples([]*ReqGroupSample{{ReqGroup: "backfilled", RAM: 1450, Time: 20 * time.Minute}})
+					So(err, ShouldBeNil)
+					err = jq.AddReqGroupSamples([]*ReqGroupSample{{ReqGroup: "backfilled"}})
+					So(err, ShouldNotBeNil)
+
+					profiles, err := jq.GetReqGroupProfiles()
+					So(err, ShouldBeNil)
+					var found *ReqGroupProfile
+					for _, p := range profiles {
+						if p.ReqGroup == "backfilled" {
+							found = p
+						}
+					}
+					So(found, ShouldNotBeNil)
+					So(found.RAM, ShouldEqual, 1500)
+					So(found.Time, ShouldEqual, 30*time.Minute)
+					So(found.Override, ShouldBeFalse)
+				})
+
+				Convey("Modify() changes queued jobs in place", func() {
+					jobs := []*Job{
+						{Cmd: "echo mod parent", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "mod", Retries: 1},
+						{Cmd: "echo mod child", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "mod", Dependencies: Dependencies{NewEssenceDependency("echo mod parent", "")}},
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+					parent := &JobEssence{Cmd: "echo mod parent"}
+
+					_, err = jq.Modify([]*JobEssence{parent}, &JobModification{})
+					So(err, ShouldNotBeNil)
+
+					retries := uint8(5)
+					changes := &JobModification{Requirements: &ReqChange{RAM: 50}, Retries: &retries}
+					err = changes.SetEnv([]string{"WR_MOD_TEST=yes"})
+					So(err, ShouldBeNil)
+					modified, err := jq.Modify([]*JobEssence{parent}, changes)
+					So(err, ShouldBeNil)
+					So(modified, ShouldEqual, 1)
+
+					job, err := jq.GetByEssence(parent, false, true)
+					So(err, ShouldBeNil)
+					So(job.Requirements.RAM, ShouldEqual, 50)
+					So(job.Override, ShouldEqual, 1)
+					So(job.Retries, ShouldEqual, 5)
+					So(job.UntilBuried, ShouldEqual, 6)
+					env, err := job.Env()
+					So(err, ShouldBeNil)
+					So(env, ShouldContain, "WR_MOD_TEST=yes")
+
+					modified, err = jq.Modify([]*JobEssence{parent}, &JobModification{Cmd: "echo mod parent 2"})
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrModifyConflict)
+					So(modified, ShouldEqual, 0)
+					job, err = jq.GetByEssence(parent, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+
+					modified, err = jq.Modify([]*JobEssence{{Cmd: "echo mod child"}}, &JobModification{Cmd: "echo mod child 2"})
+					So(err, ShouldBeNil)
+					So(modified, ShouldEqual, 1)
+					job, err = jq.GetByEssence(&JobEssence{Cmd: "echo mod child"}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+					job, err = jq.GetByEssence(&JobEssence{Cmd: "echo mod child 2"}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateDependent)
+				})
+
+				Convey("Jobs with a CallbackURL get it POSTed to when they finish", func() {
+					origBackoff := callbackBackoff
+					callbackBackoff = 10 * time.Millisecond
+					defer func() {
+						callbackBackoff = origBackoff
+					}()
+
+					var cbMutex sync.Mutex
+					var attempts int
+					received := make(map[string]*CallbackEvent)
+					signed := make(map[string]bool)
+					events := make(map[string]string)
+					ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						cbMutex.Lock()
+						defer cbMutex.Unlock()
+						attempts++
+						if attempts == 1 {
+							w.WriteHeader(http.StatusServiceUnavailable)
+							return
+						}
+						body, errr := ioutil.ReadAll(r.Body)
+						if errr != nil {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						ce := &CallbackEvent{}
+						errr = json.Unmarshal(body, ce)
+						if errr != nil {
+							w.WriteHeader(http.StatusBadRequest)
+							return
+						}
+						received[ce.Cmd] = ce
+						signed[ce.Cmd] = r.Header.Get(CallbackSignatureHeader) == callbackSignature(body, token)
+						events[ce.Cmd] = r.Header.Get(CallbackEventHeader)
+					}))
+					defer ts.Close()
+
+					var jobs []*Job
+					jobs = append(jobs, &Job{Cmd: "echo callback", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "callback", CallbackURL: ts.URL})
+					jobs = append(jobs, &Job{Cmd: "false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "callback", CallbackURL: ts.URL, Retries: 0})
+					jobs = append(jobs, &Job{Cmd: "echo nocallback", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "callback"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
+
+					for i := 0; i < 3; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						jq.Execute(job, config.RunnerExecShell)
+					}
+
+					for i := 0; i < 50; i++ {
+						<-time.After(20 * time.Millisecond)
+						cbMutex.Lock()
+						n := len(received)
+						cbMutex.Unlock()
+						if n == 2 {
+							break
+						}
+					}
+					cbMutex.Lock()
+					defer cbMutex.Unlock()
+					So(attempts, ShouldEqual, 3)
+					So(len(received), ShouldEqual, 2)
+					So(received["echo callback"], ShouldNotBeNil)
+					So(received["echo callback"].State, ShouldEqual, JobStateComplete)
+					So(received["echo callback"].Exitcode, ShouldEqual, 0)
+					So(received["echo callback"].RepGroup, ShouldEqual, "callback")
+					So(events["echo callback"], ShouldEqual, string(JobStateComplete))
+					So(signed["echo callback"], ShouldBeTrue)
+					So(received["false"], ShouldNotBeNil)
+					So(received["false"].State, ShouldEqual, JobStateBuried)
+					So(received["false"].Exitcode, ShouldEqual, 1)
+					So(events["false"], ShouldEqual, string(JobStateBuried))
+					So(signed["false"], ShouldBeTrue)
+					So(received["echo nocallback"], ShouldBeNil)
+				})
+
+				Convey("The server can record a timeline of queue state", func() {
+					var jobs []*Job
+					jobs = append(jobs, &Job{Cmd: "echo timeline1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "timeline/a"})
+					jobs = append(jobs, &Job{Cmd: "echo timeline2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "timeline/b"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					tss, err := jq.GetTimeline("", time.Time{})
+					So(err, ShouldBeNil)
+					So(len(tss), ShouldEqual, 0)
+
+					server.simutex.Lock()
+					server.schedIssues["old"] = &schedulerIssue{Msg: "old", FirstDate: time.Now().Add(-time.Hour).Unix(), LastDate: time.Now().Add(-time.Hour).Unix(), Count: 1}
+					server.schedIssues["quota"] = &schedulerIssue{Msg: "quota", FirstDate: time.Now().Unix(), LastDate: time.Now().Unix(), Count: 1}
+					server.simutex.Unlock()
+
+					err = server.recordTimeline(time.Now().Add(-time.Minute))
+					So(err, ShouldBeNil)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					server.simutex.Lock()
+					delete(server.schedIssues, "quota")
+					server.simutex.Unlock()
+					err = server.recordTimeline(time.Now())
+					So(err, ShouldBeNil)
+
+					tss, err = jq.GetTimeline("timeline", time.Time{})
+					So(err, ShouldBeNil)
+					So(len(tss), ShouldEqual, 2)
+					So(tss[0].Time.Before(tss[1].Time), ShouldBeTrue)
+					So(tss[0].Counts("timeline")[JobStateReady], ShouldEqual, 2)
+					So(tss[0].Counts("timeline/a")[JobStateReady], ShouldEqual, 1)
+					So(tss[0].Counts("timeline")[JobStateComplete], ShouldEqual, 0)
+					So(tss[0].Blocked, ShouldResemble, []string{"quota"})
+					So(tss[1].Counts("timeline")[JobStateReady], ShouldEqual, 1)
+					So(tss[1].Counts("timeline")[JobStateComplete], ShouldEqual, 1)
+					So(tss[1].Counts(job.RepGroup)[JobStateComplete], ShouldEqual, 1)
+					So(len(tss[1].Blocked), ShouldEqual, 0)
+					for _, rgc := range tss[1].RepGroups {
+						So(rgc.RepGroup, ShouldStartWith, "timeline")
+					}
+
+					tss, err = jq.GetTimeline("timeline/b", tss[1].Time)
+					So(err, ShouldBeNil)
+					So(len(tss), ShouldEqual, 1)
+					So(len(tss[0].RepGroups), ShouldEqual, 1)
+
+					purged, err := server.db.purgeTimelineBefore(time.Now())
+					So(err, ShouldBeNil)
+					So(purged, ShouldEqual, 2)
+					tss, err = jq.GetTimeline("", time.Time{})
+					So(err, ShouldBeNil)
+					So(len(tss), ShouldEqual, 0)
+				})
+
+				Convey("You can bridge a message queue to add jobs and publish their events", func() {
+					broker := newTestBroker()
+					stop := make(chan struct{})
+					var rejected int
+					opts := &BridgeOptions{
+						Defaults:    &JobDefaults{RepGrp: "bridge", Cwd: "/tmp", Memory: 10, Time: 1 * time.Second},
+						Env:         envVars,
+						EventsTopic: "events",
+						Interval:    50 * time.Millisecond,
+						Rejected: func(body []byte, err error) {
+							rejected++
+						},
+					}
+					bridged := make(chan error, 1)
+					go func() {
+						bridged <- jq.Bridge(broker, "jobs", opts, stop)
+					}()
+
+					bad := &testBrokerMessage{body: []byte(`{"cwd": "/tmp"}`), handled: make(chan string, 1)}
+					broker.msgs <- bad
+					So(<-bad.handled, ShouldEqual, "reject")
+
+					good := &testBrokerMessage{body: []byte(`[{"cmd": "echo bridged1"}, {"cmd": "false", "rep_grp": "bridge2", "retries": 0}]`), handled: make(chan string, 1)}
+					broker.msgs <- good
+					So(<-good.handled, ShouldEqual, "ack")
+					So(rejected, ShouldEqual, 1)
+
+					jobs, err := jq.GetByRepGroup("bridge", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(jobs), ShouldEqual, 1)
+					So(jobs[0].Cmd, ShouldEqual, "echo bridged1")
+					So(len(broker.getPublished("events")), ShouldEqual, 0)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						jq.Execute(job, config.RunnerExecShell)
+					}
+
+					var events [][]byte
+					for i := 0; i < 20; i++ {
+						<-time.After(50 * time.Millisecond)
+						events = broker.getPublished("events")
+						if len(events) == 2 {
+							break
+						}
+					}
+					So(len(events), ShouldEqual, 2)
+					states := make(map[string]JobState)
+					for _, e := range events {
+						be := &BridgeEvent{}
+						err = json.Unmarshal(e, be)
+						So(err, ShouldBeNil)
+						states[be.Cmd] = be.State
+					}
+					So(states["echo bridged1"], ShouldEqual, JobStateComplete)
+					So(states["false"], ShouldEqual, JobStateBuried)
+
+					close(stop)
+					So(<-bridged, ShouldBeNil)
+				})
+
+				Convey("You can watch a directory and add jobs for new files", func() {
+					dir, err := ioutil.TempDir("", "wr_jobqueue_test_watch_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(dir)
+					err = os.Mkdir(filepath.Join(dir, "sub"), 0700)
+					So(err, ShouldBeNil)
+					write := func(name, content string) {
+						errw := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+						So(errw, ShouldBeNil)
+					}
+					write("a.cram", "a")
+					write("b.txt", "b")
+					write("sub/c.cram", "c")
+
+					var addedFiles []string
+					var addedNew []bool
+					opts := &WatchOptions{
+						Dir:      dir,
+						Pattern:  "*.cram",
+						Template: &Job{Cmd: "echo {name} {stem}", Cwd: "/tmp", ReqGroup: "watch", Requirements: standardReqs, RepGroup: "watch/{stem}"},
+						Env:      envVars,
+						Seen:     make(map[string]bool),
+						Added: func(file *WatchedFile, job *Job, added bool) {
+							addedFiles = append(addedFiles, file.Path)
+							addedNew = append(addedNew, added)
+						},
+					}
+					pending := make(map[string]string)
+
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(addedFiles, ShouldBeEmpty)
+
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(addedFiles, ShouldResemble, []string{filepath.Join(dir, "a.cram")})
+					So(addedNew, ShouldResemble, []bool{true})
+					So(len(opts.Seen), ShouldEqual, 1)
+
+					jobs, err := jq.GetByRepGroup("watch/a", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(jobs), ShouldEqual, 1)
+					So(jobs[0].Cmd, ShouldEqual, "echo a.cram a")
+					So(jobs[0].Labels[WatchKeyLabel], ShouldNotBeBlank)
+
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(len(addedFiles), ShouldEqual, 1)
+
+					<-time.After(10 * time.Millisecond)
+					write("a.cram", "a2")
+					write("d.cram", "d")
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(len(addedFiles), ShouldEqual, 1)
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(addedFiles[1:], ShouldResemble, []string{filepath.Join(dir, "a.cram"), filepath.Join(dir, "d.cram")})
+					So(addedNew[1:], ShouldResemble, []bool{false, true})
+
+					opts.Recursive = true
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					err = jq.watchPoll(opts, pending)
+					So(err, ShouldBeNil)
+					So(addedFiles[len(addedFiles)-1], ShouldEqual, filepath.Join(dir, "sub", "c.cram"))
+				})
+
+				Convey("Clients with the read-only token can only query", func() {
+					roToken := server.ReadOnlyToken()
+					So(len(roToken), ShouldEqual, tokenLength)
+					So(string(roToken), ShouldNotEqual, string(token))
+
+					job := &Job{Cmd: "echo ro", Cwd: "/tmp", ReqGroup: "ro", Requirements: standardReqs, RepGroup: "ro"}
+					added, _, err := jq.Add([]*Job{job}, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+
+					rojq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, roToken, clientConnectTime)
+					So(err, ShouldBeNil)
+					defer rojq.Disconnect()
+
+					got, err := rojq.GetByRepGroup("ro", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+					_, err = rojq.GetIncomplete(0, "", false, false)
+					So(err, ShouldBeNil)
+
+					got, err = rojq.GetByRepGroup("ro", 0, "", true, true)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+					So(got[0].EnvCRetrieved, ShouldBeFalse)
+					So(len(got[0].EnvC), ShouldEqual, 0)
+					got, err = jq.GetByRepGroup("ro", 0, "", true, true)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+					So(got[0].EnvCRetrieved, ShouldBeTrue)
+					So(len(got[0].EnvC), ShouldBeGreaterThan, 0)
+					So(scopeReadOnly.getStdEnv(), ShouldBeFalse)
+					So(scopeFull.getStdEnv(), ShouldBeTrue)
+
+					_, _, err = rojq.Add([]*Job{{Cmd: "echo ro2", Cwd: "/tmp", ReqGroup: "ro", Requirements: standardReqs, RepGroup: "ro"}}, envVars, true)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrReadOnlyToken)
+
+					_, err = rojq.Delete([]*JobEssence{{Cmd: "echo ro"}})
+					So(err, ShouldNotBeNil)
+					err = rojq.SetSecret("RO_SECRET", []byte("foo"))
+					So(err, ShouldNotBeNil)
+					So(rojq.ShutdownServer(), ShouldBeFalse)
+
+					got, err = jq.GetByRepGroup("ro", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+
+					So(scopeReadOnly.allowedHTTP(http.MethodGet), ShouldBeTrue)
+					So(scopeReadOnly.allowedHTTP(http.MethodPost), ShouldBeFalse)
+					So(scopeReadOnly.allowedHTTP(http.MethodDelete), ShouldBeFalse)
+					So(scopeFull.allowedHTTP(http.MethodDelete), ShouldBeTrue)
+				})
+
+				Convey("Jobs can be added to run in a stored environment profile", func() {
+					job := &Job{Cmd: "echo profile", Cwd: "/tmp", ReqGroup: "profile", Requirements: standardReqs, RepGroup: "profile"}
+					_, _, err := jq.AddWithEnvProfile([]*Job{job}, "shared", true, 0, nil)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrUnknownEnvProfile)
+
+					err = jq.SetEnvProfile("shared", []string{"WR_PROFILE_VAR=shared"})
+					So(err, ShouldBeNil)
+					names, err := jq.GetEnvProfileNames()
+					So(err, ShouldBeNil)
+					So(names, ShouldResemble, []string{"shared"})
+
+					added, _, err := jq.AddWithEnvProfile([]*Job{job}, "shared", true, 0, nil)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+
+					got, err := jq.GetByEssence(&JobEssence{Cmd: "echo profile"}, false, true)
+					So(err, ShouldBeNil)
+					So(got, ShouldNotBeNil)
+					env, err := got.Env()
+					So(err, ShouldBeNil)
+					So(env, ShouldContain, "WR_PROFILE_VAR=shared")
+					So(env, ShouldNotContain, envVars[0])
+
+					err = jq.DeleteEnvProfile("shared")
+					So(err, ShouldBeNil)
+					err = jq.DeleteEnvProfile("shared")
+					So(err, ShouldNotBeNil)
+					names, err = jq.GetEnvProfileNames()
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+
+					got, err = jq.GetByEssence(&JobEssence{Cmd: "echo profile"}, false, true)
+					So(err, ShouldBeNil)
+					env, err = got.Env()
+					So(err, ShouldBeNil)
+					So(env, ShouldContain, "WR_PROFILE_VAR=shared")
+				})
+
+				Convey("Jobs inherit the mounts and behaviours set for their RepGroup", func() {
+					mcs := MountConfigs{{Mount: "/tmp/wr_rgd_mount", Targets: []MountTarget{{Path: "bucket/path"}}}}
+					onSuccess := &Behaviour{When: OnSuccess, Do: CleanupAll}
+					onExit := &Behaviour{When: OnExit, Do: Run, Arg: "touch foo"}
+					err := jq.SetRepGroupDefaults([]*RepGroupDefaults{{Pattern: "project-x/*"}})
+					So(err, ShouldNotBeNil)
+					err = jq.SetRepGroupDefaults([]*RepGroupDefaults{{Pattern: "[", Behaviours: Behaviours{onSuccess}}})
+					So(err, ShouldNotBeNil)
+
+					err = jq.SetRepGroupDefaults([]*RepGroupDefaults{
+						{Pattern: "project-x/*", MountConfigs: mcs, Behaviours: Behaviours{onSuccess, onExit}},
+						{Pattern: "project-x/special", Behaviours: Behaviours{onExit}},
+					})
+					So(err, ShouldBeNil)
+					defaults, err := jq.GetRepGroupDefaults()
+					So(err, ShouldBeNil)
+					So(len(defaults), ShouldEqual, 2)
+					So(defaults[0].Pattern, ShouldEqual, "project-x/*")
+					So(defaults[0].MountConfigs, ShouldResemble, mcs)
+					So(defaults[1].Pattern, ShouldEqual, "project-x/special")
+
+					ownExit := &Behaviour{When: OnExit, Do: CleanupAll}
+					inputJobs := []*Job{
+						{Cmd: "echo rgd1", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-x/a"},
+						{Cmd: "echo rgd2", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-x/b", Behaviours: Behaviours{ownExit}},
+						{Cmd: "echo rgd3", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-x/special"},
+						{Cmd: "echo rgd4", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-y/a"},
+						{Cmd: "echo rgd5", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-x/a/b"},
+					}
+					added, _, err := jq.Add(inputJobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 5)
+
+					get := func(rg string) *Job {
+						got, errg := jq.GetByRepGroup(rg, 0, "", false, false)
+						So(errg, ShouldBeNil)
+						So(len(got), ShouldEqual, 1)
+						return got[0]
+					}
+					job := get("project-x/a")
+					So(job.MountConfigs, ShouldResemble, mcs)
+					So(len(job.Behaviours), ShouldEqual, 2)
+					So(job.Behaviours[0].Do, ShouldEqual, CleanupAll)
+					So(job.Behaviours[1].Arg, ShouldEqual, "touch foo")
+
+					job = get("project-x/b")
+					So(job.MountConfigs, ShouldResemble, mcs)
+					So(len(job.Behaviours), ShouldEqual, 2)
+					So(job.Behaviours[0].When, ShouldEqual, OnExit)
+					So(job.Behaviours[0].Do, ShouldEqual, CleanupAll)
+					So(job.Behaviours[1].When, ShouldEqual, OnSuccess)
+
+					job = get("project-x/special")
+					So(job.MountConfigs, ShouldBeEmpty)
+					So(len(job.Behaviours), ShouldEqual, 1)
+					So(job.Behaviours[0].Arg, ShouldEqual, "touch foo")
+
+					job = get("project-y/a")
+					So(job.MountConfigs, ShouldBeEmpty)
+					So(job.Behaviours, ShouldBeEmpty)
+
+					job = get("project-x/a/b")
+					So(job.Behaviours, ShouldBeEmpty)
+
+					deleted, err := jq.DeleteRepGroupDefaults([]string{"project-x/*", "project-z/*"})
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 1)
+					added, _, err = jq.Add([]*Job{{Cmd: "echo rgd6", Cwd: "/tmp", ReqGroup: "rgd", Requirements: standardReqs, RepGroup: "project-x/c"}}, envVars, true)
+					So(err, ShouldBeNil)
+					So(added, ShouldEqual, 1)
+					job = get("project-x/c")
+					So(job.MountConfigs, ShouldBeEmpty)
+					So(job.Behaviours, ShouldBeEmpty)
+				})
+
+				Convey("Clients can cache static queries", func() {
+					si, err := jq.GetServerInfo()
+					So(err, ShouldBeNil)
+					So(si.PID, ShouldEqual, jq.ServerInfo.PID)
+
+					jq.EnableCache(0)
+					si2, err := jq.GetServerInfo()
+					So(err, ShouldBeNil)
+					So(si2, ShouldEqual, jq.ServerInfo)
+					si3, err := jq.GetServerInfo()
+					So(err, ShouldBeNil)
+					So(si3, ShouldEqual, si2)
+
+					names, err := jq.GetSecretNames()
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+					err = jq2.SetSecret("WR_TEST_CACHED", []byte("foo"))
+					So(err, ShouldBeNil)
+					names, err = jq.GetSecretNames()
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+
+					err = jq.SetSecret("WR_TEST_CACHED2", []byte("foo"))
+					So(err, ShouldBeNil)
+					names, err = jq.GetSecretNames()
+					So(err, ShouldBeNil)
+					So(len(names), ShouldEqual, 2)
+
+					jq.InvalidateCache()
+					si4, err := jq.GetServerInfo()
+					So(err, ShouldBeNil)
+					So(si4, ShouldNotEqual, si2)
+					So(si4.PID, ShouldEqual, si2.PID)
+
+					jq.DisableCache()
+					err = jq.DeleteSecret("WR_TEST_CACHED")
+					So(err, ShouldBeNil)
+					err = jq.DeleteSecret("WR_TEST_CACHED2")
+					So(err, ShouldBeNil)
+				})
+
+				Convey("Jobs can be given secrets", func() {
+					err := jq.SetSecret("not a valid name", []byte("foo"))
+					So(err, ShouldNotBeNil)
+
+					err = jq.SetSecret("WR_TEST_SECRET", []byte("s3cr3t"))
+					So(err, ShouldBeNil)
+					names, err := jq.GetSecretNames()
+					So(err, ShouldBeNil)
+					So(names, ShouldResemble, []string{"WR_TEST_SECRET"})
+
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_secrets_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					secretFile := filepath.Join(tmpdir, "secret")
+
+					secretCmd := "echo -n $WR_TEST_SECRET > " + secretFile
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: secretCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "secrets", Secrets: []string{"WR_TEST_SECRET"}})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					content, err := ioutil.ReadFile(secretFile)
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "s3cr3t")
+
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: secretCmd}, false, true)
+					So(err, ShouldBeNil)
+					So(job2.Secrets, ShouldResemble, []string{"WR_TEST_SECRET"})
+					env, err := job2.Env()
+					So(err, ShouldBeNil)
+					for _, envvar := range env {
+						So(envvar, ShouldNotContainSubstring, "s3cr3t")
+					}
+
+					Convey("Jobs needing deleted secrets get buried", func() {
+						err = jq.DeleteSecret("WR_TEST_SECRET")
+						So(err, ShouldBeNil)
+						err = jq.DeleteSecret("WR_TEST_SECRET")
+						So(err, ShouldNotBeNil)
+
+						jobs = nil
+						jobs = append(jobs, &Job{Cmd: "echo $WR_TEST_SECRET", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "secrets", Secrets: []string{"WR_TEST_SECRET"}})
+						inserts, _, err := jq.Add(jobs, envVars, true)
+						So(err, ShouldBeNil)
+						So(inserts, ShouldEqual, 1)
+
+						job, err := jq.Reserve(50 * time.Millisecond)
+						So(err, ShouldBeNil)
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldNotBeNil)
+						So(job.State, ShouldEqual, JobStateBuried)
+						So(job.FailReason, ShouldEqual, FailReasonSecrets)
+					})
+				})
+
+				Convey("Uploaded files can be listed, fetched and deleted", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_uploads_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					localPath := filepath.Join(tmpdir, "upload")
+					uploadContent := []byte("uploaded " + tmpdir + "\n")
+					err = ioutil.WriteFile(localPath, uploadContent, 0600)
+					So(err, ShouldBeNil)
+
+					remotePath, err := jq.UploadFile(localPath, "")
+					So(err, ShouldBeNil)
+
+					findUpload := func() *UploadedFile {
+						ufs, errg := jq.GetUploads()
+						So(errg, ShouldBeNil)
+						for _, uf := range ufs {
+							if uf.Path == remotePath {
+								return uf
+							}
+						}
+						return nil
+					}
+					uf := findUpload()
+					So(uf, ShouldNotBeNil)
+					So(uf.Size, ShouldEqual, int64(len(uploadContent)))
+					So(uf.Refs, ShouldEqual, 0)
+
+					content, err := jq.FetchUpload(remotePath)
+					So(err, ShouldBeNil)
+					So(content, ShouldResemble, uploadContent)
+					_, err = jq.FetchUpload(localPath)
+					So(err, ShouldNotBeNil)
+
+					jobs = nil
+					other := map[string]string{"cloud_config_files": remotePath + ":~/.wr_test.config"}
+					jobs = append(jobs, &Job{Cmd: "echo uploads", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1, Other: other}, RepGroup: "uploads"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					uf = findUpload()
+					So(uf, ShouldNotBeNil)
+					So(uf.Refs, ShouldEqual, 1)
+
+					_, err = jq.GCUploads(0)
+					So(err, ShouldBeNil)
+					So(findUpload(), ShouldNotBeNil)
+					err = jq.DeleteUpload(remotePath, false)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrUploadInUse)
+
+					err = jq.DeleteUpload(remotePath, true)
+					So(err, ShouldBeNil)
+					So(findUpload(), ShouldBeNil)
+					_, err = jq.FetchUpload(remotePath)
+					So(err, ShouldNotBeNil)
+				})
+
+				Convey("Host setup and cleanup commands run once per host", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_hostsetup_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					ClientHostSetupDir = filepath.Join(tmpdir, "hostsetup")
+					defer func() {
+						ClientHostSetupDir = ""
+					}()
+					hostFile := filepath.Join(tmpdir, "host")
+
+					reqs := &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1, Other: map[string]string{hostSetupOther: "echo setup >> " + hostFile, hostCleanupOther: "echo cleanup >> " + hostFile}}
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo 1 >> " + hostFile, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: reqs, RepGroup: "hostsetup"})
+					jobs = append(jobs, &Job{Cmd: "echo 2 >> " + hostFile, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: reqs, RepGroup: "hostsetup"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldBeNil)
+					}
+
+					err = jq.HostCleanup()
+					So(err, ShouldBeNil)
+					content, err := ioutil.ReadFile(hostFile)
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "setup\n1\n2\ncleanup\n")
+
+					Convey("Jobs whose host setup fails get buried", func() {
+						jobs = nil
+						jobs = append(jobs, &Job{Cmd: "echo 3", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1, Other: map[string]string{hostSetupOther: "false"}}, RepGroup: "hostsetup"})
+						inserts, _, err := jq.Add(jobs, envVars, true)
+						So(err, ShouldBeNil)
+						So(inserts, ShouldEqual, 1)
+
+						job, err := jq.Reserve(50 * time.Millisecond)
+						So(err, ShouldBeNil)
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldNotBeNil)
+						So(job.State, ShouldEqual, JobStateBuried)
+						So(job.FailReason, ShouldEqual, FailReasonHostSet)
+					})
+				})
+
+				Convey("Cmds are executed through the configured wrappers", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_wrapper_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					wrapFile := filepath.Join(tmpdir, "wrap")
+
+					server.cmdWrapper = "echo wrapped >> " + wrapFile + " &&"
+					server.cmdWrappers = map[string]string{"wrapper/none": "", "wrapper/env": "env WR_WRAPPED=yes"}
+					defer func() {
+						server.cmdWrapper = ""
+						server.cmdWrappers = nil
+					}()
+
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo 'a b' >> " + wrapFile, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "wrapper"})
+					jobs = append(jobs, &Job{Cmd: "echo none >> " + wrapFile, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "wrapper/none/sub", Priority: 1})
+					jobs = append(jobs, &Job{Cmd: "echo $WR_WRAPPED >> " + wrapFile, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "wrapper/env", Priority: 2})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
+
+					for i := 0; i < 3; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						err = jq.Execute(job, config.RunnerExecShell)
+						So(err, ShouldBeNil)
+					}
+
+					content, err := ioutil.ReadFile(wrapFile)
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "yes\nnone\nwrapped\na b\n")
+
+					job, err := jq.GetByEssence(&JobEssence{Cmd: "echo 'a b' >> " + wrapFile}, false, false)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "echo 'a b' >> "+wrapFile)
+				})
+
+				Convey("Sandboxes are deleted or kept according to their policy, and kept ones get reaped", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_sandbox_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+
+					sp, err := ParseSandboxPolicy("delete=success,keep=1ms")
+					So(err, ShouldBeNil)
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "touch out", Cwd: tmpdir, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "sandbox", SandboxPolicy: sp, Priority: 1})
+					jobs = append(jobs, &Job{Cmd: "touch out && touch $TMPDIR/tmp && false", Cwd: tmpdir, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "sandbox", SandboxPolicy: sp})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "touch out")
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.ActualCwd, ShouldNotBeBlank)
+					_, err = os.Stat(filepath.Dir(job.ActualCwd))
+					So(os.IsNotExist(err), ShouldBeTrue)
+
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job.Cmd, ShouldEqual, "touch out && touch $TMPDIR/tmp && false")
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldNotBeNil)
+					sandbox := filepath.Dir(job.ActualCwd)
+					_, err = os.Stat(filepath.Join(job.ActualCwd, "out"))
+					So(err, ShouldBeNil)
+					_, err = os.Stat(filepath.Join(sandbox, "tmp", "tmp"))
+					So(err, ShouldBeNil)
+
+					<-time.After(5 * time.Millisecond)
+					reaped, err := jq.ReapSandboxes()
+					So(err, ShouldBeNil)
+					So(reaped, ShouldEqual, 1)
+					_, err = os.Stat(sandbox)
+					So(os.IsNotExist(err), ShouldBeTrue)
+					_, err = os.Stat(filepath.Join(tmpdir, AppName+"_cwd"))
+					So(err, ShouldBeNil)
+
+					reaped, err = jq.ReapSandboxes()
+					So(err, ShouldBeNil)
+					So(reaped, ShouldEqual, 0)
+				})
+
+				Convey("Cmds can find out how many cores and how much RAM they were given", func() {
+					tmpdir, err := ioutil.TempDir("", "wr_jobqueue_test_cores_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(tmpdir)
+					coresFile := filepath.Join(tmpdir, "cores")
+
+					coresCmd := "echo -n $WR_CORES:$WR_RAM > " + coresFile
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: coresCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cores"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					err = jq.Execute(job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					content, err := ioutil.ReadFile(coresFile)
+					So(err, ShouldBeNil)
+					So(string(content), ShouldEqual, "1:10")
+				})
+
+				Convey("Jobs with a StartRate don't all start at once", func() {
+					jobs = nil
+					for i := 0; i < 3; i++ {
+						jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo startrate %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "startrate", StartRate: 2})
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.StartRate, ShouldEqual, 2)
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					job, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldBeNil)
+
+					in := server.q.Internals(0)
+					So(in.Held, ShouldEqual, 1)
+					So(in.Ready, ShouldEqual, 1)
+				})
+
+				Convey("startLimiter says when the next start is allowed and forgets old RepGroups", func() {
+					sl := &startLimiter{starts: make(map[string][]time.Time)}
+					ok, _ := sl.allow("a", 0)
+					So(ok, ShouldBeTrue)
+					before := time.Now()
+					ok, _ = sl.allow("a", 1)
+					So(ok, ShouldBeTrue)
+					ok, until := sl.allow("a", 1)
+					So(ok, ShouldBeFalse)
+					So(until, ShouldHappenOnOrBetween, before.Add(1*time.Minute), time.Now().Add(1*time.Minute))
+
+					sl.starts["old"] = []time.Time{time.Now().Add(-2 * time.Minute)}
+					sl.lastPrune = time.Now().Add(-2 * time.Minute)
+					ok, _ = sl.allow("b", 1)
+					So(ok, ShouldBeTrue)
+					So(sl.starts, ShouldNotContainKey, "old")
+					So(sl.starts, ShouldContainKey, "a")
+					So(sl.starts, ShouldContainKey, "b")
+				})
+
+				Convey("Jobs in limit groups don't run more at once than the limits", func() {
+					err := jq.SetLimitGroups([]*LimitGroup{{Name: "db writes", Limit: 1}})
+					So(err, ShouldNotBeNil)
+					err = jq.SetLimitGroups([]*LimitGroup{{Name: "db-writes", Limit: -1}})
+					So(err, ShouldNotBeNil)
+					err = jq.SetLimitGroups([]*LimitGroup{{Name: "db-writes", Limit: 1}, {Name: "irods", Limit: 2}})
+					So(err, ShouldBeNil)
+
+					_, _, err = jq.Add([]*Job{{Cmd: "echo badlimit", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, LimitGroups: []string{"a,b"}}}, envVars, true)
+					So(err, ShouldNotBeNil)
+
+					jobs = nil
+					for i := 0; i < 3; i++ {
+						jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo limitgroup %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: fmt.Sprintf("limitgroup%d", i), LimitGroups: []string{"db-writes", "irods"}, Priority: uint8(3 - i)})
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
 
-				Convey("Both current and archived jobs can be retrieved with GetByRepGroup", func() {
-					jobs, err = jq.GetByRepGroup("manually_added", 0, "", false, false)
+					job, err := jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
-					So(len(jobs), ShouldEqual, 2)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, "echo limitgroup 0")
+					So(job.LimitGroups, ShouldResemble, []string{"db-writes", "irods"})
+					job2, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job2, ShouldBeNil)
 
-					Convey("But only current jobs are retrieved with GetIncomplete", func() {
-						jobs, err = jq.GetIncomplete(0, "", false, false)
-						So(err, ShouldBeNil)
-						So(len(jobs), ShouldEqual, 1)
-						So(jobs[0].Cmd, ShouldEqual, "sleep 0.1 && false")
-						//*** should probably have a better test, where there are incomplete jobs in each of the sub queues
-					})
-				})
+					groups, err := jq.GetLimitGroups()
+					So(err, ShouldBeNil)
+					So(groups, ShouldResemble, []*LimitGroup{{Name: "db-writes", Limit: 1, Running: 1}, {Name: "irods", Limit: 2, Running: 1}})
+					So(server.q.Internals(0).Held, ShouldEqual, 2)
 
-				Convey("A temp failed job is reservable after a delay", func() {
-					job, err = jq.Reserve(50 * time.Millisecond)
+					err = jq.Execute(job, config.RunnerExecShell)
 					So(err, ShouldBeNil)
-					So(job, ShouldBeNil)
-					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+					<-time.After(50 * time.Millisecond)
+
+					groups, err = jq.GetLimitGroups()
 					So(err, ShouldBeNil)
-					So(job2, ShouldNotBeNil)
-					So(job2.State, ShouldEqual, JobStateDelayed)
+					So(groups, ShouldResemble, []*LimitGroup{{Name: "db-writes", Limit: 1}, {Name: "irods", Limit: 2}})
+					So(server.q.Internals(0).Held, ShouldEqual, 0)
 
-					<-time.After(60 * time.Millisecond)
-					job, err = jq.Reserve(5 * time.Millisecond)
+					job, err = jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
 					So(job, ShouldNotBeNil)
-					So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
-					So(job.State, ShouldEqual, JobStateReserved)
-					So(job.Attempts, ShouldEqual, 1)
-					So(job.UntilBuried, ShouldEqual, 2)
-					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
+					So(job.Cmd, ShouldEqual, "echo limitgroup 1")
+					job2, err = jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job2, ShouldBeNil)
+
+					err = jq.SetLimitGroups([]*LimitGroup{{Name: "db-writes", Limit: 5}})
+					So(err, ShouldBeNil)
+					job2, err = jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
 					So(job2, ShouldNotBeNil)
-					So(job2.State, ShouldEqual, JobStateReserved)
+					So(job2.Cmd, ShouldEqual, "echo limitgroup 2")
 
-					Convey("After 2 retries (3 attempts) it gets buried", func() {
-						err = jq.Execute(job, config.RunnerExecShell)
-						So(err, ShouldNotBeNil)
-						So(job.State, ShouldEqual, JobStateDelayed)
-						So(job.Exited, ShouldBeTrue)
-						So(job.Exitcode, ShouldEqual, 1)
-						So(job.Attempts, ShouldEqual, 2)
-						So(job.UntilBuried, ShouldEqual, 1)
+					deleted, err := jq.DeleteLimitGroups([]string{"db-writes", "foo"})
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 1)
+					groups, err = jq.GetLimitGroups()
+					So(err, ShouldBeNil)
+					So(groups, ShouldResemble, []*LimitGroup{{Name: "db-writes", Limit: -1, Running: 2}, {Name: "irods", Limit: 2, Running: 2}})
 
-						<-time.After(210 * time.Millisecond)
-						job, err = jq.Reserve(5 * time.Millisecond)
-						So(err, ShouldBeNil)
-						So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
-						So(job.State, ShouldEqual, JobStateReserved)
-						So(job.Attempts, ShouldEqual, 2)
-						So(job.UntilBuried, ShouldEqual, 1)
+					deleted, err = jq.DeleteLimitGroups([]string{"irods"})
+					So(err, ShouldBeNil)
+					So(deleted, ShouldEqual, 1)
+				})
 
-						err = jq.Execute(job, config.RunnerExecShell)
-						So(err, ShouldNotBeNil)
+				Convey("Buried jobs can be summarised by how they failed", func() {
+					jobs = nil
+					for i := 0; i < 3; i++ {
+						jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo 'cannot write /tmp/out.%d: No space left on device' >&2 && false", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "failsum"})
+					}
+					jobs = append(jobs, &Job{Cmd: "echo 'segfault at 0x7f3a ip 12' >&2 && false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "failsum"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 4)
+
+					for i := 0; i < 4; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						errr = jq.Execute(job, config.RunnerExecShell)
+						So(errr, ShouldNotBeNil)
 						So(job.State, ShouldEqual, JobStateBuried)
-						So(job.Exited, ShouldBeTrue)
-						So(job.Exitcode, ShouldEqual, 1)
-						So(job.Attempts, ShouldEqual, 3)
-						So(job.UntilBuried, ShouldEqual, 0)
+					}
 
-						<-time.After(210 * time.Millisecond)
-						job, err = jq.Reserve(5 * time.Millisecond)
-						So(err, ShouldBeNil)
-						So(job, ShouldBeNil)
+					failures, err := jq.GetFailureSummary("failsum")
+					So(err, ShouldBeNil)
+					So(len(failures), ShouldEqual, 2)
+					So(failures[0].Count, ShouldEqual, 3)
+					So(failures[0].Error, ShouldEqual, "cannot write <path> No space left on device")
+					So(len(failures[0].Hosts), ShouldEqual, 1)
+					So(failures[1].Count, ShouldEqual, 1)
+					So(failures[1].Error, ShouldEqual, "segfault at <n> ip <n>")
+					So(failures[1].Example, ShouldEqual, "echo 'segfault at 0x7f3a ip 12' >&2 && false")
+
+					failures, err = jq.GetFailureSummary("")
+					So(err, ShouldBeNil)
+					So(len(failures), ShouldBeGreaterThanOrEqualTo, 2)
 
-						Convey("Once buried it can be kicked back to ready state and be reserved again", func() {
-							job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
-							So(err, ShouldBeNil)
-							So(job2, ShouldNotBeNil)
-							So(job2.State, ShouldEqual, JobStateBuried)
+					failures, err = jq.GetFailureSummary("foo")
+					So(err, ShouldBeNil)
+					So(len(failures), ShouldEqual, 0)
+				})
 
-							kicked, err := jq.Kick([]*JobEssence{{Cmd: "sleep 0.1 && false"}})
-							So(err, ShouldBeNil)
-							So(kicked, ShouldEqual, 1)
+				Convey("Jobs can be labelled, and found by their labels", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo label 1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "labels", Labels: map[string]string{"sample": "S1", "project": "P1"}})
+					jobs = append(jobs, &Job{Cmd: "echo label 2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "labels", Labels: map[string]string{"sample": "S2", "project": "P1"}})
+					jobs = append(jobs, &Job{Cmd: "echo label 3", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "labels"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 3)
 
-							job, err = jq.Reserve(5 * time.Millisecond)
-							So(err, ShouldBeNil)
-							So(job, ShouldNotBeNil)
-							So(job.Cmd, ShouldEqual, "sleep 0.1 && false")
-							So(job.State, ShouldEqual, JobStateReserved)
-							So(job.Attempts, ShouldEqual, 3)
-							So(job.UntilBuried, ShouldEqual, 3)
+					got, err := jq.GetByLabel("sample", "S1", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 1)
+					So(got[0].Cmd, ShouldEqual, "echo label 1")
+					So(got[0].Labels, ShouldResemble, map[string]string{"sample": "S1", "project": "P1"})
 
-							job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
-							So(err, ShouldBeNil)
-							So(job2, ShouldNotBeNil)
-							So(job2.State, ShouldEqual, JobStateReserved)
-							So(job2.Attempts, ShouldEqual, 3)
-							So(job2.UntilBuried, ShouldEqual, 3)
+					got, err = jq.GetByLabel("project", "P1", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 2)
 
-							Convey("If you do nothing with a reserved job, it auto reverts back to delayed", func() {
-								<-time.After(210 * time.Millisecond)
-								job2, err = jq2.GetByEssence(&JobEssence{Cmd: "sleep 0.1 && false"}, false, false)
-								So(err, ShouldBeNil)
-								So(job2, ShouldNotBeNil)
-								So(job2.State, ShouldEqual, JobStateDelayed)
-								So(job2.Attempts, ShouldEqual, 3)
-								So(job2.UntilBuried, ShouldEqual, 3)
-							})
-						})
+					got, err = jq.GetByLabel("sample", "", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 2)
+
+					Convey("Labels can be changed after the jobs were added", func() {
+						updated, err := jq.SetLabels([]*JobEssence{{Cmd: "echo label 1"}, {Cmd: "echo label 3"}}, map[string]string{"sample": "", "version": "2"})
+						So(err, ShouldBeNil)
+						So(updated, ShouldEqual, 2)
+
+						got, err = jq.GetByLabel("sample", "S1", 0, "", false, false)
+						So(err, ShouldBeNil)
+						So(len(got), ShouldEqual, 0)
+
+						got, err = jq.GetByLabel("version", "2", 0, "", false, false)
+						So(err, ShouldBeNil)
+						So(len(got), ShouldEqual, 2)
+
+						job, err := jq.GetByEssence(&JobEssence{Cmd: "echo label 1"}, false, false)
+						So(err, ShouldBeNil)
+						So(job.Labels, ShouldResemble, map[string]string{"project": "P1", "version": "2"})
+
+						_, err = jq.SetLabels([]*JobEssence{{Cmd: "echo label 1"}}, map[string]string{"bad key": "foo"})
+						So(err, ShouldNotBeNil)
 					})
 				})
-			})
 
-			Convey("Jobs can be deleted in any state except running", func() {
-				for _, added := range jobs {
-					job, err := jq.GetByEssence(&JobEssence{Cmd: added.Cmd}, false, false)
+				Convey("Jobs can be retrieved and counted by hierarchical RepGroups", func() {
+					jobs = nil
+					for i, rg := range []string{"tree/a/s1", "tree/a/s2", "tree/b", "tree2"} {
+						jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo tree %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: rg})
+					}
+					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
-					So(job, ShouldNotBeNil)
-					So(job.State, ShouldEqual, JobStateReady)
+					So(inserts, ShouldEqual, 4)
 
-					deleted, err := jq.Delete([]*JobEssence{{Cmd: added.Cmd}})
+					got, err := jq.GetByRepGroupTree("tree/a", 0, "", false, false)
 					So(err, ShouldBeNil)
-					So(deleted, ShouldEqual, 1)
+					So(len(got), ShouldEqual, 2)
 
-					job, err = jq.GetByEssence(&JobEssence{Cmd: added.Cmd}, false, false)
+					got, err = jq.GetByRepGroupTree("tree", 0, "", false, false)
 					So(err, ShouldBeNil)
-					So(job, ShouldBeNil)
+					So(len(got), ShouldEqual, 3)
 
-					//*** add tests to show this doesn't work if running...
-				}
-				job, err := jq.Reserve(5 * time.Millisecond)
-				So(err, ShouldBeNil)
-				So(job, ShouldBeNil)
+					got, err = jq.GetByRepGroupTree("tree/", 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(got), ShouldEqual, 3)
 
-				Convey("Cmds with pipes in them are handled correctly", func() {
+					rgcs, err := jq.GetRepGroupCounts("tree")
+					So(err, ShouldBeNil)
+					So(len(rgcs), ShouldEqual, 5)
+					expected := []string{"tree", "tree/a", "tree/a/s1", "tree/a/s2", "tree/b"}
+					expectedReady := []int{3, 2, 1, 1, 1}
+					for i, rgc := range rgcs {
+						So(rgc.RepGroup, ShouldEqual, expected[i])
+						So(rgc.Counts[JobStateReady], ShouldEqual, expectedReady[i])
+					}
+				})
+
+				Convey("You can wait for all the jobs in a RepGroup to finish", func() {
 					jobs = nil
-					jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true | true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_pass"})
-					jobs = append(jobs, &Job{Cmd: "sleep 0.1 && true | false | true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_fail"})
+					jobs = append(jobs, &Job{Cmd: "echo waited && true", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "wait"})
+					jobs = append(jobs, &Job{Cmd: "echo waited && false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "wait"})
 					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
 					So(inserts, ShouldEqual, 2)
 
-					// pipe job that succeeds
-					job, err := jq.Reserve(50 * time.Millisecond)
+					var progressed int
+					opts := &WaitOptions{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond, Progress: func(ws *WaitSummary) { progressed++ }}
+					summary, err := jq.WaitForRepGroup("wait", opts)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrWaitTimeout)
+					So(summary.Incomplete, ShouldEqual, 2)
+					So(summary.Counts[JobStateReady], ShouldEqual, 2)
+					So(progressed, ShouldBeGreaterThan, 1)
+
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						jq.Execute(job, config.RunnerExecShell)
+					}
+
+					summary, err = jq.WaitForRepGroup("wait", opts)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, "sleep 0.1 && true | true")
-					So(job.State, ShouldEqual, JobStateReserved)
+					So(summary.Complete, ShouldEqual, 1)
+					So(summary.Buried, ShouldEqual, 1)
+					So(summary.Incomplete, ShouldEqual, 0)
+					So(summary.Total(), ShouldEqual, 2)
 
-					err = jq.Execute(job, config.RunnerExecShell)
+					_, err = jq.WaitForRepGroup("wait_missing", opts)
+					So(err, ShouldNotBeNil)
+					jqerr, ok = err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrMissingJob)
+
+					summary, err = jq.WaitForJobs([]*JobEssence{{Cmd: "echo waited && false"}}, opts)
 					So(err, ShouldBeNil)
-					So(job.State, ShouldEqual, JobStateComplete)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, 0)
-					So(job.FailReason, ShouldEqual, "")
+					So(summary.Complete, ShouldEqual, 0)
+					So(summary.Buried, ShouldEqual, 1)
+				})
 
-					// pipe job that fails in the middle
-					job, err = jq.Reserve(50 * time.Millisecond)
+				Convey("Jobs can capture the environment they ran in", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo fingerprinted", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "fp", CaptureFingerprint: true})
+					jobs = append(jobs, &Job{Cmd: "echo not fingerprinted", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "fp"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, "sleep 0.1 && true | false | true")
-					So(job.State, ShouldEqual, JobStateReserved)
+					So(inserts, ShouldEqual, 2)
 
-					err = jq.Execute(job, config.RunnerExecShell)
-					So(err, ShouldNotBeNil)
-					So(err.Error(), ShouldEqual, "command [sleep 0.1 && true | false | true] exited with code 1, which may be a temporary issue, so it will be tried again") //*** can fail with a receive time out; why?!
-					So(job.State, ShouldEqual, JobStateDelayed)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, 1)
-					So(job.FailReason, ShouldEqual, FailReasonExit)
+					for i := 0; i < 2; i++ {
+						job, errr := jq.Reserve(50 * time.Millisecond)
+						So(errr, ShouldBeNil)
+						So(job, ShouldNotBeNil)
+						errr = jq.Execute(job, config.RunnerExecShell)
+						So(errr, ShouldBeNil)
+					}
+
+					job, err := jq2.GetByEssence(&JobEssence{Cmd: "echo fingerprinted"}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					So(job.CaptureFingerprint, ShouldBeTrue)
+					So(job.Fingerprint, ShouldNotBeNil)
+					So(job.Fingerprint.Arch, ShouldEqual, runtime.GOARCH)
+					So(job.Fingerprint.OS, ShouldNotBeBlank)
+
+					job, err = jq2.GetByEssence(&JobEssence{Cmd: "echo not fingerprinted"}, false, false)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+					So(job.Fingerprint, ShouldBeNil)
 				})
 
-				Convey("Invalid commands are immediately buried", func() {
+				Convey("Jobs can write an execution report to their working directory", func() {
+					reportDir, err := ioutil.TempDir("", "wr_jobqueue_test_report_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(reportDir)
+
 					jobs = nil
-					jobs = append(jobs, &Job{Cmd: "awesjnalakjf --foo", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "should_fail"})
+					jobs = append(jobs, &Job{Cmd: "echo reported && exit 3", Cwd: reportDir, CwdMatters: true, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "report", ExecutionReport: true})
 					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
 					So(inserts, ShouldEqual, 1)
 
-					// job that fails because of non-existent exe
 					job, err := jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, "awesjnalakjf --foo")
-					So(job.State, ShouldEqual, JobStateReserved)
-
+					So(job, ShouldNotBeNil)
+					So(job.ExecutionReport, ShouldBeTrue)
 					err = jq.Execute(job, config.RunnerExecShell)
 					So(err, ShouldNotBeNil)
-					So(err.Error(), ShouldEqual, "command [awesjnalakjf --foo] exited with code 127 (command not found), which seems permanent, so it has been buried")
-					So(job.State, ShouldEqual, JobStateBuried)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, 127)
-					So(job.FailReason, ShouldEqual, FailReasonCFound)
 
-					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "awesjnalakjf --foo"}, false, false)
+					data, err := ioutil.ReadFile(filepath.Join(reportDir, ClientReportFile))
 					So(err, ShouldBeNil)
-					So(job2, ShouldNotBeNil)
-					So(job2.State, ShouldEqual, JobStateBuried)
-					So(job2.FailReason, ShouldEqual, FailReasonCFound)
-
-					//*** how to test the other bury cases of invalid exit code
-					// and permission problems on the exe?
+					report := &ExecutionReport{}
+					err = json.Unmarshal(data, report)
+					So(err, ShouldBeNil)
+					So(report.Cmd, ShouldEqual, "echo reported && exit 3")
+					So(report.RepGroup, ShouldEqual, "report")
+					So(report.Exitcode, ShouldEqual, 3)
+					So(report.FailReason, ShouldEqual, FailReasonExit)
+					So(report.Cwd, ShouldEqual, reportDir)
+					So(report.Host, ShouldNotBeBlank)
+					So(report.Ended.After(report.Started), ShouldBeTrue)
+					So(report.Mounts, ShouldBeEmpty)
 				})
 
-				Convey("If a job uses too much memory it is killed and we recommend more next time", func() {
+				Convey("End states that couldn't be reported can be reconciled by another client later", func() {
+					inFlightDir, err := ioutil.TempDir("", "wr_jobqueue_test_inflight_")
+					So(err, ShouldBeNil)
+					ClientInFlightDir = inFlightDir
+					defer func() {
+						ClientInFlightDir = ""
+						os.RemoveAll(inFlightDir)
+					}()
+
 					jobs = nil
-					cmd := "perl -e '@a; for (1..3) { push(@a, q[a] x 50000000); sleep(1) }'"
-					jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "run_out_of_mem"})
-					RecMBRound = 1
-					inserts, already, err := jq.Add(jobs, envVars, true)
+					jobs = append(jobs, &Job{Cmd: "echo inflight", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "inflight"})
+					jobs = append(jobs, &Job{Cmd: "echo inflight disowned", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "inflight"})
+					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
-					So(inserts, ShouldEqual, 1)
-					So(already, ShouldEqual, 0)
+					So(inserts, ShouldEqual, 2)
 
 					job, err := jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, cmd)
-					So(job.State, ShouldEqual, JobStateReserved)
+					So(job.Cmd, ShouldEqual, "echo inflight")
+					err = jq.Started(job, os.Getpid())
+					So(err, ShouldBeNil)
+					err = jq.recordInFlight(job, inFlightActionArchive, "", &JobEndState{Exitcode: 0, Exited: true})
+					So(err, ShouldBeNil)
 
-					err = jq.Execute(job, config.RunnerExecShell)
-					So(err, ShouldNotBeNil)
-					jqerr, ok := err.(Error)
-					So(ok, ShouldBeTrue)
-					So(jqerr.Err, ShouldEqual, FailReasonRAM)
-					So(job.State, ShouldEqual, JobStateDelayed)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, -1)
-					So(job.FailReason, ShouldEqual, FailReasonRAM)
-					So(job.Requirements.RAM, ShouldEqual, 1200)
-					jq.Delete([]*JobEssence{{Cmd: cmd}})
-				})
+					disownedJob, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(disownedJob.Cmd, ShouldEqual, "echo inflight disowned")
+					err = jq.recordInFlight(disownedJob, inFlightActionBury, FailReasonExit, &JobEndState{Exitcode: 1, Exited: true})
+					So(err, ShouldBeNil)
+					err = jq.Release(disownedJob, nil, "")
+					So(err, ShouldBeNil)
+
+					entries, err := ioutil.ReadDir(inFlightDir)
+					So(err, ShouldBeNil)
+					So(len(entries), ShouldEqual, 2)
 
-				RecMBRound = 100 // revert back to normal
+					ourID := jq2.clientid
+					reconciled, err := jq2.ReconcileInFlight()
+					So(err, ShouldBeNil)
+					So(reconciled, ShouldEqual, 1)
+					So(jq2.clientid, ShouldResemble, ourID)
 
-				Convey("The stdout/err of jobs is only kept for failed jobs, and cwd&TMPDIR&HOME get set appropriately", func() {
-					jobs = nil
-					baseDir, err := ioutil.TempDir("", "wr_jobqueue_test_runner_dir_")
+					entries, err = ioutil.ReadDir(inFlightDir)
 					So(err, ShouldBeNil)
-					defer os.RemoveAll(baseDir)
-					tmpDir := filepath.Join(baseDir, "jobqueue tmpdir") // testing that it works with spaces in the name
-					err = os.Mkdir(tmpDir, os.ModePerm)
+					So(len(entries), ShouldEqual, 0)
+
+					got, err := jq2.GetByEssence(&JobEssence{Cmd: "echo inflight"}, false, false)
 					So(err, ShouldBeNil)
-					jobs = append(jobs, &Job{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir, CwdMatters: true, ChangeHome: true, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "should_pass"})
-					jobs = append(jobs, &Job{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir, CwdMatters: false, ChangeHome: true, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "should_fail"})
+					So(got.State, ShouldEqual, JobStateComplete)
+					got, err = jq2.GetByEssence(&JobEssence{Cmd: "echo inflight disowned"}, false, false)
+					So(err, ShouldBeNil)
+					So(got.State, ShouldEqual, JobStateDelayed)
+				})
+
+				Convey("The stdout/err of successful jobs can be kept", func() {
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo kept && echo kepterr >&2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "keepstd", KeepStd: true})
 					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
-					So(inserts, ShouldEqual, 2)
+					So(inserts, ShouldEqual, 1)
 
-					// job that outputs to stdout and stderr but succeeds
 					job, err := jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'")
-					So(job.State, ShouldEqual, JobStateReserved)
+					So(job.KeepStd, ShouldBeTrue)
 
 					err = jq.Execute(job, config.RunnerExecShell)
 					So(err, ShouldBeNil)
 					So(job.State, ShouldEqual, JobStateComplete)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, 0)
-					stdout, err := job.StdOut()
-					So(err, ShouldBeNil)
-					So(stdout, ShouldEqual, tmpDir+"-"+os.Getenv("HOME"))
-					stderr, err := job.StdErr()
-					So(err, ShouldBeNil)
-					So(stderr, ShouldEqual, os.TempDir())
 
-					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; warn File::Spec->tmpdir, qq[\\n]'", Cwd: tmpDir}, true, false)
+					job2, err := jq2.GetByEssence(&JobEssence{Cmd: "echo kept && echo kepterr >&2"}, true, false)
 					So(err, ShouldBeNil)
 					So(job2, ShouldNotBeNil)
 					So(job2.State, ShouldEqual, JobStateComplete)
-					stdout, err = job2.StdOut()
+					stdout, err := job2.StdOut()
 					So(err, ShouldBeNil)
-					So(stdout, ShouldEqual, "")
-					stderr, err = job2.StdErr()
+					So(stdout, ShouldEqual, "kept")
+					stderr, err := job2.StdErr()
 					So(err, ShouldBeNil)
-					So(stderr, ShouldEqual, "")
+					So(stderr, ShouldEqual, "kepterr")
+				})
 
-					// job that outputs to stdout and stderr and fails
-					job, err = jq.Reserve(50 * time.Millisecond)
+				Convey("The stdout/err of jobs can be followed while they run", func() {
+					origInterval := ClientStreamInterval
+					ClientStreamInterval = 50 * time.Millisecond
+					defer func() {
+						ClientStreamInterval = origInterval
+					}()
+
+					cmd := "echo first && sleep 2 && echo second && echo err >&2"
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "streamstd", StreamStd: true})
+					inserts, _, err := jq.Add(jobs, envVars, true)
 					So(err, ShouldBeNil)
-					So(job.Cmd, ShouldEqual, "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'")
-					So(job.State, ShouldEqual, JobStateReserved)
+					So(inserts, ShouldEqual, 1)
 
-					err = jq.Execute(job, config.RunnerExecShell)
-					So(err, ShouldNotBeNil)
-					So(job.State, ShouldEqual, JobStateBuried)
-					So(job.Exited, ShouldBeTrue)
-					So(job.Exitcode, ShouldEqual, 255)
-					So(job.FailReason, ShouldEqual, FailReasonExit)
-					stdout, err = job.StdOut()
+					je := &JobEssence{Cmd: cmd}
+					std, err := jq2.GetStreamedStd(je, nil)
 					So(err, ShouldBeNil)
-					actualCwd := job.ActualCwd
-					So(actualCwd, ShouldStartWith, filepath.Join(tmpDir, "jobqueue_cwd", "d", "4", "1", "7364d743329da784e74f2d69d438d"))
-					So(actualCwd, ShouldEndWith, "cwd")
-					So(stdout, ShouldEqual, actualCwd+"-"+actualCwd)
-					stderr, err = job.StdErr()
+					So(std.StdOut, ShouldBeEmpty)
+					So(std.StdOutOffset, ShouldEqual, 0)
+
+					job, err := jq.Reserve(50 * time.Millisecond)
 					So(err, ShouldBeNil)
-					tmpDir = actualCwd[:len(actualCwd)-3] + "tmp"
-					So(stderr, ShouldEqual, tmpDir)
+					So(job.StreamStd, ShouldBeTrue)
 
-					job2, err = jq2.GetByEssence(&JobEssence{Cmd: "perl -MCwd -MFile::Spec -e '$cwd = getcwd(); print $cwd, qq[-], $ENV{HOME}, qq[\\n]; die File::Spec->tmpdir, qq[\\n]'"}, true, false)
+					executed := make(chan error, 1)
+					go func() {
+						executed <- jq.Execute(job, config.RunnerExecShell)
+					}()
+
+					limit := time.After(1500 * time.Millisecond)
+					ticker := time.NewTicker(50 * time.Millisecond)
+					defer ticker.Stop()
+				FOLLOW:
+					for {
+						select {
+						case <-ticker.C:
+							std, err = jq2.GetStreamedStd(je, std)
+							So(err, ShouldBeNil)
+							if len(std.StdOut) > 0 {
+								break FOLLOW
+							}
+						case <-limit:
+							break FOLLOW
+						}
+					}
+					So(string(std.StdOut), ShouldEqual, "first\n")
+					So(std.StdOutOffset, ShouldEqual, 6)
+					got, err := jq2.GetByEssence(je, false, false)
 					So(err, ShouldBeNil)
-					So(job2, ShouldNotBeNil)
-					So(job2.State, ShouldEqual, JobStateBuried)
-					So(job2.FailReason, ShouldEqual, FailReasonExit)
-					stdout, err = job2.StdOut()
+					So(got.State, ShouldEqual, JobStateRunning)
+
+					err = <-executed
 					So(err, ShouldBeNil)
-					So(stdout, ShouldEqual, actualCwd+"-"+actualCwd)
-					stderr, err = job2.StdErr()
+
+					std, err = jq2.GetStreamedStd(je, std)
 					So(err, ShouldBeNil)
-					So(stderr, ShouldEqual, tmpDir)
+					So(string(std.StdOut), ShouldEqual, "second\n")
+					So(string(std.StdErr), ShouldEqual, "err\n")
+					So(std.StdOutOffset, ShouldEqual, 13)
+
+					std, err = jq2.GetStreamedStd(je, nil)
+					So(err, ShouldBeNil)
+					So(string(std.StdOut), ShouldEqual, "first\nsecond\n")
+
+					std, err = jq2.GetStreamedStd(je, std)
+					So(err, ShouldBeNil)
+					So(std.StdOut, ShouldBeEmpty)
+					So(std.StdErr, ShouldBeEmpty)
+					So(std.StdOutOffset, ShouldEqual, 13)
 				})
 
 				Convey("The stdout/err of jobs is limited in size", func() {
@@ -2316,6 +5821,53 @@ func TestJobqueue(t *testing.T) {
 				So(job.Exited, ShouldBeTrue)
 				So(job.Exitcode, ShouldEqual, 0)
 			})
+			Convey("If you stop the server while a job is running, its runner can re-attach to it after a restart", func() {
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "echo 1")
+				err = jq.Started(job, os.Getpid())
+				So(err, ShouldBeNil)
+				clientID := jq.clientid
+
+				server.Stop(true)
+				wipeDevDBOnInit = false
+				graceConfig := serverConfig
+				graceConfig.ReattachGrace = 10 * time.Second
+				server, _, token, errs = Serve(graceConfig)
+				wipeDevDBOnInit = true
+				So(errs, ShouldBeNil)
+
+				other, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+				defer other.Disconnect()
+				running, err := other.GetByEssence(&JobEssence{Cmd: "echo 1"}, false, false)
+				So(err, ShouldBeNil)
+				So(running.State, ShouldEqual, JobStateDelayed)
+				reserved, err := other.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(reserved, ShouldNotBeNil)
+				So(reserved.Cmd, ShouldEqual, "echo 2")
+
+				_, err = other.Touch(job)
+				So(err, ShouldNotBeNil)
+
+				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+				jq.clientid = clientID
+				kc, err := jq.Touch(job)
+				So(err, ShouldBeNil)
+				So(kc, ShouldBeFalse)
+				running, err = other.GetByEssence(&JobEssence{Cmd: "echo 1"}, false, false)
+				So(err, ShouldBeNil)
+				So(running.State, ShouldEqual, JobStateRunning)
+				So(running.Pid, ShouldEqual, os.Getpid())
+
+				err = jq.Archive(job, &JobEndState{Exitcode: 0, Exited: true})
+				So(err, ShouldBeNil)
+				running, err = other.GetByEssence(&JobEssence{Cmd: "echo 1"}, false, false)
+				So(err, ShouldBeNil)
+				So(running.State, ShouldEqual, JobStateComplete)
+			})
 		})
 
 		Convey("You can connect, add a job, then immediately shutdown, and the db backup still completes", func() {
@@ -2436,6 +5988,109 @@ func TestJobqueue(t *testing.T) {
 				So(job2.Exitcode, ShouldEqual, 0)
 			})
 
+			Convey("You can drain the server with a deadline, and jobs still running then are killed and run again after a restart", func() {
+				longCmd := "sleep 30 && echo deadline"
+				inserts, _, err = jq.Add([]*Job{{Cmd: longCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "deadline", Priority: 255}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, longCmd)
+				go jq.Execute(job, config.RunnerExecShell)
+
+				stats, err := jq.GetServerStats()
+				So(err, ShouldBeNil)
+				So(stats.Draining, ShouldBeFalse)
+				So(stats.Deadline, ShouldEqual, 0)
+
+				running, _, err := jq.DrainServerBy(2 * time.Second)
+				So(err, ShouldBeNil)
+				So(running, ShouldEqual, 1)
+
+				stats, err = jq.GetServerStats()
+				So(err, ShouldBeNil)
+				So(stats.Draining, ShouldBeTrue)
+				So(stats.Deadline, ShouldBeGreaterThan, 0)
+				So(stats.Deadline, ShouldBeLessThanOrEqualTo, 2*time.Second)
+
+				<-time.After(6 * time.Second)
+
+				_, err = jq.Ping(10 * time.Millisecond)
+				So(err, ShouldNotBeNil)
+
+				wipeDevDBOnInit = false
+				server, _, token, errs = Serve(serverConfig)
+				wipeDevDBOnInit = true
+				So(errs, ShouldBeNil)
+				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+
+				job, err = jq.GetByEssence(&JobEssence{Cmd: longCmd}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.State, ShouldNotEqual, JobStateComplete)
+				So(job.State, ShouldNotEqual, JobStateBuried)
+				So(job.FailReason, ShouldEqual, FailReasonSignal)
+				So(job.UntilBuried, ShouldEqual, 4)
+			})
+
+			Convey("Running jobs are told when the server is shutting down, and the server confirms its shutdown after backing up", func() {
+				longCmd := "sleep 30 && echo shutdown"
+				inserts, _, err = jq.Add([]*Job{{Cmd: longCmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, Retries: uint8(3), RepGroup: "shutdown", Priority: 255}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, longCmd)
+
+				// pretend we're part way through shutting down
+				server.krmutex.Lock()
+				server.killRunners = true
+				server.krmutex.Unlock()
+				err = jq.Execute(job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, FailReasonShutdown)
+				server.krmutex.Lock()
+				server.killRunners = false
+				server.krmutex.Unlock()
+
+				job, err = jq.GetByEssence(&JobEssence{Cmd: longCmd}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.State, ShouldNotEqual, JobStateBuried)
+				So(job.FailReason, ShouldEqual, FailReasonShutdown)
+				So(job.UntilBuried, ShouldEqual, 4)
+
+				errr := os.Remove(managerDBBkFile)
+				So(errr == nil || os.IsNotExist(errr), ShouldBeTrue)
+
+				err = jq.ShutdownServerWithin(10 * time.Second)
+				So(err, ShouldBeNil)
+				_, errr = os.Stat(managerDBBkFile)
+				So(errr, ShouldBeNil)
+
+				<-time.After(2 * time.Second)
+				_, err = jq.Ping(10 * time.Millisecond)
+				So(err, ShouldNotBeNil)
+				jq.Disconnect()
+
+				wipeDevDBOnInit = false
+				server, _, token, errs = Serve(serverConfig)
+				wipeDevDBOnInit = true
+				So(errs, ShouldBeNil)
+				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+
+				job, err = jq.GetByEssence(&JobEssence{Cmd: longCmd}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.FailReason, ShouldEqual, FailReasonShutdown)
+			})
+
 			Convey("You can reserve & execute the job, shut down the server and then can't add new jobs and the started job did not complete", func() {
 				job, err := jq.Reserve(50 * time.Millisecond)
 				So(err, ShouldBeNil)
@@ -3911,6 +7566,44 @@ func TestJobqueueWithMounts(t *testing.T) {
 			So(already, ShouldEqual, 1)
 		})
 
+		Convey("Targets can have their own endpoints and be anonymous", func() {
+			t3 := MountTarget{Path: s3Path, Endpoint: "s3.eu-west-2.amazonaws.com", Region: "eu-west-2", Anonymous: true}
+			s3c, err := t3.S3Config()
+			So(err, ShouldBeNil)
+			So(s3c.Target, ShouldEqual, "https://s3.eu-west-2.amazonaws.com/"+s3Path)
+			So(s3c.Region, ShouldEqual, "eu-west-2")
+			So(s3c.AccessKey, ShouldBeBlank)
+			So(s3c.SecretKey, ShouldBeBlank)
+
+			t4 := MountTarget{Path: "1000genomes", Anonymous: true}
+			s3c, err = t4.S3Config()
+			So(err, ShouldBeNil)
+			So(s3c.Target, ShouldEqual, "https://s3.amazonaws.com/1000genomes")
+
+			Convey("Targets with Failover endpoints use the first that can be connected to", func() {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer ln.Close()
+				up := "http://" + ln.Addr().String()
+
+				t5 := MountTarget{Path: "bucket", Endpoint: "http://127.0.0.1:1", Failover: []string{up}, Anonymous: true}
+				s3c, err = t5.S3Config()
+				So(err, ShouldBeNil)
+				So(s3c.Target, ShouldEqual, up+"/bucket")
+
+				t5.Failover = []string{"http://127.0.0.1:1"}
+				_, err = t5.S3Config()
+				So(err, ShouldNotBeNil)
+			})
+
+			jobs = append(jobs, &Job{Cmd: "cat numalphanum.txt", Cwd: cwd, ReqGroup: "cat", Requirements: standardReqs, RepGroup: "a", MountConfigs: MountConfigs{{Targets: []MountTarget{t2}}}})
+			jobs = append(jobs, &Job{Cmd: "cat numalphanum.txt", Cwd: cwd, ReqGroup: "cat", Requirements: standardReqs, RepGroup: "b", MountConfigs: MountConfigs{{Targets: []MountTarget{t3}}}})
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 2)
+			So(already, ShouldEqual, 0)
+		})
+
 		Reset(func() {
 			if server != nil {
 				server.Stop(true)
@@ -4133,6 +7826,102 @@ func TestJobqueueSpeed(t *testing.T) {
 	*/
 }
 
+// BenchmarkAdd times adding b.N jobs in a single Add() request.
+func BenchmarkAdd(b *testing.B) {
+	benchmarkAdd(b, func(jq *Client, jobs []*Job) (int, error) {
+		added, _, err := jq.Add(jobs, envVars, true)
+		return added, err
+	})
+}
+
+// BenchmarkAddBulk times adding b.N jobs with AddBulk(). Run with eg.
+// -benchtime=1000000x to see how long it takes to add a million jobs.
+func BenchmarkAddBulk(b *testing.B) {
+	benchmarkAdd(b, func(jq *Client, jobs []*Job) (int, error) {
+		added, _, err := jq.AddBulk(jobs, envVars, true, 0, nil)
+		return added, err
+	})
+}
+
+// benchmarkAdd starts a fresh server and times the given adder adding b.N
+// jobs to it.
+func benchmarkAdd(b *testing.B, adder func(jq *Client, jobs []*Job) (int, error)) {
+	config := internal.ConfigLoad("development", true, testLogger)
+	serverConfig := ServerConfig{
+		Port:            config.ManagerPort,
+		WebPort:         config.ManagerWeb,
+		SchedulerName:   "local",
+		SchedulerConfig: &jqs.ConfigLocal{Shell: config.RunnerExecShell},
+		DBFile:          config.ManagerDbFile,
+		DBFileBackup:    config.ManagerDbBkFile,
+		TokenFile:       config.ManagerTokenFile,
+		CAFile:          config.ManagerCAFile,
+		CertFile:        config.ManagerCertFile,
+		CertDomain:      config.ManagerCertDomain,
+		KeyFile:         config.ManagerKeyFile,
+		Deployment:      config.Deployment,
+		Logger:          testLogger,
+	}
+	os.Remove(config.ManagerDbFile)
+	os.Remove(config.ManagerDbBkFile)
+	server, _, token, err := Serve(serverConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		server.Stop(true)
+		os.Remove(config.ManagerDbFile)
+		os.Remove(config.ManagerDbBkFile)
+	}()
+
+	jq, err := Connect("localhost:"+config.ManagerPort, config.ManagerCAFile, config.ManagerCertDomain, token, 5*time.Minute)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer jq.Disconnect()
+
+	reqs := &jqs.Requirements{RAM: 1024, Time: 4 * time.Hour, Cores: 1}
+	jobs := make([]*Job, b.N)
+	for i := range jobs {
+		jobs[i] = &Job{Cmd: fmt.Sprintf("test cmd %d", i), Cwd: "/fake/cwd", ReqGroup: "fake_group", Requirements: reqs, Retries: uint8(3), RepGroup: "benchmark"}
+	}
+
+	b.ResetTimer()
+	added, err := adder(jq, jobs)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if added != b.N {
+		b.Fatalf("only %d of %d jobs were added", added, b.N)
+	}
+}
+
+// BenchmarkReadyGrouper times working out the scheduler groups of b.N ready
+// jobs spread over 10 different requirements, as happens each time new jobs
+// become ready. Run with eg. -benchtime=500000x to see how long a scheduling
+// cycle takes with half a million ready jobs.
+func BenchmarkReadyGrouper(b *testing.B) {
+	jobs := make([]*Job, b.N)
+	for i := range jobs {
+		jobs[i] = &Job{ReqGroup: fmt.Sprintf("group%d", i%10), Requirements: &jqs.Requirements{RAM: 100 * (i % 10), Time: time.Duration(i%10) * time.Hour, Cores: 1}}
+	}
+	rec := &jqs.Requirements{RAM: 500, Time: 1 * time.Hour}
+
+	b.ResetTimer()
+	rg := newReadyGrouper(func(reqGroup string) *jqs.Requirements {
+		if reqGroup == "group0" {
+			return rec
+		}
+		return nil
+	})
+	groups := make(map[string]int)
+	for _, job := range jobs {
+		req, _ := rg.group(job)
+		groups[rg.stringify(req)]++
+	}
+}
+
 /* this func is used by the commented out test above
 func timeDealingWithBatch(addr string, jq *Client, batchNum int, b int) {
 	before := time.Now()
@@ -4272,3 +8061,55 @@ func setDomainIP(domain string) {
 		internal.InfobloxSetDomainIP(domain, ip)
 	}
 }
+
+// testBroker is an in-memory Broker for testing Bridge()
+type testBroker struct {
+	msgs      chan BrokerMessage
+	mu        sync.Mutex
+	published map[string][][]byte
+}
+
+func newTestBroker() *testBroker {
+	return &testBroker{msgs: make(chan BrokerMessage, 10), published: make(map[string][][]byte)}
+}
+
+func (b *testBroker) Consume(topic string) (<-chan BrokerMessage, error) {
+	return b.msgs, nil
+}
+
+func (b *testBroker) Publish(topic string, body []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published[topic] = append(b.published[topic], body)
+	return nil
+}
+
+func (b *testBroker) getPublished(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published[topic]
+}
+
+// testBrokerMessage is a BrokerMessage that records how it was handled
+type testBrokerMessage struct {
+	body    []byte
+	handled chan string
+}
+
+func (m *testBrokerMessage) Body() []byte {
+	return m.body
+}
+
+func (m *testBrokerMessage) Ack() error {
+	m.handled <- "ack"
+	return nil
+}
+
+func (m *testBrokerMessage) Nack(requeue bool) error {
+	if requeue {
+		m.handled <- "requeue"
+	} else {
+		m.handled <- "reject"
+	}
+	return nil
+}
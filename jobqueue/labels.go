@@ -0,0 +1,205 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for labelling jobs with arbitrary key=value
+// pairs, and for finding jobs by their labels.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// labelKeyRegex is what the keys of Job.Labels must match.
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-/]+$`)
+
+// ParseLabels parses a string of the form "key1=value1,key2=value2" in to a
+// map suitable for Job.Labels. Returns an error if the string is badly
+// formatted or a key is invalid.
+func ParseLabels(str string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if str == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(str, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("label [%s] is not in key=value format", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, validateLabels(labels)
+}
+
+// validateLabels checks that all the keys of the given labels are valid.
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return fmt.Errorf("label key [%s] is invalid; %s", key, ErrBadLabel)
+		}
+	}
+	return nil
+}
+
+// labelLookupKey is the key we use in Server.lbl for the given label.
+func labelLookupKey(key, value string) string {
+	return key + "=" + value
+}
+
+// indexLabels adds the job with the given key to our lookup of label to job
+// keys, under each of the given labels.
+func (s *Server) indexLabels(jobKey string, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	s.lbl.Lock()
+	defer s.lbl.Unlock()
+	for key, value := range labels {
+		lk := labelLookupKey(key, value)
+		if _, exists := s.lbl.lookup[lk]; !exists {
+			s.lbl.lookup[lk] = make(map[string]bool)
+		}
+		s.lbl.lookup[lk][jobKey] = true
+	}
+}
+
+// unindexLabels reverses indexLabels().
+func (s *Server) unindexLabels(jobKey string, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	s.lbl.Lock()
+	defer s.lbl.Unlock()
+	for key, value := range labels {
+		lk := labelLookupKey(key, value)
+		if m, exists := s.lbl.lookup[lk]; exists {
+			delete(m, jobKey)
+			if len(m) == 0 {
+				delete(s.lbl.lookup, lk)
+			}
+		}
+	}
+}
+
+// setJobLabels adds the given labels to the incomplete jobs with the given
+// keys, replacing the value of any existing label with the same key. Labels
+// with empty values are removed from the jobs instead. Returns the number of
+// jobs that were found and updated.
+func (s *Server) setJobLabels(jobKeys []string, labels map[string]string) (int, error) {
+	var updated []*Job
+	for _, jobKey := range jobKeys {
+		item, err := s.q.Get(jobKey)
+		if err != nil || item == nil {
+			continue
+		}
+		job := item.Data.(*Job)
+
+		job.Lock()
+		s.unindexLabels(jobKey, job.Labels)
+		if job.Labels == nil {
+			job.Labels = make(map[string]string)
+		}
+		for key, value := range labels {
+			if value == "" {
+				delete(job.Labels, key)
+			} else {
+				job.Labels[key] = value
+			}
+		}
+		s.indexLabels(jobKey, job.Labels)
+		job.Unlock()
+
+		updated = append(updated, job)
+	}
+
+	if len(updated) == 0 {
+		return 0, nil
+	}
+	return len(updated), s.db.updateLiveJobs(updated)
+}
+
+// getJobsByLabel gets the incomplete jobs that have the given label. If value
+// is blank, gets the jobs that have any value for the label key. Other args
+// are as for getJobsCurrent().
+func (s *Server) getJobsByLabel(key, value string, limit int, state JobState, getStd bool, getEnv bool) []*Job {
+	jobKeys := make(map[string]bool)
+	s.lbl.RLock()
+	if value == "" {
+		prefix := labelLookupKey(key, "")
+		for lk, m := range s.lbl.lookup {
+			if strings.HasPrefix(lk, prefix) {
+				for jobKey := range m {
+					jobKeys[jobKey] = true
+				}
+			}
+		}
+	} else {
+		for jobKey := range s.lbl.lookup[labelLookupKey(key, value)] {
+			jobKeys[jobKey] = true
+		}
+	}
+	s.lbl.RUnlock()
+
+	var jobs []*Job
+	for jobKey := range jobKeys {
+		item, err := s.q.Get(jobKey)
+		if err != nil || item == nil {
+			continue
+		}
+		job := s.itemToJob(item, false, false)
+		if v, has := job.Labels[key]; !has || (value != "" && v != value) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	if limit > 0 || state != "" || getStd || getEnv {
+		jobs = s.limitJobs(jobs, limit, state, getStd, getEnv)
+	}
+	return jobs
+}
+
+// SetLabels adds the given labels to the given incomplete Jobs, replacing the
+// values of any existing labels with the same keys. Supply a label with an
+// empty value to remove that label. Returns the number of Jobs that were
+// updated.
+func (c *Client) SetLabels(jes []*JobEssence, labels map[string]string) (int, error) {
+	err := validateLabels(labels)
+	if err != nil {
+		return 0, err
+	}
+	keys := c.jesToKeys(jes)
+	resp, err := c.request(&clientRequest{Method: "jlabel", Keys: keys, Labels: labels})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
+
+// GetByLabel gets all incomplete Jobs that have the given label. If value is
+// blank, gets those that have the label key with any value. The other args
+// are as in GetByRepGroup().
+func (c *Client) GetByLabel(key, value string, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.request(&clientRequest{Method: "getbl", Labels: map[string]string{key: value}, Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
@@ -0,0 +1,304 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for limit groups, which cap how many Jobs that
+// are members of a named group can run at once, across the whole queue.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// LimitGroup describes the most Jobs with Name in their LimitGroups that may
+// be running at once, and how many currently are. A Limit of 0 stops any more
+// of them from starting.
+type LimitGroup struct {
+	Name    string
+	Limit   int
+	Running int
+}
+
+// validateLimitGroupName returns an error if the given name can't be used for
+// a limit group: names must not be blank or contain commas or white space.
+func validateLimitGroupName(name string) error {
+	if name == "" || strings.ContainsAny(name, ", \t\n") {
+		return fmt.Errorf("limit group name [%s] must not be blank or contain commas or white space", name)
+	}
+	return nil
+}
+
+// limitGroups tracks the limit of each limit group, the keys of the Jobs in
+// each that are running (reserved or started), and the keys of the Jobs waiting
+// for a group to have room. Groups without a limit are unlimited.
+type limitGroups struct {
+	sync.Mutex
+	limits  map[string]int
+	running map[string]map[string]bool
+	waiting map[string]map[string]bool
+}
+
+// newLimitGroups returns a limitGroups with the given limits.
+func newLimitGroups(limits map[string]int) *limitGroups {
+	if limits == nil {
+		limits = make(map[string]int)
+	}
+	return &limitGroups{
+		limits:  limits,
+		running: make(map[string]map[string]bool),
+		waiting: make(map[string]map[string]bool),
+	}
+}
+
+// available tells you if the Job with the given key, in all the given groups,
+// could run without exceeding any of their limits. If not, the Job is noted as
+// waiting on the groups that are full, to be returned by finish(), set() or
+// remove() once one of them has room.
+func (lg *limitGroups) available(key string, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	lg.Lock()
+	defer lg.Unlock()
+	ok := true
+	for _, group := range groups {
+		if limit, limited := lg.limits[group]; limited && len(lg.running[group]) >= limit {
+			if lg.waiting[group] == nil {
+				lg.waiting[group] = make(map[string]bool)
+			}
+			lg.waiting[group][key] = true
+			ok = false
+		}
+	}
+	return ok
+}
+
+// start records that the Job with the given key and groups is running. It is
+// fine to call this more than once for the same Job.
+func (lg *limitGroups) start(key string, groups []string) {
+	if len(groups) == 0 {
+		return
+	}
+	lg.Lock()
+	defer lg.Unlock()
+	for _, group := range groups {
+		if lg.running[group] == nil {
+			lg.running[group] = make(map[string]bool)
+		}
+		lg.running[group][key] = true
+	}
+}
+
+// finish records that the Job with the given key and groups is no longer
+// running, returning the keys of the Jobs that were waiting on the groups that
+// now have room. It is fine to call this more than once for the same Job.
+func (lg *limitGroups) finish(key string, groups []string) []string {
+	if len(groups) == 0 {
+		return nil
+	}
+	lg.Lock()
+	defer lg.Unlock()
+	var freed []string
+	for _, group := range groups {
+		if !lg.running[group][key] {
+			continue
+		}
+		delete(lg.running[group], key)
+		if len(lg.running[group]) == 0 {
+			delete(lg.running, group)
+		}
+		freed = append(freed, group)
+	}
+	return lg.unwait(freed)
+}
+
+// set changes the limits of the given groups, returning the keys of the Jobs
+// that were waiting on them.
+func (lg *limitGroups) set(groups []*LimitGroup) []string {
+	lg.Lock()
+	defer lg.Unlock()
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		lg.limits[group.Name] = group.Limit
+		names[i] = group.Name
+	}
+	return lg.unwait(names)
+}
+
+// remove makes the given groups unlimited, returning the keys of the Jobs that
+// were waiting on them.
+func (lg *limitGroups) remove(names []string) []string {
+	lg.Lock()
+	defer lg.Unlock()
+	for _, name := range names {
+		delete(lg.limits, name)
+	}
+	return lg.unwait(names)
+}
+
+// unwait stops noting the Jobs waiting on the given groups, returning their
+// keys. You must hold the lock when calling this.
+func (lg *limitGroups) unwait(groups []string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for key := range lg.waiting[group] {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		delete(lg.waiting, group)
+	}
+	return keys
+}
+
+// finishLimitGroups gives up the limit group slots of the Job with the given
+// key and groups, which has left the run sub-queue, so that Jobs our reserve
+// filter held while waiting for them can be reserved. Unlike using our changed
+// callback, this happens before the Job can be reserved again, so the slots
+// can't be given up out of order. This is safe to call while the queue is
+// locked.
+func (s *Server) finishLimitGroups(key string, groups []string) {
+	waiting := s.limitGroups.finish(key, groups)
+	if len(waiting) == 0 {
+		return
+	}
+	q := s.q
+	go q.Unhold(waiting...)
+}
+
+// list returns every group that has a limit or running Jobs, sorted by Name.
+// Groups without a limit have a Limit of -1.
+func (lg *limitGroups) list() []*LimitGroup {
+	lg.Lock()
+	defer lg.Unlock()
+	groups := make(map[string]*LimitGroup)
+	for name, limit := range lg.limits {
+		groups[name] = &LimitGroup{Name: name, Limit: limit}
+	}
+	for name, keys := range lg.running {
+		if _, exists := groups[name]; !exists {
+			groups[name] = &LimitGroup{Name: name, Limit: -1}
+		}
+		groups[name].Running = len(keys)
+	}
+	list := make([]*LimitGroup, 0, len(groups))
+	for _, group := range groups {
+		list = append(list, group)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// storeLimitGroups stores the limits of the given groups, replacing any
+// existing limits for them.
+func (db *db) storeLimitGroups(groups []*LimitGroup) error {
+	return db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLimitGroups)
+		for _, group := range groups {
+			err := b.Put([]byte(group.Name), []byte(strconv.Itoa(group.Limit)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteLimitGroups removes the limits of the given groups, returning how many
+// had a limit.
+func (db *db) deleteLimitGroups(names []string) (int, error) {
+	var deleted int
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketLimitGroups)
+		for _, name := range names {
+			if b.Get([]byte(name)) == nil {
+				continue
+			}
+			err := b.Delete([]byte(name))
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// retrieveLimitGroups returns the stored limits, keyed by group name.
+func (db *db) retrieveLimitGroups() (map[string]int, error) {
+	limits := make(map[string]int)
+	err := db.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLimitGroups).ForEach(func(k, v []byte) error {
+			limit, err := strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+			limits[string(k)] = limit
+			return nil
+		})
+	})
+	return limits, err
+}
+
+// GetLimitGroups returns every limit group that has a limit or running Jobs,
+// sorted by Name. Groups that have running Jobs but no limit have a Limit of
+// -1.
+func (c *Client) GetLimitGroups() ([]*LimitGroup, error) {
+	resp, err := c.request(&clientRequest{Method: "getlimitgroups"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.LimitGroups, err
+}
+
+// SetLimitGroups sets the limits of the given groups (their Running values are
+// ignored), replacing any existing limits. The new limits apply immediately:
+// raising a limit lets waiting Jobs start, while lowering one below the number
+// of running Jobs stops more from starting until enough have finished. Limits
+// are remembered when the server is restarted.
+func (c *Client) SetLimitGroups(groups []*LimitGroup) error {
+	for _, group := range groups {
+		if validateLimitGroupName(group.Name) != nil || group.Limit < 0 {
+			return Error{"SetLimitGroups", group.Name, ErrBadRequest}
+		}
+	}
+	_, err := c.request(&clientRequest{Method: "setlimitgroups", LimitGroups: groups})
+	return err
+}
+
+// DeleteLimitGroups removes the limits of the given groups, so that any number
+// of their Jobs may run at once. It returns the number of groups that had a
+// limit.
+func (c *Client) DeleteLimitGroups(names []string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "dellimitgroups", Keys: names})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
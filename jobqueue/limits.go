@@ -0,0 +1,176 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for controlling the umask and resource limits
+// (ulimits) that a Job's Cmd is run with.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// limitUnlimited is the value users supply for a resource limit to have it
+// raised as high as it can go.
+const limitUnlimited = "unlimited"
+
+// procLimitsMutex is held while we have altered our own umask and resource
+// limits so that a Cmd we start can inherit them, so that concurrent
+// Execute()s can't start their Cmds with the wrong settings.
+var procLimitsMutex sync.Mutex
+
+// ProcessLimits struct is used for setting in a Job to control the umask and
+// resource limits (as per the shell's ulimit builtin) that its Cmd will be run
+// with. Unset values mean that the Cmd will inherit the settings of the runner
+// that executes it.
+//
+// Only soft resource limits are altered, and these can't be made higher than
+// the hard limits of the runner's process; "unlimited" will raise a soft limit
+// to the hard limit.
+type ProcessLimits struct {
+	// Umask is the file mode creation mask in octal, eg. "0002" so that the
+	// files your Cmd creates are group writable.
+	Umask string `json:"umask,omitempty"`
+
+	// NoFile is the maximum number of open file descriptors (ulimit -n).
+	NoFile string `json:"nofile,omitempty"`
+
+	// Core is the maximum size of core dump files (ulimit -c). Sizes can be
+	// given in bytes, or with a unit suffix, eg. "1G" for 1 Gigabyte. "0"
+	// disables core dumps.
+	Core string `json:"core,omitempty"`
+
+	// Stack is the maximum stack size (ulimit -s), specified like Core.
+	Stack string `json:"stack,omitempty"`
+
+	// FileSize is the maximum size of files your Cmd can write (ulimit -f),
+	// specified like Core.
+	FileSize string `json:"fsize,omitempty"`
+}
+
+// ParseProcessLimits takes a comma separated list of key=value pairs, where
+// keys correspond to the json properties of a ProcessLimits, eg.
+// "umask=0002,nofile=4096", and returns a validated ProcessLimits.
+func ParseProcessLimits(limits string) (ProcessLimits, error) {
+	var pl ProcessLimits
+	if limits == "" {
+		return pl, nil
+	}
+	for _, pair := range strings.Split(limits, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return pl, fmt.Errorf("limit [%s] is not in key=value format", pair)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "umask":
+			pl.Umask = kv[1]
+		case "nofile":
+			pl.NoFile = kv[1]
+		case "core":
+			pl.Core = kv[1]
+		case "stack":
+			pl.Stack = kv[1]
+		case "fsize":
+			pl.FileSize = kv[1]
+		default:
+			return pl, fmt.Errorf("limit [%s] is not a known limit", kv[0])
+		}
+	}
+	return pl, pl.Validate()
+}
+
+// IsSet tells you if any of the limits have been specified.
+func (pl ProcessLimits) IsSet() bool {
+	return pl.Umask != "" || pl.NoFile != "" || pl.Core != "" || pl.Stack != "" || pl.FileSize != ""
+}
+
+// Validate checks that all the specified limits are parsable, returning an
+// error describing the first one that isn't.
+func (pl ProcessLimits) Validate() error {
+	if pl.Umask != "" {
+		if _, err := pl.umask(); err != nil {
+			return err
+		}
+	}
+	for _, rl := range pl.rlimits() {
+		if rl.value == "" || rl.value == limitUnlimited {
+			continue
+		}
+		if _, err := parseLimitValue(rl.value, rl.isSize); err != nil {
+			return fmt.Errorf("%s limit [%s] is invalid: %s", rl.name, rl.value, err)
+		}
+	}
+	return nil
+}
+
+// String returns a comma separated list of the key=value limits that have been
+// set, in the same format accepted by ParseProcessLimits().
+func (pl ProcessLimits) String() string {
+	var set []string
+	if pl.Umask != "" {
+		set = append(set, "umask="+pl.Umask)
+	}
+	for _, rl := range pl.rlimits() {
+		if rl.value != "" {
+			set = append(set, rl.name+"="+rl.value)
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+// umask parses our Umask as an octal number.
+func (pl ProcessLimits) umask() (int, error) {
+	mask, err := strconv.ParseUint(pl.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("umask [%s] is not a valid octal mode", pl.Umask)
+	}
+	return int(mask), nil
+}
+
+// processLimit describes one of our resource limits.
+type processLimit struct {
+	name     string
+	resource int
+	value    string
+	isSize   bool
+}
+
+// rlimits returns details of all our resource limits.
+func (pl ProcessLimits) rlimits() []processLimit {
+	return []processLimit{
+		{"nofile", rlimitNoFile, pl.NoFile, false},
+		{"core", rlimitCore, pl.Core, true},
+		{"stack", rlimitStack, pl.Stack, true},
+		{"fsize", rlimitFSize, pl.FileSize, true},
+	}
+}
+
+// parseLimitValue converts a resource limit value to a number. Sizes can be
+// supplied as plain numbers of bytes, or with a unit suffix.
+func parseLimitValue(value string, isSize bool) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err == nil || !isSize {
+		return n, err
+	}
+	return bytefmt.ToBytes(value)
+}
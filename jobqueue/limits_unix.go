@@ -0,0 +1,117 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package jobqueue
+
+// This file contains the unix-specific code for applying ProcessLimits.
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// the resources that our ProcessLimits correspond to
+const (
+	rlimitNoFile = syscall.RLIMIT_NOFILE
+	rlimitCore   = syscall.RLIMIT_CORE
+	rlimitStack  = syscall.RLIMIT_STACK
+	rlimitFSize  = syscall.RLIMIT_FSIZE
+)
+
+// apply alters the umask and soft resource limits of the current process, so
+// that a command started immediately afterwards will inherit them. The
+// returned function reverts our own settings back to how they were, and must
+// be called as soon as the command has started. On error, nothing will have
+// been changed. You must hold procLimitsMutex while calling this and the
+// returned function.
+func (pl ProcessLimits) apply() (func() error, error) {
+	var restorers []func() error
+	restore := func() error {
+		var merr *multierror.Error
+		for i := len(restorers) - 1; i >= 0; i-- {
+			if err := restorers[i](); err != nil {
+				merr = multierror.Append(merr, err)
+			}
+		}
+		return merr.ErrorOrNil()
+	}
+
+	for _, rl := range pl.rlimits() {
+		if rl.value == "" {
+			continue
+		}
+
+		var orig syscall.Rlimit
+		err := syscall.Getrlimit(rl.resource, &orig)
+		if err != nil {
+			errr := restore()
+			if errr != nil {
+				err = fmt.Errorf("%s (and restoring limits failed: %s)", err.Error(), errr)
+			}
+			return nil, fmt.Errorf("could not get the current %s limit: %s", rl.name, err)
+		}
+
+		desired := orig
+		if rl.value == limitUnlimited {
+			desired.Cur = orig.Max
+		} else {
+			desired.Cur, err = parseLimitValue(rl.value, rl.isSize)
+			if err == nil && desired.Cur > orig.Max {
+				err = fmt.Errorf("it exceeds the hard limit of %d", orig.Max)
+			}
+		}
+		if err == nil {
+			err = syscall.Setrlimit(rl.resource, &desired)
+		}
+		if err != nil {
+			errr := restore()
+			if errr != nil {
+				err = fmt.Errorf("%s (and restoring limits failed: %s)", err.Error(), errr)
+			}
+			return nil, fmt.Errorf("could not set the %s limit to %s: %s", rl.name, rl.value, err)
+		}
+
+		resource := rl.resource
+		restorers = append(restorers, func() error {
+			return syscall.Setrlimit(resource, &orig)
+		})
+	}
+
+	if pl.Umask != "" {
+		mask, err := pl.umask()
+		if err != nil {
+			errr := restore()
+			if errr != nil {
+				err = fmt.Errorf("%s (and restoring limits failed: %s)", err.Error(), errr)
+			}
+			return nil, err
+		}
+		origMask := syscall.Umask(mask)
+		restorers = append(restorers, func() error {
+			syscall.Umask(origMask)
+			return nil
+		})
+	}
+
+	return restore, nil
+}
@@ -0,0 +1,38 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the Windows-specific code for applying ProcessLimits,
+// which are not supported there.
+
+import "fmt"
+
+// Windows has no equivalent of these resources, but we need values for them
+const (
+	rlimitNoFile = iota
+	rlimitCore
+	rlimitStack
+	rlimitFSize
+)
+
+// apply always returns an error on Windows, since it has no umask or resource
+// limits that a command could inherit.
+func (pl ProcessLimits) apply() (func() error, error) {
+	return nil, fmt.Errorf("umask and resource limits are not supported on Windows")
+}
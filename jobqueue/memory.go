@@ -0,0 +1,222 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for keeping down the memory used by the
+// server's in-memory copies of Jobs: commonly repeated strings are interned,
+// and once a memory budget is exceeded, rarely needed fields are dropped from
+// memory and read back from the database when they are needed.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// behaviourOverhead is our estimate of the bytes used by a Behaviour, not
+// counting its Arg.
+const behaviourOverhead = 48
+
+// internPool holds a single copy of each distinct string (and Requirements.Other
+// map) that it has been given, so that Jobs with the same values can share
+// them instead of each holding their own copy. Entries are never removed,
+// since the values interned (Cwds, RepGroups and the like) are typically shared
+// by huge numbers of Jobs.
+type internPool struct {
+	strs   map[string]string
+	others map[string]map[string]string
+	sync.Mutex
+}
+
+// newInternPool creates a new, empty internPool.
+func newInternPool() *internPool {
+	return &internPool{
+		strs:   make(map[string]string),
+		others: make(map[string]map[string]string),
+	}
+}
+
+// str returns the pool's copy of the given string. You must hold the lock.
+func (p *internPool) str(s string) string {
+	if s == "" {
+		return s
+	}
+	if interned, exists := p.strs[s]; exists {
+		return interned
+	}
+	p.strs[s] = s
+	return s
+}
+
+// other returns the pool's copy of the given map. You must hold the lock.
+// The returned map must not be altered.
+func (p *internPool) other(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return m
+	}
+	pairs := make([]string, 0, len(m))
+	for key, val := range m {
+		pairs = append(pairs, key+"="+val)
+	}
+	sort.Strings(pairs)
+	key := strings.Join(pairs, "\x00")
+	if interned, exists := p.others[key]; exists {
+		return interned
+	}
+	p.others[key] = m
+	return m
+}
+
+// intern replaces the commonly repeated strings of the given job with the
+// pool's copies.
+func (p *internPool) intern(job *Job) {
+	p.Lock()
+	defer p.Unlock()
+	job.Lock()
+	defer job.Unlock()
+	job.RepGroup = p.str(job.RepGroup)
+	job.ReqGroup = p.str(job.ReqGroup)
+	job.Cwd = p.str(job.Cwd)
+	job.EnvKey = p.str(job.EnvKey)
+	job.OutputDest = p.str(job.OutputDest)
+	job.Shell = p.str(job.Shell)
+	job.Datacentre = p.str(job.Datacentre)
+	for i, dg := range job.DepGroups {
+		job.DepGroups[i] = p.str(dg)
+	}
+	if job.Requirements != nil {
+		job.Requirements.Arch = p.str(job.Requirements.Arch)
+		job.Requirements.Other = p.other(job.Requirements.Other)
+	}
+}
+
+// jobMemory interns the strings of Jobs in the server's queue, and keeps
+// track of how much memory is used by their rarely needed ("cold") fields:
+// EnvOverride and Behaviours. Once the budget for those is used up, the cold
+// fields of further Jobs are dropped from memory; they remain in the live
+// bucket of the database that all queued Jobs are stored in.
+type jobMemory struct {
+	pool   *internPool
+	budget int
+	held   int
+	sync.Mutex
+}
+
+// newJobMemory creates a jobMemory that will hold up to budgetMB MB of cold
+// Job fields in memory. A budget of 0 means there is no limit.
+func newJobMemory(budgetMB int) *jobMemory {
+	return &jobMemory{pool: newInternPool(), budget: budgetMB * 1024 * 1024}
+}
+
+// coldSize estimates the memory used by the cold fields of the given job. You
+// must hold the job's lock.
+func coldSize(job *Job) int {
+	size := len(job.EnvOverride)
+	for _, b := range job.Behaviours {
+		size += behaviourOverhead
+		if b.Arg != nil {
+			size += len(fmt.Sprint(b.Arg))
+		}
+	}
+	return size
+}
+
+// slim interns the given job's strings and, if we are over budget, drops its
+// cold fields from memory. Only call this for jobs that have been stored in
+// the live bucket of the database.
+func (m *jobMemory) slim(job *Job) {
+	m.pool.intern(job)
+
+	job.Lock()
+	defer job.Unlock()
+	if job.coldSpilled || job.coldSize > 0 {
+		return
+	}
+	size := coldSize(job)
+	if size == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.budget > 0 && m.held+size > m.budget {
+		job.EnvOverride = nil
+		job.Behaviours = nil
+		job.coldSpilled = true
+		return
+	}
+	job.coldSize = size
+	m.held += size
+}
+
+// forget stops accounting for the cold fields of the given job, for when it
+// leaves the queue.
+func (m *jobMemory) forget(job *Job) {
+	job.Lock()
+	size := job.coldSize
+	job.coldSize = 0
+	job.Unlock()
+	if size == 0 {
+		return
+	}
+	m.Lock()
+	m.held -= size
+	m.Unlock()
+}
+
+// retrieveColdFields gets the EnvOverride and Behaviours of the job with the
+// given key from the live bucket, for jobs that had them dropped from memory.
+func (db *db) retrieveColdFields(key string) ([]byte, Behaviours, error) {
+	encoded := db.retrieve(bucketJobsLive, key)
+	if encoded == nil {
+		return nil, nil, fmt.Errorf("job %s not found in the live bucket", key)
+	}
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	job := &Job{}
+	err := dec.Decode(job)
+	if err != nil {
+		return nil, nil, err
+	}
+	return job.EnvOverride, job.Behaviours, nil
+}
+
+// encodeJob encodes the given job for storage in the database, temporarily
+// restoring its cold fields first if they had been dropped from memory.
+func (db *db) encodeJob(job *Job) ([]byte, error) {
+	job.Lock()
+	defer job.Unlock()
+	if job.coldSpilled {
+		envOverride, behaviours, err := db.retrieveColdFields(job.key())
+		if err != nil {
+			return nil, err
+		}
+		job.EnvOverride, job.Behaviours = envOverride, behaviours
+		defer func() {
+			job.EnvOverride, job.Behaviours = nil, nil
+		}()
+	}
+
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(job)
+	return encoded, err
+}
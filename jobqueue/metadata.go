@@ -0,0 +1,218 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the local http endpoint that lets a running
+// Cmd find out about its own Job, similar to cloud instance metadata services.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JobMetadataSocketEnvVar is the environment variable that Cmds get the path
+// of the unix socket of the runner's local metadata endpoint in.
+// GetJobMetadata() uses it.
+const JobMetadataSocketEnvVar = "WR_METADATA_SOCKET"
+
+// metadataTimeout is how long GetJobMetadata() waits for the runner to
+// respond.
+const metadataTimeout = 10 * time.Second
+
+// JobMetadata is what the runner's local metadata endpoint returns to a running
+// Cmd, describing its own Job.
+type JobMetadata struct {
+	Key       string `json:"key"`
+	RepGroup  string `json:"rep_group"`
+	ReqGroup  string `json:"req_group"`
+	Cmd       string `json:"cmd"`
+	Cwd       string `json:"cwd"`
+	ActualCwd string `json:"actual_cwd,omitempty"`
+	Attempt   uint32 `json:"attempt"`
+
+	// Requirements
+	MemoryMB int `json:"memory_mb"`
+	Cores    int `json:"cores"`
+	DiskGB   int `json:"disk_gb"`
+
+	// Deadline is when the Cmd will have used its expected time; after this,
+	// the job scheduler may kill it at any moment. RemainingSeconds is the
+	// number of seconds until then (negative if past it), at the time of the
+	// request.
+	Deadline         time.Time `json:"deadline"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+
+	Mounts []MountMetadata `json:"mounts,omitempty"`
+}
+
+// MountMetadata describes one of a Job's mounts in its JobMetadata.
+type MountMetadata struct {
+	Mount   string   `json:"mount"`
+	Targets []string `json:"targets"`
+
+	// the free and total space (in bytes) reported by the mounted file
+	// system, at the time of the request
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// jobMetadata creates the JobMetadata for a Job that is about to be executed,
+// with the given deadline.
+func (j *Job) jobMetadata(deadline time.Time) *JobMetadata {
+	md := &JobMetadata{
+		Key:       j.key(),
+		RepGroup:  j.RepGroup,
+		ReqGroup:  j.ReqGroup,
+		Cmd:       j.Cmd,
+		Cwd:       j.Cwd,
+		ActualCwd: j.ActualCwd,
+		Attempt:   j.Attempts + 1,
+		MemoryMB:  j.Requirements.RAM,
+		Cores:     j.Requirements.Cores,
+		DiskGB:    j.Requirements.Disk,
+		Deadline:  deadline,
+	}
+	for i, mount := range j.mountPoints {
+		mm := MountMetadata{Mount: mount}
+		if i < len(j.MountConfigs) {
+			for _, mt := range j.MountConfigs[i].Targets {
+				mm.Targets = append(mm.Targets, mt.Path)
+			}
+		}
+		md.Mounts = append(md.Mounts, mm)
+	}
+	return md
+}
+
+// serveJobMetadata starts an http server on a unix socket in a new temporary
+// directory (that only we, and so the Cmd, can access) that responds to GETs
+// with the JobMetadata for the given job, as JSON. Returns the path to the
+// socket and a function you must call to stop the server (and clean up) once
+// the Cmd has exited.
+func serveJobMetadata(job *Job, deadline time.Time) (string, func() error, error) {
+	dir, err := ioutil.TempDir("", "wr_metadata")
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		errr := os.RemoveAll(dir)
+		if errr != nil {
+			err = fmt.Errorf("%s (and removing the socket dir failed: %s)", err, errr)
+		}
+		return "", nil, err
+	}
+
+	md := job.jobMetadata(deadline)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// (we copy md so concurrent requests don't step on each other)
+		current := *md
+		current.RemainingSeconds = time.Until(current.Deadline).Seconds()
+		current.Mounts = make([]MountMetadata, len(md.Mounts))
+		for i, mm := range md.Mounts {
+			if free, total, errs := fsSpace(mm.Mount); errs == nil {
+				mm.FreeBytes = free
+				mm.TotalBytes = total
+			}
+			current.Mounts[i] = mm
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		erre := json.NewEncoder(w).Encode(current)
+		if erre != nil {
+			http.Error(w, erre.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	srv := &http.Server{Handler: mux, ReadTimeout: metadataTimeout, WriteTimeout: metadataTimeout}
+	go func() {
+		// (this returns http.ErrServerClosed once we're stopped)
+		srv.Serve(ln) // #nosec
+	}()
+
+	stop := func() error {
+		err := srv.Close()
+		errr := os.RemoveAll(dir)
+		if errr != nil {
+			if err == nil {
+				err = errr
+			} else {
+				err = fmt.Errorf("%s (and removing the socket dir failed: %s)", err.Error(), errr)
+			}
+		}
+		return err
+	}
+	return path, stop, nil
+}
+
+// GetJobMetadata is for use by Cmds being run by wr: it returns the
+// JobMetadata describing the calling Cmd's own Job, such as its requirements
+// and how long it has left before it may be killed for using too much time.
+// This can be used to, for example, decide when to checkpoint.
+//
+// Cmds not written in Go can get the same information as JSON by doing an http
+// GET over the unix socket at $WR_METADATA_SOCKET, eg.:
+// curl --unix-socket $WR_METADATA_SOCKET http://localhost/
+func GetJobMetadata() (md *JobMetadata, err error) {
+	path := os.Getenv(JobMetadataSocketEnvVar)
+	if path == "" {
+		return nil, fmt.Errorf("$%s is not set; not being run by a wr runner?", JobMetadataSocketEnvVar)
+	}
+
+	client := &http.Client{
+		Timeout: metadataTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		errc := resp.Body.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata request failed: %s", resp.Status)
+	}
+
+	md = &JobMetadata{}
+	err = json.NewDecoder(resp.Body).Decode(md)
+	return md, err
+}
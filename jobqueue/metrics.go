@@ -0,0 +1,227 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets a running Cmd emit named numeric
+// metrics, eg. QC values, that then get summarised per RepGroup.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsFileEnvVar is the environment variable that Cmds get the path of
+// their metrics file in. Cmds emit metrics by appending lines of the form
+// "name value" (or "name=value") to this file, where name may only contain
+// letters, numbers, _, ., - and /, and value is a number. If a name appears
+// more than once, the last value wins. RecordJobMetric() does this for you.
+const MetricsFileEnvVar = "WR_METRICS_FILE"
+
+// maxJobMetrics is the most metrics we'll take from a single run of a Cmd.
+const maxJobMetrics = 1000
+
+// MetricSummary summarises the values of a metric across a number of Jobs.
+type MetricSummary struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// add includes the given value in the summary.
+func (ms *MetricSummary) add(value float64) {
+	if ms.Count == 0 || value < ms.Min {
+		ms.Min = value
+	}
+	if ms.Count == 0 || value > ms.Max {
+		ms.Max = value
+	}
+	ms.Count++
+	ms.Sum += value
+}
+
+// Mean returns the mean of the summarised values.
+func (ms *MetricSummary) Mean() float64 {
+	if ms.Count == 0 {
+		return 0
+	}
+	return ms.Sum / float64(ms.Count)
+}
+
+// RepGroupMetrics holds summaries of the metrics emitted by the Jobs in a
+// RepGroup and all the RepGroups below it in the hierarchy, keyed on metric
+// name.
+type RepGroupMetrics struct {
+	RepGroup string
+	Metrics  map[string]*MetricSummary
+}
+
+// parseMetrics reads metrics in the form described for MetricsFileEnvVar,
+// ignoring any lines that aren't valid. Returns nil if there were none.
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	var metrics map[string]float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.FieldsFunc(scanner.Text(), func(r rune) bool {
+			return r == '=' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 || !labelKeyRegex.MatchString(fields[0]) {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		if metrics == nil {
+			metrics = make(map[string]float64)
+		}
+		if _, exists := metrics[fields[0]]; !exists && len(metrics) >= maxJobMetrics {
+			continue
+		}
+		metrics[fields[0]] = value
+	}
+	return metrics, scanner.Err()
+}
+
+// readMetricsFile parses the metrics file at the given path. A missing file
+// just means there were no metrics.
+func readMetricsFile(path string) (map[string]float64, error) {
+	f, err := os.Open(path) // #nosec we created this path
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	metrics, err := parseMetrics(f)
+	errc := f.Close()
+	if err == nil {
+		err = errc
+	}
+	return metrics, err
+}
+
+// createMetricsFile creates an empty file for a Cmd to write its metrics to,
+// returning its path.
+func createMetricsFile() (string, error) {
+	f, err := ioutil.TempFile("", "wr_metrics")
+	if err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name()) // #nosec we're already returning an error
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// RecordJobMetric is for use by Cmds being run by wr: it records the given
+// named value as a metric of the calling Cmd's Job, by appending it to the
+// file at $WR_METRICS_FILE. The runner attaches the metrics to the Job when
+// the Cmd exits, and the manager summarises them per RepGroup (see
+// Client.GetRepGroupMetrics()). name may only contain letters, numbers, _, .,
+// - and /.
+func RecordJobMetric(name string, value float64) (err error) {
+	path := os.Getenv(MetricsFileEnvVar)
+	if path == "" {
+		return fmt.Errorf("$%s is not set; not being run by a wr runner?", MetricsFileEnvVar)
+	}
+	if !labelKeyRegex.MatchString(name) {
+		return fmt.Errorf("metric name %q is not valid", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("metric %s has no finite value", name)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600) // #nosec the runner gave us this path
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := f.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	_, err = fmt.Fprintf(f, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+	return err
+}
+
+// repGroupMetrics summarises the metrics of the jobs in the given RepGroup and
+// all those below it, rolled up at each level of the hierarchy, sorted by
+// RepGroup. RepGroups with no metrics are left out.
+func (s *Server) repGroupMetrics(parent string) ([]*RepGroupMetrics, string, string) {
+	jobs, srerr, qerr := s.getJobsByRepGroupTree(parent, 0, "", false, false)
+	if srerr != "" {
+		return nil, srerr, qerr
+	}
+
+	parent = strings.TrimSuffix(parent, RepGroupSeparator)
+	summaries := make(map[string]map[string]*MetricSummary)
+	for _, job := range jobs {
+		if len(job.Metrics) == 0 {
+			continue
+		}
+		for _, level := range repGroupLevels(job.RepGroup) {
+			if !repGroupIsUnder(level, parent) {
+				continue
+			}
+			if _, exists := summaries[level]; !exists {
+				summaries[level] = make(map[string]*MetricSummary)
+			}
+			for name, value := range job.Metrics {
+				ms, exists := summaries[level][name]
+				if !exists {
+					ms = &MetricSummary{}
+					summaries[level][name] = ms
+				}
+				ms.add(value)
+			}
+		}
+	}
+
+	rgms := make([]*RepGroupMetrics, 0, len(summaries))
+	for repGroup, metrics := range summaries {
+		rgms = append(rgms, &RepGroupMetrics{RepGroup: repGroup, Metrics: metrics})
+	}
+	sort.Slice(rgms, func(i, j int) bool {
+		return rgms[i].RepGroup < rgms[j].RepGroup
+	})
+	return rgms, "", ""
+}
+
+// GetRepGroupMetrics gets summaries of the metrics emitted by the Cmds (see
+// MetricsFileEnvVar) of the Jobs in the given RepGroup and every RepGroup
+// below it in the hierarchy (see RepGroupSeparator), with the summaries at
+// each level including those of all the levels below it. Only the metrics of
+// the most recent run of each Job are included.
+func (c *Client) GetRepGroupMetrics(repgroup string) ([]*RepGroupMetrics, error) {
+	resp, err := c.request(&clientRequest{Method: "getrgm", Job: &Job{RepGroup: repgroup}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.RepGroupMetrics, err
+}
@@ -0,0 +1,639 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for running a read-only mirror of a server, so
+// that heavy status, REST and web interface usage by many users can be served
+// without adding load to the server that is actually scheduling the jobs.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	bolt "github.com/coreos/bbolt"
+	"github.com/gorilla/websocket"
+	"github.com/grafov/bcast" // *** must be commit e9affb593f6c871f9b4c3ee6a3c77d421fe953df or status web page updates break in certain cases
+	"github.com/inconshreveable/log15"
+	"github.com/jpillora/backoff"
+	"github.com/ugorji/go/codec"
+)
+
+// mirrorSnapshotTimeout is how long a Mirror waits for the primary server to
+// send it a snapshot of all its jobs.
+const mirrorSnapshotTimeout = 5 * time.Minute
+
+// errMirrorStopped is returned by Mirror.sync() when Stop() was called.
+var errMirrorStopped = errors.New("mirror stopped")
+
+// mirrorSnapshot returns all the jobs currently in the queue along with all
+// complete jobs, for a Mirror to start replicating us from.
+func (s *Server) mirrorSnapshot() ([]*Job, error) {
+	jobs := s.getJobsCurrent(0, "", false, false)
+	complete, err := s.db.retrieveCompleteJobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range complete {
+		job.State = JobStateComplete
+	}
+	return append(jobs, complete...), nil
+}
+
+// retrieveCompleteJobs gets all the jobs from the completed jobs bucket, but
+// not those that are also currently live (ie. are being re-run).
+func (db *db) retrieveCompleteJobs() ([]*Job, error) {
+	var jobs []*Job
+	err := db.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		return tx.Bucket(bucketJobsComplete).ForEach(func(key, encoded []byte) error {
+			if len(encoded) == 0 || newJobBucket.Get(key) != nil {
+				return nil
+			}
+			dec := codec.NewDecoderBytes(encoded, db.ch)
+			job := &Job{}
+			err := dec.Decode(job)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// MirrorConfig is supplied to StartMirror() to configure a Mirror.
+type MirrorConfig struct {
+	// Primary is the ip:port of the client port of the server to mirror.
+	Primary string
+
+	// CAFile and CertDomain are as for Connect(), used to connect to Primary.
+	CAFile     string
+	CertDomain string
+
+	// Token authenticates us with Primary; its read-only token is sufficient.
+	// Users of the Mirror's web interface and REST API must supply the same
+	// token.
+	Token []byte
+
+	// Timeout is used when connecting to Primary, as for Connect(). Defaults to
+	// 30 seconds.
+	Timeout time.Duration
+
+	// WebPort is the port to serve the status web interface and REST API on.
+	WebPort string
+
+	// CertFile and KeyFile are the TLS certificate and key to serve the web
+	// interface with, typically the same ones Primary uses.
+	CertFile string
+	KeyFile  string
+
+	// Logger is a logger object that will be used to log uncaught errors and
+	// debug statements. If not supplied, logs are discarded.
+	Logger log15.Logger
+}
+
+// Mirror serves a read-only copy of the status web interface and the GET
+// parts of the REST API of another server (the primary), keeping up to date
+// by streaming replication of the primary's job state changes. STDOUT/ERR and
+// environments of jobs are not replicated.
+type Mirror struct {
+	config     MirrorConfig
+	jobs       map[string]*Job
+	synced     bool
+	caster     *bcast.Group
+	httpServer *http.Server
+	wsconns    map[*websocket.Conn]bool
+	stop       chan struct{}
+	stopped    bool
+	mutex      sync.RWMutex
+	wsmutex    sync.Mutex
+	log15.Logger
+}
+
+// StartMirror starts serving a read-only mirror of the server at
+// config.Primary. It returns once our web interface is listening; replication
+// from the primary happens in the background (and keeps being retried if the
+// primary can't be reached), so initially we may be serving nothing. Call
+// Stop() when you're done with the Mirror.
+func StartMirror(config MirrorConfig) (*Mirror, error) {
+	if config.Primary == "" || config.WebPort == "" || len(config.Token) == 0 {
+		return nil, Error{"StartMirror", "", ErrBadRequest}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = log15.New()
+		logger.SetHandler(log15.DiscardHandler())
+	}
+
+	m := &Mirror{
+		config:  config,
+		jobs:    make(map[string]*Job),
+		caster:  bcast.NewGroup(),
+		wsconns: make(map[*websocket.Conn]bool),
+		stop:    make(chan struct{}),
+		Logger:  logger.New("mirror", config.Primary),
+	}
+
+	ln, err := net.Listen("tcp", "0.0.0.0:"+config.WebPort)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.webStatic)
+	mux.HandleFunc("/status_ws", m.webStatusWS)
+	mux.HandleFunc(restJobsEndpoint, m.restJobs)
+	m.httpServer = &http.Server{Handler: mux}
+	go func() {
+		defer internal.LogPanic(m.Logger, "jobqueue mirror web server", true)
+		errs := m.httpServer.ServeTLS(ln, config.CertFile, config.KeyFile)
+		if errs != nil && errs != http.ErrServerClosed {
+			m.Error("mirror web interface had problems", "err", errs)
+		}
+	}()
+	go m.caster.Broadcasting(0)
+	go m.replicate()
+
+	return m, nil
+}
+
+// Synced tells you if we have a copy of the primary's state and are currently
+// receiving its changes.
+func (m *Mirror) Synced() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.synced
+}
+
+// Stop stops replicating and serving our web interface.
+func (m *Mirror) Stop() {
+	m.mutex.Lock()
+	if m.stopped {
+		m.mutex.Unlock()
+		return
+	}
+	m.stopped = true
+	m.synced = false
+	close(m.stop)
+	m.mutex.Unlock()
+
+	m.caster.Close()
+	m.wsmutex.Lock()
+	for conn := range m.wsconns {
+		errc := conn.Close()
+		if errc != nil {
+			m.Warn("mirror stop failed to close a websocket", "err", errc)
+		}
+		delete(m.wsconns, conn)
+	}
+	m.wsmutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := m.httpServer.Shutdown(ctx)
+	if err != nil {
+		m.Warn("mirror shutdown of web interface failed", "err", err)
+	}
+	cancel()
+}
+
+// replicate keeps us in sync with the primary until Stop() is called,
+// starting over from a new snapshot whenever we lose touch with it.
+func (m *Mirror) replicate() {
+	defer internal.LogPanic(m.Logger, "jobqueue mirror replication", true)
+
+	b := &backoff.Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second, Factor: 2, Jitter: true}
+	for {
+		started := time.Now()
+		err := m.sync()
+		if err == errMirrorStopped {
+			return
+		}
+
+		m.mutex.Lock()
+		m.synced = false
+		m.mutex.Unlock()
+		m.Warn("replication from the primary was interrupted", "err", err)
+
+		if time.Since(started) > b.Max {
+			b.Reset()
+		}
+		select {
+		case <-time.After(b.Duration()):
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sync subscribes to all the primary's job state changes, loads a snapshot of
+// its current state, then applies the changes as they happen. It only returns
+// on failure, or with errMirrorStopped once Stop() has been called.
+func (m *Mirror) sync() error {
+	c, err := Connect(m.config.Primary, m.config.CAFile, m.config.CertDomain, m.config.Token, m.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errd := c.Disconnect()
+		if errd != nil {
+			m.Debug("mirror disconnect failed", "err", errd)
+		}
+	}()
+
+	// we subscribe before getting the snapshot, so we don't miss anything;
+	// changes that happen in between are applied after the snapshot in the
+	// order they happened, so the end result is still correct
+	sc, id, err := c.subscribe(&JobFilter{WithJobs: true})
+	if err != nil {
+		return err
+	}
+	defer c.unsubscribe(sc, id)
+
+	resp, err := c.requestWithin(&clientRequest{Method: "mirrorsnap"}, mirrorSnapshotTimeout)
+	if err != nil {
+		return err
+	}
+	m.load(resp.Jobs)
+	m.Debug("loaded snapshot from the primary", "jobs", len(resp.Jobs))
+
+	wait := SubscriptionPollWait
+	if half := m.config.Timeout / 2; half > 0 && half < wait {
+		wait = half
+	}
+	for {
+		select {
+		case <-m.stop:
+			return errMirrorStopped
+		default:
+		}
+
+		resp, err = sc.request(&clientRequest{Method: "jevents", Keys: []string{id}, Timeout: wait})
+		if err != nil {
+			return err
+		}
+		for _, event := range resp.Events {
+			if event.Job != nil {
+				m.apply(event.Job)
+			}
+		}
+		if resp.Dropped > 0 {
+			return fmt.Errorf("we fell behind and %d changes were dropped", resp.Dropped)
+		}
+	}
+}
+
+// load replaces our copy of the primary's jobs with the given snapshot,
+// telling web interface users about the differences.
+func (m *Mirror) load(jobs []*Job) {
+	m.mutex.RLock()
+	gone := make(map[string]bool, len(m.jobs))
+	for key := range m.jobs {
+		gone[key] = true
+	}
+	m.mutex.RUnlock()
+
+	for _, job := range jobs {
+		delete(gone, job.key())
+		m.apply(job)
+	}
+	for key := range gone {
+		m.remove(key)
+	}
+
+	m.mutex.Lock()
+	m.synced = true
+	m.mutex.Unlock()
+}
+
+// apply stores a replicated job in the state given by its State property,
+// telling web interface users about any state change.
+func (m *Mirror) apply(job *Job) {
+	key := job.key()
+	m.mutex.Lock()
+	from := JobStateNew
+	if old, existed := m.jobs[key]; existed {
+		from = old.State
+	}
+	if job.State == JobStateDeleted {
+		delete(m.jobs, key)
+	} else {
+		m.jobs[key] = job
+	}
+	m.mutex.Unlock()
+	m.castChange(job.RepGroup, from, job.State)
+}
+
+// remove forgets the job with the given key, telling web interface users that
+// it was deleted.
+func (m *Mirror) remove(key string) {
+	m.mutex.Lock()
+	job, existed := m.jobs[key]
+	delete(m.jobs, key)
+	m.mutex.Unlock()
+	if existed {
+		m.castChange(job.RepGroup, job.State, JobStateDeleted)
+	}
+}
+
+// castChange tells web interface users about a job in the given RepGroup
+// changing state. For display simplicity purposes, reserved is merged in to
+// running, as on the primary's status webpage.
+func (m *Mirror) castChange(repGroup string, from, to JobState) {
+	from, to = mergeReserved(from), mergeReserved(to)
+	if from == to {
+		return
+	}
+	m.caster.Send(&jstateCount{"+all+", from, to, 1})
+	m.caster.Send(&jstateCount{repGroup, from, to, 1})
+}
+
+// mergeReserved converts JobStateReserved to JobStateRunning.
+func mergeReserved(state JobState) JobState {
+	if state == JobStateReserved {
+		return JobStateRunning
+	}
+	return state
+}
+
+// copies returns copies of our jobs that pass the given filter function, so
+// that callers can alter them.
+func (m *Mirror) copies(filter func(job *Job) bool) []*Job {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var jobs []*Job
+	for _, job := range m.jobs {
+		if !filter(job) {
+			continue
+		}
+		job.RLock()
+		jobs = append(jobs, job.clientCopy(job.State))
+		job.RUnlock()
+	}
+	return jobs
+}
+
+// currentJobs returns copies of all our incomplete jobs.
+func (m *Mirror) currentJobs() []*Job {
+	return m.copies(func(job *Job) bool {
+		return job.State != JobStateComplete
+	})
+}
+
+// jobsByRepGroup returns copies of all our jobs in the given RepGroup (or
+// below it in the hierarchy, if the RepGroup ends in RepGroupSeparator).
+func (m *Mirror) jobsByRepGroup(repGroup string) []*Job {
+	if strings.HasSuffix(repGroup, RepGroupSeparator) {
+		return m.copies(func(job *Job) bool {
+			return repGroupIsUnder(job.RepGroup, repGroup)
+		})
+	}
+	return m.copies(func(job *Job) bool {
+		return job.RepGroup == repGroup
+	})
+}
+
+// jobByKey returns a copy of our job with the given key, or nil if we don't
+// have it.
+func (m *Mirror) jobByKey(key string) *Job {
+	m.mutex.RLock()
+	job, exists := m.jobs[key]
+	m.mutex.RUnlock()
+	if !exists {
+		return nil
+	}
+	job.RLock()
+	defer job.RUnlock()
+	return job.clientCopy(job.State)
+}
+
+// httpAuthorized checks that the request supplies our token, writing out an
+// error to w if not.
+func (m *Mirror) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := httpToken(w, r)
+	if !ok {
+		return false
+	}
+	if !tokenMatches([]byte(token), m.config.Token) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// webStatic serves the same static documents as the primary.
+func (m *Mirror) webStatic(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == "/" || path == "/status" {
+		path = "/status.html"
+		if !m.httpAuthorized(w, r) {
+			return
+		}
+	}
+
+	err := writeStaticDoc(w, r, path)
+	if err != nil {
+		m.Error("mirror static document write failed", "err", err)
+	}
+}
+
+// webStatusWS is like webInterfaceStatusWS(), but only supports requests that
+// look at jobs.
+func (m *Mirror) webStatusWS(w http.ResponseWriter, r *http.Request) {
+	if !m.httpAuthorized(w, r) {
+		return
+	}
+
+	conn, ok := webSocket(w, r)
+	if !ok {
+		m.Error("Failed to set up websocket", "Host", r.Host)
+		return
+	}
+	m.wsmutex.Lock()
+	m.wsconns[conn] = true
+	m.wsmutex.Unlock()
+
+	writeMutex := &sync.Mutex{}
+	stop := make(chan bool)
+
+	go func() {
+		defer internal.LogPanic(m.Logger, "jobqueue mirror websocket client handling", true)
+		defer func() {
+			m.wsmutex.Lock()
+			if m.wsconns[conn] {
+				delete(m.wsconns, conn)
+				errc := conn.Close()
+				if errc != nil {
+					m.Debug("mirror failed to close a websocket", "err", errc)
+				}
+			}
+			m.wsmutex.Unlock()
+			close(stop)
+		}()
+
+		for {
+			req := jstatusReq{}
+			errr := conn.ReadJSON(&req)
+			if errr != nil {
+				// browser was refreshed or we're stopping
+				return
+			}
+
+			var err error
+			writeMutex.Lock()
+			switch {
+			case req.Request == "current":
+				err = m.sendCurrent(conn)
+			case req.Request == "details":
+				jobs := limitJobsByState(m.jobsByRepGroup(req.RepGroup), 1, req.State)
+				for _, job := range jobs {
+					status := jobToStatus(job)
+					status.RepGroup = req.RepGroup
+					err = conn.WriteJSON(status)
+					if err != nil {
+						break
+					}
+				}
+			case req.Request == "" && req.Key != "":
+				if job := m.jobByKey(req.Key); job != nil {
+					err = conn.WriteJSON(jobToStatus(job))
+				}
+			}
+			writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer internal.LogPanic(m.Logger, "jobqueue mirror websocket status updating", true)
+
+		statusReceiver := m.caster.Join()
+		defer statusReceiver.Close()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case status := <-statusReceiver.In:
+				writeMutex.Lock()
+				err := conn.WriteJSON(status)
+				writeMutex.Unlock()
+				if err != nil {
+					m.Warn("mirror status updater failed to send JSON to client", "err", err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// sendCurrent sends the state counts of all our jobs to the status webpage,
+// as the primary does for a "current" request.
+func (m *Mirror) sendCurrent(conn *websocket.Conn) error {
+	err := webInterfaceStatusSendGroupStateCount(conn, "+all+", m.currentJobs())
+	if err != nil {
+		return err
+	}
+
+	repGroups := make(map[string][]*Job)
+	for _, job := range m.copies(func(job *Job) bool { return true }) {
+		repGroups[job.RepGroup] = append(repGroups[job.RepGroup], job)
+	}
+	rollups := make(map[string][]*Job)
+	for repGroup, jobs := range repGroups {
+		err = webInterfaceStatusSendGroupStateCount(conn, repGroup, jobs)
+		if err != nil {
+			return err
+		}
+		levels := repGroupLevels(repGroup)
+		for _, level := range levels[:len(levels)-1] {
+			rollups[level+RepGroupSeparator] = append(rollups[level+RepGroupSeparator], jobs...)
+		}
+	}
+	for rollup, jobs := range rollups {
+		err = webInterfaceStatusSendGroupStateCount(conn, rollup, jobs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restJobs is like the primary's restJobs(), but only supports GET requests.
+// The std and env parameters are ignored, since we don't have those.
+func (m *Mirror) restJobs(w http.ResponseWriter, r *http.Request) {
+	defer internal.LogPanic(m.Logger, "jobqueue mirror restJobs", false)
+
+	if !m.httpAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "This is a read-only mirror; only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, state, failCode, _, _, err := restJobsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var jobs []*Job
+	if len(r.URL.Path) > len(restJobsEndpoint) {
+		for _, id := range strings.Split(r.URL.Path[len(restJobsEndpoint):], ",") {
+			if len(id) == 32 {
+				if job := m.jobByKey(id); job != nil {
+					jobs = append(jobs, job)
+					continue
+				}
+			}
+			theseJobs := m.jobsByRepGroup(id)
+			if limit > 0 || state != "" {
+				theseJobs = limitJobsByState(theseJobs, limit, state)
+			}
+			jobs = append(jobs, theseJobs...)
+		}
+	} else {
+		jobs = m.currentJobs()
+		if limit > 0 || state != "" {
+			jobs = limitJobsByState(jobs, limit, state)
+		}
+	}
+	if failCode != "" {
+		jobs = FilterJobsByFailCode(jobs, failCode)
+	}
+
+	err = writeJobStatuses(w, http.StatusOK, jobs)
+	if err != nil {
+		m.Warn("mirror restJobs failed to encode job statuses", "err", err)
+	}
+}
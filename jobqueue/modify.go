@@ -0,0 +1,246 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for modifying queued Jobs in place.
+
+import (
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// JobModification describes changes to make to queued Jobs with
+// Client.Modify(). Zero values leave the corresponding property as it was.
+type JobModification struct {
+	// Cmd replaces the Jobs' Cmd. Since a Job's key is based on its Cmd, the
+	// Job is re-added to the queue under its new key, as a Job that has not
+	// been run before. For this reason, Jobs that other queued Jobs depend on
+	// can't have their Cmd changed.
+	Cmd string
+
+	// Requirements changes the Jobs' Requirements, as per
+	// Client.ModifyRequirements().
+	Requirements *ReqChange
+
+	// Retries replaces the Jobs' Retries, also resetting the number of times
+	// they can fail before being buried.
+	Retries *uint8
+
+	// EnvOverride holds environment variables (see SetEnv()) that are added to
+	// the Jobs' existing overrides.
+	EnvOverride []byte
+
+	// Behaviours replace the Jobs' Behaviours.
+	Behaviours Behaviours
+}
+
+// SetEnv sets environment variables, in the form "key=value", that will
+// override those the Jobs would otherwise run with.
+func (jm *JobModification) SetEnv(env []string) error {
+	var err error
+	jm.EnvOverride, err = compressEnv(env)
+	return err
+}
+
+// isEmpty tells you if applying this JobModification would change nothing.
+func (jm *JobModification) isEmpty() bool {
+	return jm.Cmd == "" && (jm.Requirements == nil || jm.Requirements.isEmpty()) && jm.Retries == nil &&
+		len(jm.EnvOverride) == 0 && len(jm.Behaviours) == 0
+}
+
+// validate checks that any Requirements changes are not too large.
+func (jm *JobModification) validate() error {
+	if jm.changesReqs() {
+		return jm.Requirements.validate()
+	}
+	return nil
+}
+
+// changesReqs tells you if applying this JobModification would change the
+// Requirements of a Job.
+func (jm *JobModification) changesReqs() bool {
+	return jm.Requirements != nil && !jm.Requirements.isEmpty()
+}
+
+// rekeys tells you if applying this JobModification would change the key of
+// the given Job, which you must hold the read lock for, returning its new key.
+func (jm *JobModification) rekeys(job *Job) (string, bool) {
+	if jm.Cmd == "" || jm.Cmd == job.Cmd {
+		return "", false
+	}
+	je := &JobEssence{Cmd: jm.Cmd, MountConfigs: job.MountConfigs}
+	if job.CwdMatters {
+		je.Cwd = job.Cwd
+	}
+	return je.Key(), true
+}
+
+// apply makes all the changes except to Cmd to the given Job, which you must
+// hold the lock for, and whose cold fields must be in memory.
+func (jm *JobModification) apply(job *Job) error {
+	if jm.changesReqs() {
+		jm.Requirements.apply(job)
+	}
+	if jm.Retries != nil {
+		job.Retries = *jm.Retries
+		job.UntilBuried = job.Retries + 1
+	}
+	if len(jm.Behaviours) > 0 {
+		job.Behaviours = jm.Behaviours
+	}
+	if len(jm.EnvOverride) > 0 {
+		env, err := (&Job{EnvOverride: jm.EnvOverride}).envCurrentOverrides()
+		if err != nil {
+			return err
+		}
+		return job.EnvAddOverride(env)
+	}
+	return nil
+}
+
+// modifyJobs applies the given modification to the Jobs with the given keys
+// that are in the queue but not currently running. Everything is checked
+// first, so that either all the Jobs are changed or none are. Ready Jobs whose
+// Requirements changed are put in to new scheduler groups, as per
+// modifyRepGroupReqs(). Returns the number of Jobs changed.
+func (s *Server) modifyJobs(keys []string, jm *JobModification) (int, string, error) {
+	var items []*queue.Item
+	for _, key := range keys {
+		item, err := s.q.Get(key)
+		if err != nil || item == nil || item.Stats().State == queue.ItemStateRun {
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return 0, "", nil
+	}
+
+	// Jobs that get a new key must not leave dependents behind (*queue would
+	// regard the removal of the old key as satisfying their dependency), nor
+	// clash with other jobs
+	newKeys := make(map[string]bool)
+	for _, item := range items {
+		job := item.Data.(*Job)
+		job.RLock()
+		newKey, rekey := jm.rekeys(job)
+		job.RUnlock()
+		if !rekey {
+			continue
+		}
+		hasDeps, err := s.q.HasDependents(item.Key)
+		if err != nil {
+			return 0, ErrInternalError, err
+		}
+		_, errg := s.q.Get(newKey)
+		if hasDeps || errg == nil || newKeys[newKey] {
+			return 0, ErrModifyConflict, Error{"Modify", item.Key, ErrModifyConflict}
+		}
+		newKeys[newKey] = true
+	}
+
+	var updated, rekeyed []*Job
+	oldGroups := make(map[string]int)
+	for _, item := range items {
+		job := item.Data.(*Job)
+		s.mem.forget(job)
+		job.Lock()
+		if job.coldSpilled {
+			envOverride, behaviours, err := s.db.retrieveColdFields(item.Key)
+			if err != nil {
+				job.Unlock()
+				return len(updated), ErrDBError, err
+			}
+			job.EnvOverride, job.Behaviours = envOverride, behaviours
+			job.coldSpilled = false
+		}
+		_, rekey := jm.rekeys(job)
+		if err := jm.apply(job); err != nil {
+			job.Unlock()
+			return len(updated), ErrInternalError, err
+		}
+		if (rekey || jm.changesReqs()) && item.Stats().State == queue.ItemStateReady && job.scheduledRunner {
+			oldGroups[job.schedulerGroup]++
+			job.scheduledRunner = false
+		}
+		job.Unlock()
+
+		if rekey {
+			rekeyed = append(rekeyed, job)
+		} else {
+			updated = append(updated, job)
+		}
+	}
+
+	s.uncountScheduledRunners(oldGroups)
+
+	if len(updated) > 0 {
+		if err := s.db.updateLiveJobs(updated); err != nil {
+			return len(updated), ErrDBError, err
+		}
+		for _, job := range updated {
+			s.mem.slim(job)
+		}
+
+		// our ready callback will calculate the new scheduler groups of the
+		// ready jobs
+		s.q.TriggerReadyAddedCallback()
+	}
+
+	if len(rekeyed) == 0 {
+		return len(updated), "", nil
+	}
+
+	newJobs := make([]*Job, len(rekeyed))
+	for i, job := range rekeyed {
+		job.RLock()
+		oldKey := job.key()
+		nj := job.specCopy()
+		nj.Cmd = jm.Cmd
+		nj.DepGroups = job.DepGroups
+		nj.Dependencies = job.Dependencies
+		nj.Datacentre = job.Datacentre
+		nj.EnvKey = job.EnvKey
+		nj.EnvOverride = job.EnvOverride
+		job.RUnlock()
+
+		if err := s.q.Remove(oldKey); err != nil {
+			return len(updated), ErrInternalError, err
+		}
+		s.discardLiveJob(oldKey, true)
+		newJobs[i] = nj
+	}
+	added, _, _, srerr, err := s.createJobs(newJobs, "", true)
+	return len(updated) + added, srerr, err
+}
+
+// Modify changes the Jobs corresponding to the given JobEssences that are in
+// the queue but not currently running, as described by changes. It returns a
+// count of Jobs that were changed.
+//
+// Either all the Jobs are changed or none of them are: if changing the Cmd of
+// one of them would clash with an existing Job, or would break the
+// dependencies of other Jobs, an error is returned and nothing is changed.
+func (c *Client) Modify(jes []*JobEssence, changes *JobModification) (int, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.request(&clientRequest{Method: "jmod", Keys: keys, Modification: changes})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
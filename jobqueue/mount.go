@@ -26,6 +26,13 @@ import (
 	"sort"
 )
 
+// remoteMount is what we need from a mounted remote file system, letting us
+// avoid depending on muxfys on systems it doesn't support.
+type remoteMount interface {
+	Unmount(doNotUpload ...bool) error
+	Logs() []string
+}
+
 // MountConfig struct is used for setting in a Job to specify that a remote file
 // system or object store should be fuse mounted prior to running the Job's Cmd.
 // Currently only supports S3-like object stores.
@@ -106,8 +113,33 @@ type MountTarget struct {
 	// If set, the environment variables $AWS_ACCESS_KEY_ID,
 	// $AWS_SECRET_ACCESS_KEY and $AWS_DEFAULT_REGION override corresponding
 	// options found in any config file.
+	//
+	// If the manager is configured to mint temporary credentials for Jobs
+	// (see ServerConfig.MountCredentials), those replace any access and secret
+	// keys found here, though the other options still apply.
 	Profile string `json:",omitempty"`
 
+	// Endpoint is the URL of the S3 service to use for this target, eg.
+	// "https://s3.eu-west-2.amazonaws.com", overriding the domain and scheme
+	// determined from Profile. If no scheme is given, https is assumed.
+	Endpoint string `json:",omitempty"`
+
+	// Failover is a list of alternate endpoints (specified like Endpoint)
+	// that serve a replica of the same data, eg. a cloud mirror of an on-site
+	// S3 service. If supplied, the primary endpoint and then each of these in
+	// turn are checked at mount time, and the first that can be connected to
+	// is used. The same credentials and Region are used for all of them.
+	Failover []string `json:",omitempty"`
+
+	// Region is the region to use for this target, overriding any region
+	// determined from Profile.
+	Region string `json:",omitempty"`
+
+	// Anonymous is a boolean, which if true, means no credentials are used to
+	// access the target, for reading from public buckets. Profile is then
+	// ignored, and Endpoint defaults to "https://s3.amazonaws.com".
+	Anonymous bool `json:",omitempty"`
+
 	// Path (required) is the name of your S3 bucket, optionally followed URL-
 	// style (separated with forward slashes) by sub-directory names. The
 	// highest performance is gained by specifying the deepest path under your
@@ -151,9 +183,10 @@ func (mcs MountConfigs) String() string {
 
 // Key returns a string representation of the most critical parts of the config
 // that would make it different from other MountConfigs in practical terms of
-// what files are accessible from where: only Mount, Target.Profile and
-// Target.Path are considered. The order of Targets (but not of MountConfig) is
-// considered as well.
+// what files are accessible from where: only Mount, Target.Profile,
+// Target.Endpoint and Target.Path are considered (Target.Failover endpoints are
+// assumed to hold the same data). The order of Targets (but not of
+// MountConfig) is considered as well.
 func (mcs MountConfigs) Key() string {
 	if len(mcs) == 0 {
 		return ""
@@ -183,6 +216,10 @@ func (mcs MountConfigs) Key() string {
 			}
 			key.WriteString(profile)
 			key.WriteString("-")
+			if t.Endpoint != "" {
+				key.WriteString(t.Endpoint)
+				key.WriteString("/")
+			}
 			key.WriteString(t.Path)
 			key.WriteString(";")
 		}
@@ -0,0 +1,309 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package jobqueue
+
+// This file contains the unix-specific code for mounting remote file systems,
+// which we do with muxfys.
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/VertebrateResequencing/muxfys"
+	"github.com/hashicorp/go-multierror"
+)
+
+// defaultS3Endpoint is the Endpoint used for Anonymous MountTargets that don't
+// specify one.
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
+// endpointCheckTimeout is how long we wait to connect to each of a
+// MountTarget's endpoints when it has Failover endpoints to choose between.
+var endpointCheckTimeout = 5 * time.Second
+
+// S3Config returns the muxfys S3 configuration for this target: details are
+// taken from the environment for the target's Profile (unless Anonymous), and
+// then overridden by any Endpoint and Region the target specifies. If the
+// target has Failover endpoints, the first of its endpoints that can be
+// connected to is used.
+func (mt MountTarget) S3Config() (*muxfys.S3Config, error) {
+	return mt.s3Config(nil)
+}
+
+// s3Config is like S3Config(), but if creds are supplied they replace the
+// keys found in the environment. muxfys's S3Config has no session token, so
+// creds that need one (as all those minted by STS do) can't be used yet and
+// result in an error.
+func (mt MountTarget) s3Config(creds *MountCredential) (*muxfys.S3Config, error) {
+	var cfg *muxfys.S3Config
+	endpoint := mt.Endpoint
+	if mt.Anonymous {
+		cfg = &muxfys.S3Config{}
+		if endpoint == "" {
+			endpoint = defaultS3Endpoint
+		}
+	} else {
+		var err error
+		cfg, err = muxfys.S3ConfigFromEnvironment(mt.Profile, mt.Path)
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			if creds.SessionToken != "" {
+				return nil, fmt.Errorf("temporary credentials with a session token can't be used to mount %s, since muxfys doesn't support them", mt.Path)
+			}
+			cfg.AccessKey = creds.AccessKey
+			cfg.SecretKey = creds.SecretKey
+		}
+	}
+
+	if endpoint != "" {
+		cfg.Target = s3Target(endpoint, mt.Path)
+	}
+	if mt.Region != "" {
+		cfg.Region = mt.Region
+	}
+
+	if len(mt.Failover) > 0 {
+		targets := []string{cfg.Target}
+		for _, alt := range mt.Failover {
+			targets = append(targets, s3Target(alt, mt.Path))
+		}
+		var reached bool
+		for _, target := range targets {
+			if endpointReachable(target) {
+				cfg.Target = target
+				reached = true
+				break
+			}
+		}
+		if !reached {
+			return nil, fmt.Errorf("none of the %d endpoints for %s could be connected to", len(targets), mt.Path)
+		}
+	}
+
+	return cfg, nil
+}
+
+// s3Target combines an endpoint (with https assumed if it has no scheme) and
+// a bucket path in to the form muxfys wants for an S3Config.Target.
+func s3Target(endpoint, path string) string {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// endpointReachable checks if we can open a connection to the host of the
+// given S3Config.Target style URL.
+func endpointReachable(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", host, endpointCheckTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Mount uses the Job's MountConfigs to mount the remote file systems at the
+// desired mount points. If a mount point is unspecified, mounts in the sub
+// folder Cwd/mnt if CwdMatters (and unspecified CacheBase becomes Cwd),
+// otherwise the actual working directory is used as the mount point (and the
+// parent of that used for unspecified CacheBase). Relative CacheDir options
+// are treated relative to the CacheBase.
+func (j *Job) Mount() error {
+	cwd := j.Cwd
+	defaultMount := filepath.Join(j.Cwd, "mnt")
+	defaultCacheBase := cwd
+	if j.ActualCwd != "" {
+		cwd = j.ActualCwd
+		defaultMount = cwd
+		defaultCacheBase = filepath.Dir(cwd)
+	}
+
+	for _, mc := range j.MountConfigs {
+		var rcs []*muxfys.RemoteConfig
+		for _, mt := range mc.Targets {
+			accessorConfig, err := mt.s3Config(j.mountCreds)
+			if err != nil {
+				_, erru := j.Unmount()
+				if erru != nil {
+					err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
+				}
+				return err
+			}
+			accessor, err := muxfys.NewS3Accessor(accessorConfig)
+			if err != nil {
+				_, erru := j.Unmount()
+				if erru != nil {
+					err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
+				}
+				return err
+			}
+
+			cacheDir := mt.CacheDir
+			if cacheDir != "" && !filepath.IsAbs(cacheDir) {
+				cacheDir = filepath.Join(defaultCacheBase, cacheDir)
+			}
+			rc := &muxfys.RemoteConfig{
+				Accessor:  accessor,
+				CacheData: mt.Cache,
+				CacheDir:  cacheDir,
+				Write:     mt.Write,
+			}
+
+			rcs = append(rcs, rc)
+		}
+
+		if len(rcs) == 0 {
+			err := fmt.Errorf("No Targets specified")
+			_, erru := j.Unmount()
+			if erru != nil {
+				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
+			}
+			return err
+		}
+
+		retries := 10
+		if mc.Retries > 0 {
+			retries = mc.Retries
+		}
+
+		mount := mc.Mount
+		if mount != "" {
+			if !filepath.IsAbs(mount) {
+				mount = filepath.Join(cwd, mount)
+			}
+		} else {
+			mount = defaultMount
+		}
+		cacheBase := mc.CacheBase
+		if cacheBase != "" {
+			if !filepath.IsAbs(cacheBase) {
+				cacheBase = filepath.Join(cwd, cacheBase)
+			}
+		} else {
+			cacheBase = defaultCacheBase
+		}
+		cfg := &muxfys.Config{
+			Mount:     mount,
+			CacheBase: cacheBase,
+			Retries:   retries,
+			Verbose:   mc.Verbose,
+		}
+
+		fs, err := muxfys.New(cfg)
+		if err != nil {
+			_, erru := j.Unmount()
+			if erru != nil {
+				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
+			}
+			return err
+		}
+
+		err = fs.Mount(rcs...)
+		if err != nil {
+			_, erru := j.Unmount()
+			if erru != nil {
+				err = fmt.Errorf("%s (and the unmount failed: %s)", err.Error(), erru)
+			}
+			return err
+		}
+
+		// (we can't use each fs.UnmountOnDeath() function because that tries
+		// to upload, but if we get killed we don't want that)
+
+		j.mountedFS = append(j.mountedFS, fs)
+		j.mountPoints = append(j.mountPoints, mount)
+	}
+
+	// unmount all on death without trying to upload
+	if len(j.mountedFS) > 0 {
+		deathSignals := make(chan os.Signal, 2)
+		signal.Notify(deathSignals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-deathSignals
+			var merr *multierror.Error
+			for _, fs := range j.mountedFS {
+				erru := fs.Unmount(true)
+				if erru != nil {
+					merr = multierror.Append(merr, erru)
+				}
+			}
+			if len(merr.Errors) > 0 {
+				panic(merr)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// mountS3Backup mounts the given S3 path at mnt, writeable, for storing
+// database backups in.
+func mountS3Backup(profile, path, mnt string) (remoteMount, error) {
+	accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := muxfys.NewS3Accessor(accessorConfig)
+	if err != nil {
+		return nil, err
+	}
+	remoteConfig := &muxfys.RemoteConfig{
+		Accessor: accessor,
+		Write:    true,
+	}
+	cfg := &muxfys.Config{
+		Mount:   mnt,
+		Retries: 10,
+	}
+	fs, err := muxfys.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.Mount(remoteConfig)
+	if err != nil {
+		return nil, err
+	}
+	fs.UnmountOnDeath()
+	return fs, nil
+}
@@ -0,0 +1,39 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the Windows-specific code for mounting remote file
+// systems, which is not supported there.
+
+import "fmt"
+
+// Mount returns an error on Windows if the Job has any MountConfigs, since
+// there is no fuse support.
+func (j *Job) Mount() error {
+	if len(j.MountConfigs) > 0 {
+		return fmt.Errorf("mounting remote file systems is not supported on Windows")
+	}
+	return nil
+}
+
+// mountS3Backup always returns an error on Windows, since there is no fuse
+// support.
+func mountS3Backup(profile, path, mnt string) (remoteMount, error) {
+	return nil, fmt.Errorf("backing up the database to S3 is not supported on Windows")
+}
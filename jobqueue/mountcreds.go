@@ -0,0 +1,363 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for minting short-lived S3 credentials for Jobs
+// that mount S3 buckets, so that long-lived keys never need to be present on
+// the machines that run Jobs.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stsMinLifetime and stsMaxLifetime are the shortest and longest lifetimes
+// that STS AssumeRole will grant credentials for.
+const (
+	stsMinLifetime = 15 * time.Minute
+	stsMaxLifetime = 12 * time.Hour
+	stsAPIVersion  = "2011-06-15"
+)
+
+// mountCredentialSlack is added to a Job's expected run time to get the
+// lifetime of the credentials minted for its mounts, since Jobs can overrun
+// and need time to upload their output at the end.
+var mountCredentialSlack = 30 * time.Minute
+
+// stsTimeout is how long we wait for an STS endpoint to respond.
+var stsTimeout = 30 * time.Second
+
+// MountCredential holds temporary S3 credentials minted for a Job by a
+// MountCredentialMinter. When a Job is Execute()d, these are used instead of
+// any from the environment for all of its non-Anonymous MountTargets. They are
+// only ever held in memory by the runner, never stored with the Job.
+//
+// NB: muxfys can't yet send a SessionToken with its requests, so credentials
+// that have one can't be used to mount, and Jobs given them are buried. Once
+// muxfys's S3Config gains a session token field, s3Config() should set it.
+type MountCredential struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+// MountCredentialMinter is the interface to something that can mint
+// MountCredentials that only grant access to the given MountTargets' paths
+// (read-only unless the target is Write), expiring after the given lifetime.
+// The name identifies who the credentials are for in the object store's audit
+// logs.
+type MountCredentialMinter interface {
+	Mint(name string, targets []MountTarget, lifetime time.Duration) (*MountCredential, error)
+}
+
+// STSMinter is a MountCredentialMinter that uses the AssumeRole action of an
+// STS endpoint (as supported by AWS, Ceph RGW and MinIO) to mint credentials,
+// with a session policy limiting them to the MountTargets' bucket prefixes.
+type STSMinter struct {
+	// Endpoint is the URL of the STS service, eg. https://sts.amazonaws.com.
+	Endpoint string
+
+	// Region is the region to sign requests for. Defaults to us-east-1.
+	Region string
+
+	// RoleARN is the role to assume. Its own policy must allow everything that
+	// Jobs might need; the minted credentials are further restricted to just
+	// what each Job mounts.
+	RoleARN string
+
+	// AccessKey and SecretKey are the long-lived credentials of a user allowed
+	// to assume the role. These stay with the server.
+	AccessKey string
+	SecretKey string
+
+	// MaxLifetime is the longest lifetime credentials can be minted for, and
+	// should be no more than the maximum session duration configured for the
+	// role. Defaults to 1 hour, the default maximum for AWS roles. Credentials
+	// are not refreshed, so Jobs expected to run for longer can't be given
+	// any.
+	MaxLifetime time.Duration
+}
+
+// stsResponse is the part of an AssumeRole response that we care about.
+type stsResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+// stsErrorResponse is the form of error responses from STS.
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// Mint calls AssumeRole on our Endpoint, asking for credentials limited to the
+// given targets that last for the given lifetime (raised to the minimum STS
+// allows if shorter). Returns an error if the lifetime is longer than our
+// MaxLifetime or the maximum STS allows, since the credentials would expire
+// while still needed.
+func (m *STSMinter) Mint(name string, targets []MountTarget, lifetime time.Duration) (*MountCredential, error) {
+	policy, err := mountPolicy(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLifetime := m.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = 1 * time.Hour
+	}
+	if maxLifetime > stsMaxLifetime {
+		maxLifetime = stsMaxLifetime
+	}
+	if lifetime > maxLifetime {
+		return nil, fmt.Errorf("credentials are needed for %s, but can only be minted for %s", lifetime, maxLifetime)
+	}
+	if lifetime < stsMinLifetime {
+		lifetime = stsMinLifetime
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", stsAPIVersion)
+	form.Set("RoleArn", m.RoleARN)
+	form.Set("RoleSessionName", name)
+	form.Set("Policy", policy)
+	form.Set("DurationSeconds", strconv.Itoa(int(lifetime.Seconds())))
+	body := form.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, m.Endpoint, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	region := m.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	signV4(req, []byte(body), m.AccessKey, m.SecretKey, region, "sts", time.Now().UTC())
+
+	client := &http.Client{Timeout: stsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	errc := resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if errc != nil {
+		return nil, errc
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var serr stsErrorResponse
+		if xml.Unmarshal(content, &serr) == nil && serr.Code != "" {
+			return nil, fmt.Errorf("AssumeRole failed: %s: %s", serr.Code, serr.Message)
+		}
+		return nil, fmt.Errorf("AssumeRole failed: %s", resp.Status)
+	}
+
+	var sresp stsResponse
+	err = xml.Unmarshal(content, &sresp)
+	if err != nil {
+		return nil, err
+	}
+	if sresp.Credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("AssumeRole response contained no credentials")
+	}
+	return &MountCredential{
+		AccessKey:    sresp.Credentials.AccessKeyID,
+		SecretKey:    sresp.Credentials.SecretAccessKey,
+		SessionToken: sresp.Credentials.SessionToken,
+		Expiration:   sresp.Credentials.Expiration,
+	}, nil
+}
+
+// policyStatement and policyDocument are the parts of an IAM policy that we
+// need to generate session policies.
+type policyStatement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string][]string `json:",omitempty"`
+}
+
+type policyDocument struct {
+	Version   string
+	Statement []*policyStatement
+}
+
+// mountPolicy generates a JSON IAM session policy that allows listing and
+// reading just the paths of the given targets, and also writing to the paths
+// of Write targets. Anonymous targets are ignored.
+func mountPolicy(targets []MountTarget) (string, error) {
+	doc := &policyDocument{Version: "2012-10-17"}
+	for _, mt := range targets {
+		if mt.Anonymous {
+			continue
+		}
+		bucket, prefix := splitBucketPath(mt.Path)
+		if bucket == "" {
+			return "", fmt.Errorf("mount target path %q has no bucket", mt.Path)
+		}
+
+		list := &policyStatement{
+			Effect:   "Allow",
+			Action:   []string{"s3:ListBucket", "s3:GetBucketLocation"},
+			Resource: []string{"arn:aws:s3:::" + bucket},
+		}
+		objects := "arn:aws:s3:::" + bucket + "/*"
+		if prefix != "" {
+			list.Condition = map[string]map[string][]string{
+				"StringLike": {"s3:prefix": {prefix, prefix + "/*"}},
+			}
+			objects = "arn:aws:s3:::" + bucket + "/" + prefix + "/*"
+		}
+
+		actions := []string{"s3:GetObject"}
+		if mt.Write {
+			actions = append(actions, "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts")
+		}
+		doc.Statement = append(doc.Statement, list, &policyStatement{
+			Effect:   "Allow",
+			Action:   actions,
+			Resource: []string{objects},
+		})
+	}
+	if len(doc.Statement) == 0 {
+		return "", fmt.Errorf("no non-anonymous mount targets to grant access to")
+	}
+
+	b, err := json.Marshal(doc)
+	return string(b), err
+}
+
+// splitBucketPath splits a MountTarget Path in to its bucket and the prefix
+// within that bucket (without leading or trailing slashes).
+func splitBucketPath(path string) (string, string) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.Trim(parts[1], "/")
+}
+
+// signV4 adds AWS Signature Version 4 headers to the given request, which must
+// have the given body.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\nhost:" + req.URL.Host + "\nx-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonicalHeaders, signedHeaders, sha256Hex(body)}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) // #nosec hash writes never fail
+	return h.Sum(nil)
+}
+
+// jobMountCredentials mints credentials for the given Job's non-Anonymous
+// MountTargets, lasting for its expected run time. Returns nil if we have no
+// MountCredentialMinter, or the Job has no such targets.
+func (s *Server) jobMountCredentials(job *Job) (*MountCredential, error) {
+	if s.mountMinter == nil {
+		return nil, nil
+	}
+
+	job.RLock()
+	targets := job.credentialTargets()
+	lifetime := mountCredentialSlack
+	if job.Requirements != nil {
+		lifetime += job.Requirements.Time
+	}
+	key := job.key()
+	job.RUnlock()
+
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	return s.mountMinter.Mint("wr-"+key, targets, lifetime)
+}
+
+// credentialTargets returns the MountTargets of the Job that need credentials.
+func (j *Job) credentialTargets() []MountTarget {
+	var targets []MountTarget
+	for _, mc := range j.MountConfigs {
+		for _, mt := range mc.Targets {
+			if !mt.Anonymous {
+				targets = append(targets, mt)
+			}
+		}
+	}
+	return targets
+}
+
+// getJobMountCredentials gets temporary credentials for the given Job's mounts
+// from the server. Returns nil if the server doesn't mint them, in which case
+// credentials come from the environment as usual. You must have Reserve()d the
+// Job, and it must be running.
+func (c *Client) getJobMountCredentials(job *Job) (*MountCredential, error) {
+	resp, err := c.request(&clientRequest{Method: "jmountcreds", Keys: []string{job.key()}})
+	if err != nil {
+		if jqerr, ok := err.(Error); ok && jqerr.Err == ErrUnknownCommand {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return resp.MountCreds, nil
+}
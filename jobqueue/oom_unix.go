@@ -0,0 +1,229 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows
+// +build !windows
+
+package jobqueue
+
+// This file contains the unix-specific code for finding out if the kernel's
+// OOM killer killed a Cmd. Only linux actually reports this; elsewhere we never
+// detect anything.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// kmsgPath is where the linux kernel makes its log messages available.
+const kmsgPath = "/dev/kmsg"
+
+// cgroupRoot is where cgroup file systems are mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// oomKilledRegex matches the kernel log message written when the OOM killer
+// kills a process, capturing its pid and the kB of anon, file and (on newer
+// kernels) shmem RSS it had.
+var oomKilledRegex = regexp.MustCompile(`Killed process (\d+) \(.*?\) total-vm:\d+kB, anon-rss:(\d+)kB, file-rss:(\d+)kB(?:, shmem-rss:(\d+)kB)?`)
+
+// oomWatcher lets Execute() find out if the OOM killer killed its Cmd (or one
+// of the Cmd's child processes). It notes kernel log messages written while the
+// Cmd runs, and the number of OOM kills in the runner's memory cgroup.
+type oomWatcher struct {
+	kmsgFd         int
+	cgroupOOMFile  string
+	cgroupOOMKills int
+	pids           map[int]bool
+}
+
+// newOOMWatcher starts watching for OOM kills. Call stop() when done.
+func newOOMWatcher() *oomWatcher {
+	w := &oomWatcher{kmsgFd: -1, pids: make(map[int]bool)}
+
+	// we use the fd directly, since an os.File would wait for more messages
+	// instead of telling us there aren't any
+	fd, err := syscall.Open(kmsgPath, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err == nil {
+		// we only want messages written from now on
+		if _, err = syscall.Seek(fd, 0, io.SeekEnd); err == nil {
+			w.kmsgFd = fd
+		} else {
+			syscall.Close(fd) // #nosec we don't care about errors closing something we can't use
+		}
+	}
+
+	w.cgroupOOMFile = cgroupOOMFile()
+	if w.cgroupOOMFile != "" {
+		w.cgroupOOMKills = cgroupOOMKills(w.cgroupOOMFile)
+	}
+
+	return w
+}
+
+// track notes the given pid and all its current descendants as being part of
+// our Cmd, so that we can recognise them as victims of the OOM killer.
+func (w *oomWatcher) track(pid int) {
+	w.pids[pid] = true
+	for _, child := range childPids(pid) {
+		w.track(child)
+	}
+}
+
+// killed tells you if the OOM killer killed any of the tracked processes (or
+// any process in our memory cgroup) since we started watching. If the kernel
+// reported how much memory its victim was using, that is also returned, in MB.
+func (w *oomWatcher) killed() (bool, int) {
+	killed := false
+	peakMB := 0
+
+	if w.kmsgFd >= 0 {
+		buf := make([]byte, 8192)
+		for {
+			n, err := syscall.Read(w.kmsgFd, buf)
+			if err != nil || n <= 0 {
+				if err == syscall.EPIPE {
+					// we missed some messages that were overwritten; carry on
+					// with the ones we can still get
+					continue
+				}
+				break
+			}
+
+			matches := oomKilledRegex.FindSubmatch(buf[:n])
+			if matches == nil {
+				continue
+			}
+			pid, err := strconv.Atoi(string(matches[1]))
+			if err != nil || !w.pids[pid] {
+				continue
+			}
+			killed = true
+			kb := 0
+			for _, match := range matches[2:] {
+				if v, errc := strconv.Atoi(string(match)); errc == nil {
+					kb += v
+				}
+			}
+			if mb := kb / 1024; mb > peakMB {
+				peakMB = mb
+			}
+		}
+	}
+
+	if !killed && w.cgroupOOMFile != "" && cgroupOOMKills(w.cgroupOOMFile) > w.cgroupOOMKills {
+		killed = true
+	}
+
+	return killed, peakMB
+}
+
+// stop stops watching for OOM kills.
+func (w *oomWatcher) stop() {
+	if w.kmsgFd >= 0 {
+		syscall.Close(w.kmsgFd) // #nosec nothing we can do about failure here
+		w.kmsgFd = -1
+	}
+}
+
+// childPids returns the pids of the direct children of the given pid, using
+// linux's /proc/*/task/*/children.
+func childPids(pid int) []int {
+	tasks, err := filepath.Glob(filepath.Join("/proc", strconv.Itoa(pid), "task", "*", "children"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, task := range tasks {
+		content, err := ioutil.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(content)) {
+			if child, err := strconv.Atoi(field); err == nil {
+				pids = append(pids, child)
+			}
+		}
+	}
+	return pids
+}
+
+// cgroupOOMFile returns the path to the file that records the number of OOM
+// kills in our memory cgroup: memory.events for cgroup v2, or
+// memory.oom_control for v1. Returns an empty string if there isn't one.
+func cgroupOOMFile() string {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	defer f.Close() // #nosec read-only
+
+	var path string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// lines are like "0::/path" for v2, or "4:memory:/path" for v1
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" && parts[0] == "0" {
+			if path == "" {
+				path = filepath.Join(cgroupRoot, parts[2], "memory.events")
+			}
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				path = filepath.Join(cgroupRoot, "memory", parts[2], "memory.oom_control")
+			}
+		}
+	}
+
+	if path == "" {
+		return ""
+	}
+	if _, err = os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// cgroupOOMKills returns the oom_kill count in the given cgroup file.
+func cgroupOOMKills(path string) int {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) == 2 && string(fields[0]) == "oom_kill" {
+			kills, err := strconv.Atoi(string(fields[1]))
+			if err == nil {
+				return kills
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the Windows-specific code for finding out if a Cmd ran
+// out of memory; Windows has no OOM killer, so we never detect anything.
+
+// oomWatcher does nothing on Windows.
+type oomWatcher struct{}
+
+// newOOMWatcher returns an oomWatcher that does nothing.
+func newOOMWatcher() *oomWatcher {
+	return &oomWatcher{}
+}
+
+// track does nothing on Windows.
+func (w *oomWatcher) track(pid int) {}
+
+// killed always returns false on Windows.
+func (w *oomWatcher) killed() (bool, int) {
+	return false, 0
+}
+
+// stop does nothing on Windows.
+func (w *oomWatcher) stop() {}
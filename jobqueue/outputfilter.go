@@ -0,0 +1,185 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for filtering the STDOUT and STDERR of Cmds
+// before we keep them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// outputRedaction is what OutputFilter.Redact matches get replaced with.
+var outputRedaction = []byte("[redacted]")
+
+// OutputFilter struct is used for setting in a Job to control which lines of
+// its Cmd's STDOUT and STDERR are kept, so that the (truncated) output stored
+// with the Job contains useful errors instead of progress spam. Each value is
+// a regular expression that is matched against individual lines, without
+// their line endings. The filters are applied before output is truncated.
+type OutputFilter struct {
+	// Keep, if set, results in only lines matching one of these being kept.
+	Keep []string `json:"keep,omitempty"`
+
+	// Drop results in lines matching any of these being discarded.
+	Drop []string `json:"drop,omitempty"`
+
+	// Redact results in anything matching these being replaced with
+	// "[redacted]", eg. to avoid storing credentials.
+	Redact []string `json:"redact,omitempty"`
+}
+
+// ParseOutputFilter takes the JSON representation of an OutputFilter, eg.
+// `{"drop":["^Progress"],"redact":["password=\\S+"]}`, and returns a validated
+// OutputFilter.
+func ParseOutputFilter(outputFilter string) (OutputFilter, error) {
+	var of OutputFilter
+	if outputFilter == "" {
+		return of, nil
+	}
+	if err := json.Unmarshal([]byte(outputFilter), &of); err != nil {
+		return of, fmt.Errorf("output filter [%s] is not valid JSON: %s", outputFilter, err)
+	}
+	return of, of.Validate()
+}
+
+// IsSet tells you if any filters have been specified.
+func (of OutputFilter) IsSet() bool {
+	return len(of.Keep) > 0 || len(of.Drop) > 0 || len(of.Redact) > 0
+}
+
+// Validate checks that all the filters are valid regular expressions,
+// returning an error describing the first one that isn't.
+func (of OutputFilter) Validate() error {
+	_, err := of.compile()
+	return err
+}
+
+// lineFilter is a compiled OutputFilter.
+type lineFilter struct {
+	keep   []*regexp.Regexp
+	drop   []*regexp.Regexp
+	redact []*regexp.Regexp
+}
+
+// compile returns a lineFilter for our filters, or nil if none were set.
+func (of OutputFilter) compile() (*lineFilter, error) {
+	if !of.IsSet() {
+		return nil, nil
+	}
+	filter := &lineFilter{}
+	var err error
+	if filter.keep, err = compileFilters("keep", of.Keep); err != nil {
+		return nil, err
+	}
+	if filter.drop, err = compileFilters("drop", of.Drop); err != nil {
+		return nil, err
+	}
+	if filter.redact, err = compileFilters("redact", of.Redact); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// compileFilters compiles the given regular expressions of the given kind.
+func compileFilters(kind string, exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("output filter %s [%s] is invalid: %s", kind, expr, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// apply returns the given line (which may end in \n) with redactions made, or
+// nil if it should not be kept.
+func (filter *lineFilter) apply(line []byte) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	if len(filter.keep) > 0 && !matchesAny(filter.keep, content) {
+		return nil
+	}
+	if matchesAny(filter.drop, content) {
+		return nil
+	}
+	for _, re := range filter.redact {
+		line = re.ReplaceAllLiteral(line, outputRedaction)
+	}
+	return line
+}
+
+// matchesAny tells you if any of the given regular expressions match b.
+func matchesAny(res []*regexp.Regexp, b []byte) bool {
+	for _, re := range res {
+		if re.Match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterWriter is an io.Writer that passes on only the complete lines written
+// to it that a lineFilter keeps.
+type filterWriter struct {
+	out     io.Writer
+	filter  *lineFilter
+	partial []byte
+}
+
+// Write buffers p until we have complete lines, which get filtered and written
+// to our out.
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	fw.partial = append(fw.partial, p...)
+	for {
+		i := bytes.IndexByte(fw.partial, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		line := fw.partial[:i+1]
+		fw.partial = fw.partial[i+1:]
+		if err := fw.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// flush filters and writes any final line that didn't end in \n.
+func (fw *filterWriter) flush() error {
+	if len(fw.partial) == 0 {
+		return nil
+	}
+	line := fw.partial
+	fw.partial = nil
+	return fw.writeLine(line)
+}
+
+// writeLine writes the given line to our out, if our filter keeps it.
+func (fw *filterWriter) writeLine(line []byte) error {
+	if kept := fw.filter.apply(line); kept != nil {
+		_, err := fw.out.Write(kept)
+		return err
+	}
+	return nil
+}
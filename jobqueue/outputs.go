@@ -0,0 +1,264 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets a running Cmd register the files and
+// metrics it produces as the outputs of its Job.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JobOutputsSocketEnvVar is the environment variable that Cmds get the path
+// of the runner's local outputs socket in. RegisterJobOutputs() uses it.
+const JobOutputsSocketEnvVar = "WR_OUTPUTS_SOCKET"
+
+// outputsSocketTimeout is how long RegisterJobOutputs() waits for the runner
+// to respond.
+const outputsSocketTimeout = 30 * time.Second
+
+// outputsSocketOK is what the runner replies with over the outputs socket when
+// outputs were registered successfully; anything else is an error message.
+const outputsSocketOK = "ok"
+
+// Artifact describes a file or metric produced by a Job's Cmd. At least one of
+// Path or Name must be set.
+type Artifact struct {
+	// Name is an optional label for the output, eg. "aligned_bam" or
+	// "reads_mapped". Registering an output with the same Name (or Path, if
+	// there is no Name) as a previously registered one replaces it.
+	Name string `json:"name,omitempty"`
+
+	// Path is the path to an output file. Relative paths are taken to be
+	// relative to the Cmd's actual working directory, and are stored as
+	// absolute paths.
+	Path string `json:"path,omitempty"`
+
+	// Size is the size of the file at Path in bytes. It is filled in for you
+	// when the file exists.
+	Size int64 `json:"size,omitempty"`
+
+	// Value is the value of a metric, eg. "1045332".
+	Value string `json:"value,omitempty"`
+}
+
+// id returns the identifier we use to decide if an Artifact replaces an
+// existing one.
+func (a Artifact) id() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Path
+}
+
+// String returns a human readable description of the Artifact.
+func (a Artifact) String() string {
+	var parts []string
+	if a.Name != "" {
+		parts = append(parts, a.Name)
+	}
+	if a.Path != "" {
+		if a.Size > 0 {
+			parts = append(parts, fmt.Sprintf("%s (%d bytes)", a.Path, a.Size))
+		} else {
+			parts = append(parts, a.Path)
+		}
+	}
+	if a.Value != "" {
+		parts = append(parts, a.Value)
+	}
+	return strings.Join(parts, ": ")
+}
+
+// addOutputs merges the given outputs with the Job's existing Outputs, with
+// new outputs replacing old ones that have the same Name or Path. You must hold
+// the Job's lock before calling this.
+func (j *Job) addOutputs(outputs []Artifact) {
+	for _, a := range outputs {
+		replaced := false
+		for i, existing := range j.Outputs {
+			if existing.id() == a.id() {
+				j.Outputs[i] = a
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			j.Outputs = append(j.Outputs, a)
+		}
+	}
+}
+
+// SetJobOutputs registers the given files and metrics as outputs of the Job
+// described by the given essence. The Job must be running, and you must be the
+// Client that reserved it; a running Cmd should use RegisterJobOutputs()
+// instead, which calls this via the runner's Client.
+func (c *Client) SetJobOutputs(je *JobEssence, outputs []Artifact) error {
+	if len(outputs) == 0 {
+		return nil
+	}
+	for _, a := range outputs {
+		if a.id() == "" {
+			return Error{"SetJobOutputs", je.JobKey, ErrBadRequest}
+		}
+	}
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	_, err := c.request(&clientRequest{Method: "joutputs", Keys: []string{je.JobKey}, Outputs: outputs})
+	return err
+}
+
+// serveJobOutputs starts listening on a unix socket in a new temporary
+// directory, so that job's Cmd can register its outputs by sending them to us,
+// which we then pass on to the server with SetJobOutputs(). Returns the path to
+// the socket and a function you must call to stop listening (and clean up) once
+// the Cmd has exited.
+func (c *Client) serveJobOutputs(job *Job, cwd string) (string, func() error, error) {
+	dir, err := ioutil.TempDir("", "wr_outputs")
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		errr := os.RemoveAll(dir)
+		if errr != nil {
+			err = fmt.Errorf("%s (and removing the socket dir failed: %s)", err, errr)
+		}
+		return "", nil, err
+	}
+
+	je := job.ToEssense()
+	done := make(chan bool)
+	go func() {
+		for {
+			conn, erra := ln.Accept()
+			if erra != nil {
+				close(done)
+				return
+			}
+			c.handleJobOutputs(conn, je, cwd)
+		}
+	}()
+
+	stop := func() error {
+		err := ln.Close()
+		if err == nil {
+			<-done
+		}
+		errr := os.RemoveAll(dir)
+		if errr != nil {
+			if err == nil {
+				err = errr
+			} else {
+				err = fmt.Errorf("%s (and removing the socket dir failed: %s)", err.Error(), errr)
+			}
+		}
+		return err
+	}
+	return path, stop, nil
+}
+
+// handleJobOutputs reads a JSON array of Artifacts from the given connection,
+// registers them for the Job, then replies with outputsSocketOK or an error.
+func (c *Client) handleJobOutputs(conn net.Conn, je *JobEssence, cwd string) {
+	defer conn.Close() // #nosec there's no one to report a failure to
+	err := conn.SetDeadline(time.Now().Add(outputsSocketTimeout))
+	if err != nil {
+		return
+	}
+
+	var outputs []Artifact
+	err = json.NewDecoder(conn).Decode(&outputs)
+	if err == nil {
+		for i, a := range outputs {
+			if a.Path == "" {
+				continue
+			}
+			if !filepath.IsAbs(a.Path) && cwd != "" {
+				a.Path = filepath.Join(cwd, a.Path)
+			}
+			if info, errs := os.Stat(a.Path); errs == nil && info.Mode().IsRegular() {
+				a.Size = info.Size()
+			}
+			outputs[i] = a
+		}
+		err = c.SetJobOutputs(je, outputs)
+	}
+
+	reply := outputsSocketOK
+	if err != nil {
+		reply = err.Error()
+	}
+	fmt.Fprintln(conn, reply) // #nosec the Cmd will get an error if this fails
+}
+
+// RegisterJobOutputs is for use by Cmds being run by wr: it registers the given
+// files and metrics as outputs of the calling Cmd's Job. They will then show up
+// in status requests for the Job. It works by talking to the runner that
+// started the Cmd over a local socket, so needs no connection to, or
+// authorisation with, the server.
+//
+// Cmds not written in Go can do the same by writing a JSON array of Artifacts
+// to the unix socket at $WR_OUTPUTS_SOCKET, and reading back a single line
+// response, which will be "ok" on success.
+func RegisterJobOutputs(outputs []Artifact) (err error) {
+	path := os.Getenv(JobOutputsSocketEnvVar)
+	if path == "" {
+		return fmt.Errorf("$%s is not set; not being run by a wr runner?", JobOutputsSocketEnvVar)
+	}
+
+	conn, err := net.DialTimeout("unix", path, outputsSocketTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errc := conn.Close()
+		if errc != nil && err == nil {
+			err = errc
+		}
+	}()
+	err = conn.SetDeadline(time.Now().Add(outputsSocketTimeout))
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(conn).Encode(outputs)
+	if err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != outputsSocketOK {
+		return fmt.Errorf("failed to register outputs: %s", reply)
+	}
+	return nil
+}
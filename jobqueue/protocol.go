@@ -0,0 +1,95 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for checking that clients and servers speak
+// compatible versions of the protocol they use to talk to each other.
+//
+// The compatibility policy is:
+//
+// ProtocolVersion is incremented whenever clientRequest, serverResponse or any
+// of the types they carry (such as Job) change. If the change is purely
+// additive (new fields that older code can safely not know about), that is all
+// that happens, and old and new code continue to work together.
+//
+// If the change is breaking (fields removed, renamed, re-typed or given a new
+// meaning), MinProtocolVersion is also raised to the new ProtocolVersion, and
+// clients and servers on either side of it refuse to talk to each other with a
+// VersionError, instead of risking requests that only partially decode. (New
+// methods are not breaking, since old servers reject them with
+// ErrUnknownCommand.)
+
+import (
+	"fmt"
+)
+
+const (
+	// ProtocolVersion is the version of the client/server protocol spoken by
+	// this code.
+	ProtocolVersion = 21
+
+	// MinProtocolVersion is the oldest ProtocolVersion of the other side that
+	// this code can still talk to.
+	MinProtocolVersion = 1
+)
+
+// Version is the version of wr that this package is part of, reported to the
+// other side of a connection so that VersionErrors can say which versions are
+// involved. It is expected to be set by the wr executable.
+var Version = ""
+
+// these are what we actually send and check, so that tests can pretend to be
+// other versions
+var (
+	protocolVersion    = ProtocolVersion
+	minProtocolVersion = MinProtocolVersion
+)
+
+// VersionError is returned by Connect() when the client and server speak
+// incompatible versions of the protocol. Clients from before protocol
+// versioning have a Protocol of 0, and so are always incompatible.
+type VersionError struct {
+	ClientVersion  string
+	ClientProtocol int
+	ServerVersion  string
+	ServerProtocol int
+}
+
+// Error describes the versions involved, and which side needs upgrading.
+func (e VersionError) Error() string {
+	upgrade := "client"
+	if e.ServerProtocol < e.ClientProtocol {
+		upgrade = "manager"
+	}
+	return fmt.Sprintf("client %s (protocol %d) cannot talk to manager %s (protocol %d), please upgrade the %s", versionName(e.ClientVersion), e.ClientProtocol, versionName(e.ServerVersion), e.ServerProtocol, upgrade)
+}
+
+// versionName returns the given version, or a description if it is unknown.
+func versionName(version string) string {
+	if version == "" {
+		return "of unknown version"
+	}
+	return version
+}
+
+// protocolCompatible tells you if we can talk to the other side, given its
+// protocol version and the minimum protocol version it can talk to.
+func protocolCompatible(theirs, theirMin int) bool {
+	return theirs >= minProtocolVersion && protocolVersion >= theirMin
+}
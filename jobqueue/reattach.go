@@ -0,0 +1,130 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets runners that were running jobs when the
+// server stopped re-attach to those jobs once the server is restarted, instead
+// of the jobs being run again.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/satori/go.uuid"
+)
+
+// runningJob records which client process is running a job, so that the client
+// can re-attach to the job after a server restart.
+type runningJob struct {
+	clientID uuid.UUID
+	pid      int
+}
+
+// setReattachable sets up our lookup of the jobs that the given runningJobs
+// say were running when we last stopped, which clients will be able to
+// re-attach to until grace has elapsed. Returns the subset of the given
+// runningJobs that are still incomplete.
+func (s *Server) setReattachable(rjs map[string]*runningJob, incomplete []*Job, grace time.Duration) map[string]*runningJob {
+	s.rjmutex.Lock()
+	defer s.rjmutex.Unlock()
+	s.reattach = make(map[string]*runningJob)
+	for _, job := range incomplete {
+		key := job.key()
+		if rj, wasRunning := rjs[key]; wasRunning {
+			s.reattach[key] = rj
+		}
+	}
+	s.reattachDeadline = time.Now().Add(grace)
+	return s.reattach
+}
+
+// reattachJob is called for the job in the given request before we deal with
+// the request. If the job was running when we last stopped, and the request
+// came from the same client and was for the same pid as before, and we're
+// still within our ReattachGrace period, the job is put back in the run
+// sub-queue as if the client had reserved it from us, so that the client can
+// carry on running it.
+func (s *Server) reattachJob(cr *clientRequest) {
+	s.rjmutex.Lock()
+	defer s.rjmutex.Unlock()
+	if len(s.reattach) == 0 {
+		return
+	}
+	if time.Now().After(s.reattachDeadline) {
+		s.reattach = nil
+		return
+	}
+
+	key := cr.Job.key()
+	rj, exists := s.reattach[key]
+	if !exists || !uuid.Equal(rj.clientID, cr.ClientID) || rj.pid != cr.Job.Pid {
+		return
+	}
+	item, err := s.q.Get(key)
+	if err != nil || item.Stats().State != queue.ItemStateDelay {
+		return
+	}
+
+	job := item.Data.(*Job)
+	job.Lock()
+	job.ReservedBy = cr.ClientID
+	job.Exited = false
+	job.Lost = false
+	job.Pid = cr.Job.Pid
+	job.Host = cr.Job.Host
+	if job.Host != "" {
+		job.HostID = s.scheduler.HostToID(job.Host)
+	}
+	job.HostIP = cr.Job.HostIP
+	job.StartTime = cr.Job.StartTime
+	if job.StartTime.IsZero() {
+		job.StartTime = time.Now()
+	}
+	job.EndTime = time.Time{}
+	if cr.Job.Attempts > job.Attempts {
+		job.Attempts = cr.Job.Attempts
+	}
+	sgroup := job.schedulerGroup
+	job.Unlock()
+
+	err = s.q.Adopt(key)
+	if err != nil {
+		s.Warn("reattaching job failed", "cmd", job.Cmd, "err", err)
+		return
+	}
+	s.limitGroups.start(key, job.getLimitGroups())
+	delete(s.reattach, key)
+
+	// like Reserve(), if the client gives up on the job it should become ready
+	// again quickly, not after our grace period
+	err = s.q.SetDelay(key, ClientReleaseDelay)
+	if err != nil {
+		s.Warn("reattach queue SetDelay failed", "err", err)
+	}
+
+	// the job will be counted off its scheduler group when it exits, so count
+	// it on now
+	s.sgcmutex.Lock()
+	if _, existed := s.sgroupcounts[sgroup]; existed {
+		s.sgroupcounts[sgroup]++
+	}
+	s.sgcmutex.Unlock()
+
+	s.Debug("reattached job", "cmd", job.Cmd, "pid", cr.Job.Pid, "host", cr.Job.Host)
+}
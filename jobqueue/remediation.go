@@ -0,0 +1,155 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for suggesting how buried jobs could be fixed,
+// and for applying those suggestions when the jobs are kicked.
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// remediationRAMMult is how much more than a Cmd's peak RAM usage we suggest
+// retrying with, following a FailReasonRAM.
+const remediationRAMMult = 1.2
+
+// remediationTimeMult is how much longer than a Cmd actually ran for we
+// suggest retrying with, following a FailReasonTime.
+const remediationTimeMult = 2
+
+// Remediation is a suggested fix for a buried Job, based on why it failed.
+// When RAM, Time or Disk are set, Client.KickWithRemediation() can apply the
+// suggestion for you; otherwise you have to act on the Advice yourself before
+// retrying.
+type Remediation struct {
+	// Advice is a human readable description of the suggested fix.
+	Advice string
+
+	// RAM is the amount of memory (MB) the Job should be retried with.
+	RAM int
+
+	// Time is the amount of time the Job should be retried with.
+	Time time.Duration
+
+	// Disk is the amount of disk space (GB) the Job should be retried with.
+	Disk int
+}
+
+// Automatic tells you if this Remediation can be applied without any manual
+// intervention.
+func (r *Remediation) Automatic() bool {
+	return r.RAM > 0 || r.Time > 0 || r.Disk > 0
+}
+
+// remediation works out a Remediation based on our FailReason. Returns nil if
+// there's nothing we can suggest. You must hold at least a read lock on the
+// Job.
+func (j *Job) remediation() *Remediation {
+	switch j.FailReason {
+	case FailReasonRAM:
+		if j.PeakRAM <= 0 {
+			return nil
+		}
+		mb := int(math.Ceil(float64(j.PeakRAM)*remediationRAMMult/100) * 100)
+		if mb < j.Requirements.RAM {
+			mb = j.Requirements.RAM
+		}
+		return &Remediation{
+			Advice: fmt.Sprintf("retry with memory %s based on peak %s", megabytesToString(mb), megabytesToString(j.PeakRAM)),
+			RAM:    mb,
+		}
+	case FailReasonTime:
+		if j.StartTime.IsZero() || j.EndTime.Before(j.StartTime) {
+			return nil
+		}
+		ran := j.EndTime.Sub(j.StartTime)
+		t := (ran * remediationTimeMult).Round(time.Minute)
+		if t < j.Requirements.Time {
+			t = j.Requirements.Time
+		}
+		return &Remediation{
+			Advice: fmt.Sprintf("retry with time %s based on being killed after %s", t, ran.Round(time.Second)),
+			Time:   t,
+		}
+	case FailReasonDisk:
+		disk := j.Requirements.Disk * 2
+		if disk < j.Requirements.Disk+1 {
+			disk = j.Requirements.Disk + 1
+		}
+		return &Remediation{
+			Advice: fmt.Sprintf("retry with disk %dG, up from %dG", disk, j.Requirements.Disk),
+			Disk:   disk,
+		}
+	case FailReasonCwd:
+		return &Remediation{Advice: fmt.Sprintf("create the working directory %s on the hosts the command runs on, then retry", j.Cwd)}
+	case FailReasonHostSet:
+		return &Remediation{Advice: "check the host setup command works on the hosts the command runs on (see the error output), then retry"}
+	case FailReasonParent:
+		return &Remediation{Advice: "fix and retry the job this depends on, which will put this back to waiting on it"}
+	case FailReasonMount:
+		return &Remediation{Advice: "check the mount targets exist and that your credentials for them are valid, then retry"}
+	case FailReasonImage:
+		return &Remediation{Advice: "check the container image exists and that docker or singularity works on the hosts the command runs on (see the error output), then retry"}
+	case FailReasonCFound:
+		return &Remediation{Advice: "make sure the command's executable is installed and in the PATH on the hosts the command runs on, then retry"}
+	}
+	return nil
+}
+
+// applyRemediation changes our Requirements according to our remediation(),
+// returning true if anything was changed. You must hold the lock on the Job.
+func (j *Job) applyRemediation() bool {
+	r := j.remediation()
+	if r == nil || !r.Automatic() {
+		return false
+	}
+	if r.RAM > 0 {
+		j.Requirements.RAM = r.RAM
+	}
+	if r.Time > 0 {
+		j.Requirements.Time = r.Time
+	}
+	if r.Disk > 0 {
+		j.Requirements.Disk = r.Disk
+	}
+	j.Override = uint8(1)
+	return true
+}
+
+// megabytesToString formats the given number of MB for display, eg. 11.2G.
+func megabytesToString(mb int) string {
+	return bytefmt.ByteSize(uint64(mb) * bytefmt.MEGABYTE)
+}
+
+// KickWithRemediation is like Kick(), but first applies the suggested
+// Remediation of each buried Job, where that can be done automatically. It
+// returns a count of jobs that it actually kicked, and how many of those had
+// their Requirements changed.
+func (c *Client) KickWithRemediation(jes []*JobEssence) (int, int, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.request(&clientRequest{Method: "jkick", Keys: keys, Remediate: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	return resp.Existed, resp.Added, err
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for default MountConfigs and Behaviours that the
+// server gives to Jobs added to matching RepGroups.
+
+import (
+	"path"
+	"sort"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/ugorji/go/codec"
+)
+
+// RepGroupDefaults describes MountConfigs and Behaviours that Jobs with a
+// RepGroup matching Pattern should get when they are added without their own.
+//
+// Pattern is matched against RepGroups using path.Match() syntax, so "*" does
+// not match "/": "project-x/*" matches "project-x/align" but not
+// "project-x/align/lane1". If more than one Pattern matches, the longest wins.
+//
+// MountConfigs are only given to Jobs that have no MountConfigs. Behaviours
+// are considered per BehaviourTrigger: a Job that has its own OnExit
+// Behaviours but none for OnSuccess will get the default OnSuccess Behaviours
+// but keep its own OnExit ones. Because MountConfigs form part of a Job's
+// key, Jobs given default MountConfigs must be looked up with them.
+type RepGroupDefaults struct {
+	Pattern      string
+	MountConfigs MountConfigs
+	Behaviours   Behaviours
+}
+
+// matches tells you if the given RepGroup matches our Pattern.
+func (d *RepGroupDefaults) matches(repGroup string) bool {
+	matched, err := path.Match(d.Pattern, repGroup)
+	return err == nil && matched
+}
+
+// applyTo gives the Job our MountConfigs and Behaviours where it doesn't have
+// its own. You must hold the Job's lock.
+func (d *RepGroupDefaults) applyTo(job *Job) {
+	if len(job.MountConfigs) == 0 && len(d.MountConfigs) > 0 {
+		job.MountConfigs = d.MountConfigs
+	}
+
+	has := make(map[BehaviourTrigger]bool)
+	for _, b := range job.Behaviours {
+		has[b.When] = true
+	}
+	for _, b := range d.Behaviours {
+		if !has[b.When] {
+			job.Behaviours = append(job.Behaviours, b)
+		}
+	}
+}
+
+// repGroupDefaultsFor returns the defaults with the longest Pattern that
+// matches the given RepGroup, or nil if none match.
+func repGroupDefaultsFor(defaults []*RepGroupDefaults, repGroup string) *RepGroupDefaults {
+	var best *RepGroupDefaults
+	for _, d := range defaults {
+		if d.matches(repGroup) && (best == nil || len(d.Pattern) > len(best.Pattern)) {
+			best = d
+		}
+	}
+	return best
+}
+
+// storeRepGroupDefaults stores the given defaults, replacing any existing ones
+// with the same Patterns.
+func (db *db) storeRepGroupDefaults(defaults []*RepGroupDefaults) error {
+	return db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRepGroupDefaults)
+		for _, d := range defaults {
+			var encoded []byte
+			enc := codec.NewEncoderBytes(&encoded, db.ch)
+			err := enc.Encode(d)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(d.Pattern), encoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteRepGroupDefaults removes the defaults with the given Patterns,
+// returning how many were deleted.
+func (db *db) deleteRepGroupDefaults(patterns []string) (int, error) {
+	var deleted int
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRepGroupDefaults)
+		for _, p := range patterns {
+			if b.Get([]byte(p)) == nil {
+				continue
+			}
+			err := b.Delete([]byte(p))
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// retrieveRepGroupDefaults returns all stored defaults, sorted by Pattern.
+func (db *db) retrieveRepGroupDefaults() ([]*RepGroupDefaults, error) {
+	var defaults []*RepGroupDefaults
+	err := db.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRepGroupDefaults).ForEach(func(k, v []byte) error {
+			d := &RepGroupDefaults{}
+			dec := codec.NewDecoderBytes(v, db.ch)
+			err := dec.Decode(d)
+			if err != nil {
+				return err
+			}
+			defaults = append(defaults, d)
+			return nil
+		})
+	})
+	sort.Slice(defaults, func(i, j int) bool {
+		return defaults[i].Pattern < defaults[j].Pattern
+	})
+	return defaults, err
+}
+
+// applyRepGroupDefaults gives the given Jobs the MountConfigs and Behaviours of
+// the stored defaults that best match their RepGroups.
+func (s *Server) applyRepGroupDefaults(jobs []*Job) error {
+	defaults, err := s.db.retrieveRepGroupDefaults()
+	if err != nil || len(defaults) == 0 {
+		return err
+	}
+	for _, job := range jobs {
+		job.Lock()
+		if d := repGroupDefaultsFor(defaults, job.RepGroup); d != nil {
+			d.applyTo(job)
+		}
+		job.Unlock()
+	}
+	return nil
+}
+
+// GetRepGroupDefaults returns all the RepGroup defaults stored on the server,
+// sorted by Pattern.
+func (c *Client) GetRepGroupDefaults() ([]*RepGroupDefaults, error) {
+	resp, err := c.request(&clientRequest{Method: "getrgdefaults"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.RepGroupDefaults, err
+}
+
+// SetRepGroupDefaults stores the given defaults on the server, replacing any
+// with the same Patterns. Jobs added afterwards with a matching RepGroup will
+// get the MountConfigs and Behaviours they don't specify themselves; Jobs
+// already added are not affected. Each default must have a valid Pattern and
+// at least one MountConfig or Behaviour.
+func (c *Client) SetRepGroupDefaults(defaults []*RepGroupDefaults) error {
+	for _, d := range defaults {
+		if _, err := path.Match(d.Pattern, ""); err != nil || d.Pattern == "" || (len(d.MountConfigs) == 0 && len(d.Behaviours) == 0) {
+			return Error{"SetRepGroupDefaults", d.Pattern, ErrBadRequest}
+		}
+	}
+	_, err := c.request(&clientRequest{Method: "setrgdefaults", RepGroupDefaults: defaults})
+	return err
+}
+
+// DeleteRepGroupDefaults removes the defaults with the given Patterns, so that
+// Jobs added afterwards no longer get them. It returns the number of defaults
+// that were removed.
+func (c *Client) DeleteRepGroupDefaults(patterns []string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "delrgdefaults", Keys: patterns})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
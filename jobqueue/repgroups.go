@@ -0,0 +1,169 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for treating RepGroups as a hierarchy, eg.
+// "project/stage/sample", so that jobs can be retrieved and counted at any
+// level of it.
+
+import (
+	"sort"
+	"strings"
+)
+
+// RepGroupSeparator separates the levels of hierarchical RepGroups, eg.
+// "project/stage/sample" is below "project/stage", which is below "project".
+const RepGroupSeparator = "/"
+
+// RepGroupCount holds the number of jobs in each state in a RepGroup and all
+// the RepGroups below it in the hierarchy. Reserved jobs are counted as
+// running.
+type RepGroupCount struct {
+	RepGroup string
+	Counts   map[JobState]int
+}
+
+// repGroupIsUnder tells you if the given repGroup is parent or below it in
+// the hierarchy.
+func repGroupIsUnder(repGroup, parent string) bool {
+	parent = strings.TrimSuffix(parent, RepGroupSeparator)
+	return repGroup == parent || strings.HasPrefix(repGroup, parent+RepGroupSeparator)
+}
+
+// repGroupLevels returns repGroup and each of its ancestors in the hierarchy,
+// eg. for "a/b/c" returns "a", "a/b" and "a/b/c".
+func repGroupLevels(repGroup string) []string {
+	parts := strings.Split(repGroup, RepGroupSeparator)
+	levels := make([]string, 0, len(parts))
+	for i := range parts {
+		levels = append(levels, strings.Join(parts[:i+1], RepGroupSeparator))
+	}
+	return levels
+}
+
+// cmdWrapperFor returns the wrapper that Cmds of Jobs in the given RepGroup
+// should be executed through: that configured for the most specific level of
+// the RepGroup's hierarchy, or else the server-wide one.
+func (s *Server) cmdWrapperFor(repGroup string) string {
+	levels := repGroupLevels(repGroup)
+	for i := len(levels) - 1; i >= 0; i-- {
+		if wrapper, exists := s.cmdWrappers[levels[i]]; exists {
+			return wrapper
+		}
+	}
+	return s.cmdWrapper
+}
+
+// getJobsByRepGroupTree is like getJobsByRepGroup(), but also gets the jobs
+// in all the RepGroups below the given one in the hierarchy. Complete jobs
+// have their RepGroup set to the one they were found under.
+func (s *Server) getJobsByRepGroupTree(parent string, limit int, state JobState, getStd bool, getEnv bool) (jobs []*Job, srerr string, qerr string) {
+	seen := make(map[string]bool)
+	s.rpl.RLock()
+	for repGroup, keys := range s.rpl.lookup {
+		if !repGroupIsUnder(repGroup, parent) {
+			continue
+		}
+		for key := range keys {
+			if seen[key] {
+				continue
+			}
+			item, err := s.q.Get(key)
+			if err == nil && item != nil {
+				seen[key] = true
+				jobs = append(jobs, s.itemToJob(item, false, false))
+			}
+		}
+	}
+	s.rpl.RUnlock()
+
+	if state == "" || state == JobStateComplete {
+		complete, err := s.db.retrieveCompleteJobsByRepGroupTree(strings.TrimSuffix(parent, RepGroupSeparator))
+		if err != nil {
+			return nil, ErrDBError, err.Error()
+		}
+		jobs = append(jobs, complete...)
+	}
+
+	if limit > 0 || state != "" || getStd || getEnv {
+		jobs = s.limitJobs(jobs, limit, state, getStd, getEnv)
+	}
+	return jobs, srerr, qerr
+}
+
+// repGroupCounts counts the states of the jobs in the given RepGroup and all
+// those below it, rolled up at each level of the hierarchy, sorted by
+// RepGroup.
+func (s *Server) repGroupCounts(parent string) ([]*RepGroupCount, string, string) {
+	jobs, srerr, qerr := s.getJobsByRepGroupTree(parent, 0, "", false, false)
+	if srerr != "" {
+		return nil, srerr, qerr
+	}
+
+	parent = strings.TrimSuffix(parent, RepGroupSeparator)
+	counts := make(map[string]map[JobState]int)
+	for _, job := range jobs {
+		state := job.State
+		if state == JobStateReserved {
+			state = JobStateRunning
+		}
+		for _, level := range repGroupLevels(job.RepGroup) {
+			if !repGroupIsUnder(level, parent) {
+				continue
+			}
+			if _, exists := counts[level]; !exists {
+				counts[level] = make(map[JobState]int)
+			}
+			counts[level][state]++
+		}
+	}
+
+	rgcs := make([]*RepGroupCount, 0, len(counts))
+	for repGroup, stateCounts := range counts {
+		rgcs = append(rgcs, &RepGroupCount{RepGroup: repGroup, Counts: stateCounts})
+	}
+	sort.Slice(rgcs, func(i, j int) bool {
+		return rgcs[i].RepGroup < rgcs[j].RepGroup
+	})
+	return rgcs, "", ""
+}
+
+// GetByRepGroupTree is like GetByRepGroup(), but also gets the Jobs in all the
+// RepGroups below the given one in the hierarchy (see RepGroupSeparator). Eg.
+// "project/stage" gets Jobs with RepGroup "project/stage" and
+// "project/stage/sample1", but not "project/stage2".
+func (c *Client) GetByRepGroupTree(repgroup string, limit int, state JobState, getStd bool, getEnv bool) ([]*Job, error) {
+	resp, err := c.request(&clientRequest{Method: "getbrt", Job: &Job{RepGroup: repgroup}, Limit: limit, State: state, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, err
+}
+
+// GetRepGroupCounts gets the number of Jobs in each state for the given
+// RepGroup and every RepGroup below it in the hierarchy (see
+// RepGroupSeparator), with the counts at each level including those of all
+// the levels below it.
+func (c *Client) GetRepGroupCounts(repgroup string) ([]*RepGroupCount, error) {
+	resp, err := c.request(&clientRequest{Method: "getrgc", Job: &Job{RepGroup: repgroup}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.RepGroupCounts, err
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for changing the resource requirements of
+// queued Jobs in bulk.
+
+import (
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// ReqChange describes changes to make to the Requirements of Jobs. Zero values
+// leave the corresponding requirement as it was.
+type ReqChange struct {
+	RAM   int
+	Time  time.Duration
+	Cores int
+	Disk  int
+}
+
+// isEmpty tells you if applying this ReqChange would change nothing.
+func (rc *ReqChange) isEmpty() bool {
+	return rc.RAM <= 0 && rc.Time <= 0 && rc.Cores <= 0 && rc.Disk <= 0
+}
+
+// validate checks that none of the changes are larger than the maximum
+// requirements we accept (see MaxRAM etc.).
+func (rc *ReqChange) validate() error {
+	return validateRequirementMaximums(rc.RAM, rc.Time, rc.Cores, rc.Disk)
+}
+
+// apply changes the given Job's Requirements, which you must hold the lock
+// for. Like automatic remediation, this sets the Job's Override to 1 if it
+// was 0, so that the new values are not immediately replaced by learned
+// ones.
+func (rc *ReqChange) apply(job *Job) {
+	req := *job.Requirements
+	if rc.RAM > 0 {
+		req.RAM = rc.RAM
+	}
+	if rc.Time > 0 {
+		req.Time = rc.Time
+	}
+	if rc.Cores > 0 {
+		req.Cores = rc.Cores
+	}
+	if rc.Disk > 0 {
+		req.Disk = rc.Disk
+	}
+	job.Requirements = &req
+	if job.Override == 0 {
+		job.Override = uint8(1)
+	}
+}
+
+// modifyRepGroupReqs applies the given change to the Requirements of all the
+// incomplete Jobs in the given RepGroup that are not currently running. The
+// ready ones are then put in to new scheduler groups, with the job scheduler
+// being told to cancel the runners it no longer needs for their old groups
+// and to start new ones suitable for the new groups. Returns the number of
+// Jobs changed.
+func (s *Server) modifyRepGroupReqs(repGroup string, change *ReqChange) (int, error) {
+	s.rpl.RLock()
+	var keys []string
+	for key := range s.rpl.lookup[repGroup] {
+		keys = append(keys, key)
+	}
+	s.rpl.RUnlock()
+
+	var updated []*Job
+	oldGroups := make(map[string]int)
+	for _, key := range keys {
+		item, err := s.q.Get(key)
+		if err != nil || item == nil {
+			continue
+		}
+		state := item.Stats().State
+		if state == queue.ItemStateRun {
+			continue
+		}
+		job := item.Data.(*Job)
+
+		job.Lock()
+		change.apply(job)
+		if state == queue.ItemStateReady && job.scheduledRunner {
+			// the job will no longer count towards the runners of its old
+			// scheduler group
+			oldGroups[job.schedulerGroup]++
+			job.scheduledRunner = false
+		}
+		job.Unlock()
+
+		updated = append(updated, job)
+	}
+
+	if len(updated) == 0 {
+		return 0, nil
+	}
+
+	s.uncountScheduledRunners(oldGroups)
+
+	err := s.db.updateLiveJobs(updated)
+
+	// our ready callback will calculate the new scheduler groups of the ready
+	// jobs and (re)schedule runners for both the new and old groups
+	s.q.TriggerReadyAddedCallback()
+
+	return len(updated), err
+}
+
+// uncountScheduledRunners reduces our counts of the runners needed for the
+// given scheduler groups by the given amounts, for when ready jobs that had
+// runners scheduled for them leave those groups.
+func (s *Server) uncountScheduledRunners(oldGroups map[string]int) {
+	if s.rc == "" || len(oldGroups) == 0 {
+		return
+	}
+	s.sgcmutex.Lock()
+	defer s.sgcmutex.Unlock()
+	for group, count := range oldGroups {
+		if current, existed := s.sgroupcounts[group]; existed {
+			current -= count
+			if current < 0 {
+				current = 0
+			}
+			s.sgroupcounts[group] = current
+		}
+	}
+}
+
+// ModifyRequirements changes the Requirements of all the incomplete Jobs with
+// the given RepGroup that are not currently running, as described by change.
+// Any ready Jobs amongst them are moved to new scheduler groups, so that
+// runners suitable for their new Requirements get scheduled, while pending
+// runners for their old Requirements are cancelled. Returns the number of Jobs
+// that were changed.
+func (c *Client) ModifyRequirements(repGroup string, change *ReqChange) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "modreqs", RepGroup: repGroup, ReqChange: change})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
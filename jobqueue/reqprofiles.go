@@ -0,0 +1,262 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for managing the resource requirements that the
+// server learns for each ReqGroup, and overrides of them set by admins.
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	bolt "github.com/coreos/bbolt"
+	"github.com/ugorji/go/codec"
+)
+
+// ReqGroupProfile describes the memory, time and disk that Jobs in a ReqGroup
+// are recommended to be given, as learned from the peak memory usage, wall time
+// and peak disk usage of previously run Jobs in that group, or as set by an
+// admin.
+type ReqGroupProfile struct {
+	ReqGroup string
+	RAM      int           // in MB
+	Time     time.Duration // wall time
+	Disk     int           // in GB; 0 if unknown
+	Samples  int           // how many distinct past values the learned RAM was based on
+	Override bool          // true if RAM, Time and Disk were set by an admin, instead of learned
+}
+
+// storeReqGroupOverrides stores the RAM, Time and Disk of the given profiles as
+// overrides of what would be learned for their ReqGroups.
+func (db *db) storeReqGroupOverrides(profiles []*ReqGroupProfile) error {
+	return db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReqGroupOverrides)
+		for _, p := range profiles {
+			var encoded []byte
+			enc := codec.NewEncoderBytes(&encoded, db.ch)
+			err := enc.Encode(&ReqGroupProfile{ReqGroup: p.ReqGroup, RAM: p.RAM, Time: p.Time, Disk: p.Disk, Override: true})
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(p.ReqGroup), encoded)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteReqGroupOverrides removes the overrides for the given ReqGroups, so
+// that learned values will be used for them again, returning how many were
+// deleted.
+func (db *db) deleteReqGroupOverrides(reqGroups []string) (int, error) {
+	var deleted int
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReqGroupOverrides)
+		for _, rg := range reqGroups {
+			if b.Get([]byte(rg)) == nil {
+				continue
+			}
+			err := b.Delete([]byte(rg))
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// deleteReqGroupSamples forgets the peak memory usages, wall times and peak
+// disk usages learned for the given ReqGroups, returning how many of them had
+// any.
+func (db *db) deleteReqGroupSamples(reqGroups []string) (int, error) {
+	var deleted int
+	err := db.update(func(tx *bolt.Tx) error {
+		for _, rg := range reqGroups {
+			prefix := []byte(rg + dbDelimiter)
+			existed := false
+			for _, bucket := range [][]byte{bucketJobMBs, bucketJobSecs, bucketJobDisk} {
+				c := tx.Bucket(bucket).Cursor()
+				for k, _ := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+					err := c.Delete()
+					if err != nil {
+						return err
+					}
+					existed = true
+				}
+			}
+			if existed {
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// retrieveReqGroupOverride returns the override for the given ReqGroup, or nil
+// if there isn't one.
+func (db *db) retrieveReqGroupOverride(reqGroup string) *ReqGroupProfile {
+	encoded := db.retrieve(bucketReqGroupOverrides, reqGroup)
+	if encoded == nil {
+		return nil
+	}
+	p := &ReqGroupProfile{}
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	err := dec.Decode(p)
+	if err != nil {
+		db.Warn("Undecodable ReqGroup override", "reqgroup", reqGroup, "err", err)
+		return nil
+	}
+	return p
+}
+
+// retrieveReqGroupProfiles returns a profile for every ReqGroup that we've
+// learned about or that has an override, sorted by ReqGroup.
+func (db *db) retrieveReqGroupProfiles() ([]*ReqGroupProfile, error) {
+	samples := make(map[string]int)
+	var order []string
+	err := db.view(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketJobMBs).ForEach(func(k, v []byte) error {
+			i := bytes.LastIndex(k, []byte(dbDelimiter))
+			if i < 0 {
+				return nil
+			}
+			rg := string(k[:i])
+			if _, seen := samples[rg]; !seen {
+				order = append(order, rg)
+			}
+			samples[rg]++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucketReqGroupOverrides).ForEach(func(k, v []byte) error {
+			rg := string(k)
+			if _, seen := samples[rg]; !seen {
+				samples[rg] = 0
+				order = append(order, rg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(order)
+
+	profiles := make([]*ReqGroupProfile, 0, len(order))
+	for _, rg := range order {
+		p := db.retrieveReqGroupOverride(rg)
+		if p == nil {
+			mb, errr := db.recommendedReqGroupMemory(rg)
+			if errr != nil {
+				return nil, errr
+			}
+			secs, errr := db.recommendedReqGroupTime(rg)
+			if errr != nil {
+				return nil, errr
+			}
+			diskMB, errr := db.recommendedReqGroupDisk(rg)
+			if errr != nil {
+				return nil, errr
+			}
+			p = &ReqGroupProfile{ReqGroup: rg, RAM: mb, Time: time.Duration(secs) * time.Second, Disk: diskMB / 1024}
+		}
+		p.Samples = samples[rg]
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// recommendedReqs returns the recommended RAM, Time and Disk (which may be 0 if
+// unknown) for jobs in the given ReqGroup: the override set by an admin if
+// any, otherwise what we learned, or nil if we don't have learned
+// recommendations for both RAM and Time.
+func (s *Server) recommendedReqs(reqGroup string) *scheduler.Requirements {
+	if p := s.db.retrieveReqGroupOverride(reqGroup); p != nil {
+		return &scheduler.Requirements{RAM: p.RAM, Time: p.Time, Disk: p.Disk}
+	}
+	recm, errm := s.db.recommendedReqGroupMemory(reqGroup)
+	recs, errs := s.db.recommendedReqGroupTime(reqGroup)
+	if recm == 0 || recs == 0 || errm != nil || errs != nil {
+		return nil
+	}
+	recd, _ := s.db.recommendedReqGroupDisk(reqGroup)
+	return &scheduler.Requirements{RAM: recm, Time: time.Duration(recs) * time.Second, Disk: recd / 1024}
+}
+
+// GetReqGroupProfiles returns the recommended memory, time and disk for every
+// ReqGroup the server has learned about or has an override for. The result
+// is suitable for later passing to SetReqGroupProfiles(), eg. of a different
+// server, to seed it with known-good resource requirements.
+func (c *Client) GetReqGroupProfiles() ([]*ReqGroupProfile, error) {
+	resp, err := c.request(&clientRequest{Method: "getreqprofiles"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ReqProfiles, err
+}
+
+// SetReqGroupProfiles stores the RAM, Time and Disk (which is optional) of the
+// given profiles as overrides of what the server learns for their ReqGroups.
+// Jobs with an Override of 0 or 1 will have their Requirements adjusted using
+// these values instead of learned ones, until DeleteReqGroupProfiles() is used.
+// The Samples and Override properties of the profiles are ignored.
+func (c *Client) SetReqGroupProfiles(profiles []*ReqGroupProfile) error {
+	for _, p := range profiles {
+		if p.ReqGroup == "" || strings.Contains(p.ReqGroup, dbDelimiter) || p.RAM <= 0 || p.Time <= 0 || p.Disk < 0 {
+			return Error{"SetReqGroupProfiles", p.ReqGroup, ErrBadRequest}
+		}
+	}
+	_, err := c.request(&clientRequest{Method: "setreqprofiles", ReqProfiles: profiles})
+	return err
+}
+
+// DeleteReqGroupProfiles removes the overrides for the given ReqGroups, so that
+// learned values are used for them again. It returns the number of overrides
+// that were removed.
+func (c *Client) DeleteReqGroupProfiles(reqGroups []string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "delreqprofiles", Keys: reqGroups})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
+
+// ResetReqGroupProfiles makes the server forget everything it has learned
+// about the given ReqGroups from previously run Jobs (and from
+// AddReqGroupSamples()), eg. after the software they run was changed to need
+// very different resources. Overrides are not affected. It returns the number
+// of ReqGroups that had learned values.
+func (c *Client) ResetReqGroupProfiles(reqGroups []string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "resetreqprofiles", Keys: reqGroups})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
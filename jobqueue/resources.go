@@ -0,0 +1,182 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for parsing human-friendly resource values and
+// for checking that resource requirements are sane.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// The largest resource requirements we accept for a Job. Anything bigger is
+// almost certainly a mistake in units (eg. RAM given in KB instead of MB), and
+// would result in a Job that could never be scheduled.
+const (
+	MaxRAM   = 16 * 1024 * 1024 // MB, ie. 16TB
+	MaxTime  = 365 * 24 * time.Hour
+	MaxCores = 4096
+	MaxDisk  = 1024 * 1024 // GB, ie. 1PB
+)
+
+// memoryUnits maps the (lower-cased) units ParseMemory() accepts to their size
+// in MB.
+var memoryUnits = map[string]float64{
+	"b":   1.0 / (1024 * 1024),
+	"k":   1.0 / 1024,
+	"kb":  1.0 / 1024,
+	"ki":  1.0 / 1024,
+	"kib": 1.0 / 1024,
+	"m":   1,
+	"mb":  1,
+	"mi":  1,
+	"mib": 1,
+	"g":   1024,
+	"gb":  1024,
+	"gi":  1024,
+	"gib": 1024,
+	"t":   1024 * 1024,
+	"tb":  1024 * 1024,
+	"ti":  1024 * 1024,
+	"tib": 1024 * 1024,
+}
+
+var (
+	memoryRegex   = regexp.MustCompile(`^(\d*\.?\d+)\s*([a-zA-Z]*)$`)
+	durationRegex = regexp.MustCompile(`(\d*\.?\d+)([a-zµ]+)`)
+)
+
+// ParseMemory parses a memory value consisting of a number and a unit, such as
+// "3.5G", "200M" or "1TB", returning it as a whole number of MB (rounded up).
+// Units are binary (1G is 1024M). A unit is required, and values below 1MB or
+// above MaxRAM are rejected.
+func ParseMemory(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	matches := memoryRegex.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("memory value (%s) should be a positive number followed by a unit, eg. 200M or 3.5G", value)
+	}
+	if matches[2] == "" {
+		return 0, fmt.Errorf("memory value (%s) needs a unit, eg. %sM or %sG", value, matches[1], matches[1])
+	}
+	multiplier, known := memoryUnits[strings.ToLower(matches[2])]
+	if !known {
+		return 0, fmt.Errorf("memory value (%s) has an unknown unit; use one of K, M, G or T", value)
+	}
+	num, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("memory value (%s) is not a number: %s", value, err)
+	}
+	mb := math.Ceil(num * multiplier)
+	if mb < 1 {
+		return 0, fmt.Errorf("memory value (%s) must be at least 1M", value)
+	}
+	if mb > MaxRAM {
+		return 0, fmt.Errorf("memory value (%s) is more than the maximum of %dM", value, MaxRAM)
+	}
+	return int(mb), nil
+}
+
+// ParseDuration parses a time value like time.ParseDuration() does, but also
+// accepts "d" (days) and "w" (weeks) units, so "2d4h" is 52 hours. Every number
+// must have a unit, and values of 0 or more than MaxTime are rejected.
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	indexes := durationRegex.FindAllStringSubmatchIndex(value, -1)
+	if len(indexes) == 0 || indexes[len(indexes)-1][1] != len(value) {
+		return 0, fmt.Errorf("time value (%s) should be positive numbers with units, eg. 30m or 2d4h", value)
+	}
+
+	var total time.Duration
+	end := 0
+	for _, index := range indexes {
+		if index[0] != end {
+			return 0, fmt.Errorf("time value (%s) should be positive numbers with units, eg. 30m or 2d4h", value)
+		}
+		end = index[1]
+		num, unit := value[index[2]:index[3]], value[index[4]:index[5]]
+
+		var d time.Duration
+		switch unit {
+		case "d", "w":
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, fmt.Errorf("time value (%s) is not valid: %s", value, err)
+			}
+			day := 24 * time.Hour
+			if unit == "w" {
+				day *= 7
+			}
+			d = time.Duration(n * float64(day))
+		default:
+			var err error
+			d, err = time.ParseDuration(num + unit)
+			if err != nil {
+				return 0, fmt.Errorf("time value (%s) is not valid: %s", value, err)
+			}
+		}
+		total += d
+		if total > MaxTime {
+			return 0, fmt.Errorf("time value (%s) is more than the maximum of %s", value, MaxTime)
+		}
+	}
+
+	if total <= 0 {
+		return 0, fmt.Errorf("time value (%s) must be more than 0", value)
+	}
+	return total, nil
+}
+
+// validateRequirements checks that the given Requirements are sane: none of
+// them may be negative or more than our Max* constants, and RAM and Time must
+// be set.
+func validateRequirements(req *scheduler.Requirements) error {
+	switch {
+	case req.RAM < 0 || req.Time < 0 || req.Cores < 0 || req.Disk < 0:
+		return fmt.Errorf("requirements can't be negative (%s)", req.Stringify())
+	case req.RAM == 0:
+		return fmt.Errorf("a RAM requirement of at least 1MB is needed")
+	case req.Time == 0:
+		return fmt.Errorf("a time requirement of more than 0 is needed")
+	}
+	return validateRequirementMaximums(req.RAM, req.Time, req.Cores, req.Disk)
+}
+
+// validateRequirementMaximums checks that none of the given values are more
+// than our Max* constants.
+func validateRequirementMaximums(ram int, t time.Duration, cores, disk int) error {
+	switch {
+	case ram > MaxRAM:
+		return fmt.Errorf("a RAM requirement of %dMB is more than the maximum of %dMB", ram, MaxRAM)
+	case t > MaxTime:
+		return fmt.Errorf("a time requirement of %s is more than the maximum of %s", t, MaxTime)
+	case cores > MaxCores:
+		return fmt.Errorf("a cores requirement of %d is more than the maximum of %d", cores, MaxCores)
+	case disk > MaxDisk:
+		return fmt.Errorf("a disk requirement of %dGB is more than the maximum of %dGB", disk, MaxDisk)
+	}
+	return nil
+}
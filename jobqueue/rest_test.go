@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -79,6 +80,7 @@ func TestREST(t *testing.T) {
 	uploadEndPoint := baseURL + "/rest/v1/upload"
 	warningsEndPoint := baseURL + "/rest/v1/warnings/"
 	serversEndPoint := baseURL + "/rest/v1/servers/"
+	debugEndPoint := baseURL + "/rest/v1/debug/"
 
 	setDomainIP(config.ManagerCertDomain)
 
@@ -140,7 +142,7 @@ func TestREST(t *testing.T) {
 			responseData, err := ioutil.ReadAll(response.Body)
 			So(err, ShouldBeNil)
 
-			var jstati []jstatus
+			var jstati []JobStatus
 			err = json.Unmarshal(responseData, &jstati)
 			So(err, ShouldBeNil)
 			So(len(jstati), ShouldEqual, 0)
@@ -164,7 +166,7 @@ func TestREST(t *testing.T) {
 			So(err, ShouldBeNil)
 			responseData, err := ioutil.ReadAll(response.Body)
 			So(err, ShouldBeNil)
-			var jstati []jstatus
+			var jstati []JobStatus
 			err = json.Unmarshal(responseData, &jstati)
 			So(err, ShouldBeNil)
 			So(len(jstati), ShouldEqual, 3)
@@ -196,7 +198,7 @@ func TestREST(t *testing.T) {
 				responseData, err := ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var jstati []jstatus
+				var jstati []JobStatus
 				err = json.Unmarshal(responseData, &jstati)
 				So(err, ShouldBeNil)
 				So(len(jstati), ShouldEqual, 3)
@@ -211,7 +213,7 @@ func TestREST(t *testing.T) {
 				responseData, err := ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var jstati []jstatus
+				var jstati []JobStatus
 				err = json.Unmarshal(responseData, &jstati)
 				So(err, ShouldBeNil)
 				So(len(jstati), ShouldEqual, 1)
@@ -225,7 +227,7 @@ func TestREST(t *testing.T) {
 				responseData, err = ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var jstati2 []jstatus
+				var jstati2 []JobStatus
 				err = json.Unmarshal(responseData, &jstati2)
 				So(err, ShouldBeNil)
 				So(len(jstati2), ShouldEqual, 2)
@@ -242,7 +244,7 @@ func TestREST(t *testing.T) {
 				responseData, err := ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var jstati []jstatus
+				var jstati []JobStatus
 				err = json.Unmarshal(responseData, &jstati)
 				So(err, ShouldBeNil)
 				So(len(jstati), ShouldEqual, 2)
@@ -261,7 +263,7 @@ func TestREST(t *testing.T) {
 					responseData, err := ioutil.ReadAll(response.Body)
 					So(err, ShouldBeNil)
 
-					var jstati []jstatus
+					var jstati []JobStatus
 					err = json.Unmarshal(responseData, &jstati)
 					So(err, ShouldBeNil)
 					So(len(jstati), ShouldEqual, 1)
@@ -300,7 +302,7 @@ func TestREST(t *testing.T) {
 					responseData, err := ioutil.ReadAll(response.Body)
 					So(err, ShouldBeNil)
 
-					var jstati []jstatus
+					var jstati []JobStatus
 					err = json.Unmarshal(responseData, &jstati)
 					So(err, ShouldBeNil)
 					So(len(jstati), ShouldEqual, 2)
@@ -318,7 +320,7 @@ func TestREST(t *testing.T) {
 					responseData, err = ioutil.ReadAll(response.Body)
 					So(err, ShouldBeNil)
 
-					var jstati2 []jstatus
+					var jstati2 []JobStatus
 					err = json.Unmarshal(responseData, &jstati2)
 					So(err, ShouldBeNil)
 					So(len(jstati2), ShouldEqual, 1)
@@ -336,7 +338,7 @@ func TestREST(t *testing.T) {
 					responseData, err = ioutil.ReadAll(response.Body)
 					So(err, ShouldBeNil)
 
-					var jstati3 []jstatus
+					var jstati3 []JobStatus
 					err = json.Unmarshal(responseData, &jstati3)
 					So(err, ShouldBeNil)
 					So(len(jstati3), ShouldEqual, 1)
@@ -356,7 +358,7 @@ func TestREST(t *testing.T) {
 					responseData, err := ioutil.ReadAll(response.Body)
 					So(err, ShouldBeNil)
 
-					var jstati []jstatus
+					var jstati []JobStatus
 					err = json.Unmarshal(responseData, &jstati)
 					So(err, ShouldBeNil)
 					So(len(jstati), ShouldEqual, 1)
@@ -379,7 +381,7 @@ func TestREST(t *testing.T) {
 			So(err, ShouldBeNil)
 			responseData, err := ioutil.ReadAll(response.Body)
 			So(err, ShouldBeNil)
-			var jstati []jstatus
+			var jstati []JobStatus
 			err = json.Unmarshal(responseData, &jstati)
 			So(err, ShouldBeNil)
 			So(len(jstati), ShouldEqual, 1)
@@ -400,7 +402,7 @@ func TestREST(t *testing.T) {
 				responseData, err := ioutil.ReadAll(response.Body)
 				So(err, ShouldBeNil)
 
-				var jstati []jstatus
+				var jstati []JobStatus
 				err = json.Unmarshal(responseData, &jstati)
 				So(err, ShouldBeNil)
 				So(len(jstati), ShouldEqual, 1)
@@ -409,6 +411,27 @@ func TestREST(t *testing.T) {
 			})
 		})
 
+		Convey("You can POST to add a job with a cloud_scratch to the queue", func() {
+			var inputJobs []*JobViaJSON
+			inputJobs = append(inputJobs, &JobViaJSON{Cmd: "echo 1 && true", RepGrp: "rp1", CloudScratch: 50})
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := ioutil.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstati []JobStatus
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].OtherRequests, ShouldResemble, []string{"cloud_scratch:50"})
+		})
+
 		Convey("You must supply certain properties when adding jobs", func() {
 			inputJobs := []*JobViaJSON{{RepGrp: "foo"}}
 			jsonValue, err := json.Marshal(inputJobs)
@@ -440,7 +463,7 @@ func TestREST(t *testing.T) {
 			So(err, ShouldBeNil)
 			responseData, err := ioutil.ReadAll(response.Body)
 			So(err, ShouldBeNil)
-			var jstati []jstatus
+			var jstati []JobStatus
 			err = json.Unmarshal(responseData, &jstati)
 			So(err, ShouldBeNil)
 			So(len(jstati), ShouldEqual, 1)
@@ -674,6 +697,150 @@ func TestREST(t *testing.T) {
 			})
 		})
 
+		Convey("You can GET the internals of the queue with the admin token", func() {
+			getDebug := func(query, auth string) (*DebugInfo, int) {
+				req, err := http.NewRequest(http.MethodGet, debugEndPoint+query, nil)
+				So(err, ShouldBeNil)
+				if auth != "" {
+					req.Header.Add("Authorization", auth)
+				}
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				defer response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					return nil, response.StatusCode
+				}
+				di := &DebugInfo{}
+				err = json.NewDecoder(response.Body).Decode(di)
+				So(err, ShouldBeNil)
+				return di, response.StatusCode
+			}
+
+			_, status := getDebug("", "")
+			So(status, ShouldEqual, http.StatusUnauthorized)
+			_, status = getDebug("", "Bearer "+string(server.ReadOnlyToken()))
+			So(status, ShouldEqual, http.StatusForbidden)
+			_, status = getDebug("?timers=many", bearer)
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer jq.Disconnect()
+			req := &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1}
+			jobs := []*Job{
+				{Cmd: "echo debug1", Cwd: "/tmp", RepGroup: "debug", Requirements: req, DepGroups: []string{"debug1"}},
+				{Cmd: "echo debug2", Cwd: "/tmp", RepGroup: "debug", Requirements: req, Dependencies: Dependencies{NewDepGroupDependency("debug1")}},
+			}
+			_, _, err = jq.Add(jobs, os.Environ(), true)
+			So(err, ShouldBeNil)
+
+			di, status := getDebug("?timers=1", bearer)
+			So(status, ShouldEqual, http.StatusOK)
+			So(di.Queue.Items, ShouldEqual, 2)
+			So(di.Queue.Ready, ShouldEqual, 1)
+			So(di.Queue.Dependant, ShouldEqual, 1)
+			So(di.Queue.Dependencies, ShouldEqual, 1)
+			So(len(di.Queue.ReadyGroups), ShouldEqual, 1)
+			So(di.Queue.NextTTRs, ShouldBeEmpty)
+		})
+
+		Convey("A Mirror serves a read-only copy of the jobs", func() {
+			ln, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			_, mirrorPort, err := net.SplitHostPort(ln.Addr().String())
+			So(err, ShouldBeNil)
+			err = ln.Close()
+			So(err, ShouldBeNil)
+
+			roToken := server.ReadOnlyToken()
+			mirror, err := StartMirror(MirrorConfig{
+				Primary:    addr,
+				CAFile:     config.ManagerCAFile,
+				CertDomain: config.ManagerCertDomain,
+				Token:      roToken,
+				Timeout:    clientConnectTime,
+				WebPort:    mirrorPort,
+				CertFile:   config.ManagerCertFile,
+				KeyFile:    config.ManagerKeyFile,
+				Logger:     testLogger,
+			})
+			So(err, ShouldBeNil)
+			defer mirror.Stop()
+			mirrorJobsEndPoint := "https://" + config.ManagerCertDomain + ":" + mirrorPort + "/rest/v1/jobs/"
+
+			getMirrored := func(path, auth string) ([]JobStatus, int) {
+				req, errr := http.NewRequest(http.MethodGet, mirrorJobsEndPoint+path, nil)
+				So(errr, ShouldBeNil)
+				req.Header.Add("Authorization", auth)
+				response, errr := client.Do(req)
+				So(errr, ShouldBeNil)
+				defer response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					return nil, response.StatusCode
+				}
+				var jstati []JobStatus
+				errr = json.NewDecoder(response.Body).Decode(&jstati)
+				So(errr, ShouldBeNil)
+				return jstati, response.StatusCode
+			}
+			waitFor := func(path string, count int) []JobStatus {
+				limit := time.After(5 * time.Second)
+				for {
+					jstati, _ := getMirrored(path, "Bearer "+string(roToken))
+					if len(jstati) == count {
+						return jstati
+					}
+					select {
+					case <-limit:
+						return jstati
+					case <-time.After(20 * time.Millisecond):
+					}
+				}
+			}
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer jq.Disconnect()
+			req := &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1}
+			jobs := []*Job{
+				{Cmd: "echo mirror1", Cwd: "/tmp", RepGroup: "mirrored", Requirements: req},
+			}
+			_, _, err = jq.Add(jobs, os.Environ(), true)
+			So(err, ShouldBeNil)
+
+			jstati := waitFor("mirrored", 1)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Cmd, ShouldEqual, "echo mirror1")
+			So(jstati[0].State, ShouldEqual, JobStateReady)
+			So(mirror.Synced(), ShouldBeTrue)
+
+			// jobs added after we started get replicated by streaming
+			jobs = []*Job{
+				{Cmd: "echo mirror2", Cwd: "/tmp", RepGroup: "mirrored", Requirements: req},
+			}
+			_, _, err = jq.Add(jobs, os.Environ(), true)
+			So(err, ShouldBeNil)
+			jstati = waitFor("", 2)
+			So(len(jstati), ShouldEqual, 2)
+
+			deleted, err := jq.Delete([]*JobEssence{{Cmd: "echo mirror1", Cwd: "/tmp"}})
+			So(err, ShouldBeNil)
+			So(deleted, ShouldEqual, 1)
+			jstati = waitFor("mirrored", 1)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].Cmd, ShouldEqual, "echo mirror2")
+
+			_, status := getMirrored("", "Bearer wrong")
+			So(status, ShouldEqual, http.StatusUnauthorized)
+
+			postReq, err := http.NewRequest(http.MethodPost, mirrorJobsEndPoint, bytes.NewReader([]byte("[]")))
+			So(err, ShouldBeNil)
+			postReq.Header.Add("Authorization", "Bearer "+string(roToken))
+			response, err := client.Do(postReq)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
 		Reset(func() {
 			server.Stop(true)
 		})
@@ -0,0 +1,208 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for controlling how long a failed Job waits
+// before its Cmd is retried.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// retryBackoff* are the possible values of RetryDelay.Backoff.
+const (
+	retryBackoffFixed       = "fixed"
+	retryBackoffExponential = "exponential"
+)
+
+// retryDefaultMax is the most an exponential RetryDelay will wait if no Max
+// was specified.
+const retryDefaultMax = 24 * time.Hour
+
+// RetryDelay struct is used for setting in a Job to control how long after
+// its Cmd fails it will be retried (if it has Retries remaining). Unset values
+// mean a fixed delay of ClientReleaseDelay.
+type RetryDelay struct {
+	// Delay is how long to wait before the first retry, eg. "5m". Defaults to
+	// ClientReleaseDelay.
+	Delay string `json:"delay,omitempty"`
+
+	// Backoff is "fixed" (the default), to wait Delay before every retry, or
+	// "exponential", to double the wait after each failure.
+	Backoff string `json:"backoff,omitempty"`
+
+	// Max is the longest an exponential Backoff will wait, eg. "2h". Defaults
+	// to 24h.
+	Max string `json:"max,omitempty"`
+
+	// Window restricts retries to starting within a daily window of local
+	// (server) time, eg. "22:00-06:00", for when a service your Cmd uses is
+	// only available (or only quiet) at certain times of day.
+	Window string `json:"window,omitempty"`
+}
+
+// ParseRetryDelay takes a comma separated list of key=value pairs, where keys
+// correspond to the json properties of a RetryDelay, eg.
+// "delay=1m,backoff=exponential,max=1h", and returns a validated RetryDelay.
+func ParseRetryDelay(retryDelay string) (RetryDelay, error) {
+	var rd RetryDelay
+	if retryDelay == "" {
+		return rd, nil
+	}
+	for _, pair := range strings.Split(retryDelay, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return rd, fmt.Errorf("retry delay [%s] is not in key=value format", pair)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "delay":
+			rd.Delay = kv[1]
+		case "backoff":
+			rd.Backoff = kv[1]
+		case "max":
+			rd.Max = kv[1]
+		case "window":
+			rd.Window = kv[1]
+		default:
+			return rd, fmt.Errorf("retry delay [%s] is not a known setting", kv[0])
+		}
+	}
+	return rd, rd.Validate()
+}
+
+// IsSet tells you if any of the settings have been specified.
+func (rd RetryDelay) IsSet() bool {
+	return rd.Delay != "" || rd.Backoff != "" || rd.Max != "" || rd.Window != ""
+}
+
+// Validate checks that all the specified settings are parsable, returning an
+// error describing the first one that isn't.
+func (rd RetryDelay) Validate() error {
+	if rd.Delay != "" {
+		if _, err := time.ParseDuration(rd.Delay); err != nil {
+			return fmt.Errorf("retry delay [%s] is invalid: %s", rd.Delay, err)
+		}
+	}
+	switch rd.Backoff {
+	case "", retryBackoffFixed, retryBackoffExponential:
+	default:
+		return fmt.Errorf("retry backoff [%s] is not one of %s or %s", rd.Backoff, retryBackoffFixed, retryBackoffExponential)
+	}
+	if rd.Max != "" {
+		if _, err := time.ParseDuration(rd.Max); err != nil {
+			return fmt.Errorf("retry max [%s] is invalid: %s", rd.Max, err)
+		}
+	}
+	if rd.Window != "" {
+		if _, _, err := rd.window(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns a comma separated list of the key=value settings that have
+// been set, in the same format accepted by ParseRetryDelay().
+func (rd RetryDelay) String() string {
+	var set []string
+	if rd.Delay != "" {
+		set = append(set, "delay="+rd.Delay)
+	}
+	if rd.Backoff != "" {
+		set = append(set, "backoff="+rd.Backoff)
+	}
+	if rd.Max != "" {
+		set = append(set, "max="+rd.Max)
+	}
+	if rd.Window != "" {
+		set = append(set, "window="+rd.Window)
+	}
+	return strings.Join(set, ",")
+}
+
+// window parses our Window in to its start and end times of day.
+func (rd RetryDelay) window() (time.Time, time.Time, error) {
+	parts := strings.Split(rd.Window, "-")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("retry window [%s] is not in HH:MM-HH:MM format", rd.Window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("retry window [%s] is invalid: %s", rd.Window, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("retry window [%s] is invalid: %s", rd.Window, err)
+	}
+	return start, end, nil
+}
+
+// delayFor returns how long a Job that has now failed the given number of
+// times should wait before being retried, given that it is now the given time.
+// Assumes we Validate().
+func (rd RetryDelay) delayFor(failures int, now time.Time) time.Duration {
+	delay := ClientReleaseDelay
+	if rd.Delay != "" {
+		delay, _ = time.ParseDuration(rd.Delay)
+	}
+
+	if rd.Backoff == retryBackoffExponential {
+		max := retryDefaultMax
+		if rd.Max != "" {
+			max, _ = time.ParseDuration(rd.Max)
+		}
+		for i := 1; i < failures && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+	}
+
+	if rd.Window == "" {
+		return delay
+	}
+	start, end, err := rd.window()
+	if err != nil {
+		return delay
+	}
+	retry := now.Add(delay)
+	if inTimeWindow(retry, start, end) {
+		return delay
+	}
+	next := time.Date(retry.Year(), retry.Month(), retry.Day(), start.Hour(), start.Minute(), 0, 0, retry.Location())
+	if next.Before(retry) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now)
+}
+
+// inTimeWindow tells you if the time of day of t is within the window between
+// the times of day of start and end, where the window may span midnight.
+func inTimeWindow(t, start, end time.Time) bool {
+	mins := t.Hour()*60 + t.Minute()
+	startMins := start.Hour()*60 + start.Minute()
+	endMins := end.Hour()*60 + end.Minute()
+	if startMins <= endMins {
+		return mins >= startMins && mins < endMins
+	}
+	return mins >= startMins || mins < endMins
+}
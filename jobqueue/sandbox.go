@@ -0,0 +1,254 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for controlling when the unique working
+// directories and TMPDIRs of Jobs get deleted.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sandboxDelete* are the possible values of SandboxPolicy.Delete.
+const (
+	sandboxDeleteAlways  = "always"
+	sandboxDeleteSuccess = "success"
+)
+
+// SandboxPolicy struct is used for setting in a Job to control what happens to
+// the unique working directory and TMPDIR created for its Cmd when CwdMatters
+// is false (its "sandbox"). Unset values mean the TMPDIR is deleted once Cmd
+// exits, and the working directory is left for any "cleanup" Behaviours to
+// deal with.
+type SandboxPolicy struct {
+	// Delete is "always", to delete the whole sandbox as soon as Cmd exits, or
+	// "success", to do that only if Cmd succeeded, keeping the sandbox
+	// (including TMPDIR) of failed Cmds so you can investigate.
+	Delete string `json:"delete,omitempty"`
+
+	// Keep is how long any sandbox that isn't deleted when Cmd exits should be
+	// kept for, eg. "3d" or "12h", after which the manager will have the next
+	// runner on the same host delete it. By default kept sandboxes are never
+	// deleted.
+	Keep string `json:"keep,omitempty"`
+}
+
+// ParseSandboxPolicy takes a comma separated list of key=value pairs, where
+// keys correspond to the json properties of a SandboxPolicy, eg.
+// "delete=success,keep=3d", and returns a validated SandboxPolicy.
+func ParseSandboxPolicy(policy string) (SandboxPolicy, error) {
+	var sp SandboxPolicy
+	if policy == "" {
+		return sp, nil
+	}
+	for _, pair := range strings.Split(policy, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return sp, fmt.Errorf("sandbox policy [%s] is not in key=value format", pair)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "delete":
+			sp.Delete = kv[1]
+		case "keep":
+			sp.Keep = kv[1]
+		default:
+			return sp, fmt.Errorf("sandbox policy [%s] is not a known setting", kv[0])
+		}
+	}
+	return sp, sp.Validate()
+}
+
+// IsSet tells you if any of the settings have been specified.
+func (sp SandboxPolicy) IsSet() bool {
+	return sp.Delete != "" || sp.Keep != ""
+}
+
+// Validate checks that all the specified settings are parsable, returning an
+// error describing the first one that isn't.
+func (sp SandboxPolicy) Validate() error {
+	switch sp.Delete {
+	case "", sandboxDeleteAlways, sandboxDeleteSuccess:
+	default:
+		return fmt.Errorf("sandbox delete [%s] is not one of %s or %s", sp.Delete, sandboxDeleteAlways, sandboxDeleteSuccess)
+	}
+	if sp.Keep != "" {
+		if _, err := sp.keepFor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns a comma separated list of the key=value settings that have
+// been set, in the same format accepted by ParseSandboxPolicy().
+func (sp SandboxPolicy) String() string {
+	var set []string
+	if sp.Delete != "" {
+		set = append(set, "delete="+sp.Delete)
+	}
+	if sp.Keep != "" {
+		set = append(set, "keep="+sp.Keep)
+	}
+	return strings.Join(set, ",")
+}
+
+// keepFor parses Keep, which can be a number of days like "3d", or anything
+// time.ParseDuration() accepts. Returns 0 if Keep isn't set.
+func (sp SandboxPolicy) keepFor() (time.Duration, error) {
+	if sp.Keep == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(sp.Keep, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(sp.Keep, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(sp.Keep)
+	}
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sandbox keep [%s] is invalid: %s", sp.Keep, err)
+	}
+	return d, nil
+}
+
+// deleteAll tells you if the whole sandbox should be deleted once Cmd exits,
+// given whether it succeeded or not.
+func (sp SandboxPolicy) deleteAll(succeeded bool) bool {
+	return sp.Delete == sandboxDeleteAlways || (sp.Delete == sandboxDeleteSuccess && succeeded)
+}
+
+// keepTmp tells you if the TMPDIR should be kept once Cmd exits, given whether
+// it succeeded or not.
+func (sp SandboxPolicy) keepTmp(succeeded bool) bool {
+	return sp.Delete == sandboxDeleteSuccess && !succeeded
+}
+
+// keptSandbox is a sandbox on some host that should be deleted once it
+// expires.
+type keptSandbox struct {
+	dir     string
+	expires time.Time
+}
+
+// keptSandboxes tracks the sandboxes on each host that Jobs' SandboxPolicy
+// said should be kept for a while.
+type keptSandboxes struct {
+	sync.Mutex
+	hosts map[string][]keptSandbox
+}
+
+// keep records that the sandbox of the given Job, which just exited on the
+// given host, should be deleted after its SandboxPolicy.Keep duration.
+func (ks *keptSandboxes) keep(job *Job, jes *JobEndState) {
+	if jes == nil || jes.KeptSandbox == "" {
+		return
+	}
+	job.RLock()
+	host := job.Host
+	keep, err := job.SandboxPolicy.keepFor()
+	job.RUnlock()
+	if err != nil || keep == 0 || host == "" {
+		return
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	ks.hosts[host] = append(ks.hosts[host], keptSandbox{dir: jes.KeptSandbox, expires: time.Now().Add(keep)})
+}
+
+// expired returns the sandboxes on the given host that should now be deleted,
+// forgetting about them.
+func (ks *keptSandboxes) expired(host string) []string {
+	ks.Lock()
+	defer ks.Unlock()
+	now := time.Now()
+	var dirs []string
+	var remaining []keptSandbox
+	for _, kept := range ks.hosts[host] {
+		if now.After(kept.expires) {
+			dirs = append(dirs, kept.dir)
+		} else {
+			remaining = append(remaining, kept)
+		}
+	}
+	if len(remaining) > 0 {
+		ks.hosts[host] = remaining
+	} else {
+		delete(ks.hosts, host)
+	}
+	return dirs
+}
+
+// removeSandbox deletes the given sandbox directory (the parent of a Job's
+// ActualCwd), along with any empty parent directories up to the hashed
+// directory base it was created in.
+func removeSandbox(dir string) error {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	base := dir
+	for filepath.Base(base) != AppName+"_cwd" {
+		parent := filepath.Dir(base)
+		if parent == base {
+			// not a hashed dir at all; don't go deleting any parents
+			return nil
+		}
+		base = parent
+	}
+	return rmEmptyDirs(dir, base)
+}
+
+// ReapSandboxes asks the server which of the sandboxes that were kept on this
+// host (due to the Jobs' SandboxPolicy) have expired, and deletes them.
+// Runners call this, so kept sandboxes get deleted as long as runners continue
+// to be run on the host. Returns the number of sandboxes deleted.
+func (c *Client) ReapSandboxes() (int, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	resp, err := c.request(&clientRequest{Method: "reapsandboxes", Host: host})
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	var errs []string
+	for _, dir := range resp.Names {
+		if errr := removeSandbox(dir); errr != nil {
+			errs = append(errs, errr.Error())
+			continue
+		}
+		reaped++
+	}
+	if len(errs) > 0 {
+		return reaped, fmt.Errorf("failed to delete some expired sandboxes: %s", strings.Join(errs, "; "))
+	}
+	return reaped, nil
+}
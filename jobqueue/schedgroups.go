@@ -0,0 +1,192 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for working out which scheduler groups ready
+// jobs belong in, efficiently even when there are very many ready jobs.
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// reqSignature is a comparable summary of the properties of a Job that
+// determine its schedulerGroup (ignoring IdealCores and IdealRAM, which are
+// negotiated per job), so that the work of calculating the schedulerGroup
+// only has to be done once for all jobs with the same signature.
+type reqSignature struct {
+	reqGroup string
+	override uint8
+	ram      int
+	time     time.Duration
+	cores    int
+	disk     int
+	arch     string
+	other    string
+}
+
+// newReqSignature returns the reqSignature of the given job.
+func newReqSignature(job *Job) reqSignature {
+	job.RLock()
+	defer job.RUnlock()
+	sig := reqSignature{
+		reqGroup: job.ReqGroup,
+		override: job.Override,
+		ram:      job.Requirements.RAM,
+		time:     job.Requirements.Time,
+		cores:    job.Requirements.Cores,
+		disk:     job.Requirements.Disk,
+		arch:     job.Requirements.Arch,
+	}
+	if len(job.Requirements.Other) > 0 {
+		others := make([]string, 0, len(job.Requirements.Other))
+		for key, val := range job.Requirements.Other {
+			others = append(others, key+"="+val)
+		}
+		sort.Strings(others)
+		sig.other = strings.Join(others, "\x00")
+	}
+	return sig
+}
+
+// schedGroupInfo holds what we worked out for the first job we saw with a
+// given reqSignature.
+type schedGroupInfo struct {
+	recommended bool
+	ram         int
+	time        time.Duration
+	disk        int
+	noRec       bool
+	req         *scheduler.Requirements
+}
+
+// readyGrouper works out the schedulerGroups of ready jobs, indexing what it
+// works out by reqSignature so that the expensive parts (getting resource
+// recommendations and stringifying requirements) are only done once per
+// distinct signature, instead of once per job.
+type readyGrouper struct {
+	recommend func(reqGroup string) *scheduler.Requirements
+	recs      map[string]*scheduler.Requirements
+	sigs      map[reqSignature]*schedGroupInfo
+	strs      map[*scheduler.Requirements]string
+}
+
+// newReadyGrouper creates a readyGrouper that will use the given function to
+// get the recommended RAM and Time of jobs in a given ReqGroup (which should
+// return nil if there is no recommendation).
+func newReadyGrouper(recommend func(reqGroup string) *scheduler.Requirements) *readyGrouper {
+	return &readyGrouper{
+		recommend: recommend,
+		recs:      make(map[string]*scheduler.Requirements),
+		sigs:      make(map[reqSignature]*schedGroupInfo),
+		strs:      make(map[*scheduler.Requirements]string),
+	}
+}
+
+// group applies any resource recommendation to the given job's Requirements,
+// and returns the Requirements that should be used to schedule it, and whether
+// no recommendation was available. The schedulerGroup of the returned
+// Requirements is then cheaply available from stringify().
+func (rg *readyGrouper) group(job *Job) (*scheduler.Requirements, bool) {
+	sig := newReqSignature(job)
+	info, seen := rg.sigs[sig]
+	if seen {
+		if info.recommended {
+			job.Lock()
+			job.Requirements.RAM = info.ram
+			job.Requirements.Time = info.time
+			job.Requirements.Disk = info.disk
+			job.Unlock()
+		}
+		return info.req, info.noRec
+	}
+
+	// depending on job.Override, get memory and time recommendations, which
+	// are rounded to get fewer larger groups. Disk recommendations only ever
+	// increase the disk requirement, since we only learn the disk usage of
+	// jobs that don't use their own Cwd
+	info = &schedGroupInfo{}
+	if sig.override != 2 {
+		recommendedReq, existed := rg.recs[sig.reqGroup]
+		if !existed {
+			recommendedReq = rg.recommend(sig.reqGroup)
+			rg.recs[sig.reqGroup] = recommendedReq
+		}
+
+		if recommendedReq != nil {
+			job.Lock()
+			if sig.override == 1 {
+				if recommendedReq.RAM > job.Requirements.RAM {
+					job.Requirements.RAM = recommendedReq.RAM
+				}
+				if recommendedReq.Time > job.Requirements.Time {
+					job.Requirements.Time = recommendedReq.Time
+				}
+			} else {
+				job.Requirements.RAM = recommendedReq.RAM
+				job.Requirements.Time = recommendedReq.Time
+			}
+			if recommendedReq.Disk > job.Requirements.Disk {
+				job.Requirements.Disk = recommendedReq.Disk
+			}
+			info.recommended = true
+			info.ram = job.Requirements.RAM
+			info.time = job.Requirements.Time
+			info.disk = job.Requirements.Disk
+			job.Unlock()
+		} else {
+			info.noRec = true
+		}
+	}
+
+	job.RLock()
+	if job.Requirements.RAM < 924 {
+		// our req will be like the jobs but with memory + 100 to allow some
+		// leeway in case the job scheduler calculates used memory
+		// differently, and for other memory usage vagaries
+		info.req = &scheduler.Requirements{
+			RAM:   job.Requirements.RAM + 100,
+			Time:  job.Requirements.Time,
+			Cores: job.Requirements.Cores,
+			Disk:  job.Requirements.Disk,
+			Arch:  job.Requirements.Arch,
+			Other: job.Requirements.Other,
+		}
+	} else {
+		info.req = job.Requirements
+	}
+	job.RUnlock()
+
+	rg.sigs[sig] = info
+	return info.req, info.noRec
+}
+
+// stringify is like req.Stringify(), but remembers the result for each
+// Requirements it is given, since many jobs share the same Requirements.
+func (rg *readyGrouper) stringify(req *scheduler.Requirements) string {
+	if str, done := rg.strs[req]; done {
+		return str
+	}
+	str := req.Stringify()
+	rg.strs[req] = str
+	return str
+}
@@ -0,0 +1,152 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the code for templating the scripts that cloud schedulers
+// run on the servers they spawn, and for reporting on those servers.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+)
+
+// scriptVarsOther is the Requirements.Other key for the comma separated
+// key=value pairs made available to post creation script templates as .Vars.
+const scriptVarsOther = "cloud_script_vars"
+
+// ScriptData is what post creation scripts that are templates (ie. contain
+// "{{") are executed with, so that the script can vary by the server it is run
+// on or by the cmds that will run there, eg.
+// "{{if gt .RAM 64000}}sysctl vm.swappiness=1{{end}}" or
+// "yum install -y {{.Vars.packages}}".
+type ScriptData struct {
+	Flavor string            // name of the server's flavor
+	Cores  int               // number of cores the flavor has
+	RAM    int               // MB of memory the flavor has
+	Disk   int               // GB of disk the flavor has
+	OS     string            // name prefix of the server's OS image
+	Vars   map[string]string // from Requirements.Other["cloud_script_vars"]
+}
+
+// ScriptVersion returns a short identifier of the content of the given script,
+// so that you can tell which version of a script a server was created with.
+// Returns an empty string for an empty script.
+func ScriptVersion(script []byte) string {
+	if len(script) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(script))[:12]
+}
+
+// renderScript executes the given script as a template with the given data, if
+// it is a template. Otherwise returns the script unchanged.
+func renderScript(script []byte, data *ScriptData) ([]byte, error) {
+	if !bytes.Contains(script, []byte("{{")) {
+		return script, nil
+	}
+	tmpl, err := template.New("script").Option("missingkey=zero").Parse(string(script))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	return rendered.Bytes(), err
+}
+
+// parseScriptVars parses a Requirements.Other["cloud_script_vars"] value, which
+// is a comma separated list of key=value pairs.
+func parseScriptVars(value string) map[string]string {
+	vars := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) != "" {
+			vars[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return vars
+}
+
+// flavorScript returns the script from the given regex => script map whose
+// regex matches the given flavor name, trying regexes in sorted order. Returns
+// nil if none match.
+func flavorScript(scripts map[string][]byte, flavorName string) []byte {
+	regexes := make([]string, 0, len(scripts))
+	for regex := range scripts {
+		regexes = append(regexes, regex)
+	}
+	sort.Strings(regexes)
+	for _, regex := range regexes {
+		if matched, err := regexp.MatchString(regex, flavorName); err == nil && matched {
+			return scripts[regex]
+		}
+	}
+	return nil
+}
+
+// CloudServer describes a server that a cloud scheduler spawned to run cmds
+// on.
+type CloudServer struct {
+	ID            string
+	Name          string
+	IP            string
+	Flavor        string
+	OS            string
+	ScriptVersion string // ScriptVersion() of the post creation script it ran
+	Bad           bool
+}
+
+// cloudServers describes the servers we have spawned.
+func (s *opst) cloudServers() []*CloudServer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	css := make([]*CloudServer, 0, len(s.servers))
+	for _, server := range s.servers {
+		if server.ID == "" || server.Destroyed() {
+			continue
+		}
+		css = append(css, newCloudServer(server))
+	}
+	sort.Slice(css, func(i, j int) bool {
+		return css[i].Name < css[j].Name
+	})
+	return css
+}
+
+// newCloudServer creates a CloudServer describing the given server.
+func newCloudServer(server *cloud.Server) *CloudServer {
+	cs := &CloudServer{
+		ID:            server.ID,
+		Name:          server.Name,
+		IP:            server.IP,
+		OS:            server.OS,
+		ScriptVersion: ScriptVersion(server.Script),
+		Bad:           server.IsBad(),
+	}
+	if server.Flavor != nil {
+		cs.Flavor = server.Flavor.Name
+	}
+	return cs
+}
@@ -0,0 +1,288 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'external': running jobs
+// via a site-provided executable that speaks a simple JSON protocol, for
+// integrating with job schedulers we don't natively support.
+//
+// For each operation, the executable is run (via the configured shell) with a
+// single JSON object on STDIN, and must print a single JSON object on STDOUT
+// and exit 0. Requests look like:
+//
+//    {"protocol":1,"op":"schedule","deployment":"production",
+//     "name":"wrp_[32 hex chars]","cmd":"wr runner ...","count":3,
+//     "requirements":{"ram":1000,"time":3600,"cores":1,"disk":0,
+//     "arch":"x86_64","other":{"key":"val"}}}
+//
+// ram is in MB, time in seconds and disk in GB. The possible ops are:
+//
+// "init": sent once at start up. Respond with {"protocol":1} to confirm you
+// speak this version of the protocol.
+//
+// "schedule": ensure that exactly count instances of cmd (each needing the
+// given requirements) are queued or running in your job scheduler. If fewer,
+// submit more; if more, cancel some that haven't started running yet. count
+// can be 0. name is constant for the cmd, and you should use it to find the
+// instances you previously submitted for it. Respond with {}, or
+// {"impossible":true} if your job scheduler could never satisfy the
+// requirements.
+//
+// "busy": respond with {"busy":true} if any instances of any cmd you were
+// asked to schedule are still queued or running, otherwise {"busy":false}.
+// name will be a prefix of the names of all the cmds for this deployment.
+//
+// "max_queue_time": respond with {"max_queue_time":N}, where N is the most
+// seconds an instance needing the given requirements will be allowed to run
+// for, or 0 if unlimited.
+//
+// "terminate": sent when wr is shutting down; kill any remaining instances
+// whose names start with name, and respond with {}.
+//
+// Any response can instead be {"error":"message"} to indicate failure.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// ExternalProtocolVersion is the version of the JSON protocol that the
+// 'external' scheduler speaks to its executable.
+const ExternalProtocolVersion = 1
+
+// external is our implementer of scheduleri
+type external struct {
+	config  *ConfigExternal
+	cbmutex sync.RWMutex
+	msgCB   MessageCallBack
+	log15.Logger
+}
+
+// ConfigExternal represents the configuration options required by the
+// external scheduler. All are required with no usable defaults.
+type ConfigExternal struct {
+	// Executable is the command line of the site-provided executable that
+	// implements the protocol described in this package's external.go, eg.
+	// "/opt/site/wr_slurm.py".
+	Executable string
+
+	// deployment is one of "development" or "production".
+	Deployment string
+
+	// shell is the shell to use to run Executable; 'bash' is recommended.
+	Shell string
+}
+
+// externalRequirements is the form Requirements take in externalRequests.
+type externalRequirements struct {
+	RAM   int               `json:"ram"`
+	Time  int               `json:"time"`
+	Cores int               `json:"cores"`
+	Disk  int               `json:"disk"`
+	Arch  string            `json:"arch,omitempty"`
+	Other map[string]string `json:"other,omitempty"`
+}
+
+// externalRequest is what we send to the executable's STDIN.
+type externalRequest struct {
+	Protocol     int                   `json:"protocol"`
+	Op           string                `json:"op"`
+	Deployment   string                `json:"deployment"`
+	Name         string                `json:"name,omitempty"`
+	Cmd          string                `json:"cmd,omitempty"`
+	Count        int                   `json:"count"`
+	Requirements *externalRequirements `json:"requirements,omitempty"`
+}
+
+// externalResponse is what we expect to read from the executable's STDOUT.
+type externalResponse struct {
+	Protocol     int    `json:"protocol"`
+	Error        string `json:"error"`
+	Impossible   bool   `json:"impossible"`
+	Busy         bool   `json:"busy"`
+	MaxQueueTime int    `json:"max_queue_time"`
+}
+
+// initialize checks that the executable speaks our protocol.
+func (s *external) initialize(config interface{}, logger log15.Logger) error {
+	s.config = config.(*ConfigExternal)
+	s.Logger = logger.New("scheduler", "external")
+
+	if s.config.Executable == "" {
+		return Error{"external", "initialize", "no executable was configured"}
+	}
+
+	resp, err := s.call(&externalRequest{Op: "init"})
+	if err != nil {
+		return err
+	}
+	if resp.Protocol != ExternalProtocolVersion {
+		return Error{"external", "initialize", fmt.Sprintf("executable speaks protocol version %d, not %d", resp.Protocol, ExternalProtocolVersion)}
+	}
+	return nil
+}
+
+// call runs our executable with the given request, returning its response.
+func (s *external) call(req *externalRequest) (*externalResponse, error) {
+	req.Protocol = ExternalProtocolVersion
+	req.Deployment = s.config.Deployment
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, Error{"external", req.Op, fmt.Sprintf("failed to encode request: %s", err)}
+	}
+
+	cmd := exec.Command(s.config.Shell, "-c", s.config.Executable) // #nosec
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		msg := fmt.Sprintf("failed to run [%s]: %s", s.config.Executable, err)
+		if errmsg := strings.TrimSpace(stderr.String()); errmsg != "" {
+			msg += " (" + errmsg + ")"
+		}
+		s.notifyMessage("External scheduler: " + msg)
+		return nil, Error{"external", req.Op, msg}
+	}
+
+	resp := &externalResponse{}
+	err = json.Unmarshal(output, resp)
+	if err != nil {
+		return nil, Error{"external", req.Op, fmt.Sprintf("[%s] returned invalid output %q: %s", s.config.Executable, output, err)}
+	}
+	if resp.Error != "" {
+		s.notifyMessage("External scheduler: " + resp.Error)
+		return resp, Error{"external", req.Op, resp.Error}
+	}
+	return resp, nil
+}
+
+// externalReqs converts Requirements to the form our executable receives.
+func externalReqs(req *Requirements) *externalRequirements {
+	var arch string
+	if req.Arch != "" {
+		arch = NormaliseArch(req.Arch)
+	}
+	return &externalRequirements{
+		RAM:   req.RAM,
+		Time:  int(req.Time.Seconds()),
+		Cores: req.Cores,
+		Disk:  req.Disk,
+		Arch:  arch,
+		Other: req.Other,
+	}
+}
+
+// reserveTimeout achieves the aims of ReserveTimeout().
+func (s *external) reserveTimeout() int {
+	return defaultReserveTimeout
+}
+
+// maxQueueTime achieves the aims of MaxQueueTime().
+func (s *external) maxQueueTime(req *Requirements) time.Duration {
+	resp, err := s.call(&externalRequest{Op: "max_queue_time", Requirements: externalReqs(req)})
+	if err != nil {
+		s.Warn("maxQueueTime failed", "err", err)
+		return infiniteQueueTime
+	}
+	return time.Duration(resp.MaxQueueTime) * time.Second
+}
+
+// schedule achieves the aims of Schedule(), by asking our executable to make
+// it so.
+func (s *external) schedule(cmd string, req *Requirements, count int) error {
+	resp, err := s.call(&externalRequest{
+		Op:           "schedule",
+		Name:         jobName(cmd, s.config.Deployment, false),
+		Cmd:          cmd,
+		Count:        count,
+		Requirements: externalReqs(req),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Impossible {
+		return Error{"external", "schedule", ErrImpossible}
+	}
+	return nil
+}
+
+// busy asks our executable if any of the cmds we've scheduled are still queued
+// or running.
+func (s *external) busy() bool {
+	resp, err := s.call(&externalRequest{Op: "busy", Name: s.namePrefix()})
+	if err != nil {
+		// busy() doesn't return an error, so just assume we're busy
+		return true
+	}
+	return resp.Busy
+}
+
+// namePrefix returns the prefix of the names of all cmds we schedule for our
+// deployment.
+func (s *external) namePrefix() string {
+	return fmt.Sprintf("wr%s_", s.config.Deployment[0:1])
+}
+
+// negotiate always grants the minimum, since we don't know what our
+// executable's job scheduler has available.
+func (s *external) negotiate(min, ideal *Requirements) *Requirements {
+	granted := *min
+	return &granted
+}
+
+// hostToID always returns an empty string, since we're not in the cloud.
+func (s *external) hostToID(host string) string {
+	return ""
+}
+
+// setMessageCallBack sets the given callback.
+func (s *external) setMessageCallBack(cb MessageCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.msgCB = cb
+}
+
+// notifyMessage calls the message callback with the given message in a
+// goroutine, if that callback has been set.
+func (s *external) notifyMessage(msg string) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.msgCB != nil {
+		go s.msgCB(msg)
+	}
+}
+
+// setBadServerCallBack does nothing, since we're not a cloud-based scheduler.
+func (s *external) setBadServerCallBack(cb BadServerCallBack) {}
+
+// cleanup asks our executable to kill any remaining jobs we scheduled.
+func (s *external) cleanup() {
+	_, err := s.call(&externalRequest{Op: "terminate", Name: s.namePrefix()})
+	if err != nil {
+		s.Warn("cleanup terminate failed", "err", err)
+	}
+}
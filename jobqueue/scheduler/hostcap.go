@@ -0,0 +1,194 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the code for capping how many cmds run at once on a
+// host, for when a host's bottleneck is something like local disk or network
+// rather than its cores or memory.
+
+import (
+	"strconv"
+	"sync"
+)
+
+// MaxPerHostKey is the Requirements.Other key that lets you cap how many cmds
+// with those Requirements (ie. in the same scheduler group) may run at once on
+// any one host. Its value is a positive whole number. It works together with
+// the MaxJobsPerHost option of the scheduler configs, the lower of the two
+// applying.
+const MaxPerHostKey = "max_per_host"
+
+// localHost is the name we track the local machine under in hostJobs.
+const localHost = "localhost"
+
+// hostJobs tracks how many cmds we are running on each host, in total and per
+// scheduler group, so that we can cap how many run at once on a host
+// regardless of how many would fit given their resource requirements. A nil
+// *hostJobs imposes no caps.
+type hostJobs struct {
+	max     int
+	total   map[string]int
+	byGroup map[string]map[string]int
+	mutex   sync.Mutex
+}
+
+// newHostJobs returns a hostJobs that allows up to max cmds to run at once on
+// each host. max of 0 means there's no overall cap, though scheduler groups
+// can still have their own caps.
+func newHostJobs(max int) *hostJobs {
+	return &hostJobs{
+		max:     max,
+		total:   make(map[string]int),
+		byGroup: make(map[string]map[string]int),
+	}
+}
+
+// groupMax returns the MaxPerHostKey value of the given Requirements, or 0 if
+// not set (or invalid).
+func groupMax(req *Requirements) int {
+	val, defined := req.Other[MaxPerHostKey]
+	if !defined {
+		return 0
+	}
+	max, err := strconv.Atoi(val)
+	if err != nil || max < 0 {
+		return 0
+	}
+	return max
+}
+
+// fit returns count, or fewer if that many more cmds with the given
+// Requirements running on the given host would exceed our caps.
+func (h *hostJobs) fit(host string, req *Requirements, count int) int {
+	if h == nil || count <= 0 {
+		return count
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.max > 0 {
+		if space := h.max - h.total[host]; space < count {
+			count = space
+		}
+	}
+	if max := groupMax(req); max > 0 {
+		if space := max - h.byGroup[host][req.Stringify()]; space < count {
+			count = space
+		}
+	}
+	if count < 0 {
+		count = 0
+	}
+	return count
+}
+
+// fitNew is like fit(), but for a host that isn't running anything yet.
+func (h *hostJobs) fitNew(req *Requirements, count int) int {
+	if h == nil {
+		return count
+	}
+	if h.max > 0 && h.max < count {
+		count = h.max
+	}
+	if max := groupMax(req); max > 0 && max < count {
+		count = max
+	}
+	return count
+}
+
+// hasSpace tells you if another cmd with the given Requirements could run on
+// the given host without exceeding our caps.
+func (h *hostJobs) hasSpace(host string, req *Requirements) bool {
+	return h.fit(host, req, 1) == 1
+}
+
+// add records that count more cmds with the given Requirements are now running
+// on the given host.
+func (h *hostJobs) add(host string, req *Requirements, count int) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.total[host] += count
+	group := req.Stringify()
+	if h.byGroup[host] == nil {
+		h.byGroup[host] = make(map[string]int)
+	}
+	h.byGroup[host][group] += count
+}
+
+// remove records that a cmd with the given Requirements is no longer running
+// on the given host.
+func (h *hostJobs) remove(host string, req *Requirements) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.total[host]--
+	if h.total[host] <= 0 {
+		delete(h.total, host)
+	}
+	groups := h.byGroup[host]
+	if groups == nil {
+		return
+	}
+	group := req.Stringify()
+	groups[group]--
+	if groups[group] <= 0 {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(h.byGroup, host)
+		}
+	}
+}
+
+// move transfers everything recorded against one host to another, for when
+// cmds were allocated to a host that was yet to exist under a temporary name.
+func (h *hostJobs) move(from, to string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if count, exists := h.total[from]; exists {
+		h.total[to] += count
+		delete(h.total, from)
+	}
+	if groups, exists := h.byGroup[from]; exists {
+		if h.byGroup[to] == nil {
+			h.byGroup[to] = make(map[string]int)
+		}
+		for group, count := range groups {
+			h.byGroup[to][group] += count
+		}
+		delete(h.byGroup, from)
+	}
+}
+
+// forget removes everything recorded against the given host.
+func (h *hostJobs) forget(host string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.total, host)
+	delete(h.byGroup, host)
+}
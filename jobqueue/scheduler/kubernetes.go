@@ -0,0 +1,719 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'kubernetes': running
+// cmds (our runners) in pods of a kubernetes cluster. We talk to the cluster's
+// REST API directly, creating one pod per cmd with resource requests and
+// limits taken from the cmd's Requirements. The manager's token and CA cert
+// are stored in a Secret that is mounted in to each pod, so that runners can
+// connect back to the manager. Pods are deleted once their cmd exits, and
+// any namespace ResourceQuotas are respected when deciding how many cmds can be
+// run at once.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	kubeSecretMountPath   = "/etc/wr-manager"
+	kubeSecretTokenKey    = "token"
+	kubeSecretCAKey       = "ca.pem"
+	kubeLabelDeployment   = "wr-deployment"
+	kubeLabelManager      = "wr-manager"
+	kubeLabelArch         = "kubernetes.io/arch"
+	kubeUnlimited         = math.MaxInt32
+)
+
+// kubePollInterval is how often runCmd checks on the state of its pod.
+var kubePollInterval = 2 * time.Second
+
+// kubeLabelRegex matches characters not allowed in kubernetes label values.
+var kubeLabelRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// ConfigKubernetes represents the configuration options required by the
+// kubernetes scheduler. Image is required; when the manager itself runs in the
+// cluster, the connection details default to those of its service account.
+type ConfigKubernetes struct {
+	// APIServer is the URL of the cluster's API server, eg.
+	// https://10.0.0.1:6443. Defaults to the in-cluster address.
+	APIServer string
+
+	// BearerToken authenticates us with the API server. Defaults to the
+	// in-cluster service account token.
+	BearerToken string
+
+	// CAFile is the path to the CA cert that signed the API server's
+	// certificate. Defaults to the in-cluster service account CA.
+	CAFile string
+
+	// Namespace is the namespace to create pods in. Defaults to the service
+	// account's namespace, or "default".
+	Namespace string
+
+	// Image is the container image to run cmds in. It must have our exe
+	// installed as Exe in the $PATH, and have Shell available.
+	Image string
+
+	// Exe is the name of our exe within Image, used in place of the exe of
+	// the cmds we're asked to run. Defaults to "wr".
+	Exe string
+
+	// Secret is the name of the Secret holding the manager's token and CA
+	// cert, which is mounted in to every pod. Defaults to
+	// "wr-manager-[Deployment]".
+	Secret string
+
+	// ManagerTokenFile and ManagerCAFile are the paths to the manager's token
+	// and CA cert. If set, Secret will be created or updated with their
+	// contents before the first pod is created; otherwise Secret must already
+	// exist with "token" and "ca.pem" keys.
+	ManagerTokenFile string
+	ManagerCAFile    string
+
+	// MaxPods is the most pods we'll have at once; 0 means unlimited (beyond
+	// any quotas on Namespace).
+	MaxPods int
+
+	// Deployment is one of "development" or "production".
+	Deployment string
+
+	// Shell is the shell to use to run your commands with; 'bash' is
+	// recommended.
+	Shell string
+
+	// StateUpdateFrequency is the frequency at which to re-check the queue to
+	// see if anything can now run. 0 (default) is treated as 1 minute.
+	StateUpdateFrequency time.Duration
+}
+
+// kubernetes is our implementer of scheduleri. It embeds local, using local's
+// queue processing but running cmds in pods instead of locally.
+type kubernetes struct {
+	local
+	config     *ConfigKubernetes
+	client     *http.Client
+	apiURL     string
+	managerID  string
+	pods       map[string]*kubePod
+	secretDone bool
+	cbmutex    sync.RWMutex
+	msgCB      MessageCallBack
+	kmutex     sync.Mutex
+}
+
+// kubePod is one of the pods we created to run a cmd.
+type kubePod struct {
+	cmd       string
+	pending   bool
+	cancelled bool
+}
+
+// kubeQuantityRegex parses kubernetes resource quantities like "500m" or
+// "4Gi".
+var kubeQuantityRegex = regexp.MustCompile(`^([0-9.]+)(m|k|Ki|M|Mi|G|Gi|T|Ti)?$`)
+
+// kubeQuantityMultipliers convert the suffixes of kubernetes quantities.
+var kubeQuantityMultipliers = map[string]float64{
+	"":   1,
+	"m":  0.001,
+	"k":  1e3,
+	"Ki": 1 << 10,
+	"M":  1e6,
+	"Mi": 1 << 20,
+	"G":  1e9,
+	"Gi": 1 << 30,
+	"T":  1e12,
+	"Ti": 1 << 40,
+}
+
+// parseKubeQuantity converts a kubernetes resource quantity to a plain number
+// (cores for cpu, bytes for memory).
+func parseKubeQuantity(q string) (float64, error) {
+	matches := kubeQuantityRegex.FindStringSubmatch(strings.TrimSpace(q))
+	if matches == nil {
+		return 0, fmt.Errorf("bad quantity [%s]", q)
+	}
+	n, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * kubeQuantityMultipliers[matches[2]], nil
+}
+
+// initialize checks the config, filling in in-cluster defaults, and sets up
+// our API client. We don't talk to the cluster until we need to run something.
+func (s *kubernetes) initialize(config interface{}, logger log15.Logger) error {
+	s.config = config.(*ConfigKubernetes)
+	s.Logger = logger.New("scheduler", "kubernetes")
+
+	if s.config.Image == "" {
+		return Error{"kubernetes", "initialize", "no image was configured"}
+	}
+	if s.config.Exe == "" {
+		s.config.Exe = "wr"
+	}
+	if s.config.Deployment == "" {
+		s.config.Deployment = "production"
+	}
+	if s.config.Secret == "" {
+		s.config.Secret = "wr-manager-" + s.config.Deployment
+	}
+
+	if s.config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return Error{"kubernetes", "initialize", "no API server was configured, and we're not running in a cluster"}
+		}
+		s.config.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if s.config.BearerToken == "" {
+		token, err := ioutil.ReadFile(kubeServiceAccountDir + "/token")
+		if err == nil {
+			s.config.BearerToken = strings.TrimSpace(string(token))
+		}
+	}
+	if s.config.CAFile == "" {
+		if _, err := os.Stat(kubeServiceAccountDir + "/ca.crt"); err == nil {
+			s.config.CAFile = kubeServiceAccountDir + "/ca.crt"
+		}
+	}
+	if s.config.Namespace == "" {
+		s.config.Namespace = "default"
+		if ns, err := ioutil.ReadFile(kubeServiceAccountDir + "/namespace"); err == nil && len(bytes.TrimSpace(ns)) > 0 {
+			s.config.Namespace = strings.TrimSpace(string(ns))
+		}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if s.config.CAFile != "" {
+		ca, err := ioutil.ReadFile(s.config.CAFile)
+		if err != nil {
+			return Error{"kubernetes", "initialize", fmt.Sprintf("could not read CA file: %s", err)}
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return Error{"kubernetes", "initialize", "CA file contained no certificates"}
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	s.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	s.apiURL = strings.TrimSuffix(s.config.APIServer, "/") + "/api/v1/namespaces/" + url.PathEscape(s.config.Namespace)
+
+	// pods we create are labelled as ours, so that multiple managers can share
+	// a namespace
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	s.managerID = kubeLabelRegex.ReplaceAllString(fmt.Sprintf("%s-%d", hostname, os.Getpid()), "-")
+	if len(s.managerID) > 63 {
+		s.managerID = s.managerID[len(s.managerID)-63:]
+	}
+	s.pods = make(map[string]*kubePod)
+
+	// initialize our job queue and other trackers
+	s.queue = queue.New(localPlace)
+	s.running = make(map[string]int)
+	s.runEnds = make(map[int]time.Time)
+
+	// set our functions for use in schedule() and processQueue()
+	s.reqCheckFunc = s.reqCheck
+	s.canCountFunc = s.canCount
+	s.runCmdFunc = s.runCmd
+	s.cancelRunCmdFunc = s.cancelRun
+	s.stateUpdateFunc = s.stateUpdate
+	s.stateUpdateFreq = s.config.StateUpdateFrequency
+	if s.stateUpdateFreq == 0 {
+		s.stateUpdateFreq = 1 * time.Minute
+	}
+
+	// pass through our shell config and logger to our local embed
+	s.local.config = &ConfigLocal{Shell: s.config.Shell}
+	s.local.Logger = s.Logger
+
+	return nil
+}
+
+// call makes a request to the API server, relative to our namespace, decoding
+// any JSON response in to result (if not nil). The response status code is
+// returned along with any error.
+func (s *kubernetes) call(method, path string, body interface{}, result interface{}) (int, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, s.apiURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		errc := resp.Body.Close()
+		if errc != nil {
+			s.Warn("kubernetes response body close failed", "err", errc)
+		}
+	}()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(content, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(content))
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s failed [%d]: %s", method, path, resp.StatusCode, status.Message)
+	}
+	if result != nil && len(content) > 0 {
+		err = json.Unmarshal(content, result)
+	}
+	return resp.StatusCode, err
+}
+
+// kubeQuota is the part of a ResourceQuota we care about.
+type kubeQuota struct {
+	Status struct {
+		Hard map[string]string `json:"hard"`
+		Used map[string]string `json:"used"`
+	} `json:"status"`
+}
+
+// quotaNeeds converts the given requirements in to what a pod for them will
+// use of each quota-able resource.
+func quotaNeeds(req *Requirements) map[string]float64 {
+	cores := float64(req.Cores)
+	mem := float64(req.RAM) * (1 << 20)
+	needs := map[string]float64{
+		"pods":            1,
+		"cpu":             cores,
+		"requests.cpu":    cores,
+		"limits.cpu":      cores,
+		"memory":          mem,
+		"requests.memory": mem,
+		"limits.memory":   mem,
+	}
+	if req.Disk > 0 {
+		disk := float64(req.Disk) * (1 << 30)
+		needs["ephemeral-storage"] = disk
+		needs["requests.ephemeral-storage"] = disk
+		needs["limits.ephemeral-storage"] = disk
+	}
+	return needs
+}
+
+// quotaCount works out how many pods with the given requirements the quotas
+// on our namespace allow for. If checkHard is true, instead returns 0 if a
+// single pod would exceed the hard limits, ignoring current usage.
+func (s *kubernetes) quotaCount(req *Requirements, checkHard bool) (int, error) {
+	var list struct {
+		Items []*kubeQuota `json:"items"`
+	}
+	_, err := s.call("GET", "/resourcequotas", nil, &list)
+	if err != nil {
+		return 0, err
+	}
+
+	count := kubeUnlimited
+	needs := quotaNeeds(req)
+	for _, quota := range list.Items {
+		for resource, hardStr := range quota.Status.Hard {
+			need, ok := needs[resource]
+			if !ok || need <= 0 {
+				continue
+			}
+			hard, err := parseKubeQuantity(hardStr)
+			if err != nil {
+				return 0, err
+			}
+			var used float64
+			if usedStr, exists := quota.Status.Used[resource]; exists && !checkHard {
+				used, err = parseKubeQuantity(usedStr)
+				if err != nil {
+					return 0, err
+				}
+			}
+			fits := int(math.Floor((hard - used) / need))
+			if fits < 0 {
+				fits = 0
+			}
+			if fits < count {
+				count = fits
+			}
+		}
+	}
+	return count, nil
+}
+
+// reqCheck gives an ErrImpossible if a pod with the given requirements could
+// never fit within the quotas on our namespace. (Pods needing a particular
+// architecture are left to the cluster to place on a suitable node.)
+func (s *kubernetes) reqCheck(req *Requirements) error {
+	count, err := s.quotaCount(req, true)
+	if err != nil {
+		return Error{"kubernetes", "schedule", err.Error()}
+	}
+	if count == 0 {
+		return Error{"kubernetes", "schedule", ErrImpossible}
+	}
+	return nil
+}
+
+// canCount tells you how many pods with the given requirements could be
+// created, given our namespace's quotas and what is already using them.
+func (s *kubernetes) canCount(req *Requirements) int {
+	count, err := s.quotaCount(req, false)
+	if err != nil {
+		s.Warn("kubernetes quota check failed", "err", err)
+		return 0
+	}
+
+	if s.config.MaxPods > 0 {
+		s.kmutex.Lock()
+		remaining := s.config.MaxPods - len(s.pods)
+		s.kmutex.Unlock()
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < count {
+			count = remaining
+		}
+	}
+	return count
+}
+
+// negotiate achieves the aims of Negotiate().
+func (s *kubernetes) negotiate(min, ideal *Requirements) *Requirements {
+	return negotiateWithin(min, ideal, func(req *Requirements) bool {
+		return s.reqCheck(req) == nil && s.canCount(req) >= 1
+	})
+}
+
+// ensureSecret creates or updates our Secret with the contents of the
+// manager's token and CA files, the first time it's called.
+func (s *kubernetes) ensureSecret() error {
+	s.kmutex.Lock()
+	defer s.kmutex.Unlock()
+	if s.secretDone || (s.config.ManagerTokenFile == "" && s.config.ManagerCAFile == "") {
+		return nil
+	}
+
+	data := make(map[string][]byte)
+	for key, path := range map[string]string{kubeSecretTokenKey: s.config.ManagerTokenFile, kubeSecretCAKey: s.config.ManagerCAFile} {
+		if path == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		data[key] = content
+	}
+
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":   s.config.Secret,
+			"labels": map[string]string{kubeLabelDeployment: s.config.Deployment},
+		},
+		"type": "Opaque",
+		"data": data, // []byte values are base64 encoded, as required
+	}
+	code, err := s.call("PUT", "/secrets/"+url.PathEscape(s.config.Secret), secret, nil)
+	if code == http.StatusNotFound {
+		_, err = s.call("POST", "/secrets", secret, nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.secretDone = true
+	return nil
+}
+
+// podSpec creates the definition of a pod that will run the given cmd with
+// the given requirements.
+func (s *kubernetes) podSpec(cmd string, req *Requirements) map[string]interface{} {
+	exe := strings.Split(cmd, " ")[0]
+	cmd = s.config.Exe + strings.TrimPrefix(cmd, exe)
+
+	resources := map[string]string{
+		"cpu":    strconv.Itoa(req.Cores),
+		"memory": fmt.Sprintf("%dMi", req.RAM),
+	}
+	if req.Disk > 0 {
+		resources["ephemeral-storage"] = fmt.Sprintf("%dGi", req.Disk)
+	}
+
+	spec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers": []map[string]interface{}{{
+			"name":    "runner",
+			"image":   s.config.Image,
+			"command": []string{s.config.Shell, "-c", cmd},
+			"env": []map[string]string{
+				{"name": "WR_MANAGERTOKENFILE", "value": kubeSecretMountPath + "/" + kubeSecretTokenKey},
+				{"name": "WR_MANAGERCAFILE", "value": kubeSecretMountPath + "/" + kubeSecretCAKey},
+			},
+			"resources": map[string]interface{}{
+				"requests": resources,
+				"limits":   resources,
+			},
+			"volumeMounts": []map[string]interface{}{{
+				"name":      "wr-manager",
+				"mountPath": kubeSecretMountPath,
+				"readOnly":  true,
+			}},
+		}},
+		"volumes": []map[string]interface{}{{
+			"name":   "wr-manager",
+			"secret": map[string]string{"secretName": s.config.Secret},
+		}},
+	}
+	if req.Arch != "" {
+		spec["nodeSelector"] = map[string]string{kubeLabelArch: kubeArch(req.Arch)}
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"generateName": "wr-runner-",
+			"labels": map[string]string{
+				kubeLabelDeployment: s.config.Deployment,
+				kubeLabelManager:    s.managerID,
+			},
+		},
+		"spec": spec,
+	}
+}
+
+// kubeArch converts an architecture name to the form kubernetes uses for the
+// kubernetes.io/arch label on its nodes, which are go's GOARCH names.
+func kubeArch(arch string) string {
+	switch arch = NormaliseArch(arch); arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	}
+	return arch
+}
+
+// runCmd creates a pod to run the cmd in, then waits for the pod to finish
+// before deleting it. NB: like local, we only return an error if we can't
+// create the pod, not if the cmd fails.
+func (s *kubernetes) runCmd(cmd string, req *Requirements, reservedCh chan bool) error {
+	err := s.ensureSecret()
+	if err != nil {
+		reservedCh <- false
+		s.notifyMessage(fmt.Sprintf("Kubernetes: could not store the manager credentials in Secret %s: %s", s.config.Secret, err))
+		return Error{"kubernetes", "runCmd", err.Error()}
+	}
+
+	var created struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	_, err = s.call("POST", "/pods", s.podSpec(cmd, req), &created)
+	if err != nil || created.Metadata.Name == "" {
+		reservedCh <- false
+		if err == nil {
+			err = errors.New("pod was created without a name")
+		}
+		s.notifyMessage(fmt.Sprintf("Kubernetes: could not create a pod: %s", err))
+		return Error{"kubernetes", "runCmd", err.Error()}
+	}
+	name := created.Metadata.Name
+	pod := &kubePod{cmd: cmd, pending: true}
+
+	s.kmutex.Lock()
+	s.pods[name] = pod
+	s.kmutex.Unlock()
+
+	s.mutex.Lock()
+	s.rcount++
+	s.mutex.Unlock()
+	reservedCh <- true
+
+	defer func() {
+		s.kmutex.Lock()
+		delete(s.pods, name)
+		s.kmutex.Unlock()
+
+		s.mutex.Lock()
+		s.rcount--
+		if s.rcount < 0 {
+			s.rcount = 0
+		}
+		s.mutex.Unlock()
+	}()
+
+	logger := s.Logger.New("pod", name)
+	logger.Debug("created pod", "cmd", cmd)
+	phase := s.waitForPod(name, pod, logger)
+
+	s.kmutex.Lock()
+	cancelled := pod.cancelled
+	s.kmutex.Unlock()
+	if cancelled {
+		return errors.New(standinNotNeeded)
+	}
+
+	if phase == "Failed" {
+		logger.Warn("pod failed", "cmd", cmd)
+	}
+	s.deletePod(name, logger)
+	return nil // do not return error running the command
+}
+
+// waitForPod polls the named pod until it has finished, returning its final
+// phase. If the pod disappears (eg. because it was cancelled or deleted by
+// someone else), returns "".
+func (s *kubernetes) waitForPod(name string, pod *kubePod, logger log15.Logger) string {
+	for {
+		var status struct {
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		}
+		code, err := s.call("GET", "/pods/"+url.PathEscape(name), nil, &status)
+		switch {
+		case code == http.StatusNotFound:
+			return ""
+		case err != nil:
+			logger.Warn("could not get pod status", "err", err)
+		default:
+			phase := status.Status.Phase
+			if phase == "Succeeded" || phase == "Failed" {
+				return phase
+			}
+			s.kmutex.Lock()
+			pod.pending = phase == "Pending" || phase == ""
+			s.kmutex.Unlock()
+		}
+
+		s.mutex.Lock()
+		cleaned := s.cleaned
+		s.mutex.Unlock()
+		if cleaned {
+			return ""
+		}
+		<-time.After(kubePollInterval)
+	}
+}
+
+// deletePod deletes the named pod, logging any failure.
+func (s *kubernetes) deletePod(name string, logger log15.Logger) {
+	code, err := s.call("DELETE", "/pods/"+url.PathEscape(name), nil, nil)
+	if err != nil && code != http.StatusNotFound {
+		logger.Warn("could not delete pod", "err", err)
+	}
+}
+
+// cancelRun deletes up to cancelCount pods for the given cmd that haven't
+// started running yet.
+func (s *kubernetes) cancelRun(cmd string, cancelCount int) {
+	s.kmutex.Lock()
+	var names []string
+	for name, pod := range s.pods {
+		if len(names) == cancelCount {
+			break
+		}
+		if pod.cmd == cmd && pod.pending && !pod.cancelled {
+			pod.cancelled = true
+			names = append(names, name)
+		}
+	}
+	s.kmutex.Unlock()
+
+	for _, name := range names {
+		s.deletePod(name, s.Logger.New("pod", name))
+	}
+}
+
+// setMessageCallBack sets the given callback.
+func (s *kubernetes) setMessageCallBack(cb MessageCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.msgCB = cb
+}
+
+// notifyMessage calls the message callback with the given message in a
+// goroutine, if that callback has been set.
+func (s *kubernetes) notifyMessage(msg string) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.msgCB != nil {
+		go s.msgCB(msg)
+	}
+}
+
+// cleanup destroys our internal queue and deletes any pods we created that
+// are still around.
+func (s *kubernetes) cleanup() {
+	s.local.cleanup()
+	selector := url.QueryEscape(kubeLabelManager + "=" + s.managerID)
+	_, err := s.call("DELETE", "/pods?labelSelector="+selector, nil, nil)
+	if err != nil {
+		s.Warn("kubernetes scheduler cleanup failed", "err", err)
+	}
+}
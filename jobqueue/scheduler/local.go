@@ -19,8 +19,8 @@
 package scheduler
 
 // This file contains a scheduleri implementation for 'local': running jobs
-// on the local machine directly. It has a very simple strictly fifo queue, so
-// may not be very efficient with the machine's resources.
+// on the local machine directly. It has a simple fifo queue, with backfilling
+// of short jobs while the oldest job waits for resources to become free.
 
 import (
 	"math"
@@ -51,6 +51,14 @@ type reqChecker func(req *Requirements) error
 // have their own canCounter implementation.)
 type canCounter func(req *Requirements) (canCount int)
 
+// quotaCheckers are functions used by schedule() to check, before trying to
+// run them, if there is enough quota to run the given number of a job at once,
+// warning if not. (We make use of this in the local struct so that other
+// implementers of scheduleri that have quotas can embed local, use local's
+// schedule(), but have their own quotaChecker implementation; it is nil for
+// those without quotas.)
+type quotaChecker func(req *Requirements, count int)
+
 // stateUpdaters are functions used by processQueue() to update any global state
 // that might have become invalid due to changes external to our own actions.
 // (We make use of this in the local struct so that other implementers of
@@ -83,9 +91,13 @@ type local struct {
 	resourceMutex    sync.RWMutex
 	queue            *queue.Queue
 	running          map[string]int
+	runEnds          map[int]time.Time
+	runID            int
+	hostJobs         *hostJobs
 	cleaned          bool
 	reqCheckFunc     reqChecker
 	canCountFunc     canCounter
+	quotaCheckFunc   quotaChecker
 	stateUpdateFunc  stateUpdater
 	stateUpdateFreq  time.Duration
 	runCmdFunc       cmdRunner
@@ -107,6 +119,12 @@ type ConfigLocal struct {
 	// StateUpdateFrequency is the frequency at which to re-check the queue to
 	// see if anything can now run. 0 (default) is treated as 1 minute.
 	StateUpdateFrequency time.Duration
+
+	// MaxJobsPerHost, if greater than 0, is the most cmds that will be run at
+	// once, regardless of how many would fit given their resource
+	// requirements. (Individual scheduler groups can have a lower cap with a
+	// Requirements.Other[MaxPerHostKey] value.)
+	MaxJobsPerHost int
 }
 
 // jobs are what we store in our queue.
@@ -133,6 +151,8 @@ func (s *local) initialize(config interface{}, logger log15.Logger) error {
 	// make our queue
 	s.queue = queue.New(localPlace)
 	s.running = make(map[string]int)
+	s.runEnds = make(map[int]time.Time)
+	s.hostJobs = newHostJobs(s.config.MaxJobsPerHost)
 
 	// set our functions for use in schedule() and processQueue()
 	s.reqCheckFunc = s.reqCheck
@@ -184,12 +204,14 @@ func (s *local) schedule(cmd string, req *Requirements, count int) error {
 		count: count,
 	}
 	s.mutex.Lock()
+	var prevCount int
 	item, err := s.queue.Add(key, "", data, 0, 0*time.Second, 30*time.Second) // the ttr just has to be long enough for processQueue() to process a job, not actually run the cmds
 	if err != nil {
 		if qerr, ok := err.(queue.Error); ok && qerr.Err == queue.ErrAlreadyExists {
 			// update the job's count (only)
 			j := item.Data.(*job)
 			j.Lock()
+			prevCount = j.count
 			j.count = count
 			j.Unlock()
 		} else {
@@ -197,8 +219,15 @@ func (s *local) schedule(cmd string, req *Requirements, count int) error {
 			return err
 		}
 	}
+	running := s.running[key]
 	s.mutex.Unlock()
 
+	// if we now need more, warn up front if we won't be able to run them all,
+	// instead of users only finding out from later failures to get resources
+	if s.quotaCheckFunc != nil && count > prevCount && count > running {
+		s.quotaCheckFunc(req, count-running)
+	}
+
 	s.startAutoProcessing()
 
 	// try and run the oldest job in the queue
@@ -210,6 +239,9 @@ func (s *local) reqCheck(req *Requirements) error {
 	if req.RAM > s.maxRAM || req.Cores > s.maxCores {
 		return Error{"local", "schedule", ErrImpossible}
 	}
+	if req.Arch != "" && NormaliseArch(req.Arch) != LocalArch() {
+		return Error{"local", "schedule", ErrImpossible}
+	}
 	return nil
 }
 
@@ -251,6 +283,7 @@ func (s *local) processQueue() error {
 	var req *Requirements
 	var count, canCount int
 	var j *job
+	var backfillBefore time.Time
 
 	// get the oldest job
 	var toRelease []string
@@ -300,6 +333,13 @@ func (s *local) processQueue() error {
 			continue
 		}
 
+		if !backfillBefore.IsZero() && time.Now().Add(req.Time).After(backfillBefore) {
+			// we're backfilling, and this job might not finish before the
+			// oldest waiting job could start, so running it could delay that
+			// job
+			continue
+		}
+
 		// now see if there's remaining capacity to run the job
 		canCount = s.canCountFunc(req)
 		s.Debug("processQueue canCount", "can", canCount, "running", running, "should", shouldCount)
@@ -308,14 +348,21 @@ func (s *local) processQueue() error {
 		}
 
 		if canCount == 0 {
-			// we don't want to go to the next most oldest, but will wait until
-			// something calls processQueue() again to get the cmd for this
-			// job running: dumb fifo behaviour
-			//*** could easily make this less dumb by considering how long we
-			// most likely have to wait for a currently running job to finish,
-			// and seeing if there are any other jobs in the queue that will
-			// finish in less time...
-			return nil
+			if !backfillBefore.IsZero() {
+				continue
+			}
+
+			// we'll wait until something calls processQueue() again to get
+			// the cmd for this job running, but since resources won't become
+			// free until the soonest a running cmd is expected to end, any
+			// younger job that can run now and is expected to finish before
+			// then can be backfilled without delaying this one
+			backfillBefore = s.earliestRunEnd()
+			if backfillBefore.IsZero() {
+				return nil
+			}
+			s.Debug("processQueue backfilling", "before", backfillBefore)
+			continue
 		}
 
 		break
@@ -326,6 +373,9 @@ func (s *local) processQueue() error {
 	reserved := make(chan bool, canCount)
 	for i := 0; i < canCount; i++ {
 		s.running[key]++
+		s.runID++
+		runID := s.runID
+		s.runEnds[runID] = time.Now().Add(req.Time)
 
 		go func() {
 			defer internal.LogPanic(s.Logger, "runCmd", true)
@@ -333,6 +383,7 @@ func (s *local) processQueue() error {
 			err := s.runCmdFunc(cmd, req, reserved)
 
 			s.mutex.Lock()
+			delete(s.runEnds, runID)
 			s.resourceMutex.Lock()
 			s.ram -= req.RAM
 			s.cores -= req.Cores
@@ -410,7 +461,55 @@ func (s *local) canCount(req *Requirements) int {
 			canCount = canCount2
 		}
 	}
-	return canCount
+	return s.hostJobs.fit(localHost, req, canCount)
+}
+
+// earliestRunEnd returns the soonest time that any of the cmds we're currently
+// running is expected to finish, based on their Requirements.Time. Returns the
+// zero time if nothing is running. You must hold s.mutex when calling this.
+func (s *local) earliestRunEnd() time.Time {
+	var earliest time.Time
+	for _, end := range s.runEnds {
+		if earliest.IsZero() || end.Before(earliest) {
+			earliest = end
+		}
+	}
+	return earliest
+}
+
+// negotiate achieves the aims of Negotiate().
+func (s *local) negotiate(min, ideal *Requirements) *Requirements {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return negotiateWithin(min, ideal, func(req *Requirements) bool {
+		return s.reqCheck(req) == nil && s.canCountFunc(req) >= 1
+	})
+}
+
+// negotiateWithin helps implement negotiate(). Starting from the ideal, we
+// step half way towards the minimum each time until we find Requirements that
+// fit() says we could run something with right now.
+func negotiateWithin(min, ideal *Requirements, fit func(req *Requirements) bool) *Requirements {
+	cores, ram := ideal.Cores, ideal.RAM
+	if cores < min.Cores {
+		cores = min.Cores
+	}
+	if ram < min.RAM {
+		ram = min.RAM
+	}
+
+	granted := *min
+	for {
+		granted.Cores, granted.RAM = cores, ram
+		if fit(&granted) {
+			return &granted
+		}
+		if cores == min.Cores && ram == min.RAM {
+			return &granted
+		}
+		cores = min.Cores + (cores-min.Cores)/2
+		ram = min.RAM + (ram-min.RAM)/2
+	}
 }
 
 // runCmd runs the command, kills it if it goes much over RAM or time limits.
@@ -433,6 +532,7 @@ func (s *local) runCmd(cmd string, req *Requirements, reservedCh chan bool) erro
 	s.resourceMutex.Lock()
 	s.ram += req.RAM
 	s.cores += req.Cores
+	s.hostJobs.add(localHost, req, 1)
 	reservedCh <- true
 	s.resourceMutex.Unlock()
 
@@ -443,6 +543,7 @@ func (s *local) runCmd(cmd string, req *Requirements, reservedCh chan bool) erro
 	if err != nil {
 		s.Error("runCmd wait", "cmd", cmd, "err", err)
 	}
+	s.hostJobs.remove(localHost, req)
 
 	s.mutex.Lock()
 	s.rcount--
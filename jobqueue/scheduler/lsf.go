@@ -417,7 +417,12 @@ func (s *lsf) schedule(cmd string, req *Requirements, count int) error {
 
 	megabytes := req.RAM
 	m := float32(megabytes) * s.memLimitMultiplier
-	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d] rusage[mem=%d] span[hosts=1]'", megabytes, megabytes))
+	var archSelect string
+	if req.Arch != "" {
+		// LSF host types are conventionally upper case, eg. X86_64
+		archSelect = " && type==" + strings.ToUpper(NormaliseArch(req.Arch))
+	}
+	bsubArgs = append(bsubArgs, "-q", queue, "-M", fmt.Sprintf("%0.0f", m), "-R", fmt.Sprintf("'select[mem>%d%s] rusage[mem=%d] span[hosts=1]'", megabytes, archSelect, megabytes))
 	if req.Cores > 1 {
 		bsubArgs = append(bsubArgs, "-n", fmt.Sprintf("%d", req.Cores))
 	}
@@ -641,6 +646,14 @@ func (s *lsf) parseBjobs(jobPrefix string, callback bjobsCB) error {
 	return err
 }
 
+// negotiate achieves the aims of Negotiate(). We can't tell what resources LSF
+// currently has available, so always return the minimum, which will be queued
+// for the shortest time.
+func (s *lsf) negotiate(min, ideal *Requirements) *Requirements {
+	granted := *min
+	return &granted
+}
+
 // hostToID always returns an empty string, since we're not in the cloud.
 func (s *lsf) hostToID(host string) string {
 	return ""
@@ -26,6 +26,7 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -44,6 +45,11 @@ const (
 	standinNotNeeded = "standin no longer needed"
 )
 
+// ScratchDirEnvVar is the environment variable that cmds get the path to their
+// scratch volume in, when they were scheduled with a
+// Requirements.Other["cloud_scratch"] value.
+const ScratchDirEnvVar = "WR_SCRATCH_DIR"
+
 // debugCounter and debugEffect are used by tests to prove some bugs
 var debugCounter int
 var debugEffect string
@@ -63,6 +69,7 @@ type opst struct {
 	reservedRAM       int
 	reservedVolume    int
 	servers           map[string]*cloud.Server
+	serverJobs        *hostJobs
 	standins          map[string]*standin
 	spawningNow       bool
 	waitingToSpawn    int
@@ -111,11 +118,31 @@ type ConfigOpenStack struct {
 	// also satisfies this regex.)
 	FlavorRegex string
 
+	// ArchFlavorRegexes lets you run commands that need a particular CPU
+	// architecture (as per Requirements.Arch) on suitable servers. Keys are
+	// normalised architecture names (see NormaliseArch()), eg. "aarch64", and
+	// values are regular expressions matching the names of the flavors that
+	// have that architecture. Commands needing an architecture that isn't a key
+	// use FlavorRegex as normal. Note that you will also need to make sure
+	// such commands use an OS image built for that architecture (eg. with a
+	// Requirements.Other["cloud_os"] value).
+	ArchFlavorRegexes map[string]string
+
 	// PostCreationScript is the []byte content of a script you want executed
 	// after a server is Spawn()ed. (Overridden during Schedule() by a
-	// Requirements.Other["cloud_script"] value.)
+	// Requirements.Other["cloud_script"] value.) If it contains "{{" it is
+	// treated as a text/template and executed with a ScriptData describing the
+	// server, so that eg. extra packages or kernel settings can depend on the
+	// flavor or on the cmds' Requirements.Other["cloud_script_vars"].
 	PostCreationScript []byte
 
+	// FlavorScripts lets servers of particular flavors run a different post
+	// creation script to PostCreationScript. Keys are regular expressions
+	// matching flavor names (tried in sorted order), and values are scripts
+	// that are treated the same way as PostCreationScript. (Overridden during
+	// Schedule() by a Requirements.Other["cloud_script"] value.)
+	FlavorScripts map[string][]byte
+
 	// ConfigFiles is a comma separated list of paths to config files that
 	// should be copied over to all spawned servers. Absolute paths are copied
 	// over to the same absolute path on the new server. To handle a config file
@@ -145,6 +172,12 @@ type ConfigOpenStack struct {
 	// 0 (default) is treated as 1 minute.
 	StateUpdateFrequency time.Duration
 
+	// MaxJobsPerHost, if greater than 0, is the most cmds that will be run at
+	// once on each server, regardless of how many would fit given their
+	// resource requirements. (Individual scheduler groups can have a lower cap
+	// with a Requirements.Other[MaxPerHostKey] value.)
+	MaxJobsPerHost int
+
 	// MaxInstances is the maximum number of instances we are allowed to spawn.
 	// -1 means we will be limited by your quota, if any. 0 (the default) means
 	// no additional instances will be spawned (commands will run locally on the
@@ -168,6 +201,11 @@ type ConfigOpenStack struct {
 	// DNSNameServers is a slice of DNS IP addresses to use for lookups on the
 	// created subnet. It defaults to Google's: []string{"8.8.4.4", "8.8.8.8"}
 	DNSNameServers []string
+
+	// Provider is the name of the cloud provider (as per cloud.New()) to spawn
+	// servers with. It defaults to "openstack"; the "terraform" scheduler sets
+	// it to "terraform".
+	Provider string
 }
 
 // AddConfigFile takes a value as per the ConfigFiles property, and appends it
@@ -381,12 +419,15 @@ func (s *opst) initialize(config interface{}, logger log15.Logger) error {
 	if s.config.OSDisk == 0 {
 		s.config.OSDisk = 1
 	}
+	if s.config.Provider == "" {
+		s.config.Provider = "openstack"
+	}
 
-	s.Logger = logger.New("scheduler", "openstack")
+	s.Logger = logger.New("scheduler", s.config.Provider)
 
-	// create a cloud provider for openstack, that we'll use to interact with
-	// openstack
-	provider, err := cloud.New("openstack", s.config.ResourceName, s.config.SavePath, logger)
+	// create a cloud provider for openstack (or whatever other cloud provider
+	// was configured), that we'll use to interact with the cloud
+	provider, err := cloud.New(s.config.Provider, s.config.ResourceName, s.config.SavePath, logger)
 	if err != nil {
 		return err
 	}
@@ -442,18 +483,29 @@ func (s *opst) initialize(config interface{}, logger log15.Logger) error {
 	// initialize our job queue and other trackers
 	s.queue = queue.New(localPlace)
 	s.running = make(map[string]int)
+	s.runEnds = make(map[int]time.Time)
 
 	// initialise our servers with details of ourself
 	s.servers = make(map[string]*cloud.Server)
+	s.serverJobs = newHostJobs(s.config.MaxJobsPerHost)
 	localhost, err := provider.LocalhostServer(s.config.OSPrefix, s.config.PostCreationScript, s.config.ConfigFiles)
 	if err != nil {
 		return err
 	}
+	if localhost.Flavor != nil {
+		// consider ourselves to have run the script that servers of our flavor
+		// would, so that cmds that would get that script can run on us
+		localhost.Script, err = s.serverScript(&Requirements{Other: make(map[string]string)}, s.config.OSPrefix, localhost.Flavor)
+		if err != nil {
+			return err
+		}
+	}
 	s.servers["localhost"] = localhost
 
 	// set our functions for use in schedule() and processQueue()
 	s.reqCheckFunc = s.reqCheck
 	s.canCountFunc = s.canCount
+	s.quotaCheckFunc = s.quotaCheck
 	s.runCmdFunc = s.runCmd
 	s.cancelRunCmdFunc = s.cancelRun
 	s.stateUpdateFunc = s.stateUpdate
@@ -493,7 +545,12 @@ func (s *opst) reqCheck(req *Requirements) error {
 		}
 
 		// check that the user hasn't requested a flavor that isn't actually big
-		// enough to run their job
+		// enough to run their job, or is of the wrong architecture
+		if !s.archFilter(req)(&cloud.Server{Flavor: requestedFlavor}) {
+			s.Warn("Requested flavor is of the wrong architecture for the job", "flavor", requestedFlavor.Name, "arch", req.Arch)
+			s.notifyMessage(fmt.Sprintf("OpenStack: requested flavor %s is not of the %s architecture the job needs", requestedFlavor.Name, req.Arch))
+			return Error{"openstack", "schedule", ErrImpossible}
+		}
 		if requestedFlavor.Cores < reqForSpawn.Cores || requestedFlavor.RAM < reqForSpawn.RAM {
 			s.Warn("Requested flavor is too small for the job", "flavor", requestedFlavor.Name, "flavorCores", requestedFlavor.Cores, "requiredCores", reqForSpawn.Cores, "flavorRAM", requestedFlavor.RAM, "requiredRAM", reqForSpawn.RAM)
 			s.notifyMessage(fmt.Sprintf("OpenStack: requested flavor %s is too small for the job needing %d cores and %d RAM", requestedFlavor.Name, reqForSpawn.Cores, reqForSpawn.RAM))
@@ -510,7 +567,7 @@ func (s *opst) reqCheck(req *Requirements) error {
 // determineFlavor picks a server flavor, preferring the smallest (cheapest)
 // amongst those that are capable of running it.
 func (s *opst) determineFlavor(req *Requirements) (*cloud.Flavor, error) {
-	flavor, err := s.provider.CheapestServerFlavor(req.Cores, req.RAM, s.config.FlavorRegex)
+	flavor, err := s.provider.CheapestServerFlavor(req.Cores, req.RAM, s.archFlavorRegex(req.Arch))
 	if err != nil {
 		if perr, ok := err.(cloud.Error); ok && perr.Err == cloud.ErrNoFlavor {
 			err = Error{"openstack", "determineFlavor", ErrImpossible}
@@ -519,6 +576,40 @@ func (s *opst) determineFlavor(req *Requirements) (*cloud.Flavor, error) {
 	return flavor, err
 }
 
+// archFlavorRegex returns the regular expression that flavors must match to
+// have the given CPU architecture. For an empty or unconfigured arch, this is
+// our configured FlavorRegex.
+func (s *opst) archFlavorRegex(arch string) string {
+	if arch != "" {
+		if regex, exists := s.config.ArchFlavorRegexes[NormaliseArch(arch)]; exists {
+			return regex
+		}
+	}
+	return s.config.FlavorRegex
+}
+
+// archFilter returns a function that tells you if a server has the CPU
+// architecture that req needs, based on the name of its flavor. If req doesn't
+// need a particular configured architecture, all servers are suitable.
+func (s *opst) archFilter(req *Requirements) func(*cloud.Server) bool {
+	allSuit := func(*cloud.Server) bool { return true }
+	if req.Arch == "" {
+		return allSuit
+	}
+	regex, exists := s.config.ArchFlavorRegexes[NormaliseArch(req.Arch)]
+	if !exists {
+		return allSuit
+	}
+	r, err := regexp.Compile(regex)
+	if err != nil {
+		s.Warn("Bad ArchFlavorRegexes regex", "arch", req.Arch, "regex", regex, "err", err)
+		return func(*cloud.Server) bool { return false }
+	}
+	return func(server *cloud.Server) bool {
+		return server.Flavor != nil && r.MatchString(server.Flavor.Name)
+	}
+}
+
 // getFlavor returns a flavor with the given name or id. Returns an error
 // if no matching flavor exists.
 func (s *opst) getFlavor(name string) (*cloud.Flavor, error) {
@@ -533,8 +624,9 @@ func (s *opst) getFlavor(name string) (*cloud.Flavor, error) {
 
 // serverReqs checks the given req's Other details to see if a particular kind
 // of server has been requested. If not specified, the returned os defaults to
-// the configured OSPrefix, script defaults to PostCreationScript, config files
-// defaults to ConfigFiles and flavor will be nil.
+// the configured OSPrefix, script defaults to the FlavorScripts script for the
+// flavor req would be run on or else PostCreationScript (rendered if it is a
+// template), config files defaults to ConfigFiles and flavor will be nil.
 func (s *opst) serverReqs(req *Requirements) (osPrefix string, osScript []byte, osConfigFiles string, flavor *cloud.Flavor, err error) {
 	if val, defined := req.Other["cloud_os"]; defined {
 		osPrefix = val
@@ -542,10 +634,16 @@ func (s *opst) serverReqs(req *Requirements) (osPrefix string, osScript []byte,
 		osPrefix = s.config.OSPrefix
 	}
 
-	if val, defined := req.Other["cloud_script"]; defined {
-		osScript = []byte(val)
-	} else {
-		osScript = s.config.PostCreationScript
+	if name, defined := req.Other["cloud_flavor"]; defined {
+		flavor, err = s.getFlavor(name)
+		if err != nil {
+			return osPrefix, osScript, osConfigFiles, flavor, err
+		}
+	}
+
+	osScript, err = s.serverScript(req, osPrefix, flavor)
+	if err != nil {
+		return osPrefix, osScript, osConfigFiles, flavor, err
 	}
 
 	if val, defined := req.Other["cloud_config_files"]; defined {
@@ -558,11 +656,75 @@ func (s *opst) serverReqs(req *Requirements) (osPrefix string, osScript []byte,
 		osConfigFiles = s.config.ConfigFiles
 	}
 
-	if name, defined := req.Other["cloud_flavor"]; defined {
-		flavor, err = s.getFlavor(name)
+	return osPrefix, osScript, osConfigFiles, flavor, err
+}
+
+// serverScript works out the post creation script that servers running the
+// given req should run, as per serverReqs(). The flavor is the one
+// specifically requested, if any; otherwise, if needed, we work out the flavor
+// req would be spawned on.
+func (s *opst) serverScript(req *Requirements, osPrefix string, flavor *cloud.Flavor) ([]byte, error) {
+	val, defined := req.Other["cloud_script"]
+	script := []byte(val)
+	if !defined {
+		script = s.config.PostCreationScript
+	}
+	templated := bytes.Contains(script, []byte("{{"))
+	if defined && !templated {
+		return script, nil
 	}
 
-	return osPrefix, osScript, osConfigFiles, flavor, err
+	if flavor == nil && (templated || len(s.config.FlavorScripts) > 0) {
+		var err error
+		flavor, err = s.determineFlavor(s.reqForSpawn(req))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !defined && flavor != nil {
+		if fs := flavorScript(s.config.FlavorScripts, flavor.Name); fs != nil {
+			script = fs
+		}
+	}
+
+	data := &ScriptData{OS: osPrefix, Vars: parseScriptVars(req.Other[scriptVarsOther])}
+	if flavor != nil {
+		data.Flavor = flavor.Name
+		data.Cores = flavor.Cores
+		data.RAM = flavor.RAM
+		data.Disk = flavor.Disk
+	}
+	rendered, err := renderScript(script, data)
+	if err != nil {
+		s.notifyMessage(fmt.Sprintf("OpenStack: post creation script could not be rendered: %s", err))
+	}
+	return rendered, err
+}
+
+// scratchGB returns the size of the scratch volume the given req needs, which
+// is 0 if it doesn't need one.
+func scratchGB(req *Requirements) int {
+	if val, defined := req.Other["cloud_scratch"]; defined {
+		if gb, err := strconv.Atoi(val); err == nil && gb > 0 {
+			return gb
+		}
+	}
+	return 0
+}
+
+// negotiate achieves the aims of Negotiate(). Unlike local's implementation,
+// we first check there's a suitable flavor ourselves, to avoid warning about
+// ideal Requirements that are too big for any flavor.
+func (s *opst) negotiate(min, ideal *Requirements) *Requirements {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return negotiateWithin(min, ideal, func(req *Requirements) bool {
+		if _, err := s.determineFlavor(s.reqForSpawn(req)); err != nil {
+			return false
+		}
+		return s.canCount(req) >= 1
+	})
 }
 
 // canCount tells you how many jobs with the given RAM and core requirements it
@@ -596,9 +758,10 @@ func (s *opst) canCount(req *Requirements) int {
 	// the biggest object is first and the smallest last. Insert each object one
 	// by one in to the first bin that has room for it.”
 	var canCount int
-	for _, server := range s.servers {
-		if !server.IsBad() && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) {
-			space := server.HasSpaceFor(req.Cores, req.RAM, req.Disk)
+	suitsArch := s.archFilter(req)
+	for sid, server := range s.servers {
+		if !server.IsBad() && server.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) && suitsArch(server) {
+			space := s.serverJobs.fit(sid, req, server.HasSpaceFor(req.Cores, req.RAM, req.Disk))
 			canCount += space
 		}
 	}
@@ -687,6 +850,14 @@ func (s *opst) canCount(req *Requirements) int {
 	}
 
 	// finally, calculate how many reqs we can get running on that many servers
+	canCount += spawnable * s.serverJobs.fitNew(req, reqsPerServer(flavor, req, checkVolume))
+	return canCount
+}
+
+// reqsPerServer calculates how many cmds with the given Requirements can run on
+// a new server of the given flavor. checkVolume should be true if the server
+// will be given a volume to match the required disk space.
+func reqsPerServer(flavor *cloud.Flavor, req *Requirements, checkVolume bool) int {
 	perServer := flavor.Cores / req.Cores
 	if perServer > 1 {
 		var n int
@@ -709,8 +880,39 @@ func (s *opst) canCount(req *Requirements) int {
 			}
 		}
 	}
-	canCount += spawnable * perServer
-	return canCount
+	return perServer
+}
+
+// quotaCheck is our quotaChecker: before we try to run count cmds with the
+// given Requirements, it works out if our existing servers and remaining quota
+// (or configured MaxInstances) allow them to all run at once. If not, it warns
+// via the message callback how many more servers of the flavor they need would
+// be required, so that users can see the shortfall straight away.
+func (s *opst) quotaCheck(req *Requirements, count int) {
+	can := s.canCount(req)
+	if can >= count {
+		return
+	}
+
+	_, _, _, flavor, err := s.serverReqs(req)
+	if err != nil {
+		return
+	}
+	if flavor == nil {
+		flavor, err = s.determineFlavor(s.reqForSpawn(req))
+		if err != nil {
+			return
+		}
+	}
+
+	perServer := reqsPerServer(flavor, req, req.Disk > flavor.Disk)
+	if perServer < 1 {
+		perServer = 1
+	}
+	servers := (count - can + perServer - 1) / perServer
+
+	s.Warn("not enough quota to run all cmds at once", "cmds", count, "canRun", can, "flavor", flavor.Name, "moreServersNeeded", servers)
+	s.notifyMessage(fmt.Sprintf("OpenStack: not enough quota to run all %d commands needing %d cores and %d RAM at once (%d can run); %d more %s servers would be needed", count, req.Cores, req.RAM, can, servers, flavor.Name))
 }
 
 // reqForSpawn checks the input Requirements and if the configured OSRAM (or
@@ -744,6 +946,7 @@ func (s *opst) reqForSpawn(req *Requirements) *Requirements {
 			Time:  req.Time,
 			Cores: req.Cores,
 			Disk:  disk,
+			Arch:  req.Arch,
 			Other: req.Other,
 		}
 	}
@@ -790,10 +993,14 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 	// look through space on existing servers to see if we can run cmd on one
 	// of them
 	var server *cloud.Server
+	var serverKey string
+	suitsArch := s.archFilter(req)
 	for sid, thisServer := range s.servers {
-		if !thisServer.IsBad() && thisServer.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) && thisServer.HasSpaceFor(req.Cores, req.RAM, req.Disk) > 0 {
+		if !thisServer.IsBad() && thisServer.Matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) && suitsArch(thisServer) && thisServer.HasSpaceFor(req.Cores, req.RAM, req.Disk) > 0 && s.serverJobs.hasSpace(sid, req) {
 			server = thisServer
+			serverKey = sid
 			server.Allocate(req.Cores, req.RAM, req.Disk)
+			s.serverJobs.add(serverKey, req, 1)
 			logger = logger.New("server", sid)
 			logger.Debug("using existing server")
 			break
@@ -803,9 +1010,10 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 	// else see if there will be space on a soon-to-be-spawned server
 	if server == nil {
 		for _, standinServer := range s.standins {
-			if standinServer.matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) && standinServer.hasSpaceFor(req) > 0 {
+			if standinServer.matches(requestedOS, requestedScript, requestedConfigFiles, requestedFlavor) && standinServer.hasSpaceFor(req) > 0 && s.serverJobs.hasSpace(standinServer.id, req) {
 				s.recordStandin(standinServer, cmd)
 				standinServer.allocate(req)
+				s.serverJobs.add(standinServer.id, req, 1)
 				s.mutex.Unlock()
 				logger = logger.New("standin", standinServer.id)
 				logger.Debug("using existing standin")
@@ -817,6 +1025,7 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 					return errw
 				}
 				s.mutex.Lock()
+				serverKey = server.ID
 				logger = logger.New("server", server.ID)
 				logger.Debug("using server from standin")
 				break
@@ -869,6 +1078,7 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 		standinID := u.String()
 		standinServer := newStandin(standinID, flavor, req.Disk, requestedOS, requestedScript, requestedConfigFiles, s.Logger)
 		standinServer.allocate(req)
+		s.serverJobs.add(standinID, req, 1)
 		s.recordStandin(standinServer, cmd)
 		logger = logger.New("standin", standinID)
 		logger.Debug("using new standin")
@@ -894,6 +1104,7 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 			}()
 			err = <-done
 			if err != nil {
+				s.serverJobs.forget(standinID)
 				s.resourceMutex.Lock()
 				s.reservedInstances--
 				s.reservedCores -= flavor.Cores
@@ -1035,6 +1246,7 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 				logger.Debug("server also failed to destroy", "err", errd)
 			}
 			standinServer.failed(fmt.Sprintf("New server failed to spawn correctly: %s", err))
+			s.serverJobs.forget(standinID)
 			s.mutex.Unlock()
 			s.notifyMessage(fmt.Sprintf("OpenStack: Failed to create a usable server: %s", err))
 			return err
@@ -1043,6 +1255,8 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 		logger.Debug("server ready")
 
 		s.servers[server.ID] = server
+		serverKey = server.ID
+		s.serverJobs.move(standinID, serverKey)
 		standinServer.worked(server) // calls server.Allocate() for everything allocated to the standin
 	} else {
 		reservedCh <- true
@@ -1059,8 +1273,33 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 		}()
 		err = s.local.runCmd(cmd, req, reserved)
 	} else {
-		logger.Debug("running command remotely", "cmd", cmd)
-		_, _, err = server.RunCmd(cmd, false)
+		// create any scratch volume the cmd needs, telling it where that is
+		remoteCmd := cmd
+		var scratchDir string
+		if gb := scratchGB(req); gb > 0 {
+			scratchDir, err = server.MountScratch(gb)
+			if err != nil {
+				logger.Warn("scratch volume creation failed", "size", gb, "err", err)
+				s.notifyMessage(fmt.Sprintf("OpenStack: Failed to create a %dGB scratch volume: %s", gb, err))
+				s.mutex.Lock()
+				server.Release(req.Cores, req.RAM, req.Disk)
+				s.serverJobs.remove(serverKey, req)
+				s.mutex.Unlock()
+				return err
+			}
+			logger.Debug("mounted scratch volume", "path", scratchDir)
+			remoteCmd = ScratchDirEnvVar + "=" + scratchDir + " " + cmd
+		}
+
+		logger.Debug("running command remotely", "cmd", remoteCmd)
+		_, _, err = server.RunCmd(remoteCmd, false)
+
+		if scratchDir != "" && !server.Destroyed() {
+			erru := server.UnmountScratch(scratchDir)
+			if erru != nil {
+				logger.Warn("scratch volume removal failed", "path", scratchDir, "err", erru)
+			}
+		}
 
 		// if we got an error running the command, we won't use this server
 		// again
@@ -1083,6 +1322,7 @@ func (s *opst) runCmd(cmd string, req *Requirements, reservedCh chan bool) error
 	// waiting and potentially get scheduled on us instead
 	s.mutex.Lock()
 	server.Release(req.Cores, req.RAM, req.Disk)
+	s.serverJobs.remove(serverKey, req)
 	if s.waitingToSpawn > 0 {
 		for _, otherStandinServer := range s.standins {
 			if otherStandinServer.isExtraneous(server) {
@@ -0,0 +1,56 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains the code for runners to find out what the job scheduler
+// that started them calls them.
+
+import "os"
+
+// RunnerIDEnvVar is the environment variable a scheduleri implementation can
+// set for the runners it starts, to tell them the identifier it knows them by,
+// if it can't be worked out from the scheduler's own environment variables.
+const RunnerIDEnvVar = "WR_RUNNER_ID"
+
+// RunnerID returns the identifier that the external job scheduler which
+// started the current process knows it by, so that users can correlate what
+// wr says with the output of the scheduler's own tools: an LSF job ID like
+// "1234" (or "1234[5]" for a job array element), or a Kubernetes pod name.
+// Returns an empty string if not running under such a scheduler.
+func RunnerID() string {
+	if id := os.Getenv(RunnerIDEnvVar); id != "" {
+		return id
+	}
+
+	if id := os.Getenv("LSB_JOBID"); id != "" {
+		if index := os.Getenv("LSB_JOBINDEX"); index != "" && index != "0" {
+			id += "[" + index + "]"
+		}
+		return id
+	}
+
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		// pods get their name as their hostname
+		if name, err := os.Hostname(); err == nil {
+			return name
+		}
+	}
+
+	return ""
+}
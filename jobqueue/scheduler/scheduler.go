@@ -21,8 +21,12 @@ Package scheduler lets the jobqueue server interact with the configured job
 scheduler (if any) to submit jobqueue runner clients and have them run on a
 compute cluster (or local machine).
 
-Currently implemented schedulers are local, LSF and OpenStack. The
-implementation of each supported scheduler type is in its own .go file.
+Currently implemented schedulers are local, LSF and OpenStack (also usable with
+any cloud that Terraform supports, as "terraform"), along with "external",
+which delegates to a site-provided executable speaking a simple JSON protocol
+(see external.go), for job schedulers that aren't natively supported, and
+"simulator", which models a cloud without using one (see simulator.go).
+The implementation of each supported scheduler type is in its own .go file.
 
 It's a pseudo plug-in system in that it is designed so that you can easily add a
 go file that implements the methods of the scheduleri interface, to support a
@@ -43,7 +47,9 @@ import (
 	"crypto/md5" // #nosec - not used for cryptographic purposes here
 	"fmt"
 	"math/rand"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -89,6 +95,7 @@ type Requirements struct {
 	Time  time.Duration     // the expected time Cmd will take to run
 	Cores int               // how many processor cores the Cmd will use
 	Disk  int               // the required local disk space in GB the Cmd needs to run
+	Arch  string            // the CPU architecture (eg. "x86_64" or "aarch64") the Cmd needs to run on; empty means any
 	Other map[string]string // a map that will be passed through to the job scheduler, defining further arbitrary resource requirements
 }
 
@@ -114,7 +121,32 @@ func (req *Requirements) Stringify() string {
 		other = fmt.Sprintf(":%x", md5.Sum([]byte(other))) // #nosec
 	}
 
-	return fmt.Sprintf("%d:%.0f:%d:%d%s", req.RAM, req.Time.Minutes(), req.Cores, req.Disk, other)
+	var arch string
+	if req.Arch != "" {
+		arch = ":" + NormaliseArch(req.Arch)
+	}
+
+	return fmt.Sprintf("%d:%.0f:%d:%d%s%s", req.RAM, req.Time.Minutes(), req.Cores, req.Disk, arch, other)
+}
+
+// NormaliseArch converts the various names used for the same CPU architecture
+// in to a single canonical name, eg. "amd64" becomes "x86_64" and "arm64"
+// becomes "aarch64". Other names are returned lower-cased.
+func NormaliseArch(arch string) string {
+	arch = strings.ToLower(arch)
+	switch arch {
+	case "amd64", "x86-64", "x64":
+		return "x86_64"
+	case "arm64", "armv8":
+		return "aarch64"
+	}
+	return arch
+}
+
+// LocalArch returns the normalised CPU architecture of the machine we're
+// running on.
+func LocalArch() string {
+	return NormaliseArch(runtime.GOARCH)
 }
 
 // CmdStatus lets you describe how many of a given cmd are already in the job
@@ -148,6 +180,7 @@ type scheduleri interface {
 	busy() bool                                               // achieve the aims of Busy()
 	reserveTimeout() int                                      // achieve the aims of ReserveTimeout()
 	maxQueueTime(req *Requirements) time.Duration             // achieve the aims of MaxQueueTime()
+	negotiate(min, ideal *Requirements) *Requirements         // achieve the aims of Negotiate()
 	hostToID(host string) string                              // achieve the aims of HostToID()
 	setMessageCallBack(MessageCallBack)                       // achieve the aims of SetMessageCallBack()
 	setBadServerCallBack(BadServerCallBack)                   // achieve the aims of SetBadServerCallBack()
@@ -174,9 +207,11 @@ type Scheduler struct {
 }
 
 // New creates a new Scheduler to interact with the given job scheduler.
-// Possible names so far are "lsf", "local" and "openstack". You must also
-// provide a config struct appropriate for your chosen scheduler, eg. for the
-// local scheduler you will provide a ConfigLocal.
+// Possible names so far are "lsf", "local", "openstack", "terraform",
+// "external", "simulator", "ssh" and "kubernetes". You must also provide a config struct appropriate
+// for your chosen scheduler, eg. for the local scheduler you will provide a
+// ConfigLocal. (The "terraform" scheduler is the "openstack" one using the
+// terraform cloud provider, so also takes a ConfigOpenStack.)
 //
 // Providing a logger allows for debug messages to be logged somewhere, along
 // with any "harmless" or unreturnable errors. If not supplied, we use a default
@@ -190,6 +225,19 @@ func New(name string, config interface{}, logger ...log15.Logger) (*Scheduler, e
 		s = &Scheduler{impl: new(local)}
 	case "openstack":
 		s = &Scheduler{impl: new(opst)}
+	case "terraform":
+		s = &Scheduler{impl: new(opst)}
+		if c, ok := config.(*ConfigOpenStack); ok {
+			c.Provider = "terraform"
+		}
+	case "external":
+		s = &Scheduler{impl: new(external)}
+	case "simulator":
+		s = &Scheduler{impl: new(simulator)}
+	case "ssh":
+		s = &Scheduler{impl: new(sshPool)}
+	case "kubernetes":
+		s = &Scheduler{impl: new(kubernetes)}
 	default:
 		return nil, Error{name, "New", ErrBadScheduler}
 	}
@@ -294,12 +342,41 @@ func (s *Scheduler) MaxQueueTime(req *Requirements) time.Duration {
 	return s.impl.maxQueueTime(req)
 }
 
+// Negotiate is for jobs that can use a range of cores and RAM. Given the
+// minimum Requirements of such a job, and the ideal Requirements (which should
+// only differ in Cores and RAM), it returns Requirements somewhere in that
+// range, depending on what the job scheduler currently has available: the
+// ideal if possible, otherwise as close to it as can be run right now, falling
+// back to the minimum. The returned value is a new Requirements.
+func (s *Scheduler) Negotiate(min, ideal *Requirements) *Requirements {
+	return s.impl.negotiate(min, ideal)
+}
+
 // HostToID will return the server id of the server with the given host name, if
 // the scheduler is cloud based. Otherwise this just returns an empty string.
 func (s *Scheduler) HostToID(host string) string {
 	return s.impl.hostToID(host)
 }
 
+// SimulationReport returns the number of cmds run and the number and cost of
+// servers spawned so far, if this is the "simulator" scheduler. For other
+// schedulers it returns nil.
+func (s *Scheduler) SimulationReport() *SimReport {
+	if sim, ok := s.impl.(*simulator); ok {
+		return sim.report()
+	}
+	return nil
+}
+
+// CloudServers describes the servers spawned so far, if this is a cloud
+// scheduler (eg. "openstack"). For other schedulers it returns nil.
+func (s *Scheduler) CloudServers() []*CloudServer {
+	if cs, ok := s.impl.(*opst); ok {
+		return cs.cloudServers()
+	}
+	return nil
+}
+
 // Cleanup means you've finished using a scheduler and it can delete any
 // remaining jobs in its system and clean up any other used resources.
 func (s *Scheduler) Cleanup() {
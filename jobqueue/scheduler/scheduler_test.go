@@ -19,9 +19,12 @@
 package scheduler
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -50,12 +53,12 @@ func TestLocal(t *testing.T) {
 	runtime.GOMAXPROCS(maxCPU)
 
 	Convey("You can get a new local scheduler", t, func() {
-		s, err := New("local", &ConfigLocal{"bash", 1 * time.Second}, testLogger)
+		s, err := New("local", &ConfigLocal{Shell: "bash", StateUpdateFrequency: 1 * time.Second}, testLogger)
 		So(err, ShouldBeNil)
 		So(s, ShouldNotBeNil)
 
-		possibleReq := &Requirements{1, 1 * time.Second, 1, 20, otherReqs}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs}
+		possibleReq := &Requirements{1, 1 * time.Second, 1, 20, "", otherReqs}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, "", otherReqs}
 
 		Convey("ReserveTimeout() returns 1 second", func() {
 			So(s.ReserveTimeout(), ShouldEqual, 1)
@@ -78,6 +81,77 @@ func TestLocal(t *testing.T) {
 			other["goo"] = "lar"
 			testReq.Other = other
 			So(testReq.Stringify(), ShouldEqual, "300:120:2:0:f88250fdf9c81d47c18d63354b85f26e")
+			testReq.Arch = "arm64"
+			So(testReq.Stringify(), ShouldEqual, "300:120:2:0:aarch64:f88250fdf9c81d47c18d63354b85f26e")
+		})
+
+		Convey("NormaliseArch() works", func() {
+			So(NormaliseArch("amd64"), ShouldEqual, "x86_64")
+			So(NormaliseArch("x86-64"), ShouldEqual, "x86_64")
+			So(NormaliseArch("ARM64"), ShouldEqual, "aarch64")
+			So(NormaliseArch("ppc64le"), ShouldEqual, "ppc64le")
+			So(LocalArch(), ShouldEqual, NormaliseArch(runtime.GOARCH))
+		})
+
+		Convey("RunnerID() works", func() {
+			vars := []string{RunnerIDEnvVar, "LSB_JOBID", "LSB_JOBINDEX", "KUBERNETES_SERVICE_HOST"}
+			orig := make(map[string]string)
+			for _, v := range vars {
+				orig[v] = os.Getenv(v)
+				os.Unsetenv(v)
+			}
+			defer func() {
+				for v, val := range orig {
+					if val != "" {
+						os.Setenv(v, val)
+					}
+				}
+			}()
+
+			So(RunnerID(), ShouldBeBlank)
+			os.Setenv("LSB_JOBID", "1234")
+			So(RunnerID(), ShouldEqual, "1234")
+			os.Setenv("LSB_JOBINDEX", "0")
+			So(RunnerID(), ShouldEqual, "1234")
+			os.Setenv("LSB_JOBINDEX", "5")
+			So(RunnerID(), ShouldEqual, "1234[5]")
+			os.Setenv(RunnerIDEnvVar, "pod-a")
+			So(RunnerID(), ShouldEqual, "pod-a")
+			os.Unsetenv(RunnerIDEnvVar)
+			os.Unsetenv("LSB_JOBID")
+			os.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+			host, err := os.Hostname()
+			So(err, ShouldBeNil)
+			So(RunnerID(), ShouldEqual, host)
+			os.Unsetenv("KUBERNETES_SERVICE_HOST")
+			os.Unsetenv("LSB_JOBINDEX")
+		})
+
+		Convey("Negotiate() grants as much of a range as is available", func() {
+			min := &Requirements{RAM: 1, Time: 1 * time.Second, Cores: 1}
+			granted := s.Negotiate(min, &Requirements{RAM: 1, Time: 1 * time.Second, Cores: maxCPU})
+			So(granted.Cores, ShouldEqual, maxCPU)
+			So(granted.RAM, ShouldEqual, 1)
+			So(min.Cores, ShouldEqual, 1)
+
+			granted = s.Negotiate(min, &Requirements{RAM: 1, Time: 1 * time.Second, Cores: maxCPU * 4})
+			So(granted.Cores, ShouldBeGreaterThanOrEqualTo, 1)
+			So(granted.Cores, ShouldBeLessThanOrEqualTo, maxCPU)
+
+			granted = s.Negotiate(min, min)
+			So(granted.Cores, ShouldEqual, 1)
+		})
+
+		Convey("Schedule() gives impossible error for other architectures", func() {
+			otherArch := "aarch64"
+			if LocalArch() == otherArch {
+				otherArch = "x86_64"
+			}
+			err := s.Schedule("foo", &Requirements{RAM: 1, Time: 1 * time.Second, Cores: 1, Arch: otherArch}, 1)
+			So(err, ShouldNotBeNil)
+			serr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(serr.Err, ShouldEqual, ErrImpossible)
 		})
 
 		Convey("Schedule() gives impossible error when given impossible reqs", func() {
@@ -88,6 +162,31 @@ func TestLocal(t *testing.T) {
 			So(serr.Err, ShouldEqual, ErrImpossible)
 		})
 
+		Convey("Schedule() checks quota before trying to run more of a cmd", func() {
+			var qcMutex sync.Mutex
+			var checked []int
+			s.impl.(*local).quotaCheckFunc = func(req *Requirements, count int) {
+				qcMutex.Lock()
+				defer qcMutex.Unlock()
+				checked = append(checked, count)
+			}
+			// only 1 of these can run at once, and it's excluded from the
+			// number checked
+			allCoresReq := &Requirements{1, 1 * time.Minute, maxCPU, 0, "", otherReqs}
+			err := s.Schedule("sleep 2", allCoresReq, 3)
+			So(err, ShouldBeNil)
+			err = s.Schedule("sleep 2", allCoresReq, 2)
+			So(err, ShouldBeNil)
+			err = s.Schedule("sleep 2", allCoresReq, 5)
+			So(err, ShouldBeNil)
+			err = s.Schedule("sleep 2", allCoresReq, 0)
+			So(err, ShouldBeNil)
+
+			qcMutex.Lock()
+			So(checked, ShouldResemble, []int{3, 4})
+			qcMutex.Unlock()
+		})
+
 		Convey("Schedule() lets you schedule more jobs than localhost CPUs", func() {
 			tmpdir, err := ioutil.TempDir("", "wr_schedulers_local_test_immediate_output_dir_")
 			if err != nil {
@@ -225,13 +324,50 @@ func TestLocal(t *testing.T) {
 
 					So(waitToFinish(s, 3, 100), ShouldBeTrue)
 				})
-
-				//*** want a test where the first job fills up all resources
-				// and has more to do, and a second job could slip and complete
-				// before resources for the first become available
 			}
 		})
 
+		if maxCPU > 2 {
+			Convey("Schedule() backfills short jobs while an older job waits for resources", func() {
+				tmpdir, err := ioutil.TempDir("", "wr_schedulers_local_test_backfill_dir_")
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer os.RemoveAll(tmpdir)
+				tmpdir2, err := ioutil.TempDir("", "wr_schedulers_local_test_nobackfill_dir_")
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer os.RemoveAll(tmpdir2)
+
+				// fill all but 1 core with a job that we claim will take an
+				// hour, then ask for a job that needs every core
+				longReq := &Requirements{1, 1 * time.Hour, maxCPU - 1, 0, "", otherReqs}
+				err = s.Schedule("sleep 2", longReq, 1)
+				So(err, ShouldBeNil)
+				bigReq := &Requirements{1, 1 * time.Minute, maxCPU, 0, "", otherReqs}
+				err = s.Schedule("sleep 0.1", bigReq, 1)
+				So(err, ShouldBeNil)
+
+				// a short job fits in the free core and will finish before
+				// the big one could start, but a job that will take longer
+				// than the long one must wait its turn
+				shortReq := &Requirements{1, 1 * time.Second, 1, 0, "", otherReqs}
+				err = s.Schedule(fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]);'", tmpdir), shortReq, 1)
+				So(err, ShouldBeNil)
+				slowReq := &Requirements{1, 2 * time.Hour, 1, 0, "", otherReqs}
+				err = s.Schedule(fmt.Sprintf("perl -MFile::Temp=tempfile -e '@a = tempfile(DIR => q[%s]);'", tmpdir2), slowReq, 1)
+				So(err, ShouldBeNil)
+
+				<-time.After(1 * time.Second)
+				So(testDirForFiles(tmpdir, 1), ShouldEqual, 1)
+				So(testDirForFiles(tmpdir2, 0), ShouldEqual, 0)
+
+				So(waitToFinish(s, 10, 100), ShouldBeTrue)
+				So(testDirForFiles(tmpdir2, 1), ShouldEqual, 1)
+			})
+		}
+
 		// wait a while for any remaining jobs to finish
 		So(waitToFinish(s, 30, 100), ShouldBeTrue)
 	})
@@ -257,8 +393,8 @@ func TestLSF(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(s, ShouldNotBeNil)
 
-		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, otherReqs}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs}
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 20, "", otherReqs}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, "", otherReqs}
 
 		Convey("ReserveTimeout() returns 25 seconds", func() {
 			So(s.ReserveTimeout(), ShouldEqual, 1)
@@ -273,30 +409,30 @@ func TestLSF(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, otherReqs}, 0)
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, "", otherReqs}, 0)
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, otherReqs}, 10)
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 5 * time.Minute, 1, 20, "", otherReqs}, 10)
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "yesterday")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{37000, 1 * time.Hour, 1, 20, otherReqs}, 0)
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{37000, 1 * time.Hour, 1, 20, "", otherReqs}, 0)
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "normal") // used to be "test" before our memory limits were removed from all queues
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs}, 0)
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 13 * time.Hour, 1, 20, "", otherReqs}, 0)
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "long")
 
-				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 73 * time.Hour, 1, 20, otherReqs}, 0)
+				queue, err = s.impl.(*lsf).determineQueue(&Requirements{1, 73 * time.Hour, 1, 20, "", otherReqs}, 0)
 				So(err, ShouldBeNil)
 				So(queue, ShouldEqual, "basement")
 			})
 
 			Convey("MaxQueueTime() returns appropriate times depending on the requirements", func() {
 				So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 720)
-				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs}).Minutes(), ShouldEqual, 4320)
+				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, "", otherReqs}).Minutes(), ShouldEqual, 4320)
 			})
 		}
 
@@ -409,6 +545,471 @@ func TestLSF(t *testing.T) {
 	})
 }
 
+func TestExternal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "wr_scheduler_external_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	logFile := filepath.Join(tmpdir, "requests")
+	exe := filepath.Join(tmpdir, "exe")
+	script := `#!/bin/bash
+req=$(cat)
+echo "$req" >> ` + logFile + `
+case "$req" in
+    *'"op":"init"'*) echo '{"protocol":1}' ;;
+    *'"op":"busy"'*) echo '{"busy":true}' ;;
+    *'"op":"max_queue_time"'*) echo '{"max_queue_time":3600}' ;;
+    *'"cores":99'*) echo '{"impossible":true}' ;;
+    *'"cores":98'*) echo '{"error":"queue is closed"}' ;;
+    *) echo '{}' ;;
+esac
+`
+	err = ioutil.WriteFile(exe, []byte(script), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("You can't get a new external scheduler without a working executable", t, func() {
+		_, err := New("external", &ConfigExternal{Deployment: "development", Shell: "bash"}, testLogger)
+		So(err, ShouldNotBeNil)
+		_, err = New("external", &ConfigExternal{Executable: "/bin/false", Deployment: "development", Shell: "bash"}, testLogger)
+		So(err, ShouldNotBeNil)
+		_, err = New("external", &ConfigExternal{Executable: "echo '{\"protocol\":2}'", Deployment: "development", Shell: "bash"}, testLogger)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can get a new external scheduler", t, func() {
+		s, err := New("external", &ConfigExternal{Executable: exe, Deployment: "development", Shell: "bash"}, testLogger)
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+
+		readLog := func() string {
+			content, errr := ioutil.ReadFile(logFile)
+			So(errr, ShouldBeNil)
+			return string(content)
+		}
+		So(readLog(), ShouldContainSubstring, `"protocol":1,"op":"init","deployment":"development"`)
+
+		Convey("Requests are passed to the executable and its responses understood", func() {
+			So(s.ReserveTimeout(), ShouldEqual, 1)
+			So(s.Busy(), ShouldBeTrue)
+			So(s.MaxQueueTime(&Requirements{100, 1 * time.Minute, 1, 0, "", otherReqs}), ShouldEqual, 1*time.Hour)
+
+			err = s.Schedule("echo 1", &Requirements{100, 1 * time.Minute, 2, 1, "amd64", otherReqs}, 3)
+			So(err, ShouldBeNil)
+			So(readLog(), ShouldContainSubstring, `"op":"schedule","deployment":"development","name":"`+jobName("echo 1", "development", false)+`","cmd":"echo 1","count":3,"requirements":{"ram":100,"time":60,"cores":2,"disk":1,"arch":"x86_64"}`)
+
+			err = s.Schedule("echo 1", &Requirements{100, 1 * time.Minute, 99, 1, "", otherReqs}, 1)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrImpossible)
+
+			err = s.Schedule("echo 1", &Requirements{100, 1 * time.Minute, 98, 1, "", otherReqs}, 1)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "queue is closed")
+
+			s.Cleanup()
+			So(readLog(), ShouldContainSubstring, `"op":"terminate","deployment":"development","name":"wrd_"`)
+		})
+	})
+}
+
+func TestSimulator(t *testing.T) {
+	small := &SimFlavor{Name: "small", Cores: 2, RAM: 4000, Disk: 20, Price: 1}
+	large := &SimFlavor{Name: "large", Cores: 8, RAM: 16000, Disk: 80, Price: 3}
+
+	Convey("Simulate() models the time and cost of running jobs", t, func() {
+		config := &ConfigSimulator{Flavors: []*SimFlavor{large, small}, MaxInstances: 2, SpawnTime: 10 * time.Minute}
+		req := &Requirements{RAM: 1000, Time: 1 * time.Hour, Cores: 1}
+
+		report, err := Simulate(config, []*Requirements{req, req, req, req})
+		So(err, ShouldBeNil)
+		So(report.Jobs, ShouldEqual, 4)
+		So(report.Servers, ShouldEqual, 2)
+		So(report.PeakServers, ShouldEqual, 2)
+		So(report.Duration, ShouldEqual, 70*time.Minute)
+		So(report.Cost, ShouldAlmostEqual, 2*70.0/60.0, 0.0001)
+
+		report, err = Simulate(config, []*Requirements{req, req, req, req, req, req})
+		So(err, ShouldBeNil)
+		So(report.Jobs, ShouldEqual, 6)
+		So(report.Servers, ShouldBeBetweenOrEqual, 2, 3)
+		So(report.PeakServers, ShouldEqual, 2)
+		So(report.Duration, ShouldEqual, 130*time.Minute)
+
+		report, err = Simulate(config, []*Requirements{{RAM: 1000, Time: 1 * time.Hour, Cores: 4}})
+		So(err, ShouldBeNil)
+		So(report.Cost, ShouldAlmostEqual, 3*70.0/60.0, 0.0001)
+
+		_, err = Simulate(config, []*Requirements{{RAM: 1000, Time: 1 * time.Hour, Cores: 16}})
+		So(err, ShouldNotBeNil)
+		serr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(serr.Err, ShouldEqual, ErrImpossible)
+
+		config.MaxCores = 4
+		_, err = Simulate(config, []*Requirements{{RAM: 1000, Time: 1 * time.Hour, Cores: 6}})
+		So(err, ShouldNotBeNil)
+		serr, ok = err.(Error)
+		So(ok, ShouldBeTrue)
+		So(serr.Err, ShouldEqual, ErrOverQuota)
+	})
+
+	Convey("You can't get a new simulator scheduler without flavors", t, func() {
+		_, err := New("simulator", &ConfigSimulator{Shell: "bash"}, testLogger)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can get a new simulator scheduler", t, func() {
+		s, err := New("simulator", &ConfigSimulator{Flavors: []*SimFlavor{small}, MaxInstances: 1, SpawnTime: 200 * time.Millisecond, Shell: "bash"}, testLogger)
+		So(err, ShouldBeNil)
+		So(s, ShouldNotBeNil)
+		defer s.Cleanup()
+		So(s.Busy(), ShouldBeFalse)
+		So(s.SimulationReport().Servers, ShouldEqual, 0)
+
+		Convey("Schedule() runs cmds once the simulated server is ready", func() {
+			err = s.Schedule("echo 2", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 4}, 1)
+			So(err, ShouldNotBeNil)
+
+			before := time.Now()
+			err = s.Schedule("sleep 0.1", &Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}, 3)
+			So(err, ShouldBeNil)
+			So(s.Busy(), ShouldBeTrue)
+
+			limit := time.After(10 * time.Second)
+		WAIT:
+			for {
+				select {
+				case <-time.After(10 * time.Millisecond):
+					if !s.Busy() {
+						break WAIT
+					}
+				case <-limit:
+					break WAIT
+				}
+			}
+			So(s.Busy(), ShouldBeFalse)
+			So(time.Since(before), ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+
+			report := s.SimulationReport()
+			So(report.Jobs, ShouldEqual, 3)
+			So(report.Servers, ShouldEqual, 1)
+			So(report.PeakServers, ShouldEqual, 1)
+			So(report.Cost, ShouldBeGreaterThan, 0)
+		})
+	})
+
+	Convey("Other schedulers have no SimulationReport", t, func() {
+		s, err := New("local", &ConfigLocal{Shell: "bash"}, testLogger)
+		So(err, ShouldBeNil)
+		So(s.SimulationReport(), ShouldBeNil)
+	})
+}
+
+func TestCloudScripts(t *testing.T) {
+	Convey("Post creation scripts can be templates", t, func() {
+		data := &ScriptData{Flavor: "g1.large", Cores: 8, RAM: 64000, Disk: 20, OS: "Ubuntu", Vars: parseScriptVars("packages=samtools bwa, swappiness = 1,bad")}
+		So(data.Vars, ShouldResemble, map[string]string{"packages": "samtools bwa", "swappiness": "1"})
+
+		script := []byte("#!/bin/bash\necho ${HOME}\n")
+		rendered, err := renderScript(script, data)
+		So(err, ShouldBeNil)
+		So(rendered, ShouldResemble, script)
+
+		rendered, err = renderScript([]byte("apt-get install -y {{.Vars.packages}}\n{{if gt .RAM 32000}}sysctl vm.swappiness={{.Vars.swappiness}}{{end}}\n{{.Vars.missing}}# {{.Flavor}} {{.OS}}"), data)
+		So(err, ShouldBeNil)
+		So(string(rendered), ShouldEqual, "apt-get install -y samtools bwa\nsysctl vm.swappiness=1\n# g1.large Ubuntu")
+
+		_, err = renderScript([]byte("{{.Nonsense"), data)
+		So(err, ShouldNotBeNil)
+
+		So(ScriptVersion(nil), ShouldEqual, "")
+		So(len(ScriptVersion(script)), ShouldEqual, 12)
+		So(ScriptVersion(script), ShouldEqual, ScriptVersion([]byte("#!/bin/bash\necho ${HOME}\n")))
+		So(ScriptVersion(script), ShouldNotEqual, ScriptVersion(rendered))
+
+		scripts := map[string][]byte{"^g1\\.": []byte("gpu"), "large$": []byte("large"), "[": []byte("invalid")}
+		So(string(flavorScript(scripts, "g1.large")), ShouldEqual, "gpu")
+		So(string(flavorScript(scripts, "m1.large")), ShouldEqual, "large")
+		So(flavorScript(scripts, "m1.small"), ShouldBeNil)
+		So(flavorScript(nil, "m1.small"), ShouldBeNil)
+	})
+}
+
+func TestSSH(t *testing.T) {
+	Convey("You can't create a new ssh scheduler without hosts and a key", t, func() {
+		_, err := New("ssh", &ConfigSSH{PrivateKey: "key", User: "user"})
+		So(err, ShouldNotBeNil)
+		_, err = New("ssh", &ConfigSSH{Hosts: []*SSHHost{{Addr: "a", Cores: 1, RAM: 1000}}, User: "user"})
+		So(err, ShouldNotBeNil)
+		_, err = New("ssh", &ConfigSSH{Hosts: []*SSHHost{{Addr: "a", Cores: 1}}, User: "user", PrivateKey: "key"})
+		So(err, ShouldNotBeNil)
+		_, err = New("ssh", &ConfigSSH{Hosts: []*SSHHost{{Addr: "a", Cores: 1, RAM: 1000}, {Addr: "a", Cores: 1, RAM: 1000}}, User: "user", PrivateKey: "key"})
+		So(err, ShouldNotBeNil)
+		_, err = New("ssh", &ConfigSSH{Hosts: []*SSHHost{{Addr: "a", Cores: 1, RAM: 1000}}, PrivateKey: "key"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("An ssh scheduler knows what its hosts can run", t, func() {
+		config := &ConfigSSH{
+			Hosts: []*SSHHost{
+				{Addr: "small", Cores: 2, RAM: 4000, Disk: 10},
+				{Addr: "large", User: "other", Cores: 8, RAM: 16000},
+			},
+			User:       "user",
+			PrivateKey: "key",
+			Shell:      "bash",
+		}
+		s, err := New("ssh", config)
+		So(err, ShouldBeNil)
+		defer s.Cleanup()
+		pool := s.impl.(*sshPool)
+		So(len(pool.hosts), ShouldEqual, 2)
+		So(pool.hosts[0].UserName, ShouldEqual, "user")
+		So(pool.hosts[1].UserName, ShouldEqual, "other")
+
+		So(pool.reqCheck(&Requirements{RAM: 16000, Cores: 8}), ShouldBeNil)
+		So(pool.reqCheck(&Requirements{RAM: 1000, Cores: 1, Disk: 10}), ShouldBeNil)
+		So(pool.reqCheck(&Requirements{RAM: 1000, Cores: 4, Disk: 10}), ShouldNotBeNil)
+		So(pool.reqCheck(&Requirements{RAM: 32000, Cores: 1}), ShouldNotBeNil)
+		So(pool.reqCheck(&Requirements{RAM: 1000, Cores: 1, Arch: "not_" + LocalArch()}), ShouldNotBeNil)
+
+		req := &Requirements{RAM: 2000, Cores: 1}
+		So(pool.canCount(req), ShouldEqual, 10)
+
+		pool.hosts[1].Allocate(4, 8000, 0)
+		So(pool.canCount(req), ShouldEqual, 6)
+
+		pool.hosts[0].GoneBad("test")
+		So(pool.canCount(req), ShouldEqual, 4)
+
+		remote, err := pool.prepare(&sshPoolHost{exes: map[string]string{"/bin/sh": "/tmp/x/sh"}}, "/bin/sh -c 'true'")
+		So(err, ShouldBeNil)
+		So(remote, ShouldEqual, "/tmp/x/sh -c 'true'")
+	})
+
+	Convey("The number of cmds run at once per host can be capped", t, func() {
+		config := &ConfigSSH{
+			Hosts: []*SSHHost{
+				{Addr: "small", Cores: 2, RAM: 4000, Disk: 10},
+				{Addr: "large", Cores: 8, RAM: 16000},
+			},
+			User:           "user",
+			PrivateKey:     "key",
+			Shell:          "bash",
+			MaxJobsPerHost: 3,
+		}
+		s, err := New("ssh", config)
+		So(err, ShouldBeNil)
+		defer s.Cleanup()
+		pool := s.impl.(*sshPool)
+
+		req := &Requirements{RAM: 1000, Cores: 1}
+		So(pool.canCount(req), ShouldEqual, 5)
+
+		groupReq := &Requirements{RAM: 1000, Cores: 1, Other: map[string]string{MaxPerHostKey: "1"}}
+		So(pool.canCount(groupReq), ShouldEqual, 2)
+
+		large := pool.hosts[1].Name
+		pool.hostJobs.add(large, groupReq, 1)
+		So(pool.canCount(groupReq), ShouldEqual, 1)
+		So(pool.canCount(req), ShouldEqual, 4)
+		pool.hostJobs.add(large, req, 2)
+		So(pool.canCount(req), ShouldEqual, 2)
+		So(pool.hostJobs.hasSpace(large, req), ShouldBeFalse)
+
+		pool.hostJobs.remove(large, groupReq)
+		So(pool.canCount(groupReq), ShouldEqual, 2)
+		So(pool.canCount(req), ShouldEqual, 3)
+
+		pool.hostJobs.move(large, "other")
+		So(pool.canCount(req), ShouldEqual, 5)
+		pool.hostJobs.forget("other")
+		So(pool.hostJobs.fit("other", req, 10), ShouldEqual, 3)
+		So(pool.hostJobs.fitNew(groupReq, 10), ShouldEqual, 1)
+
+		var none *hostJobs
+		So(none.fit("any", req, 10), ShouldEqual, 10)
+
+		ls, err := New("local", &ConfigLocal{Shell: "bash", MaxJobsPerHost: 1}, testLogger)
+		So(err, ShouldBeNil)
+		defer ls.Cleanup()
+		So(ls.impl.(*local).canCount(&Requirements{RAM: 1, Cores: 1}), ShouldEqual, 1)
+	})
+}
+
+func TestKubernetes(t *testing.T) {
+	Convey("You can't create a new kubernetes scheduler without an image", t, func() {
+		_, err := New("kubernetes", &ConfigKubernetes{APIServer: "http://localhost", Shell: "bash"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("parseKubeQuantity() understands kubernetes quantities", t, func() {
+		for q, expected := range map[string]float64{"2": 2, "500m": 0.5, "1Ki": 1024, "4Gi": 4 << 30, "1000Mi": 1000 << 20, "1G": 1e9} {
+			n, err := parseKubeQuantity(q)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, expected)
+		}
+		_, err := parseKubeQuantity("lots")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A kubernetes scheduler runs cmds in pods within quota", t, func() {
+		var mutex sync.Mutex
+		var createdPods []map[string]interface{}
+		var deleted []string
+		secrets := make(map[string]map[string]interface{})
+		pods := make(map[string]string)
+		podsUsed := 0
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			prefix := "/api/v1/namespaces/wr/"
+			if !strings.HasPrefix(r.URL.Path, prefix) || r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			var body map[string]interface{}
+			if r.Method == "POST" || r.Method == "PUT" {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			switch {
+			case path == "resourcequotas":
+				fmt.Fprintf(w, `{"items":[{"status":{"hard":{"pods":"3","requests.cpu":"4","requests.memory":"8Gi"},"used":{"pods":"%d","requests.cpu":"%d","requests.memory":"%dGi"}}}]}`, podsUsed, podsUsed, podsUsed)
+			case strings.HasPrefix(path, "secrets/") && r.Method == "PUT":
+				name := strings.TrimPrefix(path, "secrets/")
+				if _, exists := secrets[name]; !exists {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{"message":"not found"}`)
+					return
+				}
+				secrets[name] = body
+			case path == "secrets" && r.Method == "POST":
+				secrets[body["metadata"].(map[string]interface{})["name"].(string)] = body
+			case path == "pods" && r.Method == "POST":
+				name := fmt.Sprintf("wr-runner-%d", len(createdPods))
+				createdPods = append(createdPods, body)
+				pods[name] = "Running"
+				podsUsed++
+				fmt.Fprintf(w, `{"metadata":{"name":"%s"}}`, name)
+			case path == "pods" && r.Method == "DELETE":
+				deleted = append(deleted, r.URL.Query().Get("labelSelector"))
+			case strings.HasPrefix(path, "pods/"):
+				name := strings.TrimPrefix(path, "pods/")
+				phase, exists := pods[name]
+				if !exists {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if r.Method == "DELETE" {
+					delete(pods, name)
+					deleted = append(deleted, name)
+					podsUsed--
+					return
+				}
+				fmt.Fprintf(w, `{"status":{"phase":"%s"}}`, phase)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer api.Close()
+
+		origPoll := kubePollInterval
+		kubePollInterval = 10 * time.Millisecond
+		defer func() {
+			kubePollInterval = origPoll
+		}()
+
+		tmpdir, err := ioutil.TempDir("", "wr_schedulers_kube_test_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpdir)
+		tokenFile := filepath.Join(tmpdir, "token")
+		err = ioutil.WriteFile(tokenFile, []byte("managertoken"), 0600)
+		So(err, ShouldBeNil)
+
+		s, err := New("kubernetes", &ConfigKubernetes{
+			APIServer:        api.URL,
+			BearerToken:      "tok",
+			Namespace:        "wr",
+			Image:            "wr:latest",
+			ManagerTokenFile: tokenFile,
+			Deployment:       "development",
+			Shell:            "bash",
+		}, testLogger)
+		So(err, ShouldBeNil)
+		defer s.Cleanup()
+		k := s.impl.(*kubernetes)
+
+		So(k.reqCheck(&Requirements{RAM: 1000, Cores: 1}), ShouldBeNil)
+		So(k.reqCheck(&Requirements{RAM: 1000, Cores: 5}), ShouldNotBeNil)
+		So(k.reqCheck(&Requirements{RAM: 9000, Cores: 1}), ShouldNotBeNil)
+		So(k.reqCheck(&Requirements{RAM: 1000, Cores: 1, Arch: "aarch64"}), ShouldBeNil)
+		spec := k.podSpec("wr runner", &Requirements{RAM: 1000, Cores: 1, Arch: "aarch64"})["spec"].(map[string]interface{})
+		So(spec["nodeSelector"], ShouldResemble, map[string]string{"kubernetes.io/arch": "arm64"})
+		So(k.canCount(&Requirements{RAM: 1000, Cores: 1}), ShouldEqual, 3)
+		So(k.canCount(&Requirements{RAM: 3000, Cores: 1}), ShouldEqual, 2)
+		So(k.canCount(&Requirements{RAM: 1000, Cores: 2}), ShouldEqual, 2)
+
+		err = s.Schedule("/path/to/wr runner -s 'a'", &Requirements{RAM: 1000, Time: 1 * time.Minute, Cores: 1, Disk: 2}, 5)
+		So(err, ShouldBeNil)
+
+		podCount := func() int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(createdPods)
+		}
+		<-time.After(200 * time.Millisecond)
+		So(podCount(), ShouldEqual, 3)
+		So(s.Busy(), ShouldBeTrue)
+
+		mutex.Lock()
+		So(secrets, ShouldContainKey, "wr-manager-development")
+		data := secrets["wr-manager-development"]["data"].(map[string]interface{})
+		So(data["token"], ShouldEqual, "bWFuYWdlcnRva2Vu")
+		container := createdPods[0]["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+		So(container["image"], ShouldEqual, "wr:latest")
+		So(container["command"], ShouldResemble, []interface{}{"bash", "-c", "wr runner -s 'a'"})
+		limits := container["resources"].(map[string]interface{})["limits"].(map[string]interface{})
+		So(limits["cpu"], ShouldEqual, "1")
+		So(limits["memory"], ShouldEqual, "1000Mi")
+		So(limits["ephemeral-storage"], ShouldEqual, "2Gi")
+		So(createdPods[0]["spec"].(map[string]interface{}), ShouldNotContainKey, "nodeSelector")
+
+		// finishing pods frees up quota for the rest
+		for name := range pods {
+			pods[name] = "Succeeded"
+		}
+		mutex.Unlock()
+
+		<-time.After(200 * time.Millisecond)
+		So(podCount(), ShouldEqual, 5)
+		mutex.Lock()
+		So(len(deleted), ShouldEqual, 3)
+		for name := range pods {
+			pods[name] = "Failed"
+		}
+		mutex.Unlock()
+
+		<-time.After(200 * time.Millisecond)
+		So(s.Busy(), ShouldBeFalse)
+		mutex.Lock()
+		So(len(pods), ShouldEqual, 0)
+		mutex.Unlock()
+
+		s.Cleanup()
+		mutex.Lock()
+		So(deleted[len(deleted)-1], ShouldEqual, "wr-manager="+k.managerID)
+		mutex.Unlock()
+	})
+}
+
 func TestOpenstack(t *testing.T) {
 	// check if we have our special openstack-related variable
 	osPrefix := os.Getenv("OS_OS_PREFIX")
@@ -454,8 +1055,8 @@ func TestOpenstack(t *testing.T) {
 		defer s.Cleanup()
 		oss := s.impl.(*opst)
 
-		possibleReq := &Requirements{100, 1 * time.Minute, 1, 1, otherReqs}
-		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, otherReqs}
+		possibleReq := &Requirements{100, 1 * time.Minute, 1, 1, "", otherReqs}
+		impossibleReq := &Requirements{9999999999, 999999 * time.Hour, 99999, 20, "", otherReqs}
 
 		Convey("ReserveTimeout() returns 25 seconds", func() {
 			So(s.ReserveTimeout(), ShouldEqual, 1)
@@ -475,7 +1076,7 @@ func TestOpenstack(t *testing.T) {
 					So(flavor.Disk, ShouldEqual, 8)
 					So(flavor.Cores, ShouldEqual, 1)
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 1, 20, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 1, 20, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2000") // we now ignore the 20GB disk requirement
 
@@ -484,53 +1085,53 @@ func TestOpenstack(t *testing.T) {
 					So(flavor.ID, ShouldEqual, "2001")
 					So(flavor.RAM, ShouldEqual, 4096)
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 2, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 2, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2001")
 					So(flavor.RAM, ShouldEqual, 4096)
 					So(flavor.Disk, ShouldEqual, 12)
 					So(flavor.Cores, ShouldEqual, 2)
 
-					flavor, err = oss.determineFlavor(&Requirements{5000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{5000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2002")
 					So(flavor.RAM, ShouldEqual, 16384)
 					So(flavor.Disk, ShouldEqual, 20)
 					So(flavor.Cores, ShouldEqual, 4)
 
-					flavor, err = oss.determineFlavor(&Requirements{64000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{64000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2003")
 					So(flavor.RAM, ShouldEqual, 65536)
 					So(flavor.Disk, ShouldEqual, 20)
 					So(flavor.Cores, ShouldEqual, 8)
 
-					flavor, err = oss.determineFlavor(&Requirements{66000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{66000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2004")
 					So(flavor.RAM, ShouldEqual, 122880)
 					So(flavor.Disk, ShouldEqual, 128)
 					So(flavor.Cores, ShouldEqual, 16)
 
-					flavor, err = oss.determineFlavor(&Requirements{261000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{261000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2005")
 					So(flavor.RAM, ShouldEqual, 262144)
 					So(flavor.Disk, ShouldEqual, 128)
 					So(flavor.Cores, ShouldEqual, 52)
 
-					flavor, err = oss.determineFlavor(&Requirements{263000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{263000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2006")
 					So(flavor.RAM, ShouldEqual, 496640)
 					So(flavor.Disk, ShouldEqual, 128)
 					So(flavor.Cores, ShouldEqual, 56)
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 3, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 3, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2002")
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 5, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 5, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2003")
 				} else {
@@ -540,7 +1141,7 @@ func TestOpenstack(t *testing.T) {
 					So(flavor.Disk, ShouldEqual, 16)
 					So(flavor.Cores, ShouldEqual, 1)
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 1, 20, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 1, 20, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2000")
 
@@ -548,39 +1149,39 @@ func TestOpenstack(t *testing.T) {
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2000")
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 2, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 2, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2001")
 					So(flavor.RAM, ShouldEqual, 18200)
 					So(flavor.Disk, ShouldEqual, 32)
 					So(flavor.Cores, ShouldEqual, 2)
 
-					flavor, err = oss.determineFlavor(&Requirements{30000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{30000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2002")
 					So(flavor.RAM, ShouldEqual, 36400)
 					So(flavor.Disk, ShouldEqual, 64)
 					So(flavor.Cores, ShouldEqual, 4)
 
-					flavor, err = oss.determineFlavor(&Requirements{64000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{64000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2003")
 					So(flavor.RAM, ShouldEqual, 72800)
 					So(flavor.Disk, ShouldEqual, 129)
 					So(flavor.Cores, ShouldEqual, 8)
 
-					flavor, err = oss.determineFlavor(&Requirements{120000, 1 * time.Minute, 1, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{120000, 1 * time.Minute, 1, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2004")
 					So(flavor.RAM, ShouldEqual, 145600)
 					So(flavor.Disk, ShouldEqual, 258)
 					So(flavor.Cores, ShouldEqual, 16)
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 3, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 3, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2002")
 
-					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 5, 1, otherReqs})
+					flavor, err = oss.determineFlavor(&Requirements{100, 1 * time.Minute, 5, 1, "", otherReqs})
 					So(err, ShouldBeNil)
 					So(flavor.ID, ShouldEqual, "2003")
 				}
@@ -588,7 +1189,7 @@ func TestOpenstack(t *testing.T) {
 
 			Convey("MaxQueueTime() always returns 'infinite'", func() {
 				So(s.MaxQueueTime(possibleReq).Minutes(), ShouldEqual, 0)
-				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, otherReqs}).Minutes(), ShouldEqual, 0)
+				So(s.MaxQueueTime(&Requirements{1, 13 * time.Hour, 1, 20, "", otherReqs}).Minutes(), ShouldEqual, 0)
 			})
 		}
 
@@ -608,7 +1209,7 @@ func TestOpenstack(t *testing.T) {
 			Convey("Schedule() gives impossible error when reqs don't fit in the requested flavor", func() {
 				other := make(map[string]string)
 				other["cloud_flavor"] = "o1.tiny"
-				brokenReq := &Requirements{2000, 1 * time.Minute, 1, 1, other}
+				brokenReq := &Requirements{2000, 1 * time.Minute, 1, 1, "", other}
 				err := s.Schedule("foo", brokenReq, 1)
 				So(err, ShouldNotBeNil)
 				serr, ok := err.(Error)
@@ -643,7 +1244,7 @@ func TestOpenstack(t *testing.T) {
 
 				flavor, err := oss.determineFlavor(r)
 				So(err, ShouldBeNil)
-				testReq := &Requirements{flavor.RAM, 1 * time.Minute, flavor.Cores, 0, otherReqs}
+				testReq := &Requirements{flavor.RAM, 1 * time.Minute, flavor.Cores, 0, "", otherReqs}
 				can := oss.canCount(testReq)
 
 				done := make(chan bool, 1)
@@ -700,7 +1301,7 @@ func TestOpenstack(t *testing.T) {
 						cmd := "sleep 10"
 						other := make(map[string]string)
 						other["cloud_flavor"] = "o1.small"
-						thisReq := &Requirements{100, 1 * time.Minute, 1, 1, other}
+						thisReq := &Requirements{100, 1 * time.Minute, 1, 1, "", other}
 						err := s.Schedule(cmd, thisReq, 1)
 						So(err, ShouldBeNil)
 						So(s.Busy(), ShouldBeTrue)
@@ -743,7 +1344,7 @@ func TestOpenstack(t *testing.T) {
 					count := 10
 					eta := 200 // if it takes longer than this, it's a likely indicator of a bug where it has actually stalled on a stuck lock
 					cmd := "sleep 10"
-					thisReq := &Requirements{100, 1 * time.Minute, 54, 1, oReqs}
+					thisReq := &Requirements{100, 1 * time.Minute, 54, 1, "", oReqs}
 					err := s.Schedule(cmd, thisReq, count)
 					So(err, ShouldBeNil)
 					So(s.Busy(), ShouldBeTrue)
@@ -793,7 +1394,7 @@ func TestOpenstack(t *testing.T) {
 				Convey("Run everything even when a server fails to spawn", func() {
 					debugCounter = 0
 					debugEffect = "failFirstSpawn"
-					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs}
+					newReq := &Requirements{100, 1 * time.Minute, 1, 1, "", oReqs}
 					newCount := 3
 					eta := 120
 					cmd := "sleep 10"
@@ -806,7 +1407,7 @@ func TestOpenstack(t *testing.T) {
 				Convey("Run jobs and have servers still self-terminate when a server is slow to spawn", func() {
 					debugCounter = 0
 					debugEffect = "slowSecondSpawn"
-					newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs}
+					newReq := &Requirements{100, 1 * time.Minute, 1, 1, "", oReqs}
 					newCount := 3
 					eta := 120
 					cmd := "sleep 10"
@@ -831,7 +1432,7 @@ func TestOpenstack(t *testing.T) {
 					oReqs["cloud_os_ram"] = "4096"
 
 					Convey("Override the default os image and ram", func() {
-						newReq := &Requirements{100, 1 * time.Minute, 1, 1, oReqs}
+						newReq := &Requirements{100, 1 * time.Minute, 1, 1, "", oReqs}
 						newCount := 3
 						eta := 120
 						cmd := "sleep 10 && (echo override > " + oFile + ") || true"
@@ -881,15 +1482,15 @@ func TestOpenstack(t *testing.T) {
 				}
 
 				numCores := 4
-				multiCoreFlavor, err := oss.determineFlavor(&Requirements{1024, 1 * time.Minute, numCores, 6 * numCores, oReqs})
+				multiCoreFlavor, err := oss.determineFlavor(&Requirements{1024, 1 * time.Minute, numCores, 6 * numCores, "", oReqs})
 				if err == nil && multiCoreFlavor.Cores >= numCores {
 					oReqs["cloud_os_ram"] = strconv.Itoa(multiCoreFlavor.RAM)
-					jobReq := &Requirements{int(multiCoreFlavor.RAM / numCores), 1 * time.Minute, 1, 6, oReqs}
+					jobReq := &Requirements{int(multiCoreFlavor.RAM / numCores), 1 * time.Minute, 1, 6, "", oReqs}
 					confirmFlavor, err := oss.determineFlavor(oss.reqForSpawn(jobReq))
 					if err == nil && confirmFlavor.Cores >= numCores {
 						Convey("Run multiple jobs at once on multi-core servers", func() {
 							cmd := "sleep 30"
-							jobReq := &Requirements{int(multiCoreFlavor.RAM / numCores), 1 * time.Minute, 1, int(multiCoreFlavor.Disk / numCores), oReqs}
+							jobReq := &Requirements{int(multiCoreFlavor.RAM / numCores), 1 * time.Minute, 1, int(multiCoreFlavor.Disk / numCores), "", oReqs}
 							err = s.Schedule(cmd, jobReq, numCores)
 							So(err, ShouldBeNil)
 							So(s.Busy(), ShouldBeTrue)
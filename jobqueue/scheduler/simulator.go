@@ -0,0 +1,540 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'simulator': it behaves
+// like a cloud scheduler, modelling the spawning of servers of different
+// flavors (taking some time to become ready, subject to quotas, and costing
+// money while they exist), but without calling any cloud API. The cmds it is
+// asked to schedule are really run on the local machine, once the simulated
+// server they were assigned to is ready.
+//
+// It also provides Simulate(), which models running a batch of jobs on such a
+// simulated cloud without running anything, for capacity planning.
+
+import (
+	"container/heap"
+	"math"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/inconshreveable/log15"
+)
+
+// ErrOverQuota is found in the Errors returned by Simulate() when a job could
+// never run because the quota doesn't allow a big enough server.
+var ErrOverQuota = "the quota does not allow a server that could run the job"
+
+// SimFlavor describes a kind of server that the simulator can spawn.
+type SimFlavor struct {
+	Name  string  `json:"name"`
+	Cores int     `json:"cores"`
+	RAM   int     `json:"ram"`   // in MB
+	Disk  int     `json:"disk"`  // in GB
+	Price float64 `json:"price"` // cost per hour the server exists for
+}
+
+// ConfigSimulator represents the configuration options required by the
+// simulator scheduler. Flavors is required; the quotas default to unlimited.
+type ConfigSimulator struct {
+	// Flavors are the kinds of server that can be spawned. The cheapest one
+	// that can run a cmd is used.
+	Flavors []*SimFlavor
+
+	// MaxInstances, MaxCores and MaxRAM (in MB) are the quotas that limit how
+	// many servers can exist at once. 0 means unlimited.
+	MaxInstances int
+	MaxCores     int
+	MaxRAM       int
+
+	// SpawnTime is how long a newly spawned server takes to become ready.
+	SpawnTime time.Duration
+
+	// ServerKeepTime is how long a server is kept after it becomes idle before
+	// it is destroyed.
+	ServerKeepTime time.Duration
+
+	// Shell is the shell to use to run your commands with; 'bash' is
+	// recommended.
+	Shell string
+
+	// StateUpdateFrequency is the frequency at which to destroy idle servers
+	// and re-check the queue to see if anything can now run. 0 (default) is
+	// treated as 1 minute.
+	StateUpdateFrequency time.Duration
+}
+
+// SimReport summarises the use of a simulated cloud.
+type SimReport struct {
+	Jobs        int           // how many cmds were run
+	Servers     int           // how many servers were spawned
+	PeakServers int           // the most servers that existed at once
+	Cost        float64       // the total cost of the servers, based on their Flavors' Price
+	Duration    time.Duration // for Simulate(), how long until the last job finished
+}
+
+// simServer is a simulated server.
+type simServer struct {
+	flavor    *SimFlavor
+	created   time.Time
+	ready     time.Time
+	idleSince time.Time
+	destroyed time.Time
+	cores     int
+	ram       int
+	jobs      int
+}
+
+// hasSpaceFor tells you how many jobs with the given requirements could be
+// run on this server right now.
+func (s *simServer) hasSpaceFor(req *Requirements) int {
+	if req.Disk > s.flavor.Disk && s.flavor.Disk > 0 {
+		return 0
+	}
+	return fitCount(s.flavor.Cores-s.cores, s.flavor.RAM-s.ram, req)
+}
+
+// allocate reserves resources for a job with the given requirements.
+func (s *simServer) allocate(req *Requirements) {
+	s.cores += req.Cores
+	s.ram += req.RAM
+	s.jobs++
+}
+
+// release frees the resources of a job with the given requirements.
+func (s *simServer) release(req *Requirements, now time.Time) {
+	s.cores -= req.Cores
+	s.ram -= req.RAM
+	s.jobs--
+	if s.jobs <= 0 {
+		s.idleSince = now
+	}
+}
+
+// cost returns how much the server costs if it existed until the given time,
+// or until it was destroyed.
+func (s *simServer) cost(now time.Time) float64 {
+	end := now
+	if !s.destroyed.IsZero() {
+		end = s.destroyed
+	}
+	return end.Sub(s.created).Hours() * s.flavor.Price
+}
+
+// fitCount tells you how many jobs with the given requirements fit in the
+// given cores and RAM.
+func fitCount(cores, ram int, req *Requirements) int {
+	count := math.MaxInt32
+	if req.Cores > 0 {
+		count = cores / req.Cores
+	}
+	if req.RAM > 0 && ram/req.RAM < count {
+		count = ram / req.RAM
+	}
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// simCloud tracks the servers of a simulated cloud.
+type simCloud struct {
+	config  *ConfigSimulator
+	flavors []*SimFlavor // sorted cheapest first
+	servers []*simServer // servers that haven't been destroyed
+	spent   float64      // cost of destroyed servers
+	spawned int
+	peak    int
+	jobs    int
+}
+
+// newSimCloud creates a simCloud from the given config.
+func newSimCloud(config *ConfigSimulator) *simCloud {
+	flavors := make([]*SimFlavor, len(config.Flavors))
+	copy(flavors, config.Flavors)
+	sort.SliceStable(flavors, func(i, j int) bool {
+		if flavors[i].Price == flavors[j].Price {
+			return flavors[i].Cores*flavors[i].RAM < flavors[j].Cores*flavors[j].RAM
+		}
+		return flavors[i].Price < flavors[j].Price
+	})
+	return &simCloud{config: config, flavors: flavors}
+}
+
+// flavorFor returns the cheapest flavor that could run a job with the given
+// requirements, or nil if none could.
+func (c *simCloud) flavorFor(req *Requirements) *SimFlavor {
+	for _, f := range c.flavors {
+		if f.Cores >= req.Cores && f.RAM >= req.RAM && (f.Disk == 0 || f.Disk >= req.Disk) {
+			return f
+		}
+	}
+	return nil
+}
+
+// fitsQuota tells you if the quota would allow a server of the given flavor
+// to exist at all.
+func (c *simCloud) fitsQuota(f *SimFlavor) bool {
+	return (c.config.MaxCores == 0 || f.Cores <= c.config.MaxCores) &&
+		(c.config.MaxRAM == 0 || f.RAM <= c.config.MaxRAM)
+}
+
+// spawnable tells you how many more servers of the given flavor the quota
+// would allow to be spawned right now.
+func (c *simCloud) spawnable(f *SimFlavor) int {
+	var cores, ram int
+	for _, s := range c.servers {
+		cores += s.flavor.Cores
+		ram += s.flavor.RAM
+	}
+
+	count := math.MaxInt32
+	if c.config.MaxInstances > 0 {
+		count = c.config.MaxInstances - len(c.servers)
+	}
+	if c.config.MaxCores > 0 && f.Cores > 0 && (c.config.MaxCores-cores)/f.Cores < count {
+		count = (c.config.MaxCores - cores) / f.Cores
+	}
+	if c.config.MaxRAM > 0 && f.RAM > 0 && (c.config.MaxRAM-ram)/f.RAM < count {
+		count = (c.config.MaxRAM - ram) / f.RAM
+	}
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// canCount tells you how many jobs with the given requirements could be
+// started now, on existing servers or new ones that the quota allows.
+func (c *simCloud) canCount(req *Requirements) int {
+	var count int
+	for _, s := range c.servers {
+		count += s.hasSpaceFor(req)
+	}
+
+	f := c.flavorFor(req)
+	if f == nil {
+		return count
+	}
+	extra := c.spawnable(f)
+	if extra == math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return count + extra*fitCount(f.Cores, f.RAM, req)
+}
+
+// place allocates a job with the given requirements to an existing server
+// with space (preferring those that are ready soonest), or else to a newly
+// spawned one, returning the server, or nil if the quota doesn't allow it.
+func (c *simCloud) place(req *Requirements, now time.Time) *simServer {
+	var best *simServer
+	for _, s := range c.servers {
+		if s.hasSpaceFor(req) > 0 && (best == nil || s.ready.Before(best.ready)) {
+			best = s
+		}
+	}
+
+	if best == nil {
+		f := c.flavorFor(req)
+		if f == nil || c.spawnable(f) < 1 {
+			return nil
+		}
+		best = &simServer{flavor: f, created: now, ready: now.Add(c.config.SpawnTime)}
+		c.servers = append(c.servers, best)
+		c.spawned++
+		if len(c.servers) > c.peak {
+			c.peak = len(c.servers)
+		}
+	}
+
+	best.allocate(req)
+	c.jobs++
+	return best
+}
+
+// reap destroys servers that have been idle for longer than ServerKeepTime as
+// of the given time.
+func (c *simCloud) reap(now time.Time) {
+	kept := c.servers[:0]
+	for _, s := range c.servers {
+		if s.jobs <= 0 && !s.idleSince.IsZero() && !now.Before(s.idleSince.Add(c.config.ServerKeepTime)) {
+			s.destroyed = s.idleSince.Add(c.config.ServerKeepTime)
+			c.spent += s.cost(now)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	c.servers = kept
+}
+
+// report summarises our use as of the given time.
+func (c *simCloud) report(now time.Time) *SimReport {
+	cost := c.spent
+	for _, s := range c.servers {
+		cost += s.cost(now)
+	}
+	return &SimReport{Jobs: c.jobs, Servers: c.spawned, PeakServers: c.peak, Cost: cost}
+}
+
+// simRun is a job running on a simServer during Simulate().
+type simRun struct {
+	server *simServer
+	req    *Requirements
+	end    time.Time
+}
+
+// simRuns is a heap of simRuns, soonest ending first.
+type simRuns []*simRun
+
+func (r simRuns) Len() int            { return len(r) }
+func (r simRuns) Less(i, j int) bool  { return r[i].end.Before(r[j].end) }
+func (r simRuns) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+func (r *simRuns) Push(x interface{}) { *r = append(*r, x.(*simRun)) }
+func (r *simRuns) Pop() interface{} {
+	old := *r
+	n := len(old)
+	x := old[n-1]
+	*r = old[:n-1]
+	return x
+}
+
+// Simulate models running jobs with the given requirements (each taking their
+// Time to run) on a cloud described by the given config, without running
+// anything. Jobs are started in the order given, as soon as a server with space
+// for them is available or can be spawned within the quota, and servers are
+// destroyed once they have been idle for the config's ServerKeepTime. The
+// returned report tells you how long it would take for all the jobs to finish,
+// and how much the servers would cost.
+func Simulate(config *ConfigSimulator, jobs []*Requirements) (*SimReport, error) {
+	c := newSimCloud(config)
+	for _, req := range jobs {
+		f := c.flavorFor(req)
+		if f == nil {
+			return nil, Error{"simulator", "Simulate", ErrImpossible}
+		}
+		if !c.fitsQuota(f) {
+			return nil, Error{"simulator", "Simulate", ErrOverQuota}
+		}
+	}
+
+	var start time.Time
+	now, last := start, start
+	running := &simRuns{}
+	next := 0
+	for next < len(jobs) || running.Len() > 0 {
+		// start as many jobs as we can, in order
+		for next < len(jobs) {
+			server := c.place(jobs[next], now)
+			if server == nil {
+				break
+			}
+			begin := now
+			if server.ready.After(begin) {
+				begin = server.ready
+			}
+			end := begin.Add(jobs[next].Time)
+			heap.Push(running, &simRun{server: server, req: jobs[next], end: end})
+			if end.After(last) {
+				last = end
+			}
+			next++
+		}
+
+		// move on to when the next job finishes, or if nothing is running
+		// but we still couldn't start the next job, to when idle servers
+		// using up the quota get destroyed
+		if running.Len() == 0 {
+			if next == len(jobs) || len(c.servers) == 0 {
+				break
+			}
+			expires := c.servers[0].idleSince.Add(config.ServerKeepTime)
+			for _, s := range c.servers[1:] {
+				if e := s.idleSince.Add(config.ServerKeepTime); e.Before(expires) {
+					expires = e
+				}
+			}
+			now = expires
+			c.reap(now)
+			continue
+		}
+		run := heap.Pop(running).(*simRun)
+		now = run.end
+		run.server.release(run.req, now)
+		c.reap(now)
+	}
+
+	// servers stay around until their keep time expires
+	for _, s := range c.servers {
+		if !s.idleSince.IsZero() && s.idleSince.Add(config.ServerKeepTime).After(now) {
+			now = s.idleSince.Add(config.ServerKeepTime)
+		}
+	}
+	c.reap(now)
+
+	report := c.report(now)
+	report.Duration = last.Sub(start)
+	return report, nil
+}
+
+// simulator is our implementer of scheduleri. It embeds local, so that cmds
+// get run on the local machine, but it only allows them to run as the
+// simulated cloud has space for them.
+type simulator struct {
+	local
+	config *ConfigSimulator
+	cloud  *simCloud
+	cmutex sync.Mutex
+}
+
+// initialize sets up our simulated cloud.
+func (s *simulator) initialize(config interface{}, logger log15.Logger) error {
+	s.config = config.(*ConfigSimulator)
+	s.Logger = logger.New("scheduler", "simulator")
+
+	if len(s.config.Flavors) == 0 {
+		return Error{"simulator", "initialize", "no flavors were configured"}
+	}
+	s.cloud = newSimCloud(s.config)
+
+	// initialize our job queue and other trackers
+	s.queue = queue.New(localPlace)
+	s.running = make(map[string]int)
+	s.runEnds = make(map[int]time.Time)
+
+	// set our functions for use in schedule() and processQueue()
+	s.reqCheckFunc = s.reqCheck
+	s.canCountFunc = s.canCount
+	s.runCmdFunc = s.runCmd
+	s.cancelRunCmdFunc = s.cancelRun
+	s.stateUpdateFunc = s.stateUpdate
+	s.stateUpdateFreq = s.config.StateUpdateFrequency
+	if s.stateUpdateFreq == 0 {
+		s.stateUpdateFreq = 1 * time.Minute
+	}
+
+	// pass through our shell config and logger to our local embed
+	s.local.config = &ConfigLocal{Shell: s.config.Shell}
+	s.local.Logger = s.Logger
+
+	return nil
+}
+
+// reqCheck gives an ErrImpossible if no flavor could run a cmd with the given
+// requirements.
+func (s *simulator) reqCheck(req *Requirements) error {
+	s.cmutex.Lock()
+	defer s.cmutex.Unlock()
+	f := s.cloud.flavorFor(req)
+	if f == nil || !s.cloud.fitsQuota(f) {
+		return Error{"simulator", "schedule", ErrImpossible}
+	}
+	return nil
+}
+
+// canCount tells you how many cmds with the given requirements could be run
+// on our simulated servers, including ones we could spawn.
+func (s *simulator) canCount(req *Requirements) int {
+	s.cmutex.Lock()
+	defer s.cmutex.Unlock()
+	return s.cloud.canCount(req)
+}
+
+// negotiate achieves the aims of Negotiate().
+func (s *simulator) negotiate(min, ideal *Requirements) *Requirements {
+	return negotiateWithin(min, ideal, func(req *Requirements) bool {
+		return s.reqCheck(req) == nil && s.canCount(req) >= 1
+	})
+}
+
+// runCmd assigns the cmd to a simulated server, waits for that server to be
+// ready, then runs the cmd locally.
+func (s *simulator) runCmd(cmd string, req *Requirements, reservedCh chan bool) error {
+	s.cmutex.Lock()
+	server := s.cloud.place(req, time.Now())
+	s.cmutex.Unlock()
+	if server == nil {
+		reservedCh <- false
+		return Error{"simulator", "runCmd", ErrImpossible}
+	}
+
+	s.mutex.Lock()
+	s.rcount++
+	s.mutex.Unlock()
+	reservedCh <- true
+
+	defer func() {
+		s.cmutex.Lock()
+		server.release(req, time.Now())
+		s.cmutex.Unlock()
+
+		s.mutex.Lock()
+		s.rcount--
+		if s.rcount < 0 {
+			s.rcount = 0
+		}
+		s.mutex.Unlock()
+	}()
+
+	if wait := time.Until(server.ready); wait > 0 {
+		<-time.After(wait)
+	}
+
+	ec := exec.Command(s.config.Shell, "-c", cmd) // #nosec
+	err := ec.Start()
+	if err != nil {
+		s.Error("runCmd start", "cmd", cmd, "err", err)
+		return err
+	}
+	err = ec.Wait()
+	if err != nil {
+		s.Error("runCmd wait", "cmd", cmd, "err", err)
+	}
+	return nil // do not return error running the command
+}
+
+// stateUpdate destroys simulated servers that have been idle for too long.
+func (s *simulator) stateUpdate() {
+	s.cmutex.Lock()
+	defer s.cmutex.Unlock()
+	s.cloud.reap(time.Now())
+}
+
+// report summarises our use of the simulated cloud so far.
+func (s *simulator) report() *SimReport {
+	s.cmutex.Lock()
+	defer s.cmutex.Unlock()
+	return s.cloud.report(time.Now())
+}
+
+// setMessageCallBack does nothing, since nothing goes wrong in a simulation.
+func (s *simulator) setMessageCallBack(cb MessageCallBack) {}
+
+// setBadServerCallBack does nothing, since our servers never go bad.
+func (s *simulator) setBadServerCallBack(cb BadServerCallBack) {}
+
+// cleanup destroys our internal queue and logs how much our simulated servers
+// would have cost.
+func (s *simulator) cleanup() {
+	s.local.cleanup()
+	r := s.report()
+	s.Info("simulation finished", "cmds", r.Jobs, "servers", r.Servers, "peak", r.PeakServers, "cost", r.Cost)
+}
@@ -0,0 +1,330 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package scheduler
+
+// This file contains a scheduleri implementation for 'ssh': running jobs on a
+// fixed pool of machines that we can ssh to, without anything needing to be
+// installed on them beforehand. The first time a machine is used, the
+// executable of the cmds we're asked to run (ie. our own statically linked wr
+// exe) is copied to a temporary directory on it, which is removed again during
+// cleanup(). Cmds are then run over ssh, so the machines only need to be able
+// to reach the manager's port.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/inconshreveable/log15"
+)
+
+// SSHHost describes one of the machines that the ssh scheduler runs cmds on.
+type SSHHost struct {
+	// Addr is the hostname or IP address of the machine, which must accept ssh
+	// connections on port 22.
+	Addr string `json:"addr"`
+
+	// User is the user to log in as; defaults to ConfigSSH.User.
+	User string `json:"user,omitempty"`
+
+	// Cores, RAM (in MB) and Disk (in GB) are how much of the machine's
+	// resources we're allowed to use.
+	Cores int `json:"cores"`
+	RAM   int `json:"ram"`
+	Disk  int `json:"disk"`
+}
+
+// ConfigSSH represents the configuration options required by the ssh
+// scheduler. Hosts and PrivateKey are required.
+type ConfigSSH struct {
+	// Hosts are the machines to run cmds on. They must have the same CPU
+	// architecture and operating system as the machine the manager is running
+	// on, since that's the exe we copy to them.
+	Hosts []*SSHHost
+
+	// User is the user to log in to Hosts as, for those that don't specify
+	// their own.
+	User string
+
+	// PrivateKey is the PEM format private key that lets us ssh to all the
+	// Hosts without a password.
+	PrivateKey string
+
+	// Shell is the shell to use to run your commands with; 'bash' is
+	// recommended.
+	Shell string
+
+	// StateUpdateFrequency is the frequency at which to re-check the queue to
+	// see if anything can now run. 0 (default) is treated as 1 minute.
+	StateUpdateFrequency time.Duration
+
+	// MaxJobsPerHost, if greater than 0, is the most cmds that will be run at
+	// once on each of the Hosts, regardless of how many would fit given their
+	// resource requirements.
+	MaxJobsPerHost int
+}
+
+// sshPool is our implementer of scheduleri. It embeds local, using local's
+// queue processing but running cmds on its hosts instead of locally.
+type sshPool struct {
+	local
+	config    *ConfigSSH
+	hosts     []*sshPoolHost
+	remoteDir string
+	cbmutex   sync.RWMutex
+	msgCB     MessageCallBack
+	hmutex    sync.Mutex
+}
+
+// sshPoolHost is one of our hosts, noting which exes we've copied to it.
+type sshPoolHost struct {
+	*cloud.Server
+	exes  map[string]string // local path => remote path
+	mutex sync.Mutex
+}
+
+// initialize checks the config and sets up our hosts. We don't connect to any
+// of them until we need to run something there.
+func (s *sshPool) initialize(config interface{}, logger log15.Logger) error {
+	s.config = config.(*ConfigSSH)
+	s.Logger = logger.New("scheduler", "ssh")
+
+	if len(s.config.Hosts) == 0 {
+		return Error{"ssh", "initialize", "no hosts were configured"}
+	}
+	if s.config.PrivateKey == "" {
+		return Error{"ssh", "initialize", "no private key was configured"}
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range s.config.Hosts {
+		user := h.User
+		if user == "" {
+			user = s.config.User
+		}
+		if h.Addr == "" || user == "" || h.Cores <= 0 || h.RAM <= 0 {
+			return Error{"ssh", "initialize", fmt.Sprintf("host [%s] must have an addr, user, cores and ram", h.Addr)}
+		}
+		if seen[h.Addr] {
+			return Error{"ssh", "initialize", fmt.Sprintf("host [%s] was specified more than once", h.Addr)}
+		}
+		seen[h.Addr] = true
+		server := cloud.NewStaticServer(h.Addr, h.Addr, user, s.config.PrivateKey, h.Cores, h.RAM, h.Disk, s.Logger)
+		s.hosts = append(s.hosts, &sshPoolHost{Server: server, exes: make(map[string]string)})
+	}
+
+	// exes we copy over go in a directory specific to this manager, so that
+	// multiple managers can share hosts
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	s.remoteDir = fmt.Sprintf("/tmp/wr_ssh_%s_%d", hostname, os.Getpid())
+
+	// initialize our job queue and other trackers
+	s.queue = queue.New(localPlace)
+	s.running = make(map[string]int)
+	s.runEnds = make(map[int]time.Time)
+	s.hostJobs = newHostJobs(s.config.MaxJobsPerHost)
+
+	// set our functions for use in schedule() and processQueue()
+	s.reqCheckFunc = s.reqCheck
+	s.canCountFunc = s.canCount
+	s.runCmdFunc = s.runCmd
+	s.cancelRunCmdFunc = s.cancelRun
+	s.stateUpdateFunc = s.stateUpdate
+	s.stateUpdateFreq = s.config.StateUpdateFrequency
+	if s.stateUpdateFreq == 0 {
+		s.stateUpdateFreq = 1 * time.Minute
+	}
+
+	// pass through our shell config and logger to our local embed
+	s.local.config = &ConfigLocal{Shell: s.config.Shell}
+	s.local.Logger = s.Logger
+
+	return nil
+}
+
+// reqCheck gives an ErrImpossible if none of our hosts are big enough to run a
+// cmd with the given requirements, or if the requirements need a different
+// architecture to ours.
+func (s *sshPool) reqCheck(req *Requirements) error {
+	if req.Arch != "" && NormaliseArch(req.Arch) != LocalArch() {
+		return Error{"ssh", "schedule", ErrImpossible}
+	}
+	for _, host := range s.hosts {
+		if host.Flavor.Cores >= req.Cores && host.Flavor.RAM >= req.RAM && host.Disk >= req.Disk {
+			return nil
+		}
+	}
+	return Error{"ssh", "schedule", ErrImpossible}
+}
+
+// canCount tells you how many cmds with the given requirements could be run
+// on our usable hosts, given what is already running on them.
+func (s *sshPool) canCount(req *Requirements) int {
+	s.hmutex.Lock()
+	defer s.hmutex.Unlock()
+	var canCount int
+	for _, host := range s.hosts {
+		if !host.IsBad() {
+			canCount += s.hostJobs.fit(host.Name, req, host.HasSpaceFor(req.Cores, req.RAM, req.Disk))
+		}
+	}
+	return canCount
+}
+
+// negotiate achieves the aims of Negotiate().
+func (s *sshPool) negotiate(min, ideal *Requirements) *Requirements {
+	return negotiateWithin(min, ideal, func(req *Requirements) bool {
+		return s.reqCheck(req) == nil && s.canCount(req) >= 1
+	})
+}
+
+// runCmd picks a host with enough free resources, makes sure the cmd's exe is
+// there, then runs the cmd on it over ssh. If we can't get the host ready, it
+// is marked as bad and not used again.
+func (s *sshPool) runCmd(cmd string, req *Requirements, reservedCh chan bool) error {
+	s.hmutex.Lock()
+	var host *sshPoolHost
+	for _, h := range s.hosts {
+		if !h.IsBad() && h.HasSpaceFor(req.Cores, req.RAM, req.Disk) > 0 && s.hostJobs.hasSpace(h.Name, req) {
+			host = h
+			host.Allocate(req.Cores, req.RAM, req.Disk)
+			s.hostJobs.add(host.Name, req, 1)
+			break
+		}
+	}
+	s.hmutex.Unlock()
+	if host == nil {
+		reservedCh <- false
+		return Error{"ssh", "runCmd", ErrImpossible}
+	}
+
+	s.mutex.Lock()
+	s.rcount++
+	s.mutex.Unlock()
+	reservedCh <- true
+
+	defer func() {
+		s.hmutex.Lock()
+		host.Release(req.Cores, req.RAM, req.Disk)
+		s.hostJobs.remove(host.Name, req)
+		s.hmutex.Unlock()
+
+		s.mutex.Lock()
+		s.rcount--
+		if s.rcount < 0 {
+			s.rcount = 0
+		}
+		s.mutex.Unlock()
+	}()
+
+	logger := s.Logger.New("host", host.Name)
+	remoteCmd, err := s.prepare(host, cmd)
+	if err != nil {
+		logger.Warn("host went bad", "err", err)
+		host.GoneBad(err.Error())
+		s.notifyMessage(fmt.Sprintf("SSH: host %s could not be used, and won't be used again until the manager restarts: %s", host.Name, err))
+		return err
+	}
+
+	logger.Debug("running command remotely", "cmd", remoteCmd)
+	_, stderr, err := host.RunCmd(remoteCmd, false)
+	if err != nil {
+		logger.Error("runCmd", "cmd", remoteCmd, "err", err, "stderr", stderr)
+	}
+	return nil // do not return error running the command
+}
+
+// prepare makes sure that the exe of the given cmd has been copied to the
+// given host, returning the cmd altered to use the copy.
+func (s *sshPool) prepare(host *sshPoolHost, cmd string) (string, error) {
+	exe := strings.Split(cmd, " ")[0]
+	exePath, err := exec.LookPath(exe)
+	if err != nil {
+		return "", fmt.Errorf("could not look for exe [%s]: %s", exe, err)
+	}
+
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	remote, done := host.exes[exePath]
+	if !done {
+		arch, _, errr := host.RunCmd("uname -m", false)
+		if errr != nil {
+			return "", errr
+		}
+		if NormaliseArch(strings.TrimSpace(arch)) != LocalArch() {
+			return "", fmt.Errorf("its architecture %s is not %s", strings.TrimSpace(arch), LocalArch())
+		}
+
+		remote = filepath.Join(s.remoteDir, filepath.Base(exePath))
+		err = host.UploadFile(exePath, remote)
+		if err != nil {
+			return "", fmt.Errorf("could not upload exe [%s]: %s", exePath, err)
+		}
+		_, _, err = host.RunCmd("chmod u+x "+remote, false)
+		if err != nil {
+			return "", err
+		}
+		host.exes[exePath] = remote
+	}
+	return remote + strings.TrimPrefix(cmd, exe), nil
+}
+
+// setMessageCallBack sets the given callback.
+func (s *sshPool) setMessageCallBack(cb MessageCallBack) {
+	s.cbmutex.Lock()
+	defer s.cbmutex.Unlock()
+	s.msgCB = cb
+}
+
+// notifyMessage calls the message callback with the given message in a
+// goroutine, if that callback has been set.
+func (s *sshPool) notifyMessage(msg string) {
+	s.cbmutex.RLock()
+	defer s.cbmutex.RUnlock()
+	if s.msgCB != nil {
+		go s.msgCB(msg)
+	}
+}
+
+// cleanup destroys our internal queue and removes the exes we copied to our
+// hosts.
+func (s *sshPool) cleanup() {
+	s.local.cleanup()
+	for _, host := range s.hosts {
+		host.mutex.Lock()
+		copied := len(host.exes) > 0
+		host.mutex.Unlock()
+		if !copied {
+			continue
+		}
+		_, _, err := host.RunCmd("rm -rf "+s.remoteDir, false)
+		if err != nil {
+			s.Warn("ssh scheduler cleanup failed", "host", host.Name, "err", err)
+		}
+	}
+}
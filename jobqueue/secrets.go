@@ -0,0 +1,200 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for storing secrets (such as credentials) in the
+// server's database, encrypted, and giving them to running Cmds that need them.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// secretsKeyFileName is the name of the file, stored alongside the database
+// file, that holds the key we encrypt secrets with, if
+// ServerConfig.SecretsKeyFile isn't set.
+const secretsKeyFileName = "secrets.key"
+
+// secretsKeySize is the number of bytes in the key we encrypt secrets with,
+// which makes us use AES-256.
+const secretsKeySize = 32
+
+// secretNameRegex is what secret names must match, since they become the
+// names of environment variables.
+var secretNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadSecretsKey reads the key we encrypt secrets with from the given file,
+// first creating the file with a new random key if it doesn't exist.
+func loadSecretsKey(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(key) != secretsKeySize {
+			return nil, fmt.Errorf("secrets key file %s is corrupt", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, secretsKeySize)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, key, 0600)
+	return key, err
+}
+
+// encryptSecret encrypts the given plain text with AES-GCM, returning the
+// nonce followed by the cipher text.
+func encryptSecret(key, plain []byte) ([]byte, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// decryptSecret reverses encryptSecret().
+func decryptSecret(key, encrypted []byte) ([]byte, error) {
+	gcm, err := secretsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, errors.New("encrypted secret is too short")
+	}
+	nonce := encrypted[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, encrypted[gcm.NonceSize():], nil)
+}
+
+// secretsCipher makes the AEAD used by encryptSecret() and decryptSecret().
+func secretsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// setSecret encrypts the value and stores it in the database under the given
+// name, replacing any existing secret with that name.
+func (s *Server) setSecret(name string, value []byte) error {
+	encrypted, err := encryptSecret(s.secretsKey, value)
+	if err != nil {
+		return err
+	}
+	return s.db.storeSecret(name, encrypted)
+}
+
+// getSecret retrieves and decrypts the secret with the given name. Returns
+// an Error with Err ErrUnknownSecret if there's no such secret.
+func (s *Server) getSecret(name string) ([]byte, error) {
+	encrypted := s.db.retrieveSecret(name)
+	if encrypted == nil {
+		return nil, Error{"getSecret", name, ErrUnknownSecret}
+	}
+	return decryptSecret(s.secretsKey, encrypted)
+}
+
+// jobSecrets returns the decrypted values of all the secrets the given job
+// needs, keyed on their names.
+func (s *Server) jobSecrets(job *Job) (map[string]string, error) {
+	job.RLock()
+	names := make([]string, len(job.Secrets))
+	copy(names, job.Secrets)
+	job.RUnlock()
+
+	secrets := make(map[string]string, len(names))
+	for _, name := range names {
+		value, err := s.getSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = string(value)
+	}
+	return secrets, nil
+}
+
+// SetSecret stores the given value in the server's database, encrypted, under
+// the given name. Jobs that have the name in their Secrets will have the value
+// in an environment variable of that name when they are Execute()d. The name
+// must be a valid environment variable name. Setting a secret that already
+// exists replaces its value.
+func (c *Client) SetSecret(name string, value []byte) error {
+	if !secretNameRegex.MatchString(name) {
+		return Error{"SetSecret", name, ErrBadSecretName}
+	}
+	c.cache.invalidate(cacheKeySecretNames)
+	_, err := c.request(&clientRequest{Method: "setsecret", Keys: []string{name}, Secret: value})
+	return err
+}
+
+// DeleteSecret removes the secret with the given name from the server's
+// database. Jobs that still need it will be buried when they try to run.
+func (c *Client) DeleteSecret(name string) error {
+	c.cache.invalidate(cacheKeySecretNames)
+	_, err := c.request(&clientRequest{Method: "delsecret", Keys: []string{name}})
+	return err
+}
+
+// GetSecretNames returns the names of all the secrets stored in the server's
+// database. The values of secrets can't be retrieved, except by the Jobs that
+// need them. The result is cached if EnableCache() has been called.
+func (c *Client) GetSecretNames() ([]string, error) {
+	if val, cached := c.cache.get(cacheKeySecretNames); cached {
+		if names, ok := val.([]string); ok {
+			return names, nil
+		}
+	}
+	resp, err := c.request(&clientRequest{Method: "getsecrets"})
+	if err != nil {
+		return nil, err
+	}
+	c.cache.set(cacheKeySecretNames, resp.Names)
+	return resp.Names, err
+}
+
+// getJobSecrets gets the values of the secrets that the given Job needs, keyed
+// on their names. You must have Reserve()d the Job, and it must be running.
+func (c *Client) getJobSecrets(job *Job) (map[string]string, error) {
+	resp, err := c.request(&clientRequest{Method: "jsecrets", Keys: []string{job.key()}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Secrets, err
+}
@@ -48,41 +48,60 @@ import (
 	"github.com/grafov/bcast" // *** must be commit e9affb593f6c871f9b4c3ee6a3c77d421fe953df or status web page updates break in certain cases
 	"github.com/inconshreveable/log15"
 	logext "github.com/inconshreveable/log15/ext"
-	"github.com/ugorji/go/codec"
 )
 
 // Err* constants are found in our returned Errors under err.Err, so you can
 // cast and check if it's a certain type of error. ServerMode* constants are
 // used to report on the status of the server, found inside ServerInfo.
 const (
-	ErrInternalError    = "internal error"
-	ErrUnknownCommand   = "unknown command"
-	ErrBadRequest       = "bad request (missing arguments?)"
-	ErrBadJob           = "bad job (not in queue or correct sub-queue)"
-	ErrMissingJob       = "corresponding job not found"
-	ErrUnknown          = "unknown error"
-	ErrClosedInt        = "queues closed due to SIGINT"
-	ErrClosedTerm       = "queues closed due to SIGTERM"
-	ErrClosedStop       = "queues closed due to manual Stop()"
-	ErrQueueClosed      = "queue closed"
-	ErrNoHost           = "could not determine the non-loopback ip address of this host"
-	ErrNoServer         = "could not reach the server"
-	ErrMustReserve      = "you must Reserve() a Job before passing it to other methods"
-	ErrDBError          = "failed to use database"
-	ErrPermissionDenied = "bad token: permission denied"
-	ServerModeNormal    = "started"
-	ServerModeDrain     = "draining"
+	ErrInternalError     = "internal error"
+	ErrUnknownCommand    = "unknown command"
+	ErrBadRequest        = "bad request (missing arguments?)"
+	ErrBadJob            = "bad job (not in queue or correct sub-queue)"
+	ErrMissingJob        = "corresponding job not found"
+	ErrUnknown           = "unknown error"
+	ErrClosedInt         = "queues closed due to SIGINT"
+	ErrClosedTerm        = "queues closed due to SIGTERM"
+	ErrClosedStop        = "queues closed due to manual Stop()"
+	ErrQueueClosed       = "queue closed"
+	ErrNoHost            = "could not determine the non-loopback ip address of this host"
+	ErrNoServer          = "could not reach the server"
+	ErrMustReserve       = "you must Reserve() a Job before passing it to other methods"
+	ErrDBError           = "failed to use database"
+	ErrPermissionDenied  = "bad token: permission denied"
+	ErrBadSecretName     = "secret names must be valid environment variable names"
+	ErrUnknownSecret     = "no secret with that name exists"
+	ErrBadLabel          = "label keys may only contain letters, numbers, _, ., - and /"
+	ErrUnknownUpload     = "no uploaded file with that path exists"
+	ErrUploadInUse       = "uploaded file is needed by incomplete jobs"
+	ErrBadDatacentre     = "no peer manager handles that datacentre"
+	ErrUnknownEnvProfile = "no environment profile with that name exists"
+	ErrIncompatible      = "client and manager versions are incompatible"
+	ErrReadOnlyToken     = "read-only token: permission denied"
+	ErrInvalidJob        = "job is invalid"
+	ErrPeerCheck         = "could not check peer managers for duplicate jobs"
+	ErrMountCredentials  = "could not mint credentials for the job's mounts"
+	ErrUnknownSubscriber = "no subscription with that id exists"
+	ErrDependencyCycle   = "job dependencies would form a cycle"
+	ErrModifyConflict    = "modified job would clash with another job or break its dependents"
+	ErrChaos             = "fault injected by chaos mode"
+	ServerModeNormal     = "started"
+	ServerModeDrain      = "draining"
 )
 
 // these global variables are primarily exported for testing purposes; you
 // probably shouldn't change them (*** and they should probably be re-factored
 // as fields of a config struct...)
 var (
-	ServerInterruptTime   = 1 * time.Second
-	ServerItemTTR         = 60 * time.Second
-	ServerReserveTicker   = 1 * time.Second
-	ServerCheckRunnerTime = 1 * time.Minute
-	ServerLogClientErrors = true
+	ServerInterruptTime     = 1 * time.Second
+	ServerItemTTR           = 60 * time.Second
+	ServerReserveTicker     = 1 * time.Second
+	ServerCheckRunnerTime   = 1 * time.Minute
+	ServerLogClientErrors   = true
+	ServerUploadGCTime      = 1 * time.Hour
+	ServerTrashGCTime       = 10 * time.Minute
+	ServerFederationPoll    = 10 * time.Second
+	ServerStartDeadlineTime = 10 * time.Second
 )
 
 // Error records an error and the operation and item that caused it.
@@ -106,38 +125,64 @@ type itemErr struct {
 // serverResponse is the struct that the server sends to clients over the
 // network in response to their clientRequest.
 type serverResponse struct {
-	Err        string // string instead of error so we can decode on the client side
-	Added      int
-	Existed    int
-	KillCalled bool
-	Job        *Job
-	Jobs       []*Job
-	SInfo      *ServerInfo
-	SStats     *ServerStats
-	DB         []byte
-	Path       string
+	Err              string // string instead of error so we can decode on the client side
+	Codec            WireCodec
+	Added            int
+	Existed          int
+	KillCalled       bool
+	ShuttingDown     bool
+	Job              *Job
+	Jobs             []*Job
+	SInfo            *ServerInfo
+	SStats           *ServerStats
+	DB               []byte
+	Path             string
+	File             []byte
+	Uploads          []*UploadedFile
+	Names            []string
+	Secrets          map[string]string
+	Failures         []*FailureCluster
+	RepGroupCounts   []*RepGroupCount
+	RepGroupMetrics  []*RepGroupMetrics
+	Trash            []*TrashedJob
+	Timeline         []*TimelineSnapshot
+	CloudServers     []*scheduler.CloudServer
+	ReqProfiles      []*ReqGroupProfile
+	RepGroupDefaults []*RepGroupDefaults
+	LimitGroups      []*LimitGroup
+	AddResults       []*AddResult
+	MountCreds       *MountCredential
+	Stream           *StreamedStd
+	Events           []*JobEvent
+	Dropped          int
+	DepTree          *DependencyNode
 }
 
 // ServerInfo holds basic addressing info about the server.
 type ServerInfo struct {
-	Addr       string // ip:port
-	Host       string // hostname
-	Port       string // port
-	WebPort    string // port of the web interface
-	PID        int    // process id of server
-	Deployment string // deployment the server is running under
-	Scheduler  string // the name of the scheduler that jobs are being submitted to
-	Mode       string // ServerModeNormal if the server is running normally, or ServerModeDrain if draining
+	Addr        string // ip:port
+	Host        string // hostname
+	Port        string // port
+	WebPort     string // port of the web interface
+	PID         int    // process id of server
+	Deployment  string // deployment the server is running under
+	Scheduler   string // the name of the scheduler that jobs are being submitted to
+	Mode        string // ServerModeNormal if the server is running normally, or ServerModeDrain if draining
+	Version     string // version of wr the server is part of
+	Protocol    int    // ProtocolVersion of the server
+	MinProtocol int    // MinProtocolVersion of the server
 }
 
 // ServerStats holds information about the jobqueue server for sending to
 // clients.
 type ServerStats struct {
-	Delayed int           // how many jobs are waiting following a possibly transient error
-	Ready   int           // how many jobs are ready to begin running
-	Running int           // how many jobs are currently running
-	Buried  int           // how many jobs are no longer being processed because of seemingly permanent errors
-	ETC     time.Duration // how long until the the slowest of the currently running jobs is expected to complete
+	Delayed  int           // how many jobs are waiting following a possibly transient error
+	Ready    int           // how many jobs are ready to begin running
+	Running  int           // how many jobs are currently running
+	Buried   int           // how many jobs are no longer being processed because of seemingly permanent errors
+	ETC      time.Duration // how long until the the slowest of the currently running jobs is expected to complete
+	Draining bool          // true if the server is draining
+	Deadline time.Duration // if draining with a deadline, how long until still running jobs are killed
 }
 
 type rgToKeys struct {
@@ -145,6 +190,56 @@ type rgToKeys struct {
 	lookup map[string]map[string]bool
 }
 
+// startLimiter records when jobs in each RepGroup were last started, so that
+// we can obey Job.StartRate.
+type startLimiter struct {
+	sync.Mutex
+	starts    map[string][]time.Time
+	lastPrune time.Time
+}
+
+// allow returns true, and records a start, if fewer than rate jobs in the
+// given RepGroup have started in the last minute. Otherwise returns false and
+// the time at which the next job in the RepGroup could start. A rate of 0 means
+// there is no limit.
+func (sl *startLimiter) allow(repGroup string, rate int) (bool, time.Time) {
+	if rate <= 0 {
+		return true, time.Time{}
+	}
+	sl.Lock()
+	defer sl.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-1 * time.Minute)
+	var recent []time.Time
+	for _, t := range sl.starts[repGroup] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	sl.prune(now, cutoff)
+	if len(recent) >= rate {
+		sl.starts[repGroup] = recent
+		return false, recent[len(recent)-rate].Add(1 * time.Minute)
+	}
+	sl.starts[repGroup] = append(recent, now)
+	return true, time.Time{}
+}
+
+// prune forgets about RepGroups that have had no starts since the given cutoff,
+// checking at most once a minute. You must hold the lock when calling this.
+func (sl *startLimiter) prune(now, cutoff time.Time) {
+	if now.Sub(sl.lastPrune) < 1*time.Minute {
+		return
+	}
+	sl.lastPrune = now
+	for repGroup, starts := range sl.starts {
+		if len(starts) == 0 || !starts[len(starts)-1].After(cutoff) {
+			delete(sl.starts, repGroup)
+		}
+	}
+}
+
 // jstateCount is the state count change we send to the status webpage; we are
 // representing the jobs moving from one state to another.
 type jstateCount struct {
@@ -179,9 +274,19 @@ type schedulerIssue struct {
 type Server struct {
 	ServerInfo         *ServerInfo
 	token              []byte
+	roToken            []byte
+	secretsKey         []byte
+	mountMinter        MountCredentialMinter
+	chaos              *chaos
 	uploadDir          string
+	uploadGCAge        time.Duration
+	trashKeep          time.Duration
+	timelineKeep       time.Duration
+	slowRequest        time.Duration
+	cmdWrapper         string
+	cmdWrappers        map[string]string
+	outputFilter       OutputFilter
 	sock               mangos.Socket
-	ch                 codec.Handle
 	db                 *db
 	done               chan error
 	stopSigHandling    chan bool
@@ -189,35 +294,50 @@ type Server struct {
 	wg                 *sync.WaitGroup
 	up                 bool
 	drain              bool
+	drainDeadline      time.Time
+	shutdownReq        *shutdownRequest
 	blocking           bool
 	sync.Mutex
-	q               *queue.Queue
-	rpl             *rgToKeys
-	scheduler       *scheduler.Scheduler
-	sgroupcounts    map[string]int
-	sgrouptrigs     map[string]int
-	sgtr            map[string]*scheduler.Requirements
-	sgcmutex        sync.Mutex
-	racmutex        sync.RWMutex // to protect the readyaddedcallback
-	rc              string       // runner command string compatible with fmt.Sprintf(..., schedulerGroup, deployment, serverAddr, reserveTimeout, maxMinsAllowed)
-	httpServer      *http.Server
-	statusCaster    *bcast.Group
-	badServerCaster *bcast.Group
-	schedCaster     *bcast.Group
-	racCheckTimer   *time.Timer
-	racChecking     bool
-	racCheckReady   int
-	wsmutex         sync.Mutex
-	wsconns         map[string]*websocket.Conn
-	bsmutex         sync.RWMutex
-	badServers      map[string]*cloud.Server
-	simutex         sync.RWMutex
-	schedIssues     map[string]*schedulerIssue
-	krmutex         sync.RWMutex
-	killRunners     bool
-	timings         map[string]*timingAvg
-	tmutex          sync.Mutex
-	ssmutex         sync.RWMutex // "server state mutex" to protect up, drain, blocking and ServerInfo.Mode
+	q                *queue.Queue
+	rpl              *rgToKeys
+	lbl              *rgToKeys
+	sl               *startLimiter
+	limitGroups      *limitGroups
+	streams          *jobStreams
+	kept             *keptSandboxes
+	fed              *federation
+	fairShare        bool
+	scheduler        *scheduler.Scheduler
+	sgroupcounts     map[string]int
+	sgrouptrigs      map[string]int
+	sgtr             map[string]*scheduler.Requirements
+	sgcmutex         sync.Mutex
+	racmutex         sync.RWMutex // to protect the readyaddedcallback
+	rc               string       // runner command string compatible with fmt.Sprintf(..., schedulerGroup, deployment, serverAddr, reserveTimeout, maxMinsAllowed)
+	httpServer       *http.Server
+	statusCaster     *bcast.Group
+	subs             *subscriptions
+	deadlines        *startDeadlines
+	badServerCaster  *bcast.Group
+	schedCaster      *bcast.Group
+	racCheckTimer    *time.Timer
+	racChecking      bool
+	racCheckReady    int
+	wsmutex          sync.Mutex
+	wsconns          map[string]*websocket.Conn
+	bsmutex          sync.RWMutex
+	badServers       map[string]*cloud.Server
+	simutex          sync.RWMutex
+	schedIssues      map[string]*schedulerIssue
+	krmutex          sync.RWMutex
+	killRunners      bool
+	timings          map[string]*timingAvg
+	tmutex           sync.Mutex
+	ssmutex          sync.RWMutex // "server state mutex" to protect up, drain, shutdownReq, blocking and ServerInfo.Mode
+	reattach         map[string]*runningJob
+	reattachDeadline time.Time
+	rjmutex          sync.Mutex
+	mem              *jobMemory
 	log15.Logger
 }
 
@@ -265,6 +385,35 @@ type ServerConfig struct {
 	// means the token is not saved to disk.
 	TokenFile string
 
+	// Absolute path to where the server will store a read-only token, which
+	// only lets clients query the status of jobs and the server (see
+	// Server.ReadOnlyToken()). Like TokenFile, the file is only readable by
+	// the user running the server; copy it or pass ReadOnlyToken() on to the
+	// monitoring systems that need it. The default of empty string means the
+	// token is not saved to disk.
+	ReadOnlyTokenFile string
+
+	// Absolute path to the file holding the key used to encrypt secrets (see
+	// Client.SetSecret()) stored in the database. If the file does not exist,
+	// a new random key will be generated and saved there; keep it safe, since
+	// without it stored secrets can't be used. Defaults to "secrets.key" in the
+	// same directory as DBFile.
+	SecretsKeyFile string
+
+	// MountCredentials, if set, is used to mint short-lived credentials for
+	// each Job with non-Anonymous MountTargets when it is Execute()d, limited
+	// to just the paths it mounts and its expected run time. The runner uses
+	// them instead of any credentials in its environment, so that long-lived
+	// keys need never be copied to the machines that run Jobs. Jobs are buried
+	// if credentials can't be minted for them, including when their expected
+	// run time is longer than the minter will grant credentials for.
+	MountCredentials MountCredentialMinter
+
+	// Chaos, if set, makes the server inject faults, such as dropping the
+	// replies to some Touch() requests, so that you can check how clients and
+	// code embedding wr cope with realistic failures. Only for testing.
+	Chaos *ChaosConfig
+
 	// Absolute path to where CA PEM file is that will be used for
 	// securing access to the web interface. If the given file does not exist,
 	// a certificate will be generated for you at this path.
@@ -302,11 +451,108 @@ type ServerConfig struct {
 	// possible issue if you have multiple network interfaces.)
 	CIDR string
 
+	// FairShare, if true, makes the server share out the runners of each
+	// scheduler group fairly between Jobs with different RepGroups, instead of
+	// running Jobs in the order they were added (for Jobs with the same
+	// Priority; higher Priority Jobs still run first, whatever their
+	// RepGroup). This way Jobs added later can make progress while lots of
+	// Jobs added earlier are still waiting to run.
+	FairShare bool
+
+	// FairShareWeights are the relative weights of RepGroups when FairShare is
+	// true; a RepGroup with a weight of 2 will get twice as many of its Jobs
+	// running at once as one with the default weight of 1.
+	FairShareWeights map[string]int
+
 	// UploadDir is the directory where files uploaded to the Server will be
 	// stored. They get given unique names based on the MD5 checksum of the file
 	// uploaded. Defaults to /tmp.
 	UploadDir string
 
+	// CmdWrapper, if set, is a command line that every Job's Cmd will be
+	// executed through, eg. "nice -n 10" or "module load site &&". The Cmd is
+	// run as `[CmdWrapper] [shell] -c '[Cmd]'`, so the wrapper must be
+	// something that can have a command appended to it. Job.Cmd is unchanged,
+	// so status displays show the original command. Wrappers are ignored for
+	// Jobs that run under Windows shells.
+	CmdWrapper string
+
+	// CmdWrappers are wrappers (as per CmdWrapper) for particular RepGroups,
+	// which apply to Jobs in that RepGroup and all those below it in the
+	// hierarchy (see RepGroupSeparator), overriding CmdWrapper. The wrapper of
+	// the most specific RepGroup applies. An empty string means Jobs in that
+	// RepGroup are not wrapped at all.
+	CmdWrappers map[string]string
+
+	// OutputFilter is the OutputFilter used by Jobs that don't specify their
+	// own. Like CmdWrapper, it is applied when Jobs are reserved, so changing
+	// it affects Jobs already in the queue.
+	OutputFilter OutputFilter
+
+	// UploadGCAge, if set, results in files in UploadDir being checked every
+	// ServerUploadGCTime, and deleted if they were uploaded longer than this
+	// ago and no incomplete Job refers to them. The default of 0 means uploaded
+	// files are kept until deleted with Client.DeleteUpload().
+	UploadGCAge time.Duration
+
+	// TrashKeep, if set, results in Jobs that are Client.Delete()d being kept
+	// in a trash for this long, during which they can be brought back with
+	// Client.Restore(). The trash is checked for expired Jobs every
+	// ServerTrashGCTime. The default of 0 means deleted Jobs are gone
+	// immediately, as if Client.Purge() had been used.
+	TrashKeep time.Duration
+
+	// TimelineInterval, if set, results in a snapshot of the number of Jobs in
+	// each state in each RepGroup, along with the scheduler's capacity and
+	// reasons it couldn't run more, being stored this often, so that
+	// Client.GetTimeline() can show how submissions progressed over time. The
+	// default of 0 means no timeline is recorded.
+	TimelineInterval time.Duration
+
+	// TimelineKeep is how long snapshots are kept for when TimelineInterval is
+	// set. The default of 0 means they are kept forever.
+	TimelineKeep time.Duration
+
+	// SlowRequest, if set, results in a warning being logged for
+	// every client request that takes at least this long to handle, giving the
+	// method, the size of the request and reply, and how long was spent
+	// waiting on the queue lock while it was handled. The default of 0 means
+	// no such warnings are logged.
+	SlowRequest time.Duration
+
+	// ReattachGrace is how long after starting up the server will wait for the
+	// runners of Jobs that were running when it last stopped to get back in
+	// touch and carry on running them. During this time such Jobs are delayed,
+	// and then they become ready to be run again by anyone. This lets
+	// in-flight Jobs survive the server being restarted. The default of 0
+	// means Jobs that were running become ready immediately. When set, the
+	// token in TokenFile is reused (see Serve()), since runners must still
+	// be able to authenticate.
+	ReattachGrace time.Duration
+
+	// Datacentre is the name of the datacentre this server runs Jobs in. Jobs
+	// with no Datacentre, or this one, are scheduled as normal.
+	Datacentre string
+
+	// Peers are other managers that Jobs with a different Datacentre are
+	// forwarded to, according to each Peer's Datacentres. Forwarded Jobs are
+	// added to the peer (along with their environment and any uploaded files
+	// they need) once their dependencies are satisfied, and their progress
+	// there is mirrored back to the Job in this server's queue, so that they
+	// can be followed and managed from here. Adding Jobs with a Datacentre
+	// that neither this server nor a Peer handles results in an error.
+	// Secrets Jobs need must also exist on the peer. Clients with CheckPeers
+	// set have the Jobs they add checked against the queues of all Peers
+	// (including those with no Datacentres, which are never forwarded to).
+	Peers []*Peer
+
+	// JobMemoryBudget is the maximum number of MB of memory to use for holding
+	// the rarely needed parts of queued Jobs (their EnvOverride and
+	// Behaviours). Once reached, those parts of further Jobs are only kept in
+	// the database, and read from there when needed. Optional, defaults to
+	// 0, meaning no limit.
+	JobMemoryBudget int
+
 	// Logger is a logger object that will be used to log uncaught errors and
 	// debug statements. "Uncought" errors are all errors generated during
 	// operation that either shouldn't affect the success of operations, and can
@@ -341,7 +587,9 @@ type ServerConfig struct {
 // is a single user system, so there is only 1 token kept for its entire
 // lifetime. If config.TokenFile has been set, the token will also be written to
 // that file, potentially making it easier for any CLI clients to authenticate
-// with this returned Server.
+// with this returned Server. If config.ReattachGrace is also set, the token
+// already in that file (if any) is reused, so that clients from before a
+// restart can carry on.
 //
 // The possible errors from Serve() will be related to not being able to start
 // up at the supplied address; errors encountered while dealing with clients are
@@ -365,8 +613,26 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 	}
 	defer internal.LogPanic(serverLogger, "jobqueue serve", true)
 
-	// generate a secure token for clients to authenticate with
-	token, err = generateToken()
+	if err = config.OutputFilter.Validate(); err != nil {
+		return s, msg, token, err
+	}
+
+	// generate a secure token for clients to authenticate with, unless we
+	// want the runners of jobs that were running before we were restarted to
+	// be able to get back in touch, in which case we keep using our old one
+	if config.ReattachGrace > 0 && config.TokenFile != "" {
+		token, err = ioutil.ReadFile(config.TokenFile)
+		if err != nil || len(token) != tokenLength {
+			token = nil
+		}
+	}
+	if token == nil {
+		token, err = generateToken()
+		if err != nil {
+			return s, msg, token, err
+		}
+	}
+	roToken, err := readOnlyToken(config)
 	if err != nil {
 		return s, msg, token, err
 	}
@@ -480,18 +746,56 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		return s, msg, token, err
 	}
 
+	// secrets are stored in the db encrypted with a key kept outside of it
+	secretsKeyFile := config.SecretsKeyFile
+	if secretsKeyFile == "" {
+		secretsKeyFile = filepath.Join(filepath.Dir(config.DBFile), secretsKeyFileName)
+	}
+	secretsKey, err := loadSecretsKey(secretsKeyFile)
+	if err != nil {
+		return s, msg, token, err
+	}
+
 	uploadDir := config.UploadDir
 	if uploadDir == "" {
 		uploadDir = "/tmp"
 	}
 
+	fed, err := newFederation(config)
+	if err != nil {
+		return s, msg, token, err
+	}
+
+	limits, err := db.retrieveLimitGroups()
+	if err != nil {
+		return s, msg, token, err
+	}
+
 	s = &Server{
-		ServerInfo:         &ServerInfo{Addr: ip + ":" + config.Port, Host: certDomain, Port: config.Port, WebPort: config.WebPort, PID: os.Getpid(), Deployment: config.Deployment, Scheduler: config.SchedulerName, Mode: ServerModeNormal},
+		ServerInfo:         &ServerInfo{Addr: ip + ":" + config.Port, Host: certDomain, Port: config.Port, WebPort: config.WebPort, PID: os.Getpid(), Deployment: config.Deployment, Scheduler: config.SchedulerName, Mode: ServerModeNormal, Version: Version, Protocol: protocolVersion, MinProtocol: minProtocolVersion},
 		token:              token,
+		roToken:            roToken,
+		secretsKey:         secretsKey,
+		mountMinter:        config.MountCredentials,
+		chaos:              newChaos(config.Chaos),
 		uploadDir:          uploadDir,
+		uploadGCAge:        config.UploadGCAge,
+		trashKeep:          config.TrashKeep,
+		timelineKeep:       config.TimelineKeep,
+		slowRequest:        config.SlowRequest,
+		cmdWrapper:         config.CmdWrapper,
+		cmdWrappers:        config.CmdWrappers,
+		outputFilter:       config.OutputFilter,
 		sock:               sock,
-		ch:                 new(codec.BincHandle),
 		rpl:                &rgToKeys{lookup: make(map[string]map[string]bool)},
+		lbl:                &rgToKeys{lookup: make(map[string]map[string]bool)},
+		sl:                 &startLimiter{starts: make(map[string][]time.Time)},
+		limitGroups:        newLimitGroups(limits),
+		streams:            newJobStreams(),
+		kept:               &keptSandboxes{hosts: make(map[string][]keptSandbox)},
+		fed:                fed,
+		mem:                newJobMemory(config.JobMemoryBudget),
+		fairShare:          config.FairShare,
 		db:                 db,
 		stopSigHandling:    stopSigHandling,
 		stopClientHandling: stopClientHandling,
@@ -505,6 +809,8 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		rc:                 config.RunnerCmd,
 		wsconns:            make(map[string]*websocket.Conn),
 		statusCaster:       bcast.NewGroup(),
+		subs:               &subscriptions{subs: make(map[string]*subscription)},
+		deadlines:          &startDeadlines{jobs: make(map[string]*readyJob)},
 		badServerCaster:    bcast.NewGroup(),
 		badServers:         make(map[string]*cloud.Server),
 		schedCaster:        bcast.NewGroup(),
@@ -516,11 +822,24 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 	// if we're restarting from a state where there were incomplete jobs, we
 	// need to load those in to our queue now
 	s.createQueue()
+	s.q.SetShareWeights(config.FairShareWeights)
 	priorJobs, err := db.recoverIncompleteJobs()
 	if err != nil {
 		return nil, msg, token, err
 	}
 	if len(priorJobs) > 0 {
+		// jobs that were running get delayed to give their runners a chance
+		// to re-attach to them
+		var reattachable map[string]*runningJob
+		if config.ReattachGrace > 0 {
+			var rjs map[string]*runningJob
+			rjs, err = db.retrieveRunningJobs()
+			if err != nil {
+				return nil, msg, token, err
+			}
+			reattachable = s.setReattachable(rjs, priorJobs, config.ReattachGrace)
+		}
+
 		var itemdefs []*queue.ItemDef
 		for _, job := range priorJobs {
 			var deps []string
@@ -528,7 +847,11 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 			if err != nil {
 				return nil, msg, token, err
 			}
-			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps})
+			delay := 0 * time.Second
+			if _, wasRunning := reattachable[job.key()]; wasRunning {
+				delay = config.ReattachGrace
+			}
+			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: delay, TTR: ServerItemTTR, Dependencies: deps})
 		}
 		_, _, err = s.enqueueItems(itemdefs)
 		if err != nil {
@@ -536,6 +859,110 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		}
 	}
 
+	// periodically clean up old uploaded files that nothing needs any more
+	if config.UploadGCAge > 0 {
+		wg.Add(1)
+		go func() {
+			defer internal.LogPanic(s.Logger, "jobqueue upload gc", true)
+			defer wg.Done()
+
+			ticker := time.NewTicker(ServerUploadGCTime)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					deleted, errg := s.gcUploads(config.UploadGCAge)
+					if errg != nil {
+						s.Warn("upload gc failed", "err", errg)
+					}
+					if deleted > 0 {
+						s.Debug("upload gc", "deleted", deleted)
+					}
+				case <-stopClientHandling:
+					return
+				}
+			}
+		}()
+	}
+
+	// periodically permanently delete jobs that have been in the trash too long
+	if config.TrashKeep > 0 {
+		wg.Add(1)
+		go func() {
+			defer internal.LogPanic(s.Logger, "jobqueue trash gc", true)
+			defer wg.Done()
+
+			ticker := time.NewTicker(ServerTrashGCTime)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					purged, errg := s.gcTrash()
+					if errg != nil {
+						s.Warn("trash gc failed", "err", errg)
+					}
+					if purged > 0 {
+						s.Debug("trash gc", "purged", purged)
+					}
+				case <-stopClientHandling:
+					return
+				}
+			}
+		}()
+	}
+
+	// periodically record the state of the queue for later reporting
+	if config.TimelineInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer internal.LogPanic(s.Logger, "jobqueue timeline", true)
+			defer wg.Done()
+
+			ticker := time.NewTicker(config.TimelineInterval)
+			defer ticker.Stop()
+			last := time.Now()
+			for {
+				select {
+				case <-ticker.C:
+					errt := s.recordTimeline(last)
+					if errt != nil {
+						s.Warn("recording timeline failed", "err", errt)
+					}
+					last = time.Now()
+				case <-stopClientHandling:
+					return
+				}
+			}
+		}()
+	}
+
+	// periodically escalate jobs that have waited too long to start
+	wg.Add(1)
+	go func() {
+		defer internal.LogPanic(s.Logger, "jobqueue start deadlines", true)
+		defer wg.Done()
+
+		ticker := time.NewTicker(ServerStartDeadlineTime)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				escalated, erre := s.escalate(s.deadlines.due(time.Now()))
+				if erre != nil {
+					s.Warn("start deadline escalation failed", "err", erre)
+				}
+				if escalated > 0 {
+					s.Debug("start deadlines", "escalated", escalated)
+				}
+			case <-stopClientHandling:
+				return
+			}
+		}
+	}()
+
+	// forward jobs for other datacentres to our peers
+	s.fed.start(s, caFile, certDomain)
+
 	// set up responding to command-line clients
 	wg.Add(1)
 	go func() {
@@ -621,7 +1048,9 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		mux.HandleFunc(restJobsEndpoint, restJobs(s))
 		mux.HandleFunc(restWarningsEndpoint, restWarnings(s))
 		mux.HandleFunc(restBadServersEndpoint, restBadServers(s))
+		mux.HandleFunc(restTimelineEndpoint, restTimeline(s))
 		mux.HandleFunc(restFileUploadEndpoint, restFileUpload(s))
+		mux.HandleFunc(restDebugEndpoint, restDebug(s))
 		srv := &http.Server{Addr: httpAddr, Handler: mux}
 		wg.Add(1)
 		go func() {
@@ -705,13 +1134,19 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 	}()
 	<-ready
 
-	// store token on disk
+	// store tokens on disk
 	if config.TokenFile != "" {
 		err = ioutil.WriteFile(config.TokenFile, token, 0600)
 		if err != nil {
 			return s, msg, token, err
 		}
 	}
+	if config.ReadOnlyTokenFile != "" {
+		err = ioutil.WriteFile(config.ReadOnlyTokenFile, roToken, 0600)
+		if err != nil {
+			return s, msg, token, err
+		}
+	}
 
 	return s, msg, token, err
 }
@@ -736,11 +1171,24 @@ func (s *Server) Stop(wait ...bool) {
 // Drain will stop the server spawning new runners and stop Reserve*() from
 // returning any more Jobs. Once all current runners exit, we Stop().
 func (s *Server) Drain() error {
+	return s.DrainBy(time.Time{})
+}
+
+// DrainBy is like Drain(), but if Jobs are still running when the given
+// deadline passes, they are released back to the queue with a FailReason of
+// FailReasonSignal (without counting against their Retries), their runners are
+// told to kill them, and we Stop(). Calling this while already draining sets a
+// new deadline, unless deadline is the zero time, which leaves any existing
+// deadline in place.
+func (s *Server) DrainBy(deadline time.Time) error {
 	s.ssmutex.Lock()
 	defer s.ssmutex.Unlock()
 	if !s.up {
 		return Error{"Drain", "", ErrNoServer}
 	}
+	if !deadline.IsZero() {
+		s.drainDeadline = deadline
+	}
 	if s.drain {
 		return nil
 	}
@@ -756,7 +1204,15 @@ func (s *Server) Drain() error {
 			// check our queue for things running, which is cheap
 			stats := s.q.Stats()
 			if stats.Running > 0 {
-				continue TICKS
+				s.ssmutex.RLock()
+				deadline := s.drainDeadline
+				s.ssmutex.RUnlock()
+				if deadline.IsZero() || time.Now().Before(deadline) {
+					continue TICKS
+				}
+
+				s.Warn("drain deadline passed, killing running jobs", "running", stats.Running)
+				s.releaseRunningJobs(FailReasonSignal)
 			}
 			ticker.Stop()
 
@@ -770,6 +1226,33 @@ func (s *Server) Drain() error {
 	return nil
 }
 
+// releaseRunningJobs releases all running jobs back to the queue with the given
+// FailReason, without counting it against their Retries, and sets killCalled
+// on them, so that their runners kill them (or find they've been disowned) the
+// next time they touch.
+func (s *Server) releaseRunningJobs(reason string) {
+	for _, inter := range s.q.GetRunningData() {
+		job := inter.(*Job)
+		key := job.key()
+		job.Lock()
+		job.killCalled = true
+		job.Exited = true
+		job.Exitcode = -1
+		job.EndTime = time.Now()
+		job.FailReason = reason
+		job.Unlock()
+
+		err := s.q.Release(key)
+		if err != nil {
+			s.Warn("releasing a running job failed", "cmd", job.Cmd, "err", err)
+			continue
+		}
+		s.finishLimitGroups(key, job.getLimitGroups())
+		s.decrementGroupCount(job.getSchedulerGroup())
+		s.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
+	}
+}
+
 // GetServerStats returns some simple live stats about what's happening in the
 // server's queue.
 func (s *Server) GetServerStats() *ServerStats {
@@ -796,7 +1279,19 @@ func (s *Server) GetServerStats() *ServerStats {
 		job.RUnlock()
 	}
 
-	return &ServerStats{Delayed: delayed, Ready: ready, Running: running, Buried: buried, ETC: etc.Truncate(time.Minute).Sub(time.Now().Truncate(time.Minute))}
+	ss := &ServerStats{Delayed: delayed, Ready: ready, Running: running, Buried: buried, ETC: etc.Truncate(time.Minute).Sub(time.Now().Truncate(time.Minute))}
+
+	s.ssmutex.RLock()
+	ss.Draining = s.drain
+	if s.drain && !s.drainDeadline.IsZero() {
+		ss.Deadline = time.Until(s.drainDeadline).Truncate(time.Second)
+		if ss.Deadline < 0 {
+			ss.Deadline = 0
+		}
+	}
+	s.ssmutex.RUnlock()
+
+	return ss
 }
 
 // BackupDB lets you do a manual live backup of the server's database to a given
@@ -905,6 +1400,14 @@ func (s *Server) uploadFile(source io.Reader, savePath string) (string, error) {
 			if err != nil {
 				s.Warn("uploadFile file removal error", "err", err)
 			}
+
+			// and treat the existing file as newly uploaded, so gcUploads()
+			// doesn't delete it before it can be used
+			now := time.Now()
+			err = os.Chtimes(finalPath, now, now)
+			if err != nil {
+				s.Warn("uploadFile file touch error", "err", err)
+			}
 		}
 		savePath = finalPath
 	}
@@ -938,69 +1441,31 @@ func (s *Server) createQueue() {
 
 		// calculate, set and count jobs by schedulerGroup
 		groups := make(map[string]int)
-		groupToReqs := make(map[string]*scheduler.Requirements)
+		groupReqs := make(map[string]*scheduler.Requirements)
 		groupsScheduledCounts := make(map[string]int)
 		noRecGroups := make(map[string]bool)
+		negotiated := make(map[string]*scheduler.Requirements)
+		rg := newReadyGrouper(s.recommendedReqs)
 		for _, inter := range allitemdata {
 			job := inter.(*Job)
 
-			// depending on job.Override, get memory and time
-			// recommendations, which are rounded to get fewer larger
-			// groups
-			noRec := false
-			if job.Override != 2 {
-				var recommendedReq *scheduler.Requirements
-				if rec, existed := groupToReqs[job.ReqGroup]; existed {
-					recommendedReq = rec
-				} else {
-					recm, errm := s.db.recommendedReqGroupMemory(job.ReqGroup)
-					recs, errs := s.db.recommendedReqGroupTime(job.ReqGroup)
-					if recm == 0 || recs == 0 || errm != nil || errs != nil {
-						groupToReqs[job.ReqGroup] = nil
-					} else {
-						recommendedReq = &scheduler.Requirements{RAM: recm, Time: time.Duration(recs) * time.Second}
-						groupToReqs[job.ReqGroup] = recommendedReq
-					}
-				}
-
-				if recommendedReq != nil {
-					job.Lock()
-					if job.Override == 1 {
-						if recommendedReq.RAM > job.Requirements.RAM {
-							job.Requirements.RAM = recommendedReq.RAM
-						}
-						if recommendedReq.Time > job.Requirements.Time {
-							job.Requirements.Time = recommendedReq.Time
-						}
-					} else {
-						job.Requirements.RAM = recommendedReq.RAM
-						job.Requirements.Time = recommendedReq.Time
-					}
-					job.Unlock()
-				} else {
-					noRec = true
-				}
+			// jobs for other datacentres are forwarded to our peers instead
+			// of being scheduled here
+			if pf := s.fed.peerFor(job.Datacentre); pf != nil {
+				pf.claim(s, job)
+				continue
 			}
 
-			var req *scheduler.Requirements
-			if job.Requirements.RAM < 924 {
-				// our req will be like the jobs but with memory + 100 to
-				// allow some leeway in case the job scheduler calculates
-				// used memory differently, and for other memory usage
-				// vagaries
-				req = &scheduler.Requirements{
-					RAM:   job.Requirements.RAM + 100,
-					Time:  job.Requirements.Time,
-					Cores: job.Requirements.Cores,
-					Disk:  job.Requirements.Disk,
-					Other: job.Requirements.Other,
-				}
-			} else {
-				req = job.Requirements
+			req, noRec := rg.group(job)
+
+			// jobs that can use a range of cores and RAM get as much as the
+			// job scheduler can currently give them
+			if job.IdealCores > job.Requirements.Cores || job.IdealRAM > job.Requirements.RAM {
+				req = s.negotiateReq(job, req, negotiated)
 			}
 
 			prevSchedGroup := job.getSchedulerGroup()
-			schedulerGroup := req.Stringify()
+			schedulerGroup := rg.stringify(req)
 			if prevSchedGroup != schedulerGroup {
 				job.setSchedulerGroup(schedulerGroup)
 				if prevSchedGroup != "" {
@@ -1031,17 +1496,21 @@ func (s *Server) createQueue() {
 					noRecGroups[schedulerGroup] = true
 				}
 
-				s.sgcmutex.Lock()
-				if _, set := s.sgtr[schedulerGroup]; !set {
-					s.sgtr[schedulerGroup] = req
+				if _, set := groupReqs[schedulerGroup]; !set {
+					groupReqs[schedulerGroup] = req
 				}
-				s.sgcmutex.Unlock()
 			}
 		}
 
 		if s.rc != "" {
-			// clear out groups we no longer need
 			s.sgcmutex.Lock()
+			for group, req := range groupReqs {
+				if _, set := s.sgtr[group]; !set {
+					s.sgtr[group] = req
+				}
+			}
+
+			// clear out groups we no longer need
 			stillRunning := make(map[string]bool)
 			for _, inter := range q.GetRunningData() {
 				job := inter.(*Job)
@@ -1201,6 +1670,61 @@ func (s *Server) createQueue() {
 				s.statusCaster.Send(&jstateCount{group, JobStateLost, to, count})
 			}
 		}
+
+		// keep track of how long jobs with start deadlines have been ready
+		if toQ == queue.SubQueueReady {
+			now := time.Now()
+			for _, inter := range data {
+				s.deadlines.ready(inter.(*Job), now)
+			}
+		} else if fromQ == queue.SubQueueReady {
+			for _, inter := range data {
+				s.deadlines.left(inter.(*Job))
+			}
+		}
+
+		// tell subscribers what happened to each job; jobs that enter the run
+		// sub-queue have only been reserved so far
+		for _, inter := range data {
+			job := inter.(*Job)
+			state := to
+			switch toQ {
+			case queue.SubQueueRun:
+				state = JobStateReserved
+			case queue.SubQueueRemoved:
+				job.RLock()
+				if job.State != JobStateComplete {
+					state = JobStateDeleted
+				}
+				job.RUnlock()
+			}
+			s.subs.publish(job, from, state)
+		}
+
+		// jobs waiting on buried jobs can't run until they're fixed, so we bury
+		// those too
+		if fromQ == queue.SubQueueRun && toQ == queue.SubQueueBury {
+			for _, inter := range data {
+				s.buryDependents(inter.(*Job).key())
+			}
+		}
+
+		// let anyone who wants to know that jobs finished
+		if to == JobStateComplete || to == JobStateBuried {
+			for _, inter := range data {
+				job := inter.(*Job)
+				state := to
+				if toQ == queue.SubQueueRemoved {
+					job.RLock()
+					state = job.State
+					job.RUnlock()
+					if state != JobStateComplete {
+						continue
+					}
+				}
+				s.sendCallback(job, state)
+			}
+		}
 	})
 
 	// we set a callback for running items that hit their ttr because the
@@ -1226,17 +1750,104 @@ func (s *Server) createQueue() {
 			return queue.SubQueueRun
 		}
 
+		s.finishLimitGroups(job.key(), job.LimitGroups)
 		return queue.SubQueueDelay
 	})
+
+	// we set a filter so that jobs with a StartRate don't all start at once
+	// when lots of them become ready at the same time, and so that jobs in
+	// limit groups don't exceed the limits. Jobs the filter rejects are held
+	// out of the ready queue (and so not counted when scheduling runners)
+	// until they can start. Jobs it lets through take their limit group slots
+	// straight away; they're given back by finishLimitGroups()
+	q.SetReserveFilter(func(data interface{}) (bool, time.Time) {
+		job := data.(*Job)
+		job.RLock()
+		repGroup, rate, key, groups := job.RepGroup, job.StartRate, job.key(), job.LimitGroups
+		job.RUnlock()
+		if !s.limitGroups.available(key, groups) {
+			// held until finishLimitGroups() or a change of limits says there
+			// might be room
+			return false, time.Time{}
+		}
+		if ok, until := s.sl.allow(repGroup, rate); !ok {
+			return false, until
+		}
+		s.limitGroups.start(key, groups)
+		return true, time.Time{}
+	})
+}
+
+// negotiateReq returns the scheduler Requirements that the given job, which can
+// use a range of cores and RAM, should be scheduled with, where req is what it
+// would be scheduled with at minimum. Each range is only negotiated with the
+// job scheduler once per call of the ready added callback (the results being
+// stored in negotiated), and once a runner has been scheduled for the job we
+// stick with what it was granted.
+func (s *Server) negotiateReq(job *Job, req *scheduler.Requirements, negotiated map[string]*scheduler.Requirements) *scheduler.Requirements {
+	job.RLock()
+	minRAM := job.Requirements.RAM
+	idealCores, idealRAM := job.IdealCores, job.IdealRAM
+	grantedCores, grantedRAM := job.GrantedCores, job.GrantedRAM
+	job.RUnlock()
+
+	ideal := *req
+	if idealCores > ideal.Cores {
+		ideal.Cores = idealCores
+	}
+	if idealRAM > minRAM {
+		ideal.RAM += idealRAM - minRAM
+	}
+
+	var granted *scheduler.Requirements
+	if grantedCores > 0 && job.getScheduledRunner() {
+		prior := *req
+		prior.Cores = grantedCores
+		prior.RAM += grantedRAM - minRAM
+		granted = &prior
+	} else {
+		key := req.Stringify() + ideal.Stringify()
+		var cached bool
+		if granted, cached = negotiated[key]; !cached {
+			granted = s.scheduler.Negotiate(req, &ideal)
+			negotiated[key] = granted
+		}
+	}
+
+	job.Lock()
+	job.GrantedCores = granted.Cores
+	job.GrantedRAM = minRAM + granted.RAM - req.RAM
+	job.Unlock()
+	return granted
 }
 
 // enqueueItems adds new items to a queue, for when we have new jobs to handle.
 func (s *Server) enqueueItems(itemdefs []*queue.ItemDef) (added, dups int, err error) {
+	if s.fairShare {
+		for _, itemdef := range itemdefs {
+			itemdef.ShareGroup = itemdef.Data.(*Job).RepGroup
+		}
+	}
+
 	added, dups, err = s.q.AddMany(itemdefs)
 	if err != nil {
 		return added, dups, err
 	}
 
+	// the jobs are all in the database, so we can reduce the memory they use
+	// while they sit in our queue (but not of those that were duplicates of
+	// jobs already in the queue)
+	for _, itemdef := range itemdefs {
+		job := itemdef.Data.(*Job)
+		if dups > 0 {
+			item, errg := s.q.Get(itemdef.Key)
+			if errg != nil || item.Data != job {
+				continue
+			}
+		}
+		s.mem.slim(job)
+	}
+
 	// add to our lookup of job RepGroup to key
 	s.rpl.Lock()
 	for _, itemdef := range itemdefs {
@@ -1248,19 +1859,48 @@ func (s *Server) enqueueItems(itemdefs []*queue.ItemDef) (added, dups int, err e
 	}
 	s.rpl.Unlock()
 
+	// and of job labels to key
+	for _, itemdef := range itemdefs {
+		s.indexLabels(itemdef.Key, itemdef.Data.(*Job).Labels)
+	}
+
 	return added, dups, err
 }
 
 // createJobs creates new jobs, adding them to the database and the in-memory
-// queue. It returns 2 errors; the first is one of our Err constant strings,
-// the second is the actual error with more details.
+// queue. If any of the jobs are invalid, none of them are added. The jobs are
+// given the environment stored under envkey, or keep their
+// existing one if envkey is blank. It returns 2 errors; the first is one of our
+// Err constant strings, the second is the actual error with more details.
 func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool) (added, dups, alreadyComplete int, srerr string, qerr error) {
 	// create itemdefs for the jobs
+	for _, job := range inputJobs {
+		if srerr, qerr = s.validateJob(job); qerr != nil {
+			return added, dups, alreadyComplete, srerr, qerr
+		}
+	}
+	err := s.applyRepGroupDefaults(inputJobs)
+	if err != nil {
+		return added, dups, alreadyComplete, ErrDBError, err
+	}
+	err = s.checkDependencyCycles(inputJobs)
+	if err != nil {
+		srerr = ErrDBError
+		if jqerr, ok := err.(Error); ok {
+			srerr = jqerr.Err
+		}
+		return added, dups, alreadyComplete, srerr, err
+	}
 	for _, job := range inputJobs {
 		job.Lock()
-		job.EnvKey = envkey
+		if envkey != "" {
+			job.EnvKey = envkey
+		}
 		job.UntilBuried = job.Retries + 1
-		if s.rc != "" {
+		job.expandOutputDest()
+		if pf := s.fed.peerFor(job.Datacentre); pf != nil {
+			job.schedulerGroup = pf.group()
+		} else if s.rc != "" {
 			job.schedulerGroup = job.Requirements.Stringify()
 		}
 		job.Unlock()
@@ -1281,8 +1921,8 @@ func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool
 		qerr = err
 	} else {
 		// now that jobs are in the db we can get dependencies fully, so now we
-		// can build our itemdefs *** we really need to test for cycles, because
-		// if the user creates one, we won't let them delete the bad jobs!
+		// can build our itemdefs (we checked for cycles above, since if the
+		// user created one, we wouldn't let them delete the bad jobs).
 		// storeNewJobs() returns jobsToQueue, which is all of cr.Jobs plus any
 		// previously Archive()d jobs that were resurrected because of one of
 		// their DepGroup dependencies being in cr.Jobs
@@ -1363,6 +2003,7 @@ func (s *Server) killJob(jobkey string) (bool, error) {
 			if err != nil {
 				return true, err
 			}
+			s.finishLimitGroups(item.Key, job.getLimitGroups())
 			s.decrementGroupCount(job.getSchedulerGroup())
 			return true, err
 		}
@@ -1370,6 +2011,7 @@ func (s *Server) killJob(jobkey string) (bool, error) {
 		if err != nil {
 			return true, err
 		}
+		s.finishLimitGroups(item.Key, job.getLimitGroups())
 		s.decrementGroupCount(job.getSchedulerGroup())
 		return true, err
 	}
@@ -1479,6 +2121,20 @@ func (s *Server) getJobsCurrent(limit int, state JobState, getStd bool, getEnv b
 // getJobsCurrent(). States 'reserved' and 'running' are treated as the same
 // state.
 func (s *Server) limitJobs(jobs []*Job, limit int, state JobState, getStd bool, getEnv bool) []*Job {
+	limited := limitJobsByState(jobs, limit, state)
+	if getEnv || getStd {
+		for _, job := range limited {
+			s.jobPopulateStdEnv(job, getStd, getEnv)
+		}
+	}
+	return limited
+}
+
+// limitJobsByState does the work of limitJobs() without retrieving anything
+// from the database, keeping only jobs in the given state (if any), and only
+// up to limit (if > 0) jobs for each combination of state, exit code and fail
+// reason, incrementing the Similar count of the last one kept instead.
+func limitJobsByState(jobs []*Job, limit int, state JobState) []*Job {
 	groups := make(map[string][]*Job)
 	var limited []*Job
 	for _, job := range jobs {
@@ -1535,12 +2191,6 @@ func (s *Server) limitJobs(jobs []*Job, limit int, state JobState, getStd bool,
 		}
 	}
 
-	if getEnv || getStd {
-		for _, job := range limited {
-			s.jobPopulateStdEnv(job, getStd, getEnv)
-		}
-	}
-
 	return limited
 }
 
@@ -1594,6 +2244,8 @@ func (s *Server) scheduleRunners(group string) {
 					errb := s.q.Bury(item.Key)
 					if errb != nil {
 						s.Warn("scheduleRunners failed to bury an item", "err", errb)
+					} else {
+						s.finishLimitGroups(item.Key, job.getLimitGroups())
 					}
 					s.sgroupcounts[group]--
 				}
@@ -1859,6 +2511,7 @@ func (s *Server) shutdown(reason string, wait bool, stopSigHandling bool) {
 
 	s.ssmutex.Lock()
 	s.drain = false
+	s.drainDeadline = time.Time{}
 	wasBlocking := s.blocking
 	s.blocking = false
 	s.ssmutex.Unlock()
@@ -22,6 +22,7 @@ package jobqueue
 
 import (
 	"bytes"
+	"os"
 	"sync"
 	"time"
 
@@ -35,33 +36,59 @@ import (
 
 // handleRequest parses the bytes received from a connected client in to a
 // clientRequest, does the requested work, then responds back to the client with
-// a serverResponse
+// a serverResponse, encoded the same way as the request was.
 func (s *Server) handleRequest(m *mangos.Message) error {
-	dec := codec.NewDecoderBytes(m.Body, s.ch)
+	ch, _ := wireHandle(sniffWireCodec(m.Body))
+	dec := codec.NewDecoderBytes(m.Body, ch)
 	cr := &clientRequest{}
 	errd := dec.Decode(cr)
 	if errd != nil {
 		return errd
 	}
 
+	rt := s.timeRequest(cr.Method, len(m.Body))
+	var sent int
+	defer func() {
+		s.requestDone(rt, sent)
+	}()
+
 	var sr *serverResponse
 	var srerr string
 	var qerr string
+	var afterReply func()
 
 	s.ssmutex.RLock()
 	up := s.up
 	drain := s.drain
 	s.ssmutex.RUnlock()
 
-	// check that the client making the request has the expected token
-	if (len(cr.Token) != tokenLength || !tokenMatches(cr.Token, s.token)) && cr.Method != "ping" {
-		srerr = ErrPermissionDenied
-		qerr = "Client presented the wrong token"
+	// check that the client speaks a compatible protocol, and that the client
+	// making the request has the expected token
+	var incompatible bool
+	if !protocolCompatible(cr.Protocol, cr.MinProtocol) {
+		srerr = ErrIncompatible
+		qerr = VersionError{ClientVersion: cr.Version, ClientProtocol: cr.Protocol, ServerVersion: Version, ServerProtocol: protocolVersion}.Error()
+		incompatible = true
+	} else if scope := s.tokenScope(cr.Token); !scope.allowed(cr.Method) {
+		if scope == scopeReadOnly {
+			srerr = ErrReadOnlyToken
+			qerr = "Client presented a read-only token for " + cr.Method
+		} else {
+			srerr = ErrPermissionDenied
+			qerr = "Client presented the wrong token"
+		}
 	} else if s.q == nil || (!up && !drain) {
 		// the server just got shutdown
 		srerr = ErrClosedStop
 		qerr = "The server has been stopped"
+	} else if srerr = s.chaos.before(cr); srerr != "" {
+		qerr = "Chaos mode failed the request"
 	} else {
+		if !scope.getStdEnv() {
+			cr.GetStd = false
+			cr.GetEnv = false
+		}
+
 		switch cr.Method {
 		case "ping":
 			// avoid a later race condition when we try to encode ServerInfo by
@@ -71,6 +98,11 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			*si = *s.ServerInfo
 			s.ssmutex.RUnlock()
 			sr = &serverResponse{SInfo: si}
+			if cr.Codec != "" {
+				if _, known := wireHandle(cr.Codec); known {
+					sr.Codec = cr.Codec
+				}
+			}
 		case "backup":
 			s.Debug("backup requested")
 			// make an io.Writer that writes to a byte slice, so we can return
@@ -84,17 +116,50 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				sr = &serverResponse{DB: b.Bytes()}
 			}
 		case "drain":
-			s.Debug("drain requested")
-			err := s.Drain()
+			s.Debug("drain requested", "deadline", cr.Deadline)
+			var deadline time.Time
+			if cr.Deadline > 0 {
+				deadline = time.Now().Add(cr.Deadline)
+			}
+			err := s.DrainBy(deadline)
 			if err != nil {
 				srerr = ErrInternalError
 				qerr = err.Error()
 			} else {
 				sr = &serverResponse{SStats: s.GetServerStats()}
 			}
+		case "getstats":
+			sr = &serverResponse{SStats: s.GetServerStats()}
+		case "getservers":
+			sr = &serverResponse{CloudServers: s.scheduler.CloudServers()}
 		case "shutdown":
+			// acknowledge the request, then carry it out; the client can
+			// find out how it went with a shutdownwait request
 			s.Debug("shutdown requested")
-			s.Stop(true)
+			if s.requestShutdown() {
+				afterReply = func() {
+					go func() {
+						defer internal.LogPanic(s.Logger, "requested shutdown", true)
+						s.requestedShutdown()
+					}()
+				}
+			}
+		case "shutdownwait":
+			// reply once a requested shutdown has done everything but stop
+			req, wait := s.shutdownWaiter()
+			if req == nil {
+				srerr = ErrBadRequest
+				qerr = "shutdown has not been requested"
+			} else {
+				if wait {
+					<-req.done
+					afterReply = req.waiters.Done
+				}
+				if req.err != nil {
+					srerr = ErrDBError
+					qerr = req.err.Error()
+				}
+			}
 		case "upload":
 			// upload file to us
 			if cr.File == nil {
@@ -115,28 +180,164 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					}
 				}
 			}
-		case "add":
+		case "getuploads":
+			ufs, err := s.uploadedFiles()
+			if err != nil {
+				srerr = ErrInternalError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Uploads: ufs}
+			}
+		case "fetchupload":
+			if s.uploadMD5(cr.Path) == "" {
+				srerr = ErrUnknownUpload
+			} else {
+				file, err := compressFile(cr.Path)
+				if err != nil {
+					if os.IsNotExist(err) {
+						srerr = ErrUnknownUpload
+					} else {
+						srerr = ErrInternalError
+						qerr = err.Error()
+					}
+				} else {
+					sr = &serverResponse{File: file}
+				}
+			}
+		case "delupload":
+			err := s.deleteUpload(cr.Path, cr.Force)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrInternalError
+					qerr = err.Error()
+				}
+			}
+		case "gcuploads":
+			deleted, err := s.gcUploads(cr.Timeout)
+			if err != nil {
+				srerr = ErrInternalError
+				qerr = err.Error()
+			}
+			sr = &serverResponse{Existed: deleted}
+		case "setsecret":
+			if len(cr.Keys) != 1 || cr.Secret == nil {
+				srerr = ErrBadRequest
+			} else if !secretNameRegex.MatchString(cr.Keys[0]) {
+				srerr = ErrBadSecretName
+			} else {
+				err := s.setSecret(cr.Keys[0], cr.Secret)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				}
+			}
+		case "delsecret":
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				existed, err := s.db.deleteSecret(cr.Keys[0])
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else if !existed {
+					srerr = ErrUnknownSecret
+				}
+			}
+		case "getsecrets":
+			names, err := s.db.retrieveSecretNames()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Names: names}
+			}
+		case "setenvprofile":
+			if len(cr.Keys) != 1 || cr.Keys[0] == "" || cr.Env == nil {
+				srerr = ErrBadRequest
+			} else {
+				err := s.db.storeEnvProfile(cr.Keys[0], cr.Env)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				}
+			}
+		case "delenvprofile":
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				existed, err := s.db.deleteEnvProfile(cr.Keys[0])
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else if !existed {
+					srerr = ErrUnknownEnvProfile
+				}
+			}
+		case "getenvprofiles":
+			names, err := s.db.retrieveEnvProfileNames()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Names: names}
+			}
+		case "add", "addresults":
 			// add jobs to the queue, and along side keep the environment variables
-			// they're supposed to execute under.
-			if cr.Env == nil || cr.Jobs == nil {
+			// they're supposed to execute under, or use those of the given
+			// profile. "addresults" adds just the valid jobs and says what
+			// happened to each one
+			if (cr.Env == nil && cr.EnvProfile == "") || cr.Jobs == nil {
 				srerr = ErrBadRequest
 			} else {
 				// Store Env
-				envkey, err := s.db.storeEnv(cr.Env)
+				var envkey string
+				var err error
+				if cr.EnvProfile != "" {
+					envkey = s.db.retrieveEnvProfile(cr.EnvProfile)
+					if envkey == "" {
+						srerr = ErrUnknownEnvProfile
+					}
+				} else {
+					envkey, err = s.db.storeEnv(cr.Env)
+				}
+				// optionally don't add jobs that our peers already have
+				var peerDups map[string]string
 				if err != nil {
 					srerr = ErrDBError
 					qerr = err.Error()
-				} else {
-					if srerr == "" {
-						// create the jobs server-side
-						added, dups, alreadyComplete, thisSrerr, err := s.createJobs(cr.Jobs, envkey, cr.IgnoreComplete)
-						if err != nil {
-							srerr = thisSrerr
-							qerr = err.Error()
-						} else {
-							s.Debug("added jobs", "new", added, "dups", dups, "complete", alreadyComplete)
-							sr = &serverResponse{Added: added, Existed: dups + alreadyComplete}
-						}
+				} else if srerr == "" && cr.CheckPeers {
+					peerDups, err = s.fed.peerDups(cr.Jobs, cr.IgnoreComplete)
+					if err != nil {
+						srerr = ErrPeerCheck
+						qerr = err.Error()
+					}
+				}
+
+				if srerr == "" && cr.Method == "addresults" {
+					results, thisSrerr, err := s.addJobsWithResults(cr.Jobs, envkey, cr.IgnoreComplete, peerDups)
+					if err != nil {
+						srerr = thisSrerr
+						qerr = err.Error()
+					} else {
+						sr = &serverResponse{AddResults: results}
+					}
+				} else if srerr == "" {
+					// create the jobs server-side
+					jobs := withoutPeerDups(cr.Jobs, peerDups)
+					var added, dups, alreadyComplete int
+					var thisSrerr string
+					if len(jobs) > 0 {
+						added, dups, alreadyComplete, thisSrerr, err = s.createJobs(jobs, envkey, cr.IgnoreComplete)
+					}
+					if err != nil {
+						srerr = thisSrerr
+						qerr = err.Error()
+					} else {
+						peerDupCount := len(cr.Jobs) - len(jobs)
+						s.Debug("added jobs", "new", added, "dups", dups, "complete", alreadyComplete, "peerDups", peerDupCount)
+						sr = &serverResponse{Added: added, Existed: dups + alreadyComplete + peerDupCount}
 					}
 				}
 			}
@@ -154,7 +355,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					// working on this schedulerGroup, we'll just act as if nothing
 					// was ready. Likewise if in drain mode.
 					skip := false
-					if cr.FirstReserve && s.rc != "" {
+					if cr.FirstReserve && s.rc != "" && !isPeerGroup(cr.SchedulerGroup) {
 						s.sgcmutex.Lock()
 						if count, existed := s.sgroupcounts[cr.SchedulerGroup]; !existed || count == 0 {
 							skip = true
@@ -231,6 +432,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					sjob.StartTime = tnil
 					sjob.EndTime = tnil
 					sjob.PeakRAM = 0
+					sjob.PeakDisk = 0
 					sjob.Exitcode = -1
 					sgroup := sjob.schedulerGroup
 					sjob.Unlock()
@@ -243,6 +445,10 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					// make a copy of the job with some extra stuff filled in (that
 					// we don't want taking up memory here) for the client
 					job := s.itemToJob(item, false, true)
+					job.Wrapper = s.cmdWrapperFor(job.RepGroup)
+					if !job.OutputFilter.IsSet() {
+						job.OutputFilter = s.outputFilter
+					}
 					sr = &serverResponse{Job: job}
 					s.Debug("reserved job", "cmd", job.Cmd, "schedGrp", sgroup)
 				}
@@ -261,6 +467,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 						job.HostID = s.scheduler.HostToID(job.Host)
 					}
 					job.HostIP = cr.Job.HostIP
+					job.SchedulerID = cr.Job.SchedulerID
 					job.Pid = cr.Job.Pid
 					job.StartTime = time.Now()
 					var tend time.Time
@@ -268,8 +475,147 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					job.Attempts++
 					job.killCalled = false
 					job.Lost = false
+					job.Outputs = nil
+					job.Metrics = nil
 				}
 				job.Unlock()
+				if srerr == "" {
+					s.subs.publish(job, JobStateReserved, JobStateRunning)
+				}
+
+				// note that it's running, so that the client can re-attach
+				// to it if we get restarted
+				if srerr == "" {
+					err := s.db.storeRunningJob(cr.Job.key(), cr.ClientID, cr.Job.Pid)
+					if err != nil {
+						s.Warn("storing running job failed", "err", err)
+					}
+				}
+			}
+		case "joutputs":
+			// record outputs that the job's cmd has produced so far
+			if len(cr.Keys) != 1 || len(cr.Outputs) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				var job *Job
+				_, job, srerr = s.getijByKey(cr.Keys[0], cr.ClientID)
+				if srerr == "" {
+					job.Lock()
+					job.addOutputs(cr.Outputs)
+					job.Unlock()
+				}
+			}
+		case "jsecrets":
+			// give a running job's cmd the secrets it needs
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				var job *Job
+				_, job, srerr = s.getijByKey(cr.Keys[0], cr.ClientID)
+				if srerr == "" {
+					secrets, err := s.jobSecrets(job)
+					if err != nil {
+						srerr = ErrInternalError
+						if jqerr, ok := err.(Error); ok {
+							srerr = jqerr.Err
+						}
+						qerr = err.Error()
+					} else {
+						sr = &serverResponse{Secrets: secrets}
+					}
+				}
+			}
+		case "getdeptree":
+			// describe the jobs the given job waits on and that wait on it
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				tree, err := s.dependencyTree(cr.Keys[0])
+				switch {
+				case err != nil:
+					srerr = ErrDBError
+					qerr = err.Error()
+				case tree == nil:
+					srerr = ErrMissingJob
+				default:
+					sr = &serverResponse{DepTree: tree}
+				}
+			}
+		case "subscribe":
+			// start collecting events for the client
+			id, err := s.subs.add(cr.Filter)
+			if err != nil {
+				srerr = ErrInternalError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Path: id}
+			}
+		case "jevents":
+			// give the client the events of its subscription, waiting a while
+			// for there to be some
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				events, dropped, exists := s.subs.collect(cr.Keys[0], cr.Timeout)
+				if !exists {
+					srerr = ErrUnknownSubscriber
+				} else {
+					if dropped > 0 {
+						s.Warn("subscriber fell behind; events were dropped", "dropped", dropped)
+					}
+					sr = &serverResponse{Events: events, Dropped: dropped}
+				}
+			}
+		case "unsubscribe":
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				s.subs.remove(cr.Keys[0])
+			}
+		case "mirrorsnap":
+			// give a Mirror everything it needs to start replicating us
+			jobs, err := s.mirrorSnapshot()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Jobs: jobs}
+			}
+		case "jmountcreds":
+			// give a running job temporary credentials for its mounts
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				var job *Job
+				_, job, srerr = s.getijByKey(cr.Keys[0], cr.ClientID)
+				if srerr == "" {
+					creds, err := s.jobMountCredentials(job)
+					if err != nil {
+						srerr = ErrMountCredentials
+						qerr = err.Error()
+						s.Warn("minting mount credentials failed", "job", cr.Keys[0], "err", err)
+					} else {
+						sr = &serverResponse{MountCreds: creds}
+					}
+				}
+			}
+		case "jstream":
+			// store output of a running job's cmd for its followers
+			if len(cr.Keys) != 1 || cr.Stream == nil {
+				srerr = ErrBadRequest
+			} else {
+				_, _, srerr = s.getijByKey(cr.Keys[0], cr.ClientID)
+				if srerr == "" {
+					s.streams.write(cr.Keys[0], cr.Stream)
+				}
+			}
+		case "getstream":
+			// give a follower the output of a job's cmd written since it last
+			// asked
+			if len(cr.Keys) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				sr = &serverResponse{Stream: s.streams.read(cr.Keys[0], cr.Stream)}
 			}
 		case "jtouch":
 			var job *Job
@@ -282,12 +628,14 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				lost := job.Lost
 				job.RUnlock()
 
+				var shuttingDown bool
 				if !killCalled {
 					// also just return killCalled if server has been set to
-					// kill all jobs
+					// kill all jobs, which only happens when we shut down
 					s.krmutex.RLock()
 					killCalled = s.killRunners
 					s.krmutex.RUnlock()
+					shuttingDown = killCalled
 				}
 
 				if !killCalled {
@@ -308,7 +656,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 						s.statusCaster.Send(&jstateCount{job.RepGroup, JobStateLost, JobStateRunning, 1})
 					}
 				}
-				sr = &serverResponse{KillCalled: killCalled}
+				sr = &serverResponse{KillCalled: killCalled, ShuttingDown: shuttingDown}
 			}
 		case "jarchive":
 			// remove the job from the queue, rpl and live bucket and add to
@@ -322,6 +670,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				// queue package does not check we're in the run queue when
 				// Remove()ing, since you can remove from any queue)
 				job.updateAfterExit(cr.JobEndState)
+				s.kept.keep(job, cr.JobEndState)
 				job.Lock()
 				if running := item.Stats().State == queue.ItemStateRun; !running {
 					srerr = ErrBadJob
@@ -333,8 +682,13 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					key := job.key()
 					job.State = JobStateComplete
 					job.FailReason = ""
+					if job.KeepStd {
+						job.StdOutC = cr.Job.StdOutC
+						job.StdErrC = cr.Job.StdErrC
+					}
 					sgroup := job.schedulerGroup
 					rgroup := job.RepGroup
+					labels := job.Labels
 					job.Unlock()
 					err := s.db.archiveJob(key, job)
 					if err != nil {
@@ -346,11 +700,14 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 							srerr = ErrInternalError
 							qerr = err.Error()
 						} else {
+							s.finishLimitGroups(key, job.getLimitGroups())
 							s.rpl.Lock()
 							if m, exists := s.rpl.lookup[rgroup]; exists {
 								delete(m, key)
 							}
 							s.rpl.Unlock()
+							s.unindexLabels(key, labels)
+							s.mem.forget(job)
 							s.Debug("completed job", "cmd", job.Cmd, "schedGrp", sgroup)
 							go func(group string) {
 								defer internal.LogPanic(s.Logger, "jarchive", true)
@@ -368,15 +725,26 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			item, job, srerr = s.getij(cr)
 			if srerr == "" {
 				job.updateAfterExit(cr.JobEndState)
+				s.kept.keep(job, cr.JobEndState)
 				job.Lock()
 				job.FailReason = cr.Job.FailReason
-				if !job.StartTime.IsZero() {
+				if !job.StartTime.IsZero() && job.FailReason != FailReasonShutdown {
 					// obey jobs's Retries count by adjusting UntilBuried if a
 					// client reserved this job and started to run the job's cmd
+					// (unless it only failed because we told it to stop)
 					job.UntilBuried--
 				}
 				if job.Exited && job.Exitcode != 0 {
-					job.updateRecsAfterFailure()
+					var learned *scheduler.Requirements
+					if job.FailReason == FailReasonRAM || job.FailReason == FailReasonTime {
+						learned = s.recommendedReqs(job.ReqGroup)
+					}
+					job.updateRecsAfterFailure(learned)
+				}
+				if job.UntilBuried <= 0 && job.nextFallback() {
+					// rather than bury, we'll try the next command; the ready
+					// callback will sort out any new scheduler group
+					s.Debug("trying fallback cmd", "cmd", job.Cmd, "fallback", job.FallbackIndex)
 				}
 				if job.UntilBuried <= 0 {
 					sgroup := job.schedulerGroup
@@ -386,18 +754,27 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 						srerr = ErrInternalError
 						qerr = err.Error()
 					} else {
+						s.finishLimitGroups(item.Key, job.getLimitGroups())
 						s.decrementGroupCount(job.getSchedulerGroup())
 						s.db.updateJobAfterExit(job, cr.Job.StdOutC, cr.Job.StdErrC, true)
 						s.Debug("buried job", "cmd", job.Cmd, "schedGrp", sgroup)
 					}
 				} else {
 					sgroup := job.schedulerGroup
+					if job.RetryDelay.IsSet() {
+						failures := int(job.Retries) + 1 - int(job.UntilBuried)
+						errd := s.q.SetDelay(item.Key, job.RetryDelay.delayFor(failures, time.Now()))
+						if errd != nil {
+							s.Warn("release queue SetDelay failed", "err", errd)
+						}
+					}
 					job.Unlock()
 					err := s.q.Release(item.Key)
 					if err != nil {
 						srerr = ErrInternalError
 						qerr = err.Error()
 					} else {
+						s.finishLimitGroups(item.Key, job.getLimitGroups())
 						s.decrementGroupCount(job.getSchedulerGroup())
 						s.db.updateJobAfterExit(job, cr.Job.StdOutC, cr.Job.StdErrC, true)
 						s.Debug("released job", "cmd", job.Cmd, "schedGrp", sgroup)
@@ -411,33 +788,57 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			item, job, srerr = s.getij(cr)
 			if srerr == "" {
 				job.updateAfterExit(cr.JobEndState)
+				s.kept.keep(job, cr.JobEndState)
 				job.Lock()
 				job.FailReason = cr.Job.FailReason
+				// a cmd that can't be run at all won't be fixed by retrying,
+				// but a fallback cmd might work
+				fellBack := permanentCmdFailure(job.FailReason) && job.nextFallback()
 				sgroup := job.schedulerGroup
 				job.Unlock()
-				err := s.q.Bury(item.Key)
+				var err error
+				if fellBack {
+					err = s.q.Release(item.Key)
+				} else {
+					err = s.q.Bury(item.Key)
+				}
 				if err != nil {
 					srerr = ErrInternalError
 					qerr = err.Error()
 				} else {
+					s.finishLimitGroups(item.Key, job.getLimitGroups())
 					s.decrementGroupCount(job.getSchedulerGroup())
 					s.db.updateJobAfterExit(job, cr.Job.StdOutC, cr.Job.StdErrC, true)
-					s.Debug("buried job", "cmd", job.Cmd, "schedGrp", sgroup)
+					if fellBack {
+						s.Debug("released job to try fallback cmd", "cmd", job.Cmd, "fallback", job.FallbackIndex, "schedGrp", sgroup)
+					} else {
+						s.Debug("buried job", "cmd", job.Cmd, "schedGrp", sgroup)
+					}
 				}
 			}
 		case "jkick":
 			// move the jobs from the bury queue to the ready queue; unlike the
 			// other j* methods, client doesn't have to be the Reserve() owner
-			// of these jobs, and we don't want the "in run queue" test
+			// of these jobs, and we don't want the "in run queue" test. If
+			// requested, first apply the suggested remediation of each job
 			if cr.Keys == nil {
 				srerr = ErrBadRequest
 			} else {
 				kicked := 0
+				remediated := 0
 				for _, jobkey := range cr.Keys {
 					item, err := s.q.Get(jobkey)
 					if err != nil || item.Stats().State != queue.ItemStateBury {
 						continue
 					}
+					if cr.Remediate {
+						job := item.Data.(*Job)
+						job.Lock()
+						if job.applyRemediation() {
+							remediated++
+						}
+						job.Unlock()
+					}
 					err = s.q.Kick(jobkey)
 					if err == nil {
 						job := item.Data.(*Job)
@@ -445,10 +846,100 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 						job.UntilBuried = job.Retries + 1
 						s.Debug("unburied job", "cmd", job.Cmd, "schedGrp", job.schedulerGroup)
 						job.Unlock()
+						s.kickDependents(jobkey)
 						kicked++
 					}
 				}
-				sr = &serverResponse{Existed: kicked}
+				sr = &serverResponse{Existed: kicked, Added: remediated}
+			}
+		case "jlabel":
+			// change the labels of the jobs; like jkick, client doesn't have
+			// to be the Reserve() owner of these jobs
+			if cr.Keys == nil || len(cr.Labels) == 0 {
+				srerr = ErrBadRequest
+			} else if err := validateLabels(cr.Labels); err != nil {
+				srerr = ErrBadLabel
+				qerr = err.Error()
+			} else {
+				updated, err := s.setJobLabels(cr.Keys, cr.Labels)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: updated}
+				}
+			}
+		case "jcrash":
+			// attach details of a crashed runner to the jobs it was running;
+			// like jkick, client doesn't have to be the Reserve() owner of
+			// these jobs (the owner is dead)
+			if cr.Keys == nil || cr.Crash == nil {
+				srerr = ErrBadRequest
+			} else {
+				var crashed []*Job
+				for _, jobkey := range cr.Keys {
+					item, err := s.q.Get(jobkey)
+					if err != nil {
+						continue
+					}
+					job := item.Data.(*Job)
+					job.Lock()
+					job.RunnerCrash = cr.Crash
+					s.Warn("runner crashed", "cmd", job.Cmd, "host", cr.Crash.Host, "reason", cr.Crash.Reason)
+					job.Unlock()
+					crashed = append(crashed, job)
+				}
+				var err error
+				if len(crashed) > 0 {
+					err = s.db.updateLiveJobs(crashed)
+				}
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: len(crashed)}
+				}
+			}
+		case "reapsandboxes":
+			// tell a runner which of the sandboxes kept on its host should now
+			// be deleted
+			if cr.Host == "" {
+				srerr = ErrBadRequest
+			} else {
+				sr = &serverResponse{Names: s.kept.expired(cr.Host)}
+			}
+		case "modreqs":
+			// change the requirements of all the not-running jobs in a
+			// RepGroup
+			if cr.RepGroup == "" || cr.ReqChange == nil || cr.ReqChange.isEmpty() {
+				srerr = ErrBadRequest
+			} else if err := cr.ReqChange.validate(); err != nil {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			} else {
+				modified, err := s.modifyRepGroupReqs(cr.RepGroup, cr.ReqChange)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: modified}
+				}
+			}
+		case "jmod":
+			// change the properties of jobs that aren't running
+			if cr.Keys == nil || cr.Modification == nil || cr.Modification.isEmpty() {
+				srerr = ErrBadRequest
+			} else if err := cr.Modification.validate(); err != nil {
+				srerr = ErrBadRequest
+				qerr = err.Error()
+			} else {
+				modified, errsr, err := s.modifyJobs(cr.Keys, cr.Modification)
+				if err != nil {
+					srerr = errsr
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: modified}
+				}
 			}
 		case "jdel":
 			// remove the jobs from the bury/delay/dependent/ready queue and the
@@ -483,7 +974,8 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 						if err == nil {
 							deleted++
 							removedJobs = true
-							s.db.deleteLiveJob(jobkey) //*** probably want to batch this up to delete many at once
+							s.mem.forget(item.Data.(*Job))
+							s.discardLiveJob(jobkey, cr.Purge) //*** probably want to batch this up to delete many at once
 						}
 					}
 
@@ -496,9 +988,165 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					}
 					break
 				}
-				s.Debug("deleted jobs", "count", deleted)
+
+				// when purging, jobs already in the trash go as well
+				if cr.Purge {
+					purged, err := s.db.purgeTrashedJobs(cr.Keys)
+					if err != nil {
+						s.Warn("failed to purge jobs from the trash", "err", err)
+					}
+					deleted += purged
+				}
+				s.Debug("deleted jobs", "count", deleted, "purge", cr.Purge)
 				sr = &serverResponse{Existed: deleted}
 			}
+		case "getreqprofiles":
+			profiles, err := s.db.retrieveReqGroupProfiles()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{ReqProfiles: profiles}
+			}
+		case "setreqprofiles":
+			if len(cr.ReqProfiles) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				err := s.db.storeReqGroupOverrides(cr.ReqProfiles)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				}
+			}
+		case "addreqsamples":
+			if len(cr.ReqSamples) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				err := s.db.storeReqGroupSamples(cr.ReqSamples)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				}
+			}
+		case "delreqprofiles":
+			if len(cr.Keys) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				deleted, err := s.db.deleteReqGroupOverrides(cr.Keys)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: deleted}
+				}
+			}
+		case "resetreqprofiles":
+			if len(cr.Keys) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				reset, err := s.db.deleteReqGroupSamples(cr.Keys)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: reset}
+				}
+			}
+		case "getrgdefaults":
+			defaults, err := s.db.retrieveRepGroupDefaults()
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{RepGroupDefaults: defaults}
+			}
+		case "setrgdefaults":
+			if len(cr.RepGroupDefaults) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				err := s.db.storeRepGroupDefaults(cr.RepGroupDefaults)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				}
+			}
+		case "delrgdefaults":
+			if len(cr.Keys) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				deleted, err := s.db.deleteRepGroupDefaults(cr.Keys)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Existed: deleted}
+				}
+			}
+		case "getlimitgroups":
+			sr = &serverResponse{LimitGroups: s.limitGroups.list()}
+		case "setlimitgroups":
+			if len(cr.LimitGroups) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				for _, group := range cr.LimitGroups {
+					if validateLimitGroupName(group.Name) != nil || group.Limit < 0 {
+						srerr = ErrBadRequest
+						break
+					}
+				}
+				if srerr == "" {
+					err := s.db.storeLimitGroups(cr.LimitGroups)
+					if err != nil {
+						srerr = ErrDBError
+						qerr = err.Error()
+					} else {
+						s.q.Unhold(s.limitGroups.set(cr.LimitGroups)...)
+					}
+				}
+			}
+		case "dellimitgroups":
+			if len(cr.Keys) == 0 {
+				srerr = ErrBadRequest
+			} else {
+				deleted, err := s.db.deleteLimitGroups(cr.Keys)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					s.q.Unhold(s.limitGroups.remove(cr.Keys)...)
+					sr = &serverResponse{Existed: deleted}
+				}
+			}
+		case "gettrash":
+			tjs, err := s.trashedJobs(nil, cr.RepGroup)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Trash: tjs}
+			}
+		case "gettimeline":
+			tss, err := s.timeline(cr.RepGroup, cr.Since)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Timeline: tss}
+			}
+		case "jrestore":
+			// put jobs from the trash back in the queue
+			if cr.Keys == nil {
+				srerr = ErrBadRequest
+			} else {
+				restored, thisSrerr, err := s.restoreJobs(cr.Keys)
+				if err != nil {
+					srerr = thisSrerr
+					qerr = err.Error()
+				} else {
+					s.Debug("restored jobs", "count", restored)
+					sr = &serverResponse{Added: restored}
+				}
+			}
 		case "jkill":
 			// set the killCalled property on the jobs, to change the subsequent
 			// behaviour of jtouch; as per jkick, client doesn't have to be the
@@ -548,6 +1196,64 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			if len(jobs) > 0 {
 				sr = &serverResponse{Jobs: jobs}
 			}
+		case "getbrt":
+			// get jobs by their RepGroup, including those in RepGroups below it
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var jobs []*Job
+				jobs, srerr, qerr = s.getJobsByRepGroupTree(cr.Job.RepGroup, cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
+				if len(jobs) > 0 {
+					sr = &serverResponse{Jobs: jobs}
+				}
+			}
+		case "getrgc":
+			// count the states of jobs at each level of a RepGroup hierarchy
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var rgcs []*RepGroupCount
+				rgcs, srerr, qerr = s.repGroupCounts(cr.Job.RepGroup)
+				if len(rgcs) > 0 {
+					sr = &serverResponse{RepGroupCounts: rgcs}
+				}
+			}
+		case "getrgm":
+			// summarise the metrics of jobs at each level of a RepGroup
+			// hierarchy
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				var rgms []*RepGroupMetrics
+				rgms, srerr, qerr = s.repGroupMetrics(cr.Job.RepGroup)
+				if len(rgms) > 0 {
+					sr = &serverResponse{RepGroupMetrics: rgms}
+				}
+			}
+		case "getbl":
+			// get jobs by one of their labels
+			if len(cr.Labels) != 1 {
+				srerr = ErrBadRequest
+			} else {
+				var jobs []*Job
+				for key, value := range cr.Labels {
+					jobs = s.getJobsByLabel(key, value, cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
+				}
+				if len(jobs) > 0 {
+					sr = &serverResponse{Jobs: jobs}
+				}
+			}
+		case "getfailsum":
+			// summarise why buried jobs failed
+			repGroup := ""
+			if cr.Job != nil {
+				repGroup = cr.Job.RepGroup
+			}
+			var failures []*FailureCluster
+			failures, srerr, qerr = s.failureSummary(repGroup)
+			if len(failures) > 0 {
+				sr = &serverResponse{Failures: failures}
+			}
 		default:
 			srerr = ErrUnknownCommand
 		}
@@ -556,10 +1262,21 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	// on error, just send the error back to client and return a more detailed
 	// error for logging
 	if srerr != "" {
-		errr := s.reply(m, &serverResponse{Err: srerr})
+		esr := &serverResponse{Err: srerr}
+		if incompatible {
+			// so the client can say what version we are
+			s.ssmutex.RLock()
+			esr.SInfo = &ServerInfo{Version: s.ServerInfo.Version, Protocol: s.ServerInfo.Protocol, MinProtocol: s.ServerInfo.MinProtocol}
+			s.ssmutex.RUnlock()
+		}
+		var errr error
+		sent, errr = s.reply(m, ch, esr)
 		if errr != nil {
 			s.Warn("reply to client failed", "err", errr)
 		}
+		if afterReply != nil {
+			afterReply()
+		}
 		if qerr == "" {
 			qerr = srerr
 		}
@@ -575,8 +1292,61 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 		sr = &serverResponse{}
 	}
 
+	// pretend the reply got lost
+	if s.chaos.dropReply(cr.Method) {
+		if afterReply != nil {
+			afterReply()
+		}
+		return nil
+	}
+
 	// send reply to client
-	return s.reply(m, sr) // *** log failure to reply?
+	var err error
+	sent, err = s.reply(m, ch, sr) // *** log failure to reply?
+	if afterReply != nil {
+		afterReply()
+	}
+	return err
+}
+
+// requestTimer holds what we need to know about a client request when it
+// started, to be able to log its handling time once it has been replied to.
+type requestTimer struct {
+	method   string
+	size     int
+	start    time.Time
+	q        *queue.Queue
+	lockWait time.Duration
+}
+
+// timeRequest starts timing the handling of a client request of the given
+// method and encoded size. Pass the result to requestDone() after replying.
+func (s *Server) timeRequest(method string, size int) *requestTimer {
+	rt := &requestTimer{method: method, size: size, q: s.q}
+	if rt.q != nil {
+		rt.lockWait = rt.q.LockWait()
+	}
+	rt.start = time.Now()
+	return rt
+}
+
+// requestDone records how long the request took to handle, and warns about it
+// if that exceeded our SlowRequest threshold. The queue lock wait reported is
+// the total time that all requests being handled in parallel with this one
+// spent waiting on each other for access to the queue, which tells you if a
+// slow request was slow due to contention rather than its own work.
+func (s *Server) requestDone(rt *requestTimer, sent int) {
+	took := time.Since(rt.start)
+	s.logTimings(rt.method, took)
+
+	if s.slowRequest <= 0 || took < s.slowRequest {
+		return
+	}
+	var lockWait time.Duration
+	if rt.q != nil {
+		lockWait = rt.q.LockWait() - rt.lockWait
+	}
+	s.Warn("slow request", "method", rt.method, "took", took, "requestBytes", rt.size, "replyBytes", sent, "queueLockWait", lockWait)
 }
 
 // logTimings will log the average took after 1000 calls to this message with
@@ -631,13 +1401,23 @@ func (s *Server) getij(cr *clientRequest) (*queue.Item, *Job, string) {
 		return nil, nil, ErrBadRequest
 	}
 
-	item, err := s.q.Get(cr.Job.key())
+	// if we were restarted while the client was running this job, let it
+	// carry on
+	s.reattachJob(cr)
+
+	return s.getijByKey(cr.Job.key(), cr.ClientID)
+}
+
+// getijByKey is like getij, but for when the client only supplied the key of
+// the job.
+func (s *Server) getijByKey(key string, clientID uuid.UUID) (*queue.Item, *Job, string) {
+	item, err := s.q.Get(key)
 	if err != nil || item.Stats().State != queue.ItemStateRun {
 		return item, nil, ErrBadJob
 	}
 	job := item.Data.(*Job)
 
-	if !uuid.Equal(cr.ClientID, job.ReservedBy) {
+	if !uuid.Equal(clientID, job.ReservedBy) {
 		return item, job, ErrMustReserve
 	}
 
@@ -659,54 +1439,17 @@ func (s *Server) itemStateToJobState(itemState queue.ItemState, lost bool) JobSt
 func (s *Server) itemToJob(item *queue.Item, getStd bool, getEnv bool) *Job {
 	sjob := item.Data.(*Job)
 	sjob.RLock()
-
 	stats := item.Stats()
-
-	state := s.itemStateToJobState(stats.State, sjob.Lost)
-
-	// we're going to fill in some properties of the Job and return
-	// it to client, but don't want those properties set here for
-	// us, so we make a new Job and fill stuff in that
-	req := &scheduler.Requirements{}
-	*req = *sjob.Requirements // copy reqs since server changes these, avoiding a race condition
-	job := &Job{
-		RepGroup:     sjob.RepGroup,
-		ReqGroup:     sjob.ReqGroup,
-		DepGroups:    sjob.DepGroups,
-		Cmd:          sjob.Cmd,
-		Cwd:          sjob.Cwd,
-		CwdMatters:   sjob.CwdMatters,
-		ChangeHome:   sjob.ChangeHome,
-		ActualCwd:    sjob.ActualCwd,
-		Requirements: req,
-		Priority:     sjob.Priority,
-		Retries:      sjob.Retries,
-		PeakRAM:      sjob.PeakRAM,
-		Exited:       sjob.Exited,
-		Exitcode:     sjob.Exitcode,
-		FailReason:   sjob.FailReason,
-		StartTime:    sjob.StartTime,
-		EndTime:      sjob.EndTime,
-		Pid:          sjob.Pid,
-		Host:         sjob.Host,
-		HostID:       sjob.HostID,
-		HostIP:       sjob.HostIP,
-		CPUtime:      sjob.CPUtime,
-		State:        state,
-		Attempts:     sjob.Attempts,
-		UntilBuried:  sjob.UntilBuried,
-		ReservedBy:   sjob.ReservedBy,
-		EnvKey:       sjob.EnvKey,
-		EnvOverride:  sjob.EnvOverride,
-		Dependencies: sjob.Dependencies,
-		Behaviours:   sjob.Behaviours,
-		MountConfigs: sjob.MountConfigs,
-	}
-
-	if !sjob.StartTime.IsZero() && state == JobStateReserved {
-		job.State = JobStateRunning
-	}
+	job := sjob.clientCopy(s.itemStateToJobState(stats.State, sjob.Lost))
+	spilled := sjob.coldSpilled
 	sjob.RUnlock()
+	if spilled {
+		envOverride, behaviours, err := s.db.retrieveColdFields(job.key())
+		if err != nil {
+			s.Warn("itemToJob failed to retrieve job fields from the database", "cmd", job.Cmd, "err", err)
+		}
+		job.EnvOverride, job.Behaviours = envOverride, behaviours
+	}
 	s.jobPopulateStdEnv(job, getStd, getEnv)
 	return job
 }
@@ -725,15 +1468,16 @@ func (s *Server) jobPopulateStdEnv(job *Job, getStd bool, getEnv bool) {
 	}
 }
 
-// reply to a client
-func (s *Server) reply(m *mangos.Message, sr *serverResponse) error {
+// reply to a client, encoding with the given handle. Returns the size of the
+// encoded reply.
+func (s *Server) reply(m *mangos.Message, ch codec.Handle, sr *serverResponse) (int, error) {
 	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, s.ch)
+	enc := codec.NewEncoderBytes(&encoded, ch)
 	err := enc.Encode(sr)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	m.Body = encoded
 	err = s.sock.SendMsg(m)
-	return err
+	return len(encoded), err
 }
@@ -28,12 +28,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/ugorji/go/codec"
@@ -43,7 +41,9 @@ const (
 	restJobsEndpoint       = "/rest/v1/jobs/"
 	restWarningsEndpoint   = "/rest/v1/warnings/"
 	restBadServersEndpoint = "/rest/v1/servers/"
+	restTimelineEndpoint   = "/rest/v1/timeline/"
 	restFileUploadEndpoint = "/rest/v1/upload/"
+	restDebugEndpoint      = "/rest/v1/debug/"
 	restFormTrue           = "true"
 	bearerSchema           = "Bearer "
 )
@@ -57,16 +57,21 @@ type JobViaJSON struct {
 	ChangeHome   bool         `json:"change_home"`
 	MountConfigs MountConfigs `json:"mounts"`
 	ReqGrp       string       `json:"req_grp"`
-	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte.
+	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte (see
+	// ParseMemory()).
 	Memory string `json:"memory"`
-	// Time is a duration with a unit suffix, eg. 1h for 1 hour.
+	// Time is a duration with a unit suffix, eg. 1h for 1 hour or 2d4h for 2
+	// days and 4 hours (see ParseDuration()).
 	Time string `json:"time"`
 	CPUs *int   `json:"cpus"`
 	// Disk is the number of Gigabytes the cmd will use.
 	Disk             *int              `json:"disk"`
+	EnforceDisk      bool              `json:"enforce_disk"`
 	Override         *int              `json:"override"`
 	Priority         *int              `json:"priority"`
 	Retries          *int              `json:"retries"`
+	RetryDelay       RetryDelay        `json:"retry_delay"`
+	Sandbox          SandboxPolicy     `json:"sandbox"`
 	RepGrp           string            `json:"rep_grp"`
 	DepGrps          []string          `json:"dep_grps"`
 	Deps             []string          `json:"deps"`
@@ -78,9 +83,34 @@ type JobViaJSON struct {
 	CloudOS          string            `json:"cloud_os"`
 	CloudUser        string            `json:"cloud_username"`
 	CloudScript      string            `json:"cloud_script"`
+	CloudScriptVars  string            `json:"cloud_script_vars"`
 	CloudConfigFiles string            `json:"cloud_config_files"`
 	CloudOSRam       *int              `json:"cloud_ram"`
 	CloudFlavor      string            `json:"cloud_flavor"`
+	CloudScratch     int               `json:"cloud_scratch"`
+	Limits           ProcessLimits     `json:"limits"`
+	OutputDest       string            `json:"output_dest"`
+	Shell            string            `json:"shell"`
+	Arch             string            `json:"arch"`
+	Secrets          []string          `json:"secrets"`
+	StartRate        *int              `json:"start_rate"`
+	LimitGrps        []string          `json:"limit_grps"`
+	IdealCPUs        int               `json:"ideal_cpus"`
+	IdealMemory      string            `json:"ideal_memory"`
+	Labels           map[string]string `json:"labels"`
+	Fingerprint      bool              `json:"fingerprint"`
+	CoreDumps        bool              `json:"core_dumps"`
+	CoreDest         string            `json:"core_dest"`
+	Report           bool              `json:"report"`
+	Datacentre       string            `json:"datacentre"`
+	HostSetup        string            `json:"host_setup"`
+	HostCleanup      string            `json:"host_cleanup"`
+	MaxPerHost       int               `json:"max_per_host"`
+	CallbackURL      string            `json:"callback_url"`
+	StartDeadline    StartDeadline     `json:"start_deadline"`
+	OutputFilter     OutputFilter      `json:"output_filter"`
+	Container        Container         `json:"container"`
+	Fallbacks        []FallbackViaJSON `json:"fallbacks"`
 }
 
 // JobDefaults is supplied to JobViaJSON.Convert() to provide default values for
@@ -99,12 +129,14 @@ type JobDefaults struct {
 	// Time is the amount of time each cmd will run for. Defaults to 1 hour.
 	Time time.Duration
 	// Disk is the number of Gigabytes cmds will use.
-	Disk      int
-	Override  int
-	Priority  int
-	Retries   int
-	DepGroups []string
-	Deps      Dependencies
+	Disk int
+	// EnforceDisk results in cmds being killed if they use more than Disk.
+	EnforceDisk bool
+	Override    int
+	Priority    int
+	Retries     int
+	DepGroups   []string
+	Deps        Dependencies
 	// Env is a comma separated list of key=val pairs.
 	Env          string
 	OnFailure    Behaviours
@@ -116,11 +148,73 @@ type JobDefaults struct {
 	CloudFlavor  string
 	// CloudScript is the local path to a script.
 	CloudScript string
+	// CloudScriptVars are comma separated key=value pairs available to
+	// cloud scripts that are templates.
+	CloudScriptVars string
 	// CloudConfigFiles is the config files to copy in cloud.Server.CopyOver() format
 	CloudConfigFiles string
 	// CloudOSRam is the number of Megabytes that CloudOS needs to run. Defaults
 	// to 1000.
-	CloudOSRam    int
+	CloudOSRam int
+	// CloudScratch is the number of Gigabytes of scratch volume each cmd
+	// needs.
+	CloudScratch int
+	// Limits are the umask and resource limits cmds will run with.
+	Limits ProcessLimits
+	// RetryDelay controls how long cmds wait after failing before being
+	// retried.
+	RetryDelay RetryDelay
+	// Sandbox controls when the unique working directories of cmds get
+	// deleted.
+	Sandbox SandboxPolicy
+	// OutputDest is a template for where cmd outputs should end up.
+	OutputDest string
+	// Shell is the shell cmds will be run with.
+	Shell string
+	// Arch is the CPU architecture cmds need to run on.
+	Arch string
+	// Secrets are the names of secrets cmds need.
+	Secrets []string
+	// StartRate is the maximum number of cmds in a RepGrp that may start
+	// per minute.
+	StartRate int
+	// LimitGroups are the names of the limit groups cmds belong to.
+	LimitGroups []string
+	// IdealCPUs and IdealMemory (in Megabytes) are the most cores and RAM
+	// cmds could make use of, if available.
+	IdealCPUs   int
+	IdealMemory int
+	// Labels are key=value pairs to tag cmds with.
+	Labels map[string]string
+	// Fingerprint results in the execution environment of cmds being
+	// recorded.
+	Fingerprint bool
+	// CoreDumps results in cmds being allowed to dump core, with any core
+	// being collected in CoreDest.
+	CoreDumps bool
+	CoreDest  string
+	// Report results in an execution report being written to the working
+	// directory of cmds when they finish.
+	Report bool
+	// Datacentre is the datacentre cmds should run in, when the manager has
+	// peers in other datacentres.
+	Datacentre string
+	// HostSetup and HostCleanup are commands to run once per host before the
+	// first and after the last cmd of their scheduler group.
+	HostSetup   string
+	HostCleanup string
+	// MaxPerHost is the most cmds of the same scheduler group that may run at
+	// once on any one host.
+	MaxPerHost int
+	// CallbackURL is a URL the manager POSTs to when cmds finish.
+	CallbackURL string
+	// StartDeadline controls what happens to cmds that have waited too long
+	// to start.
+	StartDeadline StartDeadline
+	// OutputFilter controls which lines of the output of cmds are kept.
+	OutputFilter OutputFilter
+	// Container is the container cmds should be run inside.
+	Container     Container
 	compressedEnv []byte
 	osRAM         string
 }
@@ -191,6 +285,7 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 	var deps Dependencies
 	var behaviours Behaviours
 	var mounts MountConfigs
+	var limits ProcessLimits
 
 	if jvj.RepGrp == "" {
 		repg = jd.RepGrp
@@ -219,12 +314,113 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		changeHome = true
 	}
 
+	enforceDisk := jd.EnforceDisk
+	if jvj.EnforceDisk {
+		enforceDisk = true
+	}
+
+	fingerprint := jd.Fingerprint
+	if jvj.Fingerprint {
+		fingerprint = true
+	}
+
+	coreDumps := jd.CoreDumps
+	if jvj.CoreDumps {
+		coreDumps = true
+	}
+
+	report := jd.Report
+	if jvj.Report {
+		report = true
+	}
+
+	coreDest := jd.CoreDest
+	if jvj.CoreDest != "" {
+		coreDest = jvj.CoreDest
+	}
+
+	datacentre := jd.Datacentre
+	if jvj.Datacentre != "" {
+		datacentre = jvj.Datacentre
+	}
+
+	callbackURL := jd.CallbackURL
+	if jvj.CallbackURL != "" {
+		callbackURL = jvj.CallbackURL
+	}
+	if callbackURL != "" {
+		u, err := url.Parse(callbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("callback_url value (%s) is not an http(s) URL", callbackURL)
+		}
+	}
+
+	outputDest := jd.OutputDest
+	if jvj.OutputDest != "" {
+		outputDest = jvj.OutputDest
+	}
+
+	shell := jd.Shell
+	if jvj.Shell != "" {
+		shell = jvj.Shell
+	}
+
+	arch := jd.Arch
+	if jvj.Arch != "" {
+		arch = jvj.Arch
+	}
+
+	secrets := jd.Secrets
+	if len(jvj.Secrets) > 0 {
+		secrets = jvj.Secrets
+	}
+
+	startRate := jd.StartRate
+	if jvj.StartRate != nil {
+		startRate = *jvj.StartRate
+	}
+	if startRate < 0 {
+		return nil, fmt.Errorf("start_rate value (%d) can't be negative", startRate)
+	}
+
+	limitGroups := jd.LimitGroups
+	if len(jvj.LimitGrps) > 0 {
+		limitGroups = jvj.LimitGrps
+	}
+
+	idealCPUs := jd.IdealCPUs
+	if jvj.IdealCPUs > 0 {
+		idealCPUs = jvj.IdealCPUs
+	}
+
+	idealMB := jd.IdealMemory
+	if jvj.IdealMemory != "" {
+		thismb, err := ParseMemory(jvj.IdealMemory)
+		if err != nil {
+			return nil, fmt.Errorf("ideal_%s", err)
+		}
+		idealMB = thismb
+	}
+
+	var labels map[string]string
+	if len(jd.Labels) > 0 || len(jvj.Labels) > 0 {
+		labels = make(map[string]string, len(jd.Labels)+len(jvj.Labels))
+		for key, value := range jd.Labels {
+			labels[key] = value
+		}
+		for key, value := range jvj.Labels {
+			labels[key] = value
+		}
+		if err := validateLabels(labels); err != nil {
+			return nil, err
+		}
+	}
+
 	if jvj.ReqGrp == "" {
 		if jd.ReqGrp != "" {
 			rg = jd.ReqGrp
 		} else {
-			parts := strings.Split(cmd, " ")
-			rg = filepath.Base(parts[0])
+			rg = reqGroupForCmd(cmd)
 		}
 	} else {
 		rg = jvj.ReqGrp
@@ -239,20 +435,20 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 	if jvj.Memory == "" {
 		mb = jd.DefaultMemory()
 	} else {
-		thismb, err := bytefmt.ToMegabytes(jvj.Memory)
+		thismb, err := ParseMemory(jvj.Memory)
 		if err != nil {
-			return nil, fmt.Errorf("memory value (%s) was not specified correctly: %s", jvj.Memory, err)
+			return nil, err
 		}
-		mb = int(thismb)
+		mb = thismb
 	}
 
 	if jvj.Time == "" {
 		dur = jd.DefaultTime()
 	} else {
 		var err error
-		dur, err = time.ParseDuration(jvj.Time)
+		dur, err = ParseDuration(jvj.Time)
 		if err != nil {
-			return nil, fmt.Errorf("time value (%s) was not specified correctly: %s", jvj.Time, err)
+			return nil, err
 		}
 	}
 
@@ -344,6 +540,56 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		mounts = jd.MountConfigs
 	}
 
+	retryDelay := jd.RetryDelay
+	if jvj.RetryDelay.IsSet() {
+		retryDelay = jvj.RetryDelay
+	}
+	if err := retryDelay.Validate(); err != nil {
+		return nil, err
+	}
+
+	sandbox := jd.Sandbox
+	if jvj.Sandbox.IsSet() {
+		sandbox = jvj.Sandbox
+	}
+	if err := sandbox.Validate(); err != nil {
+		return nil, err
+	}
+
+	startDeadline := jd.StartDeadline
+	if jvj.StartDeadline.IsSet() {
+		startDeadline = jvj.StartDeadline
+	}
+	if err := startDeadline.Validate(); err != nil {
+		return nil, err
+	}
+
+	outputFilter := jd.OutputFilter
+	if jvj.OutputFilter.IsSet() {
+		outputFilter = jvj.OutputFilter
+	}
+	if err := outputFilter.Validate(); err != nil {
+		return nil, err
+	}
+
+	container := jd.Container
+	if jvj.Container.IsSet() {
+		container = jvj.Container
+	}
+	if err := container.Validate(); err != nil {
+		return nil, err
+	}
+
+	if jvj.Limits.IsSet() {
+		limits = jvj.Limits
+	} else {
+		limits = jd.Limits
+	}
+	err := limits.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	// scheduler-specific options
 	other := make(map[string]string)
 	if jvj.CloudOS != "" {
@@ -379,6 +625,12 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		other["cloud_script"] = string(postCreation)
 	}
 
+	if jvj.CloudScriptVars != "" {
+		other["cloud_script_vars"] = jvj.CloudScriptVars
+	} else if jd.CloudScriptVars != "" {
+		other["cloud_script_vars"] = jd.CloudScriptVars
+	}
+
 	if jvj.CloudConfigFiles != "" {
 		other["cloud_config_files"] = jvj.CloudConfigFiles
 	} else if jd.CloudConfigFiles != "" {
@@ -392,33 +644,125 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		other["cloud_os_ram"] = jd.DefaultCloudOSRam()
 	}
 
+	if jvj.CloudScratch > 0 {
+		other["cloud_scratch"] = strconv.Itoa(jvj.CloudScratch)
+	} else if jd.CloudScratch > 0 {
+		other["cloud_scratch"] = strconv.Itoa(jd.CloudScratch)
+	}
+
+	if jvj.HostSetup != "" {
+		other[hostSetupOther] = jvj.HostSetup
+	} else if jd.HostSetup != "" {
+		other[hostSetupOther] = jd.HostSetup
+	}
+
+	if jvj.HostCleanup != "" {
+		other[hostCleanupOther] = jvj.HostCleanup
+	} else if jd.HostCleanup != "" {
+		other[hostCleanupOther] = jd.HostCleanup
+	}
+
+	if jvj.MaxPerHost < 0 {
+		return nil, fmt.Errorf("max_per_host value (%d) can't be negative", jvj.MaxPerHost)
+	}
+	if jvj.MaxPerHost > 0 {
+		other[jqs.MaxPerHostKey] = strconv.Itoa(jvj.MaxPerHost)
+	} else if jd.MaxPerHost > 0 {
+		other[jqs.MaxPerHostKey] = strconv.Itoa(jd.MaxPerHost)
+	}
+
+	req := &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, Arch: arch, Other: other}
+
+	var fallbacks []*Fallback
+	for _, fvj := range jvj.Fallbacks {
+		fb, err := fvj.convert(req)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, fb)
+	}
+
 	return &Job{
-		RepGroup:     repg,
-		Cmd:          cmd,
-		Cwd:          cwd,
-		CwdMatters:   cwdMatters,
-		ChangeHome:   changeHome,
-		ReqGroup:     rg,
-		Requirements: &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, Other: other},
-		Override:     uint8(override),
-		Priority:     uint8(priority),
-		Retries:      uint8(retries),
-		DepGroups:    depGroups,
-		Dependencies: deps,
-		EnvOverride:  envOverride,
-		Behaviours:   behaviours,
-		MountConfigs: mounts,
+		RepGroup:           repg,
+		Cmd:                cmd,
+		Cwd:                cwd,
+		CwdMatters:         cwdMatters,
+		ChangeHome:         changeHome,
+		SandboxPolicy:      sandbox,
+		ReqGroup:           rg,
+		Requirements:       req,
+		Override:           uint8(override),
+		Priority:           uint8(priority),
+		Retries:            uint8(retries),
+		RetryDelay:         retryDelay,
+		DepGroups:          depGroups,
+		Dependencies:       deps,
+		EnvOverride:        envOverride,
+		Behaviours:         behaviours,
+		MountConfigs:       mounts,
+		ProcessLimits:      limits,
+		EnforceDisk:        enforceDisk,
+		OutputDest:         outputDest,
+		Shell:              shell,
+		Secrets:            secrets,
+		StartRate:          startRate,
+		LimitGroups:        limitGroups,
+		IdealCores:         idealCPUs,
+		IdealRAM:           idealMB,
+		Labels:             labels,
+		CaptureFingerprint: fingerprint,
+		CoreDumps:          coreDumps,
+		CoreDest:           coreDest,
+		ExecutionReport:    report,
+		Datacentre:         datacentre,
+		CallbackURL:        callbackURL,
+		StartDeadline:      startDeadline,
+		OutputFilter:       outputFilter,
+		Container:          container,
+		Fallbacks:          fallbacks,
 	}, nil
 }
 
 // httpAuthorized checks for parameter 'token' and for Authorization header for
-// Bearer token; if not supplied, or the token is wrong, writes out an error to
-// w, otherwise returns true.
+// Bearer token; if not supplied, or the token is wrong, or is the read-only
+// token and this isn't a GET request, writes out an error to w, otherwise
+// returns true.
 func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	scope, ok := s.httpTokenScope(w, r)
+	if !ok {
+		return false
+	}
+	if !scope.allowedHTTP(r.Method) {
+		http.Error(w, "Read-only token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// httpTokenScope is like httpAuthorized, but doesn't check the request method,
+// instead returning the scope of the valid token supplied.
+func (s *Server) httpTokenScope(w http.ResponseWriter, r *http.Request) (tokenScope, bool) {
+	token, ok := httpToken(w, r)
+	if !ok {
+		return scopeNone, false
+	}
+
+	scope := s.tokenScope([]byte(token))
+	if scope == scopeNone {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return scopeNone, false
+	}
+	return scope, true
+}
+
+// httpToken gets the token supplied with a request, either as the 'token'
+// parameter or as a Bearer token in the Authorization header. If neither were
+// supplied, writes out an error to w and returns false.
+func httpToken(w http.ResponseWriter, r *http.Request) (string, bool) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("form parsing error: %s", err), http.StatusBadRequest)
-		return false
+		return "", false
 	}
 
 	// try token parameter
@@ -428,22 +772,17 @@ func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return false
+			return "", false
 		}
 
 		if !strings.HasPrefix(authHeader, bearerSchema) {
 			http.Error(w, "Authorization requires Bearer scheme", http.StatusUnauthorized)
-			return false
+			return "", false
 		}
 
 		token = authHeader[len(bearerSchema):]
 	}
-
-	if !tokenMatches([]byte(token), s.token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return false
-	}
-	return true
+	return token, true
 }
 
 // restJobs lets you do CRUD on jobs in the queue.
@@ -451,10 +790,14 @@ func restJobs(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(s.Logger, "jobqueue web server restJobs", false)
 
-		ok := s.httpAuthorized(w, r)
+		scope, ok := s.httpTokenScope(w, r)
 		if !ok {
 			return
 		}
+		if !scope.allowedHTTP(r.Method) {
+			http.Error(w, "Read-only token", http.StatusForbidden)
+			return
+		}
 
 		// carry out a different action based on the HTTP Verb
 		var jobs []*Job
@@ -462,7 +805,7 @@ func restJobs(s *Server) http.HandlerFunc {
 		var err error
 		switch r.Method {
 		case http.MethodGet:
-			jobs, status, err = restJobsStatus(r, s)
+			jobs, status, err = restJobsStatus(r, s, scope)
 		case http.MethodPost:
 			jobs, status, err = restJobsAdd(r, s)
 		default:
@@ -475,36 +818,84 @@ func restJobs(s *Server) http.HandlerFunc {
 			return
 		}
 
-		// convert jobs to jstatus
-		jstati := make([]jstatus, len(jobs))
-		for i, job := range jobs {
-			jstati[i] = jobToStatus(job)
-		}
-
-		// return job details as JSON
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(status)
-		encoder := json.NewEncoder(w)
-		encoder.SetEscapeHTML(false)
-		erre := encoder.Encode(jstati)
+		erre := writeJobStatuses(w, status, jobs)
 		if erre != nil {
 			s.Warn("restJobs failed to encode job statuses", "err", erre)
 		}
 	}
 }
 
+// writeJobStatuses converts the given jobs to JobStatus and writes them out as
+// JSON with the given http.Status* value.
+func writeJobStatuses(w http.ResponseWriter, status int, jobs []*Job) error {
+	jstati := make([]JobStatus, len(jobs))
+	for i, job := range jobs {
+		jstati[i] = jobToStatus(job)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(jstati)
+}
+
 // restJobsStatus gets the status of the requested jobs in the queue. The
 // request url can be suffixed with comma separated job keys or RepGroups.
 // Possible query parameters are std, env (which can take a "true" value), limit
-// (a number) and state (one of delayed|ready|reserved|running|lost|buried|
-// dependent|complete). Returns the Jobs, a http.Status* value and error.
-func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
-	// handle possible ?query parameters
-	var getStd, getEnv bool
-	var limit int
-	var state JobState
-	var err error
+// (a number), state (one of delayed|ready|reserved|running|lost|buried|
+// dependent|complete) and fail_code (one of the FailCode* values); std and env
+// are ignored unless the request was made with the full token. Returns the
+// Jobs, a http.Status* value and error.
+func restJobsStatus(r *http.Request, s *Server, scope tokenScope) ([]*Job, int, error) {
+	limit, state, failCode, getStd, getEnv, err := restJobsQuery(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !scope.getStdEnv() {
+		getStd = false
+		getEnv = false
+	}
 
+	if len(r.URL.Path) > len(restJobsEndpoint) {
+		// get the requested jobs
+		ids := r.URL.Path[len(restJobsEndpoint):]
+		var jobs []*Job
+		for _, id := range strings.Split(ids, ",") {
+			if len(id) == 32 {
+				// id might be a Job.key()
+				theseJobs, _, qerr := s.getJobsByKeys([]string{id}, getStd, getEnv)
+				if qerr == "" && len(theseJobs) > 0 {
+					jobs = append(jobs, theseJobs...)
+					continue
+				}
+			}
+
+			// id might be a Job.RepGroup
+			theseJobs, _, qerr := s.getJobsByRepGroup(id, limit, state, getStd, getEnv)
+			if qerr != "" {
+				return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
+			}
+			if len(theseJobs) > 0 {
+				jobs = append(jobs, theseJobs...)
+			}
+		}
+		if failCode != "" {
+			jobs = FilterJobsByFailCode(jobs, failCode)
+		}
+		return jobs, http.StatusOK, err
+	}
+
+	// get all current jobs
+	jobs := s.getJobsCurrent(limit, state, getStd, getEnv)
+	if failCode != "" {
+		jobs = FilterJobsByFailCode(jobs, failCode)
+	}
+	return jobs, http.StatusOK, err
+}
+
+// restJobsQuery parses the possible ?query parameters of restJobsStatus().
+func restJobsQuery(r *http.Request) (limit int, state JobState, failCode string, getStd bool, getEnv bool, err error) {
 	if r.Form.Get("std") == restFormTrue {
 		getStd = true
 	}
@@ -514,7 +905,7 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 	if r.Form.Get("limit") != "" {
 		limit, err = strconv.Atoi(r.Form.Get("limit"))
 		if err != nil {
-			return nil, http.StatusBadRequest, err
+			return limit, state, failCode, getStd, getEnv, err
 		}
 	}
 	if r.Form.Get("state") != "" {
@@ -537,35 +928,11 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 			state = JobStateComplete
 		}
 	}
-
-	if len(r.URL.Path) > len(restJobsEndpoint) {
-		// get the requested jobs
-		ids := r.URL.Path[len(restJobsEndpoint):]
-		var jobs []*Job
-		for _, id := range strings.Split(ids, ",") {
-			if len(id) == 32 {
-				// id might be a Job.key()
-				theseJobs, _, qerr := s.getJobsByKeys([]string{id}, getStd, getEnv)
-				if qerr == "" && len(theseJobs) > 0 {
-					jobs = append(jobs, theseJobs...)
-					continue
-				}
-			}
-
-			// id might be a Job.RepGroup
-			theseJobs, _, qerr := s.getJobsByRepGroup(id, limit, state, getStd, getEnv)
-			if qerr != "" {
-				return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
-			}
-			if len(theseJobs) > 0 {
-				jobs = append(jobs, theseJobs...)
-			}
-		}
-		return jobs, http.StatusOK, err
+	failCode = r.Form.Get("fail_code")
+	if failCode != "" && FailCodeReason(failCode) == "" {
+		err = fmt.Errorf("fail_code [%s] is not known", failCode)
 	}
-
-	// get all current jobs
-	return s.getJobsCurrent(limit, state, getStd, getEnv), http.StatusOK, err
+	return limit, state, failCode, getStd, getEnv, err
 }
 
 // restJobsAdd creates and adds jobs to the queue and returns them on success.
@@ -573,46 +940,91 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 //
 // It optionally takes parameters to use as defaults for the job properties,
 // which correspond to the json properties of a JobViaJSON (except for cmd and
-// cmd_deps). For dep_grps, deps and env, which normally take []string, provide
-// a comma-separated list. mounts, on_failure, on_success and on_exit values
-// should be supplied as url query escaped JSON strings.
+// cmd_deps). For dep_grps, deps, env, secrets and limit_grps, which normally
+// take []string, provide a comma-separated list. mounts, on_failure,
+// on_success, on_exit, output_filter and container values should be supplied
+// as url query escaped JSON strings. limits, retry_delay, sandbox and
+// start_deadline should be comma-separated lists of key=value pairs, as
+// understood by ParseProcessLimits(), ParseRetryDelay(), ParseSandboxPolicy()
+// and ParseStartDeadline() respectively.
 //
 // The returned int is a http.Status* variable.
 func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 	// handle possible ?query parameters
 	jd := &JobDefaults{
-		Cwd:         r.Form.Get("cwd"),
-		RepGrp:      r.Form.Get("rep_grp"),
-		ReqGrp:      r.Form.Get("req_grp"),
-		CPUs:        urlStringToInt(r.Form.Get("cpus")),
-		Disk:        urlStringToInt(r.Form.Get("disk")),
-		Override:    urlStringToInt(r.Form.Get("override")),
-		Priority:    urlStringToInt(r.Form.Get("priority")),
-		Retries:     urlStringToInt(r.Form.Get("retries")),
-		DepGroups:   urlStringToSlice(r.Form.Get("dep_grps")),
-		Env:         r.Form.Get("env"),
-		CloudOS:     r.Form.Get("cloud_os"),
-		CloudUser:   r.Form.Get("cloud_username"),
-		CloudScript: r.Form.Get("cloud_script"),
-		CloudFlavor: r.Form.Get("cloud_flavor"),
-		CloudOSRam:  urlStringToInt(r.Form.Get("cloud_ram")),
-	}
+		Cwd:          r.Form.Get("cwd"),
+		RepGrp:       r.Form.Get("rep_grp"),
+		ReqGrp:       r.Form.Get("req_grp"),
+		CPUs:         urlStringToInt(r.Form.Get("cpus")),
+		Disk:         urlStringToInt(r.Form.Get("disk")),
+		Override:     urlStringToInt(r.Form.Get("override")),
+		Priority:     urlStringToInt(r.Form.Get("priority")),
+		Retries:      urlStringToInt(r.Form.Get("retries")),
+		DepGroups:    urlStringToSlice(r.Form.Get("dep_grps")),
+		Env:          r.Form.Get("env"),
+		CloudOS:      r.Form.Get("cloud_os"),
+		CloudUser:    r.Form.Get("cloud_username"),
+		CloudScript:  r.Form.Get("cloud_script"),
+		CloudFlavor:  r.Form.Get("cloud_flavor"),
+		CloudOSRam:   urlStringToInt(r.Form.Get("cloud_ram")),
+		CloudScratch: urlStringToInt(r.Form.Get("cloud_scratch")),
+		OutputDest:   r.Form.Get("output_dest"),
+		Shell:        r.Form.Get("shell"),
+		Arch:         r.Form.Get("arch"),
+		Secrets:      urlStringToSlice(r.Form.Get("secrets")),
+		StartRate:    urlStringToInt(r.Form.Get("start_rate")),
+		LimitGroups:  urlStringToSlice(r.Form.Get("limit_grps")),
+		IdealCPUs:    urlStringToInt(r.Form.Get("ideal_cpus")),
+		HostSetup:    r.Form.Get("host_setup"),
+		HostCleanup:  r.Form.Get("host_cleanup"),
+		MaxPerHost:   urlStringToInt(r.Form.Get("max_per_host")),
+		CoreDest:     r.Form.Get("core_dest"),
+		Datacentre:   r.Form.Get("datacentre"),
+		CallbackURL:  r.Form.Get("callback_url"),
+	}
+	jd.CloudScriptVars = r.Form.Get("cloud_script_vars")
 	if r.Form.Get("cwd_matters") == restFormTrue {
 		jd.CwdMatters = true
 	}
 	if r.Form.Get("change_home") == restFormTrue {
 		jd.ChangeHome = true
 	}
+	if r.Form.Get("enforce_disk") == restFormTrue {
+		jd.EnforceDisk = true
+	}
+	if r.Form.Get("fingerprint") == restFormTrue {
+		jd.Fingerprint = true
+	}
+	if r.Form.Get("core_dumps") == restFormTrue {
+		jd.CoreDumps = true
+	}
+	if r.Form.Get("report") == restFormTrue {
+		jd.Report = true
+	}
 	if r.Form.Get("memory") != "" {
-		mb, err := bytefmt.ToMegabytes(r.Form.Get("memory"))
+		mb, err := ParseMemory(r.Form.Get("memory"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		jd.Memory = mb
+	}
+	if r.Form.Get("ideal_memory") != "" {
+		mb, err := ParseMemory(r.Form.Get("ideal_memory"))
 		if err != nil {
 			return nil, http.StatusBadRequest, err
 		}
-		jd.Memory = int(mb)
+		jd.IdealMemory = mb
+	}
+	if r.Form.Get("labels") != "" {
+		labels, err := ParseLabels(r.Form.Get("labels"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		jd.Labels = labels
 	}
 	if r.Form.Get("time") != "" {
 		var err error
-		jd.Time, err = time.ParseDuration(r.Form.Get("time"))
+		jd.Time, err = ParseDuration(r.Form.Get("time"))
 		if err != nil {
 			return nil, http.StatusBadRequest, err
 		}
@@ -663,6 +1075,46 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 			jd.MountConfigs = mcs
 		}
 	}
+	if r.Form.Get("output_filter") != "" {
+		err := urlStringToStruct(r.Form.Get("output_filter"), &jd.OutputFilter)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("container") != "" {
+		err := urlStringToStruct(r.Form.Get("container"), &jd.Container)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("limits") != "" {
+		var err error
+		jd.Limits, err = ParseProcessLimits(r.Form.Get("limits"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("retry_delay") != "" {
+		var err error
+		jd.RetryDelay, err = ParseRetryDelay(r.Form.Get("retry_delay"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("sandbox") != "" {
+		var err error
+		jd.Sandbox, err = ParseSandboxPolicy(r.Form.Get("sandbox"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if r.Form.Get("start_deadline") != "" {
+		var err error
+		jd.StartDeadline, err = ParseStartDeadline(r.Form.Get("start_deadline"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
 
 	// decode the posted JSON
 	var jvjs []*JobViaJSON
@@ -806,6 +1258,99 @@ func restBadServers(s *Server) http.HandlerFunc {
 	}
 }
 
+// restTimeline lets you read the snapshots of queue state recorded when the
+// server has a TimelineInterval. The optional 'rep_grp' parameter limits the
+// counts to that RepGroup and below, and the optional 'since' parameter is a
+// duration (eg. 24h) limiting the snapshots to those taken that long ago or
+// more recently. The only method supported is GET.
+func restTimeline(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restTimeline", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		var since time.Time
+		if r.Form.Get("since") != "" {
+			ago, err := time.ParseDuration(r.Form.Get("since"))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad since parameter: %s", err), http.StatusBadRequest)
+				return
+			}
+			since = time.Now().Add(-ago)
+		}
+
+		tss, err := s.timeline(r.Form.Get("rep_grp"), since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(tss) == 0 {
+			tss = []*TimelineSnapshot{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		erre := encoder.Encode(tss)
+		if erre != nil {
+			s.Warn("restTimeline failed to encode timeline", "err", erre)
+		}
+	}
+}
+
+// restDebug returns a DebugInfo describing the internals of the server's queue,
+// for debugging jobs that seem to be stuck. Only GET is supported, and only
+// with the full (not read-only) token. The optional timers parameter sets how
+// many of the delayed and running jobs with the soonest timers to include
+// (default 10).
+func restDebug(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restDebug", false)
+
+		scope, ok := s.httpTokenScope(w, r)
+		if !ok {
+			return
+		}
+		if scope != scopeFull {
+			http.Error(w, "Admin token required", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			return
+		}
+
+		timers := debugTimers
+		if r.Form.Get("timers") != "" {
+			var err error
+			timers, err = strconv.Atoi(r.Form.Get("timers"))
+			if err != nil || timers < 0 {
+				http.Error(w, fmt.Sprintf("bad timers parameter: %s", r.Form.Get("timers")), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(s.debugInfo(timers))
+		if err != nil {
+			s.Warn("restDebug failed to encode debug info", "err", err)
+		}
+	}
+}
+
 // restFileUpload lets you upload files from a client to the server. The only
 // method supported is PUT.
 func restFileUpload(s *Server) http.HandlerFunc {
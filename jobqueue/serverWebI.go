@@ -61,9 +61,10 @@ type jstatusReq struct {
 	Msg        string // required argument for dismissMsg
 }
 
-// jstatus is the job info we send to the status webpage (only real difference
-// to Job is that some of the values are converted to easy-to-display forms).
-type jstatus struct {
+// JobStatus is the job info we send to the status webpage and return from the
+// REST API (only real difference to Job is that some of the values are
+// converted to easy-to-display forms).
+type JobStatus struct {
 	Key          string
 	RepGroup     string
 	DepGroups    []string
@@ -75,6 +76,8 @@ type jstatus struct {
 	HomeChanged  bool
 	Behaviours   string
 	Mounts       string
+	OutputDest   string
+	Outputs      []string
 	// ExpectedRAM is in Megabytes.
 	ExpectedRAM int
 	// ExpectedTime is in seconds.
@@ -87,10 +90,12 @@ type jstatus struct {
 	Exited        bool
 	Exitcode      int
 	FailReason    string
+	FailCode      string
 	Pid           int
 	Host          string
 	HostID        string
 	HostIP        string
+	SchedulerID   string
 	Walltime      float64
 	CPUtime       float64
 	Started       int64
@@ -119,42 +124,49 @@ func webInterfaceStatic(s *Server) http.HandlerFunc {
 			}
 		}
 
-		// during development, to avoid having to rebuild and restart manager on
-		// every change to a file in static dir, do:
-		// $ esc -pkg jobqueue -prefix $GOPATH/src/github.com/VertebrateResequencing/wr/static -private -o jobqueue/static.go $GOPATH/src/github.com/VertebrateResequencing/wr/static
-		// and set the boolean to true. Don't forget to rerun esc without the abs
-		// paths and change the boolean back to false before any commit!
-		doc, err := _escFSByte(false, path)
+		err := writeStaticDoc(w, r, path)
 		if err != nil {
-			http.NotFound(w, r)
-			return
+			s.Error("web interface static document write failed", "err", err)
 		}
+	}
+}
 
-		if strings.HasPrefix(path, "/js") {
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		} else if strings.HasPrefix(path, "/css") {
-			w.Header().Set("Content-Type", "text/css; charset=utf-8")
-		} else if strings.HasPrefix(path, "/fonts") {
-			if strings.HasSuffix(path, ".eot") {
-				w.Header().Set("Content-Type", "application/vnd.ms-fontobject")
-			} else if strings.HasSuffix(path, ".svg") {
-				w.Header().Set("Content-Type", "image/svg+xml")
-			} else if strings.HasSuffix(path, ".ttf") {
-				w.Header().Set("Content-Type", "application/x-font-truetype")
-			} else if strings.HasSuffix(path, ".woff") {
-				w.Header().Set("Content-Type", "application/font-woff")
-			} else if strings.HasSuffix(path, ".woff2") {
-				w.Header().Set("Content-Type", "application/font-woff2")
-			}
-		} else if strings.HasSuffix(path, "favicon.ico") {
-			w.Header().Set("Content-Type", "image/x-icon")
-		}
+// writeStaticDoc writes out the static document at the given path with an
+// appropriate Content-Type, or a 404 if there's no such document.
+func writeStaticDoc(w http.ResponseWriter, r *http.Request, path string) error {
+	// during development, to avoid having to rebuild and restart manager on
+	// every change to a file in static dir, do:
+	// $ esc -pkg jobqueue -prefix $GOPATH/src/github.com/VertebrateResequencing/wr/static -private -o jobqueue/static.go $GOPATH/src/github.com/VertebrateResequencing/wr/static
+	// and set the boolean to true. Don't forget to rerun esc without the abs
+	// paths and change the boolean back to false before any commit!
+	doc, err := _escFSByte(false, path)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
 
-		_, err = w.Write(doc)
-		if err != nil {
-			s.Error("web interface static document write failed", "err", err)
+	if strings.HasPrefix(path, "/js") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	} else if strings.HasPrefix(path, "/css") {
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	} else if strings.HasPrefix(path, "/fonts") {
+		if strings.HasSuffix(path, ".eot") {
+			w.Header().Set("Content-Type", "application/vnd.ms-fontobject")
+		} else if strings.HasSuffix(path, ".svg") {
+			w.Header().Set("Content-Type", "image/svg+xml")
+		} else if strings.HasSuffix(path, ".ttf") {
+			w.Header().Set("Content-Type", "application/x-font-truetype")
+		} else if strings.HasSuffix(path, ".woff") {
+			w.Header().Set("Content-Type", "application/font-woff")
+		} else if strings.HasSuffix(path, ".woff2") {
+			w.Header().Set("Content-Type", "application/font-woff2")
 		}
+	} else if strings.HasSuffix(path, "favicon.ico") {
+		w.Header().Set("Content-Type", "image/x-icon")
 	}
+
+	_, err = w.Write(doc)
+	return err
 }
 
 // webSocket upgrades a http connection to a websocket
@@ -175,7 +187,7 @@ func webSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, bool) {
 // webpage
 func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ok := s.httpAuthorized(w, r)
+		scope, ok := s.httpTokenScope(w, r)
 		if !ok {
 			return
 		}
@@ -217,6 +229,11 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 
 				switch {
 				case req.Request != "":
+					// the read-only token can only be used to look
+					if scope != scopeFull && req.Request != "current" && req.Request != "details" {
+						continue
+					}
+
 					switch req.Request {
 					case "current":
 						// get all current jobs
@@ -234,7 +251,11 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 						for _, job := range jobs {
 							repGroups[job.RepGroup] = append(repGroups[job.RepGroup], job)
 						}
+						// also roll the counts up to each higher level of
+						// hierarchical RepGroups, sent with a trailing
+						// RepGroupSeparator to distinguish them
 						failed := false
+						rollups := make(map[string][]*Job)
 						for repGroup, jobs := range repGroups {
 							complete, _, qerr := s.getCompleteJobsByRepGroup(repGroup)
 							if qerr != "" {
@@ -247,6 +268,19 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 								failed = true
 								break
 							}
+							levels := repGroupLevels(repGroup)
+							for _, level := range levels[:len(levels)-1] {
+								rollups[level+RepGroupSeparator] = append(rollups[level+RepGroupSeparator], jobs...)
+							}
+						}
+						if !failed {
+							for rollup, jobs := range rollups {
+								err := webInterfaceStatusSendGroupStateCount(conn, rollup, jobs)
+								if err != nil {
+									failed = true
+									break
+								}
+							}
 						}
 
 						// also send details of dead servers
@@ -269,7 +303,13 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 						// *** probably want to take the count as a req option,
 						// so user can request to see more than just 1 job per
 						// State+Exitcode+FailReason
-						jobs, _, errstr := s.getJobsByRepGroup(req.RepGroup, 1, req.State, true, true)
+						var jobs []*Job
+						var errstr string
+						if strings.HasSuffix(req.RepGroup, RepGroupSeparator) {
+							jobs, errstr, _ = s.getJobsByRepGroupTree(req.RepGroup, 1, req.State, scope.getStdEnv(), scope.getStdEnv())
+						} else {
+							jobs, errstr, _ = s.getJobsByRepGroup(req.RepGroup, 1, req.State, scope.getStdEnv(), scope.getStdEnv())
+						}
 						if errstr == "" && len(jobs) > 0 {
 							writeMutex.Lock()
 							failed := false
@@ -316,7 +356,9 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 								s.Warn("failed to remove job", "cmd", job.Cmd, "err", err)
 								continue
 							}
-							s.db.deleteLiveJob(key)
+							s.discardLiveJob(key, false)
+							s.mem.forget(job)
+							s.unindexLabels(key, job.Labels)
 							s.Debug("removed job", "cmd", job.Cmd)
 							toDelete = append(toDelete, key)
 							if job.State == JobStateReady {
@@ -359,7 +401,7 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 						continue
 					}
 				case req.Key != "":
-					jobs, _, errstr := s.getJobsByKeys([]string{req.Key}, true, true)
+					jobs, _, errstr := s.getJobsByKeys([]string{req.Key}, scope.getStdEnv(), scope.getStdEnv())
 					if errstr == "" && len(jobs) == 1 {
 						status := jobToStatus(jobs[0])
 						writeMutex.Lock()
@@ -443,7 +485,13 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 	}
 }
 
-func jobToStatus(job *Job) jstatus {
+// ToStatus returns a JobStatus summarising the Job. Its StdErr, StdOut and Env
+// will only be set if the Job was retrieved with them.
+func (j *Job) ToStatus() JobStatus {
+	return jobToStatus(j)
+}
+
+func jobToStatus(job *Job) JobStatus {
 	stderr, _ := job.StdErr()
 	stdout, _ := job.StdOut()
 	env, _ := job.Env()
@@ -462,7 +510,11 @@ func jobToStatus(job *Job) jstatus {
 	for key, val := range job.Requirements.Other {
 		ot = append(ot, key+":"+val)
 	}
-	return jstatus{
+	var outputs []string
+	for _, a := range job.Outputs {
+		outputs = append(outputs, a.String())
+	}
+	return JobStatus{
 		Key:           job.key(),
 		RepGroup:      job.RepGroup,
 		DepGroups:     job.DepGroups,
@@ -474,6 +526,8 @@ func jobToStatus(job *Job) jstatus {
 		HomeChanged:   job.ChangeHome,
 		Behaviours:    job.Behaviours.String(),
 		Mounts:        job.MountConfigs.String(),
+		OutputDest:    job.OutputDest,
+		Outputs:       outputs,
 		ExpectedRAM:   job.Requirements.RAM,
 		ExpectedTime:  job.Requirements.Time.Seconds(),
 		RequestedDisk: job.Requirements.Disk,
@@ -483,10 +537,12 @@ func jobToStatus(job *Job) jstatus {
 		Exited:        job.Exited,
 		Exitcode:      job.Exitcode,
 		FailReason:    job.FailReason,
+		FailCode:      FailReasonCode(job.FailReason),
 		Pid:           job.Pid,
 		Host:          job.Host,
 		HostID:        job.HostID,
 		HostIP:        job.HostIP,
+		SchedulerID:   job.SchedulerID,
 		Walltime:      job.WallTime().Seconds(),
 		CPUtime:       job.CPUtime.Seconds(),
 		Started:       job.StartTime.Unix(),
@@ -511,7 +567,19 @@ func (s *Server) reqToJobs(req jstatusReq, allowedItemStates []queue.ItemState)
 	if req.RepGroup != "" {
 		s.rpl.RLock()
 		defer s.rpl.RUnlock()
-		for key := range s.rpl.lookup[req.RepGroup] {
+		keys := s.rpl.lookup[req.RepGroup]
+		if strings.HasSuffix(req.RepGroup, RepGroupSeparator) {
+			// a rolled-up level of hierarchical RepGroups
+			keys = make(map[string]bool)
+			for repGroup, rgKeys := range s.rpl.lookup {
+				if repGroupIsUnder(repGroup, req.RepGroup) {
+					for key := range rgKeys {
+						keys[key] = true
+					}
+				}
+			}
+		}
+		for key := range keys {
 			item, err := s.q.Get(key)
 			if item == nil || err != nil {
 				continue
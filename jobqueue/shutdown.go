@@ -0,0 +1,131 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the server code for shutting down at the request of a
+// client: acknowledging the request, telling runners to give up their jobs,
+// doing a final database backup and letting the client know how that went,
+// before actually stopping.
+
+import (
+	"sync"
+	"time"
+)
+
+// shutdownRunnerWait is how long a requested shutdown waits for runners to
+// notice that we're shutting down and exit, as a multiple of
+// ClientTouchInterval.
+const shutdownRunnerWait = 3
+
+// shutdownReplyWait is the most time we give clients waiting on the outcome of
+// a requested shutdown to be sent their reply, before we stop.
+const shutdownReplyWait = 5 * time.Second
+
+// shutdownRequest tracks a shutdown requested by a client.
+type shutdownRequest struct {
+	done     chan struct{}
+	err      error
+	finished bool
+	waiters  sync.WaitGroup
+}
+
+// requestShutdown records that a client requested a shutdown, also stopping
+// any more jobs from being reserved. Returns false if a shutdown had already
+// been requested.
+func (s *Server) requestShutdown() bool {
+	s.ssmutex.Lock()
+	defer s.ssmutex.Unlock()
+	if s.shutdownReq != nil {
+		return false
+	}
+	s.shutdownReq = &shutdownRequest{done: make(chan struct{})}
+	s.drain = true
+	s.ServerInfo.Mode = ServerModeDrain
+	return true
+}
+
+// shutdownWaiter returns the current shutdown request, or nil if there isn't
+// one. If the bool is true, the caller has been added to the request's waiters
+// and must wait on its done channel, then call waiters.Done() once it has
+// replied to its client.
+func (s *Server) shutdownWaiter() (*shutdownRequest, bool) {
+	s.ssmutex.Lock()
+	defer s.ssmutex.Unlock()
+	req := s.shutdownReq
+	if req == nil || req.finished {
+		return req, false
+	}
+	req.waiters.Add(1)
+	return req, true
+}
+
+// requestedShutdown carries out a shutdown requested by a client, after we've
+// acknowledged the request. Runners are told we're shutting down (so they kill
+// their Cmds and release their jobs with FailReasonShutdown), and given some
+// time to exit. Then the database is backed up, and clients waiting on the
+// outcome are told of any backup error, before we Stop().
+func (s *Server) requestedShutdown() {
+	s.krmutex.Lock()
+	s.killRunners = true
+	s.krmutex.Unlock()
+
+	if s.HasRunners() {
+		limit := time.After(shutdownRunnerWait * ClientTouchInterval)
+		ticker := time.NewTicker(100 * time.Millisecond)
+	WAIT:
+		for {
+			select {
+			case <-ticker.C:
+				if !s.HasRunners() {
+					break WAIT
+				}
+			case <-limit:
+				s.Warn("requested shutdown proceeding with runners still running")
+				break WAIT
+			}
+		}
+		ticker.Stop()
+	}
+
+	err := s.db.backupNow()
+	if err != nil {
+		s.Error("requested shutdown database backup failed", "err", err)
+	}
+
+	s.ssmutex.Lock()
+	req := s.shutdownReq
+	req.err = err
+	req.finished = true
+	close(req.done)
+	s.ssmutex.Unlock()
+
+	replied := make(chan struct{})
+	go func() {
+		req.waiters.Wait()
+		close(replied)
+	}()
+	select {
+	case <-replied:
+	case <-time.After(shutdownReplyWait):
+		s.Warn("requested shutdown proceeding without replying to all clients")
+	}
+
+	// we already waited for runners as long as we're willing to
+	s.Stop()
+}
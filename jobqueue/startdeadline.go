@@ -0,0 +1,272 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for escalating Jobs that have been waiting to
+// start for longer than they wanted to.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// StartDeadline struct is used for setting in a Job to have the Server take
+// action if the Job has been ready to run for longer than Within without
+// starting, eg. because the cluster is full of other work. Escalation happens
+// (at most) once each time the Job becomes ready.
+type StartDeadline struct {
+	// Within is how long the Job may be ready to run before it is escalated,
+	// eg. "30m" (see ParseDuration()).
+	Within string `json:"within,omitempty"`
+
+	// Priority, if higher than the Job's Priority, is the Priority the Job is
+	// raised to.
+	Priority uint8 `json:"priority,omitempty"`
+
+	// RelaxFlavor, if true, removes any cloud_flavor the Job was restricted to,
+	// so that it can run on any flavor of server big enough.
+	RelaxFlavor bool `json:"relax_flavor,omitempty"`
+
+	// Datacentre, if set, has the Job forwarded to the peer manager that
+	// handles that datacentre (see Job.Datacentre), eg. one that uses a cloud
+	// scheduler and so can create more capacity on demand.
+	Datacentre string `json:"datacentre,omitempty"`
+
+	// Notify, if true, results in the Server logging a warning about the Job,
+	// and POSTing to its CallbackURL (if any) with state "ready".
+	Notify bool `json:"notify,omitempty"`
+}
+
+// ParseStartDeadline takes a comma separated list of key=value pairs, where
+// keys correspond to the json properties of a StartDeadline, eg.
+// "within=30m,priority=200,notify=true", and returns a validated
+// StartDeadline.
+func ParseStartDeadline(startDeadline string) (StartDeadline, error) {
+	var sd StartDeadline
+	if startDeadline == "" {
+		return sd, nil
+	}
+	for _, pair := range strings.Split(startDeadline, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return sd, fmt.Errorf("start deadline [%s] is not in key=value format", pair)
+		}
+		var err error
+		switch strings.TrimSpace(kv[0]) {
+		case "within":
+			sd.Within = kv[1]
+		case "priority":
+			var p uint64
+			p, err = strconv.ParseUint(kv[1], 10, 8)
+			sd.Priority = uint8(p)
+		case "relax_flavor":
+			sd.RelaxFlavor, err = strconv.ParseBool(kv[1])
+		case "datacentre":
+			sd.Datacentre = kv[1]
+		case "notify":
+			sd.Notify, err = strconv.ParseBool(kv[1])
+		default:
+			return sd, fmt.Errorf("start deadline [%s] is not a known setting", kv[0])
+		}
+		if err != nil {
+			return sd, fmt.Errorf("start deadline %s [%s] is invalid: %s", kv[0], kv[1], err)
+		}
+	}
+	return sd, sd.Validate()
+}
+
+// IsSet tells you if any of the settings have been specified.
+func (sd StartDeadline) IsSet() bool {
+	return sd.Within != "" || sd.Priority > 0 || sd.RelaxFlavor || sd.Datacentre != "" || sd.Notify
+}
+
+// Validate checks that Within is parsable and that at least one form of
+// escalation has been specified, returning an error if not.
+func (sd StartDeadline) Validate() error {
+	if !sd.IsSet() {
+		return nil
+	}
+	if sd.Within == "" {
+		return fmt.Errorf("start deadline needs a within duration")
+	}
+	if _, err := ParseDuration(sd.Within); err != nil {
+		return fmt.Errorf("start deadline within [%s] is invalid: %s", sd.Within, err)
+	}
+	if sd.Priority == 0 && !sd.RelaxFlavor && sd.Datacentre == "" && !sd.Notify {
+		return fmt.Errorf("start deadline [%s] has no escalation", sd)
+	}
+	return nil
+}
+
+// String returns a comma separated list of the key=value settings that have
+// been set, in the same format accepted by ParseStartDeadline().
+func (sd StartDeadline) String() string {
+	var set []string
+	if sd.Within != "" {
+		set = append(set, "within="+sd.Within)
+	}
+	if sd.Priority > 0 {
+		set = append(set, "priority="+strconv.Itoa(int(sd.Priority)))
+	}
+	if sd.RelaxFlavor {
+		set = append(set, "relax_flavor=true")
+	}
+	if sd.Datacentre != "" {
+		set = append(set, "datacentre="+sd.Datacentre)
+	}
+	if sd.Notify {
+		set = append(set, "notify=true")
+	}
+	return strings.Join(set, ",")
+}
+
+// within returns our Within as a duration. Assumes we Validate().
+func (sd StartDeadline) within() time.Duration {
+	d, _ := ParseDuration(sd.Within)
+	return d
+}
+
+// readyJob is a Job with a StartDeadline that is waiting to start.
+type readyJob struct {
+	job      *Job
+	deadline time.Time
+}
+
+// startDeadlines tracks the ready Jobs that have a StartDeadline.
+type startDeadlines struct {
+	jobs map[string]*readyJob
+	sync.Mutex
+}
+
+// ready notes that the given job became ready to run at the given time, if it
+// has a StartDeadline.
+func (sds *startDeadlines) ready(job *Job, now time.Time) {
+	job.RLock()
+	sd := job.StartDeadline
+	key := job.key()
+	job.RUnlock()
+	if !sd.IsSet() {
+		return
+	}
+	sds.Lock()
+	defer sds.Unlock()
+	sds.jobs[key] = &readyJob{job: job, deadline: now.Add(sd.within())}
+}
+
+// left notes that the given job is no longer ready to run.
+func (sds *startDeadlines) left(job *Job) {
+	key := job.key()
+	sds.Lock()
+	defer sds.Unlock()
+	delete(sds.jobs, key)
+}
+
+// due returns the jobs whose deadlines have passed by the given time, and
+// stops tracking them.
+func (sds *startDeadlines) due(now time.Time) []*Job {
+	sds.Lock()
+	defer sds.Unlock()
+	var jobs []*Job
+	for key, rj := range sds.jobs {
+		if now.After(rj.deadline) {
+			jobs = append(jobs, rj.job)
+			delete(sds.jobs, key)
+		}
+	}
+	return jobs
+}
+
+// escalate applies the StartDeadline of each of the given jobs that are still
+// ready to run. Jobs whose Requirements or Datacentre changed are then put in
+// to new scheduler groups, as per modifyRepGroupReqs(). Returns the number of
+// jobs escalated.
+func (s *Server) escalate(jobs []*Job) (int, error) {
+	var updated []*Job
+	oldGroups := make(map[string]int)
+	for _, job := range jobs {
+		key := job.key()
+		item, err := s.q.Get(key)
+		if err != nil || item == nil {
+			continue
+		}
+		stats := item.Stats()
+		if stats.State != queue.ItemStateReady {
+			continue
+		}
+
+		job.Lock()
+		sd := job.StartDeadline
+		regroup := false
+		if sd.Priority > job.Priority {
+			job.Priority = sd.Priority
+		}
+		if _, restricted := job.Requirements.Other["cloud_flavor"]; sd.RelaxFlavor && restricted {
+			// copy reqs since clients may be reading them
+			req := *job.Requirements
+			req.Other = make(map[string]string)
+			for k, v := range job.Requirements.Other {
+				if k != "cloud_flavor" {
+					req.Other[k] = v
+				}
+			}
+			job.Requirements = &req
+			regroup = true
+		}
+		if sd.Datacentre != "" && sd.Datacentre != job.Datacentre {
+			job.Datacentre = sd.Datacentre
+			regroup = true
+		}
+		if regroup && job.scheduledRunner {
+			oldGroups[job.schedulerGroup]++
+			job.scheduledRunner = false
+		}
+		priority, group := job.Priority, job.schedulerGroup
+		job.Unlock()
+
+		if priority != stats.Priority {
+			if erru := s.q.Update(key, group, job, priority, stats.Delay, stats.TTR); erru != nil {
+				s.Warn("start deadline priority change failed", "job", key, "err", erru)
+			}
+		}
+		if sd.Notify {
+			s.Warn("job has not started by its start deadline", "job", key, "within", sd.Within)
+			s.sendCallback(job, JobStateReady)
+		}
+		updated = append(updated, job)
+	}
+
+	if len(updated) == 0 {
+		return 0, nil
+	}
+
+	s.uncountScheduledRunners(oldGroups)
+
+	err := s.db.updateLiveJobs(updated)
+
+	// our ready callback will calculate the new scheduler groups of the ready
+	// jobs and (re)schedule runners for both the new and old groups
+	s.q.TriggerReadyAddedCallback()
+
+	return len(updated), err
+}
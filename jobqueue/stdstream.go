@@ -0,0 +1,232 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for streaming the STDOUT and STDERR of the Cmds
+// of Jobs that have StreamStd set to the server while they run, so that they
+// can be followed (as 'wr run' does) instead of only seen once the Cmd exits.
+
+import (
+	"sync"
+	"time"
+)
+
+// jobStreamMax is the most of each of the STDOUT and STDERR of a Job that the
+// server holds for followers, and that a runner holds while it can't reach the
+// server. Older output is dropped.
+const jobStreamMax = 1024 * 1024
+
+// jobStreamKeep is how long the server holds the streamed output of a Job after
+// it was last written to, so that followers can read the end of it after the
+// Job has stopped running.
+var jobStreamKeep = 10 * time.Minute
+
+// ClientStreamInterval is how often runners send the output of Cmds of Jobs
+// with StreamStd set to the server.
+var ClientStreamInterval = 1 * time.Second
+
+// StreamedStd holds some of the output of a Job's Cmd, as returned by
+// Client.GetStreamedStd().
+type StreamedStd struct {
+	StdOut []byte
+	StdErr []byte
+
+	// StdOutOffset and StdErrOffset are the positions in the Cmd's whole
+	// STDOUT and STDERR that StdOut and StdErr end at; supply this
+	// StreamedStd to your next GetStreamedStd() call to get what was written
+	// after them.
+	StdOutOffset int64
+	StdErrOffset int64
+}
+
+// stdStream is the end of one of the STDOUT or STDERR of a Job's Cmd, as held
+// by the server.
+type stdStream struct {
+	buf   []byte
+	start int64 // the offset of buf[0] in the whole output
+}
+
+// write appends to the stream, discarding the oldest bytes beyond
+// jobStreamMax.
+func (ss *stdStream) write(p []byte) {
+	ss.buf = append(ss.buf, p...)
+	if over := len(ss.buf) - jobStreamMax; over > 0 {
+		ss.buf = append([]byte(nil), ss.buf[over:]...)
+		ss.start += int64(over)
+	}
+}
+
+// since returns a copy of what we hold after the given offset, along with the
+// offset of its end. If we no longer hold the output at offset, what we have
+// is returned.
+func (ss *stdStream) since(offset int64) ([]byte, int64) {
+	end := ss.start + int64(len(ss.buf))
+	if offset < ss.start {
+		offset = ss.start
+	}
+	if offset >= end {
+		return nil, end
+	}
+	return append([]byte(nil), ss.buf[offset-ss.start:]...), end
+}
+
+// jobStream is the streamed output of a Job's Cmd.
+type jobStream struct {
+	out     stdStream
+	err     stdStream
+	written time.Time
+}
+
+// jobStreams holds the streamed output of the Cmds of Jobs, keyed on Job key.
+type jobStreams struct {
+	streams map[string]*jobStream
+	sync.Mutex
+}
+
+// newJobStreams creates a new jobStreams.
+func newJobStreams() *jobStreams {
+	return &jobStreams{streams: make(map[string]*jobStream)}
+}
+
+// write adds the output in std to the stream of the given Job.
+func (js *jobStreams) write(key string, std *StreamedStd) {
+	js.Lock()
+	defer js.Unlock()
+	now := time.Now()
+	js.prune(now)
+	stream, exists := js.streams[key]
+	if !exists {
+		stream = &jobStream{}
+		js.streams[key] = stream
+	}
+	stream.out.write(std.StdOut)
+	stream.err.write(std.StdErr)
+	stream.written = now
+}
+
+// read returns the output of the given Job written after the offsets in from,
+// which may be nil to get all we hold.
+func (js *jobStreams) read(key string, from *StreamedStd) *StreamedStd {
+	if from == nil {
+		from = &StreamedStd{}
+	}
+	js.Lock()
+	defer js.Unlock()
+	js.prune(time.Now())
+	stream, exists := js.streams[key]
+	if !exists {
+		return &StreamedStd{StdOutOffset: from.StdOutOffset, StdErrOffset: from.StdErrOffset}
+	}
+	std := &StreamedStd{}
+	std.StdOut, std.StdOutOffset = stream.out.since(from.StdOutOffset)
+	std.StdErr, std.StdErrOffset = stream.err.since(from.StdErrOffset)
+	return std
+}
+
+// prune forgets the streams that haven't been written to for jobStreamKeep.
+// You must hold the lock when calling this.
+func (js *jobStreams) prune(now time.Time) {
+	for key, stream := range js.streams {
+		if now.Sub(stream.written) > jobStreamKeep {
+			delete(js.streams, key)
+		}
+	}
+}
+
+// stdCollector collects the output of a Cmd as it is written, for a runner to
+// periodically send to the server.
+type stdCollector struct {
+	out *tailBuffer
+	err *tailBuffer
+}
+
+// newStdCollector creates a new stdCollector.
+func newStdCollector() *stdCollector {
+	return &stdCollector{
+		out: &tailBuffer{max: jobStreamMax},
+		err: &tailBuffer{max: jobStreamMax},
+	}
+}
+
+// take returns the output collected since we were last asked, or nil if there
+// isn't any.
+func (sc *stdCollector) take() *StreamedStd {
+	std := &StreamedStd{StdOut: sc.out.take(), StdErr: sc.err.take()}
+	if len(std.StdOut) == 0 && len(std.StdErr) == 0 {
+		return nil
+	}
+	return std
+}
+
+// streamStd sends the output collected by sc for the given Job to the server
+// every ClientStreamInterval, until the returned function is called, which
+// sends whatever was collected since the last time. You must have Reserve()d
+// the Job. Failures to send are ignored, since the output is only for the
+// benefit of anyone following the Job.
+func (c *Client) streamStd(job *Job, sc *stdCollector) func() {
+	key := job.key()
+	send := func() {
+		if std := sc.take(); std != nil {
+			c.request(&clientRequest{Method: "jstream", Keys: []string{key}, Stream: std}) // #nosec following is best-effort
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ClientStreamInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		send()
+	}
+}
+
+// GetStreamedStd gets the STDOUT and STDERR that the Cmd of the Job described
+// by je has written since the offsets in from, which may be nil to get
+// everything the server holds. Pass the returned StreamedStd to the next call
+// to continue where you left off.
+//
+// This only works for Jobs with StreamStd set, and only while they're running
+// and for a short time after. The server only holds the last 1MB of each of
+// STDOUT and STDERR, so if you call this infrequently for Cmds that write a
+// lot, you'll miss some.
+func (c *Client) GetStreamedStd(je *JobEssence, from *StreamedStd) (*StreamedStd, error) {
+	req := &clientRequest{Method: "getstream", Keys: []string{je.Key()}}
+	if from != nil {
+		req.Stream = &StreamedStd{StdOutOffset: from.StdOutOffset, StdErrOffset: from.StdErrOffset}
+	}
+	resp, err := c.request(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stream, err
+}
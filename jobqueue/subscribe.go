@@ -0,0 +1,348 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code that lets clients subscribe to a stream of
+// events describing Jobs changing state, instead of polling for changes.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/satori/go.uuid"
+)
+
+// subscriptionBuffer is the maximum number of undelivered events we hold for a
+// subscription; if a subscriber falls further behind than this, its oldest
+// events are dropped.
+const subscriptionBuffer = 10000
+
+// these variables are only exported for testing purposes; you probably
+// shouldn't change them
+var (
+	// SubscriptionPollWait is the longest a client waits for events in each
+	// request it makes for them. It is capped to half the timeout given to
+	// Connect().
+	SubscriptionPollWait = 30 * time.Second
+
+	// SubscriptionExpiry is how long the server keeps a subscription whose
+	// client has stopped asking for its events.
+	SubscriptionExpiry = 5 * time.Minute
+)
+
+// JobFilter describes the Jobs that Client.Subscribe() sends JobEvents for.
+// Jobs must match all the properties that are set; an empty JobFilter matches
+// every Job.
+type JobFilter struct {
+	// RepGroup, if set, must be the Job's RepGroup.
+	RepGroup string
+
+	// Keys, if set, must include the Job's key.
+	Keys []string
+
+	// Labels, if set, must all be present with the same values in the Job's
+	// Labels.
+	Labels map[string]string
+
+	// States, if set, must include the state the Job changed to.
+	States []JobState
+
+	// WithJobs, if set, makes each JobEvent carry a copy of the Job as it was
+	// after the change. This is what a Mirror uses to replicate our state.
+	WithJobs bool
+}
+
+// matches tells you if the given Job changing to the given state passes the
+// filter. You must hold at least a read lock on the Job.
+func (f *JobFilter) matches(job *Job, state JobState) bool {
+	if f.RepGroup != "" && job.RepGroup != f.RepGroup {
+		return false
+	}
+	if len(f.Keys) > 0 && !inSlice(f.Keys, job.key()) {
+		return false
+	}
+	for key, val := range f.Labels {
+		if job.Labels[key] != val {
+			return false
+		}
+	}
+	if len(f.States) > 0 {
+		found := false
+		for _, s := range f.States {
+			if s == state {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// inSlice tells you if the given string is in the given slice.
+func inSlice(slice []string, str string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// JobEvent describes a Job changing state, as sent by Client.Subscribe().
+// Reserved means a runner picked the Job up, and Running that it started its
+// Cmd.
+type JobEvent struct {
+	Key        string
+	Cmd        string
+	RepGroup   string
+	From       JobState
+	State      JobState
+	Host       string
+	Exitcode   int
+	FailReason string
+	Time       time.Time
+
+	// Job is only set for subscriptions with JobFilter.WithJobs. It lacks the
+	// Job's STDOUT/ERR and environment.
+	Job *Job
+}
+
+// newJobEvent creates a JobEvent for the given Job changing state. You must
+// hold at least a read lock on the Job.
+func newJobEvent(job *Job, from, to JobState) *JobEvent {
+	return &JobEvent{
+		Key:        job.key(),
+		Cmd:        job.Cmd,
+		RepGroup:   job.RepGroup,
+		From:       from,
+		State:      to,
+		Host:       job.Host,
+		Exitcode:   job.Exitcode,
+		FailReason: job.FailReason,
+		Time:       time.Now(),
+	}
+}
+
+// subscription holds the events for a subscriber that it hasn't yet collected.
+type subscription struct {
+	filter   *JobFilter
+	events   []*JobEvent
+	dropped  int
+	notify   chan struct{}
+	lastPoll time.Time
+}
+
+// subscriptions holds all the current subscriptions, keyed on their ids.
+type subscriptions struct {
+	subs map[string]*subscription
+	sync.Mutex
+}
+
+// add creates a new subscription with the given filter, returning its id.
+func (ss *subscriptions) add(filter *JobFilter) (string, error) {
+	if filter == nil {
+		filter = &JobFilter{}
+	}
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	id := u.String()
+	ss.Lock()
+	defer ss.Unlock()
+	ss.subs[id] = &subscription{filter: filter, notify: make(chan struct{}, 1), lastPoll: time.Now()}
+	return id, nil
+}
+
+// remove gets rid of the subscription with the given id.
+func (ss *subscriptions) remove(id string) {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.subs, id)
+}
+
+// publish gives an event for the given Job changing state to every
+// subscription whose filter it matches. Subscriptions that have not been
+// polled in SubscriptionExpiry are removed.
+func (ss *subscriptions) publish(job *Job, from, to JobState) {
+	ss.Lock()
+	defer ss.Unlock()
+	if len(ss.subs) == 0 {
+		return
+	}
+
+	job.RLock()
+	defer job.RUnlock()
+	var event, withJob *JobEvent
+	for id, sub := range ss.subs {
+		if time.Since(sub.lastPoll) > SubscriptionExpiry {
+			delete(ss.subs, id)
+			continue
+		}
+		if !sub.filter.matches(job, to) {
+			continue
+		}
+		var e *JobEvent
+		if sub.filter.WithJobs {
+			if withJob == nil {
+				withJob = newJobEvent(job, from, to)
+				withJob.Job = job.clientCopy(to)
+			}
+			e = withJob
+		} else {
+			if event == nil {
+				event = newJobEvent(job, from, to)
+			}
+			e = event
+		}
+		if len(sub.events) >= subscriptionBuffer {
+			sub.events = sub.events[1:]
+			sub.dropped++
+		}
+		sub.events = append(sub.events, e)
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// collect returns the events of the subscription with the given id, waiting up
+// to the given time for there to be some. The bool is false if there is no
+// such subscription.
+func (ss *subscriptions) collect(id string, wait time.Duration) ([]*JobEvent, int, bool) {
+	ss.Lock()
+	sub, exists := ss.subs[id]
+	if !exists {
+		ss.Unlock()
+		return nil, 0, false
+	}
+	sub.lastPoll = time.Now()
+	if len(sub.events) == 0 {
+		ss.Unlock()
+		select {
+		case <-sub.notify:
+		case <-time.After(wait):
+		}
+		ss.Lock()
+	}
+	events, dropped := sub.events, sub.dropped
+	sub.events, sub.dropped = nil, 0
+	sub.lastPoll = time.Now()
+	ss.Unlock()
+	return events, dropped, true
+}
+
+// Subscribe returns a channel that receives a JobEvent every time a Job that
+// passes the given filter changes state, so that you can follow Jobs without
+// repeatedly calling GetByRepGroup() or similar. Events are received over a
+// second connection to the server, so this Client can carry on being used as
+// normal. JobEvents are sent for the states Reserved, Running, Buried and
+// Complete, as well as Ready, Delayed, Dependent and Deleted.
+//
+// If the connection is lost (eg. because the server restarts), we keep trying
+// to reconnect and resubscribe, but events that happened in the meantime are
+// missed. Events are also missed if you fall far behind in reading from the
+// channel. The channel is closed when you Disconnect() this Client.
+func (c *Client) Subscribe(filter JobFilter) (<-chan *JobEvent, error) {
+	sc, id, err := c.subscribe(&filter)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := SubscriptionPollWait
+	if half := c.timeout / 2; half > 0 && half < wait {
+		wait = half
+	}
+
+	events := make(chan *JobEvent)
+	go func() {
+		defer close(events)
+		b := &backoff.Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second, Factor: 2, Jitter: true}
+		for {
+			var resp *serverResponse
+			var errr error
+			if sc != nil {
+				resp, errr = sc.request(&clientRequest{Method: "jevents", Keys: []string{id}, Timeout: wait})
+			}
+			if sc == nil || errr != nil {
+				// the connection or the server's record of our subscription
+				// was lost, so start over
+				if sc != nil {
+					sc.Disconnect() // #nosec we're replacing it regardless
+					sc = nil
+				}
+				select {
+				case <-time.After(b.Duration()):
+				case <-c.subStop:
+					return
+				}
+				sc, id, _ = c.subscribe(&filter) // #nosec on failure sc is nil, so we try again
+				continue
+			}
+			b.Reset()
+
+			for _, event := range resp.Events {
+				select {
+				case events <- event:
+				case <-c.subStop:
+					c.unsubscribe(sc, id)
+					return
+				}
+			}
+
+			select {
+			case <-c.subStop:
+				c.unsubscribe(sc, id)
+				return
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
+
+// subscribe makes a new connection to the server and creates a subscription
+// for the given filter on it, returning the connection and subscription id.
+func (c *Client) subscribe(filter *JobFilter) (*Client, string, error) {
+	sc, err := Connect(c.addr, c.caFile, c.certDomain, c.token, c.timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := sc.request(&clientRequest{Method: "subscribe", Filter: filter})
+	if err != nil {
+		errd := sc.Disconnect()
+		if errd != nil {
+			err = errd
+		}
+		return nil, "", err
+	}
+	return sc, resp.Path, nil
+}
+
+// unsubscribe tells the server we no longer want the subscription with the
+// given id, and disconnects the connection it was made on.
+func (c *Client) unsubscribe(sc *Client, id string) {
+	sc.request(&clientRequest{Method: "unsubscribe", Keys: []string{id}}) // #nosec the server expires it anyway
+	sc.Disconnect()                                                       // #nosec nothing we can do about failure here
+}
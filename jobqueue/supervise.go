@@ -0,0 +1,315 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for supervising runner processes, so that if they
+// crash while running jobs, the jobs they were running can be told why, instead
+// of the server only knowing that it lost contact with them.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// RunnerCrash* are the Reasons of a RunnerCrash.
+const (
+	RunnerCrashPanic  = "runner panicked"
+	RunnerCrashOOM    = "runner was killed by the OOM killer"
+	RunnerCrashSignal = "runner was killed by a signal"
+)
+
+// runnerCrashTail is how much of the end of a supervised runner's STDERR we
+// keep, to find any panic message in.
+const runnerCrashTail = 64 * 1024
+
+// ClientCrashDir is a directory that SuperviseRunner() records the crashes of
+// runners in, so that the next runner on the same host can report them with
+// ReportRunnerCrashes(). The default of blank string disables recording.
+// ClientInFlightDir must also be set for crashes to be associated with jobs.
+var ClientCrashDir = ""
+
+// RunnerCrash describes how a runner process died unexpectedly while running a
+// Job.
+type RunnerCrash struct {
+	Host   string
+	PID    int
+	Time   time.Time
+	Reason string // one of the RunnerCrash* constants
+	Detail string // eg. the panic message and stack trace
+}
+
+// runnerCrashRecord is what we store on local disk about a runner crash.
+type runnerCrashRecord struct {
+	Crash   *RunnerCrash
+	JobKeys []string
+}
+
+// tailBuffer is an io.Writer that only keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+	sync.Mutex
+}
+
+// Write appends to our buffer, discarding the oldest bytes beyond our max.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of what we've kept.
+func (t *tailBuffer) Bytes() []byte {
+	t.Lock()
+	defer t.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+// take returns what we've kept and empties our buffer.
+func (t *tailBuffer) take() []byte {
+	t.Lock()
+	defer t.Unlock()
+	b := t.buf
+	t.buf = nil
+	return b
+}
+
+// SuperviseRunner runs the given command, which should be a runner (eg. one
+// that calls Execute() on the Jobs it reserves), as a child process, passing on
+// any signals we receive, and waits for it to exit. Its STDERR is passed
+// through to ours (or to cmd.Stderr if set).
+//
+// If the child dies due to a panic, or is killed by the OOM killer or by a
+// signal we didn't pass on, a RunnerCrash describing that is returned, and if
+// it was running any Jobs (according to the records Execute() makes in
+// ClientInFlightDir), the crash is recorded in ClientCrashDir, for
+// ReportRunnerCrashes() to report later.
+//
+// Returns the exit code that the child exited with (128 + the signal number if
+// it was killed by a signal).
+func SuperviseRunner(cmd *exec.Cmd) (int, *RunnerCrash, error) {
+	tail := &tailBuffer{max: runnerCrashTail}
+	stderr := cmd.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	cmd.Stderr = io.MultiWriter(stderr, tail)
+
+	oom := newOOMWatcher()
+	defer oom.stop()
+
+	err := cmd.Start()
+	if err != nil {
+		return 0, nil, err
+	}
+	pid := cmd.Process.Pid
+	oom.track(pid)
+
+	var forwarded bool
+	var fmutex sync.Mutex
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	stopForwarding := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				fmutex.Lock()
+				forwarded = true
+				fmutex.Unlock()
+				cmd.Process.Signal(sig) // #nosec if it's already gone, Wait() will tell us
+			case <-stopForwarding:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	signal.Stop(sigs)
+	close(stopForwarding)
+	if err == nil {
+		return 0, nil, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, nil, err
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 1, nil, nil
+	}
+
+	var crash *RunnerCrash
+	code := ws.ExitStatus()
+	fmutex.Lock()
+	wasForwarded := forwarded
+	fmutex.Unlock()
+	switch {
+	case ws.Signaled():
+		code = 128 + int(ws.Signal())
+		if wasForwarded {
+			break
+		}
+		crash = &RunnerCrash{Reason: RunnerCrashSignal, Detail: "killed by " + ws.Signal().String()}
+		if killed, peakMB := oom.killed(); killed {
+			crash.Reason = RunnerCrashOOM
+			if peakMB > 0 {
+				crash.Detail = "killed while using " + strconv.Itoa(peakMB) + "MB"
+			}
+		}
+	case code == 2:
+		// the exit code of Go programs that panic or hit a fatal error
+		if detail := panicDetail(tail.Bytes()); detail != "" {
+			crash = &RunnerCrash{Reason: RunnerCrashPanic, Detail: detail}
+		}
+	}
+
+	if crash != nil {
+		crash.PID = pid
+		crash.Time = time.Now()
+		crash.Host, _ = os.Hostname() // #nosec a blank host is fine
+		err = recordRunnerCrash(pid, crash)
+	}
+	return code, crash, err
+}
+
+// panicDetail returns the last panic or fatal error message and stack trace in
+// the given output of a Go program, or blank if there isn't one.
+func panicDetail(stderr []byte) string {
+	start := -1
+	for _, marker := range []string{"panic: ", "fatal error: "} {
+		if i := bytes.LastIndex(stderr, []byte(marker)); i > start {
+			start = i
+		}
+	}
+	if start == -1 {
+		return ""
+	}
+	return string(bytes.TrimSpace(stderr[start:]))
+}
+
+// recordRunnerCrash stores the given crash in ClientCrashDir, along with the
+// keys of the Jobs that the runner with the given pid was running, according to
+// the records in ClientInFlightDir. Does nothing if either dir has not been
+// set, or the runner wasn't running any Jobs.
+func recordRunnerCrash(pid int, crash *RunnerCrash) error {
+	if ClientCrashDir == "" || ClientInFlightDir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(ClientInFlightDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	ch := new(codec.BincHandle)
+	var keys []string
+	for _, entry := range entries {
+		encoded, errr := ioutil.ReadFile(filepath.Join(ClientInFlightDir, entry.Name()))
+		if errr != nil {
+			continue
+		}
+		ifl := &inFlight{}
+		dec := codec.NewDecoderBytes(encoded, ch)
+		if errd := dec.Decode(ifl); errd != nil || ifl.Job == nil {
+			continue
+		}
+		if ifl.RunnerPID == pid && ifl.EndState == nil {
+			keys = append(keys, ifl.Job.key())
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, ch)
+	err = enc.Encode(&runnerCrashRecord{Crash: crash, JobKeys: keys})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(ClientCrashDir, 0700)
+	if err != nil {
+		return err
+	}
+	name := crash.Host + "." + strconv.Itoa(pid) + "." + strconv.FormatInt(crash.Time.UnixNano(), 10)
+	return ioutil.WriteFile(filepath.Join(ClientCrashDir, name), encoded, 0600)
+}
+
+// ReportRunnerCrashes looks in ClientCrashDir for crashes recorded by
+// SuperviseRunner(), and tells the server about them, so that the Jobs that
+// the crashed runners were running get their RunnerCrash set. (The server will
+// have already noticed it lost contact with them.)
+//
+// Call this straight after Connect(). Returns the number of Jobs that crashes
+// were reported for. Does nothing if ClientCrashDir has not been set.
+func (c *Client) ReportRunnerCrashes() (int, error) {
+	if ClientCrashDir == "" {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(ClientCrashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	reported := 0
+	for _, entry := range entries {
+		path := filepath.Join(ClientCrashDir, entry.Name())
+		encoded, errr := ioutil.ReadFile(path)
+		if errr != nil {
+			continue
+		}
+		rcr := &runnerCrashRecord{}
+		dec := codec.NewDecoderBytes(encoded, c.ch)
+		errr = dec.Decode(rcr)
+		if errr != nil || rcr.Crash == nil {
+			os.Remove(path) // #nosec it's unusable anyway
+			continue
+		}
+
+		resp, errr := c.request(&clientRequest{Method: "jcrash", Keys: rcr.JobKeys, Crash: rcr.Crash})
+		if errr != nil {
+			// the server is probably unreachable; try again next time
+			return reported, errr
+		}
+		os.Remove(path) // #nosec nothing we can do about failure here
+		reported += resp.Existed
+	}
+	return reported, nil
+}
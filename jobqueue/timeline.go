@@ -0,0 +1,268 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for periodically recording the state of the
+// queue, so that users can see how their submissions progressed over time.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/ugorji/go/codec"
+)
+
+// TimelineSnapshot records the state of the queue at a point in time.
+type TimelineSnapshot struct {
+	Time time.Time
+
+	// RepGroups holds the number of Jobs in each state, rolled up at each level
+	// of the RepGroup hierarchy (as per Client.GetRepGroupCounts()).
+	RepGroups []*RepGroupCount
+
+	// Runners is the number of runners the scheduler was being asked to run.
+	Runners int
+
+	// Draining is true if the server was draining at the time.
+	Draining bool
+
+	// Blocked holds the messages from the scheduler, received since the
+	// previous snapshot, explaining why it wasn't able to run more runners
+	// (eg. because of quota limits).
+	Blocked []string
+}
+
+// Counts returns the state counts for the given RepGroup, which will be empty
+// if the RepGroup had no Jobs at the time.
+func (ts *TimelineSnapshot) Counts(repGroup string) map[JobState]int {
+	repGroup = strings.TrimSuffix(repGroup, RepGroupSeparator)
+	for _, rgc := range ts.RepGroups {
+		if rgc.RepGroup == repGroup {
+			return rgc.Counts
+		}
+	}
+	return make(map[JobState]int)
+}
+
+// filter returns a copy of the snapshot with only the RepGroupCounts for the
+// given RepGroup and those below it in the hierarchy.
+func (ts *TimelineSnapshot) filter(repGroup string) *TimelineSnapshot {
+	filtered := *ts
+	filtered.RepGroups = nil
+	for _, rgc := range ts.RepGroups {
+		if repGroupIsUnder(rgc.RepGroup, repGroup) {
+			filtered.RepGroups = append(filtered.RepGroups, rgc)
+		}
+	}
+	return &filtered
+}
+
+// timelineKey returns the key a snapshot taken at the given time is stored
+// under, such that keys sort in time order.
+func timelineKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// storeTimelineSnapshot stores the given snapshot in the database.
+func (db *db) storeTimelineSnapshot(ts *TimelineSnapshot) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(ts)
+	if err != nil {
+		return err
+	}
+	err = db.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTimeline).Put(timelineKey(ts.Time), encoded)
+	})
+	db.backgroundBackup()
+	return err
+}
+
+// retrieveTimeline returns the snapshots taken since the given time, in time
+// order.
+func (db *db) retrieveTimeline(since time.Time) ([]*TimelineSnapshot, error) {
+	var tss []*TimelineSnapshot
+	err := db.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketTimeline).Cursor()
+		for k, encoded := c.Seek(timelineKey(since)); k != nil; k, encoded = c.Next() {
+			ts := &TimelineSnapshot{}
+			err := codec.NewDecoderBytes(encoded, db.ch).Decode(ts)
+			if err != nil {
+				return err
+			}
+			tss = append(tss, ts)
+		}
+		return nil
+	})
+	return tss, err
+}
+
+// purgeTimelineBefore permanently deletes the snapshots taken before the given
+// time, returning how many were deleted.
+func (db *db) purgeTimelineBefore(before time.Time) (int, error) {
+	purged := 0
+	limit := timelineKey(before)
+	err := db.update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketTimeline).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if purged > 0 {
+		db.backgroundBackup()
+	}
+	return purged, err
+}
+
+// countCompleteJobsByRepGroup returns the number of complete jobs in each
+// RepGroup, without having to decode them.
+func (db *db) countCompleteJobsByRepGroup() (map[string]int, error) {
+	counts := make(map[string]int)
+	delimiter := []byte(dbDelimiter)
+	err := db.view(func(tx *bolt.Tx) error {
+		newJobBucket := tx.Bucket(bucketJobsLive)
+		completeJobBucket := tx.Bucket(bucketJobsComplete)
+		return tx.Bucket(bucketRTK).ForEach(func(k, _ []byte) error {
+			i := bytes.Index(k, delimiter)
+			if i == -1 {
+				return nil
+			}
+			key := k[i+len(delimiter):]
+			if completeJobBucket.Get(key) != nil && newJobBucket.Get(key) == nil {
+				counts[string(k[:i])]++
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// timelineSnapshot works out the current state of the queue, including any
+// scheduler issues that have been reported since the given time.
+func (s *Server) timelineSnapshot(since time.Time) (*TimelineSnapshot, error) {
+	counts := make(map[string]map[JobState]int)
+	add := func(repGroup string, state JobState, n int) {
+		for _, level := range repGroupLevels(repGroup) {
+			if _, exists := counts[level]; !exists {
+				counts[level] = make(map[JobState]int)
+			}
+			counts[level][state] += n
+		}
+	}
+
+	for _, item := range s.q.AllItems() {
+		job := s.itemToJob(item, false, false)
+		state := job.State
+		if state == JobStateReserved {
+			state = JobStateRunning
+		}
+		add(job.RepGroup, state, 1)
+	}
+
+	complete, err := s.db.countCompleteJobsByRepGroup()
+	if err != nil {
+		return nil, err
+	}
+	for repGroup, n := range complete {
+		add(repGroup, JobStateComplete, n)
+	}
+
+	ts := &TimelineSnapshot{Time: time.Now(), RepGroups: make([]*RepGroupCount, 0, len(counts))}
+	for repGroup, stateCounts := range counts {
+		ts.RepGroups = append(ts.RepGroups, &RepGroupCount{RepGroup: repGroup, Counts: stateCounts})
+	}
+	sort.Slice(ts.RepGroups, func(i, j int) bool {
+		return ts.RepGroups[i].RepGroup < ts.RepGroups[j].RepGroup
+	})
+
+	s.sgcmutex.Lock()
+	for _, count := range s.sgroupcounts {
+		ts.Runners += count
+	}
+	s.sgcmutex.Unlock()
+
+	s.ssmutex.RLock()
+	ts.Draining = s.ServerInfo.Mode == ServerModeDrain
+	s.ssmutex.RUnlock()
+
+	s.simutex.RLock()
+	for _, si := range s.schedIssues {
+		if si.LastDate >= since.Unix() {
+			ts.Blocked = append(ts.Blocked, si.Msg)
+		}
+	}
+	s.simutex.RUnlock()
+	sort.Strings(ts.Blocked)
+
+	return ts, nil
+}
+
+// recordTimeline takes a snapshot of the current state of the queue and
+// stores it, also deleting snapshots older than our timelineKeep.
+func (s *Server) recordTimeline(since time.Time) error {
+	ts, err := s.timelineSnapshot(since)
+	if err != nil {
+		return err
+	}
+	err = s.db.storeTimelineSnapshot(ts)
+	if err != nil {
+		return err
+	}
+	if s.timelineKeep > 0 {
+		_, err = s.db.purgeTimelineBefore(time.Now().Add(-s.timelineKeep))
+	}
+	return err
+}
+
+// timeline returns the stored snapshots taken since the given time, with
+// their counts limited to those for the given RepGroup and below, if that is
+// not blank.
+func (s *Server) timeline(repGroup string, since time.Time) ([]*TimelineSnapshot, error) {
+	tss, err := s.db.retrieveTimeline(since)
+	if err != nil || repGroup == "" {
+		return tss, err
+	}
+	repGroup = strings.TrimSuffix(repGroup, RepGroupSeparator)
+	for i, ts := range tss {
+		tss[i] = ts.filter(repGroup)
+	}
+	return tss, nil
+}
+
+// GetTimeline returns the snapshots of the state of the queue that the server
+// has recorded since the given time (see ServerConfig.TimelineInterval), in
+// time order. If repGroup is not blank, the counts in each snapshot are limited
+// to those for that RepGroup and those below it in the hierarchy.
+func (c *Client) GetTimeline(repGroup string, since time.Time) ([]*TimelineSnapshot, error) {
+	resp, err := c.request(&clientRequest{Method: "gettimeline", RepGroup: repGroup, Since: since})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Timeline, err
+}
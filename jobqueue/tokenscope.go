@@ -0,0 +1,134 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for the read-only token, which lets clients such
+// as monitoring systems query the server without being able to change anything.
+
+import (
+	"io/ioutil"
+	"net/http"
+)
+
+// readOnlyMethods are the clientRequest Methods that a client presenting the
+// read-only token may call: those that only query job status and server stats.
+// (Notably not getsecrets, fetchupload or backup, which give access to more
+// than status.) Jobs retrieved with the read-only token never include their
+// std or env, since those can hold credentials; see getStdEnv().
+var readOnlyMethods = map[string]bool{
+	"ping":           true,
+	"getstats":       true,
+	"getservers":     true,
+	"getbc":          true,
+	"getbr":          true,
+	"getin":          true,
+	"getbrt":         true,
+	"getrgc":         true,
+	"getrgm":         true,
+	"getbl":          true,
+	"getfailsum":     true,
+	"gettrash":       true,
+	"gettimeline":    true,
+	"getuploads":     true,
+	"getenvprofiles": true,
+	"getreqprofiles": true,
+	"getrgdefaults":  true,
+	"getlimitgroups": true,
+	"getdeptree":     true,
+	"subscribe":      true,
+	"jevents":        true,
+	"unsubscribe":    true,
+	"mirrorsnap":     true,
+}
+
+// tokenScope describes what a token presented by a client allows it to do.
+type tokenScope int
+
+const (
+	scopeNone tokenScope = iota
+	scopeReadOnly
+	scopeFull
+)
+
+// readOnlyToken returns the read-only token stored in the given file if it is
+// valid and we want to reuse it (as we do with the normal token), otherwise
+// generates a new one.
+func readOnlyToken(config ServerConfig) ([]byte, error) {
+	if config.ReattachGrace > 0 && config.ReadOnlyTokenFile != "" {
+		token, err := ioutil.ReadFile(config.ReadOnlyTokenFile)
+		if err == nil && len(token) == tokenLength {
+			return token, nil
+		}
+	}
+	return generateToken()
+}
+
+// tokenScope tells you what the given token allows a client to do.
+func (s *Server) tokenScope(token []byte) tokenScope {
+	if len(token) != tokenLength {
+		return scopeNone
+	}
+	if tokenMatches(token, s.token) {
+		return scopeFull
+	}
+	if tokenMatches(token, s.roToken) {
+		return scopeReadOnly
+	}
+	return scopeNone
+}
+
+// allowed tells you if a client presenting a token with this scope may call
+// the given clientRequest Method.
+func (ts tokenScope) allowed(method string) bool {
+	switch ts {
+	case scopeFull:
+		return true
+	case scopeReadOnly:
+		return readOnlyMethods[method]
+	}
+	return method == "ping"
+}
+
+// getStdEnv tells you if a client presenting a token with this scope may
+// retrieve the stdout, stderr and environment of jobs. Only the full token
+// allows this.
+func (ts tokenScope) getStdEnv() bool {
+	return ts == scopeFull
+}
+
+// allowedHTTP tells you if a client presenting a token with this scope may make
+// a request with the given HTTP method. The read-only token is only good for
+// GET requests.
+func (ts tokenScope) allowedHTTP(method string) bool {
+	switch ts {
+	case scopeFull:
+		return true
+	case scopeReadOnly:
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	return false
+}
+
+// ReadOnlyToken returns the token that clients can use to query the status of
+// jobs and the server, but not to add, modify or remove jobs or to stop the
+// server. Unlike the token returned by Serve(), it is safe to give to
+// monitoring systems and dashboards.
+func (s *Server) ReadOnlyToken() []byte {
+	return s.roToken
+}
@@ -0,0 +1,253 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for keeping Delete()d jobs in a trash for a
+// while, so that they can be brought back if they were deleted by mistake.
+
+import (
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/ugorji/go/codec"
+)
+
+// TrashedJob is a Job that was Delete()d, but which can be Restore()d until
+// Expires.
+type TrashedJob struct {
+	Job     *Job
+	Trashed time.Time
+	Expires time.Time
+}
+
+// trashEntry is how a TrashedJob is stored in the database.
+type trashEntry struct {
+	Trashed time.Time
+	Job     []byte // the Job's encoding from the live bucket
+}
+
+// trashLiveJob moves a job from the live bucket to the trash bucket, for use
+// when a user deletes a job they might want back. A backgroundBackup() is
+// triggered afterwards.
+func (db *db) trashLiveJob(key string) error {
+	bkey := []byte(key)
+	err := db.update(func(tx *bolt.Tx) error {
+		live := tx.Bucket(bucketJobsLive)
+		encoded := live.Get(bkey)
+		if encoded == nil {
+			return nil
+		}
+		var entry []byte
+		enc := codec.NewEncoderBytes(&entry, db.ch)
+		err := enc.Encode(&trashEntry{Trashed: time.Now(), Job: encoded})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bucketJobsTrash).Put(bkey, entry)
+		if err != nil {
+			return err
+		}
+		return live.Delete(bkey)
+	})
+	db.backgroundBackup()
+	return err
+}
+
+// retrieveTrashedJobs returns the jobs in the trash with the given keys, or if
+// keys is nil, all of them with the given RepGroup, or if that is blank, every
+// job in the trash.
+func (db *db) retrieveTrashedJobs(keys []string, repGroup string) ([]*TrashedJob, error) {
+	var tjs []*TrashedJob
+	decode := func(encoded []byte) error {
+		entry := &trashEntry{}
+		err := codec.NewDecoderBytes(encoded, db.ch).Decode(entry)
+		if err != nil {
+			return err
+		}
+		job := &Job{}
+		err = codec.NewDecoderBytes(entry.Job, db.ch).Decode(job)
+		if err != nil {
+			return err
+		}
+		if keys == nil && repGroup != "" && job.RepGroup != repGroup {
+			return nil
+		}
+		job.State = JobStateDeleted
+		tjs = append(tjs, &TrashedJob{Job: job, Trashed: entry.Trashed})
+		return nil
+	}
+
+	err := db.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobsTrash)
+		if keys == nil {
+			return b.ForEach(func(_, encoded []byte) error {
+				return decode(encoded)
+			})
+		}
+		for _, key := range keys {
+			if encoded := b.Get([]byte(key)); encoded != nil {
+				if err := decode(encoded); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return tjs, err
+}
+
+// purgeTrashedJobs permanently deletes the jobs with the given keys from the
+// trash, returning how many were there.
+func (db *db) purgeTrashedJobs(keys []string) (int, error) {
+	purged := 0
+	err := db.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobsTrash)
+		for _, key := range keys {
+			bkey := []byte(key)
+			if b.Get(bkey) == nil {
+				continue
+			}
+			if err := b.Delete(bkey); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if purged > 0 {
+		db.backgroundBackup()
+	}
+	return purged, err
+}
+
+// purgeExpiredTrash permanently deletes the jobs that were put in the trash
+// before the given time, returning how many were deleted.
+func (db *db) purgeExpiredTrash(before time.Time) (int, error) {
+	var expired []string
+	err := db.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobsTrash).ForEach(func(key, encoded []byte) error {
+			entry := &trashEntry{}
+			if errd := codec.NewDecoderBytes(encoded, db.ch).Decode(entry); errd != nil || entry.Trashed.Before(before) {
+				expired = append(expired, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	return db.purgeTrashedJobs(expired)
+}
+
+// discardLiveJob removes a job that the user deleted from the live bucket,
+// keeping it in the trash unless purge is true or we have no trash.
+func (s *Server) discardLiveJob(key string, purge bool) {
+	if purge || s.trashKeep <= 0 {
+		s.db.deleteLiveJob(key)
+		return
+	}
+	if err := s.db.trashLiveJob(key); err != nil {
+		s.Warn("failed to move deleted job to the trash", "key", key, "err", err)
+	}
+}
+
+// trashedJobs returns the jobs in the trash, as per
+// db.retrieveTrashedJobs(), with their expiry times filled in.
+func (s *Server) trashedJobs(keys []string, repGroup string) ([]*TrashedJob, error) {
+	tjs, err := s.db.retrieveTrashedJobs(keys, repGroup)
+	for _, tj := range tjs {
+		tj.Expires = tj.Trashed.Add(s.trashKeep)
+	}
+	return tjs, err
+}
+
+// restoreJobs takes the jobs with the given keys out of the trash and adds
+// them back to the queue. Jobs that have since been re-added are just removed
+// from the trash. Returns the number of jobs added back.
+func (s *Server) restoreJobs(keys []string) (int, string, error) {
+	tjs, err := s.db.retrieveTrashedJobs(keys, "")
+	if err != nil {
+		return 0, ErrDBError, err
+	}
+	if len(tjs) == 0 {
+		return 0, "", nil
+	}
+
+	// the jobs keep the environments they were added with, and we add them all
+	// at once so that any dependencies between them are restored
+	jobs := make([]*Job, len(tjs))
+	restoredKeys := make([]string, len(tjs))
+	for i, tj := range tjs {
+		tj.Job.State = ""
+		jobs[i] = tj.Job
+		restoredKeys[i] = tj.Job.key()
+	}
+	added, _, _, srerr, err := s.createJobs(jobs, "", false)
+	if err != nil {
+		return added, srerr, err
+	}
+
+	_, err = s.db.purgeTrashedJobs(restoredKeys)
+	if err != nil {
+		return added, ErrDBError, err
+	}
+	return added, "", nil
+}
+
+// gcTrash permanently deletes the jobs that have been in the trash for longer
+// than our trashKeep. Returns the number of jobs deleted.
+func (s *Server) gcTrash() (int, error) {
+	return s.db.purgeExpiredTrash(time.Now().Add(-s.trashKeep))
+}
+
+// GetTrash returns the jobs that have been Delete()d but which can still be
+// Restore()d, limited to those with the given RepGroup if that is not blank.
+func (c *Client) GetTrash(repGroup string) ([]*TrashedJob, error) {
+	resp, err := c.request(&clientRequest{Method: "gettrash", RepGroup: repGroup})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Trash, err
+}
+
+// Restore adds jobs that were Delete()d back to the queue, as long as they are
+// still in the trash (see GetTrash()). Jobs that depended on each other when
+// deleted will do so again if restored together. It returns a count of jobs
+// that were actually restored.
+func (c *Client) Restore(jes []*JobEssence) (int, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.request(&clientRequest{Method: "jrestore", Keys: keys})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Added, err
+}
+
+// Purge is like Delete(), but the jobs are deleted permanently instead of
+// being put in the trash. Any of the jobs that are already in the trash are
+// also permanently deleted. It returns a count of jobs that it actually
+// removed from the queue or trash.
+func (c *Client) Purge(jes []*JobEssence) (int, error) {
+	keys := c.jesToKeys(jes)
+	resp, err := c.request(&clientRequest{Method: "jdel", Keys: keys, Purge: true})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
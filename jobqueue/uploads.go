@@ -0,0 +1,222 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for managing the files that clients have
+// uploaded to the server's UploadDir.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UploadedFile describes a file previously uploaded to the server's UploadDir
+// with Client.UploadFile().
+type UploadedFile struct {
+	// Path is the absolute path of the file on the server's machine.
+	Path string
+
+	// MD5 is the checksum of the file's content.
+	MD5 string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// Modified is when the file was last uploaded.
+	Modified time.Time
+
+	// Refs is the number of incomplete Jobs that refer to the file, eg. in
+	// their cloud_config_files.
+	Refs int
+}
+
+// uploadMD5 returns the MD5 checksum that the given path in our UploadDir was
+// stored under by uploadFile(), or blank if the path is not of an uploaded
+// file. Since UploadDir might be shared with other things (eg. it defaults to
+// /tmp), this is what stops us touching anything else.
+func (s *Server) uploadMD5(path string) string {
+	rel, err := filepath.Rel(s.uploadDir, filepath.Clean(path))
+	if err != nil {
+		return ""
+	}
+	md5 := strings.Replace(rel, string(filepath.Separator), "", -1)
+	if len(md5) != 32 || strings.Trim(md5, "0123456789abcdef") != "" {
+		return ""
+	}
+	dir, leaf := calculateHashedDir(s.uploadDir, md5)
+	if filepath.Join(dir, leaf) != filepath.Clean(path) {
+		return ""
+	}
+	return md5
+}
+
+// uploadRefs returns how many incomplete Jobs refer to each file in our
+// UploadDir.
+func (s *Server) uploadRefs() map[string]int {
+	refs := make(map[string]int)
+	for _, item := range s.q.AllItems() {
+		job := item.Data.(*Job)
+		job.RLock()
+		var ccf string
+		if job.Requirements != nil {
+			ccf = job.Requirements.Other["cloud_config_files"]
+		}
+		job.RUnlock()
+		if ccf == "" {
+			continue
+		}
+		for _, cf := range strings.Split(ccf, ",") {
+			source := strings.Split(cf, ":")[0]
+			if s.uploadMD5(source) != "" {
+				refs[filepath.Clean(source)]++
+			}
+		}
+	}
+	return refs
+}
+
+// uploadedFiles returns details of all the files in our UploadDir.
+func (s *Server) uploadedFiles() ([]*UploadedFile, error) {
+	refs := s.uploadRefs()
+	var ufs []*UploadedFile
+	err := filepath.Walk(s.uploadDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == s.uploadDir {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			// ignore things in a shared UploadDir we can't look at
+			return nil
+		}
+		if info.IsDir() {
+			// only descend in to our single character hashed dirs
+			if path != s.uploadDir && (len(info.Name()) != 1 || !strings.Contains("0123456789abcdef", info.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		md5 := s.uploadMD5(path)
+		if md5 == "" {
+			return nil
+		}
+		ufs = append(ufs, &UploadedFile{
+			Path:     path,
+			MD5:      md5,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+			Refs:     refs[path],
+		})
+		return nil
+	})
+	return ufs, err
+}
+
+// deleteUpload deletes the given uploaded file, along with any of its hashed
+// parent directories that become empty. Unless force is true, files that
+// incomplete Jobs refer to are not deleted.
+func (s *Server) deleteUpload(path string, force bool) error {
+	path = filepath.Clean(path)
+	if s.uploadMD5(path) == "" {
+		return Error{"deleteUpload", path, ErrUnknownUpload}
+	}
+	if !force && s.uploadRefs()[path] > 0 {
+		return Error{"deleteUpload", path, ErrUploadInUse}
+	}
+	err := os.Remove(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Error{"deleteUpload", path, ErrUnknownUpload}
+		}
+		return err
+	}
+	for dir := filepath.Dir(path); dir != s.uploadDir && strings.HasPrefix(dir, s.uploadDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// gcUploads deletes the uploaded files that were last uploaded longer than age
+// ago and that no incomplete Job refers to. Returns the number of files
+// deleted.
+func (s *Server) gcUploads(age time.Duration) (int, error) {
+	ufs, err := s.uploadedFiles()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, uf := range ufs {
+		if uf.Refs > 0 || time.Since(uf.Modified) < age {
+			continue
+		}
+		err = s.deleteUpload(uf.Path, false)
+		if err != nil {
+			if jqerr, ok := err.(Error); ok && jqerr.Err == ErrUploadInUse {
+				continue
+			}
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// GetUploads returns details of all the files that have been uploaded to the
+// server's UploadDir with UploadFile().
+func (c *Client) GetUploads() ([]*UploadedFile, error) {
+	resp, err := c.request(&clientRequest{Method: "getuploads"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Uploads, err
+}
+
+// FetchUpload returns the content of the uploaded file at the given path (as
+// returned by UploadFile() or GetUploads()).
+func (c *Client) FetchUpload(path string) ([]byte, error) {
+	resp, err := c.request(&clientRequest{Method: "fetchupload", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return decompress(resp.File)
+}
+
+// DeleteUpload deletes the uploaded file at the given path (as returned by
+// UploadFile() or GetUploads()). Files that incomplete Jobs refer to are only
+// deleted if force is true.
+func (c *Client) DeleteUpload(path string, force bool) error {
+	_, err := c.request(&clientRequest{Method: "delupload", Path: path, Force: force})
+	return err
+}
+
+// GCUploads deletes the uploaded files that were last uploaded longer than age
+// ago and that no incomplete Job refers to, as the server does periodically if
+// its UploadGCAge is set. Returns the number of files deleted.
+func (c *Client) GCUploads(age time.Duration) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "gcuploads", Timeout: age})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Existed, err
+}
@@ -53,8 +53,6 @@ const mkHashedLevels = 4
 // tokenLength is the fixed size of our authentication token
 const tokenLength = 43
 
-var pss = []byte("Pss:")
-
 // cr, lf and ellipses get used by stdFilter()
 var cr = []byte("\r")
 var lf = []byte("\n")
@@ -241,46 +239,84 @@ func decompress(compressed []byte) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// get the current memory usage of a pid, relying on modern linux /proc/*/smaps
-// (based on http://stackoverflow.com/a/31881979/675083).
-func currentMemory(pid int) (int, error) {
-	var err error
-	f, err := os.Open(fmt.Sprintf("/proc/%d/smaps", pid))
+// wrapCmd returns a command line that runs cmdLine with the given (unix) shell
+// via wrapper.
+func wrapCmd(wrapper, shell, cmdLine string) string {
+	return wrapper + " " + shell + " -c '" + strings.Replace(cmdLine, "'", `'\''`, -1) + "'"
+}
+
+// shellCommand creates an exec.Cmd that will run cmdLine with the given shell,
+// which can be a unix shell like bash, or on Windows, cmd or powershell.
+func shellCommand(shell, cmdLine string) *exec.Cmd {
+	var cmd *exec.Cmd
+	name := shellName(shell)
+	switch name {
+	case "cmd":
+		cmd = exec.Command(shell, "/S", "/C", cmdLine) // #nosec
+	case "powershell", "pwsh":
+		cmd = exec.Command(shell, "-NoProfile", "-NonInteractive", "-Command", cmdLine) // #nosec
+	default:
+		cmd = exec.Command(shell, "-c", cmdLine) // #nosec Our whole purpose is to allow users to run arbitrary commands via us...
+	}
+	prepareShellCmd(cmd, name, cmdLine)
+	return cmd
+}
+
+// setShellCmdLine changes the command line that a cmd made by shellCommand()
+// will run. It must be called before the cmd is started.
+func setShellCmdLine(cmd *exec.Cmd, shell, cmdLine string) {
+	cmd.Args[len(cmd.Args)-1] = cmdLine
+	prepareShellCmd(cmd, shellName(shell), cmdLine)
+}
+
+// shellName returns the lower-cased base name of shell (which may be a unix or
+// Windows path), without any .exe suffix.
+func shellName(shell string) string {
+	if i := strings.LastIndexAny(shell, `/\`); i >= 0 {
+		shell = shell[i+1:]
+	}
+	return strings.TrimSuffix(strings.ToLower(shell), ".exe")
+}
+
+// isWindowsShell tells you if shell is one of the Windows shells that
+// shellCommand() supports.
+func isWindowsShell(shell string) bool {
+	switch shellName(shell) {
+	case "cmd", "powershell", "pwsh":
+		return true
+	}
+	return false
+}
+
+// currentDisk gets the current disk usage (in bytes) of the files within dir
+// and all its sub-directories, the way du would. It does not descend in to
+// other file systems (such as fuse mounts) or muxfys cache directories. Files
+// that get deleted while we are looking are ignored.
+func currentDisk(dir string) (int64, error) {
+	fi, err := os.Stat(dir)
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		errc := f.Close()
-		if errc != nil {
-			if err == nil {
-				err = errc
-			} else {
-				err = fmt.Errorf("%s (and closing smaps failed: %s)", err.Error(), errc)
+	dev, _ := fileUsage(fi)
+
+	var total int64
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, errw error) error {
+		if errw != nil {
+			if os.IsNotExist(errw) {
+				return nil
 			}
+			return errw
 		}
-	}()
-
-	kb := uint64(0)
-	r := bufio.NewScanner(f)
-	for r.Scan() {
-		line := r.Bytes()
-		if bytes.HasPrefix(line, pss) {
-			var size uint64
-			_, err = fmt.Sscanf(string(line[4:]), "%d", &size)
-			if err != nil {
-				return 0, err
+		thisDev, used := fileUsage(info)
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".muxfys") || thisDev != dev {
+				return filepath.SkipDir
 			}
-			kb += size
 		}
-	}
-	if err = r.Err(); err != nil {
-		return 0, err
-	}
-
-	// convert kB to MB
-	mem := int(kb / 1024)
-
-	return mem, err
+		total += used
+		return nil
+	})
+	return total, err
 }
 
 // this prefixSuffixSaver-related code is taken from os/exec, since they are not
@@ -348,12 +384,18 @@ func minInt(a, b int) int {
 
 // stdFilter keeps only the first and last line of any contiguous block of \r
 // terminated lines (to mostly eliminate progress bars), intended for use with
-// stdout/err streaming input, outputting to a prefixSuffixSaver. Because you
-// must finish reading from the input before continuing, it returns a channel
-// that you should wait to receive an error from (nil if everything workd).
-func stdFilter(std io.Reader, out io.Writer) chan error {
+// stdout/err streaming input, outputting to a prefixSuffixSaver. If filter is
+// not nil, the resulting lines are also passed through that. Because you must
+// finish reading from the input before continuing, it returns a channel that
+// you should wait to receive an error from (nil if everything workd).
+func stdFilter(std io.Reader, out io.Writer, filter *lineFilter) chan error {
 	reader := bufio.NewReader(std)
 	done := make(chan error)
+	var fw *filterWriter
+	if filter != nil {
+		fw = &filterWriter{out: out, filter: filter}
+		out = fw
+	}
 	go func() {
 		var merr *multierror.Error
 		for {
@@ -389,6 +431,11 @@ func stdFilter(std io.Reader, out io.Writer) chan error {
 				break
 			}
 		}
+		if fw != nil {
+			if errf := fw.flush(); errf != nil {
+				merr = multierror.Append(merr, errf)
+			}
+		}
 		done <- merr.ErrorOrNil()
 	}()
 	return done
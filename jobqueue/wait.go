@@ -0,0 +1,166 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the client code for waiting on all the jobs in a RepGroup
+// (or some other set of jobs) to finish.
+
+import (
+	"time"
+)
+
+// ErrWaitTimeout is the Err of the Error returned by WaitForRepGroup() and
+// WaitForJobs() when WaitOptions.Timeout is reached.
+const ErrWaitTimeout = "timed out waiting for jobs to finish"
+
+// defaultWaitInterval is used when WaitOptions.Interval is not set.
+const defaultWaitInterval = 10 * time.Second
+
+// WaitOptions configure WaitForRepGroup() and WaitForJobs().
+type WaitOptions struct {
+	// Tree, if true, also waits for Jobs in RepGroups below the given one in
+	// the hierarchy (see GetByRepGroupTree()). Not used by WaitForJobs().
+	Tree bool
+
+	// Interval is how often to check on the Jobs. Defaults to 10s.
+	Interval time.Duration
+
+	// Timeout, if set, is the longest to wait before giving up.
+	Timeout time.Duration
+
+	// Progress, if set, is called with the current summary after every check.
+	Progress func(*WaitSummary)
+}
+
+// WaitSummary describes the states of the Jobs being waited on by
+// WaitForRepGroup() or WaitForJobs().
+type WaitSummary struct {
+	// Complete is the number of Jobs that completed successfully.
+	Complete int
+
+	// Buried is the number of Jobs that failed and were buried.
+	Buried int
+
+	// Incomplete is the number of Jobs that have yet to finish.
+	Incomplete int
+
+	// Counts holds the number of Jobs in each JobState. Reserved Jobs are
+	// counted as running.
+	Counts map[JobState]int
+}
+
+// Total returns the total number of Jobs being waited on.
+func (ws *WaitSummary) Total() int {
+	return ws.Complete + ws.Buried + ws.Incomplete
+}
+
+// WaitForRepGroup blocks until all the Jobs with the given RepGroup are either
+// complete or buried, checking on them every opts.Interval. Note that lost
+// Jobs count as unfinished until they are confirmed dead or come back.
+//
+// Returns a summary of the final states of the Jobs. If there are no Jobs with
+// the RepGroup, returns an Error with Err ErrMissingJob. If opts.Timeout is
+// reached first, returns the summary as of then along with an Error with Err
+// ErrWaitTimeout.
+func (c *Client) WaitForRepGroup(repgroup string, opts *WaitOptions) (*WaitSummary, error) {
+	if opts == nil {
+		opts = &WaitOptions{}
+	}
+	return c.waitFor("WaitForRepGroup", repgroup, opts, func() ([]*Job, error) {
+		// use a limit of 1 so that we get back just 1 Job per state, with
+		// Similar telling us how many more there are
+		if opts.Tree {
+			return c.GetByRepGroupTree(repgroup, 1, "", false, false)
+		}
+		return c.GetByRepGroup(repgroup, 1, "", false, false)
+	})
+}
+
+// WaitForJobs is like WaitForRepGroup(), but waits for the Jobs described by
+// the given JobEssences, eg. those you just Add()ed.
+func (c *Client) WaitForJobs(jes []*JobEssence, opts *WaitOptions) (*WaitSummary, error) {
+	if opts == nil {
+		opts = &WaitOptions{}
+	}
+	return c.waitFor("WaitForJobs", "", opts, func() ([]*Job, error) {
+		return c.GetByEssences(jes)
+	})
+}
+
+// waitFor implements WaitForRepGroup() and WaitForJobs(), repeatedly calling
+// getJobs and summarising the Jobs it returns until they've all finished.
+func (c *Client) waitFor(op string, item string, opts *WaitOptions, getJobs func() ([]*Job, error)) (*WaitSummary, error) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultWaitInterval
+	}
+	var deadline <-chan time.Time
+	if opts.Timeout > 0 {
+		deadline = time.After(opts.Timeout)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		jobs, err := getJobs()
+		if err != nil {
+			return nil, err
+		}
+		summary := summariseWait(jobs)
+		if opts.Progress != nil {
+			opts.Progress(summary)
+		}
+		if summary.Total() == 0 {
+			return summary, Error{op, item, ErrMissingJob}
+		}
+		if summary.Incomplete == 0 {
+			return summary, nil
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-deadline:
+			return summary, Error{op, item, ErrWaitTimeout}
+		}
+	}
+}
+
+// summariseWait creates a WaitSummary from the given Jobs, taking in to
+// account their Similar counts.
+func summariseWait(jobs []*Job) *WaitSummary {
+	summary := &WaitSummary{Counts: make(map[JobState]int)}
+	for _, job := range jobs {
+		count := 1 + job.Similar
+		state := job.State
+		if state == JobStateReserved {
+			state = JobStateRunning
+		}
+		summary.Counts[state] += count
+		switch state {
+		case JobStateComplete:
+			summary.Complete += count
+		case JobStateBuried:
+			summary.Buried += count
+		default:
+			summary.Incomplete += count
+		}
+	}
+	return summary
+}
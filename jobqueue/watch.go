@@ -0,0 +1,246 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the client code for watching a directory and adding jobs
+// for new files that appear in it.
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WatchKeyLabel is the label that Watch() gives the Jobs it adds, with a value
+// of the IdempotencyKey() of the file the Job was added for.
+const WatchKeyLabel = "wr_watch_key"
+
+// defaultWatchInterval is used when WatchOptions.Interval is not set.
+const defaultWatchInterval = 1 * time.Minute
+
+// WatchedFile describes a file found by Watch().
+type WatchedFile struct {
+	// Path is the path to the file, substituted in to Job templates.
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// IdempotencyKey returns a key that is the same for the same file as long as
+// it is not modified.
+func (f *WatchedFile) IdempotencyKey() string {
+	return byteKey([]byte(fmt.Sprintf("%s\t%d\t%d", f.Path, f.Size, f.ModTime.UnixNano())))
+}
+
+// WatchOptions configure Watch().
+type WatchOptions struct {
+	// Dir is the directory to watch. To watch an S3 prefix, supply List
+	// instead.
+	Dir string
+
+	// Pattern is a path.Match() pattern that the base names of files must
+	// match. Blank matches everything.
+	Pattern string
+
+	// Recursive, if true, also watches sub-directories of Dir.
+	Recursive bool
+
+	// Template is the Job to add for each new file. In its Cmd, Cwd and
+	// RepGroup, "{path}" is replaced with the WatchedFile's Path, "{name}" with
+	// its base name, "{stem}" with its base name minus extension, and "{dir}"
+	// with its directory.
+	Template *Job
+
+	// Env is the environment the Jobs will run in, as per Add().
+	Env []string
+
+	// Rerun, if true, adds Jobs even if identical Jobs have already completed
+	// (eg. because a file was replaced with a new version of itself).
+	Rerun bool
+
+	// Interval is how often to look for new files. Defaults to 1m.
+	Interval time.Duration
+
+	// Seen holds the IdempotencyKey()s of files that Jobs have already been
+	// added for, and that should therefore be ignored. It is updated as Jobs
+	// are added, so you can persist it between calls to Watch(). Created if
+	// nil.
+	Seen map[string]bool
+
+	// Added, if set, is called for each file a Job is added for, with added
+	// false if the Job already existed.
+	Added func(file *WatchedFile, job *Job, added bool)
+
+	// List, if set, is used to find files instead of looking in Dir. It should
+	// return all current files; Pattern and Recursive are not applied.
+	List func() ([]*WatchedFile, error)
+}
+
+// Watch looks for files in WatchOptions.Dir every WatchOptions.Interval, and
+// adds a Job based on WatchOptions.Template for each new one it finds. Files
+// are only considered once they have been seen with the same size and
+// modification time twice in a row, so that we don't act on files that are
+// still being written.
+//
+// Jobs are only added once per file (see WatchedFile.IdempotencyKey()), and are
+// labelled with WatchKeyLabel. Even without WatchOptions.Seen, Jobs identical
+// to ones that already exist (and have completed, unless WatchOptions.Rerun)
+// are not added again.
+//
+// Watch keeps going until the stop channel is closed, or an error occurs.
+func (c *Client) Watch(opts *WatchOptions, stop <-chan struct{}) error {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	if opts.Seen == nil {
+		opts.Seen = make(map[string]bool)
+	}
+
+	pending := make(map[string]string)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := c.watchPoll(opts, pending)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// watchPoll does one round of Watch(): finds the current files, and adds Jobs
+// for those that are new and unchanged since the last round. pending holds
+// the IdempotencyKey()s of the last round's files, keyed on path, and is
+// updated.
+func (c *Client) watchPoll(opts *WatchOptions, pending map[string]string) error {
+	var files []*WatchedFile
+	var err error
+	if opts.List != nil {
+		files, err = opts.List()
+	} else {
+		files, err = ListWatchedFiles(opts.Dir, opts.Pattern, opts.Recursive)
+	}
+	if err != nil {
+		return err
+	}
+
+	var ready []*WatchedFile
+	current := make(map[string]bool, len(files))
+	for _, file := range files {
+		current[file.Path] = true
+		key := file.IdempotencyKey()
+		if opts.Seen[key] {
+			continue
+		}
+		if pending[file.Path] == key {
+			ready = append(ready, file)
+		}
+		pending[file.Path] = key
+	}
+	for p := range pending {
+		if !current[p] {
+			delete(pending, p)
+		}
+	}
+
+	for _, file := range ready {
+		job := watchJob(opts.Template, file)
+		added, _, err := c.Add([]*Job{job}, opts.Env, opts.Rerun)
+		if err != nil {
+			return err
+		}
+		key := file.IdempotencyKey()
+		opts.Seen[key] = true
+		delete(pending, file.Path)
+		if opts.Added != nil {
+			opts.Added(file, job, added == 1)
+		}
+	}
+	return nil
+}
+
+// watchJob returns a copy of the template Job with the placeholders described
+// in WatchOptions.Template filled in for the given file, labelled with the
+// file's IdempotencyKey().
+func watchJob(template *Job, file *WatchedFile) *Job {
+	name := path.Base(file.Path)
+	replacer := strings.NewReplacer(
+		"{path}", file.Path,
+		"{name}", name,
+		"{stem}", strings.TrimSuffix(name, path.Ext(name)),
+		"{dir}", path.Dir(file.Path),
+	)
+
+	job := template.specCopy()
+	job.Cmd = replacer.Replace(job.Cmd)
+	job.Cwd = replacer.Replace(job.Cwd)
+	job.RepGroup = replacer.Replace(job.RepGroup)
+	if job.Labels == nil {
+		job.Labels = make(map[string]string)
+	}
+	job.Labels[WatchKeyLabel] = file.IdempotencyKey()
+	return job
+}
+
+// ListWatchedFiles returns the regular files in dir (and its sub-directories if
+// recursive) with base names matching pattern, in lexical order. It is what
+// Watch() uses when WatchOptions.List is not set.
+func ListWatchedFiles(dir, pattern string, recursive bool) ([]*WatchedFile, error) {
+	var files []*WatchedFile
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p != dir && os.IsNotExist(err) {
+				// deleted while we were walking
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if pattern != "" {
+			matched, errm := path.Match(pattern, info.Name())
+			if errm != nil {
+				return errm
+			}
+			if !matched {
+				return nil
+			}
+		}
+		files = append(files, &WatchedFile{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,82 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the encodings clients and the server can use for the
+// messages they send each other.
+
+import (
+	"github.com/ugorji/go/codec"
+)
+
+// WireCodec names an encoding of the messages sent between clients and the
+// server.
+type WireCodec string
+
+// WireCodec* constants are the encodings the server understands. Binc is the
+// most compact and is what everything used before codecs could be negotiated;
+// msgpack and JSON are standard formats, so traffic can be inspected with
+// normal tools and third-party clients are easier to write.
+const (
+	WireCodecBinc    WireCodec = "binc"
+	WireCodecMsgpack WireCodec = "msgpack"
+	WireCodecJSON    WireCodec = "json"
+)
+
+// ClientWireCodec is the encoding that Connect() asks the server to use for all
+// messages after the initial ping. If the server doesn't support it (eg. it is
+// an older version), the client silently carries on using binc.
+var ClientWireCodec = WireCodecBinc
+
+// wireHandles are the configured codec handles for each WireCodec. Handles are
+// safe to share once configured.
+var wireHandles = map[WireCodec]codec.Handle{
+	WireCodecBinc:    new(codec.BincHandle),
+	WireCodecMsgpack: &codec.MsgpackHandle{WriteExt: true},
+	WireCodecJSON:    new(codec.JsonHandle),
+}
+
+// wireHandle returns the codec handle for the given WireCodec, and a boolean
+// indicating if the WireCodec was known; unknown codecs get binc.
+func wireHandle(wc WireCodec) (codec.Handle, bool) {
+	if h, known := wireHandles[wc]; known {
+		return h, true
+	}
+	return wireHandles[WireCodecBinc], false
+}
+
+// sniffWireCodec works out which WireCodec was used to encode the given
+// message. We can tell from the first byte because every message is an encoded
+// struct, and each codec uses distinct bytes to start a map: binc uses 0xb0 to
+// 0xbf, msgpack uses 0x80 to 0x8f, 0xde or 0xdf, and JSON uses '{', possibly
+// after some whitespace.
+func sniffWireCodec(body []byte) WireCodec {
+	for _, b := range body {
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+			continue
+		case b == '{':
+			return WireCodecJSON
+		case b&0xf0 == 0x80 || b == 0xde || b == 0xdf:
+			return WireCodecMsgpack
+		}
+		break
+	}
+	return WireCodecBinc
+}
@@ -0,0 +1,118 @@
+// Copyright © 2018 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+// This file contains the code for reporting on the internal structures of a
+// Queue, for debugging purposes.
+
+import (
+	"sort"
+	"time"
+)
+
+// Internals holds details of the Queue's internal structures, to help debug
+// items that seem to be stuck.
+type Internals struct {
+	Stats
+
+	// ReadyGroups are the number of items in the ready sub-queue per
+	// ReserveGroup.
+	ReadyGroups map[string]int
+
+	// Held is the number of items in the ready sub-queue that the
+	// ReserveFilter is currently holding back.
+	Held int
+
+	// Dependencies is the total number of unresolved dependencies of the items
+	// in the dependent sub-queue, while Depended is the number of keys that
+	// items are waiting on.
+	Dependencies int
+	Depended     int
+
+	// NextDelays are the items in the delay sub-queue that will become ready
+	// soonest, and NextTTRs are the items in the run sub-queue that will hit
+	// their TTR soonest.
+	NextDelays []*ItemTimer
+	NextTTRs   []*ItemTimer
+
+	// DelayTime and TTRTime are when the Queue next plans to check for delayed
+	// items becoming ready and running items hitting their TTR.
+	DelayTime time.Time
+	TTRTime   time.Time
+}
+
+// ItemTimer describes how long it will be until something happens to an item.
+type ItemTimer struct {
+	Key       string
+	Remaining time.Duration
+}
+
+// Internals returns details of the Queue's internal structures, with the
+// given number of items with the soonest timers in NextDelays and NextTTRs.
+func (queue *Queue) Internals(timers int) *Internals {
+	queue.rlock()
+	defer queue.mutex.RUnlock()
+
+	in := &Internals{
+		Stats: Stats{
+			Items:     len(queue.items),
+			Delayed:   queue.delayQueue.len(),
+			Ready:     queue.readyQueue.len(),
+			Running:   queue.runQueue.len(),
+			Buried:    queue.buryQueue.len(),
+			Dependant: queue.depQueue.len(),
+		},
+		ReadyGroups: make(map[string]int),
+		Held:        len(queue.readyQueue.heldItems()),
+		Depended:    len(queue.dependants),
+		DelayTime:   queue.delayTime,
+		TTRTime:     queue.ttrTime,
+	}
+
+	var delayed, running []*ItemTimer
+	for key, item := range queue.items {
+		item.mutex.RLock()
+		switch item.state {
+		case ItemStateReady:
+			in.ReadyGroups[item.ReserveGroup]++
+		case ItemStateDependent:
+			in.Dependencies += len(item.remainingDeps)
+		case ItemStateDelay:
+			delayed = append(delayed, &ItemTimer{Key: key, Remaining: time.Until(item.readyAt)})
+		case ItemStateRun:
+			running = append(running, &ItemTimer{Key: key, Remaining: time.Until(item.releaseAt)})
+		}
+		item.mutex.RUnlock()
+	}
+	in.NextDelays = soonestTimers(delayed, timers)
+	in.NextTTRs = soonestTimers(running, timers)
+
+	return in
+}
+
+// soonestTimers returns the max ItemTimers with the least Remaining, in order.
+func soonestTimers(its []*ItemTimer, max int) []*ItemTimer {
+	sort.Slice(its, func(i, j int) bool {
+		return its[i].Remaining < its[j].Remaining
+	})
+	if len(its) > max {
+		its = its[:max]
+	}
+	return its
+}
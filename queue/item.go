@@ -45,6 +45,7 @@ const (
 type Item struct {
 	Key           string
 	ReserveGroup  string
+	ShareGroup    string
 	Data          interface{}
 	state         ItemState
 	reserves      uint32
@@ -253,6 +254,16 @@ func (item *Item) switchDelayReady() {
 	item.state = ItemStateReady
 }
 
+// update after we've switched from the delay to the run sub-queue
+func (item *Item) switchDelayRun() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.queueIndexes[0] = -1
+	item.readyAt = time.Time{}
+	item.reserves++
+	item.state = ItemStateRun
+}
+
 // update after we've switched from the delay to the dependent sub-queue
 func (item *Item) switchDelayDependent() {
 	item.mutex.Lock()
@@ -270,6 +281,15 @@ func (item *Item) switchDependentReady() {
 	item.state = ItemStateReady
 }
 
+// update after we've switched from the dependent to the bury sub-queue
+func (item *Item) switchDependentBury() {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	item.queueIndexes[4] = -1
+	item.buries++
+	item.state = ItemStateBury
+}
+
 // update after we've switched from the ready to the run sub-queue
 func (item *Item) switchReadyRun() {
 	item.mutex.Lock()
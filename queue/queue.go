@@ -81,7 +81,9 @@ package queue
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -110,6 +112,7 @@ var (
 	ErrNotReady      = errors.New("not ready")
 	ErrNotRunning    = errors.New("not running")
 	ErrNotBuried     = errors.New("not buried")
+	ErrNotDelayed    = errors.New("not delayed")
 )
 
 // Error records an error and the operation, item and queue that caused it.
@@ -141,6 +144,14 @@ type ChangedCallback func(from, to SubQueue, data []interface{})
 // values will be treated as SubQueueReady).
 type TTRCallback func(data interface{}) SubQueue
 
+// ReserveFilter is used as a callback to decide if an item in the ready
+// sub-queue may be Reserve()d right now, based on that item's data. Items it
+// returns false for are held: they stay in the ready sub-queue, but are not
+// considered by Reserve() (nor included in the data given to your
+// ReadyAddedCallback) until the returned time, or until you Unhold() them if
+// the returned time is zero.
+type ReserveFilter func(data interface{}) (ok bool, holdUntil time.Time)
+
 // defaultTTRCallback is used if the the user never calls SetTTRCallback() and
 // always moves the items to the ready sub-queue.
 var defaultTTRCallback = func(data interface{}) SubQueue {
@@ -151,6 +162,7 @@ var defaultTTRCallback = func(data interface{}) SubQueue {
 // automatically depending on their delay or ttr expiring, or manually by
 // calling certain methods.
 type Queue struct {
+	lockWait               int64 // nanoseconds; first for 64bit alignment
 	Name                   string
 	mutex                  sync.RWMutex
 	items                  map[string]*Item
@@ -175,6 +187,8 @@ type Queue struct {
 	readyAddedCbRecall     bool
 	changedCb              ChangedCallback
 	ttrCb                  TTRCallback
+	reserveFilter          ReserveFilter
+	shareWeights           map[string]int
 }
 
 // Stats holds information about the Queue's state.
@@ -196,6 +210,7 @@ type ItemDef struct {
 	Delay        time.Duration
 	TTR          time.Duration
 	Dependencies []string
+	ShareGroup   string
 }
 
 // New is a helper to create instance of the Queue struct.
@@ -262,7 +277,7 @@ func (queue *Queue) readyAdded() {
 		queue.readyAddedCbMutex.Unlock()
 
 		go func() {
-			queue.mutex.RLock()
+			queue.rlock()
 			var data []interface{}
 			for _, il := range queue.readyQueue.groupedItems {
 				for _, item := range il {
@@ -310,15 +325,103 @@ func (queue *Queue) changed(from, to SubQueue, items []*Item) {
 // return the sub-queue the item should be moved to. If you don't set this, the
 // default will be to move all items to the ready sub-queue.
 func (queue *Queue) SetTTRCallback(callback TTRCallback) {
-	queue.mutex.Lock()
+	queue.lock()
 	defer queue.mutex.Unlock()
 	queue.ttrCb = callback
 }
 
+// SetReserveFilter sets a callback that will be called by Reserve() on the
+// data of the next item in the ready sub-queue. If it returns false, that item
+// is held (see ReserveFilter) and the next one is considered instead. This
+// lets you limit the rate at which certain items get reserved. The callback is
+// called while the queue is locked, so must not call any methods on the queue.
+// Any items held by a previous filter are unheld.
+func (queue *Queue) SetReserveFilter(filter ReserveFilter) {
+	queue.lock()
+	queue.reserveFilter = filter
+	var unheld bool
+	for _, item := range queue.readyQueue.heldItems() {
+		if queue.readyQueue.unhold(item) {
+			unheld = true
+		}
+	}
+	queue.mutex.Unlock()
+	if unheld {
+		queue.readyAdded()
+	}
+}
+
+// Unhold is a thread-safe way to let Reserve() consider items that your
+// ReserveFilter held, without waiting for the time it returned. Keys of items
+// that aren't held are ignored.
+func (queue *Queue) Unhold(keys ...string) {
+	queue.lock()
+	if queue.closed {
+		queue.mutex.Unlock()
+		return
+	}
+	var unheld bool
+	for _, key := range keys {
+		if item, exists := queue.items[key]; exists && queue.readyQueue.unhold(item) {
+			unheld = true
+		}
+	}
+	queue.mutex.Unlock()
+	if unheld {
+		queue.readyAdded()
+	}
+}
+
+// SetShareWeights sets the relative weights of the ShareGroups that items can
+// be added to with AddMany(). When the next item in a ReserveGroup could come
+// from more than one ShareGroup, Reserve() picks the ShareGroup whose next item
+// has the highest priority, and amongst those with equal priority, the one
+// that currently has the fewest items in the run sub-queue relative to its
+// weight. This way items of the same priority from different ShareGroups get
+// reserved in proportion to their weights, regardless of the order they were
+// added in. ShareGroups without a weight have a weight of 1.
+func (queue *Queue) SetShareWeights(weights map[string]int) {
+	queue.lock()
+	defer queue.mutex.Unlock()
+	queue.shareWeights = weights
+}
+
+// shareOrder returns the ShareGroups that have ready items in the given
+// ReserveGroup, in the order we should try to reserve from them: highest
+// priority next item first, then to keep usage of the run sub-queue fair. You
+// must hold the queue's lock when calling this.
+func (queue *Queue) shareOrder(reserveGroup string) []string {
+	shares := queue.readyQueue.shares(reserveGroup)
+	if len(shares) < 2 {
+		return shares
+	}
+
+	priority := make(map[string]uint8, len(shares))
+	usage := make(map[string]float64, len(shares))
+	for _, share := range shares {
+		priority[share] = queue.readyQueue.headPriority(reserveGroup, share)
+		weight := queue.shareWeights[share]
+		if weight < 1 {
+			weight = 1
+		}
+		usage[share] = float64(queue.runQueue.shareCount(share)) / float64(weight)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if priority[shares[i]] != priority[shares[j]] {
+			return priority[shares[i]] > priority[shares[j]]
+		}
+		if usage[shares[i]] == usage[shares[j]] {
+			return shares[i] < shares[j]
+		}
+		return usage[shares[i]] < usage[shares[j]]
+	})
+	return shares
+}
+
 // Destroy shuts down a queue, destroying any contents. You can't do anything
 // useful with it after that.
 func (queue *Queue) Destroy() error {
-	queue.mutex.Lock()
+	queue.lock()
 	defer queue.mutex.Unlock()
 
 	if queue.closed {
@@ -337,10 +440,33 @@ func (queue *Queue) Destroy() error {
 	return nil
 }
 
+// lock gets the write lock on the queue, recording how long we had to wait for
+// it.
+func (queue *Queue) lock() {
+	start := time.Now()
+	queue.mutex.Lock()
+	atomic.AddInt64(&queue.lockWait, int64(time.Since(start)))
+}
+
+// rlock is like lock(), but gets the read lock.
+func (queue *Queue) rlock() {
+	start := time.Now()
+	queue.mutex.RLock()
+	atomic.AddInt64(&queue.lockWait, int64(time.Since(start)))
+}
+
+// LockWait returns the total time that all callers of the queue's methods have
+// spent waiting for other callers to finish, since the queue was created. By
+// comparing the value before and after some operation, you can tell how much
+// lock contention there was while it ran.
+func (queue *Queue) LockWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&queue.lockWait))
+}
+
 // Stats returns information about the number of items in the queue and each
 // sub-queue.
 func (queue *Queue) Stats() *Stats {
-	queue.mutex.RLock()
+	queue.rlock()
 	defer queue.mutex.RUnlock()
 
 	return &Stats{
@@ -367,7 +493,7 @@ func (queue *Queue) Stats() *Stats {
 // these ids get Remove()d from the queue. Add() returns an item, which may have
 // already existed (in which case, nothing was actually added or changed).
 func (queue *Queue) Add(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, deps ...[]string) (*Item, error) {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -448,7 +574,7 @@ func (queue *Queue) itemHasDeps(item *Item) bool {
 // not added because they were duplicates of items already in the queue. If an
 // error occurs, nothing will have been added.
 func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -467,6 +593,7 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 		}
 
 		item := newItem(def.Key, def.ReserveGroup, def.Data, def.Priority, def.Delay, def.TTR)
+		item.ShareGroup = def.ShareGroup
 		queue.items[def.Key] = item
 
 		if len(def.Dependencies) > 0 {
@@ -505,7 +632,7 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 
 // Get is a thread-safe way to get an item by the key you used to Add() it.
 func (queue *Queue) Get(key string) (*Item, error) {
-	queue.mutex.RLock()
+	queue.rlock()
 	defer queue.mutex.RUnlock()
 
 	if queue.closed {
@@ -522,7 +649,7 @@ func (queue *Queue) Get(key string) (*Item, error) {
 // GetRunningData gets all the item.Data of items currently in the run sub-
 // queue.
 func (queue *Queue) GetRunningData() []interface{} {
-	queue.mutex.RLock()
+	queue.rlock()
 	defer queue.mutex.RUnlock()
 	var data []interface{}
 	for _, item := range queue.runQueue.items {
@@ -549,7 +676,7 @@ func (queue *Queue) AllItems() []*Item {
 // item.UnresolvedDependencies()), and then calling item.Stats() to get
 // stats.Priority, stats.Delay and stats.TTR.
 func (queue *Queue) Update(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration, deps ...[]string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -688,7 +815,7 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 
 // SetDelay is a thread-safe way to change the delay of an item.
 func (queue *Queue) SetDelay(key string, delay time.Duration) error {
-	queue.mutex.Lock()
+	queue.lock()
 	if queue.closed {
 		queue.mutex.Unlock()
 		return Error{queue.Name, "SetDelay", key, ErrQueueClosed}
@@ -719,7 +846,7 @@ func (queue *Queue) SetDelay(key string, delay time.Duration) error {
 
 // SetReserveGroup is a thread-safe way to change the ReserveGroup of an item.
 func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
-	queue.mutex.Lock()
+	queue.lock()
 	if queue.closed {
 		queue.mutex.Unlock()
 		return Error{queue.Name, "SetReserveGroup", key, ErrQueueClosed}
@@ -764,7 +891,7 @@ func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 // able to later, you can manually call Release(), which moves it to the delay
 // sub-queue.
 func (queue *Queue) Reserve(reserveGroup ...string) (*Item, error) {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -776,8 +903,15 @@ func (queue *Queue) Reserve(reserveGroup ...string) (*Item, error) {
 		group = reserveGroup[0]
 	}
 
-	// pop an item from the ready queue and add it to the run queue
-	item := queue.readyQueue.pop(group)
+	// pop an item from the ready queue, trying the fairest ShareGroup first,
+	// and add it to the run queue
+	var item *Item
+	for _, share := range queue.shareOrder(group) {
+		item = queue.popReady(group, share)
+		if item != nil {
+			break
+		}
+	}
 	if item == nil {
 		queue.mutex.Unlock()
 		return item, Error{queue.Name, "Reserve", "", ErrNothingReady}
@@ -794,10 +928,75 @@ func (queue *Queue) Reserve(reserveGroup ...string) (*Item, error) {
 	return item, nil
 }
 
+// Adopt is a thread-safe way to switch an item in the delay sub-queue straight
+// to the run sub-queue, as if it had become ready and been Reserve()d. This is
+// for when you delayed an item because you weren't sure if something was
+// already handling it, and it turns out that something is.
+//
+// As with Reserve(), you will need to Touch() the item before its ttr is
+// reached, and Remove(), Release() or Bury() it when you're done.
+func (queue *Queue) Adopt(key string) error {
+	queue.lock()
+
+	if queue.closed {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "Adopt", key, ErrQueueClosed}
+	}
+
+	// check it's actually still in the queue first
+	item, ok := queue.items[key]
+	if !ok {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "Adopt", key, ErrNotFound}
+	}
+
+	// and it must be in the delay queue
+	if ok = item.state == ItemStateDelay; !ok {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "Adopt", key, ErrNotDelayed}
+	}
+
+	// switch from delay to run queue
+	queue.delayQueue.remove(item)
+	item.switchDelayRun()
+	item.touch()
+	queue.runQueue.push(item)
+
+	queue.mutex.Unlock()
+	queue.ttrNotificationTrigger(item)
+	queue.changed(SubQueueDelay, SubQueueRun, []*Item{item})
+
+	return nil
+}
+
+// popReady pops the next item in the given ReserveGroup and ShareGroup from the
+// ready sub-queue, holding any our reserveFilter doesn't want reserved right
+// now. You must hold the queue's lock when calling this.
+func (queue *Queue) popReady(reserveGroup, shareGroup string) *Item {
+	for {
+		item := queue.readyQueue.pop(reserveGroup, shareGroup)
+		if item == nil || queue.reserveFilter == nil {
+			return item
+		}
+
+		ok, until := queue.reserveFilter(item.Data)
+		if ok {
+			return item
+		}
+		queue.readyQueue.hold(item)
+		if !until.IsZero() {
+			key := item.Key
+			time.AfterFunc(time.Until(until), func() {
+				queue.Unhold(key)
+			})
+		}
+	}
+}
+
 // Touch is a thread-safe way to extend the amount of time a Reserve()d item
 // is allowed to run.
 func (queue *Queue) Touch(key string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -830,7 +1029,7 @@ func (queue *Queue) Touch(key string) error {
 // Release is a thread-safe way to switch an item in the run sub-queue to the
 // delay sub-queue, for when the item should be dealt with later, not now.
 func (queue *Queue) Release(key string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -875,7 +1074,7 @@ func (queue *Queue) Release(key string) error {
 // bury sub-queue, for when the item can't be dealt with ever, at least until
 // the user takes some action and changes something.
 func (queue *Queue) Bury(key string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -908,7 +1107,7 @@ func (queue *Queue) Bury(key string) error {
 // Kick is a thread-safe way to switch an item in the bury sub-queue to the
 // ready sub-queue, for when a previously buried item can now be handled.
 func (queue *Queue) Kick(key string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -947,7 +1146,7 @@ func (queue *Queue) Kick(key string) error {
 
 // Remove is a thread-safe way to remove an item from the queue.
 func (queue *Queue) Remove(key string) error {
-	queue.mutex.Lock()
+	queue.lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
@@ -1028,7 +1227,7 @@ func (queue *Queue) Remove(key string) error {
 // you're removing it because it was undesired as opposed to complete, as
 // Remove() always triggers dependent items to become ready.
 func (queue *Queue) HasDependents(key string) (bool, error) {
-	queue.mutex.Lock()
+	queue.lock()
 	defer queue.mutex.Unlock()
 
 	if queue.closed {
@@ -1039,10 +1238,70 @@ func (queue *Queue) HasDependents(key string) (bool, error) {
 	return has, nil
 }
 
+// Dependents returns the items that were added with a dependency on the item
+// with the given key, and which haven't yet been removed.
+func (queue *Queue) Dependents(key string) []*Item {
+	queue.rlock()
+	defer queue.mutex.RUnlock()
+
+	deps := queue.dependants[key]
+	items := make([]*Item, 0, len(deps))
+	for _, item := range deps {
+		items = append(items, item)
+	}
+	return items
+}
+
+// BuryDependents is a thread-safe way to switch all the items in the dependent
+// sub-queue that depend on the item with the given key, directly or
+// indirectly, to the bury sub-queue, for when the given item will not complete
+// without intervention. Kick()ing them later puts them back in the dependent
+// sub-queue. Returns the keys of the items that were buried.
+func (queue *Queue) BuryDependents(key string) ([]string, error) {
+	queue.lock()
+
+	if queue.closed {
+		queue.mutex.Unlock()
+		return nil, Error{queue.Name, "BuryDependents", key, ErrQueueClosed}
+	}
+
+	var buried []*Item
+	seen := map[string]bool{key: true}
+	parents := []string{key}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		for _, dep := range queue.dependants[parent] {
+			if seen[dep.Key] {
+				continue
+			}
+			seen[dep.Key] = true
+			parents = append(parents, dep.Key)
+			if dep.state != ItemStateDependent {
+				continue
+			}
+			queue.depQueue.remove(dep)
+			queue.buryQueue.push(dep)
+			dep.switchDependentBury()
+			buried = append(buried, dep)
+		}
+	}
+	queue.mutex.Unlock()
+
+	keys := make([]string, len(buried))
+	for i, item := range buried {
+		keys[i] = item.Key
+	}
+	if len(buried) > 0 {
+		queue.changed(SubQueueDependent, SubQueueBury, buried)
+	}
+	return keys, nil
+}
+
 func (queue *Queue) startDelayProcessing() {
 	sendStarted := true
 	for {
-		queue.mutex.Lock()
+		queue.lock()
 		var sleepTime time.Duration
 		if queue.delayQueue.len() > 0 {
 			sleepTime = time.Until(queue.delayQueue.firstItem().ReadyAt())
@@ -1058,7 +1317,7 @@ func (queue *Queue) startDelayProcessing() {
 
 		select {
 		case <-time.After(time.Until(queue.delayTime)):
-			queue.mutex.Lock()
+			queue.lock()
 			len := queue.delayQueue.len()
 			addedReady := false
 			var items []*Item
@@ -1093,7 +1352,7 @@ func (queue *Queue) startDelayProcessing() {
 }
 
 func (queue *Queue) delayNotificationTrigger(item *Item) {
-	queue.mutex.RLock()
+	queue.rlock()
 	if queue.delayTime.After(time.Now().Add(item.delay)) {
 		queue.mutex.RUnlock()
 		queue.delayNotification <- true
@@ -1107,7 +1366,7 @@ func (queue *Queue) startTTRProcessing() {
 	sendStarted := true
 	for {
 		var sleepTime time.Duration
-		queue.mutex.Lock()
+		queue.lock()
 		if queue.runQueue.len() > 0 {
 			sleepTime = time.Until(queue.runQueue.firstItem().ReleaseAt())
 		} else {
@@ -1122,7 +1381,7 @@ func (queue *Queue) startTTRProcessing() {
 
 		select {
 		case <-time.After(time.Until(queue.ttrTime)):
-			queue.mutex.Lock()
+			queue.lock()
 			length := queue.runQueue.len()
 			var delayedItems, buriedItems, readyItems []*Item
 			for i := 0; i < length; i++ {
@@ -1185,7 +1444,7 @@ func (queue *Queue) startTTRProcessing() {
 }
 
 func (queue *Queue) ttrNotificationTrigger(item *Item) {
-	queue.mutex.RLock()
+	queue.rlock()
 	if queue.ttrTime.After(time.Now().Add(item.ttr)) {
 		queue.mutex.RUnlock()
 		queue.ttrNotification <- true
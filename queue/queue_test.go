@@ -230,6 +230,39 @@ func TestQueue(t *testing.T) {
 			So(item.creation, ShouldHappenOnOrBefore, items["key_0"].creation)
 		})
 
+		Convey("Delayed items can be adopted straight in to the run queue", func() {
+			prepareToCheckChanged()
+			err := queue.Adopt("key_9")
+			So(err, ShouldBeNil)
+			So(checkChanged(SubQueueDelay, SubQueueRun, 1), ShouldBeTrue)
+
+			stats = queue.Stats()
+			So(stats.Delayed, ShouldEqual, 9)
+			So(stats.Running, ShouldEqual, 1)
+			item, err := queue.Get("key_9")
+			So(err, ShouldBeNil)
+			So(item.Stats().State, ShouldEqual, ItemStateRun)
+			So(item.Stats().Reserves, ShouldEqual, 1)
+
+			err = queue.Touch("key_9")
+			So(err, ShouldBeNil)
+			err = queue.Release("key_9")
+			So(err, ShouldBeNil)
+
+			err = queue.Adopt("key_fake")
+			So(err, ShouldNotBeNil)
+			qerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(qerr.Err, ShouldEqual, ErrNotFound)
+
+			<-time.After(110 * time.Millisecond)
+			err = queue.Adopt("key_0")
+			So(err, ShouldNotBeNil)
+			qerr, ok = err.(Error)
+			So(ok, ShouldBeTrue)
+			So(qerr.Err, ShouldEqual, ErrNotDelayed)
+		})
+
 		Convey("They should start delayed and gradually become ready", func() {
 			<-time.After(110 * time.Millisecond)
 			stats = queue.Stats()
@@ -955,6 +988,95 @@ func TestQueue(t *testing.T) {
 			So(err, ShouldNotBeNil)
 			So(item, ShouldBeNil)
 		})
+
+		Convey("You can stop some items being reserved with SetReserveFilter()", func() {
+			queue.SetReserveFilter(func(data interface{}) (bool, time.Time) {
+				return data.(*testdata).ID%2 == 0, time.Time{}
+			})
+
+			for i := 0; i < 10; i++ {
+				item, err := queue.Reserve()
+				So(err, ShouldBeNil)
+				So(item, ShouldNotBeNil)
+				So(item.Data.(*testdata).ID%2, ShouldEqual, 0)
+			}
+			stats := queue.Stats()
+			So(stats.Running, ShouldEqual, 10)
+			So(stats.Ready, ShouldEqual, 990)
+
+			queue.SetReserveFilter(func(data interface{}) (bool, time.Time) {
+				return false, time.Time{}
+			})
+			item, err := queue.Reserve()
+			So(err, ShouldNotBeNil)
+			So(item, ShouldBeNil)
+			qerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(qerr.Err, ShouldEqual, ErrNothingReady)
+			stats = queue.Stats()
+			So(stats.Ready, ShouldEqual, 990)
+			So(queue.Internals(0).Held, ShouldEqual, 990)
+
+			queue.SetReserveFilter(nil)
+			So(queue.Internals(0).Held, ShouldEqual, 0)
+			item, err = queue.Reserve()
+			So(err, ShouldBeNil)
+			So(item, ShouldNotBeNil)
+		})
+
+		Convey("Items held by SetReserveFilter() can be unheld", func() {
+			var readyData []interface{}
+			var readyMutex sync.Mutex
+			queue.SetReadyAddedCallback(func(queuename string, allitemdata []interface{}) {
+				readyMutex.Lock()
+				readyData = allitemdata
+				readyMutex.Unlock()
+			})
+
+			timed, err := queue.Get("key_0")
+			So(err, ShouldBeNil)
+			allow := false
+			queue.SetReserveFilter(func(data interface{}) (bool, time.Time) {
+				if allow {
+					return true, time.Time{}
+				}
+				if data == timed.Data {
+					return false, time.Now().Add(50 * time.Millisecond)
+				}
+				return false, time.Time{}
+			})
+			_, err = queue.Reserve()
+			So(err, ShouldNotBeNil)
+			So(queue.Internals(0).Held, ShouldEqual, 1000)
+
+			queue.TriggerReadyAddedCallback()
+			<-time.After(10 * time.Millisecond)
+			readyMutex.Lock()
+			So(len(readyData), ShouldEqual, 0)
+			readyMutex.Unlock()
+
+			queue.Unhold("key_1", "key_2", "not_a_key")
+			So(queue.Internals(0).Held, ShouldEqual, 998)
+			<-time.After(10 * time.Millisecond)
+			readyMutex.Lock()
+			So(len(readyData), ShouldEqual, 2)
+			readyMutex.Unlock()
+
+			<-time.After(60 * time.Millisecond)
+			So(queue.Internals(0).Held, ShouldEqual, 997)
+
+			allow = true
+			item, err := queue.Reserve()
+			So(err, ShouldBeNil)
+			So(item, ShouldNotBeNil)
+			So(item.Key, ShouldBeIn, []string{"key_0", "key_1", "key_2"})
+
+			err = queue.Remove("key_3")
+			So(err, ShouldBeNil)
+			stats := queue.Stats()
+			So(stats.Ready, ShouldEqual, 998)
+			So(queue.Internals(0).Held, ShouldEqual, 996)
+		})
 	})
 
 	Convey("Once a thousand items with no delay and differing ReserveGroups have been added to the queue", t, func() {
@@ -1124,6 +1246,93 @@ func TestQueue(t *testing.T) {
 		})
 	})
 
+	Convey("Once items in different ShareGroups have been added to the queue", t, func() {
+		queue := New("share queue")
+		defer queue.Destroy()
+		var itemdefs []*ItemDef
+		for _, share := range []string{"a", "b"} {
+			for i := 0; i < 10; i++ {
+				itemdefs = append(itemdefs, &ItemDef{
+					Key:          fmt.Sprintf("%s_%d", share, i),
+					ReserveGroup: "group",
+					ShareGroup:   share,
+					Data:         share,
+					TTR:          1 * time.Minute,
+				})
+			}
+		}
+		added, _, err := queue.AddMany(itemdefs)
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 20)
+		So(queue.Stats().Ready, ShouldEqual, 20)
+		So(queue.readyQueue.len("group"), ShouldEqual, 20)
+
+		reserveCounts := func(n int) map[string]int {
+			counts := make(map[string]int)
+			for i := 0; i < n; i++ {
+				item, err := queue.Reserve("group")
+				So(err, ShouldBeNil)
+				So(item, ShouldNotBeNil)
+				counts[item.Data.(string)]++
+			}
+			return counts
+		}
+
+		Convey("Reserve() takes turns between them", func() {
+			counts := reserveCounts(6)
+			So(counts["a"], ShouldEqual, 3)
+			So(counts["b"], ShouldEqual, 3)
+
+			Convey("Until one runs out", func() {
+				counts = reserveCounts(14)
+				So(counts["a"], ShouldEqual, 7)
+				So(counts["b"], ShouldEqual, 7)
+				_, err = queue.Reserve("group")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Reserve() obeys SetShareWeights()", func() {
+			queue.SetShareWeights(map[string]int{"b": 3})
+			counts := reserveCounts(8)
+			So(counts["a"], ShouldEqual, 2)
+			So(counts["b"], ShouldEqual, 6)
+		})
+
+		Convey("Higher priority items are reserved first, even from busier ShareGroups", func() {
+			counts := reserveCounts(4)
+			So(counts["a"], ShouldEqual, 2)
+			So(counts["b"], ShouldEqual, 2)
+
+			_, _, err = queue.AddMany([]*ItemDef{
+				{Key: "a_urgent", ReserveGroup: "group", ShareGroup: "a", Data: "a", Priority: 255, TTR: 1 * time.Minute},
+				{Key: "c_0", ReserveGroup: "group", ShareGroup: "c", Data: "c", TTR: 1 * time.Minute},
+			})
+			So(err, ShouldBeNil)
+
+			item, err := queue.Reserve("group")
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "a_urgent")
+			item, err = queue.Reserve("group")
+			So(err, ShouldBeNil)
+			So(item.Key, ShouldEqual, "c_0")
+		})
+
+		Convey("Releasing items makes their ShareGroup's turn come sooner", func() {
+			item, err := queue.Reserve("group")
+			So(err, ShouldBeNil)
+			So(item.Data, ShouldEqual, "a")
+			item, err = queue.Reserve("group")
+			So(err, ShouldBeNil)
+			So(item.Data, ShouldEqual, "b")
+			err = queue.Remove(item.Key)
+			So(err, ShouldBeNil)
+			item, err = queue.Reserve("group")
+			So(err, ShouldBeNil)
+			So(item.Data, ShouldEqual, "b")
+		})
+	})
+
 	Convey("Once some items with dependencies have been added to the queue", t, func() {
 		// https://i-msdn.sec.s-msft.com/dynimg/IC332764.gif
 		queue := New("dep queue")
@@ -1167,6 +1376,27 @@ func TestQueue(t *testing.T) {
 			So(hasDeps, ShouldBeFalse)
 		})
 
+		Convey("BuryDependents() buries the direct and indirect dependents", func() {
+			So(len(queue.Dependents("key_1")), ShouldEqual, 2)
+			So(len(queue.Dependents("key_8")), ShouldEqual, 0)
+
+			buried, err := queue.BuryDependents("key_1")
+			So(err, ShouldBeNil)
+			sort.Strings(buried)
+			So(buried, ShouldResemble, []string{"key_4", "key_5", "key_6", "key_7", "key_8"})
+			So(queue.Stats().Buried, ShouldEqual, 5)
+
+			err = queue.Kick("key_7")
+			So(err, ShouldBeNil)
+			seven, err := queue.Get("key_7")
+			So(err, ShouldBeNil)
+			So(seven.Stats().State, ShouldEqual, ItemStateDependent)
+
+			buried, err = queue.BuryDependents("key_2")
+			So(err, ShouldBeNil)
+			So(buried, ShouldResemble, []string{"key_7"})
+		})
+
 		Convey("You can update dependencies", func() {
 			four, err := queue.Get("key_4")
 			So(err, ShouldBeNil)
@@ -1322,12 +1552,42 @@ func TestQueue(t *testing.T) {
 			Data: "2",
 			TTR:  30 * time.Second,
 		})
-		itemdefs = append(itemdefs, &ItemDef{"key_3", "", "3", 0, 0 * time.Second, 30 * time.Second, []string{}})
-		itemdefs = append(itemdefs, &ItemDef{"key_4", "", "4", 0, 0 * time.Second, 30 * time.Second, []string{"key_1"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_5", "", "5", 0, 0 * time.Second, 30 * time.Second, []string{"key_2", "key_3"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_6", "", "6", 0, 0 * time.Second, 30 * time.Second, []string{"key_3", "key_4"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_7", "", "7", 0, 0 * time.Second, 30 * time.Second, []string{"key_5", "key_6"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_8", "", "8", 0, 0 * time.Second, 30 * time.Second, []string{"key_5"}})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_3",
+			Data:         "3",
+			TTR:          30 * time.Second,
+			Dependencies: []string{},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_4",
+			Data:         "4",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_1"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_5",
+			Data:         "5",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_2", "key_3"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_6",
+			Data:         "6",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_3", "key_4"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_7",
+			Data:         "7",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_5", "key_6"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_8",
+			Data:         "8",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_5"},
+		})
 
 		added, dups, err := queue.AddMany(itemdefs)
 		So(err, ShouldBeNil)
@@ -1384,6 +1644,61 @@ func TestQueue(t *testing.T) {
 		So(added[1], ShouldEqual, 10)
 		callBackLock.RUnlock()
 	})
+
+	Convey("LockWait() reports how long callers waited for the queue lock", t, func() {
+		queue := New("myqueue")
+		defer queue.Destroy()
+		before := queue.LockWait()
+
+		queue.lock()
+		go func() {
+			<-time.After(50 * time.Millisecond)
+			queue.mutex.Unlock()
+		}()
+		queue.Stats()
+
+		So(queue.LockWait()-before, ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+	})
+
+	Convey("Internals() reports on the queue's internal structures", t, func() {
+		queue := New("myqueue")
+		defer queue.Destroy()
+		_, err := queue.Add("delayed1", "", "data", 0, 1*time.Hour, 1*time.Minute)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("delayed2", "", "data", 0, 2*time.Hour, 1*time.Minute)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("ready1", "g", "data", 0, 0*time.Second, 30*time.Second)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("ready2", "g", "data", 0, 0*time.Second, 30*time.Second)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("ready3", "", "data", 0, 0*time.Second, 30*time.Second)
+		So(err, ShouldBeNil)
+		_, err = queue.Add("dep", "", "data", 0, 0*time.Second, 30*time.Second, []string{"ready2", "ready3"})
+		So(err, ShouldBeNil)
+		item, err := queue.Reserve("g")
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldEqual, "ready1")
+
+		in := queue.Internals(1)
+		So(in.Items, ShouldEqual, 6)
+		So(in.Delayed, ShouldEqual, 2)
+		So(in.Ready, ShouldEqual, 2)
+		So(in.Running, ShouldEqual, 1)
+		So(in.Dependant, ShouldEqual, 1)
+		So(in.ReadyGroups, ShouldResemble, map[string]int{"g": 1, "": 1})
+		So(in.Dependencies, ShouldEqual, 2)
+		So(in.Depended, ShouldEqual, 2)
+		So(len(in.NextDelays), ShouldEqual, 1)
+		So(in.NextDelays[0].Key, ShouldEqual, "delayed1")
+		So(in.NextDelays[0].Remaining, ShouldBeBetween, 59*time.Minute, 1*time.Hour)
+		So(len(in.NextTTRs), ShouldEqual, 1)
+		So(in.NextTTRs[0].Key, ShouldEqual, "ready1")
+		So(in.NextTTRs[0].Remaining, ShouldBeBetween, 29*time.Second, 30*time.Second)
+
+		in = queue.Internals(5)
+		So(len(in.NextDelays), ShouldEqual, 2)
+		So(in.NextDelays[1].Key, ShouldEqual, "delayed2")
+	})
 }
 
 func depTestFunc(queue *Queue) {
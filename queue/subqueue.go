@@ -26,21 +26,38 @@ import (
 	"sync"
 )
 
+// shareGroupSeparator separates the ReserveGroup and ShareGroup of items in the
+// keys of subQueue.groupedItems.
+const shareGroupSeparator = "\x00"
+
 type subQueue struct {
 	mutex        sync.RWMutex
 	items        []*Item
 	groupedItems map[string][]*Item
+	groupShares  map[string]map[string]int
+	shareCounts  map[string]int
+	held         map[*Item]bool
 	sqIndex      int
 	reserveGroup string
 }
 
+// groupKey returns the key of groupedItems that items with the given
+// ReserveGroup and ShareGroup are stored under.
+func groupKey(reserveGroup, shareGroup string) string {
+	if shareGroup == "" {
+		return reserveGroup
+	}
+	return reserveGroup + shareGroupSeparator + shareGroup
+}
+
 // create a new subQueue that can hold *Items in "priority" order. sqIndex is
 // one of 0 (priority is based on the item's delay), 1 (priority is based on the
 // item's priority or creation) or 2 (priority is based on the item's ttr).
 func newSubQueue(sqIndex int) *subQueue {
-	queue := &subQueue{sqIndex: sqIndex}
+	queue := &subQueue{sqIndex: sqIndex, shareCounts: make(map[string]int)}
 	if sqIndex == 1 {
 		queue.groupedItems = make(map[string][]*Item)
+		queue.groupShares = make(map[string]map[string]int)
 	}
 	heap.Init(queue)
 	return queue
@@ -51,43 +68,151 @@ func (q *subQueue) push(item *Item) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
-		q.reserveGroup = item.ReserveGroup
+		q.reserveGroup = groupKey(item.ReserveGroup, item.ShareGroup)
 	}
 	heap.Push(q, item)
+	q.count(item, item.ReserveGroup, 1)
 }
 
-// pop removes the next item from the queue according to its "priority"
+// count keeps track of how many items we hold in each ShareGroup, and for the
+// ready queue, which ShareGroups each ReserveGroup has items in.
+func (q *subQueue) count(item *Item, reserveGroup string, delta int) {
+	q.shareCounts[item.ShareGroup] += delta
+	if q.shareCounts[item.ShareGroup] <= 0 {
+		delete(q.shareCounts, item.ShareGroup)
+	}
+	if q.sqIndex != 1 {
+		return
+	}
+	shares, existed := q.groupShares[reserveGroup]
+	if !existed {
+		shares = make(map[string]int)
+		q.groupShares[reserveGroup] = shares
+	}
+	shares[item.ShareGroup] += delta
+	if shares[item.ShareGroup] <= 0 {
+		delete(shares, item.ShareGroup)
+		if len(shares) == 0 {
+			delete(q.groupShares, reserveGroup)
+		}
+	}
+}
+
+// shares returns the ShareGroups of the items in the given ReserveGroup.
+func (q *subQueue) shares(reserveGroup string) []string {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	var shares []string
+	for share := range q.groupShares[reserveGroup] {
+		shares = append(shares, share)
+	}
+	return shares
+}
+
+// shareCount tells you how many items in the given ShareGroup are in the
+// queue.
+func (q *subQueue) shareCount(shareGroup string) int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return q.shareCounts[shareGroup]
+}
+
+// headPriority returns the priority of the item that pop() would return for
+// the given ReserveGroup and ShareGroup of the ready queue, or 0 if there are
+// no such items.
+func (q *subQueue) headPriority(reserveGroup, shareGroup string) uint8 {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	itemList := q.groupedItems[groupKey(reserveGroup, shareGroup)]
+	if len(itemList) == 0 {
+		return 0
+	}
+	return itemList[0].priority
+}
+
+// pop removes the next item from the queue according to its "priority". For
+// the ready queue, you can supply a ShareGroup after the ReserveGroup to only
+// consider items in that ShareGroup.
 func (q *subQueue) pop(reserveGroup ...string) *Item {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 	var itemList []*Item
+	var group string
 	if q.sqIndex == 1 {
-		var group string
-		if len(reserveGroup) == 1 {
+		var share string
+		if len(reserveGroup) > 0 {
 			group = reserveGroup[0]
 		}
+		if len(reserveGroup) > 1 {
+			share = reserveGroup[1]
+		}
 		var existed bool
-		if itemList, existed = q.groupedItems[group]; !existed {
+		if itemList, existed = q.groupedItems[groupKey(group, share)]; !existed {
 			return nil
 		}
-		q.reserveGroup = group
+		q.reserveGroup = groupKey(group, share)
 	} else {
 		itemList = q.items
 	}
 	if len(itemList) == 0 {
 		return nil
 	}
-	return heap.Pop(q).(*Item)
+	item := heap.Pop(q).(*Item)
+	q.count(item, group, -1)
+	return item
+}
+
+// hold sets aside an item that was just pop()ed from the ready queue, so that
+// it won't be pop()ed again until it is unhold()ed. Held items still count
+// towards len() and can be remove()d as normal.
+func (q *subQueue) hold(item *Item) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.held == nil {
+		q.held = make(map[*Item]bool)
+	}
+	q.held[item] = true
+}
+
+// unhold puts a held item back in to the ready queue, returning false if it
+// wasn't held.
+func (q *subQueue) unhold(item *Item) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if !q.held[item] {
+		return false
+	}
+	delete(q.held, item)
+	q.reserveGroup = groupKey(item.ReserveGroup, item.ShareGroup)
+	heap.Push(q, item)
+	q.count(item, item.ReserveGroup, 1)
+	return true
+}
+
+// heldItems returns the items that are currently held.
+func (q *subQueue) heldItems() []*Item {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	items := make([]*Item, 0, len(q.held))
+	for item := range q.held {
+		items = append(items, item)
+	}
+	return items
 }
 
 // remove removes a given item from the queue
 func (q *subQueue) remove(item *Item) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	if q.held[item] {
+		delete(q.held, item)
+		return
+	}
 	if q.sqIndex == 1 {
-		q.reserveGroup = item.ReserveGroup
+		q.reserveGroup = groupKey(item.ReserveGroup, item.ShareGroup)
 	}
 	heap.Remove(q, item.queueIndexes[q.sqIndex])
+	q.count(item, item.ReserveGroup, -1)
 }
 
 // len tells you how many items are in the queue
@@ -97,13 +222,18 @@ func (q *subQueue) len(reserveGroup ...string) int {
 	var itemList []*Item
 	if q.sqIndex == 1 {
 		if len(reserveGroup) == 1 {
-			group := reserveGroup[0]
-			var existed bool
-			if itemList, existed = q.groupedItems[group]; !existed {
-				return 0
+			num := 0
+			for share := range q.groupShares[reserveGroup[0]] {
+				num += len(q.groupedItems[groupKey(reserveGroup[0], share)])
 			}
+			for item := range q.held {
+				if item.ReserveGroup == reserveGroup[0] {
+					num++
+				}
+			}
+			return num
 		} else {
-			num := 0
+			num := len(q.held)
 			for _, il := range q.groupedItems {
 				num += len(il)
 			}
@@ -129,13 +259,22 @@ func (q *subQueue) firstItem() *Item {
 func (q *subQueue) update(item *Item, oldGroup ...string) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	if q.held[item] {
+		// it will be put in the right place when unheld
+		return
+	}
 	if q.sqIndex == 1 && len(oldGroup) == 1 && oldGroup[0] != item.ReserveGroup {
-		q.reserveGroup = oldGroup[0]
+		q.reserveGroup = groupKey(oldGroup[0], item.ShareGroup)
 		heap.Remove(q, item.queueIndexes[q.sqIndex])
-		q.reserveGroup = item.ReserveGroup
+		q.count(item, oldGroup[0], -1)
+		q.reserveGroup = groupKey(item.ReserveGroup, item.ShareGroup)
 		heap.Push(q, item)
+		q.count(item, item.ReserveGroup, 1)
 		return
 	}
+	if q.sqIndex == 1 {
+		q.reserveGroup = groupKey(item.ReserveGroup, item.ShareGroup)
+	}
 	heap.Fix(q, item.queueIndexes[q.sqIndex])
 }
 
@@ -145,9 +284,12 @@ func (q *subQueue) empty() {
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
 		q.groupedItems = make(map[string][]*Item)
+		q.groupShares = make(map[string]map[string]int)
 	} else {
 		q.items = nil
 	}
+	q.shareCounts = make(map[string]int)
+	q.held = nil
 }
 
 // the following functions are required for the heap implementation, and though